@@ -314,7 +314,7 @@ export const testUpstream = config => async (dispatch) => {
 
         const upstreamResponse = await apiClient.testUpstream(values);
         const testMessages = Object.keys(upstreamResponse).map((key) => {
-            const message = upstreamResponse[key];
+            const message = upstreamResponse[key].status;
             if (message !== 'OK') {
                 dispatch(addErrorToast({ error: t('dns_test_not_ok_toast', { key }) }));
             }
@@ -88,7 +88,10 @@ class App extends Component {
                         </Fragment>
                     )}
                     {!encryption.processing && (
-                        <EncryptionTopline notAfter={encryption.not_after} />
+                        <EncryptionTopline
+                            notAfter={encryption.not_after}
+                            expiresSoon={encryption.expires_soon}
+                        />
                     )}
                     <LoadingBar className="loading-bar" updateTime={1000} />
                     <Route component={Header} />
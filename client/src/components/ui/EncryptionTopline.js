@@ -2,7 +2,6 @@ import React from 'react';
 import PropTypes from 'prop-types';
 import { Trans, withNamespaces } from 'react-i18next';
 import isAfter from 'date-fns/is_after';
-import addDays from 'date-fns/add_days';
 
 import Topline from './Topline';
 import { EMPTY_DATE } from '../../helpers/constants';
@@ -12,7 +11,7 @@ const EncryptionTopline = (props) => {
         return false;
     }
 
-    const isAboutExpire = isAfter(addDays(Date.now(), 30), props.notAfter);
+    const isAboutExpire = props.expiresSoon;
     const isExpired = isAfter(Date.now(), props.notAfter);
 
     if (isExpired) {
@@ -38,6 +37,7 @@ const EncryptionTopline = (props) => {
 
 EncryptionTopline.propTypes = {
     notAfter: PropTypes.string.isRequired,
+    expiresSoon: PropTypes.bool,
 };
 
 export default withNamespaces()(EncryptionTopline);
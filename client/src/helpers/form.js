@@ -1,7 +1,18 @@
 import React, { Fragment } from 'react';
 import { Trans } from 'react-i18next';
 import PropTypes from 'prop-types';
-import { R_IPV4, R_MAC, R_HOST, R_IPV6, R_CIDR, UNSAFE_PORTS, R_URL_REQUIRES_PROTOCOL } from '../helpers/constants';
+import {
+    R_IPV4,
+    R_MAC,
+    R_HOST,
+    R_IPV6,
+    R_CIDR,
+    UNSAFE_PORTS,
+    R_URL_REQUIRES_PROTOCOL,
+    R_FILE_URL,
+    R_UNIX_ABSOLUTE_PATH,
+    R_WIN_ABSOLUTE_PATH,
+} from '../helpers/constants';
 import { createOnBlurHandler } from './helpers';
 
 export const renderField = (props, elementType) => {
@@ -284,4 +295,15 @@ export const isValidUrl = (value) => {
     return undefined;
 };
 
+export const isValidFilterUrl = (value) => {
+    if (value
+        && !R_URL_REQUIRES_PROTOCOL.test(value)
+        && !R_FILE_URL.test(value)
+        && !R_UNIX_ABSOLUTE_PATH.test(value)
+        && !R_WIN_ABSOLUTE_PATH.test(value)) {
+        return <Trans>form_error_url_or_path_format</Trans>;
+    }
+    return undefined;
+};
+
 export const toNumber = value => value && parseInt(value, 10);
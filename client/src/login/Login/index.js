@@ -18,8 +18,8 @@ class Login extends Component {
         isForgotPasswordVisible: false,
     };
 
-    handleSubmit = ({ username: name, password }) => {
-        this.props.processLogin({ name, password });
+    handleSubmit = ({ username: name, password, totp = '' }) => {
+        this.props.processLogin({ name, password, totp });
     };
 
     toggleText = () => {
@@ -64,6 +64,7 @@ const encryption = handleActions({
     key_type: '',
     not_after: '',
     not_before: '',
+    expires_soon: false,
     port_dns_over_tls: '',
     port_https: '',
     subject: '',
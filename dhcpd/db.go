@@ -19,8 +19,9 @@ const dbFilename = "leases.db"
 type leaseJSON struct {
 	HWAddr   []byte `json:"mac"`
 	IP       []byte `json:"ip"`
-	Hostname string `json:"host"`
-	Expiry   int64  `json:"exp"`
+	Hostname string   `json:"host"`
+	Expiry   int64    `json:"exp"`
+	Options  []string `json:"options,omitempty"`
 }
 
 func normalizeIP(ip net.IP) net.IP {
@@ -78,6 +79,7 @@ func (s *Server) dbLoad() {
 			IP:       obj[i].IP,
 			Hostname: obj[i].Hostname,
 			Expiry:   time.Unix(obj[i].Expiry, 0),
+			Options:  obj[i].Options,
 		}
 
 		if obj[i].Expiry == leaseExpireStatic {
@@ -136,6 +138,7 @@ func (s *Server) dbStore() {
 			IP:       s.leases[i].IP,
 			Hostname: s.leases[i].Hostname,
 			Expiry:   s.leases[i].Expiry.Unix(),
+			Options:  s.leases[i].Options,
 		}
 		leases = append(leases, lease)
 	}
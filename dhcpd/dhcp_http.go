@@ -22,10 +22,10 @@ func httpError(r *http.Request, w http.ResponseWriter, code int, format string,
 }
 
 // []Lease -> JSON
-func convertLeases(inputLeases []Lease, includeExpires bool) []map[string]string {
-	leases := []map[string]string{}
+func convertLeases(inputLeases []Lease, includeExpires bool) []map[string]interface{} {
+	leases := []map[string]interface{}{}
 	for _, l := range inputLeases {
-		lease := map[string]string{
+		lease := map[string]interface{}{
 			"mac":      l.HWAddr.String(),
 			"ip":       l.IP.String(),
 			"hostname": l.Hostname,
@@ -33,6 +33,12 @@ func convertLeases(inputLeases []Lease, includeExpires bool) []map[string]string
 
 		if includeExpires {
 			lease["expires"] = l.Expiry.Format(time.RFC3339)
+		} else {
+			options := l.Options
+			if options == nil {
+				options = []string{}
+			}
+			lease["options"] = options
 		}
 
 		leases = append(leases, lease)
@@ -43,10 +49,12 @@ func convertLeases(inputLeases []Lease, includeExpires bool) []map[string]string
 func (s *Server) handleDHCPStatus(w http.ResponseWriter, r *http.Request) {
 	leases := convertLeases(s.Leases(LeasesDynamic), true)
 	staticLeases := convertLeases(s.Leases(LeasesStatic), false)
+	leases6 := convertLeases(s.Leases6(), true)
 	status := map[string]interface{}{
 		"config":        s.conf,
 		"leases":        leases,
 		"static_leases": staticLeases,
+		"v6_leases":     leases6,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -58,9 +66,10 @@ func (s *Server) handleDHCPStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 type staticLeaseJSON struct {
-	HWAddr   string `json:"mac"`
-	IP       string `json:"ip"`
-	Hostname string `json:"hostname"`
+	HWAddr   string   `json:"mac"`
+	IP       string   `json:"ip"`
+	Hostname string   `json:"hostname"`
+	Options  []string `json:"options"`
 }
 
 type dhcpServerConfigJSON struct {
@@ -82,6 +91,17 @@ func (s *Server) handleDHCPSetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if newconfig.Enabled && !s.conf.Enabled {
+		// don't conflict with another DHCP server in the same network
+		found, err := CheckIfOtherDHCPServersPresent(newconfig.InterfaceName)
+		if err != nil {
+			log.Debug("DHCP: couldn't check for other DHCP servers on %s: %s", newconfig.InterfaceName, err)
+		} else if found {
+			httpError(r, w, http.StatusBadRequest, "Another DHCP server is running on interface %s", newconfig.InterfaceName)
+			return
+		}
+	}
+
 	err = s.Stop()
 	if err != nil {
 		log.Error("failed to stop the DHCP server: %s", err)
@@ -258,6 +278,7 @@ func (s *Server) handleDHCPAddStaticLease(w http.ResponseWriter, r *http.Request
 		IP:       ip,
 		HWAddr:   mac,
 		Hostname: lj.Hostname,
+		Options:  lj.Options,
 	}
 	err = s.AddStaticLease(lease)
 	if err != nil {
@@ -295,6 +316,35 @@ func (s *Server) handleDHCPRemoveStaticLease(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+func (s *Server) handleDHCPUpdateStaticLease(w http.ResponseWriter, r *http.Request) {
+	lj := staticLeaseJSON{}
+	err := json.NewDecoder(r.Body).Decode(&lj)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	ip, _ := parseIPv4(lj.IP)
+	if ip == nil {
+		httpError(r, w, http.StatusBadRequest, "invalid IP")
+		return
+	}
+
+	mac, _ := net.ParseMAC(lj.HWAddr)
+
+	lease := Lease{
+		IP:       ip,
+		HWAddr:   mac,
+		Hostname: lj.Hostname,
+		Options:  lj.Options,
+	}
+	err = s.UpdateStaticLease(lease)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+}
+
 func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
 	err := s.Stop()
 	if err != nil {
@@ -305,6 +355,9 @@ func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
 	if err != nil && !os.IsNotExist(err) {
 		log.Error("DHCP: os.Remove: %s: %s", s.conf.DBFilePath, err)
 	}
+	if s.srv6 != nil {
+		s.srv6.reset()
+	}
 
 	oldconf := s.conf
 	s.conf = ServerConfig{}
@@ -324,5 +377,6 @@ func (s *Server) registerHandlers() {
 	s.conf.HTTPRegister("POST", "/control/dhcp/find_active_dhcp", s.handleDHCPFindActiveServer)
 	s.conf.HTTPRegister("POST", "/control/dhcp/add_static_lease", s.handleDHCPAddStaticLease)
 	s.conf.HTTPRegister("POST", "/control/dhcp/remove_static_lease", s.handleDHCPRemoveStaticLease)
+	s.conf.HTTPRegister("POST", "/control/dhcp/update_static_lease", s.handleDHCPUpdateStaticLease)
 	s.conf.HTTPRegister("POST", "/control/dhcp/reset", s.handleReset)
 }
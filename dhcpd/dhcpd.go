@@ -28,6 +28,10 @@ type Lease struct {
 	// Lease expiration time
 	// 1: static lease
 	Expiry time.Time `json:"expires"`
+
+	// Custom DHCP options of a static lease ("CODE TYPE VALUE")
+	// They override the options of the server.
+	Options []string `json:"options,omitempty"`
 }
 
 // ServerConfig - DHCP server configuration
@@ -45,6 +49,14 @@ type ServerConfig struct {
 	// 0: disable
 	ICMPTimeout uint32 `json:"icmp_timeout_msec" yaml:"icmp_timeout_msec"`
 
+	// Custom DHCP options ("CODE TYPE VALUE", e.g. "66 text tftp.example.org")
+	// They override the options from the settings above.
+	Options []string `json:"options" yaml:"options"`
+
+	// DHCPv6 server and router advertisements on the same interface
+	// They work only while DHCP server is enabled.
+	Conf6 V6ServerConfig `json:"v6" yaml:"dhcpv6"`
+
 	WorkDir    string `json:"-" yaml:"-"`
 	DBFilePath string `json:"-" yaml:"-"` // path to DB file
 
@@ -89,6 +101,8 @@ type Server struct {
 
 	conf ServerConfig
 
+	srv6 *v6Server // DHCPv6 server
+
 	// Called when the leases DB is modified
 	onLeaseChanged onLeaseChangedT
 }
@@ -114,6 +128,7 @@ func Create(config ServerConfig) *Server {
 	s := Server{}
 	s.conf = config
 	s.conf.DBFilePath = filepath.Join(config.WorkDir, dbFilename)
+	s.srv6 = newV6Server(filepath.Join(config.WorkDir, dbFilename6), s.notify)
 	if s.conf.Enabled {
 		err := s.setConfig(config)
 		if err != nil {
@@ -128,6 +143,7 @@ func Create(config ServerConfig) *Server {
 	// we can't delay database loading until DHCP server is started,
 	//  because we need static leases functionality available beforehand
 	s.dbLoad()
+	s.srv6.dbLoad()
 	return &s
 }
 
@@ -189,6 +205,14 @@ func (s *Server) setConfig(config ServerConfig) error {
 		return wrapErrPrint(err, "DHCP: Incorrect range_start/range_end values")
 	}
 
+	if s.srv6 == nil {
+		s.srv6 = newV6Server("", s.notify)
+	}
+	err = s.srv6.setConfig(config.Conf6)
+	if err != nil {
+		return wrapErrPrint(err, "Invalid DHCPv6 configuration")
+	}
+
 	subnet, err := parseIPv4(config.SubnetMask)
 	if err != nil || !isValidSubnetMask(subnet) {
 		return wrapErrPrint(err, "Failed to parse subnet mask %s", config.SubnetMask)
@@ -208,6 +232,13 @@ func (s *Server) setConfig(config ServerConfig) error {
 		dhcp4.OptionRouter:           router,
 		dhcp4.OptionDomainNameServer: s.ipnet.IP,
 	}
+	custom, err := parseDHCPOptions(config.Options)
+	if err != nil {
+		return wrapErrPrint(err, "Invalid DHCP options")
+	}
+	for code, data := range custom {
+		s.leaseOptions[code] = data
+	}
 
 	oldconf := s.conf
 	s.conf = config
@@ -252,11 +283,21 @@ func (s *Server) Start() error {
 		s.cond.Signal()
 	}()
 
+	err = s.srv6.Start(iface)
+	if err != nil {
+		// DHCPv4 server continues to work
+		log.Error("%s", err)
+	}
+
 	return nil
 }
 
 // Stop closes the listening UDP socket
 func (s *Server) Stop() error {
+	if s.srv6 != nil {
+		s.srv6.Stop()
+	}
+
 	if s.conn == nil {
 		// nothing to do, return silently
 		return nil
@@ -524,7 +565,7 @@ func (s *Server) handleDiscover(p dhcp4.Packet, options dhcp4.Options) dhcp4.Pac
 		break
 	}
 
-	opt := s.leaseOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
+	opt := s.optionsForLease(lease).SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
 	reply := dhcp4.ReplyPacket(p, dhcp4.Offer, s.ipnet.IP, lease.IP, s.leaseTime, opt)
 	log.Tracef("Replying with offer: offered IP %v for %v with options %+v", lease.IP, s.leaseTime, reply.ParseOptions())
 	return reply
@@ -570,13 +611,18 @@ func (s *Server) handleDHCP4Request(p dhcp4.Packet, options dhcp4.Options) dhcp4
 	if lease.Expiry.Unix() != leaseExpireStatic {
 		lease.Expiry = time.Now().Add(s.leaseTime)
 		s.leasesLock.Lock()
+		// the client may have changed its host name since the lease was reserved
+		hostname := p.ParseOptions()[dhcp4.OptionHostName]
+		if len(hostname) != 0 {
+			lease.Hostname = string(hostname)
+		}
 		s.dbStore()
 		s.leasesLock.Unlock()
 		s.notify(LeaseChangedAdded) // Note: maybe we shouldn't call this function if only expiration time is updated
 	}
 	log.Tracef("Replying with ACK.  IP: %s  HW: %s  Expire: %s",
 		lease.IP, lease.HWAddr, lease.Expiry)
-	opt := s.leaseOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
+	opt := s.optionsForLease(lease).SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
 	return dhcp4.ReplyPacket(p, dhcp4.ACK, s.ipnet.IP, lease.IP, s.leaseTime, opt)
 }
 
@@ -610,10 +656,19 @@ func (s *Server) AddStaticLease(l Lease) error {
 	if len(l.HWAddr) != 6 {
 		return fmt.Errorf("Invalid MAC")
 	}
+	_, err := parseDHCPOptions(l.Options)
+	if err != nil {
+		return err
+	}
 	l.Expiry = time.Unix(leaseExpireStatic, 0)
 
 	s.leasesLock.Lock()
 
+	if s.findStaticLease(l.HWAddr) != nil {
+		s.leasesLock.Unlock()
+		return fmt.Errorf("Static lease with the same MAC already exists")
+	}
+
 	if s.findReservedHWaddr(l.IP) != nil {
 		err := s.rmDynamicLeaseWithIP(l.IP)
 		if err != nil {
@@ -629,6 +684,57 @@ func (s *Server) AddStaticLease(l Lease) error {
 	return nil
 }
 
+// Find a static lease by MAC address
+func (s *Server) findStaticLease(hwaddr net.HardwareAddr) *Lease {
+	for _, lease := range s.leases {
+		if lease.Expiry.Unix() == leaseExpireStatic && bytes.Equal(lease.HWAddr, hwaddr) {
+			return lease
+		}
+	}
+	return nil
+}
+
+// UpdateStaticLease changes IP address, hostname and options of the static lease with the same MAC address (thread-safe)
+func (s *Server) UpdateStaticLease(l Lease) error {
+	if len(l.IP) != 4 {
+		return fmt.Errorf("Invalid IP")
+	}
+	if len(l.HWAddr) != 6 {
+		return fmt.Errorf("Invalid MAC")
+	}
+	_, err := parseDHCPOptions(l.Options)
+	if err != nil {
+		return err
+	}
+
+	s.leasesLock.Lock()
+
+	lease := s.findStaticLease(l.HWAddr)
+	if lease == nil {
+		s.leasesLock.Unlock()
+		return fmt.Errorf("Lease not found")
+	}
+
+	if !lease.IP.Equal(l.IP) {
+		if s.findReservedHWaddr(l.IP) != nil {
+			err := s.rmDynamicLeaseWithIP(l.IP)
+			if err != nil {
+				s.leasesLock.Unlock()
+				return err
+			}
+		}
+		s.unreserveIP(lease.IP)
+		lease.IP = l.IP
+		s.reserveIP(lease.IP, lease.HWAddr)
+	}
+	lease.Hostname = l.Hostname
+	lease.Options = l.Options
+	s.dbStore()
+	s.leasesLock.Unlock()
+	s.notify(LeaseChangedAddedStatic)
+	return nil
+}
+
 // Remove a dynamic lease by IP address
 func (s *Server) rmDynamicLeaseWithIP(ip net.IP) error {
 	var newLeases []*Lease
@@ -714,6 +820,14 @@ func (s *Server) Leases(flags int) []Lease {
 	return result
 }
 
+// Leases6 returns the list of current DHCPv6 leases (thread-safe)
+func (s *Server) Leases6() []Lease {
+	if s.srv6 == nil {
+		return nil
+	}
+	return s.srv6.Leases()
+}
+
 // Print information about the current leases
 func (s *Server) printLeases() {
 	log.Tracef("Leases:")
@@ -745,7 +859,10 @@ func (s *Server) FindMACbyIP(ip net.IP) net.HardwareAddr {
 
 	ip4 := ip.To4()
 	if ip4 == nil {
-		return nil
+		if s.srv6 == nil {
+			return nil
+		}
+		return s.srv6.findMACbyIP(ip)
 	}
 
 	for _, l := range s.leases {
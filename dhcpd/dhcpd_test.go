@@ -127,12 +127,37 @@ func testStaticLeases(t *testing.T, s *Server) {
 	var l Lease
 	l.IP = []byte{1, 1, 1, 1}
 	l.HWAddr = []byte{2, 2, 3, 4, 5, 6}
+	l.Options = []string{"66 tftp"}
+	err = s.AddStaticLease(l)
+	check(t, err != nil, "AddStaticLease: invalid options")
+
+	l.Options = []string{"66 text tftp"}
 	err = s.AddStaticLease(l)
 	check(t, err == nil, "AddStaticLease")
 
 	ll := s.Leases(LeasesStatic)
 	check(t, len(ll) != 0 && bytes.Equal(ll[0].IP, []byte{1, 1, 1, 1}), "StaticLeases")
 
+	// a static lease with the same MAC can't be added twice
+	l2 := l
+	l2.IP = []byte{1, 1, 1, 2}
+	err = s.AddStaticLease(l2)
+	check(t, err != nil, "AddStaticLease: duplicate MAC")
+
+	// change IP and hostname of the static lease
+	l2.Hostname = "host"
+	err = s.UpdateStaticLease(l2)
+	check(t, err == nil, "UpdateStaticLease")
+	ll = s.Leases(LeasesStatic)
+	check(t, len(ll) == 1 && bytes.Equal(ll[0].IP, []byte{1, 1, 1, 2}) && ll[0].Hostname == "host", "UpdateStaticLease: lease")
+	check(t, s.findReservedHWaddr([]byte{1, 1, 1, 1}) == nil, "UpdateStaticLease: old IP is released")
+
+	l3 := l2
+	l3.HWAddr = []byte{3, 2, 3, 4, 5, 6}
+	err = s.UpdateStaticLease(l3)
+	check(t, err != nil, "UpdateStaticLease: not found")
+
+	l = l2
 	err = s.RemoveStaticLease(l)
 	check(t, err == nil, "RemoveStaticLease")
 }
@@ -0,0 +1,155 @@
+// Custom DHCP options
+
+package dhcpd
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// Parse the custom DHCP option
+// Format: "CODE TYPE VALUE", e.g.:
+//  "66 text tftp.example.org"
+//  "6 ips 192.168.1.1,192.168.1.2"
+//  "121 routes 10.0.0.0/8 192.168.1.1,172.16.0.0/12 192.168.1.254"
+//  "43 hex 0104c0a80101"
+// Types:
+//  hex: hexadecimal data
+//  text: string
+//  ip: IPv4 address
+//  ips: comma-separated IPv4 addresses
+//  u8, u16, u32: unsigned integer
+//  bool: "true" or "false"
+//  routes: comma-separated classless static routes "DESTINATION/PREFIX ROUTER" (RFC 3442)
+func parseDHCPOption(s string) (dhcp4.OptionCode, []byte, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), " ", 3)
+	if len(parts) != 3 {
+		return 0, nil, fmt.Errorf("invalid option %q: the format is \"CODE TYPE VALUE\"", s)
+	}
+
+	code, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil || code == 0 || code == 255 {
+		return 0, nil, fmt.Errorf("invalid option %q: invalid code", s)
+	}
+	switch dhcp4.OptionCode(code) {
+	case dhcp4.OptionDHCPMessageType, dhcp4.OptionServerIdentifier, dhcp4.OptionIPAddressLeaseTime:
+		return 0, nil, fmt.Errorf("invalid option %q: option %d can't be changed", s, code)
+	}
+
+	data, err := parseDHCPOptionValue(parts[1], strings.TrimSpace(parts[2]))
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid option %q: %s", s, err)
+	}
+	if len(data) > 255 {
+		return 0, nil, fmt.Errorf("invalid option %q: the data is too long", s)
+	}
+	return dhcp4.OptionCode(code), data, nil
+}
+
+func parseDHCPOptionValue(typ, val string) ([]byte, error) {
+	switch typ {
+	case "hex":
+		return hex.DecodeString(val)
+
+	case "text":
+		return []byte(val), nil
+
+	case "ip", "ips":
+		var data []byte
+		list := strings.Split(val, ",")
+		if typ == "ip" && len(list) != 1 {
+			return nil, fmt.Errorf("only one IP address is allowed")
+		}
+		for _, s := range list {
+			ip, err := parseIPv4(strings.TrimSpace(s))
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, ip...)
+		}
+		return data, nil
+
+	case "u8", "u16", "u32":
+		bits, _ := strconv.Atoi(typ[1:])
+		n, err := strconv.ParseUint(val, 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value: %s", typ, val)
+		}
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(n))
+		return data[4-bits/8:], nil
+
+	case "bool":
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bool value: %s", val)
+		}
+		if b {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+
+	case "routes":
+		return parseClasslessRoutes(val)
+	}
+	return nil, fmt.Errorf("invalid type %q", typ)
+}
+
+// Get the data of Classless Static Route option (RFC 3442)
+func parseClasslessRoutes(val string) ([]byte, error) {
+	var data []byte
+	for _, s := range strings.Split(val, ",") {
+		fields := strings.Fields(s)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid route %q: the format is \"DESTINATION/PREFIX ROUTER\"", s)
+		}
+		_, ipnet, err := net.ParseCIDR(fields[0])
+		if err != nil || ipnet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid route destination: %s", fields[0])
+		}
+		router, err := parseIPv4(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		ones, _ := ipnet.Mask.Size()
+		data = append(data, byte(ones))
+		data = append(data, ipnet.IP.To4()[:(ones+7)/8]...)
+		data = append(data, router...)
+	}
+	return data, nil
+}
+
+// Parse the list of custom DHCP options
+func parseDHCPOptions(list []string) (dhcp4.Options, error) {
+	opts := dhcp4.Options{}
+	for _, s := range list {
+		code, data, err := parseDHCPOption(s)
+		if err != nil {
+			return nil, err
+		}
+		opts[code] = data
+	}
+	return opts, nil
+}
+
+// Get the options for the lease: the options of the server overridden by the options of the static lease
+func (s *Server) optionsForLease(lease *Lease) dhcp4.Options {
+	if len(lease.Options) == 0 {
+		return s.leaseOptions
+	}
+	opts := dhcp4.Options{}
+	for code, data := range s.leaseOptions {
+		opts[code] = data
+	}
+	leaseOpts, _ := parseDHCPOptions(lease.Options) // the options were checked when the lease was added
+	for code, data := range leaseOpts {
+		opts[code] = data
+	}
+	return opts
+}
@@ -0,0 +1,84 @@
+package dhcpd
+
+import (
+	"testing"
+
+	"github.com/krolaw/dhcp4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDHCPOption(t *testing.T) {
+	code, data, err := parseDHCPOption("66 text tftp.example.org")
+	assert.Nil(t, err)
+	assert.Equal(t, dhcp4.OptionTFTPServerName, code)
+	assert.Equal(t, []byte("tftp.example.org"), data)
+
+	_, data, err = parseDHCPOption("67 text pxelinux.0 arg")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("pxelinux.0 arg"), data)
+
+	_, data, err = parseDHCPOption("43 hex 0104c0a80101")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 4, 192, 168, 1, 1}, data)
+
+	_, data, err = parseDHCPOption("6 ips 192.168.1.1, 192.168.1.2")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{192, 168, 1, 1, 192, 168, 1, 2}, data)
+
+	_, data, err = parseDHCPOption("26 u16 1500")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x05, 0xdc}, data)
+
+	_, data, err = parseDHCPOption("19 bool true")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1}, data)
+
+	// RFC 3442 examples
+	_, data, err = parseDHCPOption("121 routes 10.0.0.0/8 192.168.1.1,10.17.0.0/16 192.168.1.2,0.0.0.0/0 192.168.1.254")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{
+		8, 10, 192, 168, 1, 1,
+		16, 10, 17, 192, 168, 1, 2,
+		0, 192, 168, 1, 254,
+	}, data)
+
+	for _, s := range []string{
+		"66 tftp.example.org",
+		"0 text a",
+		"255 text a",
+		"256 text a",
+		"53 u8 1",
+		"54 ip 192.168.1.1",
+		"51 u32 3600",
+		"43 hex 01z",
+		"3 ip 192.168.1.1,192.168.1.2",
+		"6 ips ::1",
+		"26 u16 65536",
+		"19 bool maybe",
+		"121 routes 10.0.0.0/8",
+		"1 float 1.5",
+	} {
+		_, _, err = parseDHCPOption(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestOptionsForLease(t *testing.T) {
+	s := Server{}
+	s.leaseOptions = dhcp4.Options{
+		dhcp4.OptionRouter:         []byte{192, 168, 1, 1},
+		dhcp4.OptionTFTPServerName: []byte("tftp"),
+	}
+
+	l := &Lease{}
+	assert.Equal(t, s.leaseOptions, s.optionsForLease(l))
+
+	l.Options = []string{"66 text tftp2", "67 text boot.efi"}
+	opts := s.optionsForLease(l)
+	assert.Equal(t, []byte{192, 168, 1, 1}, opts[dhcp4.OptionRouter])
+	assert.Equal(t, []byte("tftp2"), opts[dhcp4.OptionTFTPServerName])
+	assert.Equal(t, []byte("boot.efi"), opts[dhcp4.OptionBootFileName])
+
+	// the options of the server aren't changed
+	assert.Equal(t, []byte("tftp"), s.leaseOptions[dhcp4.OptionTFTPServerName])
+}
@@ -0,0 +1,492 @@
+// DHCPv6 server
+
+package dhcpd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	dbFilename6 = "leases6.db"
+
+	v6OfferTimeout = 60 * time.Second // the time during which the offered address is reserved for the client
+)
+
+// V6ServerConfig - DHCPv6 server configuration
+type V6ServerConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// The first address of the pool
+	// The pool continues up to the address with the last byte 0xff, e.g. 2001:db8::10 - 2001:db8::ff
+	RangeStart    string `json:"range_start" yaml:"range_start"`
+	LeaseDuration uint32 `json:"lease_duration" yaml:"lease_duration"` // in seconds
+
+	// Send router advertisements with RDNSS option,
+	// so the clients that don't support DHCPv6 (e.g. Android) also get DNS server address.
+	// RA may be enabled without DHCPv6 server; RangeStart still defines the advertised /64 prefix.
+	RAEnabled bool `json:"ra_enabled" yaml:"ra_enabled"`
+
+	// Allow the clients to configure their addresses from the advertised prefix by SLAAC
+	RAAllowSLAAC bool `json:"ra_allow_slaac" yaml:"ra_allow_slaac"`
+}
+
+// DHCPv6 lease
+type v6Lease struct {
+	Lease
+	DUID    []byte // client identifier; empty: declined address
+	offered bool   // the address is offered to the client, but isn't requested yet
+}
+
+// The current state of DHCPv6 server
+type v6Server struct {
+	conf       V6ServerConfig
+	rangeStart net.IP
+	leaseTime  time.Duration
+	dbFilePath string
+	notify     func(flags int)
+
+	leases     []*v6Lease
+	leasesLock sync.Mutex
+
+	// set when the server is started
+	serverID []byte   // DUID-LL of the interface
+	dnsIP    []net.IP // the addresses of DNS server sent to clients
+	conn     *ipv6.PacketConn
+	ra       *raSender
+}
+
+func newV6Server(dbFilePath string, notify func(flags int)) *v6Server {
+	return &v6Server{dbFilePath: dbFilePath, notify: notify}
+}
+
+func (s *v6Server) setConfig(conf V6ServerConfig) error {
+	if !conf.Enabled && !conf.RAEnabled {
+		s.conf = conf
+		return nil
+	}
+
+	ip := net.ParseIP(conf.RangeStart)
+	if ip == nil || ip.To4() != nil {
+		return fmt.Errorf("DHCPv6: invalid range start %s", conf.RangeStart)
+	}
+
+	s.conf = conf
+	s.rangeStart = ip
+	s.leaseTime = time.Hour * 24
+	if conf.LeaseDuration != 0 {
+		s.leaseTime = time.Second * time.Duration(conf.LeaseDuration)
+	}
+	return nil
+}
+
+// Return TRUE if the address is within the pool
+func (s *v6Server) ipInRange(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil || s.rangeStart == nil || !bytes.Equal(ip[:15], s.rangeStart[:15]) {
+		return false
+	}
+	return ip[15] >= s.rangeStart[15]
+}
+
+// Get the address of the pool by its index or nil
+func (s *v6Server) ipByIndex(i int) net.IP {
+	n := int(s.rangeStart[15]) + i
+	if n > 0xff {
+		return nil
+	}
+	ip := make(net.IP, 16)
+	copy(ip, s.rangeStart)
+	ip[15] = byte(n)
+	return ip
+}
+
+// Find a lease by client's DUID
+// The leases outside of the current pool are ignored.
+func (s *v6Server) findLease(duid []byte) *v6Lease {
+	for _, l := range s.leases {
+		if bytes.Equal(l.DUID, duid) && s.ipInRange(l.IP) {
+			return l
+		}
+	}
+	return nil
+}
+
+// Reserve an address for the client
+// The address is taken from the pool or from an expired lease.
+func (s *v6Server) reserveLease(duid []byte) *v6Lease {
+	now := time.Now()
+	used := map[string]*v6Lease{}
+	for _, l := range s.leases {
+		used[l.IP.String()] = l
+	}
+
+	for i := 0; ; i++ {
+		ip := s.ipByIndex(i)
+		if ip == nil {
+			break
+		}
+		l, ok := used[ip.String()]
+		if !ok {
+			l = &v6Lease{}
+			l.IP = ip
+			s.leases = append(s.leases, l)
+		} else if l.Expiry.After(now) {
+			continue
+		}
+		l.DUID = append([]byte{}, duid...)
+		l.HWAddr = duidHWAddr(duid)
+		l.Hostname = ""
+		l.Expiry = now.Add(v6OfferTimeout)
+		l.offered = true
+		return l
+	}
+	return nil
+}
+
+// Process the message from the client and get the reply (nil: no reply)
+func (s *v6Server) process(req *v6Msg) *v6Msg {
+	duid := req.option(v6OptClientID)
+	if len(duid) == 0 {
+		log.Debug("DHCPv6: no client ID in message %d", req.msgType)
+		return nil
+	}
+
+	switch req.msgType {
+	case v6MsgSolicit, v6MsgRebind, v6MsgInformationRequest:
+		//
+	case v6MsgRequest, v6MsgRenew, v6MsgRelease, v6MsgDecline:
+		if !bytes.Equal(req.option(v6OptServerID), s.serverID) {
+			log.Tracef("DHCPv6: message %d isn't for this server", req.msgType)
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	resp := &v6Msg{msgType: v6MsgReply, xid: req.xid}
+	resp.addOption(v6OptServerID, s.serverID)
+	resp.addOption(v6OptClientID, duid)
+
+	if req.msgType == v6MsgInformationRequest {
+		resp.addOption(v6OptDNSServers, marshalV6DNS(s.dnsIP))
+		return resp
+	}
+
+	iaData := req.option(v6OptIANA)
+	if iaData == nil {
+		if req.msgType == v6MsgSolicit {
+			return nil // the client wants temporary or delegated addresses, we don't support them
+		}
+		resp.addOption(v6OptStatusCode, marshalV6Status(v6StatusSuccess, ""))
+		return resp
+	}
+	ia, err := parseV6IANA(iaData)
+	if err != nil {
+		log.Debug("DHCPv6: %s", err)
+		return nil
+	}
+
+	s.leasesLock.Lock()
+	commit := false
+	lease := s.findLease(duid)
+	switch req.msgType {
+	case v6MsgSolicit:
+		if lease == nil {
+			lease = s.reserveLease(duid)
+		} else if lease.Expiry.Before(time.Now()) {
+			lease.Expiry = time.Now().Add(v6OfferTimeout)
+			lease.offered = true
+		}
+		if req.hasOption(v6OptRapidCommit) {
+			resp.addOption(v6OptRapidCommit, nil)
+			commit = true
+		} else {
+			resp.msgType = v6MsgAdvertise
+		}
+
+	case v6MsgRequest, v6MsgRenew, v6MsgRebind:
+		if lease != nil {
+			ip := ia.addr()
+			if ip != nil && !ip.Equal(lease.IP) {
+				lease = nil
+			}
+		}
+		commit = true
+
+	case v6MsgRelease, v6MsgDecline:
+		if lease != nil {
+			if req.msgType == v6MsgDecline {
+				// the address is used by another device: don't assign it for some time
+				lease.DUID = nil
+				lease.HWAddr = nil
+				lease.Expiry = time.Now().Add(s.leaseTime)
+			} else {
+				lease.Expiry = time.Now()
+			}
+			s.dbStore()
+		}
+		s.leasesLock.Unlock()
+		resp.addOption(v6OptStatusCode, marshalV6Status(v6StatusSuccess, ""))
+		return resp
+	}
+
+	riaNA := v6IANA{iaid: ia.iaid}
+	if lease == nil {
+		s.leasesLock.Unlock()
+		status := v6StatusNoBinding
+		if req.msgType == v6MsgSolicit {
+			status = v6StatusNoAddrsAvail
+		}
+		riaNA.options = append(riaNA.options, v6Option{code: v6OptStatusCode, data: marshalV6Status(uint16(status), "")})
+		resp.addOption(v6OptIANA, riaNA.marshal())
+		return resp
+	}
+
+	if commit {
+		lease.Expiry = time.Now().Add(s.leaseTime)
+		lease.offered = false
+		host := parseV6FQDN(req.option(v6OptClientFQDN))
+		if len(host) != 0 {
+			lease.Hostname = host
+		}
+		s.dbStore()
+	}
+	ip := lease.IP
+	s.leasesLock.Unlock()
+	if commit {
+		s.notify(LeaseChangedAdded)
+	}
+
+	lifetime := uint32(s.leaseTime.Seconds())
+	riaNA.t1 = lifetime / 2
+	riaNA.t2 = lifetime * 4 / 5
+	riaNA.options = append(riaNA.options, v6Option{code: v6OptIAAddr, data: marshalV6IAAddr(ip, lifetime, lifetime)})
+	resp.addOption(v6OptIANA, riaNA.marshal())
+	resp.addOption(v6OptDNSServers, marshalV6DNS(s.dnsIP))
+	return resp
+}
+
+// Get the addresses of the interface for DNS server: global unicast addresses or link-local address
+func getIfaceIPv6(iface *net.Interface) []net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var global, linkLocal []net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.To4() != nil {
+			continue
+		}
+		if ipnet.IP.IsLinkLocalUnicast() {
+			linkLocal = append(linkLocal, ipnet.IP)
+		} else if ipnet.IP.IsGlobalUnicast() {
+			global = append(global, ipnet.IP)
+		}
+	}
+	if len(global) != 0 {
+		return global[:1]
+	}
+	return linkLocal
+}
+
+// Start DHCPv6 server and the sending of router advertisements on the interface
+func (s *v6Server) Start(iface *net.Interface) error {
+	if !s.conf.Enabled && !s.conf.RAEnabled {
+		return nil
+	}
+
+	s.dnsIP = getIfaceIPv6(iface)
+	if len(s.dnsIP) == 0 {
+		return fmt.Errorf("DHCPv6: couldn't find IPv6 address of interface %s", iface.Name)
+	}
+	s.serverID = makeDUIDLL(iface.HardwareAddr)
+
+	if s.conf.RAEnabled {
+		s.ra = newRASender(iface, s.conf, s.rangeStart, s.dnsIP[0])
+		err := s.ra.start()
+		if err != nil {
+			s.ra = nil
+			log.Error("DHCPv6: %s", err)
+		}
+	}
+
+	if !s.conf.Enabled {
+		return nil
+	}
+
+	c, err := net.ListenPacket("udp6", "[::]:547")
+	if err != nil {
+		return wrapErrPrint(err, "Couldn't start listening socket on [::]:547")
+	}
+	p := ipv6.NewPacketConn(c)
+	err = p.JoinGroup(iface, &net.UDPAddr{IP: net.ParseIP("ff02::1:2")})
+	if err != nil {
+		_ = c.Close()
+		return wrapErrPrint(err, "Couldn't join DHCPv6 multicast group on %s", iface.Name)
+	}
+	_ = p.SetControlMessage(ipv6.FlagInterface, true) // not supported on Windows
+	s.conn = p
+	log.Info("DHCPv6: listening on [::]:547")
+
+	go s.serve(p, iface.Index)
+	return nil
+}
+
+// Stop DHCPv6 server
+func (s *v6Server) Stop() {
+	if s.ra != nil {
+		s.ra.stop()
+		s.ra = nil
+	}
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *v6Server) serve(p *ipv6.PacketConn, ifIndex int) {
+	buf := make([]byte, 1500)
+	for {
+		n, cm, src, err := p.ReadFrom(buf)
+		if err != nil {
+			log.Debug("DHCPv6: %s", err)
+			return
+		}
+		if cm != nil && cm.IfIndex != ifIndex {
+			continue
+		}
+
+		req, err := parseV6Msg(buf[:n])
+		if err != nil {
+			log.Debug("DHCPv6: invalid message from %s: %s", src, err)
+			continue
+		}
+		resp := s.process(req)
+		if resp == nil {
+			continue
+		}
+		_, err = p.WriteTo(resp.marshal(), &ipv6.ControlMessage{IfIndex: ifIndex}, src)
+		if err != nil {
+			log.Debug("DHCPv6: couldn't send reply to %s: %s", src, err)
+		}
+	}
+}
+
+// Get the active leases
+func (s *v6Server) Leases() []Lease {
+	var result []Lease
+	now := time.Now()
+	s.leasesLock.Lock()
+	for _, l := range s.leases {
+		if len(l.DUID) != 0 && !l.offered && l.Expiry.After(now) {
+			result = append(result, l.Lease)
+		}
+	}
+	s.leasesLock.Unlock()
+	return result
+}
+
+// Find MAC address by IP address in the active leases
+func (s *v6Server) findMACbyIP(ip net.IP) net.HardwareAddr {
+	now := time.Now()
+	s.leasesLock.Lock()
+	defer s.leasesLock.Unlock()
+	for _, l := range s.leases {
+		if l.IP.Equal(ip) && !l.offered && l.Expiry.After(now) {
+			return l.HWAddr
+		}
+	}
+	return nil
+}
+
+// Remove all leases
+func (s *v6Server) reset() {
+	s.leasesLock.Lock()
+	s.leases = nil
+	s.leasesLock.Unlock()
+	err := os.Remove(s.dbFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("DHCPv6: os.Remove: %s: %s", s.dbFilePath, err)
+	}
+}
+
+type lease6JSON struct {
+	DUID     []byte `json:"duid"`
+	HWAddr   []byte `json:"mac"`
+	IP       []byte `json:"ip"`
+	Hostname string `json:"host"`
+	Expiry   int64  `json:"exp"`
+}
+
+// Load lease table from DB
+func (s *v6Server) dbLoad() {
+	s.leases = nil
+	data, err := ioutil.ReadFile(s.dbFilePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("DHCPv6: can't read file %s: %v", s.dbFilePath, err)
+		}
+		return
+	}
+
+	obj := []lease6JSON{}
+	err = json.Unmarshal(data, &obj)
+	if err != nil {
+		log.Error("DHCPv6: invalid DB: %v", err)
+		return
+	}
+
+	for _, o := range obj {
+		l := &v6Lease{DUID: o.DUID}
+		l.HWAddr = o.HWAddr
+		l.IP = o.IP
+		l.Hostname = o.Hostname
+		l.Expiry = time.Unix(o.Expiry, 0)
+		s.leases = append(s.leases, l)
+	}
+	log.Info("DHCPv6: loaded %d leases from DB", len(s.leases))
+}
+
+// Store lease table in DB
+func (s *v6Server) dbStore() {
+	if len(s.dbFilePath) == 0 {
+		return
+	}
+	leases := []lease6JSON{}
+	now := time.Now()
+	for _, l := range s.leases {
+		if l.offered || l.Expiry.Before(now) {
+			continue
+		}
+		leases = append(leases, lease6JSON{
+			DUID:     l.DUID,
+			HWAddr:   l.HWAddr,
+			IP:       l.IP,
+			Hostname: l.Hostname,
+			Expiry:   l.Expiry.Unix(),
+		})
+	}
+
+	data, err := json.Marshal(leases)
+	if err != nil {
+		log.Error("json.Marshal: %v", err)
+		return
+	}
+	err = file.SafeWrite(s.dbFilePath, data)
+	if err != nil {
+		log.Error("DHCPv6: can't store lease table on disk: %v  filename: %s", err, s.dbFilePath)
+		return
+	}
+	log.Debug("DHCPv6: stored %d leases in DB", len(leases))
+}
@@ -0,0 +1,239 @@
+// DHCPv6 messages (RFC 8415)
+
+package dhcpd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DHCPv6 message types
+const (
+	v6MsgSolicit            = 1
+	v6MsgAdvertise          = 2
+	v6MsgRequest            = 3
+	v6MsgConfirm            = 4
+	v6MsgRenew              = 5
+	v6MsgRebind             = 6
+	v6MsgReply              = 7
+	v6MsgRelease            = 8
+	v6MsgDecline            = 9
+	v6MsgInformationRequest = 11
+)
+
+// DHCPv6 options
+const (
+	v6OptClientID    = 1
+	v6OptServerID    = 2
+	v6OptIANA        = 3
+	v6OptIAAddr      = 5
+	v6OptStatusCode  = 13
+	v6OptRapidCommit = 14
+	v6OptDNSServers  = 23
+	v6OptClientFQDN  = 39
+)
+
+// DHCPv6 status codes
+const (
+	v6StatusSuccess      = 0
+	v6StatusNoAddrsAvail = 2
+	v6StatusNoBinding    = 3
+)
+
+// DUID types
+const (
+	duidLLT = 1 // link-layer address plus time
+	duidLL  = 3 // link-layer address
+)
+
+// DHCPv6 option
+type v6Option struct {
+	code uint16
+	data []byte
+}
+
+// DHCPv6 message
+type v6Msg struct {
+	msgType byte
+	xid     [3]byte // transaction ID
+	options []v6Option
+}
+
+// Parse the options
+func parseV6Options(data []byte) ([]v6Option, error) {
+	var options []v6Option
+	for len(data) != 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("option is too short")
+		}
+		code := binary.BigEndian.Uint16(data)
+		n := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+n {
+			return nil, fmt.Errorf("option %d is too short", code)
+		}
+		options = append(options, v6Option{code: code, data: data[4 : 4+n]})
+		data = data[4+n:]
+	}
+	return options, nil
+}
+
+// Parse DHCPv6 message
+func parseV6Msg(data []byte) (*v6Msg, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("message is too short")
+	}
+	m := &v6Msg{msgType: data[0]}
+	copy(m.xid[:], data[1:4])
+	var err error
+	m.options, err = parseV6Options(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Get the data of the first option with this code or nil
+func (m *v6Msg) option(code uint16) []byte {
+	for _, o := range m.options {
+		if o.code == code {
+			return o.data
+		}
+	}
+	return nil
+}
+
+// Return TRUE if the message has the option (the options may have no data)
+func (m *v6Msg) hasOption(code uint16) bool {
+	for _, o := range m.options {
+		if o.code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *v6Msg) addOption(code uint16, data []byte) {
+	m.options = append(m.options, v6Option{code: code, data: data})
+}
+
+func marshalV6Options(options []v6Option) []byte {
+	var data []byte
+	for _, o := range options {
+		data = append(data, byte(o.code>>8), byte(o.code), byte(len(o.data)>>8), byte(len(o.data)))
+		data = append(data, o.data...)
+	}
+	return data
+}
+
+func (m *v6Msg) marshal() []byte {
+	data := []byte{m.msgType, m.xid[0], m.xid[1], m.xid[2]}
+	return append(data, marshalV6Options(m.options)...)
+}
+
+// IA_NA option: identity association for non-temporary addresses
+type v6IANA struct {
+	iaid    uint32
+	t1, t2  uint32 // in seconds
+	options []v6Option
+}
+
+func parseV6IANA(data []byte) (*v6IANA, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("IA_NA option is too short")
+	}
+	ia := &v6IANA{
+		iaid: binary.BigEndian.Uint32(data),
+		t1:   binary.BigEndian.Uint32(data[4:]),
+		t2:   binary.BigEndian.Uint32(data[8:]),
+	}
+	var err error
+	ia.options, err = parseV6Options(data[12:])
+	if err != nil {
+		return nil, err
+	}
+	return ia, nil
+}
+
+// Get the first address from IAADDR options or nil
+func (ia *v6IANA) addr() net.IP {
+	for _, o := range ia.options {
+		if o.code == v6OptIAAddr && len(o.data) >= 24 {
+			return net.IP(o.data[:16])
+		}
+	}
+	return nil
+}
+
+func (ia *v6IANA) marshal() []byte {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data, ia.iaid)
+	binary.BigEndian.PutUint32(data[4:], ia.t1)
+	binary.BigEndian.PutUint32(data[8:], ia.t2)
+	return append(data, marshalV6Options(ia.options)...)
+}
+
+// Get the data of IAADDR option
+func marshalV6IAAddr(ip net.IP, preferred, valid uint32) []byte {
+	data := make([]byte, 24)
+	copy(data, ip.To16())
+	binary.BigEndian.PutUint32(data[16:], preferred)
+	binary.BigEndian.PutUint32(data[20:], valid)
+	return data
+}
+
+// Get the data of STATUS_CODE option
+func marshalV6Status(code uint16, msg string) []byte {
+	return append([]byte{byte(code >> 8), byte(code)}, msg...)
+}
+
+// Get the data of DNS_RECURSIVE_NAME_SERVER option
+func marshalV6DNS(servers []net.IP) []byte {
+	var data []byte
+	for _, ip := range servers {
+		data = append(data, ip.To16()...)
+	}
+	return data
+}
+
+// Get DUID-LL for the MAC address
+func makeDUIDLL(mac net.HardwareAddr) []byte {
+	return append([]byte{0, duidLL, 0, 1}, mac...)
+}
+
+// Get the link-layer address from DUID-LLT or DUID-LL
+// Return nil for the other DUID types.
+func duidHWAddr(duid []byte) net.HardwareAddr {
+	if len(duid) < 4 {
+		return nil
+	}
+	var mac []byte
+	switch binary.BigEndian.Uint16(duid) {
+	case duidLLT:
+		if len(duid) < 8 {
+			return nil
+		}
+		mac = duid[8:]
+	case duidLL:
+		mac = duid[4:]
+	default:
+		return nil
+	}
+	if len(mac) != 6 {
+		return nil
+	}
+	return net.HardwareAddr(append([]byte{}, mac...))
+}
+
+// Get the host name from CLIENT_FQDN option: the first label of the domain name
+func parseV6FQDN(data []byte) string {
+	if len(data) < 2 {
+		return ""
+	}
+	n := int(data[1]) // the length of the first label
+	if n == 0 || len(data) < 2+n {
+		return ""
+	}
+	return strings.ToLower(string(data[2 : 2+n]))
+}
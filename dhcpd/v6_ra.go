@@ -0,0 +1,196 @@
+// Router advertisements (RFC 4861) with RDNSS option (RFC 8106)
+
+package dhcpd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	raInterval         = 200 * time.Second // interval between unsolicited advertisements
+	raMinReplyInterval = 3 * time.Second   // the minimum interval between the replies to router solicitations
+	raRDNSSLifetime    = 2 * raInterval
+
+	raPrefixValidLifetime     = 3600 // in seconds
+	raPrefixPreferredLifetime = 1800 // in seconds
+)
+
+// RA flags
+const (
+	raFlagManaged = 0x80 // the addresses are available via DHCPv6
+	raFlagOther   = 0x40 // other configuration (DNS) is available via DHCPv6
+
+	raPrefixFlagOnLink     = 0x80
+	raPrefixFlagAutonomous = 0x40 // the prefix may be used for SLAAC
+)
+
+// RA options
+const (
+	raOptSourceLinkAddr = 1
+	raOptPrefixInfo     = 3
+	raOptRDNSS          = 25
+)
+
+// The sender of router advertisements
+// AdGuard Home isn't a router, so it advertises itself with zero router lifetime:
+// the clients use the prefix and DNS server information, but don't use it as a default router.
+type raSender struct {
+	iface   *net.Interface
+	managed bool   // DHCPv6 server is enabled
+	slaac   bool   // the prefix may be used for SLAAC
+	prefix  net.IP // /64 prefix of DHCPv6 pool
+	dnsIP   net.IP
+
+	conn     *icmp.PacketConn
+	lock     sync.Mutex
+	lastSent time.Time
+	stopCh   chan bool
+}
+
+func newRASender(iface *net.Interface, conf V6ServerConfig, rangeStart, dnsIP net.IP) *raSender {
+	return &raSender{
+		iface:   iface,
+		managed: conf.Enabled,
+		slaac:   conf.RAAllowSLAAC,
+		prefix:  rangeStart.Mask(net.CIDRMask(64, 128)),
+		dnsIP:   dnsIP,
+	}
+}
+
+// Get the router advertisement packet
+func (ra *raSender) packet() []byte {
+	data := []byte{
+		byte(ipv6.ICMPTypeRouterAdvertisement), 0, 0, 0, // type, code, checksum (filled by the kernel)
+		64,   // current hop limit
+		0,    // flags
+		0, 0, // router lifetime
+		0, 0, 0, 0, // reachable time
+		0, 0, 0, 0, // retransmission timer
+	}
+	if ra.managed {
+		data[5] = raFlagManaged | raFlagOther
+	}
+
+	if len(ra.iface.HardwareAddr) == 6 {
+		data = append(data, raOptSourceLinkAddr, 1)
+		data = append(data, ra.iface.HardwareAddr...)
+	}
+
+	prefix := make([]byte, 32)
+	prefix[0] = raOptPrefixInfo
+	prefix[1] = 4
+	prefix[2] = 64 // prefix length
+	prefix[3] = raPrefixFlagOnLink
+	if ra.slaac {
+		prefix[3] |= raPrefixFlagAutonomous
+	}
+	binary.BigEndian.PutUint32(prefix[4:], raPrefixValidLifetime)
+	binary.BigEndian.PutUint32(prefix[8:], raPrefixPreferredLifetime)
+	copy(prefix[16:], ra.prefix.To16())
+	data = append(data, prefix...)
+
+	rdnss := make([]byte, 24)
+	rdnss[0] = raOptRDNSS
+	rdnss[1] = 3
+	binary.BigEndian.PutUint32(rdnss[4:], uint32(raRDNSSLifetime.Seconds()))
+	copy(rdnss[8:], ra.dnsIP.To16())
+	data = append(data, rdnss...)
+
+	return data
+}
+
+// Start sending router advertisements
+func (ra *raSender) start() error {
+	var linkLocal net.IP
+	addrs, _ := ra.iface.Addrs()
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if ok && ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+			linkLocal = ipnet.IP
+			break
+		}
+	}
+	if linkLocal == nil {
+		return fmt.Errorf("RA: couldn't find link-local address of interface %s", ra.iface.Name)
+	}
+
+	c, err := icmp.ListenPacket("ip6:ipv6-icmp", linkLocal.String()+"%"+ra.iface.Name)
+	if err != nil {
+		return fmt.Errorf("RA: icmp.ListenPacket: %s", err)
+	}
+	p := c.IPv6PacketConn()
+	_ = p.SetMulticastHopLimit(255)
+	_ = p.SetHopLimit(255)
+	_ = p.SetMulticastInterface(ra.iface)
+	err = p.JoinGroup(ra.iface, &net.IPAddr{IP: net.IPv6linklocalallrouters})
+	if err != nil {
+		log.Debug("RA: couldn't join all-routers group on %s: %s", ra.iface.Name, err)
+	}
+	f := ipv6.ICMPFilter{}
+	f.SetAll(true)
+	f.Accept(ipv6.ICMPTypeRouterSolicitation)
+	_ = p.SetICMPFilter(&f)
+
+	ra.conn = c
+	ra.stopCh = make(chan bool)
+	log.Info("RA: sending router advertisements on %s", ra.iface.Name)
+
+	go ra.sendLoop()
+	go ra.recvLoop()
+	return nil
+}
+
+func (ra *raSender) stop() {
+	close(ra.stopCh)
+	_ = ra.conn.Close()
+}
+
+// Send router advertisement to all nodes
+func (ra *raSender) send() {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+	if time.Since(ra.lastSent) < raMinReplyInterval {
+		return
+	}
+	ra.lastSent = time.Now()
+
+	dst := &net.IPAddr{IP: net.IPv6linklocalallnodes, Zone: ra.iface.Name}
+	_, err := ra.conn.WriteTo(ra.packet(), dst)
+	if err != nil {
+		log.Debug("RA: %s", err)
+	}
+}
+
+func (ra *raSender) sendLoop() {
+	for {
+		ra.send()
+		select {
+		case <-time.After(raInterval):
+			//
+		case <-ra.stopCh:
+			return
+		}
+	}
+}
+
+// Reply to router solicitations
+func (ra *raSender) recvLoop() {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := ra.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n != 0 && buf[0] == byte(ipv6.ICMPTypeRouterSolicitation) {
+			ra.send()
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package dhcpd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestV6Server(t *testing.T, rangeStart string) *v6Server {
+	s := newV6Server("", func(flags int) {})
+	err := s.setConfig(V6ServerConfig{Enabled: true, RangeStart: rangeStart, LeaseDuration: 3600})
+	assert.Nil(t, err)
+	s.serverID = makeDUIDLL(net.HardwareAddr{0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa})
+	s.dnsIP = []net.IP{net.ParseIP("2001:db8::1")}
+	return s
+}
+
+// Get the client's message with IA_NA option
+func newV6Request(msgType byte, duid []byte, serverID []byte, ip net.IP) *v6Msg {
+	m := &v6Msg{msgType: msgType, xid: [3]byte{1, 2, 3}}
+	m.addOption(v6OptClientID, duid)
+	if serverID != nil {
+		m.addOption(v6OptServerID, serverID)
+	}
+	ia := v6IANA{iaid: 1}
+	if ip != nil {
+		ia.options = append(ia.options, v6Option{code: v6OptIAAddr, data: marshalV6IAAddr(ip, 0, 0)})
+	}
+	m.addOption(v6OptIANA, ia.marshal())
+	return m
+}
+
+// Parse the reply and get IA_NA option
+func parseV6Reply(t *testing.T, resp *v6Msg) *v6IANA {
+	m, err := parseV6Msg(resp.marshal())
+	assert.Nil(t, err)
+	ia, err := parseV6IANA(m.option(v6OptIANA))
+	assert.Nil(t, err)
+	return ia
+}
+
+func TestV6Msg(t *testing.T) {
+	mac := net.HardwareAddr{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+	assert.Equal(t, mac, duidHWAddr(makeDUIDLL(mac)))
+	assert.Equal(t, mac, duidHWAddr([]byte{0, 1, 0, 1, 0x11, 0x22, 0x33, 0x44, 1, 2, 3, 4, 5, 6}))
+	assert.Nil(t, duidHWAddr([]byte{0, 2, 0, 0, 0, 1, 2, 3}))
+
+	assert.Equal(t, "host", parseV6FQDN([]byte{0, 4, 'H', 'o', 's', 't', 3, 'l', 'a', 'n', 0}))
+	assert.Equal(t, "", parseV6FQDN([]byte{0, 0}))
+
+	_, err := parseV6Msg([]byte{1, 0, 0, 0, 0, 1, 0, 10, 1})
+	assert.NotNil(t, err)
+}
+
+func TestV6Server(t *testing.T) {
+	s := newTestV6Server(t, "2001:db8::fe")
+	duid := makeDUIDLL(net.HardwareAddr{1, 2, 3, 4, 5, 6})
+
+	// Solicit -> Advertise
+	resp := s.process(newV6Request(v6MsgSolicit, duid, nil, nil))
+	assert.Equal(t, byte(v6MsgAdvertise), resp.msgType)
+	assert.Equal(t, [3]byte{1, 2, 3}, resp.xid)
+	assert.Equal(t, s.serverID, resp.option(v6OptServerID))
+	ia := parseV6Reply(t, resp)
+	assert.Equal(t, uint32(1), ia.iaid)
+	assert.Equal(t, "2001:db8::fe", ia.addr().String())
+	assert.Equal(t, 0, len(s.Leases()))
+
+	// Request -> Reply: the lease is committed
+	req := newV6Request(v6MsgRequest, duid, s.serverID, ia.addr())
+	req.addOption(v6OptClientFQDN, []byte{0, 4, 'h', 'o', 's', 't'})
+	resp = s.process(req)
+	assert.Equal(t, byte(v6MsgReply), resp.msgType)
+	assert.Equal(t, net.ParseIP("2001:db8::1").To16(), net.IP(resp.option(v6OptDNSServers)))
+	ia = parseV6Reply(t, resp)
+	assert.Equal(t, "2001:db8::fe", ia.addr().String())
+	assert.Equal(t, uint32(1800), ia.t1)
+	leases := s.Leases()
+	assert.Equal(t, 1, len(leases))
+	assert.Equal(t, "host", leases[0].Hostname)
+	assert.Equal(t, "01:02:03:04:05:06", leases[0].HWAddr.String())
+	assert.Equal(t, "01:02:03:04:05:06", s.findMACbyIP(net.ParseIP("2001:db8::fe")).String())
+
+	// Request for another server is ignored
+	assert.Nil(t, s.process(newV6Request(v6MsgRequest, duid, []byte{1}, ia.addr())))
+
+	// Solicit with rapid commit: the lease is committed at once
+	duid2 := makeDUIDLL(net.HardwareAddr{1, 2, 3, 4, 5, 7})
+	req = newV6Request(v6MsgSolicit, duid2, nil, nil)
+	req.addOption(v6OptRapidCommit, nil)
+	resp = s.process(req)
+	assert.Equal(t, byte(v6MsgReply), resp.msgType)
+	assert.True(t, resp.hasOption(v6OptRapidCommit))
+	assert.Equal(t, "2001:db8::ff", parseV6Reply(t, resp).addr().String())
+	assert.Equal(t, 2, len(s.Leases()))
+
+	// No more addresses in the pool
+	resp = s.process(newV6Request(v6MsgSolicit, makeDUIDLL(net.HardwareAddr{1, 2, 3, 4, 5, 8}), nil, nil))
+	ia = parseV6Reply(t, resp)
+	assert.Nil(t, ia.addr())
+	assert.Equal(t, []byte{0, v6StatusNoAddrsAvail}, ia.options[0].data)
+
+	// Renew with the wrong address
+	resp = s.process(newV6Request(v6MsgRenew, duid, s.serverID, net.ParseIP("2001:db8::ff")))
+	ia = parseV6Reply(t, resp)
+	assert.Equal(t, []byte{0, v6StatusNoBinding}, ia.options[0].data)
+
+	// Release: the address is available again
+	resp = s.process(newV6Request(v6MsgRelease, duid, s.serverID, net.ParseIP("2001:db8::fe")))
+	assert.Equal(t, byte(v6MsgReply), resp.msgType)
+	assert.Equal(t, 1, len(s.Leases()))
+	resp = s.process(newV6Request(v6MsgSolicit, makeDUIDLL(net.HardwareAddr{1, 2, 3, 4, 5, 8}), nil, nil))
+	assert.Equal(t, "2001:db8::fe", parseV6Reply(t, resp).addr().String())
+}
+
+func TestV6Config(t *testing.T) {
+	s := newV6Server("", nil)
+	assert.Nil(t, s.setConfig(V6ServerConfig{}))
+	assert.NotNil(t, s.setConfig(V6ServerConfig{Enabled: true, RangeStart: "192.168.0.1"}))
+	assert.NotNil(t, s.setConfig(V6ServerConfig{RAEnabled: true}))
+	assert.Nil(t, s.setConfig(V6ServerConfig{Enabled: true, RangeStart: "2001:db8::10"}))
+	assert.Equal(t, 24*time.Hour, s.leaseTime)
+	assert.True(t, s.ipInRange(net.ParseIP("2001:db8::10")))
+	assert.True(t, s.ipInRange(net.ParseIP("2001:db8::ff")))
+	assert.False(t, s.ipInRange(net.ParseIP("2001:db8::f")))
+	assert.False(t, s.ipInRange(net.ParseIP("2001:db8::1:10")))
+}
+
+func TestRAPacket(t *testing.T) {
+	iface := &net.Interface{Name: "eth0", HardwareAddr: net.HardwareAddr{1, 2, 3, 4, 5, 6}}
+	ra := newRASender(iface, V6ServerConfig{Enabled: true, RAAllowSLAAC: true},
+		net.ParseIP("2001:db8:1:2::10"), net.ParseIP("2001:db8:1:2::1"))
+	data := ra.packet()
+	assert.Equal(t, 16+8+32+24, len(data))
+	assert.Equal(t, byte(134), data[0])
+	assert.Equal(t, byte(raFlagManaged|raFlagOther), data[5])
+	assert.Equal(t, []byte{0, 0}, data[6:8]) // router lifetime
+
+	// source link-layer address
+	assert.Equal(t, []byte{raOptSourceLinkAddr, 1, 1, 2, 3, 4, 5, 6}, data[16:24])
+
+	// prefix information
+	prefix := data[24:56]
+	assert.Equal(t, []byte{raOptPrefixInfo, 4, 64, raPrefixFlagOnLink | raPrefixFlagAutonomous}, prefix[:4])
+	assert.Equal(t, "2001:db8:1:2::", net.IP(prefix[16:]).String())
+
+	// RDNSS
+	rdnss := data[56:]
+	assert.Equal(t, []byte{raOptRDNSS, 3}, rdnss[:2])
+	assert.Equal(t, "2001:db8:1:2::1", net.IP(rdnss[8:]).String())
+}
@@ -0,0 +1,180 @@
+// Pre-check of host names: a bloom filter over the domains of the rules of a filter list
+
+package dnsfilter
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+const (
+	bloomBitsPerKey = 10 // ~1% of false positives
+	bloomHashes     = 7
+)
+
+// Bloom filter over strings
+// A negative answer is always correct, a positive answer may be false.
+type bloomFilter struct {
+	bits []uint64
+	mask uint64 // the number of bits - 1 (a power of 2)
+}
+
+func newBloomFilter(n int) *bloomFilter {
+	nbits := uint64(64)
+	for nbits < uint64(n)*bloomBitsPerKey {
+		nbits *= 2
+	}
+	return &bloomFilter{
+		bits: make([]uint64, nbits/64),
+		mask: nbits - 1,
+	}
+}
+
+// FNV-1a hash of a string
+func bloomHash(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i != len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (b *bloomFilter) add(h uint64) {
+	h1, h2 := h, (h>>32)|1
+	for i := uint64(0); i != bloomHashes; i++ {
+		n := (h1 + i*h2) & b.mask
+		b.bits[n/64] |= 1 << (n % 64)
+	}
+}
+
+func (b *bloomFilter) has(h uint64) bool {
+	h1, h2 := h, (h>>32)|1
+	for i := uint64(0); i != bloomHashes; i++ {
+		n := (h1 + i*h2) & b.mask
+		if b.bits[n/64]&(1<<(n%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Return TRUE if any of the hashes may be in the set
+// nil object is an empty set.
+func (b *bloomFilter) hasAny(hashes []uint64) bool {
+	if b == nil {
+		return false
+	}
+	for _, h := range hashes {
+		if b.has(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the hashes of the host name and all its parent domains: "a.b.c", "b.c", "c"
+// These are the domains that can be matched by "||domain^" and host rules.
+func hostHashes(host string) []uint64 {
+	host = strings.ToLower(host)
+	hashes := make([]uint64, 0, 4)
+	for {
+		hashes = append(hashes, bloomHash(host))
+		i := strings.IndexByte(host, '.')
+		if i == -1 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return hashes
+}
+
+// Get the domain of a "||domain^" rule, with or without "@@" prefix and modifiers
+// Return an empty string if the rule can match host names other than the domain and its subdomains.
+func simpleRuleDomain(text string) string {
+	text = strings.TrimPrefix(text, "@@")
+	if !strings.HasPrefix(text, "||") {
+		return ""
+	}
+	text = text[2:]
+	i := strings.IndexByte(text, '$')
+	if i != -1 {
+		if strings.Contains(text[i:], "badfilter") {
+			return "" // it must be seen by the engine that matches the rules it disables
+		}
+		text = text[:i]
+	}
+	text = strings.TrimSuffix(text, "|")
+	if !strings.HasSuffix(text, "^") {
+		return ""
+	}
+	text = text[:len(text)-1]
+	if len(text) == 0 || text[0] == '.' || text[len(text)-1] == '.' {
+		return ""
+	}
+	for _, c := range text {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') &&
+			c != '.' && c != '-' && c != '_' {
+			return ""
+		}
+	}
+	return strings.ToLower(text)
+}
+
+// The rules of a filter list divided for the pre-check
+type ruleScan struct {
+	domains   []string // the domains of "||domain^" rules and the host names of host rules
+	complex   []string // the texts of the other rules: they're matched even if the pre-check fails
+	badfilter []string // the texts of the rules disabled by $badfilter rules
+}
+
+// Read the rules of a filter list and divide them for the pre-check
+func scanRules(r io.Reader, listID int) ruleScan {
+	rs := ruleScan{}
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if len(line) != 0 && line[0] != '!' && line[0] != '#' {
+			if strings.Contains(line, "badfilter") {
+				rule, e := rules.NewNetworkRule(line, listID)
+				if e == nil && rule.IsOptionEnabled(rules.OptionBadfilter) {
+					target := badfilterTarget(line)
+					if len(target) != 0 {
+						rs.badfilter = append(rs.badfilter, target)
+					}
+				}
+			}
+
+			if d := simpleRuleDomain(line); len(d) != 0 {
+				rs.domains = append(rs.domains, d)
+			} else if hr, e := rules.NewHostRule(line, listID); e == nil {
+				for _, h := range hr.Hostnames {
+					rs.domains = append(rs.domains, strings.ToLower(h))
+				}
+			} else {
+				rs.complex = append(rs.complex, line)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return rs
+}
+
+// Create the bloom filter over the domains
+// Return nil if there are no domains.
+func newDomainsBloom(domains []string) *bloomFilter {
+	if len(domains) == 0 {
+		return nil
+	}
+	b := newBloomFilter(len(domains))
+	for _, d := range domains {
+		b.add(bloomHash(d))
+	}
+	return b
+}
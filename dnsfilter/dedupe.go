@@ -0,0 +1,188 @@
+// Dedupe of the rules across filter lists: a rule that is in a preceding list isn't added to the engine of a list
+// User rules aren't deduped: they're modified often and each modification would re-create the engines of all lists.
+
+package dnsfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/urlfilter/filterlist"
+)
+
+// The rules of the preceding lists
+// The rules are stored as 64-bit hashes of their texts to save memory:
+// the probability that a rule is removed because of a hash collision is negligible.
+type ruleDedupe struct {
+	seen map[uint64]bool
+}
+
+func newRuleDedupe() *ruleDedupe {
+	return &ruleDedupe{
+		seen: map[uint64]bool{},
+	}
+}
+
+// Get the versions of the engines for the filters (see filterVersion())
+// With dedupe the engine of a list depends on the preceding lists, so their versions are included.
+func engineVersions(filters []Filter, dedupe bool) []string {
+	versions := []string{}
+	prev := crc32.NewIEEE()
+	for _, f := range filters {
+		v := filterVersion(f)
+		if dedupe && f.ID != 0 {
+			versions = append(versions, fmt.Sprintf("%s:dedupe:%x", v, prev.Sum32()))
+			_, _ = prev.Write([]byte(v + "\n"))
+		} else {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+// Copy the rules that aren't in the set yet and add them to the set
+// Comments aren't copied.
+// Return the number of rules that are already in the set
+func (rd *ruleDedupe) filter(r io.Reader, w io.Writer) (int, error) {
+	n := 0
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if len(line) != 0 && line[0] != '!' && line[0] != '#' {
+			h := bloomHash(line)
+			if rd.seen[h] {
+				n++
+			} else {
+				rd.seen[h] = true
+				_, e := io.WriteString(w, line+"\n")
+				if e != nil {
+					return 0, e
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Add the rules of a list which engine is reused
+func (rd *ruleDedupe) addList(f Filter) error {
+	if f.ID == 0 || !fileExists(f.FilePath) {
+		return nil
+	}
+
+	if strings.HasSuffix(f.FilePath, ".gz") {
+		data, err := ioutil.ReadFile(f.FilePath)
+		if err != nil {
+			return fmt.Errorf("ioutil.ReadFile(): %s: %s", f.FilePath, err)
+		}
+		if util.IsGzip(data) {
+			data, err = util.Gunzip(data, 0)
+			if err != nil {
+				return fmt.Errorf("gunzip: %s: %s", f.FilePath, err)
+			}
+		}
+		_, err = rd.filter(bytes.NewReader(data), ioutil.Discard)
+		return err
+	}
+
+	file, err := os.Open(f.FilePath)
+	if err != nil {
+		return fmt.Errorf("os.Open(): %s: %s", f.FilePath, err)
+	}
+	defer file.Close()
+	_, err = rd.filter(file, ioutil.Discard)
+	return err
+}
+
+// Remove the rules that are in the preceding lists from the rule list of a filter and add the others to the set
+// If the rules are read from the file, the remaining rules are written to a temporary file:
+// it's kept open by the rule list and must be removed by the caller after the rules are scanned.
+// The rule list is closed if it's replaced.
+// Return the rule list, the text of the rules if they're stored in memory, the path of the temporary file
+// and the number of removed rules
+func (rd *ruleDedupe) dedupeList(f Filter, list filterlist.RuleList, data []byte) (filterlist.RuleList, []byte, string, int, error) {
+	if f.ID == 0 {
+		return list, data, "", 0, nil
+	}
+	if data != nil {
+		buf := bytes.Buffer{}
+		n, _ := rd.filter(bytes.NewReader(data), &buf)
+		if n == 0 {
+			return list, data, "", 0, nil
+		}
+		_ = list.Close()
+		data = buf.Bytes()
+		list = &filterlist.StringRuleList{
+			ID:             int(f.ID),
+			RulesText:      string(data),
+			IgnoreCosmetic: true,
+		}
+		return list, data, "", n, nil
+	}
+
+	if !fileExists(f.FilePath) {
+		return list, nil, "", 0, nil
+	}
+	file, err := os.Open(f.FilePath)
+	if err != nil {
+		_ = list.Close()
+		return nil, nil, "", 0, fmt.Errorf("os.Open(): %s: %s", f.FilePath, err)
+	}
+	defer file.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(f.FilePath), filepath.Base(f.FilePath)+".dedupe")
+	if err != nil {
+		_ = list.Close()
+		return nil, nil, "", 0, fmt.Errorf("ioutil.TempFile(): %s", err)
+	}
+	w := bufio.NewWriter(tmp)
+	n, err := rd.filter(file, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	_ = tmp.Close()
+	if err != nil || n == 0 {
+		_ = os.Remove(tmp.Name())
+		if err != nil {
+			_ = list.Close()
+			return nil, nil, "", 0, fmt.Errorf("%s: %s", tmp.Name(), err)
+		}
+		return list, nil, "", 0, nil
+	}
+
+	newList, err := filterlist.NewFileRuleList(int(f.ID), tmp.Name(), true)
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		_ = list.Close()
+		return nil, nil, "", 0, fmt.Errorf("filterlist.NewFileRuleList(): %s: %s", tmp.Name(), err)
+	}
+	_ = list.Close()
+	return newList, nil, tmp.Name(), n, nil
+}
+
+// Get the index of the last filter which engine can't be reused
+// The rules of the reused lists before it are needed to dedupe the rules of the created lists.
+// Return -1 if all engines are reused
+func lastCreated(filters []Filter, versions []string, reusable map[int64]*listEngine) int {
+	last := -1
+	for i, f := range filters {
+		le, ok := reusable[f.ID]
+		if !ok || le.version != versions[i] {
+			last = i
+		}
+	}
+	return last
+}
@@ -1,20 +1,17 @@
 package dnsfilter
 
 import (
-	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
-	"runtime"
 	"strings"
 	"sync"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/AdguardTeam/golibs/cache"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/urlfilter"
-	"github.com/AdguardTeam/urlfilter/filterlist"
 	"github.com/AdguardTeam/urlfilter/rules"
 	"github.com/miekg/dns"
 )
@@ -33,6 +30,13 @@ type RequestFilteringSettings struct {
 	ParentalEnabled     bool
 	ClientTags          []string
 	ServicesRules       []ServiceEntry
+
+	// Audit mode: the requests aren't blocked, the filtering result is only written to query log
+	AuditMode bool
+
+	// The client of the request: for expression rules
+	ClientIP string
+	ClientID string
 }
 
 // Config allows you to configure DNS filtering with New() or just change variables directly.
@@ -47,13 +51,35 @@ type Config struct {
 	ParentalCacheSize     uint `yaml:"parental_cache_size"`     // (in bytes)
 	CacheTime             uint `yaml:"cache_time"`              // Element's TTL (in minutes)
 
+	// Parental control service: DNS server that answers hash-prefix TXT requests for adult content categories
+	// Empty: the default AdGuard service is used
+	ParentalServer string `yaml:"parental_server"`
+
+	// Safe browsing service: DNS server that answers hash-prefix TXT requests for malware and phishing host names
+	// Empty: the default AdGuard service is used
+	SafeBrowsingServer string `yaml:"safebrowsing_server"`
+
+	// Memory budget for the filtering engines (in MB).  0: no limit
+	// If the old and the new engines together would exceed it, the engines are replaced list by list.
+	FiltersMemoryBudget uint32 `yaml:"filters_memory_budget"`
+
+	// Remove the rules that are in the preceding filter lists from the engine of a list
+	FiltersDedupe bool `yaml:"filters_dedupe"`
+
 	Rewrites []RewriteEntry `yaml:"rewrites"`
 
+	// Expression rules: evaluated in order after rewrites, before filter lists
+	ExprRules []ExprRule `yaml:"expression_rules"`
+
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func() `yaml:"-"`
 
 	// Register an HTTP handler
 	HTTPRegister func(string, string, func(http.ResponseWriter, *http.Request)) `yaml:"-"`
+
+	// Get IP addresses of the safe search host names from upstream servers
+	// nil: the system resolver is used
+	ResolveHost func(host string) ([]net.IPAddr, error) `yaml:"-"`
 }
 
 // LookupStats store stats collected during safebrowsing or parental checks
@@ -79,11 +105,15 @@ type filtersInitializerParams struct {
 
 // Dnsfilter holds added rules and performs hostname matches against the rules
 type Dnsfilter struct {
-	rulesStorage         *filterlist.RuleStorage
-	filteringEngine      *urlfilter.DNSEngine
-	rulesStorageWhite    *filterlist.RuleStorage
-	filteringEngineWhite *urlfilter.DNSEngine
-	engineLock           sync.RWMutex
+	engines      *engineSet // block-lists
+	enginesWhite *engineSet // allow-lists
+	engineLock   sync.RWMutex
+
+	// Serializes the changes of the engines: engineLock is held only while the new engines are swapped in
+	engineBuildLock sync.Mutex
+	swapStats       EngineSwapStats // the last replacement of the engines (protected by engineLock)
+	peakMemory      uint64          // the peak estimated memory usage of the engines (protected by engineLock)
+	peakHeapAlloc   uint64          // the peak heap size during the replacements (protected by engineLock)
 
 	parentalServer       string // access via methods
 	safeBrowsingServer   string // access via methods
@@ -103,6 +133,10 @@ type Filter struct {
 	ID       int64  // auto-assigned when filter is added (see nextFilterID)
 	Data     []byte `yaml:"-"` // List of rules divided by '\n'
 	FilePath string `yaml:"-"` // Path to a filtering rules file
+
+	// Checksum of the file data (optional).  If it's not set, the file is considered modified when its modification time or size changes.
+	// It's used to find out whether the filtering engine for this filter has to be re-created.
+	Checksum uint32 `yaml:"-"`
 }
 
 // Reason holds an enum detailing why it was filtered or not filtered
@@ -135,6 +169,13 @@ const (
 
 	// ReasonRewrite - rewrite rule was applied
 	ReasonRewrite
+
+	// NotFilteredExpression - the request is allowed by an expression rule
+	NotFilteredExpression
+	// FilteredExpression - the request is blocked by an expression rule
+	FilteredExpression
+	// FilteredQueryPolicy - the request is blocked by TLD or query type policy
+	FilteredQueryPolicy
 )
 
 var reasonNames = []string{
@@ -150,6 +191,10 @@ var reasonNames = []string{
 	"FilteredBlockedService",
 
 	"Rewrite",
+
+	"NotFilteredExpression",
+	"FilteredExpression",
+	"FilteredQueryPolicy",
 }
 
 func (r Reason) String() string {
@@ -175,6 +220,7 @@ func (d *Dnsfilter) WriteDiskConfig(c *Config) {
 	d.confLock.Lock()
 	*c = d.Config
 	c.Rewrites = rewriteArrayDup(d.Config.Rewrites)
+	c.ExprRules = exprRulesDup(d.Config.ExprRules)
 	d.confLock.Unlock()
 }
 
@@ -228,18 +274,18 @@ func (d *Dnsfilter) filtersInitializer() {
 
 // Close - close the object
 func (d *Dnsfilter) Close() {
+	d.engineBuildLock.Lock()
+	defer d.engineBuildLock.Unlock()
 	d.engineLock.Lock()
 	defer d.engineLock.Unlock()
 	d.reset()
 }
 
 func (d *Dnsfilter) reset() {
-	if d.rulesStorage != nil {
-		_ = d.rulesStorage.Close()
-	}
-	if d.rulesStorageWhite != nil {
-		d.rulesStorageWhite.Close()
-	}
+	d.engines.closeUnused(nil)
+	d.enginesWhite.closeUnused(nil)
+	d.engines = nil
+	d.enginesWhite = nil
 }
 
 type dnsFilterContext struct {
@@ -267,6 +313,58 @@ type Result struct {
 	ServiceName string `json:",omitempty"` // Name of the blocked service
 }
 
+// Names of filtering steps
+const (
+	TraceRewrites        = "rewrites"
+	TraceExprRules       = "expression_rules"
+	TraceAllowlists      = "allowlists"
+	TraceBlocklists      = "blocklists" // block-lists and user rules
+	TraceBlockedServices = "blocked_services"
+	TraceSafeSearch      = "safesearch"
+	TraceSafeBrowsing    = "safebrowsing"
+	TraceParental        = "parental"
+)
+
+// MatchedRule - a filtering rule that matched a host name
+type MatchedRule struct {
+	Text     string // Original rule text
+	FilterID int64  // Filter ID the rule belongs to
+}
+
+// TraceStep - a filtering step performed while checking a host name
+type TraceStep struct {
+	Name   string        // Step name (see Trace*)
+	Result Result        // The result of this step
+	Rules  []MatchedRule // All rules from filter lists that matched the host name on this step
+	Error  string        // The error that occurred during this step
+}
+
+// Trace - the filtering steps in the order they were performed
+// The steps for the disabled filtering features aren't performed.
+type Trace struct {
+	Steps []TraceStep
+}
+
+// Record a step.  It's safe to call it for a nil object.
+func (t *Trace) add(name string, res Result, rules []MatchedRule, err error) {
+	if t == nil {
+		return
+	}
+	step := TraceStep{Name: name, Result: res, Rules: rules}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	t.Steps = append(t.Steps, step)
+}
+
+// Record a step with the rules matched by DNS engine.  It's safe to call it for a nil object.
+func (t *Trace) addMatch(name string, res Result, rr urlfilter.DNSResult) {
+	if t == nil {
+		return
+	}
+	t.add(name, res, matchedRules(rr), nil)
+}
+
 // Matched can be used to see if any match at all was found, no matter filtered or not
 func (r Reason) Matched() bool {
 	return r != NotFilteredNotFound
@@ -278,29 +376,50 @@ func (d *Dnsfilter) CheckHostRules(host string, qtype uint16, setts *RequestFilt
 		return Result{}, nil
 	}
 
-	return d.matchHost(host, qtype, setts.ClientTags)
+	return d.matchHost(host, qtype, setts.ClientTags, nil)
 }
 
 // CheckHost tries to match the host against filtering rules,
 // then safebrowsing and parental if they are enabled
 func (d *Dnsfilter) CheckHost(host string, qtype uint16, setts *RequestFilteringSettings) (Result, error) {
+	return d.checkHost(host, qtype, setts, nil)
+}
+
+// CheckHostTrace checks the host just like CheckHost does and returns the filtering steps that were performed
+func (d *Dnsfilter) CheckHostTrace(host string, qtype uint16, setts *RequestFilteringSettings) (Result, Trace, error) {
+	trace := Trace{}
+	res, err := d.checkHost(host, qtype, setts, &trace)
+	return res, trace, err
+}
+
+func (d *Dnsfilter) checkHost(host string, qtype uint16, setts *RequestFilteringSettings, trace *Trace) (Result, error) {
 	// sometimes DNS clients will try to resolve ".", which is a request to get root servers
 	if host == "" {
 		return Result{Reason: NotFilteredNotFound}, nil
 	}
-	host = strings.ToLower(host)
+	// the rules and the rewrites use punycode, just like DNS queries do
+	host = util.ToPunycode(strings.ToLower(host))
 
 	var result Result
 	var err error
 
-	result = d.processRewrites(host)
+	result = d.processRewrites(host, qtype)
+	trace.add(TraceRewrites, result, nil, nil)
 	if result.Reason == ReasonRewrite {
 		return result, nil
 	}
 
+	if setts.FilteringEnabled && d.hasExprRules() {
+		result = d.processExprRules(host, qtype, setts)
+		trace.add(TraceExprRules, result, nil, nil)
+		if result.Reason.Matched() {
+			return result, nil
+		}
+	}
+
 	// try filter lists first
 	if setts.FilteringEnabled {
-		result, err = d.matchHost(host, qtype, setts.ClientTags)
+		result, err = d.matchHost(host, qtype, setts.ClientTags, trace)
 		if err != nil {
 			return result, err
 		}
@@ -311,6 +430,7 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, setts *RequestFiltering
 
 	if len(setts.ServicesRules) != 0 {
 		result = matchBlockedServicesRules(host, setts.ServicesRules)
+		trace.add(TraceBlockedServices, result, nil, nil)
 		if result.Reason.Matched() {
 			return result, nil
 		}
@@ -318,6 +438,7 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, setts *RequestFiltering
 
 	if setts.SafeSearchEnabled {
 		result, err = d.checkSafeSearch(host)
+		trace.add(TraceSafeSearch, result, nil, err)
 		if err != nil {
 			log.Info("SafeSearch: failed: %v", err)
 			return Result{}, nil
@@ -330,6 +451,7 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, setts *RequestFiltering
 
 	if setts.SafeBrowsingEnabled {
 		result, err = d.checkSafeBrowsing(host)
+		trace.add(TraceSafeBrowsing, result, nil, err)
 		if err != nil {
 			log.Info("SafeBrowsing: failed: %v", err)
 			return Result{}, nil
@@ -341,6 +463,7 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, setts *RequestFiltering
 
 	if setts.ParentalEnabled {
 		result, err = d.checkParental(host)
+		trace.add(TraceParental, result, nil, err)
 		if err != nil {
 			log.Printf("Parental: failed: %v", err)
 			return Result{}, nil
@@ -354,18 +477,19 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, setts *RequestFiltering
 }
 
 // Process rewrites table
-// . Find CNAME for a domain name (exact match or by wildcard)
+// . Find CNAME for a domain name (exact match, by wildcard or by regular expression)
 //  . if found, set domain name to canonical name
 //  . repeat for the new domain name (Note: we return only the last CNAME)
-// . Find A or AAAA record for a domain name (exact match or by wildcard)
+// . Find A or AAAA record for a domain name (exact match, by wildcard or by regular expression)
 //  . if found, return IP addresses (both IPv4 and IPv6)
-func (d *Dnsfilter) processRewrites(host string) Result {
+// The entries for another request type are skipped.
+func (d *Dnsfilter) processRewrites(host string, qtype uint16) Result {
 	var res Result
 
 	d.confLock.RLock()
 	defer d.confLock.RUnlock()
 
-	rr := findRewrites(d.Rewrites, host)
+	rr := findRewrites(d.Rewrites, host, qtype)
 	if len(rr) != 0 {
 		res.Reason = ReasonRewrite
 	}
@@ -373,16 +497,16 @@ func (d *Dnsfilter) processRewrites(host string) Result {
 	cnames := map[string]bool{}
 	origHost := host
 	for len(rr) != 0 && rr[0].Type == dns.TypeCNAME {
-		log.Debug("Rewrite: CNAME for %s is %s", host, rr[0].Answer)
-		host = rr[0].Answer
+		log.Debug("Rewrite: CNAME for %s is %s", host, rr[0].canonName)
+		host = rr[0].canonName
 		_, ok := cnames[host]
 		if ok {
 			log.Info("Rewrite: breaking CNAME redirection loop: %s.  Question: %s", host, origHost)
 			return res
 		}
 		cnames[host] = false
-		res.CanonName = rr[0].Answer
-		rr = findRewrites(d.Rewrites, host)
+		res.CanonName = rr[0].canonName
+		rr = findRewrites(d.Rewrites, host, qtype)
 	}
 
 	for _, r := range rr {
@@ -428,86 +552,44 @@ func fileExists(fn string) bool {
 	return true
 }
 
-func createFilteringEngine(filters []Filter) (*filterlist.RuleStorage, *urlfilter.DNSEngine, error) {
-	listArray := []filterlist.RuleList{}
-	for _, f := range filters {
-		var list filterlist.RuleList
-
-		if f.ID == 0 {
-			list = &filterlist.StringRuleList{
-				ID:             0,
-				RulesText:      string(f.Data),
-				IgnoreCosmetic: true,
-			}
-
-		} else if !fileExists(f.FilePath) {
-			list = &filterlist.StringRuleList{
-				ID:             int(f.ID),
-				IgnoreCosmetic: true,
-			}
-
-		} else if runtime.GOOS == "windows" {
-			// On Windows we don't pass a file to urlfilter because
-			//  it's difficult to update this file while it's being used.
-			data, err := ioutil.ReadFile(f.FilePath)
-			if err != nil {
-				return nil, nil, fmt.Errorf("ioutil.ReadFile(): %s: %s", f.FilePath, err)
-			}
-			list = &filterlist.StringRuleList{
-				ID:             int(f.ID),
-				RulesText:      string(data),
-				IgnoreCosmetic: true,
-			}
-
-		} else {
-			var err error
-			list, err = filterlist.NewFileRuleList(int(f.ID), f.FilePath, true)
-			if err != nil {
-				return nil, nil, fmt.Errorf("filterlist.NewFileRuleList(): %s: %s", f.FilePath, err)
-			}
-		}
-		listArray = append(listArray, list)
-	}
-
-	rulesStorage, err := filterlist.NewRuleStorage(listArray)
-	if err != nil {
-		return nil, nil, fmt.Errorf("filterlist.NewRuleStorage(): %s", err)
-	}
-	filteringEngine := urlfilter.NewDNSEngine(rulesStorage)
-	return rulesStorage, filteringEngine, nil
-}
-
 // Initialize urlfilter objects
+// Only the engines for new and modified filters are created, the others are reused.
+// The filtering isn't locked while the engines are created (see swapEngines()).
 func (d *Dnsfilter) initFiltering(allowFilters, blockFilters []Filter) error {
-	d.engineLock.Lock()
-	defer d.engineLock.Unlock()
-	d.reset()
-	rulesStorage, filteringEngine, err := createFilteringEngine(blockFilters)
-	if err != nil {
-		return err
-	}
-	rulesStorageWhite, filteringEngineWhite, err := createFilteringEngine(allowFilters)
+	err := d.swapEngines(allowFilters, blockFilters)
 	if err != nil {
 		return err
 	}
-	d.rulesStorage = rulesStorage
-	d.filteringEngine = filteringEngine
-	d.rulesStorageWhite = rulesStorageWhite
-	d.filteringEngineWhite = filteringEngineWhite
 	log.Debug("initialized filtering engine")
 
 	return nil
 }
 
+// Get all rules from the result of DNS engine
+func matchedRules(rr urlfilter.DNSResult) []MatchedRule {
+	var list []MatchedRule
+	if rr.NetworkRule != nil {
+		list = append(list, MatchedRule{Text: rr.NetworkRule.Text(), FilterID: int64(rr.NetworkRule.GetFilterListID())})
+	}
+	for _, r := range rr.HostRulesV4 {
+		list = append(list, MatchedRule{Text: r.Text(), FilterID: int64(r.GetFilterListID())})
+	}
+	for _, r := range rr.HostRulesV6 {
+		list = append(list, MatchedRule{Text: r.Text(), FilterID: int64(r.GetFilterListID())})
+	}
+	return list
+}
+
 // matchHost is a low-level way to check only if hostname is filtered by rules, skipping expensive safebrowsing and parental lookups
-func (d *Dnsfilter) matchHost(host string, qtype uint16, ctags []string) (Result, error) {
+// trace: record the steps (may be nil)
+func (d *Dnsfilter) matchHost(host string, qtype uint16, ctags []string, trace *Trace) (Result, error) {
 	d.engineLock.RLock()
 	// Keep in mind that this lock must be held no just when calling Match()
 	//  but also while using the rules returned by it.
 	defer d.engineLock.RUnlock()
 
-	if d.filteringEngineWhite != nil {
-		rr, ok := d.filteringEngineWhite.Match(host, ctags)
+	if d.enginesWhite != nil {
+		rr, ok := d.enginesWhite.match(host, ctags)
 		if ok {
 			var rule rules.Rule
 			if rr.NetworkRule != nil {
@@ -521,19 +603,30 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16, ctags []string) (Result
 			log.Debug("Filtering: found whitelist rule for host '%s': '%s'  list_id: %d",
 				host, rule.Text(), rule.GetFilterListID())
 			res := makeResult(rule, NotFilteredWhiteList)
+			trace.addMatch(TraceAllowlists, res, rr)
 			return res, nil
 		}
+		trace.add(TraceAllowlists, Result{}, nil, nil)
 	}
 
-	if d.filteringEngine == nil {
+	if d.engines == nil {
+		trace.add(TraceBlocklists, Result{}, nil, nil)
 		return Result{}, nil
 	}
 
-	rr, ok := d.filteringEngine.Match(host, ctags)
+	rr, ok := d.engines.match(host, ctags)
 	if !ok {
+		trace.add(TraceBlocklists, Result{}, nil, nil)
 		return Result{}, nil
 	}
 
+	res := matchResult(host, qtype, rr)
+	trace.addMatch(TraceBlocklists, res, rr)
+	return res, nil
+}
+
+// Get the result for the rules matched by block-lists engine
+func matchResult(host string, qtype uint16, rr urlfilter.DNSResult) Result {
 	if rr.NetworkRule != nil {
 		log.Debug("Filtering: found rule for host '%s': '%s'  list_id: %d",
 			host, rr.NetworkRule.Text(), rr.NetworkRule.GetFilterListID())
@@ -542,7 +635,7 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16, ctags []string) (Result
 			reason = NotFilteredWhiteList
 		}
 		res := makeResult(rr.NetworkRule, reason)
-		return res, nil
+		return res
 	}
 
 	if qtype == dns.TypeA && rr.HostRulesV4 != nil {
@@ -551,7 +644,7 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16, ctags []string) (Result
 			host, rule.Text(), rule.GetFilterListID())
 		res := makeResult(rule, FilteredBlackList)
 		res.IP = rule.IP.To4()
-		return res, nil
+		return res
 	}
 
 	if qtype == dns.TypeAAAA && rr.HostRulesV6 != nil {
@@ -560,7 +653,7 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16, ctags []string) (Result
 			host, rule.Text(), rule.GetFilterListID())
 		res := makeResult(rule, FilteredBlackList)
 		res.IP = rule.IP
-		return res, nil
+		return res
 	}
 
 	if rr.HostRulesV4 != nil || rr.HostRulesV6 != nil {
@@ -576,10 +669,10 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16, ctags []string) (Result
 			host, rule.Text(), rule.GetFilterListID())
 		res := makeResult(rule, FilteredBlackList)
 		res.IP = net.IP{}
-		return res, nil
+		return res
 	}
 
-	return Result{}, nil
+	return Result{}
 }
 
 // Construct Result object
@@ -622,17 +715,18 @@ func New(c *Config, blockFilters []Filter) *Dnsfilter {
 
 	d := new(Dnsfilter)
 
+	if c != nil {
+		d.Config = *c
+		d.prepareRewrites()
+		d.prepareExprRules()
+	}
+
 	err := d.initSecurityServices()
 	if err != nil {
 		log.Error("dnsfilter: initialize services: %s", err)
 		return nil
 	}
 
-	if c != nil {
-		d.Config = *c
-		d.prepareRewrites()
-	}
-
 	if blockFilters != nil {
 		err := d.initFiltering(nil, blockFilters)
 		if err != nil {
@@ -655,6 +749,7 @@ func (d *Dnsfilter) Start() {
 	if d.Config.HTTPRegister != nil { // for tests
 		d.registerSecurityHandlers()
 		d.registerRewritesHandlers()
+		d.registerExprRulesHandlers()
 	}
 }
 
@@ -2,11 +2,17 @@ package dnsfilter
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"path"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/AdguardTeam/urlfilter/rules"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -191,6 +197,35 @@ func TestSafeSearch(t *testing.T) {
 	}
 }
 
+func TestSafeSearchResolveHost(t *testing.T) {
+	d := NewForTest(&Config{SafeSearchEnabled: true}, nil)
+	defer d.Close()
+	resolved := []string{}
+	d.ResolveHost = func(host string) ([]net.IPAddr, error) {
+		resolved = append(resolved, host)
+		return []net.IPAddr{{IP: net.ParseIP("::1")}, {IP: net.IP{1, 2, 3, 4}}}, nil
+	}
+
+	result, err := d.CheckHost("www.bing.com", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.True(t, result.IsFiltered)
+	assert.Equal(t, FilteredSafeSearch, result.Reason)
+	assert.Equal(t, "1.2.3.4", result.IP.String())
+	assert.Equal(t, []string{"strict.bing.com"}, resolved)
+
+	// the result is taken from cache
+	result, err = d.CheckHost("www.bing.com", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3.4", result.IP.String())
+	assert.Equal(t, 1, len(resolved))
+
+	// the addresses aren't needed for the services with the fixed IP
+	result, err = d.CheckHost("yandex.ru", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.Equal(t, "213.180.193.56", result.IP.String())
+	assert.Equal(t, 1, len(resolved))
+}
+
 func TestCheckHostSafeSearchYandex(t *testing.T) {
 	d := NewForTest(&Config{SafeSearchEnabled: true}, nil)
 	defer d.Close()
@@ -348,6 +383,25 @@ func TestParentalControl(t *testing.T) {
 	d.parentalServer = defaultParentalServer
 }
 
+func TestParentalServer(t *testing.T) {
+	d := NewForTest(&Config{ParentalEnabled: true, ParentalServer: "tls://127.0.0.1"}, nil)
+	defer d.Close()
+	assert.Equal(t, "tls://127.0.0.1", d.parentalServer)
+	assert.Equal(t, "127.0.0.1:853", d.parentalUpstream.Address())
+
+	d2 := NewForTest(&Config{ParentalEnabled: true}, nil)
+	defer d2.Close()
+	assert.Equal(t, defaultParentalServer, d2.parentalServer)
+}
+
+func TestSafeBrowsingServer(t *testing.T) {
+	d := NewForTest(&Config{SafeBrowsingEnabled: true, SafeBrowsingServer: "tls://127.0.0.1"}, nil)
+	defer d.Close()
+	assert.Equal(t, "tls://127.0.0.1", d.safeBrowsingServer)
+	assert.Equal(t, "127.0.0.1:853", d.safeBrowsingUpstream.Address())
+	assert.Equal(t, defaultParentalServer, d.parentalServer)
+}
+
 // FILTERING
 
 var blockingRules = "||example.org^\n"
@@ -457,6 +511,401 @@ func TestWhitelist(t *testing.T) {
 
 }
 
+func TestClientTags(t *testing.T) {
+	rules := `||host1^$ctag=device_tv|user_child
+||host2^$ctag=~os_ios
+||host3^
+@@||host3^$ctag=user_admin
+`
+	filters := []Filter{Filter{
+		ID: 0, Data: []byte(rules),
+	}}
+	d := NewForTest(nil, filters)
+	defer d.Close()
+
+	check := func(host string, tags []string) bool {
+		s := RequestFilteringSettings{FilteringEnabled: true, ClientTags: tags}
+		ret, err := d.CheckHost(host, dns.TypeA, &s)
+		assert.Nil(t, err)
+		return ret.IsFiltered
+	}
+
+	// the rule is applied to the clients with any of the tags
+	assert.True(t, check("host1", []string{"device_tv"}))
+	assert.True(t, check("host1", []string{"device_pc", "user_child"}))
+	assert.False(t, check("host1", []string{"device_pc"}))
+	assert.False(t, check("host1", nil))
+
+	// the rule is applied to all tagged clients except the ones with the tag
+	assert.True(t, check("host2", []string{"os_android"}))
+	assert.False(t, check("host2", nil))
+	assert.False(t, check("host2", []string{"device_phone", "os_ios"}))
+
+	// the exception is applied to the clients with the tag
+	assert.True(t, check("host3", []string{"user_child"}))
+	assert.False(t, check("host3", []string{"user_admin"}))
+}
+
+func TestCompressedFilterFile(t *testing.T) {
+	data, _ := util.Gzip([]byte("||host1^\n"))
+	dir, _ := ioutil.TempDir("", "dnsfilter")
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "filter-test.txt.gz")
+	_ = ioutil.WriteFile(fn, data, 0644)
+
+	filters := []Filter{Filter{
+		ID: 1, FilePath: fn,
+	}}
+	d := NewForTest(nil, filters)
+	defer d.Close()
+
+	ret, err := d.CheckHost("host1", dns.TypeA, &setts)
+	assert.True(t, err == nil)
+	assert.True(t, ret.IsFiltered && ret.FilterID == 1)
+	d.checkMatchEmpty(t, "host2")
+}
+
+func TestCheckHostTrace(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dnsfilter")
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := func(id int64, data string) Filter {
+		f := Filter{ID: id, FilePath: filepath.Join(dir, fmt.Sprintf("%d.txt", id))}
+		_ = ioutil.WriteFile(f.FilePath, []byte(data), 0644)
+		return f
+	}
+	filters := []Filter{fn(1, "||host1^\n||host2^\n"), fn(2, "0.0.0.0 host3\n::1 host3\n")}
+	whiteFilters := []Filter{fn(3, "||host1^\n")}
+	d := NewForTest(nil, filters)
+	d.SetFilters(filters, whiteFilters, false)
+	defer d.Close()
+
+	rule, _ := rules.NewNetworkRule("||host4^", 0)
+	setts := RequestFilteringSettings{FilteringEnabled: true}
+	setts.ServicesRules = []ServiceEntry{{Name: "service", Rules: []*rules.NetworkRule{rule}}}
+
+	// matched by white filter: the next steps aren't performed
+	ret, trace, err := d.CheckHostTrace("host1", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.Equal(t, NotFilteredWhiteList, ret.Reason)
+	assert.Equal(t, 2, len(trace.Steps))
+	assert.Equal(t, TraceRewrites, trace.Steps[0].Name)
+	assert.Equal(t, TraceAllowlists, trace.Steps[1].Name)
+	assert.Equal(t, []MatchedRule{{Text: "||host1^", FilterID: 3}}, trace.Steps[1].Rules)
+
+	ret, trace, err = d.CheckHostTrace("host2", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.True(t, ret.IsFiltered && ret.FilterID == 1)
+	assert.Equal(t, 3, len(trace.Steps))
+	assert.Equal(t, TraceBlocklists, trace.Steps[2].Name)
+	assert.Equal(t, ret, trace.Steps[2].Result)
+	assert.Equal(t, []MatchedRule{{Text: "||host2^", FilterID: 1}}, trace.Steps[2].Rules)
+
+	// all matched host rules are returned
+	ret, trace, err = d.CheckHostTrace("host3", dns.TypeAAAA, &setts)
+	assert.Nil(t, err)
+	assert.Equal(t, "::1 host3", ret.Rule)
+	assert.Equal(t, []MatchedRule{{Text: "0.0.0.0 host3", FilterID: 2}, {Text: "::1 host3", FilterID: 2}}, trace.Steps[2].Rules)
+
+	// the result is the same as the one returned by CheckHost()
+	ret2, _ := d.CheckHost("host3", dns.TypeAAAA, &setts)
+	assert.Equal(t, ret2, ret)
+
+	ret, trace, err = d.CheckHostTrace("host4", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.Equal(t, FilteredBlockedService, ret.Reason)
+	assert.Equal(t, 4, len(trace.Steps))
+	assert.Equal(t, TraceBlockedServices, trace.Steps[3].Name)
+	assert.Equal(t, "service", trace.Steps[3].Result.ServiceName)
+	assert.Equal(t, 0, len(trace.Steps[2].Rules))
+}
+
+func TestEngineSet(t *testing.T) {
+	assert.Equal(t, "||host^$important", badfilterTarget("||host^$important,badfilter"))
+	assert.Equal(t, "||host^", badfilterTarget("||host^$badfilter"))
+	assert.Equal(t, "", badfilterTarget("||host^$important"))
+
+	dir, _ := ioutil.TempDir("", "dnsfilter")
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := func(id int64, data string) Filter {
+		f := Filter{ID: id, FilePath: filepath.Join(dir, fmt.Sprintf("%d.txt", id))}
+		_ = ioutil.WriteFile(f.FilePath, []byte(data), 0644)
+		return f
+	}
+	filters := []Filter{
+		{ID: 0, Data: []byte("@@||host2^\n||host5^$badfilter\n")},
+		fn(1, "||host1^\n||host2^\n||host5^\n"),
+		fn(2, "0.0.0.0 host3\n||host1^$important\n"),
+	}
+	d := NewForTest(nil, filters)
+	defer d.Close()
+
+	// the rules of all lists are matched together
+	ret, err := d.CheckHost("host1", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.True(t, ret.IsFiltered)
+	assert.Equal(t, int64(2), ret.FilterID)
+	assert.Equal(t, "||host1^$important", ret.Rule)
+
+	ret, err = d.CheckHost("host2", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.Equal(t, NotFilteredWhiteList, ret.Reason)
+	assert.Equal(t, int64(0), ret.FilterID)
+
+	d.checkMatchEmpty(t, "host5")
+
+	ret, err = d.CheckHost("host3", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.True(t, ret.IsFiltered)
+	assert.Equal(t, "0.0.0.0 host3", ret.Rule)
+
+	// only the engines for the modified filters are re-created
+	prev := append([]*listEngine{}, d.engines.lists...)
+	filters[0].Data = []byte("||host4^\n")
+	filters[2].Checksum = 1
+	assert.Nil(t, d.SetFilters(filters, nil, false))
+	assert.Equal(t, 3, len(d.engines.lists))
+	assert.True(t, prev[0] != d.engines.lists[0])
+	assert.True(t, prev[1] == d.engines.lists[1])
+	assert.True(t, prev[2] != d.engines.lists[2])
+	d.checkMatch(t, "host4")
+	d.checkMatch(t, "host2")
+	d.checkMatch(t, "host5")
+
+	// an unchanged checksum means that the data hasn't changed
+	prev = append([]*listEngine{}, d.engines.lists...)
+	assert.Nil(t, d.SetFilters(filters, nil, false))
+	assert.True(t, prev[2] == d.engines.lists[2])
+
+	assert.NotNil(t, d.SetFilters(append(filters, filters[1]), nil, false))
+	d.checkMatch(t, "host1")
+}
+
+func TestEngineSwap(t *testing.T) {
+	filters := []Filter{
+		{ID: 0, Data: []byte("||host1^\n")},
+	}
+	allow := []Filter{
+		{ID: 0, Data: []byte("@@||host2^\n")},
+	}
+	d := NewForTest(nil, filters)
+	defer d.Close()
+	assert.Nil(t, d.SetFilters(filters, allow, false))
+	prof := d.Profile()
+	assert.Equal(t, swapParallel, prof.LastSwap.Strategy)
+	assert.Equal(t, 1, prof.LastSwap.Created)
+	assert.True(t, prof.PeakHeapAlloc != 0)
+	d.checkMatch(t, "host1")
+
+	// the requests are matched while the engines are replaced
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				done <- true
+				return
+			default:
+				_, _ = d.CheckHost("host1", dns.TypeA, &setts)
+			}
+		}
+	}()
+	for i := 0; i != 10; i++ {
+		filters[0].Data = []byte(fmt.Sprintf("||host1^\n||host%d^\n", i+10))
+		assert.Nil(t, d.SetFilters(filters, allow, false))
+	}
+	stop <- true
+	<-done
+	d.checkMatch(t, "host19")
+
+	// the memory budget is exceeded: the engines are replaced list by list
+	d.FiltersMemoryBudget = 1
+	d.engines.lists[0].memory = 2 * 1024 * 1024
+	old := d.enginesWhite.lists[0]
+	filters[0].Data = []byte("||host3^\n")
+	assert.Nil(t, d.SetFilters(filters, allow, false))
+	prof = d.Profile()
+	assert.Equal(t, swapListByList, prof.LastSwap.Strategy)
+	assert.Equal(t, 1, prof.LastSwap.Created)
+	assert.True(t, prof.PeakMemory >= 2*1024*1024)
+	assert.True(t, old == d.enginesWhite.lists[0])
+	d.checkMatch(t, "host3")
+	d.checkMatchEmpty(t, "host1")
+	ret, err := d.CheckHost("host2", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.Equal(t, NotFilteredWhiteList, ret.Reason)
+
+	// the removed lists
+	assert.Nil(t, d.SetFilters(filters, nil, false))
+	assert.Equal(t, 0, len(d.enginesWhite.lists))
+	assert.NotNil(t, d.SetFilters(append(filters, filters[0]), nil, false))
+}
+
+func TestBloomPrecheck(t *testing.T) {
+	assert.Equal(t, "example.org", simpleRuleDomain("||Example.org^"))
+	assert.Equal(t, "example.org", simpleRuleDomain("@@||example.org^|"))
+	assert.Equal(t, "example.org", simpleRuleDomain("||example.org^$important,ctag=device_pc"))
+	assert.Equal(t, "", simpleRuleDomain("||example.org^$badfilter"))
+	assert.Equal(t, "", simpleRuleDomain("||example.org"))
+	assert.Equal(t, "", simpleRuleDomain("||*.example.org^"))
+	assert.Equal(t, "", simpleRuleDomain("||.example.org^"))
+	assert.Equal(t, "", simpleRuleDomain("|example.org^"))
+	assert.Equal(t, "", simpleRuleDomain("/example/"))
+
+	rs := scanRules(strings.NewReader(`! comment
+# comment
+||host1^
+0.0.0.0 host2 Host3
+host4.org
+/ads[0-9]/
+||host5^$badfilter
+`), 1)
+	assert.Equal(t, []string{"host1", "host2", "host3", "host4.org"}, rs.domains)
+	assert.Equal(t, []string{"/ads[0-9]/", "||host5^$badfilter"}, rs.complex)
+	assert.Equal(t, []string{"||host5^"}, rs.badfilter)
+
+	b := newDomainsBloom([]string{"example.org", "host"})
+	assert.True(t, b.hasAny(hostHashes("example.org")))
+	assert.True(t, b.hasAny(hostHashes("sub.Example.org")))
+	assert.True(t, b.hasAny(hostHashes("host")))
+	assert.False(t, b.hasAny(hostHashes("example.com")))
+	assert.False(t, b.hasAny(hostHashes("example.org.com")))
+	var empty *bloomFilter
+	assert.False(t, empty.hasAny(hostHashes("example.org")))
+
+	// the result with the pre-check is the same as the result of the full engine
+	data := "||host1^\n@@||allowed.host1^\n0.0.0.0 host2\n/^ads[0-9]+\\./\n||host3^$important\n||host3^$important,badfilter\n" +
+		"||host4*^\n"
+	le, err := newListEngine(Filter{ID: 0, Data: []byte(data)}, "", nil)
+	assert.Nil(t, err)
+	defer le.close()
+	assert.NotNil(t, le.bloom)
+	assert.NotNil(t, le.complex)
+	for _, h := range []string{"host1", "sub.host1", "allowed.host1", "xhost1", "host2", "sub.host2", "ads1.example.org",
+		"host3", "host4.org", "host5", "host1.org"} {
+		rr1, ok1 := le.engine.Match(h, nil)
+		rr2, ok2 := le.match(h, nil, hostHashes(h))
+		assert.Equal(t, ok1, ok2, h)
+		assert.Equal(t, matchedRules(rr1), matchedRules(rr2), h)
+	}
+}
+
+func TestFiltersDedupe(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dnsfilter")
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := func(id int64, data string) Filter {
+		f := Filter{ID: id, FilePath: filepath.Join(dir, fmt.Sprintf("%d.txt", id))}
+		_ = ioutil.WriteFile(f.FilePath, []byte(data), 0644)
+		return f
+	}
+	filterID := func(d *Dnsfilter, host string) int64 {
+		ret, err := d.CheckHost(host, dns.TypeA, &setts)
+		assert.Nil(t, err)
+		assert.Equal(t, FilteredBlackList, ret.Reason, host)
+		return ret.FilterID
+	}
+	duplicates := func(d *Dnsfilter) []int {
+		list := []int{}
+		for _, le := range d.engines.lists {
+			list = append(list, le.duplicates)
+		}
+		return list
+	}
+
+	filters := []Filter{
+		{ID: 0, Data: []byte("||host1^\n||host1^\n")},
+		fn(1, "||host1^\n||host2^\n||host2^\n"),
+		fn(2, "! comment\n||host2^\n||host3^\n"),
+	}
+	d := NewForTest(&Config{FiltersDedupe: true}, filters)
+	defer d.Close()
+	// user rules aren't deduped
+	assert.Equal(t, []int{0, 1, 1}, duplicates(d))
+	assert.Equal(t, 1, d.engines.lists[2].engine.RulesCount)
+	assert.Equal(t, 2, d.Profile().Duplicates)
+	assert.Equal(t, int64(0), filterID(d, "host1"))
+	assert.Equal(t, int64(1), filterID(d, "host2"))
+	assert.Equal(t, int64(2), filterID(d, "host3"))
+	// the temporary files are removed
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 2, len(files))
+
+	// the lists are reused when user rules are modified
+	le := d.engines.lists[1]
+	filters[0].Data = []byte("||host9^\n")
+	assert.Nil(t, d.SetFilters(filters, nil, false))
+	assert.True(t, le == d.engines.lists[1])
+
+	// the rules of the reused lists are used to dedupe the modified list
+	filters[2] = fn(2, "||host1^\n||host5^\n")
+	assert.Nil(t, d.SetFilters(filters, nil, false))
+	assert.True(t, le == d.engines.lists[1])
+	assert.Equal(t, []int{0, 1, 1}, duplicates(d))
+	assert.Equal(t, int64(2), filterID(d, "host5"))
+
+	// the lists after the modified list are re-created
+	filters[1] = fn(1, "||host5^\n")
+	assert.Nil(t, d.SetFilters(filters, nil, false))
+	assert.Equal(t, []int{0, 0, 1}, duplicates(d))
+	assert.Equal(t, int64(1), filterID(d, "host5"))
+	assert.Equal(t, int64(2), filterID(d, "host1"))
+
+	d.FiltersDedupe = false
+	assert.Nil(t, d.SetFilters(filters, nil, false))
+	assert.Equal(t, []int{0, 0, 0}, duplicates(d))
+	assert.Equal(t, 2, d.engines.lists[2].engine.RulesCount)
+}
+
+func TestEngineProfile(t *testing.T) {
+	assert.Equal(t, time.Duration(0), percentile(nil, 50))
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	assert.Equal(t, time.Duration(5), percentile(sorted, 50))
+	assert.Equal(t, time.Duration(9), percentile(sorted, 90))
+	assert.Equal(t, time.Duration(10), percentile(sorted, 99))
+
+	// the ring buffer keeps the latest durations
+	p := listProfile{}
+	for i := 0; i != profileSamples+2; i++ {
+		p.add(time.Duration(i))
+	}
+	durations, n := p.get()
+	assert.Equal(t, uint64(profileSamples+2), n)
+	assert.Equal(t, profileSamples, len(durations))
+	assert.Equal(t, time.Duration(profileSamples), durations[0])
+	assert.Equal(t, time.Duration(profileSamples+1), durations[1])
+
+	filters := []Filter{
+		{ID: 0, Data: []byte("||host1^\n||host2^\n")},
+		{ID: 0, Data: []byte("@@||host3^\n")},
+	}
+	d := NewForTest(nil, filters[:1])
+	defer d.Close()
+	assert.Nil(t, d.SetFilters(filters[:1], filters[1:], false))
+
+	// 1 of profileSampleRate requests is measured
+	for i := 0; i != 2*profileSampleRate; i++ {
+		d.checkMatch(t, "host1")
+	}
+	prof := d.Profile()
+	assert.Equal(t, profileSampleRate, prof.SampleRate)
+	assert.Equal(t, 2, len(prof.Lists))
+	assert.True(t, prof.Lists[0].Allowlist)
+	assert.Equal(t, 1, prof.Lists[0].RulesCount)
+	assert.Equal(t, uint64(2), prof.Lists[0].Matches)
+	assert.False(t, prof.Lists[1].Allowlist)
+	assert.Equal(t, 2, prof.Lists[1].RulesCount)
+	assert.Equal(t, uint64(2), prof.Lists[1].Matches)
+	assert.Equal(t, 2, prof.Lists[1].Samples)
+	assert.True(t, prof.Lists[1].P50 <= prof.Lists[1].Max)
+	assert.True(t, prof.HeapAlloc != 0)
+
+	prof = d.Benchmark([]string{"host1", "host4"}, 3)
+	assert.Equal(t, 2, len(prof.Lists))
+	assert.Equal(t, uint64(6), prof.Lists[1].Matches)
+	assert.Equal(t, 6, prof.Lists[1].Samples)
+	assert.True(t, prof.Lists[1].P99 <= prof.Lists[1].Max)
+}
+
 // CLIENT SETTINGS
 
 func applyClientSettings(setts *RequestFilteringSettings) {
@@ -535,19 +984,19 @@ func TestRewrites(t *testing.T) {
 	d := Dnsfilter{}
 	// CNAME, A, AAAA
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"somecname", "somehost.com", 0, nil},
-		RewriteEntry{"somehost.com", "0.0.0.0", 0, nil},
+		RewriteEntry{Domain: "somecname", Answer: "somehost.com"},
+		RewriteEntry{Domain: "somehost.com", Answer: "0.0.0.0"},
 
-		RewriteEntry{"host.com", "1.2.3.4", 0, nil},
-		RewriteEntry{"host.com", "1.2.3.5", 0, nil},
-		RewriteEntry{"host.com", "1:2:3::4", 0, nil},
-		RewriteEntry{"www.host.com", "host.com", 0, nil},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.5"},
+		RewriteEntry{Domain: "host.com", Answer: "1:2:3::4"},
+		RewriteEntry{Domain: "www.host.com", Answer: "host.com"},
 	}
 	d.prepareRewrites()
-	r := d.processRewrites("host2.com")
+	r := d.processRewrites("host2.com", dns.TypeA)
 	assert.Equal(t, NotFilteredNotFound, r.Reason)
 
-	r = d.processRewrites("www.host.com")
+	r = d.processRewrites("www.host.com", dns.TypeA)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, "host.com", r.CanonName)
 	assert.True(t, len(r.IPList) == 3)
@@ -557,51 +1006,51 @@ func TestRewrites(t *testing.T) {
 
 	// wildcard
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"host.com", "1.2.3.4", 0, nil},
-		RewriteEntry{"*.host.com", "1.2.3.5", 0, nil},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "*.host.com", Answer: "1.2.3.5"},
 	}
 	d.prepareRewrites()
-	r = d.processRewrites("host.com")
+	r = d.processRewrites("host.com", dns.TypeA)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.True(t, r.IPList[0].Equal(net.ParseIP("1.2.3.4")))
 
-	r = d.processRewrites("www.host.com")
+	r = d.processRewrites("www.host.com", dns.TypeA)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.True(t, r.IPList[0].Equal(net.ParseIP("1.2.3.5")))
 
-	r = d.processRewrites("www.host2.com")
+	r = d.processRewrites("www.host2.com", dns.TypeA)
 	assert.Equal(t, NotFilteredNotFound, r.Reason)
 
 	// override a wildcard
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"a.host.com", "1.2.3.4", 0, nil},
-		RewriteEntry{"*.host.com", "1.2.3.5", 0, nil},
+		RewriteEntry{Domain: "a.host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "*.host.com", Answer: "1.2.3.5"},
 	}
 	d.prepareRewrites()
-	r = d.processRewrites("a.host.com")
+	r = d.processRewrites("a.host.com", dns.TypeA)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.True(t, len(r.IPList) == 1)
 	assert.True(t, r.IPList[0].Equal(net.ParseIP("1.2.3.4")))
 
 	// wildcard + CNAME
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"host.com", "1.2.3.4", 0, nil},
-		RewriteEntry{"*.host.com", "host.com", 0, nil},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
+		RewriteEntry{Domain: "*.host.com", Answer: "host.com"},
 	}
 	d.prepareRewrites()
-	r = d.processRewrites("www.host.com")
+	r = d.processRewrites("www.host.com", dns.TypeA)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, "host.com", r.CanonName)
 	assert.True(t, r.IPList[0].Equal(net.ParseIP("1.2.3.4")))
 
 	// 2 CNAMEs
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"b.host.com", "a.host.com", 0, nil},
-		RewriteEntry{"a.host.com", "host.com", 0, nil},
-		RewriteEntry{"host.com", "1.2.3.4", 0, nil},
+		RewriteEntry{Domain: "b.host.com", Answer: "a.host.com"},
+		RewriteEntry{Domain: "a.host.com", Answer: "host.com"},
+		RewriteEntry{Domain: "host.com", Answer: "1.2.3.4"},
 	}
 	d.prepareRewrites()
-	r = d.processRewrites("b.host.com")
+	r = d.processRewrites("b.host.com", dns.TypeA)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, "host.com", r.CanonName)
 	assert.True(t, len(r.IPList) == 1)
@@ -609,12 +1058,12 @@ func TestRewrites(t *testing.T) {
 
 	// 2 CNAMEs + wildcard
 	d.Rewrites = []RewriteEntry{
-		RewriteEntry{"b.host.com", "a.host.com", 0, nil},
-		RewriteEntry{"a.host.com", "x.somehost.com", 0, nil},
-		RewriteEntry{"*.somehost.com", "1.2.3.4", 0, nil},
+		RewriteEntry{Domain: "b.host.com", Answer: "a.host.com"},
+		RewriteEntry{Domain: "a.host.com", Answer: "x.somehost.com"},
+		RewriteEntry{Domain: "*.somehost.com", Answer: "1.2.3.4"},
 	}
 	d.prepareRewrites()
-	r = d.processRewrites("b.host.com")
+	r = d.processRewrites("b.host.com", dns.TypeA)
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, "x.somehost.com", r.CanonName)
 	assert.True(t, len(r.IPList) == 1)
@@ -623,6 +1072,26 @@ func TestRewrites(t *testing.T) {
 
 // BENCHMARKS
 
+func BenchmarkMatchNotFound(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i != 100000; i++ {
+		fmt.Fprintf(&sb, "||host%d.example.org^\n0.0.0.0 ads%d.example.net\n", i, i)
+	}
+	d := NewForTest(nil, []Filter{{ID: 0, Data: []byte(sb.String())}})
+	defer d.Close()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		hostname := "www.example.com"
+		ret, err := d.CheckHost(hostname, dns.TypeA, &setts)
+		if err != nil {
+			b.Errorf("Error while matching host %s: %s", hostname, err)
+		}
+		if ret.IsFiltered {
+			b.Errorf("Expected hostname %s not to match", hostname)
+		}
+	}
+}
+
 func BenchmarkSafeBrowsing(b *testing.B) {
 	d := NewForTest(&Config{SafeBrowsingEnabled: true}, nil)
 	defer d.Close()
@@ -684,3 +1153,224 @@ func BenchmarkSafeSearchParallel(b *testing.B) {
 		}
 	})
 }
+
+func TestRewritesExtended(t *testing.T) {
+	d := Dnsfilter{}
+
+	// the most specific wildcard
+	d.Rewrites = []RewriteEntry{
+		{Domain: "*.host.com", Answer: "1.2.3.4"},
+		{Domain: "*.sub.host.com", Answer: "1.2.3.5"},
+	}
+	d.prepareRewrites()
+	r := d.processRewrites("a.sub.host.com", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.Equal(t, 1, len(r.IPList))
+	assert.True(t, r.IPList[0].Equal(net.ParseIP("1.2.3.5")))
+
+	// exception
+	d.Rewrites = []RewriteEntry{
+		{Domain: "*.host.com", Answer: "1.2.3.4"},
+		{Domain: "*.sub.host.com", Answer: "#"},
+		{Domain: "www.host.com", Answer: "#"},
+	}
+	d.prepareRewrites()
+	r = d.processRewrites("a.host.com", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	r = d.processRewrites("a.sub.host.com", dns.TypeA)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+	r = d.processRewrites("www.host.com", dns.TypeA)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+
+	// request type
+	d.Rewrites = []RewriteEntry{
+		{Domain: "host.com", Answer: "1.2.3.4", QType: "A"},
+		{Domain: "*.host.com", Answer: "1:2:3::4", QType: "aaaa"},
+	}
+	d.prepareRewrites()
+	r = d.processRewrites("host.com", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	r = d.processRewrites("host.com", dns.TypeAAAA)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+	r = d.processRewrites("www.host.com", dns.TypeAAAA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.True(t, r.IPList[0].Equal(net.ParseIP("1:2:3::4")))
+	r = d.processRewrites("www.host.com", dns.TypeA)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+
+	// regular expression with capture groups
+	d.Rewrites = []RewriteEntry{
+		{Domain: `/^host-(\d+)-(\d+)\.lan$/`, Answer: "192.168.$1.$2"},
+		{Domain: `/^(.+)\.old\.com$/`, Answer: "$1.new.com"},
+		{Domain: "x.new.com", Answer: "1.2.3.4"},
+		{Domain: "host-1-3.lan", Answer: "#"},
+	}
+	d.prepareRewrites()
+	r = d.processRewrites("host-1-2.lan", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.True(t, r.IPList[0].Equal(net.ParseIP("192.168.1.2")))
+	r = d.processRewrites("host-1-3.lan", dns.TypeA)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+	r = d.processRewrites("x.old.com", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.Equal(t, "x.new.com", r.CanonName)
+	assert.True(t, r.IPList[0].Equal(net.ParseIP("1.2.3.4")))
+
+	ent := RewriteEntry{Domain: "/(/", Answer: "1.2.3.4"}
+	assert.NotNil(t, ent.check())
+	ent = RewriteEntry{Domain: "host.com", Answer: "1.2.3.4", QType: "MX"}
+	assert.NotNil(t, ent.check())
+}
+
+func TestSetRewrites(t *testing.T) {
+	d := Dnsfilter{}
+	d.Rewrites = []RewriteEntry{{Domain: "host.com", Answer: "1.2.3.4"}}
+	d.prepareRewrites()
+
+	// the current entries are kept on error
+	assert.NotNil(t, d.SetRewrites([]RewriteEntry{{Domain: "a.com", Answer: "1.2.3.5"}, {Domain: "b.com"}}))
+	assert.Equal(t, 1, len(d.Rewrites))
+
+	assert.Nil(t, d.SetRewrites([]RewriteEntry{{Domain: "a.com", Answer: "1.2.3.5"}}))
+	r := d.processRewrites("host.com", dns.TypeA)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+	r = d.processRewrites("a.com", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.True(t, r.IPList[0].Equal(net.ParseIP("1.2.3.5")))
+}
+
+func TestExpr(t *testing.T) {
+	env := exprEnv{
+		domain:   "ads.example.org",
+		qtype:    "AAAA",
+		client:   "192.168.1.2",
+		clientID: "kid",
+		now:      time.Date(2020, 1, 5, 22, 30, 0, 0, time.UTC), // Sunday
+	}
+	match := func(s string) bool {
+		n, err := compileExpr(s)
+		assert.Nil(t, err, s)
+		if err != nil {
+			return false
+		}
+		e := env
+		e.steps = exprRequestBudget
+		ok, err := n.match(&e)
+		assert.Nil(t, err, s)
+		return ok
+	}
+
+	assert.True(t, match(`is_subdomain(domain, "example.org") && qtype in ["A", "AAAA"]`))
+	assert.False(t, match(`is_subdomain(domain, "le.org")`))
+	assert.True(t, match(`(hour >= 22 || hour < 7) && weekday == 0 && minute == 30`))
+	assert.True(t, match(`in_subnet(client, "192.168.0.0/16") && client_id != "adult"`))
+	assert.True(t, match(`matches(domain, "^ads?\\.") && labels(domain) == 3 && len(domain) > 10`))
+	assert.True(t, match(`!contains(domain, "tracker") && has_prefix(domain, "ads") && has_suffix(domain, ".org")`))
+	assert.True(t, match(`true || false && false`))
+	assert.False(t, match(`hour in [1, 2, 3]`))
+
+	for _, s := range []string{
+		``,
+		`domain`,                              // not bool
+		`hour == "22"`,                        // type mismatch
+		`domain < "b"`,                        // strings aren't ordered
+		`unknown == 1`,                        // unknown variable
+		`foo(domain)`,                         // unknown function
+		`matches(domain, client)`,             // not a literal
+		`matches(domain, "(")`,                // invalid regexp
+		`in_subnet(client, "192.168.0.0/33")`, // invalid CIDR
+		`contains(domain)`,                    // argument count
+		`qtype in ["A", 1]`,
+		`domain == "a`,
+		`domain == "a" )`,
+		`domain = "a"`,
+		`!` + strings.Repeat("(", 40) + `true` + strings.Repeat(")", 40),
+		strings.Repeat(`domain == "a" || `, 100) + `true`,
+	} {
+		_, err := compileExpr(s)
+		assert.NotNil(t, err, s)
+	}
+
+	// the budget is shared by all evaluations of the request
+	n, err := compileExpr(`matches(domain, "q") || matches(domain, "z")`)
+	assert.Nil(t, err)
+	e := env
+	e.steps = 5
+	_, err = n.match(&e)
+	assert.Equal(t, errExprBudget, err)
+}
+
+func TestExprRules(t *testing.T) {
+	d := NewForTest(&Config{ExprRules: []ExprRule{
+		{Name: "invalid", Enabled: true, Expr: "domain", Action: ExprActionBlock},
+	}}, nil)
+	defer d.Close()
+	assert.False(t, d.ExprRules[0].Enabled)
+
+	assert.NotNil(t, d.SetExprRules([]ExprRule{{Name: "1", Expr: "true", Action: "drop"}}))
+	assert.NotNil(t, d.SetExprRules([]ExprRule{{Name: "1", Expr: "true", Action: ExprActionRewrite}}))
+	assert.NotNil(t, d.SetExprRules([]ExprRule{{Expr: "true", Action: ExprActionBlock}}))
+	assert.NotNil(t, d.SetExprRules([]ExprRule{
+		{Name: "1", Expr: "true", Action: ExprActionBlock},
+		{Name: "1", Expr: "true", Action: ExprActionAllow},
+	}))
+
+	assert.Nil(t, d.SetExprRules([]ExprRule{
+		{Name: "disabled", Expr: "true", Action: ExprActionBlock},
+		{Name: "allow", Enabled: true, Expr: `client == "192.168.1.2"`, Action: ExprActionAllow},
+		{Name: "block", Enabled: true, Expr: `is_subdomain(domain, "example.org")`, Action: ExprActionBlock},
+		{Name: "ip", Enabled: true, Expr: `domain == "nas.lan"`, Action: ExprActionRewrite, Answer: "192.168.1.3"},
+		{Name: "cname", Enabled: true, Expr: `domain == "www.lan"`, Action: ExprActionRewrite, Answer: "nas.lan"},
+	}))
+
+	setts := RequestFilteringSettings{FilteringEnabled: true, ClientIP: "192.168.1.2"}
+	r, trace, _ := d.CheckHostTrace("ads.example.org", dns.TypeA, &setts)
+	assert.Equal(t, NotFilteredExpression, r.Reason)
+	assert.Equal(t, "allow", r.Rule)
+	assert.Equal(t, TraceExprRules, trace.Steps[1].Name)
+
+	setts.ClientIP = "192.168.1.5"
+	r, _ = d.CheckHost("ads.example.org", dns.TypeA, &setts)
+	assert.True(t, r.IsFiltered)
+	assert.Equal(t, FilteredExpression, r.Reason)
+	assert.Equal(t, "block", r.Rule)
+
+	r, _ = d.CheckHost("nas.lan", dns.TypeA, &setts)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.True(t, r.IPList[0].Equal(net.ParseIP("192.168.1.3")))
+
+	r, _ = d.CheckHost("www.lan", dns.TypeA, &setts)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.Equal(t, "nas.lan", r.CanonName)
+
+	r, _ = d.CheckHost("other.org", dns.TypeA, &setts)
+	assert.False(t, r.Reason.Matched())
+
+	// filtering is disabled for the client
+	setts.FilteringEnabled = false
+	r, _ = d.CheckHost("ads.example.org", dns.TypeA, &setts)
+	assert.False(t, r.IsFiltered)
+}
+
+func TestIDN(t *testing.T) {
+	filters := []Filter{{ID: 0, Data: []byte("||xn--e1afmkfd.xn--p1ai^\n")}}
+	d := NewForTest(nil, filters)
+	defer d.Close()
+
+	// the host name in Unicode matches the rule in punycode
+	res, err := d.CheckHost("ПРИМЕР.рф", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.True(t, res.IsFiltered)
+
+	// rewrites in Unicode match the queries in punycode
+	d.Rewrites = []RewriteEntry{
+		{Domain: "*.Пример.рф", Answer: "сервер.рф"},
+		{Domain: "xn--b1afb6bcb.xn--p1ai", Answer: "1.2.3.4"},
+	}
+	d.prepareRewrites()
+	r := d.processRewrites("www.xn--e1afmkfd.xn--p1ai", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.Equal(t, "xn--b1afb6bcb.xn--p1ai", r.CanonName)
+	assert.Equal(t, 1, len(r.IPList))
+	assert.Equal(t, "*.Пример.рф", d.Rewrites[0].Domain)
+}
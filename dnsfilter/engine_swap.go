@@ -0,0 +1,285 @@
+// Replacement of the filtering engines within the memory budget
+
+package dnsfilter
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Strategies of the replacement of the engines
+const (
+	swapParallel   = "parallel"     // the new engines are created while the old ones are in use
+	swapListByList = "list_by_list" // the old engine of a list is closed before the new one is created
+)
+
+// Memory usage of an engine per byte of filter data
+// It's used for the estimate if there are no engines yet to learn the ratio from.
+const engineMemoryPerByte = 4
+
+// EngineSwapStats - the statistics of a replacement of the filtering engines
+type EngineSwapStats struct {
+	Time      time.Time
+	Strategy  string // "parallel" or "list_by_list"
+	Created   int    // the number of created engines
+	Estimated uint64 // the estimated memory usage of the created engines (in bytes)
+	Duration  time.Duration
+
+	// The peak during the replacement: the estimated memory usage of all engines and the heap size
+	PeakMemory    uint64
+	PeakHeapAlloc uint64
+}
+
+// Get the size of filter data (in bytes)
+func filterSize(f Filter) uint64 {
+	if f.ID == 0 {
+		return uint64(len(f.Data))
+	}
+	st, err := os.Stat(f.FilePath)
+	if err != nil {
+		return 0
+	}
+	return uint64(st.Size())
+}
+
+// Get the memory usage of the engines (each engine is counted once) and the size of their filter data
+func engineMemory(sets ...*engineSet) (uint64, uint64) {
+	var memory, size uint64
+	seen := map[*listEngine]bool{}
+	for _, s := range sets {
+		if s == nil {
+			continue
+		}
+		for _, le := range s.lists {
+			if !seen[le] {
+				seen[le] = true
+				memory += le.memory
+				size += le.size
+			}
+		}
+	}
+	return memory, size
+}
+
+// Estimate the memory usage of the engines for the new and modified lists (in bytes)
+// The usage is proportional to the size of filter data: the ratio is taken from the current engine of the list
+// or, for a new list, the ratio for all current engines is used.
+func estimateEngines(filters []Filter, s *engineSet, perByte float64, dedupe bool) uint64 {
+	cur := map[int64]*listEngine{}
+	if s != nil {
+		for _, le := range s.lists {
+			cur[le.id] = le
+		}
+	}
+	versions := engineVersions(filters, dedupe)
+	var n uint64
+	for i, f := range filters {
+		le, ok := cur[f.ID]
+		if ok && le.version == versions[i] {
+			continue
+		}
+		ratio := perByte
+		if ok && le.size != 0 {
+			ratio = float64(le.memory) / float64(le.size)
+		}
+		n += uint64(float64(filterSize(f)) * ratio)
+	}
+	return n
+}
+
+// Set the new engines: the new and modified lists are taken from the filters, the others are reused
+// If the estimated memory usage of the old and the new engines together exceeds the budget,
+// the engines are replaced list by list.
+func (d *Dnsfilter) swapEngines(allowFilters, blockFilters []Filter) error {
+	d.engineBuildLock.Lock()
+	defer d.engineBuildLock.Unlock()
+	// the engines are changed only while engineBuildLock is held, so they can be read without engineLock here
+
+	st := EngineSwapStats{
+		Time:     time.Now(),
+		Strategy: swapParallel,
+	}
+	curMemory, curSize := engineMemory(d.engines, d.enginesWhite)
+	perByte := float64(engineMemoryPerByte)
+	if curMemory != 0 && curSize != 0 {
+		perByte = float64(curMemory) / float64(curSize)
+	}
+	dedupe := d.Config.FiltersDedupe
+	st.Estimated = estimateEngines(blockFilters, d.engines, perByte, dedupe) +
+		estimateEngines(allowFilters, d.enginesWhite, perByte, dedupe)
+
+	budget := uint64(d.Config.FiltersMemoryBudget) * 1024 * 1024
+	if budget != 0 && curMemory+st.Estimated > budget {
+		log.Info("filtering engines: current: %d bytes, estimated for the new engines: %d bytes, budget: %d bytes: replacing the engines list by list",
+			curMemory, st.Estimated, budget)
+		st.Strategy = swapListByList
+		st.PeakMemory = curMemory
+		st.PeakHeapAlloc = heapAlloc()
+	}
+
+	var err error
+	if st.Strategy == swapParallel {
+		err = d.swapParallel(allowFilters, blockFilters, &st)
+	} else {
+		err = d.swapListByList(&d.enginesWhite, allowFilters, &st)
+		if err == nil {
+			err = d.swapListByList(&d.engines, blockFilters, &st)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	st.Duration = time.Since(st.Time)
+
+	d.engineLock.Lock()
+	d.swapStats = st
+	if st.PeakMemory > d.peakMemory {
+		d.peakMemory = st.PeakMemory
+	}
+	if st.PeakHeapAlloc > d.peakHeapAlloc {
+		d.peakHeapAlloc = st.PeakHeapAlloc
+	}
+	d.engineLock.Unlock()
+
+	log.Debug("filtering engines: %s: created %d engines in %s, peak: ~%d bytes (heap: %d bytes)",
+		st.Strategy, st.Created, st.Duration, st.PeakMemory, st.PeakHeapAlloc)
+	return nil
+}
+
+// Get the number of engines in the set that aren't in the previous set
+func countCreated(s, prev *engineSet) int {
+	old := map[*listEngine]bool{}
+	if prev != nil {
+		for _, le := range prev.lists {
+			old[le] = true
+		}
+	}
+	n := 0
+	for _, le := range s.lists {
+		if !old[le] {
+			n++
+		}
+	}
+	return n
+}
+
+// Create the new engines while the old ones are in use, then swap them
+// The filtering isn't interrupted, but the old and the new engines of the modified lists exist at the same time.
+func (d *Dnsfilter) swapParallel(allowFilters, blockFilters []Filter, st *EngineSwapStats) error {
+	engines, err := newEngineSet(blockFilters, d.engines, d.Config.FiltersDedupe)
+	if err != nil {
+		return err
+	}
+	enginesWhite, err := newEngineSet(allowFilters, d.enginesWhite, d.Config.FiltersDedupe)
+	if err != nil {
+		engines.closeUnused(d.engines)
+		return err
+	}
+
+	st.Created = countCreated(engines, d.engines) + countCreated(enginesWhite, d.enginesWhite)
+	st.PeakMemory, _ = engineMemory(d.engines, d.enginesWhite, engines, enginesWhite)
+	st.PeakHeapAlloc = heapAlloc()
+
+	d.engineLock.Lock()
+	prev, prevWhite := d.engines, d.enginesWhite
+	d.engines = engines
+	d.enginesWhite = enginesWhite
+	d.engineLock.Unlock()
+
+	// the old engines can't be in use after the swap
+	prev.closeUnused(engines)
+	prevWhite.closeUnused(enginesWhite)
+	return nil
+}
+
+// Set the engines for the lists and close the old engines that aren't used anymore
+func (d *Dnsfilter) setEngineSet(set **engineSet, lists []*listEngine) {
+	s := newEngineSetFromLists(lists)
+	d.engineLock.Lock()
+	prev := *set
+	*set = s
+	d.engineLock.Unlock()
+	prev.closeUnused(s)
+}
+
+// Get the engines in the order of the filters
+func orderedEngines(filters []Filter, engines map[int64]*listEngine) []*listEngine {
+	lists := []*listEngine{}
+	for _, f := range filters {
+		le, ok := engines[f.ID]
+		if ok {
+			lists = append(lists, le)
+		}
+	}
+	return lists
+}
+
+// Replace the engines of the set one by one
+// The engines of the removed lists are closed first.
+// The old engine of a modified list is closed before the new one is created, so the memory isn't needed for both at once,
+// but the list isn't used for filtering until its new engine is ready.
+// If an engine can't be created, the list remains unused.
+func (d *Dnsfilter) swapListByList(set **engineSet, filters []Filter, st *EngineSwapStats) error {
+	ids := map[int64]bool{}
+	for _, f := range filters {
+		if ids[f.ID] {
+			return fmt.Errorf("duplicate list ID: %d", f.ID)
+		}
+		ids[f.ID] = true
+	}
+
+	cur := map[int64]*listEngine{}
+	if *set != nil {
+		for _, le := range (*set).lists {
+			if ids[le.id] {
+				cur[le.id] = le
+			}
+		}
+	}
+	d.setEngineSet(set, orderedEngines(filters, cur))
+
+	versions := engineVersions(filters, d.Config.FiltersDedupe)
+	var rd *ruleDedupe
+	last := -1
+	if d.Config.FiltersDedupe {
+		rd = newRuleDedupe()
+		last = lastCreated(filters, versions, cur)
+	}
+	for i, f := range filters {
+		le, ok := cur[f.ID]
+		if ok && le.version == versions[i] {
+			if i < last {
+				err := rd.addList(f)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if ok {
+			delete(cur, f.ID)
+			d.setEngineSet(set, orderedEngines(filters, cur))
+		}
+
+		le, err := newListEngine(f, versions[i], rd)
+		if err != nil {
+			return err
+		}
+		st.Created++
+		memory, _ := engineMemory(d.engines, d.enginesWhite)
+		if memory+le.memory > st.PeakMemory {
+			st.PeakMemory = memory + le.memory
+		}
+		heap := heapAlloc()
+		if heap > st.PeakHeapAlloc {
+			st.PeakHeapAlloc = heap
+		}
+
+		cur[f.ID] = le
+		d.setEngineSet(set, orderedEngines(filters, cur))
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+package dnsfilter
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/AdguardTeam/urlfilter/filterlist"
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// Filtering engine for a single filter list
+type listEngine struct {
+	id      int64
+	version string // identifies the data the engine was created from (see filterVersion())
+	storage *filterlist.RuleStorage
+	engine  *urlfilter.DNSEngine
+
+	// Texts of the rules that are disabled by $badfilter rules of this list
+	badfilter []string
+
+	// Pre-check: if none of the domains of a host name is in the bloom filter,
+	// the host can't be matched by "||domain^" and host rules, so only the other rules of the list are matched.
+	bloom          *bloomFilter            // nil: there are no domains
+	complex        *urlfilter.DNSEngine    // the other rules.  nil: there are no other rules
+	complexStorage *filterlist.RuleStorage // the storage for the other rules
+
+	duplicates int // the number of rules that aren't used because they're in the preceding lists (see ruleDedupe)
+
+	size      uint64        // the size of filter data (in bytes)
+	memory    uint64        // estimated memory usage of the rules index (in bytes)
+	buildTime time.Duration // the time it took to create the engine
+	prof      listProfile   // the latest match durations
+}
+
+// A set of filtering engines: one engine for each filter list
+// When the filters are set again, the engines of the lists that haven't changed are reused,
+// so that only the rules of new and modified lists are parsed and indexed.
+type engineSet struct {
+	nMatch uint64 // the number of matches (atomic; must be the first field for 64-bit alignment)
+
+	lists []*listEngine
+
+	// Texts of the rules that are disabled by $badfilter rules of all lists.
+	// A $badfilter rule disables the rules of other lists as well.
+	badfilter map[string]bool
+}
+
+// Get the string that identifies the version of filter data
+func filterVersion(f Filter) string {
+	if f.ID == 0 {
+		return fmt.Sprintf("data:%d:%x", len(f.Data), crc32.ChecksumIEEE(f.Data))
+	}
+	if f.Checksum != 0 {
+		return fmt.Sprintf("%s:%x", f.FilePath, f.Checksum)
+	}
+	st, err := os.Stat(f.FilePath)
+	if err != nil {
+		return f.FilePath
+	}
+	return fmt.Sprintf("%s:%d:%d", f.FilePath, st.ModTime().UnixNano(), st.Size())
+}
+
+// Create a rule list object for a filter
+// Return the text of the rules if they're stored in memory
+func newRuleList(f Filter) (filterlist.RuleList, []byte, error) {
+	if f.ID == 0 {
+		list := &filterlist.StringRuleList{
+			ID:             0,
+			RulesText:      string(f.Data),
+			IgnoreCosmetic: true,
+		}
+		return list, f.Data, nil
+	}
+
+	if !fileExists(f.FilePath) {
+		list := &filterlist.StringRuleList{
+			ID:             int(f.ID),
+			IgnoreCosmetic: true,
+		}
+		return list, nil, nil
+	}
+
+	if runtime.GOOS == "windows" || strings.HasSuffix(f.FilePath, ".gz") {
+		// On Windows we don't pass a file to urlfilter because
+		//  it's difficult to update this file while it's being used.
+		// Compressed files can't be used by urlfilter directly, so we decompress them into memory.
+		data, err := ioutil.ReadFile(f.FilePath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ioutil.ReadFile(): %s: %s", f.FilePath, err)
+		}
+		if util.IsGzip(data) {
+			data, err = util.Gunzip(data, 0)
+			if err != nil {
+				return nil, nil, fmt.Errorf("gunzip: %s: %s", f.FilePath, err)
+			}
+		}
+		list := &filterlist.StringRuleList{
+			ID:             int(f.ID),
+			RulesText:      string(data),
+			IgnoreCosmetic: true,
+		}
+		return list, data, nil
+	}
+
+	list, err := filterlist.NewFileRuleList(int(f.ID), f.FilePath, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("filterlist.NewFileRuleList(): %s: %s", f.FilePath, err)
+	}
+	return list, nil, nil
+}
+
+// Get the text of the rule that is disabled by a $badfilter rule
+// Return an empty string if the modifier isn't found
+func badfilterTarget(text string) string {
+	i := strings.LastIndexByte(text, '$')
+	if i == -1 {
+		return ""
+	}
+	found := false
+	opts := []string{}
+	for _, o := range strings.Split(text[i+1:], ",") {
+		if strings.TrimSpace(o) == "badfilter" {
+			found = true
+			continue
+		}
+		opts = append(opts, o)
+	}
+	if !found {
+		return ""
+	}
+	if len(opts) == 0 {
+		return text[:i]
+	}
+	return text[:i] + "$" + strings.Join(opts, ",")
+}
+
+// Create a filtering engine for a filter list
+// version: the version of the engine (see engineVersions())
+// rd: the rules of the preceding lists that are removed from the list (nil: dedupe is disabled)
+func newListEngine(f Filter, version string, rd *ruleDedupe) (*listEngine, error) {
+	list, data, err := newRuleList(f)
+	if err != nil {
+		return nil, err
+	}
+	// the heap growth is an estimate: the garbage may be collected in the meantime
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	heap := ms.HeapAlloc
+	start := time.Now()
+
+	size := uint64(len(data))
+	path := f.FilePath // the file the rules are read from by urlfilter
+	duplicates := 0
+	if rd != nil {
+		var tmp string
+		list, data, tmp, duplicates, err = rd.dedupeList(f, list, data)
+		if err != nil {
+			return nil, err
+		}
+		if len(tmp) != 0 {
+			// the file is kept open by urlfilter.  Note that on Windows the rules are always stored in memory.
+			defer os.Remove(tmp)
+			path = tmp
+		}
+	}
+
+	rs := ruleScan{}
+	if data != nil {
+		rs = scanRules(bytes.NewReader(data), int(f.ID))
+	} else if f.ID != 0 && fileExists(path) {
+		// the rules are read by urlfilter from the file, so we read it once more to find $badfilter rules
+		//  and to divide the rules for the pre-check
+		file, err := os.Open(path)
+		if err != nil {
+			_ = list.Close()
+			return nil, fmt.Errorf("os.Open(): %s: %s", path, err)
+		}
+		rs = scanRules(file, int(f.ID))
+		_ = file.Close()
+		size = filterSize(f)
+	}
+
+	storage, err := filterlist.NewRuleStorage([]filterlist.RuleList{list})
+	if err != nil {
+		_ = list.Close()
+		return nil, fmt.Errorf("filterlist.NewRuleStorage(): %s", err)
+	}
+
+	le := &listEngine{
+		id:         f.ID,
+		version:    version,
+		storage:    storage,
+		engine:     urlfilter.NewDNSEngine(storage),
+		badfilter:  rs.badfilter,
+		bloom:      newDomainsBloom(rs.domains),
+		duplicates: duplicates,
+		size:       size,
+	}
+	if len(rs.complex) != 0 {
+		clist := &filterlist.StringRuleList{
+			ID:             int(f.ID),
+			RulesText:      strings.Join(rs.complex, "\n"),
+			IgnoreCosmetic: true,
+		}
+		le.complexStorage, err = filterlist.NewRuleStorage([]filterlist.RuleList{clist})
+		if err != nil {
+			_ = storage.Close()
+			return nil, fmt.Errorf("filterlist.NewRuleStorage(): %s", err)
+		}
+		le.complex = urlfilter.NewDNSEngine(le.complexStorage)
+	}
+
+	le.buildTime = time.Since(start)
+	runtime.ReadMemStats(&ms)
+	if ms.HeapAlloc > heap {
+		le.memory = ms.HeapAlloc - heap
+	}
+	if duplicates != 0 {
+		log.Info("filtering engine for list %d: %d duplicate rules removed", f.ID, duplicates)
+	}
+	log.Debug("filtering engine for list %d: %d rules (%d domains for the pre-check, %d other rules), ~%d bytes, created in %s",
+		f.ID, le.engine.RulesCount, len(rs.domains), len(rs.complex), le.memory, le.buildTime)
+	return le, nil
+}
+
+// Match the host against the rules of the list
+// hashes: the hashes of the host name and its parent domains (see hostHashes())
+func (le *listEngine) match(host string, ctags []string, hashes []uint64) (urlfilter.DNSResult, bool) {
+	if le.bloom.hasAny(hashes) {
+		return le.engine.Match(host, ctags)
+	}
+	if le.complex == nil {
+		return urlfilter.DNSResult{}, false
+	}
+	return le.complex.Match(host, ctags)
+}
+
+// Close the storages of the engines
+func (le *listEngine) close() {
+	_ = le.storage.Close()
+	if le.complexStorage != nil {
+		_ = le.complexStorage.Close()
+	}
+}
+
+// Create the set of filtering engines for the filters
+// The engines from the previous set are reused if their data hasn't changed.
+// dedupe: remove the rules that are in the preceding lists
+// Note that the engines of the previous set that aren't reused must be closed by the caller (see closeUnused()).
+func newEngineSet(filters []Filter, prev *engineSet, dedupe bool) (*engineSet, error) {
+	reusable := map[int64]*listEngine{}
+	if prev != nil {
+		for _, le := range prev.lists {
+			reusable[le.id] = le
+		}
+	}
+	versions := engineVersions(filters, dedupe)
+	var rd *ruleDedupe
+	last := -1
+	if dedupe {
+		rd = newRuleDedupe()
+		last = lastCreated(filters, versions, reusable)
+	}
+
+	lists := []*listEngine{}
+	ids := map[int64]bool{}
+	created := 0
+	for i, f := range filters {
+		if ids[f.ID] {
+			newEngineSetFromLists(lists).closeUnused(prev)
+			return nil, fmt.Errorf("duplicate list ID: %d", f.ID)
+		}
+		ids[f.ID] = true
+
+		le, ok := reusable[f.ID]
+		if !ok || le.version != versions[i] {
+			var err error
+			le, err = newListEngine(f, versions[i], rd)
+			if err != nil {
+				newEngineSetFromLists(lists).closeUnused(prev)
+				return nil, err
+			}
+			created++
+		} else if i < last {
+			err := rd.addList(f)
+			if err != nil {
+				newEngineSetFromLists(lists).closeUnused(prev)
+				return nil, err
+			}
+		}
+		lists = append(lists, le)
+	}
+
+	log.Debug("filtering engines: %d lists, %d created", len(lists), created)
+	return newEngineSetFromLists(lists), nil
+}
+
+// Create the set of the existing engines
+func newEngineSetFromLists(lists []*listEngine) *engineSet {
+	s := &engineSet{
+		lists:     lists,
+		badfilter: map[string]bool{},
+	}
+	for _, le := range lists {
+		for _, r := range le.badfilter {
+			s.badfilter[r] = true
+		}
+	}
+	return s
+}
+
+// Close the engines that aren't used by another set
+func (s *engineSet) closeUnused(other *engineSet) {
+	if s == nil {
+		return
+	}
+	used := map[*listEngine]bool{}
+	if other != nil {
+		for _, le := range other.lists {
+			used[le] = true
+		}
+	}
+	for _, le := range s.lists {
+		if !used[le] {
+			le.close()
+		}
+	}
+}
+
+// Match the host against the rules of all lists
+// The result is the same as if all lists were loaded into a single engine:
+// . network rules have priority over host rules
+// . the network rule with the highest priority is selected (e.g. a whitelist rule has priority over a blocking rule)
+// . host rules of all lists are returned
+// Note that if a rule is disabled by a $badfilter rule from another list,
+// the other matching rules from its list aren't used.
+// The match duration of each list is measured for 1 of profileSampleRate requests.
+func (s *engineSet) match(host string, ctags []string) (urlfilter.DNSResult, bool) {
+	measure := atomic.AddUint64(&s.nMatch, 1)%profileSampleRate == 0
+	hashes := hostHashes(host)
+	var networkRule *rules.NetworkRule
+	res := urlfilter.DNSResult{}
+	for _, le := range s.lists {
+		var start time.Time
+		if measure {
+			start = time.Now()
+		}
+		rr, ok := le.match(host, ctags, hashes)
+		if measure {
+			le.prof.add(time.Since(start))
+		}
+		if !ok {
+			continue
+		}
+
+		if rr.NetworkRule != nil {
+			if s.badfilter[rr.NetworkRule.Text()] {
+				continue
+			}
+			if networkRule == nil || rr.NetworkRule.IsHigherPriority(networkRule) {
+				networkRule = rr.NetworkRule
+			}
+			continue
+		}
+
+		res.HostRulesV4 = append(res.HostRulesV4, rr.HostRulesV4...)
+		res.HostRulesV6 = append(res.HostRulesV6, rr.HostRulesV6...)
+	}
+
+	if networkRule != nil {
+		return urlfilter.DNSResult{NetworkRule: networkRule}, true
+	}
+	return res, res.HostRulesV4 != nil || res.HostRulesV6 != nil
+}
@@ -0,0 +1,641 @@
+// Expression language of expression rules
+//
+// Expression: a condition of the request, e.g.
+//	is_subdomain(domain, "example.org") && qtype in ["A", "AAAA"] && (hour >= 22 || hour < 7)
+//
+// Variables: domain, qtype, client, client_id (strings), hour, minute, weekday (integers, weekday 0 is Sunday)
+// Operators: || && ! == != < <= > >= in [...]
+// Functions: is_subdomain(s, domain), has_prefix(s, x), has_suffix(s, x), contains(s, x),
+//  matches(s, "regexp"), in_subnet(ip, "CIDR"), len(s), labels(s)
+//
+// The expressions can't access anything but the request data.
+// Each operation uses the execution budget of the request.
+
+package dnsfilter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	exprMaxLength = 1024 // the maximum length of an expression
+	exprMaxDepth  = 32   // the maximum nesting level of an expression
+)
+
+var errExprBudget = errors.New("execution budget exceeded")
+
+type exprType int
+
+const (
+	exprBool exprType = iota
+	exprInt
+	exprString
+)
+
+func (t exprType) String() string {
+	switch t {
+	case exprBool:
+		return "bool"
+	case exprInt:
+		return "integer"
+	}
+	return "string"
+}
+
+type exprValue struct {
+	b bool
+	i int
+	s string
+}
+
+// The request data available to expressions
+type exprEnv struct {
+	domain   string
+	qtype    string
+	client   string
+	clientID string
+	now      time.Time
+
+	steps int // the remaining execution budget
+}
+
+// Spend the execution budget
+func (env *exprEnv) step(n int) error {
+	env.steps -= n
+	if env.steps < 0 {
+		return errExprBudget
+	}
+	return nil
+}
+
+// A compiled expression
+type exprNode struct {
+	t       exprType
+	eval    func(env *exprEnv) (exprValue, error)
+	literal bool // the node is a literal value
+}
+
+type exprVar struct {
+	t   exprType
+	get func(env *exprEnv) exprValue
+}
+
+var exprVars = map[string]exprVar{
+	"domain":    {exprString, func(env *exprEnv) exprValue { return exprValue{s: env.domain} }},
+	"qtype":     {exprString, func(env *exprEnv) exprValue { return exprValue{s: env.qtype} }},
+	"client":    {exprString, func(env *exprEnv) exprValue { return exprValue{s: env.client} }},
+	"client_id": {exprString, func(env *exprEnv) exprValue { return exprValue{s: env.clientID} }},
+	"hour":      {exprInt, func(env *exprEnv) exprValue { return exprValue{i: env.now.Hour()} }},
+	"minute":    {exprInt, func(env *exprEnv) exprValue { return exprValue{i: env.now.Minute()} }},
+	"weekday":   {exprInt, func(env *exprEnv) exprValue { return exprValue{i: int(env.now.Weekday())} }},
+}
+
+// Tokens
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokInt
+	tokOp
+)
+
+type exprToken struct {
+	kind int
+	text string // identifier, operator or the value of a string literal
+	pos  int
+}
+
+// Split the expression into tokens
+func exprTokenize(s string) ([]exprToken, error) {
+	toks := []exprToken{}
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			j := i
+			for j < len(s) && (s[j] == '_' || (s[j] >= 'a' && s[j] <= 'z') || (s[j] >= 'A' && s[j] <= 'Z') || (s[j] >= '0' && s[j] <= '9')) {
+				j++
+			}
+			toks = append(toks, exprToken{tokIdent, s[i:j], i})
+			i = j
+
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			toks = append(toks, exprToken{tokInt, s[i:j], i})
+			i = j
+
+		case c == '"':
+			val := strings.Builder{}
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				val.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			toks = append(toks, exprToken{tokString, val.String(), i})
+			i = j + 1
+
+		default:
+			op := ""
+			for _, o := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if len(op) == 0 {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+			toks = append(toks, exprToken{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	toks = append(toks, exprToken{tokEOF, "", len(s)})
+	return toks, nil
+}
+
+type exprParser struct {
+	toks  []exprToken
+	pos   int
+	depth int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.toks[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// Consume the operator if it's the next token
+func (p *exprParser) accept(op string) bool {
+	t := p.peek()
+	if t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("expected %q at %d", op, t.pos)
+	}
+	return nil
+}
+
+// Compile the expression
+func compileExpr(s string) (*exprNode, error) {
+	if len(s) > exprMaxLength {
+		return nil, fmt.Errorf("expression is too long")
+	}
+	toks, err := exprTokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	if n.t != exprBool {
+		return nil, fmt.Errorf("the result must be bool, not %s", n.t)
+	}
+	return n, nil
+}
+
+// Evaluate the compiled expression
+func (n *exprNode) match(env *exprEnv) (bool, error) {
+	v, err := n.eval(env)
+	return v.b, err
+}
+
+// Create a node of the binary logical operator
+func exprLogical(op string, a, b *exprNode) (*exprNode, error) {
+	if a.t != exprBool || b.t != exprBool {
+		return nil, fmt.Errorf("operator %s requires bool operands", op)
+	}
+	isOr := op == "||"
+	return &exprNode{t: exprBool, eval: func(env *exprEnv) (exprValue, error) {
+		if err := env.step(1); err != nil {
+			return exprValue{}, err
+		}
+		v, err := a.eval(env)
+		if err != nil || v.b == isOr {
+			return v, err
+		}
+		return b.eval(env)
+	}}, nil
+}
+
+func (p *exprParser) parseOr() (*exprNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > exprMaxDepth {
+		return nil, fmt.Errorf("expression is too complex")
+	}
+
+	n, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		b, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		n, err = exprLogical("||", n, b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (p *exprParser) parseAnd() (*exprNode, error) {
+	n, err := p.parseCmp()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		b, err := p.parseCmp()
+		if err != nil {
+			return nil, err
+		}
+		n, err = exprLogical("&&", n, b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (p *exprParser) parseCmp() (*exprNode, error) {
+	a, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.kind == tokIdent && t.text == "in" {
+		p.next()
+		return p.parseIn(a)
+	}
+	if t.kind != tokOp {
+		return a, nil
+	}
+	op := t.text
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+	default:
+		return a, nil
+	}
+
+	b, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if a.t != b.t {
+		return nil, fmt.Errorf("operator %s: can't compare %s and %s", op, a.t, b.t)
+	}
+	if op != "==" && op != "!=" && a.t != exprInt {
+		return nil, fmt.Errorf("operator %s requires integer operands", op)
+	}
+
+	return &exprNode{t: exprBool, eval: func(env *exprEnv) (exprValue, error) {
+		if err := env.step(1); err != nil {
+			return exprValue{}, err
+		}
+		va, err := a.eval(env)
+		if err != nil {
+			return exprValue{}, err
+		}
+		vb, err := b.eval(env)
+		if err != nil {
+			return exprValue{}, err
+		}
+		r := false
+		switch op {
+		case "==":
+			r = va == vb
+		case "!=":
+			r = va != vb
+		case "<":
+			r = va.i < vb.i
+		case "<=":
+			r = va.i <= vb.i
+		case ">":
+			r = va.i > vb.i
+		case ">=":
+			r = va.i >= vb.i
+		}
+		return exprValue{b: r}, nil
+	}}, nil
+}
+
+// Parse the list of literals of "in" operator
+func (p *exprParser) parseIn(a *exprNode) (*exprNode, error) {
+	err := p.expect("[")
+	if err != nil {
+		return nil, err
+	}
+	list := []exprValue{}
+	for !p.accept("]") {
+		if len(list) != 0 {
+			err = p.expect(",")
+			if err != nil {
+				return nil, err
+			}
+		}
+		t := p.next()
+		switch {
+		case t.kind == tokString && a.t == exprString:
+			list = append(list, exprValue{s: t.text})
+		case t.kind == tokInt && a.t == exprInt:
+			i, err := strconv.Atoi(t.text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number at %d", t.pos)
+			}
+			list = append(list, exprValue{i: i})
+		default:
+			return nil, fmt.Errorf("operator in: expected %s literal at %d", a.t, t.pos)
+		}
+	}
+
+	return &exprNode{t: exprBool, eval: func(env *exprEnv) (exprValue, error) {
+		if err := env.step(1 + len(list)); err != nil {
+			return exprValue{}, err
+		}
+		v, err := a.eval(env)
+		if err != nil {
+			return exprValue{}, err
+		}
+		for _, it := range list {
+			if it == v {
+				return exprValue{b: true}, nil
+			}
+		}
+		return exprValue{}, nil
+	}}, nil
+}
+
+func (p *exprParser) parseUnary() (*exprNode, error) {
+	if !p.accept("!") {
+		return p.parsePrimary()
+	}
+
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > exprMaxDepth {
+		return nil, fmt.Errorf("expression is too complex")
+	}
+
+	a, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if a.t != exprBool {
+		return nil, fmt.Errorf("operator ! requires bool operand")
+	}
+	return &exprNode{t: exprBool, eval: func(env *exprEnv) (exprValue, error) {
+		if err := env.step(1); err != nil {
+			return exprValue{}, err
+		}
+		v, err := a.eval(env)
+		return exprValue{b: !v.b}, err
+	}}, nil
+}
+
+func exprConst(t exprType, v exprValue) *exprNode {
+	return &exprNode{t, func(env *exprEnv) (exprValue, error) {
+		return v, nil
+	}, true}
+}
+
+func (p *exprParser) parsePrimary() (*exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return exprConst(exprString, exprValue{s: t.text}), nil
+
+	case tokInt:
+		i, err := strconv.Atoi(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number at %d", t.pos)
+		}
+		return exprConst(exprInt, exprValue{i: i}), nil
+
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return exprConst(exprBool, exprValue{b: true}), nil
+		case "false":
+			return exprConst(exprBool, exprValue{}), nil
+		}
+		if p.accept("(") {
+			return p.parseCall(t)
+		}
+		v, ok := exprVars[t.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable %s at %d", t.text, t.pos)
+		}
+		get := v.get
+		return &exprNode{t: v.t, eval: func(env *exprEnv) (exprValue, error) {
+			return get(env), nil
+		}}, nil
+
+	case tokOp:
+		if t.text == "(" {
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		}
+	}
+	if t.kind == tokEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+// Parse the arguments of the function call
+func (p *exprParser) parseArgs() ([]*exprNode, error) {
+	args := []*exprNode{}
+	for !p.accept(")") {
+		if len(args) != 0 {
+			err := p.expect(",")
+			if err != nil {
+				return nil, err
+			}
+		}
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, n)
+	}
+	return args, nil
+}
+
+// Get the value of the argument which must be a string literal
+func exprLiteralArg(fn string, args []*exprNode, i int) (string, error) {
+	if !args[i].literal {
+		return "", fmt.Errorf("%s: argument %d must be a string literal", fn, i+1)
+	}
+	v, _ := args[i].eval(&exprEnv{})
+	return v.s, nil
+}
+
+// The number of arguments of the functions
+var exprFuncArgs = map[string]int{
+	"is_subdomain": 2,
+	"has_prefix":   2,
+	"has_suffix":   2,
+	"contains":     2,
+	"matches":      2,
+	"in_subnet":    2,
+	"len":          1,
+	"labels":       1,
+}
+
+// String functions with 2 arguments
+var exprStringFuncs = map[string]func(s, x string) bool{
+	"has_prefix": strings.HasPrefix,
+	"has_suffix": strings.HasSuffix,
+	"contains":   strings.Contains,
+	"is_subdomain": func(s, domain string) bool {
+		return s == domain || strings.HasSuffix(s, "."+domain)
+	},
+}
+
+func (p *exprParser) parseCall(name exprToken) (*exprNode, error) {
+	fn := name.text
+	nargs, ok := exprFuncArgs[fn]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s at %d", fn, name.pos)
+	}
+	args, err := p.parseArgs()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != nargs {
+		return nil, fmt.Errorf("%s: expected %d arguments", fn, nargs)
+	}
+	for i, a := range args {
+		if a.t != exprString {
+			return nil, fmt.Errorf("%s: argument %d must be a string", fn, i+1)
+		}
+	}
+
+	a := args[0]
+	if f, ok := exprStringFuncs[fn]; ok {
+		b := args[1]
+		return &exprNode{t: exprBool, eval: func(env *exprEnv) (exprValue, error) {
+			va, err := a.eval(env)
+			if err != nil {
+				return exprValue{}, err
+			}
+			vb, err := b.eval(env)
+			if err != nil {
+				return exprValue{}, err
+			}
+			if err := env.step(1 + len(va.s)/16); err != nil {
+				return exprValue{}, err
+			}
+			return exprValue{b: f(va.s, vb.s)}, nil
+		}}, nil
+	}
+
+	switch fn {
+	case "matches":
+		s, err := exprLiteralArg(fn, args, 1)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+		return &exprNode{t: exprBool, eval: func(env *exprEnv) (exprValue, error) {
+			v, err := a.eval(env)
+			if err != nil {
+				return exprValue{}, err
+			}
+			if err := env.step(1 + len(v.s)/4); err != nil {
+				return exprValue{}, err
+			}
+			return exprValue{b: re.MatchString(v.s)}, nil
+		}}, nil
+
+	case "in_subnet":
+		s, err := exprLiteralArg(fn, args, 1)
+		if err != nil {
+			return nil, err
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+		return &exprNode{t: exprBool, eval: func(env *exprEnv) (exprValue, error) {
+			v, err := a.eval(env)
+			if err != nil {
+				return exprValue{}, err
+			}
+			if err := env.step(1); err != nil {
+				return exprValue{}, err
+			}
+			ip := net.ParseIP(v.s)
+			return exprValue{b: ip != nil && ipnet.Contains(ip)}, nil
+		}}, nil
+
+	case "len", "labels":
+		isLabels := fn == "labels"
+		return &exprNode{t: exprInt, eval: func(env *exprEnv) (exprValue, error) {
+			v, err := a.eval(env)
+			if err != nil {
+				return exprValue{}, err
+			}
+			if err := env.step(1); err != nil {
+				return exprValue{}, err
+			}
+			if !isLabels {
+				return exprValue{i: len(v.s)}, nil
+			}
+			if len(v.s) == 0 {
+				return exprValue{}, nil
+			}
+			return exprValue{i: strings.Count(v.s, ".") + 1}, nil
+		}}, nil
+	}
+
+	return nil, fmt.Errorf("unknown function %s at %d", fn, name.pos)
+}
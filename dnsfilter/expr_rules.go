@@ -0,0 +1,256 @@
+// Expression rules
+
+package dnsfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Actions of expression rules
+const (
+	ExprActionBlock   = "block"
+	ExprActionAllow   = "allow"
+	ExprActionRewrite = "rewrite"
+)
+
+// The execution budget of all expression rules for one request (in operations)
+const exprRequestBudget = 10000
+
+// ExprRule - the action is performed for the requests the expression is true for
+type ExprRule struct {
+	Name    string `yaml:"name" json:"name"`
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Expr    string `yaml:"expr" json:"expr"`
+	Action  string `yaml:"action" json:"action"`                     // "block", "allow" or "rewrite"
+	Answer  string `yaml:"answer,omitempty" json:"answer,omitempty"` // for "rewrite": IP address or host name (CNAME)
+
+	node *exprNode // compiled expression
+	ip   net.IP    // parsed Answer if it's an IP address
+}
+
+// Check the rule and compile its expression
+func (r *ExprRule) prepare() error {
+	if len(r.Name) == 0 {
+		return fmt.Errorf("name is required")
+	}
+	node, err := compileExpr(r.Expr)
+	if err != nil {
+		return err
+	}
+
+	r.ip = nil
+	switch r.Action {
+	case ExprActionBlock, ExprActionAllow:
+		//
+	case ExprActionRewrite:
+		if len(r.Answer) == 0 {
+			return fmt.Errorf("answer is required for rewrite action")
+		}
+		r.ip = net.ParseIP(r.Answer)
+	default:
+		return fmt.Errorf("invalid action: %s", r.Action)
+	}
+
+	r.node = node
+	return nil
+}
+
+// Check and compile all rules;  the invalid ones are disabled
+func (d *Dnsfilter) prepareExprRules() {
+	for i := range d.ExprRules {
+		r := &d.ExprRules[i]
+		err := r.prepare()
+		if err != nil {
+			log.Error("Expression rule %s: %s: disabled", r.Name, err)
+			r.Enabled = false
+		}
+	}
+}
+
+// SetExprRules replaces all expression rules
+func (d *Dnsfilter) SetExprRules(list []ExprRule) error {
+	names := map[string]bool{}
+	arr := make([]ExprRule, 0, len(list))
+	for _, r := range list {
+		err := r.prepare()
+		if err != nil {
+			return fmt.Errorf("expression rule %s: %s", r.Name, err)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate expression rule name: %s", r.Name)
+		}
+		names[r.Name] = true
+		arr = append(arr, r)
+	}
+
+	d.confLock.Lock()
+	d.Config.ExprRules = arr
+	d.confLock.Unlock()
+	log.Debug("Expression rules: replaced all rules [%d]", len(arr))
+	return nil
+}
+
+// Get the result of the rule
+// The response to a rewritten request of another type than the IP address has is empty.
+func (r *ExprRule) result() Result {
+	res := Result{Rule: r.Name}
+	switch r.Action {
+	case ExprActionBlock:
+		res.IsFiltered = true
+		res.Reason = FilteredExpression
+	case ExprActionAllow:
+		res.Reason = NotFilteredExpression
+	case ExprActionRewrite:
+		res.Reason = ReasonRewrite
+		if r.ip == nil {
+			res.CanonName = r.Answer
+		} else {
+			res.IPList = []net.IP{r.ip}
+		}
+	}
+	return res
+}
+
+func (d *Dnsfilter) hasExprRules() bool {
+	d.confLock.RLock()
+	defer d.confLock.RUnlock()
+	return len(d.ExprRules) != 0
+}
+
+// Evaluate the enabled rules in order: the first rule the expression is true for is applied
+func (d *Dnsfilter) processExprRules(host string, qtype uint16, setts *RequestFilteringSettings) Result {
+	d.confLock.RLock()
+	defer d.confLock.RUnlock()
+
+	env := &exprEnv{
+		domain:   host,
+		qtype:    dns.TypeToString[qtype],
+		client:   setts.ClientIP,
+		clientID: setts.ClientID,
+		now:      time.Now(),
+		steps:    exprRequestBudget,
+	}
+	for i := range d.ExprRules {
+		r := &d.ExprRules[i]
+		if !r.Enabled || r.node == nil {
+			continue
+		}
+		ok, err := r.node.match(env)
+		if err != nil {
+			log.Debug("Expression rule %s: %s: %s", r.Name, host, err)
+			return Result{}
+		}
+		if ok {
+			log.Debug("Expression rule %s matched %s", r.Name, host)
+			return r.result()
+		}
+	}
+	return Result{}
+}
+
+func exprRulesDup(a []ExprRule) []ExprRule {
+	return append([]ExprRule{}, a...)
+}
+
+func (d *Dnsfilter) handleExprRulesList(w http.ResponseWriter, r *http.Request) {
+	d.confLock.RLock()
+	arr := exprRulesDup(d.Config.ExprRules)
+	d.confLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(arr)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (d *Dnsfilter) handleExprRulesSet(w http.ResponseWriter, r *http.Request) {
+	arr := []ExprRule{}
+	err := json.NewDecoder(r.Body).Decode(&arr)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = d.SetExprRules(arr)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	d.Config.ConfigModified()
+}
+
+type exprCheckJSON struct {
+	Expr     string `json:"expr"`
+	Domain   string `json:"domain"`
+	QType    string `json:"qtype"` // empty: "A"
+	Client   string `json:"client"`
+	ClientID string `json:"client_id"`
+	Time     string `json:"time"` // RFC3339.  Empty: the current time
+}
+
+type exprCheckResultJSON struct {
+	Matched bool   `json:"matched"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Evaluate the expression for the request data
+func (d *Dnsfilter) handleExprCheck(w http.ResponseWriter, r *http.Request) {
+	req := exprCheckJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	env := &exprEnv{
+		domain:   strings.ToLower(strings.TrimSuffix(req.Domain, ".")),
+		qtype:    strings.ToUpper(req.QType),
+		client:   req.Client,
+		clientID: req.ClientID,
+		now:      time.Now(),
+		steps:    exprRequestBudget,
+	}
+	if len(env.qtype) == 0 {
+		env.qtype = "A"
+	}
+	if len(req.Time) != 0 {
+		env.now, err = time.Parse(time.RFC3339, req.Time)
+		if err != nil {
+			httpError(r, w, http.StatusBadRequest, "invalid time: %s", err)
+			return
+		}
+	}
+
+	resp := exprCheckResultJSON{}
+	node, err := compileExpr(req.Expr)
+	if err == nil {
+		resp.Matched, err = node.match(env)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func (d *Dnsfilter) registerExprRulesHandlers() {
+	d.Config.HTTPRegister("GET", "/control/expression_rules/list", d.handleExprRulesList)
+	d.Config.HTTPRegister("POST", "/control/expression_rules/set", d.handleExprRulesSet)
+	d.Config.HTTPRegister("POST", "/control/expression_rules/check", d.handleExprCheck)
+}
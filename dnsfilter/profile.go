@@ -0,0 +1,197 @@
+// Rule engine profiling: match latency per filter list and memory usage of the engines
+
+package dnsfilter
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	profileSamples    = 1024 // the number of the latest match durations stored for each list
+	profileSampleRate = 8    // 1 of this number of requests is measured
+)
+
+// The latest match durations of a filter list
+type listProfile struct {
+	lock    sync.Mutex
+	samples []time.Duration // ring buffer
+	pos     int
+	count   uint64 // the number of measured matches
+}
+
+func (p *listProfile) add(d time.Duration) {
+	p.lock.Lock()
+	if len(p.samples) < profileSamples {
+		p.samples = append(p.samples, d)
+	} else {
+		p.samples[p.pos] = d
+		p.pos = (p.pos + 1) % profileSamples
+	}
+	p.count++
+	p.lock.Unlock()
+}
+
+// Get a copy of the stored durations and the number of measured matches
+func (p *listProfile) get() ([]time.Duration, uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]time.Duration{}, p.samples...), p.count
+}
+
+// ListProfile - match latency of a filter list
+type ListProfile struct {
+	ID         int64
+	Allowlist  bool
+	RulesCount int
+
+	// Estimated memory usage of the rules index (in bytes): the growth of heap size while the engine was created
+	MemoryBytes uint64
+	BuildTime   time.Duration
+	Duplicates  int // the number of removed duplicate rules (see Config.FiltersDedupe)
+
+	Samples int    // the number of durations the percentiles are calculated from
+	Matches uint64 // the number of measured matches since the engine was created
+	P50     time.Duration
+	P90     time.Duration
+	P99     time.Duration
+	Max     time.Duration
+}
+
+// EngineProfile - match latency of all filter lists and memory usage of the engines
+type EngineProfile struct {
+	Lists       []ListProfile
+	MemoryBytes uint64 // the sum of the estimates for all lists
+	Duplicates  int    // the number of removed duplicate rules of all lists
+	HeapAlloc   uint64 // the heap size of the process
+	SampleRate  int    // 1 of this number of requests is measured
+
+	LastSwap      EngineSwapStats // the last replacement of the engines
+	PeakMemory    uint64          // the peak estimated memory usage of the engines since the start
+	PeakHeapAlloc uint64          // the peak heap size during the replacements of the engines
+}
+
+// Get the percentile (0..100) of the sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// Get the profile of the list without the match durations
+func (le *listEngine) profile(allowlist bool) ListProfile {
+	return ListProfile{
+		ID:          le.id,
+		Allowlist:   allowlist,
+		RulesCount:  le.engine.RulesCount,
+		MemoryBytes: le.memory,
+		BuildTime:   le.buildTime,
+		Duplicates:  le.duplicates,
+	}
+}
+
+// Set the percentiles of the match durations
+func (lp *ListProfile) setDurations(durations []time.Duration) {
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	lp.Samples = len(durations)
+	lp.P50 = percentile(durations, 50)
+	lp.P90 = percentile(durations, 90)
+	lp.P99 = percentile(durations, 99)
+	if len(durations) != 0 {
+		lp.Max = durations[len(durations)-1]
+	}
+}
+
+// Get the heap size of the process
+func heapAlloc() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+func newEngineProfile() EngineProfile {
+	return EngineProfile{
+		Lists:      []ListProfile{},
+		HeapAlloc:  heapAlloc(),
+		SampleRate: profileSampleRate,
+	}
+}
+
+// Profile - get the match latency percentiles of the latest measured requests
+func (d *Dnsfilter) Profile() EngineProfile {
+	prof := newEngineProfile()
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+	prof.LastSwap = d.swapStats
+	prof.PeakMemory = d.peakMemory
+	prof.PeakHeapAlloc = d.peakHeapAlloc
+	for i, set := range []*engineSet{d.enginesWhite, d.engines} {
+		if set == nil {
+			continue
+		}
+		for _, le := range set.lists {
+			lp := le.profile(i == 0)
+			durations, matches := le.prof.get()
+			lp.setDurations(durations)
+			lp.Matches = matches
+			prof.Lists = append(prof.Lists, lp)
+			prof.MemoryBytes += le.memory
+			prof.Duplicates += le.duplicates
+		}
+	}
+	return prof
+}
+
+// Benchmark - match the host names against each filter list and get the latency percentiles
+// The engines are locked during one iteration only, so the filters may be changed in the meantime.
+// In this case the results are returned for the lists that were used during the last iteration.
+func (d *Dnsfilter) Benchmark(hosts []string, iterations int) EngineProfile {
+	type key struct {
+		id        int64
+		allowlist bool
+	}
+	durations := map[key][]time.Duration{}
+	var last []ListProfile
+	hashes := [][]uint64{}
+	for _, h := range hosts {
+		hashes = append(hashes, hostHashes(h))
+	}
+
+	for n := 0; n != iterations; n++ {
+		last = nil
+		d.engineLock.RLock()
+		for i, set := range []*engineSet{d.enginesWhite, d.engines} {
+			if set == nil {
+				continue
+			}
+			for _, le := range set.lists {
+				k := key{le.id, i == 0}
+				for j, h := range hosts {
+					start := time.Now()
+					_, _ = le.match(h, nil, hashes[j])
+					durations[k] = append(durations[k], time.Since(start))
+				}
+				last = append(last, le.profile(i == 0))
+			}
+		}
+		d.engineLock.RUnlock()
+	}
+
+	prof := newEngineProfile()
+	for _, lp := range last {
+		k := key{lp.ID, lp.Allowlist}
+		lp.setDurations(durations[k])
+		lp.Matches = uint64(len(durations[k]))
+		prof.Lists = append(prof.Lists, lp)
+		prof.MemoryBytes += lp.MemoryBytes
+		prof.Duplicates += lp.Duplicates
+	}
+	return prof
+}
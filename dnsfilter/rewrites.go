@@ -4,25 +4,38 @@ package dnsfilter
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
 	"net"
 	"net/http"
+	"regexp"
 	"sort"
 	"strings"
 
+	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
 
 // RewriteEntry is a rewrite array element
 type RewriteEntry struct {
-	Domain string `yaml:"domain"`
-	Answer string `yaml:"answer"` // IP address or canonical name
-	Type   uint16 `yaml:"-"`      // DNS record type: CNAME, A or AAAA
-	IP     net.IP `yaml:"-"`      // Parsed IP address (if Type is A or AAAA)
+	Domain string `yaml:"domain"`         // host name, wildcard ("*.host.com") or regular expression ("/^host[0-9]+\.com$/")
+	Answer string `yaml:"answer"`         // IP address or canonical name;  "#": exception
+	QType  string `yaml:"type,omitempty"` // "A" or "AAAA": the entry is used for the requests of this type only
+	Type   uint16 `yaml:"-"`              // DNS record type: CNAME, A or AAAA
+	IP     net.IP `yaml:"-"`              // Parsed IP address (if Type is A or AAAA)
+
+	qtype     uint16         // parsed QType value;  0: any
+	re        *regexp.Regexp // compiled regular expression (if Domain is a regular expression)
+	host      string         // Domain in lower case with internationalized names converted to punycode
+	canonName string         // Answer converted the same way (if Type is CNAME)
 }
 
+// The answer of an exception entry: the matched host names aren't rewritten
+const rewriteException = "#"
+
 func (r *RewriteEntry) equals(b RewriteEntry) bool {
-	return r.Domain == b.Domain && r.Answer == b.Answer
+	return r.Domain == b.Domain && r.Answer == b.Answer && strings.EqualFold(r.QType, b.QType)
 }
 
 func isWildcard(host string) bool {
@@ -36,34 +49,52 @@ func matchDomainWildcard(host, wildcard string) bool {
 		strings.HasSuffix(host, wildcard[1:])
 }
 
+// Return TRUE if the domain is a regular expression: "/.../"
+func isRegexp(domain string) bool {
+	return len(domain) > 2 &&
+		domain[0] == '/' && domain[len(domain)-1] == '/'
+}
+
 type rewritesArray []RewriteEntry
 
 func (a rewritesArray) Len() int { return len(a) }
 
 func (a rewritesArray) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 
-// Priority: CNAME, A/AAAA;  exact, wildcard.
+// Priority: A/AAAA, CNAME
 func (a rewritesArray) Less(i, j int) bool {
-	if a[i].Type == dns.TypeCNAME && a[j].Type != dns.TypeCNAME {
-		return false
-	} else if a[i].Type != dns.TypeCNAME && a[j].Type == dns.TypeCNAME {
-		return true
+	return a[i].Type != dns.TypeCNAME && a[j].Type == dns.TypeCNAME
+}
+
+// Prepare entry for use
+func (r *RewriteEntry) prepare() {
+	r.qtype = 0
+	switch strings.ToUpper(r.QType) {
+	case "A":
+		r.qtype = dns.TypeA
+	case "AAAA":
+		r.qtype = dns.TypeAAAA
 	}
 
-	if isWildcard(a[i].Domain) && !isWildcard(a[j].Domain) {
-		return false
-	} else if !isWildcard(a[i].Domain) && isWildcard(a[j].Domain) {
-		return true
+	r.re = nil
+	r.host = ""
+	if isRegexp(r.Domain) {
+		// an invalid expression doesn't match anything
+		r.re, _ = regexp.Compile("(?i)" + r.Domain[1:len(r.Domain)-1])
+	} else {
+		r.host = util.ToPunycode(strings.ToLower(r.Domain))
 	}
 
-	return i < j
-}
+	r.IP = nil
+	if r.Answer == rewriteException {
+		r.Type = 0
+		return
+	}
 
-// Prepare entry for use
-func (r *RewriteEntry) prepare() {
 	ip := net.ParseIP(r.Answer)
 	if ip == nil {
 		r.Type = dns.TypeCNAME
+		r.canonName = util.ToPunycode(strings.ToLower(r.Answer))
 		return
 	}
 
@@ -77,41 +108,115 @@ func (r *RewriteEntry) prepare() {
 	}
 }
 
+// Check the entry
+func (r *RewriteEntry) check() error {
+	if len(r.Domain) == 0 || len(r.Answer) == 0 {
+		return fmt.Errorf("domain and answer are required")
+	}
+	if isRegexp(r.Domain) {
+		_, err := regexp.Compile(r.Domain[1 : len(r.Domain)-1])
+		if err != nil {
+			return fmt.Errorf("invalid regular expression: %s", err)
+		}
+	}
+	switch strings.ToUpper(r.QType) {
+	case "", "A", "AAAA":
+		//
+	default:
+		return fmt.Errorf("invalid request type: %s", r.QType)
+	}
+	return nil
+}
+
 func (d *Dnsfilter) prepareRewrites() {
 	for i := range d.Rewrites {
 		d.Rewrites[i].prepare()
 	}
 }
 
+// SetRewrites replaces all rewrite entries
+// The entries are checked first: on error the current entries are kept.
+func (d *Dnsfilter) SetRewrites(list []RewriteEntry) error {
+	arr := make([]RewriteEntry, 0, len(list))
+	for _, ent := range list {
+		err := ent.check()
+		if err != nil {
+			return fmt.Errorf("rewrite %s -> %s: %s", ent.Domain, ent.Answer, err)
+		}
+		ent.prepare()
+		arr = append(arr, ent)
+	}
+
+	d.confLock.Lock()
+	d.Config.Rewrites = arr
+	d.confLock.Unlock()
+	log.Debug("Rewrites: replaced all elements [%d]", len(arr))
+	return nil
+}
+
+// Get the priority of the entry for the host name
+// 0: doesn't match;  exact match > the longest wildcard > regular expression
+func (r *RewriteEntry) matchLevel(host string) int {
+	if isRegexp(r.Domain) {
+		if r.re != nil && r.re.MatchString(host) {
+			return 1
+		}
+		return 0
+	}
+	if r.host == host {
+		return math.MaxInt32
+	}
+	if matchDomainWildcard(host, r.host) {
+		return 1 + len(r.host)
+	}
+	return 0
+}
+
+// Get the entry for the host name matched by the regular expression:
+// $1..$9 in the answer are replaced with the capture groups
+func (r RewriteEntry) expand(host string) RewriteEntry {
+	m := r.re.FindStringSubmatchIndex(host)
+	r.Answer = string(r.re.ExpandString(nil, r.Answer, host, m))
+	r.Domain = host
+	r.prepare()
+	return r
+}
+
 // Get the list of matched rewrite entries.
-// Priority: CNAME, A/AAAA;  exact, wildcard.
-// If matched exactly, don't return wildcard entries.
-func findRewrites(a []RewriteEntry, host string) []RewriteEntry {
+// Only the entries with the highest priority are used: exact match, then the most specific wildcard, then regular expressions.
+// If an exception entry is matched, nothing is returned.
+// Priority of the returned entries: A/AAAA, CNAME.
+func findRewrites(a []RewriteEntry, host string, qtype uint16) []RewriteEntry {
 	rr := rewritesArray{}
+	best := 0
 	for _, r := range a {
-		if r.Domain != host {
-			if !matchDomainWildcard(host, r.Domain) {
-				continue
-			}
+		if r.qtype != 0 && r.qtype != qtype {
+			continue
+		}
+		level := r.matchLevel(host)
+		if level == 0 || level < best {
+			continue
+		}
+		if level > best {
+			best = level
+			rr = rr[:0]
+		}
+		if r.re != nil {
+			r = r.expand(host)
 		}
 		rr = append(rr, r)
 	}
 
+	for _, r := range rr {
+		if r.Answer == rewriteException {
+			return nil
+		}
+	}
 	if len(rr) == 0 {
 		return nil
 	}
 
-	sort.Sort(rr)
-
-	isWC := isWildcard(rr[0].Domain)
-	if !isWC {
-		for i, r := range rr {
-			if isWildcard(r.Domain) {
-				rr = rr[:i]
-				break
-			}
-		}
-	}
+	sort.Stable(rr)
 	return rr
 }
 
@@ -124,6 +229,7 @@ func rewriteArrayDup(a []RewriteEntry) []RewriteEntry {
 type rewriteEntryJSON struct {
 	Domain string `json:"domain"`
 	Answer string `json:"answer"`
+	QType  string `json:"type"`
 }
 
 func (d *Dnsfilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
@@ -135,6 +241,7 @@ func (d *Dnsfilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
 		jsent := rewriteEntryJSON{
 			Domain: ent.Domain,
 			Answer: ent.Answer,
+			QType:  ent.QType,
 		}
 		arr = append(arr, &jsent)
 	}
@@ -160,6 +267,12 @@ func (d *Dnsfilter) handleRewriteAdd(w http.ResponseWriter, r *http.Request) {
 	ent := RewriteEntry{
 		Domain: jsent.Domain,
 		Answer: jsent.Answer,
+		QType:  jsent.QType,
+	}
+	err = ent.check()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
 	}
 	ent.prepare()
 	d.confLock.Lock()
@@ -183,6 +296,7 @@ func (d *Dnsfilter) handleRewriteDelete(w http.ResponseWriter, r *http.Request)
 	entDel := RewriteEntry{
 		Domain: jsent.Domain,
 		Answer: jsent.Answer,
+		QType:  jsent.QType,
 	}
 	arr := []RewriteEntry{}
 	d.confLock.Lock()
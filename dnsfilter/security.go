@@ -37,14 +37,22 @@ func (d *Dnsfilter) initSecurityServices() error {
 	d.parentalServer = defaultParentalServer
 	opts := upstream.Options{Timeout: dnsTimeout, Bootstrap: bootstrapServers}
 
+	if len(d.Config.ParentalServer) != 0 {
+		d.parentalServer = d.Config.ParentalServer
+	}
+
 	d.parentalUpstream, err = upstream.AddressToUpstream(d.parentalServer, opts)
 	if err != nil {
-		return err
+		return fmt.Errorf("parental server %s: %s", d.parentalServer, err)
+	}
+
+	if len(d.Config.SafeBrowsingServer) != 0 {
+		d.safeBrowsingServer = d.Config.SafeBrowsingServer
 	}
 
 	d.safeBrowsingUpstream, err = upstream.AddressToUpstream(d.safeBrowsingServer, opts)
 	if err != nil {
-		return err
+		return fmt.Errorf("safe browsing server %s: %s", d.safeBrowsingServer, err)
 	}
 
 	return nil
@@ -105,6 +113,23 @@ func (d *Dnsfilter) SafeSearchDomain(host string) (string, bool) {
 	return val, ok
 }
 
+// Get IP addresses of the safe search host name
+func (d *Dnsfilter) lookupSafeHost(host string) ([]net.IP, error) {
+	if d.ResolveHost == nil {
+		return net.LookupIP(host)
+	}
+
+	addrs, err := d.ResolveHost(host)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
 func (d *Dnsfilter) checkSafeSearch(host string) (Result, error) {
 	if log.GetLevel() >= log.DEBUG {
 		timer := log.StartTimer()
@@ -132,8 +157,7 @@ func (d *Dnsfilter) checkSafeSearch(host string) (Result, error) {
 		return res, nil
 	}
 
-	// TODO this address should be resolved with upstream that was configured in dnsforward
-	addrs, err := net.LookupIP(safeHost)
+	addrs, err := d.lookupSafeHost(safeHost)
 	if err != nil {
 		log.Tracef("SafeSearchDomain for %s was found but failed to lookup for %s cause %s", host, safeHost, err)
 		return Result{}, err
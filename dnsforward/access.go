@@ -2,23 +2,29 @@ package dnsforward
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/AdguardTeam/urlfilter/filterlist"
 )
 
 type accessCtx struct {
 	lock sync.Mutex
 
-	allowedClients    map[string]bool // IP addresses of whitelist clients
-	disallowedClients map[string]bool // IP addresses of clients that should be blocked
+	allowedClients    map[string]bool // IP addresses and ClientIDs of whitelist clients
+	disallowedClients map[string]bool // IP addresses and ClientIDs of clients that should be blocked
 
 	allowedClientsIPNet    []net.IPNet // CIDRs of whitelist clients
 	disallowedClientsIPNet []net.IPNet // CIDRs of clients that should be blocked
 
-	blockedHosts map[string]bool // hosts that should be blocked
+	blockedHosts          map[string]bool      // hosts that should be blocked
+	blockedHostsWildcards []string             // "*.domain": subdomains that should be blocked
+	blockedHostsEngine    *urlfilter.DNSEngine // filtering rules for hosts that should be blocked, e.g. "||arpa^"
 }
 
 func (a *accessCtx) Init(allowedClients, disallowedClients, blockedHosts []string) error {
@@ -32,18 +38,52 @@ func (a *accessCtx) Init(allowedClients, disallowedClients, blockedHosts []strin
 		return err
 	}
 
-	convertArrayToMap(&a.blockedHosts, blockedHosts)
-	return nil
+	return a.initBlockedHosts(blockedHosts)
 }
 
-func convertArrayToMap(dst *map[string]bool, src []string) {
-	*dst = make(map[string]bool)
-	for _, s := range src {
-		(*dst)[s] = true
+// Return TRUE if the blocked host entry is a filtering rule rather than a host name or a wildcard
+func isAccessRule(s string) bool {
+	return strings.ContainsAny(s, "|^/$@") ||
+		(strings.Contains(s, "*") && !isWildcard(s))
+}
+
+// Split the list of blocked hosts into host names, wildcards and filtering rules
+func (a *accessCtx) initBlockedHosts(list []string) error {
+	a.blockedHosts = make(map[string]bool)
+	a.blockedHostsWildcards = nil
+	a.blockedHostsEngine = nil
+
+	var rules []string
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+		if isAccessRule(s) {
+			rules = append(rules, s)
+		} else if isWildcard(s) {
+			a.blockedHostsWildcards = append(a.blockedHostsWildcards, strings.ToLower(s))
+		} else {
+			a.blockedHosts[strings.ToLower(s)] = true
+		}
+	}
+
+	if len(rules) == 0 {
+		return nil
+	}
+	rl := &filterlist.StringRuleList{
+		RulesText:      strings.Join(rules, "\n"),
+		IgnoreCosmetic: true,
 	}
+	storage, err := filterlist.NewRuleStorage([]filterlist.RuleList{rl})
+	if err != nil {
+		return fmt.Errorf("filterlist.NewRuleStorage(): %s", err)
+	}
+	a.blockedHostsEngine = urlfilter.NewDNSEngine(storage)
+	return nil
 }
 
-// Split array of IP or CIDR into 2 containers for fast search
+// Split array of IP, CIDR or ClientID into 2 containers for fast search
 func processIPCIDRArray(dst *map[string]bool, dstIPNet *[]net.IPNet, src []string) error {
 	*dst = make(map[string]bool)
 
@@ -54,6 +94,11 @@ func processIPCIDRArray(dst *map[string]bool, dstIPNet *[]net.IPNet, src []strin
 			continue
 		}
 
+		if IsValidClientID(s) {
+			(*dst)[s] = true
+			continue
+		}
+
 		_, ipnet, err := net.ParseCIDR(s)
 		if err != nil {
 			return err
@@ -66,6 +111,11 @@ func processIPCIDRArray(dst *map[string]bool, dstIPNet *[]net.IPNet, src []strin
 
 // IsBlockedIP - return TRUE if this client should be blocked
 func (a *accessCtx) IsBlockedIP(ip string) bool {
+	return a.IsBlockedClient(ip, "")
+}
+
+// IsBlockedClient - return TRUE if the client with this IP address and ClientID (optional) should be blocked
+func (a *accessCtx) IsBlockedClient(ip, clientID string) bool {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
@@ -74,6 +124,9 @@ func (a *accessCtx) IsBlockedIP(ip string) bool {
 		if ok {
 			return false
 		}
+		if len(clientID) != 0 && a.allowedClients[clientID] {
+			return false
+		}
 
 		if len(a.allowedClientsIPNet) != 0 {
 			ipAddr := net.ParseIP(ip)
@@ -91,6 +144,9 @@ func (a *accessCtx) IsBlockedIP(ip string) bool {
 	if ok {
 		return true
 	}
+	if len(clientID) != 0 && a.disallowedClients[clientID] {
+		return true
+	}
 
 	if len(a.disallowedClientsIPNet) != 0 {
 		ipAddr := net.ParseIP(ip)
@@ -106,10 +162,29 @@ func (a *accessCtx) IsBlockedIP(ip string) bool {
 
 // IsBlockedDomain - return TRUE if this domain should be blocked
 func (a *accessCtx) IsBlockedDomain(host string) bool {
+	host = strings.ToLower(host)
+
 	a.lock.Lock()
+	defer a.lock.Unlock()
+
 	_, ok := a.blockedHosts[host]
-	a.lock.Unlock()
-	return ok
+	if ok {
+		return true
+	}
+
+	for _, w := range a.blockedHostsWildcards {
+		if matchDomainWildcard(host, w) {
+			return true
+		}
+	}
+
+	if a.blockedHostsEngine != nil {
+		rr, ok := a.blockedHostsEngine.Match(host, nil)
+		if ok && rr.NetworkRule != nil && !rr.NetworkRule.Whitelist {
+			return true
+		}
+	}
+	return false
 }
 
 type accessListJSON struct {
@@ -138,7 +213,7 @@ func (s *Server) handleAccessList(w http.ResponseWriter, r *http.Request) {
 func checkIPCIDRArray(src []string) error {
 	for _, s := range src {
 		ip := net.ParseIP(s)
-		if ip != nil {
+		if ip != nil || IsValidClientID(s) {
 			continue
 		}
 
@@ -0,0 +1,84 @@
+package dnsforward
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Client IP address anonymization modes for query log and statistics
+const (
+	anonymizeModeMask = "mask" // the last octet of IPv4 address and the last 80 bits of IPv6 address are set to 0
+	anonymizeModeHash = "hash" // the address is replaced with its hash
+)
+
+// The hash salt is changed after this period, so the hashes can't be linked across periods
+const anonymizeSaltPeriod = 24 * time.Hour
+
+// Check the client IP address anonymization mode
+func checkAnonymizeMode(mode string) error {
+	switch mode {
+	case "", anonymizeModeMask, anonymizeModeHash:
+		return nil
+	}
+	return fmt.Errorf("invalid client IP anonymization mode: %s", mode)
+}
+
+// Set the host part of IP address to 0
+func maskIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IP{ip4[0], ip4[1], ip4[2], 0}
+	}
+	if len(ip) != net.IPv6len {
+		return ip
+	}
+	m := make(net.IP, net.IPv6len)
+	copy(m, ip[:6])
+	return m
+}
+
+// Client IP address hashing with the salt that is changed periodically
+type ipAnonymizer struct {
+	lock     sync.Mutex
+	salt     []byte
+	saltTime time.Time // the time when the salt was generated
+}
+
+// Get the hash of IP address
+// The hash is represented as IPv6 address from fd00::/8 range (unique local addresses),
+// so it can be stored and searched in the same way as a real client address.
+func (a *ipAnonymizer) hashIP(ip net.IP) net.IP {
+	a.lock.Lock()
+	if a.salt == nil || time.Since(a.saltTime) >= anonymizeSaltPeriod {
+		a.salt = make([]byte, 16)
+		_, _ = rand.Read(a.salt)
+		a.saltTime = time.Now()
+	}
+	salt := a.salt
+	a.lock.Unlock()
+
+	h := sha256.New()
+	_, _ = h.Write(salt)
+	_, _ = h.Write(ip.To16())
+	sum := h.Sum(nil)
+	r := net.IP(sum[:net.IPv6len])
+	r[0] = 0xfd
+	return r
+}
+
+// Anonymize the client IP address according to the settings
+func (s *Server) anonymizeIP(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	switch s.conf.AnonymizeClientIP {
+	case anonymizeModeMask:
+		return maskIP(ip)
+	case anonymizeModeHash:
+		return s.anonymizer.hashIP(ip)
+	}
+	return ip
+}
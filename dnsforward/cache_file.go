@@ -0,0 +1,146 @@
+// Storing DNS cache in file
+
+package dnsforward
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// File format:
+// "AGHC" | uint8(version) | response...
+// response: uint16(key length) | key | uint32(data length) | data
+// The key and the data are the same as in cache: the data begins with the expiration time.
+const (
+	cacheFileMagic   = "AGHC"
+	cacheFileVersion = 1
+)
+
+// Start tracking the keys of the stored responses:  it's required for storing the cache in file
+func (c *optimisticCache) trackKeys() {
+	c.lock.Lock()
+	if c.keys == nil {
+		c.keys = map[string]bool{}
+	}
+	c.lock.Unlock()
+}
+
+// Write the responses that may still be used to file
+// Return the number of stored responses.
+func (c *optimisticCache) save(fn string, now time.Time) (int, error) {
+	c.lock.Lock()
+	keys := make([]string, 0, len(c.keys))
+	for k := range c.keys {
+		keys = append(keys, k)
+	}
+	c.lock.Unlock()
+
+	buf := bytes.Buffer{}
+	buf.WriteString(cacheFileMagic)
+	buf.WriteByte(cacheFileVersion)
+	n := 0
+	for _, k := range keys {
+		data := c.items.Get([]byte(k))
+		if len(data) <= 4 || !c.usable(int64(binary.BigEndian.Uint32(data))-now.Unix()) {
+			continue
+		}
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(k)))
+		buf.WriteString(k)
+		_ = binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+		buf.Write(data)
+		n++
+	}
+
+	tmp := fn + ".tmp"
+	err := ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return 0, err
+	}
+	err = os.Rename(tmp, fn)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, err
+	}
+	return n, nil
+}
+
+// Read the responses from file
+// The expired responses that may not be used anymore are skipped.
+// Return the number of loaded responses.
+func (c *optimisticCache) load(fn string, now time.Time) (int, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) < len(cacheFileMagic)+1 || string(b[:len(cacheFileMagic)]) != cacheFileMagic {
+		return 0, fmt.Errorf("%s: invalid file format", fn)
+	}
+	if b[len(cacheFileMagic)] != cacheFileVersion {
+		return 0, fmt.Errorf("%s: unsupported version %d", fn, b[len(cacheFileMagic)])
+	}
+	b = b[len(cacheFileMagic)+1:]
+
+	n := 0
+	for len(b) != 0 {
+		if len(b) < 2 {
+			return n, fmt.Errorf("%s: data is truncated", fn)
+		}
+		klen := int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		if len(b) < klen+4 {
+			return n, fmt.Errorf("%s: data is truncated", fn)
+		}
+		key := b[:klen]
+		dlen := int(binary.BigEndian.Uint32(b[klen:]))
+		b = b[klen+4:]
+		if len(b) < dlen {
+			return n, fmt.Errorf("%s: data is truncated", fn)
+		}
+		data := b[:dlen]
+		b = b[dlen:]
+
+		if klen <= 5 || dlen <= 4 || !c.usable(int64(binary.BigEndian.Uint32(data))-now.Unix()) {
+			continue
+		}
+		key = append([]byte{}, key...)
+		_ = c.items.Set(key, append([]byte{}, data...))
+		c.addKey(key)
+		n++
+	}
+	return n, nil
+}
+
+// Load the responses stored on shutdown
+// The file is removed so that the responses are loaded only once.
+func (s *Server) loadCache() {
+	fn := s.conf.CacheFile
+	n, err := s.cache.load(fn, time.Now())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		log.Error("DNS: cache: %s", err)
+	} else {
+		log.Info("DNS: cache: loaded %d responses from %s", n, fn)
+	}
+	_ = os.Remove(fn)
+}
+
+// Store the responses in file if the cache is persistent
+func (s *Server) saveCache() {
+	if s.cache == nil || !s.conf.CachePersistent || len(s.conf.CacheFile) == 0 {
+		return
+	}
+	n, err := s.cache.save(s.conf.CacheFile, time.Now())
+	if err != nil {
+		log.Error("DNS: cache: %s", err)
+		return
+	}
+	log.Info("DNS: cache: stored %d responses in %s", n, s.conf.CacheFile)
+}
@@ -0,0 +1,75 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+type cacheInfoJSON struct {
+	Enabled bool `json:"enabled"`  // false: dnsproxy's cache is used (EDNS Client Subnet is enabled), the counters aren't available
+	MaxSize uint `json:"max_size"` // the maximum size of the main cache (in bytes)
+	cacheInfo
+}
+
+// Get the cache counters: the main cache and the caches of forwarding zones
+func (s *Server) handleCacheInfo(w http.ResponseWriter, r *http.Request) {
+	resp := cacheInfoJSON{}
+	s.RLock()
+	resp.MaxSize = s.conf.CacheSize
+	if resp.MaxSize == 0 {
+		resp.MaxSize = optimisticCacheDefaultSize
+	}
+	if s.cache != nil {
+		resp.Enabled = true
+		s.cache.addInfo(&resp.cacheInfo)
+	}
+	for _, z := range s.zones {
+		z.cache.addInfo(&resp.cacheInfo)
+	}
+	s.RUnlock()
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Marshal: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+type cacheFlushJSON struct {
+	Name string `json:"name"` // host name.  Empty: delete all responses
+}
+
+// Delete all responses or the responses for the host name from cache
+func (s *Server) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	req := cacheFlushJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+
+	s.RLock()
+	defer s.RUnlock()
+	if s.cache == nil {
+		httpError(r, w, http.StatusBadRequest, "cache can't be flushed while EDNS Client Subnet is enabled")
+		return
+	}
+	caches := []*optimisticCache{s.cache}
+	for _, z := range s.zones {
+		caches = append(caches, z.cache)
+	}
+	for _, c := range caches {
+		if len(name) == 0 {
+			c.clear()
+		} else {
+			c.clearName(name)
+		}
+	}
+	log.Debug("DNS: cache: flushed %q", name)
+}
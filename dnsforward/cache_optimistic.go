@@ -0,0 +1,514 @@
+package dnsforward
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	glcache "github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	optimisticCacheDefaultSize = 64 * 1024 // in bytes
+	optimisticDefaultMaxStale  = 24 * 60 * 60
+
+	// TTL of the records of an expired response (RFC 8767 4)
+	optimisticStaleTTL = 30
+
+	// The maximum time SERVFAIL responses may be cached for (RFC 2308 7.1)
+	cacheMaxServfailTTL = 5 * 60
+
+	// Default prefetch settings
+	cacheDefaultPrefetchHits = 5
+	cacheDefaultPrefetchTime = 10 // in seconds
+	cacheDefaultPrefetchQPS  = 10
+)
+
+// Cache lifetime settings (in seconds)
+type cacheTTLs struct {
+	min      uint32 // the lower limit of TTL of the cached responses;  0: no limit
+	max      uint32 // the upper limit of TTL of the cached responses;  0: no limit
+	negative uint32 // the lifetime of NXDOMAIN and NODATA responses;  0: from the response (SOA record)
+	servfail uint32 // the lifetime of SERVFAIL responses;  0: they aren't cached
+}
+
+// Prefetch settings: a popular response is refreshed in background shortly before it expires
+type cachePrefetch struct {
+	hits uint32 // the number of requests for the response after which it's popular;  0: prefetch is disabled
+	time uint32 // the time (in seconds) before expiration during which the response is refreshed
+	qps  uint32 // the maximum number of refresh requests per second
+}
+
+// Optimistic (serve-stale) DNS cache:
+// an expired response is returned to the client immediately and is refreshed in background.
+// It is used instead of dnsproxy's cache when CacheOptimistic setting is enabled.
+type optimisticCache struct {
+	items    glcache.Cache
+	maxStale uint32 // the maximum time (in seconds) after expiration during which the response may be used; 0: never
+	ttls     cacheTTLs
+	prefetch cachePrefetch
+
+	// counters
+	hits       uint64
+	misses     uint64
+	evictions  uint64 // the responses deleted to free space for the new ones
+	prefetches uint64 // the responses refreshed before expiration
+
+	lock       sync.Mutex
+	refreshing map[string]bool // the keys of the responses that are being refreshed at the moment
+	keys       map[string]bool // the keys of the stored responses (for storing the cache in file);  nil: not tracked
+
+	queried         map[string]uint32 // the number of requests for the response since it was stored (if prefetch is enabled)
+	prefetchSecond  int64             // the current second (Unix time) of prefetch rate limit
+	prefetchCounter uint32            // the number of refresh requests during prefetchSecond
+}
+
+func newOptimisticCache(size uint, maxStale uint32) *optimisticCache {
+	if maxStale == 0 {
+		maxStale = optimisticDefaultMaxStale
+	}
+	c := &optimisticCache{
+		maxStale:   maxStale,
+		refreshing: map[string]bool{},
+		queried:    map[string]uint32{},
+	}
+	conf := glcache.Config{
+		MaxSize:   optimisticCacheDefaultSize,
+		EnableLRU: true,
+		OnDelete: func(key []byte, val []byte) {
+			atomic.AddUint64(&c.evictions, 1)
+			c.removeKey(key)
+		},
+	}
+	if size != 0 {
+		conf.MaxSize = size
+	}
+	c.items = glcache.New(conf)
+	return c
+}
+
+// Create a cache that doesn't use expired responses
+func newResponseCache(size uint) *optimisticCache {
+	c := newOptimisticCache(size, 0)
+	c.maxStale = 0
+	return c
+}
+
+// Get the cache lifetime settings
+func cacheTTLsFromConfig(c *FilteringConfig) cacheTTLs {
+	return cacheTTLs{
+		min:      c.CacheMinTTL,
+		max:      c.CacheMaxTTL,
+		negative: c.CacheNegativeTTL,
+		servfail: c.CacheServfailTTL,
+	}
+}
+
+// Get the prefetch settings
+func cachePrefetchFromConfig(c *FilteringConfig) cachePrefetch {
+	if !c.CachePrefetch {
+		return cachePrefetch{}
+	}
+	p := cachePrefetch{
+		hits: c.CachePrefetchHits,
+		time: c.CachePrefetchTime,
+		qps:  c.CachePrefetchQPS,
+	}
+	if p.hits == 0 {
+		p.hits = cacheDefaultPrefetchHits
+	}
+	if p.time == 0 {
+		p.time = cacheDefaultPrefetchTime
+	}
+	if p.qps == 0 {
+		p.qps = cacheDefaultPrefetchQPS
+	}
+	return p
+}
+
+// Check the cache settings
+func checkCacheConfig(c *FilteringConfig) error {
+	if c.CacheMaxTTL != 0 && c.CacheMinTTL > c.CacheMaxTTL {
+		return fmt.Errorf("cache_ttl_min must be less than or equal to cache_ttl_max")
+	}
+	if c.CacheServfailTTL > cacheMaxServfailTTL {
+		return fmt.Errorf("cache_servfail_ttl must be less than or equal to %d", cacheMaxServfailTTL)
+	}
+	return nil
+}
+
+// Get the cache key for the request:
+// uint8(do) | uint16(qtype) | uint16(qclass) | name
+func optimisticCacheKey(m *dns.Msg) []byte {
+	q := m.Question[0]
+	opt := m.IsEdns0()
+	return cacheKey(q.Name, q.Qtype, q.Qclass, opt != nil && opt.Do())
+}
+
+func cacheKey(name string, qtype, qclass uint16, do bool) []byte {
+	b := make([]byte, 1+2+2+len(name))
+	if do {
+		b[0] = 1
+	}
+	binary.BigEndian.PutUint16(b[1:], qtype)
+	binary.BigEndian.PutUint16(b[3:], qclass)
+	copy(b[5:], strings.ToLower(name))
+	return b
+}
+
+// Get the lowest TTL of the records in the response
+// Return 0 if there are no records
+func lowestTTL(m *dns.Msg) uint32 {
+	var ttl uint32 = math.MaxUint32
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype != dns.TypeOPT && h.Ttl < ttl {
+				ttl = h.Ttl
+			}
+		}
+	}
+	if ttl == math.MaxUint32 {
+		return 0
+	}
+	return ttl
+}
+
+// Set TTL of the records to be within the limits
+func limitTTLs(m *dns.Msg, min, max uint32) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if h.Ttl < min {
+				h.Ttl = min
+			} else if max != 0 && h.Ttl > max {
+				h.Ttl = max
+			}
+		}
+	}
+}
+
+// Return TRUE if it's a negative response: NXDOMAIN or NODATA
+func isNegativeResponse(m *dns.Msg) bool {
+	return m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0)
+}
+
+// Get the time the response may be stored in cache for (in seconds);  0: it must not be stored
+// TTL of the records are changed to be within the limits.
+func (c *optimisticCache) lifetime(m *dns.Msg) uint32 {
+	if m.Truncated || len(m.Question) != 1 {
+		return 0
+	}
+	if m.Rcode == dns.RcodeServerFailure {
+		return c.ttls.servfail
+	}
+	if c.ttls.negative != 0 && isNegativeResponse(m) {
+		return c.ttls.negative
+	}
+	if c.ttls.min != 0 || c.ttls.max != 0 {
+		limitTTLs(m, c.ttls.min, c.ttls.max)
+	}
+	if !isCacheable(m) {
+		return 0
+	}
+	return lowestTTL(m)
+}
+
+// Return TRUE if the response may be stored in cache (the rules are the same as in dnsproxy)
+func isCacheable(m *dns.Msg) bool {
+	if m.Truncated || len(m.Question) != 1 || lowestTTL(m) == 0 {
+		return false
+	}
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return false
+	}
+
+	qtype := m.Question[0].Qtype
+	if m.Rcode == dns.RcodeSuccess && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+		// a NOERROR response must contain at least one A or AAAA record
+		for _, rr := range m.Answer {
+			t := rr.Header().Rrtype
+			if t == dns.TypeA || t == dns.TypeAAAA {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Store the response
+// Format: uint32(expire) | DNS message
+func (c *optimisticCache) set(m *dns.Msg, now time.Time) {
+	if m == nil {
+		return
+	}
+	ttl := c.lifetime(m)
+	if ttl == 0 {
+		return
+	}
+	pm, err := m.Pack()
+	if err != nil {
+		return
+	}
+	data := make([]byte, 4+len(pm))
+	binary.BigEndian.PutUint32(data, uint32(now.Unix())+ttl)
+	copy(data[4:], pm)
+	key := optimisticCacheKey(m)
+	_ = c.items.Set(key, data)
+	c.addKey(key)
+	c.resetQueried(key)
+}
+
+// Delete the response
+func (c *optimisticCache) del(key []byte) {
+	c.items.Del(key)
+	c.removeKey(key)
+}
+
+func (c *optimisticCache) addKey(key []byte) {
+	c.lock.Lock()
+	if c.keys != nil {
+		c.keys[string(key)] = true
+	}
+	c.lock.Unlock()
+}
+
+func (c *optimisticCache) removeKey(key []byte) {
+	c.lock.Lock()
+	if c.keys != nil {
+		delete(c.keys, string(key))
+	}
+	delete(c.queried, string(key))
+	c.lock.Unlock()
+}
+
+func (c *optimisticCache) resetQueried(key []byte) {
+	if c.prefetch.hits == 0 {
+		return
+	}
+	c.lock.Lock()
+	delete(c.queried, string(key))
+	c.lock.Unlock()
+}
+
+// Count the request for the response and return TRUE if it must be prefetched
+// left: the time (in seconds) until the response expires
+func (c *optimisticCache) needPrefetch(key []byte, left int64, now time.Time) bool {
+	if c.prefetch.hits == 0 {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := c.queried[string(key)] + 1
+	c.queried[string(key)] = n
+	if n < c.prefetch.hits || left > int64(c.prefetch.time) || c.refreshing[string(key)] {
+		return false
+	}
+
+	sec := now.Unix()
+	if sec != c.prefetchSecond {
+		c.prefetchSecond = sec
+		c.prefetchCounter = 0
+	}
+	if c.prefetchCounter >= c.prefetch.qps {
+		return false
+	}
+	c.prefetchCounter++
+	return true
+}
+
+// Return TRUE if the response may be used
+// left: the time (in seconds) until the response expires
+func (c *optimisticCache) usable(left int64) bool {
+	return left > 0 || (c.maxStale != 0 && -left <= int64(c.maxStale))
+}
+
+// Get the response for the request
+// stale: the response has expired and it must be refreshed
+// TTL values of the records are decreased by the time the response has been in cache;
+// the records of an expired response have the TTL of optimisticStaleTTL.
+// Expired SERVFAIL responses aren't used.
+func (c *optimisticCache) get(req *dns.Msg, now time.Time) (resp *dns.Msg, stale bool) {
+	resp, left := c.lookup(req, now)
+	return resp, resp != nil && left <= 0
+}
+
+// Get the response for the request and the time (in seconds) until it expires
+func (c *optimisticCache) lookup(req *dns.Msg, now time.Time) (*dns.Msg, int64) {
+	if len(req.Question) != 1 {
+		return nil, 0
+	}
+	key := optimisticCacheKey(req)
+	data := c.items.Get(key)
+	if len(data) <= 4 {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, 0
+	}
+
+	expire := int64(binary.BigEndian.Uint32(data))
+	left := expire - now.Unix()
+	if !c.usable(left) {
+		c.del(key)
+		atomic.AddUint64(&c.misses, 1)
+		return nil, 0
+	}
+
+	resp := &dns.Msg{}
+	if resp.Unpack(data[4:]) != nil || (left <= 0 && resp.Rcode == dns.RcodeServerFailure) {
+		c.del(key)
+		atomic.AddUint64(&c.misses, 1)
+		return nil, 0
+	}
+	atomic.AddUint64(&c.hits, 1)
+	resp.Id = req.Id
+	resp.Question = []dns.Question{req.Question[0]}
+
+	ttl := uint32(optimisticStaleTTL)
+	if left > 0 {
+		ttl = uint32(left)
+	}
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype != dns.TypeOPT {
+				h.Ttl = ttl
+			}
+		}
+	}
+	return resp, left
+}
+
+// Refresh the cached response in background
+// Does nothing if the response is already being refreshed.
+func (c *optimisticCache) refresh(p *proxy.Proxy, d *proxy.DNSContext, prefetch bool) {
+	key := string(optimisticCacheKey(d.Req))
+	c.lock.Lock()
+	if c.refreshing[key] {
+		c.lock.Unlock()
+		return
+	}
+	c.refreshing[key] = true
+	c.lock.Unlock()
+	if prefetch {
+		atomic.AddUint64(&c.prefetches, 1)
+	}
+
+	ctx := &proxy.DNSContext{
+		Proto:     d.Proto,
+		Req:       d.Req.Copy(),
+		Addr:      d.Addr,
+		StartTime: time.Now(),
+		Upstreams: d.Upstreams,
+	}
+	go func() {
+		err := p.Resolve(ctx)
+		if err != nil {
+			log.Debug("DNS: cache: couldn't refresh %s: %s", ctx.Req.Question[0].Name, err)
+		} else {
+			c.set(ctx.Res, time.Now())
+		}
+
+		c.lock.Lock()
+		delete(c.refreshing, key)
+		c.lock.Unlock()
+	}()
+}
+
+// Get the response from cache or pass the request to upstream servers
+func (c *optimisticCache) resolve(p *proxy.Proxy, d *proxy.DNSContext) error {
+	now := time.Now()
+	resp, left := c.lookup(d.Req, now)
+	if resp != nil {
+		if left <= 0 {
+			log.Debug("DNS: cache: serving expired response for %s", d.Req.Question[0].Name)
+			c.refresh(p, d, false)
+		} else if c.needPrefetch(optimisticCacheKey(d.Req), left, now) {
+			log.Debug("DNS: cache: prefetching %s", d.Req.Question[0].Name)
+			c.refresh(p, d, true)
+		}
+		d.Res = resp
+		return nil
+	}
+
+	err := p.Resolve(d)
+	if err == nil {
+		c.set(d.Res, time.Now())
+	} else if c.ttls.servfail != 0 {
+		// the client receives SERVFAIL response
+		resp = &dns.Msg{}
+		resp.SetRcode(d.Req, dns.RcodeServerFailure)
+		c.set(resp, time.Now())
+	}
+	return err
+}
+
+// Delete all responses
+func (c *optimisticCache) clear() {
+	c.items.Clear()
+	c.lock.Lock()
+	if c.keys != nil {
+		c.keys = map[string]bool{}
+	}
+	c.queried = map[string]uint32{}
+	c.lock.Unlock()
+	atomic.StoreUint64(&c.hits, 0)
+	atomic.StoreUint64(&c.misses, 0)
+	atomic.StoreUint64(&c.evictions, 0)
+	atomic.StoreUint64(&c.prefetches, 0)
+}
+
+// Delete the responses for the host name (of all types)
+func (c *optimisticCache) clearName(name string) {
+	name = dns.Fqdn(name)
+	del := func(qtype uint16) {
+		c.del(cacheKey(name, qtype, dns.ClassINET, false))
+		c.del(cacheKey(name, qtype, dns.ClassINET, true))
+	}
+	for t := range dns.TypeToString {
+		del(t)
+	}
+	for _, t := range extraQueryTypes {
+		del(t)
+	}
+}
+
+// Cache statistics
+type cacheInfo struct {
+	Entries    uint64 `json:"entries"`
+	Size       uint64 `json:"size"` // the size of the cached data (in bytes)
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Evictions  uint64 `json:"evictions"`  // the number of responses deleted to free space for the new ones
+	Prefetches uint64 `json:"prefetches"` // the number of popular responses refreshed before expiration
+}
+
+// Add the counters of the cache
+func (c *optimisticCache) addInfo(info *cacheInfo) {
+	st := c.items.Stats()
+	info.Entries += uint64(st.Count)
+	info.Size += uint64(st.Size)
+	info.Hits += atomic.LoadUint64(&c.hits)
+	info.Misses += atomic.LoadUint64(&c.misses)
+	info.Evictions += atomic.LoadUint64(&c.evictions)
+	info.Prefetches += atomic.LoadUint64(&c.prefetches)
+}
+
+// Get the response from optimistic cache or pass the request to upstream servers
+func (s *Server) resolveWithCache(d *proxy.DNSContext) error {
+	if s.cache == nil || len(d.Upstreams) != 0 {
+		// custom upstreams: don't use cache as dnsproxy does
+		return s.dnsProxy.Resolve(d)
+	}
+	return s.cache.resolve(s.dnsProxy, d)
+}
@@ -0,0 +1,111 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// The default path of DNS-over-HTTPS requests
+const dohPath = "/dns-query"
+
+// IsValidClientID - return TRUE if the string is a valid ClientID:
+// 1-63 characters: lowercase letters, digits and hyphens (not at the beginning or at the end)
+func IsValidClientID(id string) bool {
+	if len(id) == 0 || len(id) > 63 || id[0] == '-' || id[len(id)-1] == '-' {
+		return false
+	}
+	for _, c := range id {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Get ClientID from the server name: "clientid.<serverName>" -> "clientid"
+func clientIDFromServerName(sni, serverName string) string {
+	if len(serverName) == 0 {
+		return ""
+	}
+	sni = strings.ToLower(sni)
+	if !strings.HasSuffix(sni, "."+serverName) {
+		return ""
+	}
+	id := sni[:len(sni)-len(serverName)-1]
+	if !IsValidClientID(id) {
+		return ""
+	}
+	return id
+}
+
+// Get ClientID from the path of DNS-over-HTTPS request: "/dns-query/clientid" -> "clientid"
+func clientIDFromDOHPath(path string) string {
+	return clientIDFromPath(path, dohPath)
+}
+
+// Get ClientID from the path of DNS-over-HTTPS request with the base path: "<base>/clientid" -> "clientid"
+func clientIDFromPath(path, base string) string {
+	if !strings.HasPrefix(path, base+"/") {
+		return ""
+	}
+	id := strings.ToLower(strings.TrimSuffix(path[len(base)+1:], "/"))
+	if !IsValidClientID(id) {
+		return ""
+	}
+	return id
+}
+
+// Get ClientID of the client using an encrypted protocol
+// The verified client certificate has a priority (see clientIDFromCertificate).
+// DNS-over-TLS: the server name from Client Hello
+// DNS-over-HTTPS: the URL path, then the server name from Client Hello, then ClientID of the endpoint (see DoHEndpoint)
+// The sources are limited by ClientID mode of the server name used by the client.
+// Return an empty string if there's no ClientID.
+func (s *Server) clientID(d *proxy.DNSContext) string {
+	switch d.Proto {
+	case proxy.ProtoTLS:
+		conn, ok := d.Conn.(*tls.Conn)
+		if !ok {
+			return ""
+		}
+		state := conn.ConnectionState()
+		if id := s.clientIDFromCertificate(&state); len(id) != 0 {
+			return id
+		}
+		sni := state.ServerName
+		serverName, mode := s.clientIDRule(sni)
+		if mode != ClientIDModeAll && mode != ClientIDModeSNI {
+			return ""
+		}
+		return clientIDFromServerName(sni, serverName)
+
+	case proxy.ProtoHTTPS:
+		r := d.HTTPRequest
+		if r == nil {
+			return ""
+		}
+		if id := s.clientIDFromCertificate(r.TLS); len(id) != 0 {
+			return id
+		}
+		sni := ""
+		if r.TLS != nil {
+			sni = r.TLS.ServerName
+		}
+		serverName, mode := s.clientIDRule(sni)
+		base, defaultID := matchDoHPath(r.URL.Path, s.conf.DoHPath, s.conf.DoHEndpoints)
+		id := ""
+		if len(base) != 0 && (mode == ClientIDModeAll || mode == ClientIDModePath) {
+			id = clientIDFromPath(r.URL.Path, base)
+		}
+		if len(id) == 0 && r.TLS != nil && (mode == ClientIDModeAll || mode == ClientIDModeSNI) {
+			id = clientIDFromServerName(sni, serverName)
+		}
+		if len(id) == 0 {
+			id = defaultID
+		}
+		return id
+	}
+	return ""
+}
@@ -0,0 +1,287 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Configuration transaction
+// The changes are made to a copy of the settings,
+// validated as a whole, applied atomically and written to disk once.
+// If DNS server fails to start with the new settings, the previous settings are restored.
+type configTx struct {
+	s    *Server
+	prev FilteringConfig
+	conf FilteringConfig // the new settings
+}
+
+// Start a transaction
+// Only one transaction may be in progress at a time.
+func (s *Server) beginConfigTx() *configTx {
+	s.txLock.Lock()
+	s.RLock()
+	tx := &configTx{
+		s:    s,
+		prev: s.conf.FilteringConfig,
+		conf: s.conf.FilteringConfig,
+	}
+	s.RUnlock()
+	return tx
+}
+
+// Finish the transaction
+func (tx *configTx) close() {
+	tx.s.txLock.Unlock()
+}
+
+// Validate the new settings
+func (tx *configTx) validate() error {
+	err := ValidateConfig(&tx.conf)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(tx.conf.UpstreamDNS, tx.prev.UpstreamDNS) ||
+		!reflect.DeepEqual(tx.conf.BootstrapDNS, tx.prev.BootstrapDNS) {
+		err = checkUpstreamsReachable(tx.conf.UpstreamDNS, tx.conf.BootstrapDNS, tx.s.conf.UpstreamProxy)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the new settings, restart DNS server if needed and write the configuration
+func (tx *configTx) commit(restart bool) error {
+	err := tx.apply(restart)
+	if err != nil {
+		return err
+	}
+	tx.s.conf.ConfigModified()
+	return nil
+}
+
+// Apply the new settings and restart DNS server if needed
+func (tx *configTx) apply(restart bool) error {
+	s := tx.s
+	dns64Prefix, _ := parseDNS64Prefix(tx.conf.DNS64Prefix)
+	s.Lock()
+	s.conf.FilteringConfig = tx.conf
+	s.conf.dns64Prefix = dns64Prefix
+	s.Unlock()
+
+	if restart {
+		err := s.Reconfigure(nil)
+		if err != nil {
+			log.Error("DNS: %s: restoring the previous settings", err)
+			s.Lock()
+			s.conf.FilteringConfig = tx.prev
+			s.Unlock()
+			err2 := s.Reconfigure(nil)
+			if err2 != nil {
+				log.Error("DNS: can't restore the previous settings: %s", err2)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset the settings which are applied without restarting DNS server (see handleSetConfig)
+func clearHotSettings(c *FilteringConfig) {
+	c.ProtectionEnabled = false
+	c.BlockingMode = ""
+	c.BlockingIPv4 = ""
+	c.BlockingIPv6 = ""
+	c.BlockingIPAddrv4 = nil
+	c.BlockingIPAddrv6 = nil
+	c.BlockedTLDs = nil
+	c.BlockedQueryTypes = nil
+	c.MaxUDPResponseSize = 0
+	c.AAAADisabled = false
+	c.DNS64Enabled = false
+	c.DNS64Prefix = ""
+	c.FullCNAMEFiltering = false
+	c.AnonymizeClientIP = ""
+	c.QueryLogIgnoreAllowed = false
+	c.LocalPTREnabled = false
+}
+
+// Return TRUE if DNS server must be restarted to apply the new settings
+// The callbacks aren't compared.  The empty and nil arrays are equal.
+func needRestart(prev, conf FilteringConfig) bool {
+	clearHotSettings(&prev)
+	clearHotSettings(&conf)
+	a := reflect.ValueOf(prev)
+	b := reflect.ValueOf(conf)
+	for i := 0; i != a.NumField(); i++ {
+		fa := a.Field(i)
+		fb := b.Field(i)
+		switch fa.Kind() {
+		case reflect.Func:
+			continue
+		case reflect.Slice, reflect.Map:
+			if fa.Len() == 0 && fb.Len() == 0 {
+				continue
+			}
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			log.Debug("DNS: %s has changed", a.Type().Field(i).Name)
+			return true
+		}
+	}
+	return false
+}
+
+// Reload - apply all DNS settings at once, e.g. after the configuration file has been reloaded
+// DNS server is restarted only if the settings that require it have changed,
+// otherwise the requests in progress aren't affected.
+// The configuration isn't written.
+func (s *Server) Reload(c *FilteringConfig) error {
+	tx := s.beginConfigTx()
+	defer tx.close()
+	tx.conf = *c
+	if tx.conf.BlockingMode == "custom_ip" {
+		tx.conf.BlockingIPAddrv4 = net.ParseIP(tx.conf.BlockingIPv4)
+		tx.conf.BlockingIPAddrv6 = net.ParseIP(tx.conf.BlockingIPv6)
+	}
+
+	err := tx.validate()
+	if err != nil {
+		return err
+	}
+	restart := needRestart(tx.prev, tx.conf)
+	log.Debug("DNS: reloading settings, restart: %t", restart)
+	return tx.apply(restart)
+}
+
+// ValidateConfig checks DNS settings as a whole without applying them
+func ValidateConfig(c *FilteringConfig) error {
+	if len(c.BlockingMode) != 0 && !ValidateBlockingMode(c.BlockingMode, c.BlockingIPv4, c.BlockingIPv6) {
+		return fmt.Errorf("blocking_mode: incorrect value")
+	}
+
+	_, err := parseDNS64Prefix(c.DNS64Prefix)
+	if err != nil {
+		return fmt.Errorf("dns64_prefix: %s", err)
+	}
+
+	err = checkECSConfig(c.EDNSClientSubnetMode, c.EDNSClientSubnetCustom, c.EDNSClientSubnetUpstreams)
+	if err != nil {
+		return err
+	}
+
+	err = checkRatelimitConfig(c)
+	if err != nil {
+		return err
+	}
+
+	err = checkIPCIDRArray(c.AllowedClients)
+	if err == nil {
+		err = checkIPCIDRArray(c.DisallowedClients)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = checkAnonymizeMode(c.AnonymizeClientIP)
+	if err != nil {
+		return err
+	}
+
+	if len(c.UpstreamDNS) != 0 {
+		err = ValidateUpstreams(c.UpstreamDNS)
+		if err != nil {
+			return fmt.Errorf("wrong upstreams specification: %s", err)
+		}
+	}
+
+	for _, host := range c.BootstrapDNS {
+		err = checkBootstrap(host)
+		if err != nil {
+			return fmt.Errorf("%s can not be used as bootstrap dns cause: %s", host, err)
+		}
+	}
+
+	for _, u := range c.FallbackDNS {
+		d, err := validateUpstream(u)
+		if err != nil || !d {
+			return fmt.Errorf("wrong fallback upstream specification: %s", u)
+		}
+	}
+
+	err = checkUpstreamMode(c.UpstreamMode, c.UpstreamWeights)
+	if err != nil {
+		return err
+	}
+
+	err = checkForwardZones(c.ForwardZones)
+	if err != nil {
+		return err
+	}
+
+	err = checkListeners(c.Listeners)
+	if err != nil {
+		return err
+	}
+
+	_, err = prepareLocalZones(c.LocalZones)
+	if err != nil {
+		return err
+	}
+
+	_, err = buildPipeline(c.Pipeline)
+	if err != nil {
+		return err
+	}
+
+	err = checkBlockedTLDs(c.BlockedTLDs)
+	if err != nil {
+		return fmt.Errorf("blocked_tlds: %s", err)
+	}
+	err = CheckQueryTypes(c.BlockedQueryTypes)
+	if err != nil {
+		return fmt.Errorf("blocked_query_types: %s", err)
+	}
+
+	err = checkCacheConfig(c)
+	if err != nil {
+		return err
+	}
+
+	if c.UseLocalPTRResolvers && len(c.LocalPTRResolvers) != 0 {
+		err = checkLocalResolvers(c.LocalPTRResolvers)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check that at least one of the default upstream servers responds
+func checkUpstreamsReachable(upstreams []string, bootstrap []string, proxyURL *url.URL) error {
+	if len(upstreams) == 0 {
+		return nil
+	}
+
+	var errs []error
+	for _, u := range upstreams {
+		_, defaultUpstream, err := separateUpstream(u)
+		if err != nil || !defaultUpstream {
+			continue
+		}
+		_, err = checkDNS(u, bootstrap, proxyURL)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("none of the upstream servers responds: %s", errs[0])
+}
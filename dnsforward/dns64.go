@@ -0,0 +1,158 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// The Well-Known Prefix for IPv4-embedded IPv6 addresses (RFC 6052)
+const dns64WellKnownPrefix = "64:ff9b::/96"
+
+// IPv4-mapped IPv6 addresses: AAAA records in this range are ignored (RFC 6147 5.1.4)
+var ipv4MappedNet = &net.IPNet{
+	IP:   net.IP{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0, 0, 0, 0},
+	Mask: net.CIDRMask(96, 128),
+}
+
+// Parse NAT64 prefix
+// The prefix length must be one of the lengths allowed by RFC 6052: 32, 40, 48, 56, 64 or 96
+func parseDNS64Prefix(s string) (*net.IPNet, error) {
+	if len(s) == 0 {
+		s = dns64WellKnownPrefix
+	}
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil || ip.To4() != nil {
+		return nil, fmt.Errorf("invalid DNS64 prefix: %s", s)
+	}
+	n, _ := ipnet.Mask.Size()
+	switch n {
+	case 32, 40, 48, 56, 64, 96:
+		//
+	default:
+		return nil, fmt.Errorf("invalid DNS64 prefix length: %d", n)
+	}
+	if n != 96 && ip[8] != 0 {
+		// bits 64-71 are reserved and must be zero
+		return nil, fmt.Errorf("invalid DNS64 prefix: bits 64-71 must be zero")
+	}
+	return ipnet, nil
+}
+
+// Embed IPv4 address into IPv6 address with the prefix (RFC 6052 2.2)
+func dns64Synthesize(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP)
+	n, _ := prefix.Mask.Size()
+	i := n / 8
+	for _, b := range ip4.To4() {
+		if i == 8 {
+			i++ // skip the reserved octet
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
+
+// Return TRUE if the response contains AAAA records that may be used by the client
+func hasUsableAAAA(resp *dns.Msg) bool {
+	for _, rr := range resp.Answer {
+		a, ok := rr.(*dns.AAAA)
+		if ok && !ipv4MappedNet.Contains(a.AAAA) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get TTL of the negative response (from SOA record in authority section)
+// Return FALSE if there's no SOA record
+func negativeTTL(resp *dns.Msg) (uint32, bool) {
+	for _, rr := range resp.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return ttl, true
+		}
+	}
+	return 0, false
+}
+
+// Synthesize AAAA records from A records if there are no AAAA records for the requested name (RFC 6147)
+func processDNS64(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+
+	if !s.conf.DNS64Enabled || s.conf.dns64Prefix == nil || !ctx.responseFromUpstream ||
+		d.Req.Question[0].Qtype != dns.TypeAAAA || d.Res == nil {
+		return resultDone
+	}
+	if d.Req.CheckingDisabled {
+		// the client validates DNSSEC by itself, so it must receive the original response (RFC 6147 5.5)
+		return resultDone
+	}
+	if d.Res.Rcode != dns.RcodeSuccess || hasUsableAAAA(d.Res) {
+		return resultDone
+	}
+
+	req := d.Req.Copy()
+	req.Question[0].Qtype = dns.TypeA
+	actx := &proxy.DNSContext{
+		Proto:     d.Proto,
+		Req:       req,
+		Addr:      d.Addr,
+		StartTime: d.StartTime,
+		Upstreams: d.Upstreams,
+	}
+	err := s.resolve(actx)
+	if err != nil {
+		log.Debug("DNS64: %s: %s", req.Question[0].Name, err)
+		return resultDone
+	}
+	if actx.Res == nil || actx.Res.Rcode != dns.RcodeSuccess {
+		return resultDone
+	}
+
+	maxTTL, limited := negativeTTL(d.Res)
+	resp := d.Res.Copy()
+	resp.Answer = nil
+	resp.Ns = nil
+	n := 0
+	for _, rr := range actx.Res.Answer {
+		switch v := rr.(type) {
+		case *dns.CNAME:
+			resp.Answer = append(resp.Answer, dns.Copy(v))
+
+		case *dns.A:
+			ttl := v.Hdr.Ttl
+			if limited && maxTTL < ttl {
+				ttl = maxTTL
+			}
+			aaaa := &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   v.Hdr.Name,
+					Rrtype: dns.TypeAAAA,
+					Class:  v.Hdr.Class,
+					Ttl:    ttl,
+				},
+				AAAA: dns64Synthesize(s.conf.dns64Prefix, v.A),
+			}
+			resp.Answer = append(resp.Answer, aaaa)
+			n++
+		}
+	}
+	if n == 0 {
+		return resultDone
+	}
+
+	log.Debug("DNS64: %s: synthesized %d AAAA records", req.Question[0].Name, n)
+	d.Res = resp
+	return resultDone
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"runtime"
 	"sort"
 	"strings"
@@ -54,11 +55,36 @@ type Server struct {
 	queryLog  querylog.QueryLog    // Query log instance
 	stats     stats.Stats
 	access    *accessCtx
+	ratelimit *ratelimiter
+	cache     *optimisticCache // nil if dnsproxy's cache is used (EDNS Client Subnet is enabled)
+	health    *healthChecker   // nil if health checking is disabled
+	dnssec    *dnssecValidator // nil if DNSSEC validation is disabled
+
+	fallbackHealth *healthChecker // health checking of fallback servers;  nil if health checking is disabled
+
+	certLock sync.RWMutex // protects the certificate of DNS-over-TLS server
+	txLock   sync.Mutex   // only one configuration transaction may be in progress
+
+	zones          map[string]*forwardZone // forwarding zones by name (lowercase, with the trailing dot)
+	localResolvers []upstream.Upstream     // servers for PTR requests for unknown local addresses
+	localNetworks  []*net.IPNet            // the networks of the network interfaces (if local resolvers are used)
+	localZones     map[string]*localZone   // local zones by name (lowercase, with the trailing dot)
+	pipeline       []stage                 // request processing stages
+	tracer         queryTracer             // trace mode settings and the traces of the requests
+
+	anonymizer ipAnonymizer // for "hash" client IP anonymization mode
+	metrics    serverMetrics
 
 	// DNS proxy instance for internal usage
 	// We don't Start() it and so no listen port is required.
 	internalProxy *proxy.Proxy
 
+	// DNS proxy instances for the additional listeners
+	// They pass the requests to the main instance.
+	listeners []*proxy.Proxy
+
+	sockets *socketLoops // nil if the sockets aren't served
+
 	isRunning bool
 
 	sync.RWMutex
@@ -83,6 +109,8 @@ func NewServer(dnsFilter *dnsfilter.Dnsfilter, stats stats.Stats, queryLog query
 // Close - close object
 func (s *Server) Close() {
 	s.Lock()
+	s.stopSockets()
+	s.saveCache()
 	s.dnsFilter = nil
 	s.stats = nil
 	s.queryLog = nil
@@ -107,6 +135,22 @@ func (s *Server) WriteDiskConfig(c *FilteringConfig) {
 	c.DisallowedClients = stringArrayDup(sc.DisallowedClients)
 	c.BlockedHosts = stringArrayDup(sc.BlockedHosts)
 	c.UpstreamDNS = stringArrayDup(sc.UpstreamDNS)
+	c.FallbackDNS = stringArrayDup(sc.FallbackDNS)
+	c.LocalPTRResolvers = stringArrayDup(sc.LocalPTRResolvers)
+	c.LocalZones = copyLocalZones(sc.LocalZones)
+	c.Pipeline = stringArrayDup(sc.Pipeline)
+	c.BlockedTLDs = stringArrayDup(sc.BlockedTLDs)
+	c.BlockedQueryTypes = stringArrayDup(sc.BlockedQueryTypes)
+	c.Listeners = append([]ListenerConfig{}, sc.Listeners...)
+	c.UpstreamWeights = map[string]uint{}
+	for k, v := range sc.UpstreamWeights {
+		c.UpstreamWeights[k] = v
+	}
+	c.EDNSClientSubnetUpstreams = append([]ECSUpstreamConfig{}, sc.EDNSClientSubnetUpstreams...)
+	c.ForwardZones = []ForwardZone{}
+	for _, z := range sc.ForwardZones {
+		c.ForwardZones = append(c.ForwardZones, ForwardZone{Zone: z.Zone, Upstreams: stringArrayDup(z.Upstreams)})
+	}
 	s.RUnlock()
 }
 
@@ -114,10 +158,26 @@ func (s *Server) WriteDiskConfig(c *FilteringConfig) {
 // The zero FilteringConfig is empty and ready for use.
 type FilteringConfig struct {
 	// Filtering callback function
-	FilterHandler func(clientAddr string, settings *dnsfilter.RequestFilteringSettings) `yaml:"-"`
+	// clientID: ClientID of the client using an encrypted protocol.  Empty: the client is identified by IP address.
+	FilterHandler func(clientAddr, clientID string, settings *dnsfilter.RequestFilteringSettings) `yaml:"-"`
+
+	// This callback function returns the list of upstream servers for a client specified by IP address or ClientID
+	GetUpstreamsByClient func(clientAddr, clientID string) []upstream.Upstream `yaml:"-"`
 
-	// This callback function returns the list of upstream servers for a client specified by IP address
-	GetUpstreamsByClient func(clientAddr string) []upstream.Upstream `yaml:"-"`
+	// This callback function returns the blocking mode for a client specified by IP address or ClientID
+	// An empty mode means that the global settings are used.
+	GetBlockingModeByClient func(clientAddr, clientID string) (mode string, ipv4, ipv6 net.IP) `yaml:"-"`
+
+	// This callback function returns the host name of a local client specified by IP address
+	// An empty string means that the host name is unknown.
+	GetHostnameByIP func(clientAddr string) string `yaml:"-"`
+
+	// This callback function returns TRUE when the requests of a client specified by IP address or ClientID
+	// must not be written to query log or counted in statistics
+	GetLogSettingsByClient func(clientAddr, clientID string) (ignoreQueryLog, ignoreStats bool) `yaml:"-"`
+
+	// This callback function returns the query policy settings for a client specified by IP address or ClientID
+	GetQueryPolicyByClient func(clientAddr, clientID string) QueryPolicy `yaml:"-"`
 
 	ProtectionEnabled bool `yaml:"protection_enabled"` // whether or not use any of dnsfilter features
 
@@ -128,20 +188,85 @@ type FilteringConfig struct {
 	BlockingIPAddrv6 net.IP `yaml:"-"`
 
 	BlockedResponseTTL uint32   `yaml:"blocked_response_ttl"` // if 0, then default is used (3600)
-	Ratelimit          uint32   `yaml:"ratelimit"`            // max number of requests per second from a given IP (0 to disable)
-	RatelimitWhitelist []string `yaml:"ratelimit_whitelist"`  // a list of whitelisted client IP addresses
+	Ratelimit          uint32   `yaml:"ratelimit"`            // max number of UDP requests per second from a given client subnet (0 to disable)
+	RatelimitWhitelist []string `yaml:"ratelimit_whitelist"`  // a list of whitelisted client IP addresses or CIDRs
 	RefuseAny          bool     `yaml:"refuse_any"`           // if true, refuse ANY requests
 	BootstrapDNS       []string `yaml:"bootstrap_dns"`        // a list of bootstrap DNS for DoH and DoT (plain DNS only)
 	AllServers         bool     `yaml:"all_servers"`          // if true, parallel queries to all configured upstream servers are enabled
+	FallbackDNS        []string `yaml:"fallback_dns"`         // upstream servers used when all upstream servers have failed
+
+	// The length of the client subnet prefix for rate limiting.  0: 32 for IPv4, 128 for IPv6 (per IP address)
+	RatelimitSubnetLenIPv4 uint32 `yaml:"ratelimit_subnet_len_ipv4"`
+	RatelimitSubnetLenIPv6 uint32 `yaml:"ratelimit_subnet_len_ipv6"`
+
+	// A client subnet is banned for RatelimitBanDuration seconds (600 by default)
+	// when the number of its rate-limited requests during a minute reaches RatelimitBanThreshold.  0: banning is disabled
+	// The requests from the banned subnets are dropped for all protocols.
+	RatelimitBanThreshold uint32 `yaml:"ratelimit_ban_threshold"`
+	RatelimitBanDuration  uint32 `yaml:"ratelimit_ban_duration"`
+
+	// The maximum size of UDP responses (in bytes), the larger responses are truncated.  0: no limit
+	// It's the protection against amplification attacks.  The size requested by the client (EDNS0) is used if it's less.
+	MaxUDPResponseSize uint32 `yaml:"max_udp_response_size"`
+
+	// Upstream selection policy: "lowest_rtt" (default), "parallel", "round_robin", "weighted" or "strict_order"
+	// "parallel" is used if AllServers is true
+	UpstreamMode    string          `yaml:"upstream_mode"`
+	UpstreamWeights map[string]uint `yaml:"upstream_weights"` // weights for "weighted" mode by upstream address (1 by default)
+
+	// Conditional forwarding: the requests for these zones are passed to the zones' upstream servers only
+	ForwardZones []ForwardZone `yaml:"forward_zones"`
+
+	// Authoritative local zones
+	LocalZones []LocalZone `yaml:"local_zones"`
+
+	// Check each name of CNAME chain in the response with all filtering engines
+	// (blocked services, safe browsing, parental control), not only with filtering rules
+	FullCNAMEFiltering bool `yaml:"full_cname_filtering"`
+
+	// Client IP address anonymization in query log and statistics: "" (disabled), "mask" or "hash"
+	AnonymizeClientIP string `yaml:"anonymize_client_ip"`
+	// Don't write the requests that weren't filtered to query log
+	QueryLogIgnoreAllowed bool `yaml:"querylog_ignore_allowed"`
+
+	// Respond to PTR requests for local addresses with the host names of the clients
+	LocalPTREnabled bool `yaml:"local_ptr_enabled"`
+	// Pass PTR requests for unknown local addresses to LocalPTRResolvers (instead of responding with NXDOMAIN)
+	UseLocalPTRResolvers bool     `yaml:"use_local_ptr_resolvers"`
+	LocalPTRResolvers    []string `yaml:"local_ptr_resolvers"`
+
+	// Interval between probe queries to upstream servers (in seconds).  0: health checking is disabled
+	UpstreamHealthCheckInterval uint32 `yaml:"upstream_health_check_interval"`
+	// The number of consecutive failures after which an upstream server is considered down.  0: default (3)
+	UpstreamMaxFailures uint32 `yaml:"upstream_max_failures"`
 
 	EnableEDNSClientSubnet bool `yaml:"edns_client_subnet"` // Enable EDNS Client Subnet option
 
+	// How to process EDNS Client Subnet option: "auto" (default), "forward", "strip" or "custom"
+	EDNSClientSubnetMode   string `yaml:"edns_client_subnet_mode"`
+	EDNSClientSubnetCustom string `yaml:"edns_client_subnet_custom"` // subnet for "custom" mode
+
+	// ECS settings for specific upstream servers
+	EDNSClientSubnetUpstreams []ECSUpstreamConfig `yaml:"edns_client_subnet_upstreams"`
+
 	// Respond with an empty answer to all AAAA requests
 	AAAADisabled bool `yaml:"aaaa_disabled"`
 
-	AllowedClients    []string `yaml:"allowed_clients"`    // IP addresses of whitelist clients
-	DisallowedClients []string `yaml:"disallowed_clients"` // IP addresses of clients that should be blocked
-	BlockedHosts      []string `yaml:"blocked_hosts"`      // hosts that should be blocked
+	// Query policies (when protection is enabled)
+	BlockedTLDs       []string `yaml:"blocked_tlds"`        // e.g. "zip", "*.top": the requests for the hosts within these TLDs are blocked
+	BlockedQueryTypes []string `yaml:"blocked_query_types"` // e.g. "ANY", "HTTPS": the requests of these types get an empty answer
+
+	// DNS64: synthesize AAAA records from A records for the names that have no AAAA records (RFC 6147)
+	DNS64Enabled bool   `yaml:"dns64_enabled"`
+	DNS64Prefix  string `yaml:"dns64_prefix"` // NAT64 prefix, e.g. "64:ff9b::/96".  Empty: the Well-Known Prefix
+
+	// Validate DNSSEC signatures of the responses from upstream servers
+	// Respond with SERVFAIL when the validation fails (unless the client has set CD bit).
+	DNSSECValidation bool `yaml:"dnssec_validation"`
+
+	AllowedClients    []string `yaml:"allowed_clients"`    // IP addresses, CIDRs or ClientIDs of whitelist clients
+	DisallowedClients []string `yaml:"disallowed_clients"` // IP addresses, CIDRs or ClientIDs of clients that should be blocked
+	BlockedHosts      []string `yaml:"blocked_hosts"`      // hosts, wildcards or filtering rules: requests for these hosts are dropped
 
 	// IP (or domain name) which is used to respond to DNS requests blocked by parental control or safe-browsing
 	ParentalBlockHost     string `yaml:"parental_block_host"`
@@ -149,6 +274,31 @@ type FilteringConfig struct {
 
 	CacheSize   uint     `yaml:"cache_size"` // DNS cache size (in bytes)
 	UpstreamDNS []string `yaml:"upstream_dns"`
+
+	// Optimistic cache: respond with an expired cached response and refresh it in background
+	CacheOptimistic         bool   `yaml:"cache_optimistic"`
+	CacheOptimisticMaxStale uint32 `yaml:"cache_optimistic_max_stale"` // in seconds.  0: default (1 day)
+
+	// Cache lifetime settings (in seconds)
+	CacheMinTTL      uint32 `yaml:"cache_ttl_min"`      // the lower limit of TTL of the cached responses.  0: no limit
+	CacheMaxTTL      uint32 `yaml:"cache_ttl_max"`      // the upper limit of TTL of the cached responses.  0: no limit
+	CacheNegativeTTL uint32 `yaml:"cache_negative_ttl"` // the lifetime of NXDOMAIN and NODATA responses.  0: from SOA record
+	CacheServfailTTL uint32 `yaml:"cache_servfail_ttl"` // the lifetime of SERVFAIL responses (5 minutes maximum).  0: not cached
+
+	// Store the cache in file on shutdown and load it on startup
+	CachePersistent bool `yaml:"cache_persistent"`
+
+	// The addresses the DNS server listens on.  Empty: bind_host and port settings are used
+	Listeners []ListenerConfig `yaml:"listeners"`
+
+	// Prefetch: refresh a popular response in background shortly before it expires
+	CachePrefetch     bool   `yaml:"cache_prefetch"`
+	CachePrefetchHits uint32 `yaml:"cache_prefetch_hits"` // the number of requests after which the response is popular.  0: default (5)
+	CachePrefetchTime uint32 `yaml:"cache_prefetch_time"` // the time before expiration (in seconds).  0: default (10)
+	CachePrefetchQPS  uint32 `yaml:"cache_prefetch_qps"`  // the maximum number of prefetch requests per second.  0: default (10)
+
+	// The order of request processing stages, including the registered middlewares.  Empty: the default order
+	Pipeline []string `yaml:"pipeline"`
 }
 
 // TLSConfig is the TLS configuration for HTTPS, DNS-over-HTTPS, and DNS-over-TLS
@@ -161,11 +311,34 @@ type TLSConfig struct {
 	CertificatePath string `yaml:"certificate_path" json:"certificate_path"` // certificate file name
 	PrivateKeyPath  string `yaml:"private_key_path" json:"private_key_path"` // private key file name
 
+	// The server name of DNS-over-TLS and DNS-over-HTTPS servers
+	// The clients may use "clientid.<server name>" to identify themselves.
+	ServerName string `yaml:"-" json:"-"`
+
+	// The sources of ClientID for ServerName: "" (all), "sni", "path", "none"
+	ClientIDMode string `yaml:"client_id_mode" json:"client_id_mode"`
+
+	// Additional server names with their own certificates
+	ServerNames []TLSServerName `yaml:"server_names" json:"server_names"`
+
+	// The path of DNS-over-HTTPS requests.  Empty: "/dns-query"
+	DoHPath string `yaml:"doh_path" json:"doh_path"`
+
+	// Additional paths of DNS-over-HTTPS requests with their ClientIDs
+	DoHEndpoints []DoHEndpoint `yaml:"doh_endpoints" json:"doh_endpoints"`
+
+	// Mutual TLS: DNS-over-TLS and DNS-over-HTTPS clients must present a certificate signed by the client CA
+	ClientAuth   bool   `yaml:"client_auth" json:"client_auth"`
+	ClientCA     string `yaml:"client_ca" json:"client_ca"`           // PEM-encoded CA certificates
+	ClientCAPath string `yaml:"client_ca_path" json:"client_ca_path"` // CA certificates file name
+
 	CertificateChainData []byte `yaml:"-" json:"-"`
 	PrivateKeyData       []byte `yaml:"-" json:"-"`
+	ClientCAData         []byte `yaml:"-" json:"-"`
 
-	cert     tls.Certificate // nolint(structcheck) - linter thinks that this field is unused, while TLSConfig is directly included into ServerConfig
-	dnsNames []string        // nolint(structcheck) // DNS names from certificate (SAN) or CN value from Subject
+	cert     tls.Certificate  // nolint(structcheck) - linter thinks that this field is unused, while TLSConfig is directly included into ServerConfig
+	dnsNames []string         // nolint(structcheck) // DNS names from certificate (SAN) or CN value from Subject
+	tlsNames *TLSCertificates // nolint(structcheck) // the parsed ServerNames
 }
 
 // ServerConfig represents server configuration.
@@ -183,8 +356,28 @@ type ServerConfig struct {
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func()
 
+	// Called when an upstream server is considered down by health checking
+	OnUpstreamDown func(address string, err error)
+
+	// Called for each blocked request
+	OnDNSBlocked func(clientIP, host string, result *dnsfilter.Result)
+
 	// Register an HTTP handler
 	HTTPRegister func(string, string, func(http.ResponseWriter, *http.Request))
+
+	// The file the DNS cache is stored in if CachePersistent is enabled
+	CacheFile string
+
+	// The listening sockets used instead of the listen addresses (UDP, TCP and TLS)
+	// nil: DNS server binds the listen addresses
+	Sockets *Sockets
+
+	// The outbound proxy for DNS-over-HTTPS upstream servers
+	// nil: they're connected directly
+	UpstreamProxy *url.URL
+
+	dns64Prefix *net.IPNet // parsed DNS64Prefix value
+	ecsSubnet   *net.IPNet // parsed EDNSClientSubnetCustom value
 }
 
 // if any of ServerConfig values are zero, then default values from below are used
@@ -233,11 +426,65 @@ func (s *Server) Start() error {
 
 // startInternal starts without locking
 func (s *Server) startInternal() error {
-	err := s.dnsProxy.Start()
-	if err == nil {
-		s.isRunning = true
+	var err error
+	if hasListenAddr(&s.dnsProxy.Config) {
+		err = s.dnsProxy.Start()
+		if err != nil {
+			return err
+		}
+	} else {
+		// all requests are received on the sockets
+		s.dnsProxy.Init()
+	}
+	for i, p := range s.listeners {
+		err = p.Start()
+		if err != nil {
+			for _, p := range s.listeners[:i] {
+				_ = p.Stop()
+			}
+			_ = s.dnsProxy.Stop()
+			return err
+		}
+	}
+
+	s.isRunning = true
+	s.startSockets()
+	if s.health != nil {
+		s.health.start()
+		s.fallbackHealth.start()
+	}
+	return nil
+}
+
+// Create fallback upstream object with metrics and health tracking
+func (s *Server) fallbackToUpstream(address string, opts upstream.Options) (upstream.Upstream, error) {
+	u, err := AddressToUpstream(address, opts, s.conf.UpstreamProxy)
+	if err != nil {
+		return nil, err
+	}
+	u = s.metrics.wrap(address, u)
+	if s.fallbackHealth != nil {
+		u = s.fallbackHealth.wrap(address, u)
+	}
+	return u, nil
+}
+
+// Get the function that creates upstream objects with ECS settings, metrics and health tracking
+// addrs: the configured addresses of the created objects are stored here
+func (s *Server) addressToUpstream(addrs map[upstream.Upstream]string) proxy.AddressToUpstreamFunction {
+	ecsAddressToUpstream := s.ecsAddressToUpstream()
+	return func(address string, opts upstream.Options) (upstream.Upstream, error) {
+		u, err := ecsAddressToUpstream(address, opts)
+		if err != nil {
+			return nil, err
+		}
+		u = s.metrics.wrap(address, u)
+		if s.health != nil {
+			u = s.health.wrap(address, u)
+		}
+		addrs[u] = address
+		return u, nil
 	}
-	return err
 }
 
 // Prepare the object
@@ -254,6 +501,18 @@ func (s *Server) Prepare(config *ServerConfig) error {
 		}
 	}
 
+	var err error
+	s.conf.dns64Prefix, err = parseDNS64Prefix(s.conf.DNS64Prefix)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+
+	err = checkECSConfig(s.conf.EDNSClientSubnetMode, s.conf.EDNSClientSubnetCustom, s.conf.EDNSClientSubnetUpstreams)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+	s.conf.ecsSubnet, _ = checkECSMode(s.conf.EDNSClientSubnetMode, s.conf.EDNSClientSubnetCustom, false)
+
 	if len(s.conf.UpstreamDNS) == 0 {
 		s.conf.UpstreamDNS = defaultDNS
 	}
@@ -261,12 +520,100 @@ func (s *Server) Prepare(config *ServerConfig) error {
 		s.conf.BootstrapDNS = defaultBootstrap
 	}
 
-	upstreamConfig, err := proxy.ParseUpstreamsConfig(s.conf.UpstreamDNS, s.conf.BootstrapDNS, DefaultTimeout)
+	if s.health != nil {
+		s.health.close()
+		s.fallbackHealth.close()
+		s.health = nil
+		s.fallbackHealth = nil
+	}
+	if s.conf.UpstreamHealthCheckInterval != 0 {
+		s.health = newHealthChecker(time.Duration(s.conf.UpstreamHealthCheckInterval)*time.Second,
+			s.conf.UpstreamMaxFailures, s.conf.OnUpstreamDown)
+		// the state of fallback servers doesn't affect the usage of the main servers
+		s.fallbackHealth = newHealthChecker(time.Duration(s.conf.UpstreamHealthCheckInterval)*time.Second,
+			s.conf.UpstreamMaxFailures, s.conf.OnUpstreamDown)
+	}
+
+	err = checkUpstreamMode(s.conf.UpstreamMode, s.conf.UpstreamWeights)
 	if err != nil {
-		return fmt.Errorf("DNS: proxy.ParseUpstreamsConfig: %s", err)
+		return fmt.Errorf("DNS: %s", err)
 	}
-	s.conf.Upstreams = upstreamConfig.Upstreams
+	err = checkAnonymizeMode(s.conf.AnonymizeClientIP)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+	addrs := map[upstream.Upstream]string{}
+	upstreamConfig, err := proxy.ParseUpstreamsConfigEx(s.conf.UpstreamDNS, s.conf.BootstrapDNS, DefaultTimeout,
+		s.addressToUpstream(addrs))
+	if err != nil {
+		return fmt.Errorf("DNS: proxy.ParseUpstreamsConfigEx: %s", err)
+	}
+	s.conf.Upstreams = applyUpstreamMode(s.conf.UpstreamMode, upstreamConfig.Upstreams, addrs, s.conf.UpstreamWeights)
 	s.conf.DomainsReservedUpstreams = upstreamConfig.DomainReservedUpstreams
+	for host, list := range s.conf.DomainsReservedUpstreams {
+		s.conf.DomainsReservedUpstreams[host] = applyUpstreamMode(s.conf.UpstreamMode, list, addrs, s.conf.UpstreamWeights)
+	}
+
+	s.localZones, err = prepareLocalZones(s.conf.LocalZones)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+
+	s.pipeline, err = buildPipeline(s.conf.Pipeline)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+
+	err = checkBlockedTLDs(s.conf.BlockedTLDs)
+	if err != nil {
+		return fmt.Errorf("DNS: blocked_tlds: %s", err)
+	}
+	err = checkCacheConfig(&s.conf.FilteringConfig)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+	err = checkListeners(s.conf.Listeners)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+	err = CheckQueryTypes(s.conf.BlockedQueryTypes)
+	if err != nil {
+		return fmt.Errorf("DNS: blocked_query_types: %s", err)
+	}
+
+	s.zones, err = s.prepareForwardZones(addrs)
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
+
+	s.localResolvers = nil
+	s.localNetworks = nil
+	if s.conf.UseLocalPTRResolvers && len(s.conf.LocalPTRResolvers) != 0 {
+		err = checkLocalResolvers(s.conf.LocalPTRResolvers)
+		if err != nil {
+			return fmt.Errorf("DNS: %s", err)
+		}
+		localConfig, err := proxy.ParseUpstreamsConfig(s.conf.LocalPTRResolvers, s.conf.BootstrapDNS, DefaultTimeout)
+		if err != nil {
+			return fmt.Errorf("DNS: local resolvers: proxy.ParseUpstreamsConfig: %s", err)
+		}
+		s.localResolvers = localConfig.Upstreams
+
+		// the local resolvers know the networks of this machine better than the public upstream servers
+		s.localNetworks = interfaceNetworks()
+		log.Debug("DNS: local networks: %v", s.localNetworks)
+	}
+
+	// dnsproxy uses fallback servers only when the main servers have failed to respond
+	var fallbacks []upstream.Upstream
+	if len(s.conf.FallbackDNS) != 0 {
+		fallbackConfig, err := proxy.ParseUpstreamsConfigEx(s.conf.FallbackDNS, s.conf.BootstrapDNS, DefaultTimeout,
+			s.fallbackToUpstream)
+		if err != nil {
+			return fmt.Errorf("DNS: fallback servers: proxy.ParseUpstreamsConfig: %s", err)
+		}
+		fallbacks = fallbackConfig.Upstreams
+	}
 
 	if len(s.conf.ParentalBlockHost) == 0 {
 		s.conf.ParentalBlockHost = parentalBlockHost
@@ -281,20 +628,43 @@ func (s *Server) Prepare(config *ServerConfig) error {
 		s.conf.TCPListenAddr = defaultValues.TCPListenAddr
 	}
 
+	// dnsproxy's cache is replaced by our cache which supports optimistic mode and lifetime settings.
+	// Responses with EDNS Client Subnet option are stored by dnsproxy's subnet cache only.
+	s.cache = nil
+	if !s.conf.EnableEDNSClientSubnet {
+		if s.conf.CacheOptimistic {
+			s.cache = newOptimisticCache(s.conf.CacheSize, s.conf.CacheOptimisticMaxStale)
+		} else {
+			s.cache = newResponseCache(s.conf.CacheSize)
+		}
+		s.cache.ttls = cacheTTLsFromConfig(&s.conf.FilteringConfig)
+		s.cache.prefetch = cachePrefetchFromConfig(&s.conf.FilteringConfig)
+		if s.conf.CachePersistent && len(s.conf.CacheFile) != 0 {
+			s.cache.trackKeys()
+			s.loadCache()
+		}
+	}
+
+	// the validated keys are kept in cache after reconfiguration
+	if !s.conf.DNSSECValidation {
+		s.dnssec = nil
+	} else if s.dnssec == nil {
+		s.dnssec = newDNSSECValidator(s.exchangeDNSSEC)
+	}
+
 	proxyConfig := proxy.Config{
 		UDPListenAddr:            s.conf.UDPListenAddr,
 		TCPListenAddr:            s.conf.TCPListenAddr,
-		Ratelimit:                int(s.conf.Ratelimit),
-		RatelimitWhitelist:       s.conf.RatelimitWhitelist,
 		RefuseAny:                s.conf.RefuseAny,
-		CacheEnabled:             true,
+		CacheEnabled:             s.cache == nil,
 		CacheSizeBytes:           int(s.conf.CacheSize),
 		Upstreams:                s.conf.Upstreams,
 		DomainsReservedUpstreams: s.conf.DomainsReservedUpstreams,
 		BeforeRequestHandler:     s.beforeRequestHandler,
 		RequestHandler:           s.handleDNSRequest,
-		AllServers:               s.conf.AllServers,
+		AllServers:               s.conf.AllServers || s.conf.UpstreamMode == upstreamModeParallel,
 		EnableEDNSClientSubnet:   s.conf.EnableEDNSClientSubnet,
+		Fallbacks:                fallbacks,
 	}
 
 	intlProxyConfig := proxy.Config{
@@ -311,13 +681,36 @@ func (s *Server) Prepare(config *ServerConfig) error {
 		return err
 	}
 
-	if s.conf.TLSListenAddr != nil && len(s.conf.CertificateChainData) != 0 && len(s.conf.PrivateKeyData) != 0 {
+	err = CheckDoHPaths(s.conf.DoHPath, s.conf.DoHEndpoints)
+	if err != nil {
+		return fmt.Errorf("DNS-over-HTTPS: %s", err)
+	}
+
+	// rate limiting is done here rather than by dnsproxy: it's done by client subnets
+	err = checkRatelimitConfig(&s.conf.FilteringConfig)
+	if err != nil {
+		return err
+	}
+	s.ratelimit = newRatelimiter(&s.conf.FilteringConfig)
+
+	socketsTLS := s.conf.Sockets != nil && len(s.conf.Sockets.TLS) != 0
+	if (s.conf.TLSListenAddr != nil || listenersUseTLS(s.conf.Listeners) || socketsTLS) &&
+		len(s.conf.CertificateChainData) != 0 && len(s.conf.PrivateKeyData) != 0 {
 		proxyConfig.TLSListenAddr = s.conf.TLSListenAddr
 		s.conf.cert, err = tls.X509KeyPair(s.conf.CertificateChainData, s.conf.PrivateKeyData)
 		if err != nil {
 			return errorx.Decorate(err, "Failed to parse TLS keypair")
 		}
 
+		err = CheckClientIDMode(s.conf.ClientIDMode)
+		if err != nil {
+			return err
+		}
+		s.conf.tlsNames, err = NewTLSCertificates(s.conf.ServerNames)
+		if err != nil {
+			return fmt.Errorf("TLS: server names: %s", err)
+		}
+
 		if s.conf.StrictSNICheck {
 			x, err := x509.ParseCertificate(s.conf.cert.Certificate[0])
 			if err != nil {
@@ -337,6 +730,14 @@ func (s *Server) Prepare(config *ServerConfig) error {
 			GetCertificate: s.onGetCertificate,
 			MinVersion:     tls.VersionTLS12,
 		}
+		if s.conf.ClientAuth {
+			// the connections without a valid client certificate are rejected during TLS handshake
+			proxyConfig.TLSConfig.ClientCAs, err = ParseClientCAs(s.conf.ClientCAData)
+			if err != nil {
+				return fmt.Errorf("TLS: client CA: %s", err)
+			}
+			proxyConfig.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
 	}
 
 	if len(proxyConfig.Upstreams) == 0 {
@@ -348,6 +749,32 @@ func (s *Server) Prepare(config *ServerConfig) error {
 		s.registerHandlers()
 	}
 
+	// the main instance listens on the addresses of the first listener
+	s.listeners = nil
+	if len(s.conf.Listeners) != 0 {
+		confs, err := listenerConfigs(s.conf.Listeners, proxyConfig)
+		if err != nil {
+			return fmt.Errorf("DNS: %s", err)
+		}
+		if !s.conf.Sockets.empty() {
+			// the main instance serves the sockets
+			confs = append([]proxy.Config{proxyConfig}, confs...)
+		}
+		proxyConfig = confs[0]
+		for _, c := range confs[1:] {
+			s.listeners = append(s.listeners, &proxy.Proxy{Config: c})
+		}
+	}
+
+	// the sockets replace the listen addresses of the main instance
+	if !s.conf.Sockets.empty() {
+		proxyConfig.UDPListenAddr = nil
+		proxyConfig.TCPListenAddr = nil
+		if socketsTLS {
+			proxyConfig.TLSListenAddr = nil
+		}
+	}
+
 	// Initialize and start the DNS proxy
 	s.dnsProxy = &proxy.Proxy{Config: proxyConfig}
 	return nil
@@ -391,13 +818,46 @@ func matchDNSName(dnsNames []string, sni string) bool {
 }
 
 // Called by 'tls' package when Client Hello is received
+// The certificate of an additional server name is selected by SNI value; otherwise the main certificate is used.
 // If the server name (from SNI) supplied by client is incorrect - we terminate the ongoing TLS handshake.
 func (s *Server) onGetCertificate(ch *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.certLock.RLock()
+	defer s.certLock.RUnlock()
+	if c := s.conf.tlsNames.Get(ch.ServerName); c != nil {
+		return c, nil
+	}
 	if s.conf.StrictSNICheck && !matchDNSName(s.conf.dnsNames, ch.ServerName) {
 		log.Info("DNS: TLS: unknown SNI in Client Hello: %s", ch.ServerName)
 		return nil, fmt.Errorf("Invalid SNI")
 	}
-	return &s.conf.cert, nil
+	cert := s.conf.cert
+	return &cert, nil
+}
+
+// UpdateCertificate - replace the certificate of DNS-over-TLS server without restarting it
+func (s *Server) UpdateCertificate(certChain, privateKey []byte) error {
+	cert, err := tls.X509KeyPair(certChain, privateKey)
+	if err != nil {
+		return errorx.Decorate(err, "Failed to parse TLS keypair")
+	}
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return errorx.Decorate(err, "x509.ParseCertificate(): %s", err)
+	}
+	dnsNames := x.DNSNames
+	if len(dnsNames) == 0 {
+		dnsNames = []string{x.Subject.CommonName}
+	}
+	sort.Strings(dnsNames)
+
+	s.certLock.Lock()
+	s.conf.cert = cert
+	s.conf.dnsNames = dnsNames
+	s.conf.CertificateChainData = certChain
+	s.conf.PrivateKeyData = privateKey
+	s.certLock.Unlock()
+	log.Debug("DNS: TLS: the certificate has been updated")
+	return nil
 }
 
 // Stop stops the DNS server
@@ -409,11 +869,23 @@ func (s *Server) Stop() error {
 
 // stopInternal stops without locking
 func (s *Server) stopInternal() error {
-	if s.dnsProxy != nil {
+	if s.health != nil {
+		s.health.close()
+		s.fallbackHealth.close()
+	}
+	// dnsproxy can't stop the server which is already stopped:
+	// its listener goroutines keep the lock after they have exited
+	if s.dnsProxy != nil && s.isRunning {
 		err := s.dnsProxy.Stop()
 		if err != nil {
 			return errorx.Decorate(err, "could not stop the DNS server properly")
 		}
+		for _, p := range s.listeners {
+			err = p.Stop()
+			if err != nil {
+				return errorx.Decorate(err, "could not stop the DNS server properly")
+			}
+		}
 	}
 
 	s.isRunning = false
@@ -479,9 +951,22 @@ func ipFromAddr(a net.Addr) string {
 }
 
 func (s *Server) beforeRequestHandler(p *proxy.Proxy, d *proxy.DNSContext) (bool, error) {
+	if s.ratelimit.isLimited(getIP(d.Addr), d.Proto == proxy.ProtoUDP, time.Now()) {
+		log.Tracef("Client IP %s is rate-limited", d.Addr)
+		return false, nil
+	}
+
+	// DNS-over-HTTPS listeners receive the requests with any path
+	if d.Proto == proxy.ProtoHTTPS && d.HTTPRequest != nil &&
+		!IsDoHPath(d.HTTPRequest.URL.Path, s.conf.DoHPath, s.conf.DoHEndpoints) {
+		log.Tracef("Unknown DNS-over-HTTPS path: %s", d.HTTPRequest.URL.Path)
+		return false, nil
+	}
+
 	ip := ipFromAddr(d.Addr)
-	if s.access.IsBlockedIP(ip) {
-		log.Tracef("Client IP %s is blocked by settings", ip)
+	clientID := s.clientID(d)
+	if s.access.IsBlockedClient(ip, clientID) {
+		log.Tracef("Client IP %s (ClientID %q) is blocked by settings", ip, clientID)
 		return false, nil
 	}
 
@@ -505,9 +990,16 @@ type dnsContext struct {
 	result               *dnsfilter.Result
 	origResp             *dns.Msg     // response received from upstream servers.  Set when response is modified by filtering
 	origQuestion         dns.Question // question received from client.  Set when Rewrites are used.
+	dnssec               string       // DNSSEC validation status;  empty if the response isn't validated
 	err                  error        // error returned from the module
 	protectionEnabled    bool         // filtering is enabled, dnsfilter object is ready
 	responseFromUpstream bool         // response is received from upstream servers
+	aaaaDisabled         bool         // AAAA records are filtered out for this client
+	aaaaFiltered         bool         // AAAA request is answered with an empty response
+	trace                *queryTrace  // nil if the request isn't traced
+
+	// the result of filtering that isn't applied in audit mode: the request would have been blocked
+	wouldBlock *dnsfilter.Result
 }
 
 const (
@@ -520,19 +1012,17 @@ const (
 func processInitial(ctx *dnsContext) int {
 	s := ctx.srv
 	d := ctx.proxyCtx
-	if s.conf.AAAADisabled && d.Req.Question[0].Qtype == dns.TypeAAAA {
-		_ = proxy.CheckDisabledAAAARequest(d, true)
-		return resultFinish
-	}
+	s.applyQueryPolicy(ctx)
 
 	if s.conf.OnDNSRequest != nil {
 		s.conf.OnDNSRequest(d)
 	}
 
 	// disable Mozilla DoH
-	if (d.Req.Question[0].Qtype == dns.TypeA || d.Req.Question[0].Qtype == dns.TypeAAAA) &&
+	if d.Res == nil && (d.Req.Question[0].Qtype == dns.TypeA || d.Req.Question[0].Qtype == dns.TypeAAAA) &&
 		d.Req.Question[0].Name == "use-application-dns.net." {
 		d.Res = s.genNXDomain(d.Req)
+		ctx.trace.add("Mozilla DoH canary domain")
 		return resultFinish
 	}
 
@@ -543,6 +1033,9 @@ func processInitial(ctx *dnsContext) int {
 func processFilteringBeforeRequest(ctx *dnsContext) int {
 	s := ctx.srv
 	d := ctx.proxyCtx
+	if d.Res != nil {
+		return resultDone // response is already set - nothing to do
+	}
 
 	s.RLock()
 	// Synchronize access to s.dnsFilter so it won't be suddenly uninitialized while in use.
@@ -557,6 +1050,8 @@ func processFilteringBeforeRequest(ctx *dnsContext) int {
 	if ctx.protectionEnabled {
 		ctx.setts = s.getClientRequestFilteringSettings(d)
 		ctx.result, err = s.filterDNSRequest(ctx)
+	} else {
+		ctx.trace.add("protection is disabled")
 	}
 	s.RUnlock()
 
@@ -577,19 +1072,47 @@ func processUpstream(ctx *dnsContext) int {
 
 	if d.Addr != nil && s.conf.GetUpstreamsByClient != nil {
 		clientIP := ipFromAddr(d.Addr)
-		upstreams := s.conf.GetUpstreamsByClient(clientIP)
+		upstreams := s.conf.GetUpstreamsByClient(clientIP, s.clientID(d))
 		if len(upstreams) > 0 {
 			log.Debug("Using custom upstreams for %s", clientIP)
 			d.Upstreams = upstreams
+			ctx.trace.add("using %d custom upstream servers of the client", len(upstreams))
 		}
 	}
 
+	// DNSSEC records are always requested when the validation is enabled
+	var clientOPT, clientDO bool
+	if s.dnssec != nil {
+		clientOPT, clientDO = setDO(d.Req)
+	}
+
+	if ctx.trace != nil {
+		s.traceResolve(ctx)
+	}
+
 	// request was not filtered so let it be processed further
-	err := s.dnsProxy.Resolve(d)
+	start := time.Now()
+	err := s.resolve(d)
+	if ctx.trace != nil {
+		s.traceResolved(ctx, time.Since(start), err)
+	}
+	if s.dnssec != nil {
+		if err == nil && d.Res != nil {
+			s.validateDNSSEC(ctx, clientDO)
+			ctx.trace.add("DNSSEC validation: %s", ctx.dnssec)
+		}
+		restoreDO(d.Req, d.Res, clientOPT, clientDO)
+	}
 	if err != nil {
 		ctx.err = err
 		return resultError
 	}
+	s.metrics.countCache(d.Upstream == nil)
+
+	if ctx.aaaaDisabled && d.Res != nil && stripAAAA(d.Res) {
+		log.Debug("DNS: removed AAAA records from the response to %s", d.Req.Question[0].Name)
+		ctx.trace.add("removed AAAA records from the response")
+	}
 
 	ctx.responseFromUpstream = true
 	return resultDone
@@ -617,7 +1140,8 @@ func processFilteringAfterResponse(ctx *dnsContext) int {
 			d.Res.Answer = answer
 		}
 
-	} else if res.Reason != dnsfilter.NotFilteredWhiteList && ctx.protectionEnabled {
+	} else if res.Reason != dnsfilter.NotFilteredWhiteList && res.Reason != dnsfilter.NotFilteredExpression &&
+		ctx.protectionEnabled {
 		origResp2 := d.Res
 		ctx.result, err = s.filterDNSResponse(ctx)
 		if err != nil {
@@ -639,6 +1163,12 @@ func processQueryLogsAndStats(ctx *dnsContext) int {
 	elapsed := time.Since(ctx.startTime)
 	s := ctx.srv
 	d := ctx.proxyCtx
+	s.metrics.countRequest(ctx.result)
+
+	if ctx.result.IsFiltered && s.conf.OnDNSBlocked != nil && d.Addr != nil && len(d.Req.Question) != 0 {
+		host := strings.TrimSuffix(d.Req.Question[0].Name, ".")
+		s.conf.OnDNSBlocked(s.anonymizeIP(getIP(d.Addr)).String(), host, ctx.result)
+	}
 
 	shouldLog := true
 	msg := d.Req
@@ -648,7 +1178,25 @@ func processQueryLogsAndStats(ctx *dnsContext) int {
 		shouldLog = false
 	}
 
+	// AAAA requests answered with an empty response are only counted in statistics
+	if ctx.aaaaFiltered {
+		shouldLog = false
+	}
+
+	ignoreStats := false
+	if d.Addr != nil && s.conf.GetLogSettingsByClient != nil {
+		var ignoreQueryLog bool
+		ignoreQueryLog, ignoreStats = s.conf.GetLogSettingsByClient(ipFromAddr(d.Addr), s.clientID(d))
+		if ignoreQueryLog {
+			shouldLog = false
+		}
+	}
+
 	s.RLock()
+	if s.conf.QueryLogIgnoreAllowed && !ctx.result.IsFiltered {
+		shouldLog = false
+	}
+
 	// Synchronize access to s.queryLog and s.stats so they won't be suddenly uninitialized while in use.
 	// This can happen after proxy server has been stopped, but its workers haven't yet exited.
 	if shouldLog && s.queryLog != nil {
@@ -657,8 +1205,10 @@ func processQueryLogsAndStats(ctx *dnsContext) int {
 			Answer:     d.Res,
 			OrigAnswer: ctx.origResp,
 			Result:     ctx.result,
+			WouldBlock: ctx.wouldBlock,
 			Elapsed:    elapsed,
-			ClientIP:   getIP(d.Addr),
+			ClientIP:   s.anonymizeIP(getIP(d.Addr)),
+			DNSSEC:     ctx.dnssec,
 		}
 		if d.Upstream != nil {
 			p.Upstream = d.Upstream.Address()
@@ -666,7 +1216,9 @@ func processQueryLogsAndStats(ctx *dnsContext) int {
 		s.queryLog.Add(p)
 	}
 
-	s.updateStats(d, elapsed, *ctx.result)
+	if !ignoreStats {
+		s.updateStats(ctx, elapsed)
+	}
 	s.RUnlock()
 
 	return resultDone
@@ -678,17 +1230,20 @@ func (s *Server) handleDNSRequest(p *proxy.Proxy, d *proxy.DNSContext) error {
 	ctx := &dnsContext{srv: s, proxyCtx: d}
 	ctx.result = &dnsfilter.Result{}
 	ctx.startTime = time.Now()
+	ctx.trace = s.startTrace(ctx)
+	defer s.finishTrace(ctx)
 
-	type modProcessFunc func(ctx *dnsContext) int
-	mods := []modProcessFunc{
-		processInitial,
-		processFilteringBeforeRequest,
-		processUpstream,
-		processFilteringAfterResponse,
-		processQueryLogsAndStats,
-	}
-	for _, process := range mods {
-		r := process(ctx)
+	s.RLock()
+	mods := s.pipeline
+	s.RUnlock()
+	if mods == nil {
+		mods = defaultStages()
+	}
+	for _, st := range mods {
+		ctx.trace.startStage(st.name)
+		hadRes := d.Res != nil
+		r := st.process(ctx)
+		ctx.trace.endStage(d, hadRes, r, ctx.err)
 		switch r {
 		case resultFinish:
 			return nil
@@ -699,10 +1254,30 @@ func (s *Server) handleDNSRequest(p *proxy.Proxy, d *proxy.DNSContext) error {
 
 	if d.Res != nil {
 		d.Res.Compress = true // some devices require DNS message compression
+		s.limitUDPResponse(d)
 	}
 	return nil
 }
 
+// Truncate UDP response to the maximum size (protection against amplification attacks)
+func (s *Server) limitUDPResponse(d *proxy.DNSContext) {
+	if d.Proto != proxy.ProtoUDP || s.conf.MaxUDPResponseSize == 0 {
+		return
+	}
+	size := dns.MinMsgSize
+	opt := d.Req.IsEdns0()
+	if opt != nil {
+		size = int(opt.UDPSize())
+	}
+	if size > int(s.conf.MaxUDPResponseSize) {
+		size = int(s.conf.MaxUDPResponseSize)
+	}
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	d.Res.Truncate(size)
+}
+
 // Get IP address from net.Addr
 func getIP(addr net.Addr) net.IP {
 	switch addr := addr.(type) {
@@ -714,10 +1289,12 @@ func getIP(addr net.Addr) net.IP {
 	return nil
 }
 
-func (s *Server) updateStats(d *proxy.DNSContext, elapsed time.Duration, res dnsfilter.Result) {
+func (s *Server) updateStats(ctx *dnsContext, elapsed time.Duration) {
 	if s.stats == nil {
 		return
 	}
+	d := ctx.proxyCtx
+	res := *ctx.result
 
 	e := stats.Entry{}
 	e.Domain = strings.ToLower(d.Req.Question[0].Name)
@@ -728,6 +1305,7 @@ func (s *Server) updateStats(d *proxy.DNSContext, elapsed time.Duration, res dns
 	case *net.TCPAddr:
 		e.Client = addr.IP
 	}
+	e.Client = s.anonymizeIP(e.Client)
 	e.Time = uint32(elapsed / 1000)
 	switch res.Reason {
 
@@ -735,6 +1313,8 @@ func (s *Server) updateStats(d *proxy.DNSContext, elapsed time.Duration, res dns
 		fallthrough
 	case dnsfilter.NotFilteredWhiteList:
 		fallthrough
+	case dnsfilter.NotFilteredExpression:
+		fallthrough
 	case dnsfilter.NotFilteredError:
 		e.Result = stats.RNotFiltered
 
@@ -750,19 +1330,31 @@ func (s *Server) updateStats(d *proxy.DNSContext, elapsed time.Duration, res dns
 	case dnsfilter.FilteredInvalid:
 		fallthrough
 	case dnsfilter.FilteredBlockedService:
+		fallthrough
+	case dnsfilter.FilteredExpression:
+		fallthrough
+	case dnsfilter.FilteredQueryPolicy:
 		e.Result = stats.RFiltered
 	}
+	if ctx.aaaaFiltered {
+		e.Result = stats.RFilteredAAAA
+	}
+	if res.Reason == dnsfilter.FilteredBlackList || res.Reason == dnsfilter.NotFilteredWhiteList {
+		e.RuleMatched = true
+		e.FilterID = res.FilterID
+	}
 	s.stats.Update(e)
 }
 
 // getClientRequestFilteringSettings lookups client filtering settings
-// using the client's IP address from the DNSContext
+// using the client's IP address and ClientID from the DNSContext
 func (s *Server) getClientRequestFilteringSettings(d *proxy.DNSContext) *dnsfilter.RequestFilteringSettings {
 	setts := s.dnsFilter.GetConfig()
 	setts.FilteringEnabled = true
+	setts.ClientIP = ipFromAddr(d.Addr)
+	setts.ClientID = s.clientID(d)
 	if s.conf.FilterHandler != nil {
-		clientAddr := ipFromAddr(d.Addr)
-		s.conf.FilterHandler(clientAddr, &setts)
+		s.conf.FilterHandler(setts.ClientIP, setts.ClientID, &setts)
 	}
 	return &setts
 }
@@ -772,11 +1364,25 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 	d := ctx.proxyCtx
 	req := d.Req
 	host := strings.TrimSuffix(req.Question[0].Name, ".")
-	res, err := s.dnsFilter.CheckHost(host, d.Req.Question[0].Qtype, ctx.setts)
+	var res dnsfilter.Result
+	var err error
+	if ctx.trace != nil {
+		var trace dnsfilter.Trace
+		res, trace, err = s.dnsFilter.CheckHostTrace(host, d.Req.Question[0].Qtype, ctx.setts)
+		ctx.trace.addFiltering(host, trace)
+	} else {
+		res, err = s.dnsFilter.CheckHost(host, d.Req.Question[0].Qtype, ctx.setts)
+	}
 	if err != nil {
 		// Return immediately if there's an error
 		return nil, errorx.Decorate(err, "dnsfilter failed to check host '%s'", host)
 
+	} else if res.IsFiltered && ctx.setts.AuditMode {
+		log.Debug("DNSFwd: audit mode: %s would be blocked: %s", host, res.Reason)
+		ctx.trace.add("audit mode: the request isn't blocked")
+		ctx.wouldBlock = &res
+		return &dnsfilter.Result{}, nil
+
 	} else if res.IsFiltered {
 		// log.Tracef("Host %s is filtered, reason - '%s', matched rule: '%s'", host, res.Reason, res.Rule)
 		d.Res = s.genDNSFilterMessage(d, &res)
@@ -818,13 +1424,16 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 // If this is a match, we set a new response in d.Res and return.
 func (s *Server) filterDNSResponse(ctx *dnsContext) (*dnsfilter.Result, error) {
 	d := ctx.proxyCtx
+	checked := map[string]bool{}
 	for _, a := range d.Res.Answer {
 		host := ""
+		cname := false
 
 		switch v := a.(type) {
 		case *dns.CNAME:
 			log.Debug("DNSFwd: Checking CNAME %s for %s", v.Target, v.Hdr.Name)
-			host = strings.TrimSuffix(v.Target, ".")
+			host = strings.ToLower(strings.TrimSuffix(v.Target, "."))
+			cname = true
 
 		case *dns.A:
 			host = v.A.String()
@@ -845,12 +1454,27 @@ func (s *Server) filterDNSResponse(ctx *dnsContext) (*dnsfilter.Result, error) {
 			s.RUnlock()
 			continue
 		}
-		res, err := s.dnsFilter.CheckHostRules(host, d.Req.Question[0].Qtype, ctx.setts)
+		var res dnsfilter.Result
+		var err error
+		if cname && s.conf.FullCNAMEFiltering {
+			res, err = s.checkCNAMEHost(ctx, host, checked)
+		} else {
+			res, err = s.dnsFilter.CheckHostRules(host, d.Req.Question[0].Qtype, ctx.setts)
+		}
 		s.RUnlock()
+		if ctx.trace != nil {
+			ctx.trace.addFiltering(host, dnsfilter.Trace{Steps: []dnsfilter.TraceStep{{Name: "response", Result: res}}})
+		}
 
 		if err != nil {
 			return nil, err
 
+		} else if res.IsFiltered && ctx.setts.AuditMode {
+			log.Debug("DNSFwd: audit mode: %s would be blocked by response: %s", d.Req.Question[0].Name, host)
+			ctx.trace.add("audit mode: the response isn't blocked")
+			ctx.wouldBlock = &res
+			return nil, nil
+
 		} else if res.IsFiltered {
 			d.Res = s.genDNSFilterMessage(d, &res)
 			log.Debug("DNSFwd: Matched %s by response: %s", d.Req.Question[0].Name, host)
@@ -861,6 +1485,28 @@ func (s *Server) filterDNSResponse(ctx *dnsContext) (*dnsfilter.Result, error) {
 	return nil, nil
 }
 
+// Check the name from CNAME chain of the response with all filtering engines (as the requested name)
+// Safe search isn't used: it rewrites the requested name only.
+// checked: the names that have already been checked
+func (s *Server) checkCNAMEHost(ctx *dnsContext, host string, checked map[string]bool) (dnsfilter.Result, error) {
+	if checked[host] {
+		return dnsfilter.Result{}, nil
+	}
+	checked[host] = true
+
+	setts := *ctx.setts
+	setts.SafeSearchEnabled = false
+	res, err := s.dnsFilter.CheckHost(host, ctx.proxyCtx.Req.Question[0].Qtype, &setts)
+	if err != nil {
+		return res, err
+	}
+	if !res.IsFiltered {
+		// rewrites aren't applied to the names from the response
+		return dnsfilter.Result{}, nil
+	}
+	return res, nil
+}
+
 // Create a DNS response by DNS request and set necessary flags
 func (s *Server) makeResponse(req *dns.Msg) *dns.Msg {
 	resp := dns.Msg{}
@@ -870,11 +1516,35 @@ func (s *Server) makeResponse(req *dns.Msg) *dns.Msg {
 	return &resp
 }
 
+// Get the blocking mode settings for the client
+func (s *Server) getBlockingMode(d *proxy.DNSContext) (string, net.IP, net.IP) {
+	if d.Addr != nil && s.conf.GetBlockingModeByClient != nil {
+		mode, ipv4, ipv6 := s.conf.GetBlockingModeByClient(ipFromAddr(d.Addr), s.clientID(d))
+		if len(mode) != 0 {
+			return mode, ipv4, ipv6
+		}
+	}
+	return s.conf.BlockingMode, s.conf.BlockingIPAddrv4, s.conf.BlockingIPAddrv6
+}
+
 // genDNSFilterMessage generates a DNS message corresponding to the filtering result
 func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Result) *dns.Msg {
 	m := d.Req
+	mode, ipv4, ipv6 := s.getBlockingMode(d)
+
+	if mode == "refused" {
+		return s.genRefused(m)
+	}
 
 	if m.Question[0].Qtype != dns.TypeA && m.Question[0].Qtype != dns.TypeAAAA {
+		if mode == "null_ip" || mode == "custom_ip" {
+			switch m.Question[0].Qtype {
+			case dns.TypeMX:
+				return s.genNullMX(m)
+			case dns.TypeTXT:
+				return s.genNoData(m)
+			}
+		}
 		return s.genNXDomain(m)
 	}
 
@@ -891,7 +1561,7 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 			return s.genResponseWithIP(m, result.IP)
 		}
 
-		if s.conf.BlockingMode == "null_ip" {
+		if mode == "null_ip" {
 			// it means that we should return 0.0.0.0 or :: for any blocked request
 
 			switch m.Question[0].Qtype {
@@ -901,17 +1571,17 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 				return s.genAAAARecord(m, net.IPv6zero)
 			}
 
-		} else if s.conf.BlockingMode == "custom_ip" {
+		} else if mode == "custom_ip" {
 			// means that we should return custom IP for any blocked request
 
 			switch m.Question[0].Qtype {
 			case dns.TypeA:
-				return s.genARecord(m, s.conf.BlockingIPAddrv4)
+				return s.genARecord(m, ipv4)
 			case dns.TypeAAAA:
-				return s.genAAAARecord(m, s.conf.BlockingIPAddrv6)
+				return s.genAAAARecord(m, ipv6)
 			}
 
-		} else if s.conf.BlockingMode == "nxdomain" {
+		} else if mode == "nxdomain" {
 			// means that we should return NXDOMAIN for any blocked request
 
 			return s.genNXDomain(m)
@@ -1033,6 +1703,36 @@ func (s *Server) genCNAMEAnswer(req *dns.Msg, cname string) *dns.CNAME {
 	return answer
 }
 
+func (s *Server) genRefused(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetRcode(request, dns.RcodeRefused)
+	resp.RecursionAvailable = true
+	return &resp
+}
+
+// Make an empty NOERROR response
+func (s *Server) genNoData(request *dns.Msg) *dns.Msg {
+	resp := s.makeResponse(request)
+	resp.Ns = s.genSOA(request)
+	return resp
+}
+
+// Make a "null MX" response: the domain doesn't accept email (RFC 7505)
+func (s *Server) genNullMX(request *dns.Msg) *dns.Msg {
+	resp := s.makeResponse(request)
+	answer := new(dns.MX)
+	answer.Hdr = dns.RR_Header{
+		Name:   request.Question[0].Name,
+		Rrtype: dns.TypeMX,
+		Ttl:    s.conf.BlockedResponseTTL,
+		Class:  dns.ClassINET,
+	}
+	answer.Preference = 0
+	answer.Mx = "."
+	resp.Answer = append(resp.Answer, answer)
+	return resp
+}
+
 func (s *Server) genNXDomain(request *dns.Msg) *dns.Msg {
 	resp := dns.Msg{}
 	resp.SetRcode(request, dns.RcodeNameError)
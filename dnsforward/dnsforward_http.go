@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/jsonutil"
@@ -28,7 +30,54 @@ type dnsConfigJSON struct {
 	BlockingIPv4      string `json:"blocking_ipv4"`
 	BlockingIPv6      string `json:"blocking_ipv6"`
 	EDNSCSEnabled     bool   `json:"edns_cs_enabled"`
+	EDNSCSMode        string `json:"edns_cs_mode"`
+	EDNSCSCustom      string `json:"edns_cs_custom"`
 	DisableIPv6       bool   `json:"disable_ipv6"`
+	DNS64Enabled      bool   `json:"dns64_enabled"`
+	DNS64Prefix       string `json:"dns64_prefix"`
+	DNSSECValidation  bool   `json:"dnssec_validation"`
+
+	CacheOptimistic         bool   `json:"cache_optimistic"`
+	CacheOptimisticMaxStale uint32 `json:"cache_optimistic_max_stale"`
+	CacheSize               uint   `json:"cache_size"`
+	CacheMinTTL             uint32 `json:"cache_ttl_min"`
+	CacheMaxTTL             uint32 `json:"cache_ttl_max"`
+	CacheNegativeTTL        uint32 `json:"cache_negative_ttl"`
+	CacheServfailTTL        uint32 `json:"cache_servfail_ttl"`
+	CachePersistent         bool   `json:"cache_persistent"`
+	CachePrefetch           bool   `json:"cache_prefetch"`
+	CachePrefetchHits       uint32 `json:"cache_prefetch_hits"`
+	CachePrefetchTime       uint32 `json:"cache_prefetch_time"`
+	CachePrefetchQPS        uint32 `json:"cache_prefetch_qps"`
+
+	Listeners []ListenerConfig `json:"listeners"`
+
+	EDNSCSUpstreams []ECSUpstreamConfig `json:"edns_cs_upstreams"`
+
+	FullCNAMEFiltering bool `json:"full_cname_filtering"`
+
+	AnonymizeClientIP     string `json:"anonymize_client_ip"`
+	QueryLogIgnoreAllowed bool   `json:"querylog_ignore_allowed"`
+
+	LocalPTREnabled      bool     `json:"local_ptr_enabled"`
+	UseLocalPTRResolvers bool     `json:"use_local_ptr_resolvers"`
+	LocalPTRResolvers    []string `json:"local_ptr_resolvers"`
+
+	RatelimitSubnetLenIPv4 uint32   `json:"ratelimit_subnet_len_ipv4"`
+	RatelimitSubnetLenIPv6 uint32   `json:"ratelimit_subnet_len_ipv6"`
+	RatelimitBanThreshold  uint32   `json:"ratelimit_ban_threshold"`
+	RatelimitBanDuration   uint32   `json:"ratelimit_ban_duration"`
+	RatelimitWhitelist     []string `json:"ratelimit_whitelist"`
+	RatelimitBanned        []string `json:"ratelimit_banned"` // read-only
+	RefuseAny              bool     `json:"refuse_any"`
+	BlockedTLDs            []string `json:"blocked_tlds"`
+	BlockedQueryTypes      []string `json:"blocked_query_types"`
+	MaxUDPResponseSize     uint32   `json:"max_udp_response_size"`
+
+	UpstreamHealthCheckInterval uint32               `json:"upstream_health_check_interval"`
+	UpstreamMaxFailures         uint32               `json:"upstream_max_failures"`
+	UpstreamsHealth             []upstreamHealthJSON `json:"upstreams_health"` // read-only
+	FallbacksHealth             []upstreamHealthJSON `json:"fallbacks_health"` // read-only
 }
 
 func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
@@ -39,8 +88,56 @@ func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	resp.BlockingIPv4 = s.conf.BlockingIPv4
 	resp.BlockingIPv6 = s.conf.BlockingIPv6
 	resp.RateLimit = s.conf.Ratelimit
+	resp.RatelimitSubnetLenIPv4 = s.conf.RatelimitSubnetLenIPv4
+	resp.RatelimitSubnetLenIPv6 = s.conf.RatelimitSubnetLenIPv6
+	resp.RatelimitBanThreshold = s.conf.RatelimitBanThreshold
+	resp.RatelimitBanDuration = s.conf.RatelimitBanDuration
+	resp.RatelimitWhitelist = stringArrayDup(s.conf.RatelimitWhitelist)
+	resp.RatelimitBanned = s.ratelimit.banned(time.Now())
+	if resp.RatelimitBanned == nil {
+		resp.RatelimitBanned = []string{}
+	}
+	resp.RefuseAny = s.conf.RefuseAny
+	resp.BlockedTLDs = stringArrayDup(s.conf.BlockedTLDs)
+	resp.BlockedQueryTypes = stringArrayDup(s.conf.BlockedQueryTypes)
+	resp.MaxUDPResponseSize = s.conf.MaxUDPResponseSize
 	resp.EDNSCSEnabled = s.conf.EnableEDNSClientSubnet
+	resp.EDNSCSMode = s.conf.EDNSClientSubnetMode
+	if len(resp.EDNSCSMode) == 0 {
+		resp.EDNSCSMode = ecsModeAuto
+	}
+	resp.EDNSCSCustom = s.conf.EDNSClientSubnetCustom
+	resp.EDNSCSUpstreams = append([]ECSUpstreamConfig{}, s.conf.EDNSClientSubnetUpstreams...)
+	resp.UpstreamHealthCheckInterval = s.conf.UpstreamHealthCheckInterval
+	resp.UpstreamMaxFailures = s.conf.UpstreamMaxFailures
+	resp.UpstreamsHealth = []upstreamHealthJSON{}
+	if s.health != nil {
+		resp.UpstreamsHealth = s.health.status()
+		resp.FallbacksHealth = s.fallbackHealth.status()
+	}
 	resp.DisableIPv6 = s.conf.AAAADisabled
+	resp.DNS64Enabled = s.conf.DNS64Enabled
+	resp.DNS64Prefix = s.conf.DNS64Prefix
+	resp.DNSSECValidation = s.conf.DNSSECValidation
+	resp.CacheOptimistic = s.conf.CacheOptimistic
+	resp.CacheOptimisticMaxStale = s.conf.CacheOptimisticMaxStale
+	resp.CacheSize = s.conf.CacheSize
+	resp.CacheMinTTL = s.conf.CacheMinTTL
+	resp.CacheMaxTTL = s.conf.CacheMaxTTL
+	resp.CacheNegativeTTL = s.conf.CacheNegativeTTL
+	resp.CacheServfailTTL = s.conf.CacheServfailTTL
+	resp.CachePersistent = s.conf.CachePersistent
+	resp.CachePrefetch = s.conf.CachePrefetch
+	resp.CachePrefetchHits = s.conf.CachePrefetchHits
+	resp.CachePrefetchTime = s.conf.CachePrefetchTime
+	resp.CachePrefetchQPS = s.conf.CachePrefetchQPS
+	resp.Listeners = append([]ListenerConfig{}, s.conf.Listeners...)
+	resp.FullCNAMEFiltering = s.conf.FullCNAMEFiltering
+	resp.AnonymizeClientIP = s.conf.AnonymizeClientIP
+	resp.QueryLogIgnoreAllowed = s.conf.QueryLogIgnoreAllowed
+	resp.LocalPTREnabled = s.conf.LocalPTREnabled
+	resp.UseLocalPTRResolvers = s.conf.UseLocalPTRResolvers
+	resp.LocalPTRResolvers = stringArrayDup(s.conf.LocalPTRResolvers)
 	s.RUnlock()
 
 	js, err := json.Marshal(resp)
@@ -52,19 +149,20 @@ func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(js)
 }
 
-func checkBlockingMode(req dnsConfigJSON) bool {
-	bm := req.BlockingMode
-	if !(bm == "default" || bm == "nxdomain" || bm == "null_ip" || bm == "custom_ip") {
+// ValidateBlockingMode - return TRUE if the blocking mode settings are valid
+// ipv4 and ipv6 are checked for "custom_ip" mode only
+func ValidateBlockingMode(mode, ipv4, ipv6 string) bool {
+	if !(mode == "default" || mode == "nxdomain" || mode == "null_ip" || mode == "custom_ip" || mode == "refused") {
 		return false
 	}
 
-	if bm == "custom_ip" {
-		ip := net.ParseIP(req.BlockingIPv4)
+	if mode == "custom_ip" {
+		ip := net.ParseIP(ipv4)
 		if ip == nil || ip.To4() == nil {
 			return false
 		}
 
-		ip = net.ParseIP(req.BlockingIPv6)
+		ip = net.ParseIP(ipv6)
 		if ip == nil {
 			return false
 		}
@@ -81,57 +179,198 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if js.Exists("blocking_mode") && !checkBlockingMode(req) {
-		httpError(r, w, http.StatusBadRequest, "blocking_mode: incorrect value")
-		return
-	}
-
+	tx := s.beginConfigTx()
+	defer tx.close()
+	c := &tx.conf
 	restart := false
-	s.Lock()
 
 	if js.Exists("protection_enabled") {
-		s.conf.ProtectionEnabled = req.ProtectionEnabled
+		c.ProtectionEnabled = req.ProtectionEnabled
 	}
 
 	if js.Exists("blocking_mode") {
-		s.conf.BlockingMode = req.BlockingMode
+		c.BlockingMode = req.BlockingMode
 		if req.BlockingMode == "custom_ip" {
 			if js.Exists("blocking_ipv4") {
-				s.conf.BlockingIPv4 = req.BlockingIPv4
-				s.conf.BlockingIPAddrv4 = net.ParseIP(req.BlockingIPv4)
+				c.BlockingIPv4 = req.BlockingIPv4
+				c.BlockingIPAddrv4 = net.ParseIP(req.BlockingIPv4)
 			}
 			if js.Exists("blocking_ipv6") {
-				s.conf.BlockingIPv6 = req.BlockingIPv6
-				s.conf.BlockingIPAddrv6 = net.ParseIP(req.BlockingIPv6)
+				c.BlockingIPv6 = req.BlockingIPv6
+				c.BlockingIPAddrv6 = net.ParseIP(req.BlockingIPv6)
 			}
 		}
 	}
 
 	if js.Exists("ratelimit") {
-		if s.conf.Ratelimit != req.RateLimit {
+		if c.Ratelimit != req.RateLimit {
 			restart = true
 		}
-		s.conf.Ratelimit = req.RateLimit
+		c.Ratelimit = req.RateLimit
+	}
+	if js.Exists("ratelimit_subnet_len_ipv4") {
+		c.RatelimitSubnetLenIPv4 = req.RatelimitSubnetLenIPv4
+		restart = true
+	}
+	if js.Exists("ratelimit_subnet_len_ipv6") {
+		c.RatelimitSubnetLenIPv6 = req.RatelimitSubnetLenIPv6
+		restart = true
+	}
+	if js.Exists("ratelimit_ban_threshold") {
+		c.RatelimitBanThreshold = req.RatelimitBanThreshold
+		restart = true
+	}
+	if js.Exists("ratelimit_ban_duration") {
+		c.RatelimitBanDuration = req.RatelimitBanDuration
+		restart = true
+	}
+	if js.Exists("ratelimit_whitelist") {
+		c.RatelimitWhitelist = req.RatelimitWhitelist
+		restart = true
+	}
+	if js.Exists("refuse_any") {
+		c.RefuseAny = req.RefuseAny
+		restart = true
+	}
+	if js.Exists("blocked_tlds") {
+		c.BlockedTLDs = req.BlockedTLDs
+	}
+	if js.Exists("blocked_query_types") {
+		c.BlockedQueryTypes = req.BlockedQueryTypes
+	}
+	if js.Exists("max_udp_response_size") {
+		c.MaxUDPResponseSize = req.MaxUDPResponseSize
 	}
 
 	if js.Exists("edns_cs_enabled") {
-		s.conf.EnableEDNSClientSubnet = req.EDNSCSEnabled
+		c.EnableEDNSClientSubnet = req.EDNSCSEnabled
+		restart = true
+	}
+	if js.Exists("edns_cs_mode") {
+		c.EDNSClientSubnetMode = req.EDNSCSMode
+		restart = true
+	}
+	if js.Exists("edns_cs_custom") {
+		c.EDNSClientSubnetCustom = req.EDNSCSCustom
+		restart = true
+	}
+	if js.Exists("edns_cs_upstreams") {
+		c.EDNSClientSubnetUpstreams = req.EDNSCSUpstreams
 		restart = true
 	}
 
 	if js.Exists("disable_ipv6") {
-		s.conf.AAAADisabled = req.DisableIPv6
+		c.AAAADisabled = req.DisableIPv6
 	}
 
-	s.Unlock()
-	s.conf.ConfigModified()
+	if js.Exists("dns64_enabled") {
+		c.DNS64Enabled = req.DNS64Enabled
+	}
+	if js.Exists("dns64_prefix") {
+		c.DNS64Prefix = req.DNS64Prefix
+	}
 
-	if restart {
-		err = s.Reconfigure(nil)
-		if err != nil {
-			httpError(r, w, http.StatusInternalServerError, "%s", err)
-			return
-		}
+	if js.Exists("dnssec_validation") {
+		c.DNSSECValidation = req.DNSSECValidation
+		restart = true
+	}
+
+	if js.Exists("upstream_health_check_interval") {
+		c.UpstreamHealthCheckInterval = req.UpstreamHealthCheckInterval
+		restart = true
+	}
+	if js.Exists("upstream_max_failures") {
+		c.UpstreamMaxFailures = req.UpstreamMaxFailures
+		restart = true
+	}
+
+	if js.Exists("cache_optimistic") {
+		c.CacheOptimistic = req.CacheOptimistic
+		restart = true
+	}
+	if js.Exists("cache_optimistic_max_stale") {
+		c.CacheOptimisticMaxStale = req.CacheOptimisticMaxStale
+		restart = true
+	}
+	if js.Exists("cache_size") {
+		c.CacheSize = req.CacheSize
+		restart = true
+	}
+	if js.Exists("cache_ttl_min") {
+		c.CacheMinTTL = req.CacheMinTTL
+		restart = true
+	}
+	if js.Exists("cache_ttl_max") {
+		c.CacheMaxTTL = req.CacheMaxTTL
+		restart = true
+	}
+	if js.Exists("cache_negative_ttl") {
+		c.CacheNegativeTTL = req.CacheNegativeTTL
+		restart = true
+	}
+	if js.Exists("cache_servfail_ttl") {
+		c.CacheServfailTTL = req.CacheServfailTTL
+		restart = true
+	}
+	if js.Exists("cache_persistent") {
+		c.CachePersistent = req.CachePersistent
+		restart = true
+	}
+	if js.Exists("cache_prefetch") {
+		c.CachePrefetch = req.CachePrefetch
+		restart = true
+	}
+	if js.Exists("cache_prefetch_hits") {
+		c.CachePrefetchHits = req.CachePrefetchHits
+		restart = true
+	}
+	if js.Exists("cache_prefetch_time") {
+		c.CachePrefetchTime = req.CachePrefetchTime
+		restart = true
+	}
+	if js.Exists("cache_prefetch_qps") {
+		c.CachePrefetchQPS = req.CachePrefetchQPS
+		restart = true
+	}
+
+	if js.Exists("listeners") {
+		c.Listeners = req.Listeners
+		restart = true
+	}
+
+	if js.Exists("full_cname_filtering") {
+		c.FullCNAMEFiltering = req.FullCNAMEFiltering
+	}
+
+	if js.Exists("anonymize_client_ip") {
+		c.AnonymizeClientIP = req.AnonymizeClientIP
+	}
+	if js.Exists("querylog_ignore_allowed") {
+		c.QueryLogIgnoreAllowed = req.QueryLogIgnoreAllowed
+	}
+
+	if js.Exists("local_ptr_enabled") {
+		c.LocalPTREnabled = req.LocalPTREnabled
+	}
+	if js.Exists("use_local_ptr_resolvers") {
+		c.UseLocalPTRResolvers = req.UseLocalPTRResolvers
+		restart = true
+	}
+	if js.Exists("local_ptr_resolvers") {
+		c.LocalPTRResolvers = req.LocalPTRResolvers
+		restart = true
+	}
+
+	err = tx.validate()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	err = tx.commit(restart)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "%s", err)
+		return
 	}
 }
 
@@ -139,6 +378,12 @@ type upstreamJSON struct {
 	Upstreams    []string `json:"upstream_dns"`  // Upstreams
 	BootstrapDNS []string `json:"bootstrap_dns"` // Bootstrap DNS
 	AllServers   bool     `json:"all_servers"`   // --all-servers param for dnsproxy
+	FallbackDNS  []string `json:"fallback_dns"`  // Fallback upstreams
+
+	UpstreamMode    string          `json:"upstream_mode"`    // Upstream selection policy
+	UpstreamWeights map[string]uint `json:"upstream_weights"` // Weights for "weighted" mode
+
+	ForwardZones []ForwardZone `json:"forward_zones"` // Conditional forwarding
 }
 
 func (s *Server) handleSetUpstreamConfig(w http.ResponseWriter, r *http.Request) {
@@ -149,36 +394,24 @@ func (s *Server) handleSetUpstreamConfig(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if len(req.Upstreams) != 0 {
-		err = ValidateUpstreams(req.Upstreams)
-		if err != nil {
-			httpError(r, w, http.StatusBadRequest, "wrong upstreams specification: %s", err)
-			return
-		}
-	}
-
-	newconf := FilteringConfig{}
-	newconf.UpstreamDNS = req.Upstreams
+	tx := s.beginConfigTx()
+	defer tx.close()
+	c := &tx.conf
+	c.UpstreamDNS = req.Upstreams
+	c.BootstrapDNS = req.BootstrapDNS
+	c.AllServers = req.AllServers
+	c.FallbackDNS = req.FallbackDNS
+	c.UpstreamMode = req.UpstreamMode
+	c.UpstreamWeights = req.UpstreamWeights
+	c.ForwardZones = req.ForwardZones
 
-	// bootstrap servers are plain DNS only
-	for _, host := range req.BootstrapDNS {
-		if err := checkPlainDNS(host); err != nil {
-			httpError(r, w, http.StatusBadRequest, "%s can not be used as bootstrap dns cause: %s", host, err)
-			return
-		}
+	err = tx.validate()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
 	}
-	newconf.BootstrapDNS = req.BootstrapDNS
-
-	newconf.AllServers = req.AllServers
-
-	s.Lock()
-	s.conf.UpstreamDNS = newconf.UpstreamDNS
-	s.conf.BootstrapDNS = newconf.BootstrapDNS
-	s.conf.AllServers = newconf.AllServers
-	s.Unlock()
-	s.conf.ConfigModified()
 
-	err = s.Reconfigure(nil)
+	err = tx.commit(true)
 	if err != nil {
 		httpError(r, w, http.StatusInternalServerError, "%s", err)
 		return
@@ -208,7 +441,13 @@ func ValidateUpstreams(upstreams []string) error {
 	return nil
 }
 
-var protocols = []string{"tls://", "https://", "tcp://", "sdns://"}
+var protocols = []string{"tls://", "https://", "tcp://", "sdns://", "dns://"}
+
+// The protocols which aren't supported by dnsproxy yet
+var unsupportedProtocols = map[string]string{
+	"quic://": "DNS-over-QUIC",
+	"h3://":   "DNS-over-HTTP/3",
+}
 
 func validateUpstream(u string) (bool, error) {
 	// Check if user tries to specify upstream for domain
@@ -225,9 +464,19 @@ func validateUpstream(u string) (bool, error) {
 	// Check if the upstream has a valid protocol prefix
 	for _, proto := range protocols {
 		if strings.HasPrefix(u, proto) {
+			// check the URL format and DNS stamp;  no requests are sent here
+			_, err = upstream.AddressToUpstream(u, upstream.Options{Timeout: DefaultTimeout})
+			if err != nil {
+				return defaultUpstream, fmt.Errorf("wrong upstream format: %s", err)
+			}
 			return defaultUpstream, nil
 		}
 	}
+	for proto, name := range unsupportedProtocols {
+		if strings.HasPrefix(u, proto) {
+			return defaultUpstream, fmt.Errorf("%s is not supported", name)
+		}
+	}
 
 	// Return error if the upstream contains '://' without any valid protocol
 	if strings.Contains(u, "://") {
@@ -288,6 +537,37 @@ func checkPlainDNS(upstream string) error {
 	return nil
 }
 
+// checkBootstrap checks if host is a valid bootstrap server:
+// plain DNS, DNS-over-TLS or DNS-over-HTTPS server with IP address, or DNS stamp
+func checkBootstrap(host string) error {
+	if !strings.Contains(host, "://") {
+		return checkPlainDNS(host)
+	}
+
+	if strings.HasPrefix(host, "sdns://") {
+		_, err := upstream.AddressToUpstream(host, upstream.Options{Timeout: DefaultTimeout})
+		return err
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "tls" && u.Scheme != "https" && u.Scheme != "tcp" && u.Scheme != "dns" {
+		return fmt.Errorf("unsupported protocol %s", u.Scheme)
+	}
+	if net.ParseIP(u.Hostname()) == nil {
+		return fmt.Errorf("%s is not a valid IP", u.Hostname())
+	}
+	return nil
+}
+
+// The result of testing an upstream server
+type upstreamTestResult struct {
+	Status string `json:"status"` // "OK" or error message
+	RTT    uint32 `json:"rtt"`    // round-trip time (in milliseconds)
+}
+
 func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 	req := upstreamJSON{}
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -296,20 +576,27 @@ func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(req.Upstreams) == 0 {
+	if len(req.Upstreams) == 0 && len(req.FallbackDNS) == 0 {
 		httpError(r, w, http.StatusBadRequest, "No servers specified")
 		return
 	}
 
-	result := map[string]string{}
+	for _, host := range req.BootstrapDNS {
+		if err := checkBootstrap(host); err != nil {
+			httpError(r, w, http.StatusBadRequest, "%s can not be used as bootstrap dns cause: %s", host, err)
+			return
+		}
+	}
+
+	result := map[string]upstreamTestResult{}
 
-	for _, host := range req.Upstreams {
-		err = checkDNS(host, req.BootstrapDNS)
+	for _, host := range append(stringArrayDup(req.Upstreams), req.FallbackDNS...) {
+		rtt, err := checkDNS(host, req.BootstrapDNS, s.conf.UpstreamProxy)
 		if err != nil {
 			log.Info("%v", err)
-			result[host] = err.Error()
+			result[host] = upstreamTestResult{Status: err.Error()}
 		} else {
-			result[host] = "OK"
+			result[host] = upstreamTestResult{Status: "OK", RTT: uint32(rtt / time.Millisecond)}
 		}
 	}
 
@@ -327,20 +614,22 @@ func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func checkDNS(input string, bootstrap []string) error {
+// checkDNS sends a test request to the upstream server and returns the round-trip time
+// proxyURL: the outbound proxy for DNS-over-HTTPS servers (nil: no proxy)
+func checkDNS(input string, bootstrap []string, proxyURL *url.URL) (time.Duration, error) {
 	// separate upstream from domains list
 	input, defaultUpstream, err := separateUpstream(input)
 	if err != nil {
-		return fmt.Errorf("wrong upstream format: %s", err)
+		return 0, fmt.Errorf("wrong upstream format: %s", err)
 	}
 
 	// No need to check this entrance
 	if input == "#" && !defaultUpstream {
-		return nil
+		return 0, nil
 	}
 
 	if _, err := validateUpstream(input); err != nil {
-		return fmt.Errorf("wrong upstream format: %s", err)
+		return 0, fmt.Errorf("wrong upstream format: %s", err)
 	}
 
 	if len(bootstrap) == 0 {
@@ -348,9 +637,9 @@ func checkDNS(input string, bootstrap []string) error {
 	}
 
 	log.Debug("Checking if DNS %s works...", input)
-	u, err := upstream.AddressToUpstream(input, upstream.Options{Bootstrap: bootstrap, Timeout: DefaultTimeout})
+	u, err := AddressToUpstream(input, upstream.Options{Bootstrap: bootstrap, Timeout: DefaultTimeout}, proxyURL)
 	if err != nil {
-		return fmt.Errorf("failed to choose upstream for %s: %s", input, err)
+		return 0, fmt.Errorf("failed to choose upstream for %s: %s", input, err)
 	}
 
 	req := dns.Msg{}
@@ -359,21 +648,23 @@ func checkDNS(input string, bootstrap []string) error {
 	req.Question = []dns.Question{
 		{Name: "google-public-dns-a.google.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
 	}
+	start := time.Now()
 	reply, err := u.Exchange(&req)
+	rtt := time.Since(start)
 	if err != nil {
-		return fmt.Errorf("couldn't communicate with DNS server %s: %s", input, err)
+		return 0, fmt.Errorf("couldn't communicate with DNS server %s: %s", input, err)
 	}
 	if len(reply.Answer) != 1 {
-		return fmt.Errorf("DNS server %s returned wrong answer", input)
+		return 0, fmt.Errorf("DNS server %s returned wrong answer", input)
 	}
 	if t, ok := reply.Answer[0].(*dns.A); ok {
 		if !net.IPv4(8, 8, 8, 8).Equal(t.A) {
-			return fmt.Errorf("DNS server %s returned wrong answer: %v", input, t.A)
+			return 0, fmt.Errorf("DNS server %s returned wrong answer: %v", input, t.A)
 		}
 	}
 
-	log.Debug("DNS %s works OK", input)
-	return nil
+	log.Debug("DNS %s works OK (%s)", input, rtt)
+	return rtt, nil
 }
 
 func (s *Server) registerHandlers() {
@@ -384,4 +675,17 @@ func (s *Server) registerHandlers() {
 
 	s.conf.HTTPRegister("GET", "/control/access/list", s.handleAccessList)
 	s.conf.HTTPRegister("POST", "/control/access/set", s.handleAccessSet)
+
+	s.conf.HTTPRegister("GET", "/control/zones", s.handleZonesList)
+	s.conf.HTTPRegister("POST", "/control/zones/add", s.handleZoneAdd)
+	s.conf.HTTPRegister("POST", "/control/zones/delete", s.handleZoneDelete)
+	s.conf.HTTPRegister("POST", "/control/zones/update", s.handleZoneUpdate)
+
+	s.conf.HTTPRegister("GET", "/control/cache_info", s.handleCacheInfo)
+	s.conf.HTTPRegister("POST", "/control/cache_flush", s.handleCacheFlush)
+
+	s.conf.HTTPRegister("GET", "/control/trace/config", s.handleTraceConfig)
+	s.conf.HTTPRegister("POST", "/control/trace/config/set", s.handleTraceConfigSet)
+	s.conf.HTTPRegister("GET", "/control/trace/list", s.handleTraceList)
+	s.conf.HTTPRegister("POST", "/control/trace/clear", s.handleTraceClear)
 }
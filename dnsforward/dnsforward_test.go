@@ -1,23 +1,42 @@
 package dnsforward
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/metrics"
+	"github.com/AdguardTeam/AdGuardHome/querylog"
+	"github.com/AdguardTeam/AdGuardHome/stats"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/urlfilter/rules"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
@@ -127,6 +146,40 @@ func TestDotServer(t *testing.T) {
 	}
 }
 
+func TestDotUpdateCertificate(t *testing.T) {
+	_, certPem, keyPem := createServerTLSConfig(t)
+	s := createTestServer(t)
+	s.conf.TLSConfig = TLSConfig{
+		TLSListenAddr:        &net.TCPAddr{Port: 0},
+		CertificateChainData: certPem,
+		PrivateKeyData:       keyPem,
+	}
+	_ = s.Prepare(nil)
+	err := s.Start()
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoTLS).String()
+
+	// get the certificate of the server
+	serverCert := func() []byte {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: tlsServerName})
+		assert.Nil(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+	block, _ := pem.Decode(certPem)
+	assert.Equal(t, block.Bytes, serverCert())
+
+	// the new certificate is used without restarting the server
+	_, certPem2, keyPem2 := createServerTLSConfig(t)
+	assert.Nil(t, s.UpdateCertificate(certPem2, keyPem2))
+	block, _ = pem.Decode(certPem2)
+	assert.Equal(t, block.Bytes, serverCert())
+
+	assert.NotNil(t, s.UpdateCertificate(certPem2, keyPem))
+	assert.Equal(t, block.Bytes, serverCert())
+}
+
 func TestServerRace(t *testing.T) {
 	s := createTestServer(t)
 	err := s.Start()
@@ -392,7 +445,7 @@ func TestBlockCNAME(t *testing.T) {
 func TestClientRulesForCNAMEMatching(t *testing.T) {
 	s := createTestServer(t)
 	testUpstm := &testUpstream{testCNAMEs, testIPv4, nil}
-	s.conf.FilterHandler = func(clientAddr string, settings *dnsfilter.RequestFilteringSettings) {
+	s.conf.FilterHandler = func(clientAddr, clientID string, settings *dnsfilter.RequestFilteringSettings) {
 		settings.FilteringEnabled = false
 	}
 	err := s.startWithUpstream(testUpstm)
@@ -413,6 +466,40 @@ func TestClientRulesForCNAMEMatching(t *testing.T) {
 	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
 }
 
+func TestFullCNAMEFiltering(t *testing.T) {
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	testUpstm := &testUpstream{
+		cn:   map[string]string{"shop.example.org.": "tracker.example.net."},
+		ipv4: map[string][]net.IP{"tracker.example.net.": {{1, 2, 3, 4}}},
+	}
+	rule, _ := rules.NewNetworkRule("||tracker.example.net^", 0)
+	s.conf.FilterHandler = func(clientAddr, clientID string, settings *dnsfilter.RequestFilteringSettings) {
+		settings.ServicesRules = []dnsfilter.ServiceEntry{
+			{Name: "tracker", Rules: []*rules.NetworkRule{rule}},
+		}
+	}
+	err := s.startWithUpstream(testUpstm)
+	assert.Nil(t, err)
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	// the canonical name is blocked by blocked services only:
+	// response isn't blocked
+	req := createTestMessage("shop.example.org.")
+	reply, err := dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+
+	// response is blocked
+	s.conf.FullCNAMEFiltering = true
+	req = createTestMessage("shop.example.org.")
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+
+	_ = s.Stop()
+}
+
 func TestNullBlockedRequest(t *testing.T) {
 	s := createTestServer(t)
 	s.conf.FilteringConfig.BlockingMode = "null_ip"
@@ -803,16 +890,66 @@ func TestIsBlockedIPBlockedDomain(t *testing.T) {
 	assert.True(t, !a.IsBlockedDomain("host3"))
 }
 
+func TestIsBlockedClientID(t *testing.T) {
+	a := &accessCtx{}
+	assert.Nil(t, a.Init([]string{"1.1.1.1", "kids-tablet"}, nil, nil))
+	assert.False(t, a.IsBlockedClient("2.2.2.2", "kids-tablet"))
+	assert.True(t, a.IsBlockedClient("2.2.2.2", "phone"))
+	assert.True(t, a.IsBlockedClient("2.2.2.2", ""))
+	assert.False(t, a.IsBlockedClient("1.1.1.1", "phone"))
+
+	a = &accessCtx{}
+	assert.Nil(t, a.Init(nil, []string{"2.2.0.0/16", "phone"}, nil))
+	assert.True(t, a.IsBlockedClient("1.1.1.1", "phone"))
+	assert.False(t, a.IsBlockedClient("1.1.1.1", "kids-tablet"))
+	assert.True(t, a.IsBlockedClient("2.2.1.1", "kids-tablet"))
+
+	assert.Nil(t, checkIPCIDRArray([]string{"1.1.1.1", "2.2.0.0/16", "phone"}))
+	assert.NotNil(t, checkIPCIDRArray([]string{"Phone!"}))
+}
+
+func TestIsBlockedDomainPatterns(t *testing.T) {
+	a := &accessCtx{}
+	assert.Nil(t, a.Init(nil, nil, []string{
+		"Host1",
+		"*.example.org",
+		"||in-addr.arpa^",
+		"/^ads[0-9]+\\./",
+		"# comment",
+	}))
+
+	assert.True(t, a.IsBlockedDomain("host1"))
+	assert.True(t, a.IsBlockedDomain("HOST1"))
+	assert.False(t, a.IsBlockedDomain("host11"))
+
+	// wildcard: subdomains only
+	assert.True(t, a.IsBlockedDomain("a.example.org"))
+	assert.True(t, a.IsBlockedDomain("a.b.example.org"))
+	assert.False(t, a.IsBlockedDomain("example.org"))
+
+	// filtering rules
+	assert.True(t, a.IsBlockedDomain("1.0.0.127.in-addr.arpa"))
+	assert.True(t, a.IsBlockedDomain("in-addr.arpa"))
+	assert.False(t, a.IsBlockedDomain("ip6.arpa"))
+	assert.True(t, a.IsBlockedDomain("ads12.example.net"))
+	assert.False(t, a.IsBlockedDomain("ads.example.net"))
+	assert.False(t, a.IsBlockedDomain("# comment"))
+}
+
 func TestValidateUpstream(t *testing.T) {
 	invalidUpstreams := []string{"1.2.3.4.5",
 		"123.3.7m",
 		"htttps://google.com/dns-query",
 		"[/host.com]tls://dns.adguard.com",
 		"[host.ru]#",
+		"sdns://invalid",
+		"quic://dns.adguard.com",
+		"h3://dns.adguard.com/dns-query",
 	}
 
 	validDefaultUpstreams := []string{"1.1.1.1",
 		"tls://1.1.1.1",
+		"dns://1.1.1.1",
 		"https://dns.adguard.com/dns-query",
 		"sdns://AQMAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20",
 	}
@@ -851,6 +988,29 @@ func TestValidateUpstream(t *testing.T) {
 	}
 }
 
+func TestCheckBootstrap(t *testing.T) {
+	for _, s := range []string{
+		"1.1.1.1",
+		"1.1.1.1:53",
+		"tcp://1.1.1.1",
+		"tls://1.1.1.1",
+		"https://1.1.1.1/dns-query",
+		"sdns://AQMAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20",
+	} {
+		assert.Nil(t, checkBootstrap(s), s)
+	}
+
+	for _, s := range []string{
+		"dns.adguard.com",
+		"tls://dns.adguard.com",
+		"https://dns.adguard.com/dns-query",
+		"quic://1.1.1.1",
+		"sdns://invalid",
+	} {
+		assert.NotNil(t, checkBootstrap(s), s)
+	}
+}
+
 func TestValidateUpstreamsSet(t *testing.T) {
 	// Set of valid upstreams. There is no default upstream specified
 	upstreamsSet := []string{"[/host.com/]1.1.1.1",
@@ -902,3 +1062,2207 @@ func TestMatchDNSName(t *testing.T) {
 	assert.True(t, !matchDNSName(dnsNames, ""))
 	assert.True(t, !matchDNSName(dnsNames, "*.host2"))
 }
+
+func TestDNS64Synthesize(t *testing.T) {
+	check := func(prefix, ip4, expected string) {
+		t.Helper()
+		p, err := parseDNS64Prefix(prefix)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, dns64Synthesize(p, net.ParseIP(ip4)).String())
+	}
+	// examples from RFC 6052 2.4
+	check("2001:db8::/32", "192.0.2.33", "2001:db8:c000:221::")
+	check("2001:db8:100::/40", "192.0.2.33", "2001:db8:1c0:2:21::")
+	check("2001:db8:122::/48", "192.0.2.33", "2001:db8:122:c000:2:2100::")
+	check("2001:db8:122:300::/56", "192.0.2.33", "2001:db8:122:3c0:0:221::")
+	check("2001:db8:122:344::/64", "192.0.2.33", "2001:db8:122:344:c0:2:2100:0")
+	check("2001:db8:122:344::/96", "192.0.2.33", "2001:db8:122:344::c000:221")
+	check("", "192.0.2.33", "64:ff9b::c000:221")
+
+	_, err := parseDNS64Prefix("2001:db8::/33")
+	assert.NotNil(t, err)
+	_, err = parseDNS64Prefix("1.2.3.0/24")
+	assert.NotNil(t, err)
+	_, err = parseDNS64Prefix("2001:db8:122:344:ff00::/64")
+	assert.NotNil(t, err)
+}
+
+// An upstream that returns only A records (AAAA requests get an empty NOERROR response)
+type ipv4OnlyUpstream struct {
+	ipv4 map[string][]net.IP
+}
+
+func (u *ipv4OnlyUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	name := m.Question[0].Name
+	ips, ok := u.ipv4[name]
+	if !ok {
+		resp.SetRcode(m, dns.RcodeNameError)
+		return resp, nil
+	}
+	if m.Question[0].Qtype == dns.TypeA {
+		for _, ip := range ips {
+			a := &dns.A{A: ip}
+			a.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}
+			resp.Answer = append(resp.Answer, a)
+		}
+	} else {
+		soa := &dns.SOA{Ns: "ns.example.org.", Mbox: "hostmaster.example.org.", Minttl: 600}
+		soa.Hdr = dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 900}
+		resp.Ns = append(resp.Ns, soa)
+	}
+	return resp, nil
+}
+
+func (u *ipv4OnlyUpstream) Address() string {
+	return "test"
+}
+
+func TestDNS64(t *testing.T) {
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	s.conf.DNS64Enabled = true
+	s.conf.DNS64Prefix = "2001:db8:122:344::/96"
+	u := &ipv4OnlyUpstream{ipv4: map[string][]net.IP{
+		"ipv4only.example.org.": {{192, 0, 2, 33}},
+		"null.example.org.":     {{1, 2, 3, 4}},
+	}}
+	err := s.startWithUpstream(u)
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	req := createTestMessageWithType("ipv4only.example.org.", dns.TypeAAAA)
+	reply, err := dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, 1, len(reply.Answer))
+	aaaa, ok := reply.Answer[0].(*dns.AAAA)
+	assert.True(t, ok)
+	assert.Equal(t, "2001:db8:122:344::c000:221", aaaa.AAAA.String())
+	// TTL is limited by the negative caching TTL of AAAA response
+	assert.Equal(t, uint32(600), aaaa.Hdr.Ttl)
+
+	// A requests aren't changed
+	req = createTestMessageWithType("ipv4only.example.org.", dns.TypeA)
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reply.Answer))
+	_, ok = reply.Answer[0].(*dns.A)
+	assert.True(t, ok)
+
+	// blocked requests aren't changed
+	req = createTestMessageWithType("null.example.org.", dns.TypeAAAA)
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	for _, rr := range reply.Answer {
+		aaaa, ok = rr.(*dns.AAAA)
+		if ok {
+			assert.False(t, s.conf.dns64Prefix.Contains(aaaa.AAAA))
+		}
+	}
+
+	// DNSSEC validation by client: no synthesis
+	req = createTestMessageWithType("ipv4only.example.org.", dns.TypeAAAA)
+	req.CheckingDisabled = true
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(reply.Answer))
+}
+
+func TestOptimisticCache(t *testing.T) {
+	c := newOptimisticCache(0, 60)
+	now := time.Now()
+	req := createTestMessageWithType("example.org.", dns.TypeA)
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	a := &dns.A{A: net.IP{1, 2, 3, 4}}
+	a.Hdr = dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100}
+	resp.Answer = append(resp.Answer, a)
+	c.set(resp, now)
+
+	// a response without A records isn't stored
+	req2 := createTestMessageWithType("example.com.", dns.TypeA)
+	resp2 := &dns.Msg{}
+	resp2.SetReply(req2)
+	c.set(resp2, now)
+	r, _ := c.get(req2, now)
+	assert.Nil(t, r)
+
+	r, stale := c.get(req, now.Add(40*time.Second))
+	assert.NotNil(t, r)
+	assert.False(t, stale)
+	assert.Equal(t, req.Id, r.Id)
+	assert.Equal(t, uint32(60), r.Answer[0].Header().Ttl)
+
+	// the name is case-insensitive
+	r, _ = c.get(createTestMessageWithType("EXAMPLE.org.", dns.TypeA), now)
+	assert.NotNil(t, r)
+	assert.Equal(t, "EXAMPLE.org.", r.Question[0].Name)
+
+	// expired
+	r, stale = c.get(req, now.Add(130*time.Second))
+	assert.NotNil(t, r)
+	assert.True(t, stale)
+	assert.Equal(t, uint32(optimisticStaleTTL), r.Answer[0].Header().Ttl)
+
+	// expired more than maxStale seconds ago
+	r, _ = c.get(req, now.Add(170*time.Second))
+	assert.Nil(t, r)
+}
+
+// Upstream that counts the requests and responds with a short TTL
+type countingUpstream struct {
+	n int32
+}
+
+func (u *countingUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.n, 1)
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	a := &dns.A{A: net.IP{1, 2, 3, 4}}
+	a.Hdr = dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1}
+	resp.Answer = append(resp.Answer, a)
+	return resp, nil
+}
+
+func (u *countingUpstream) Address() string {
+	return "test"
+}
+
+func TestOptimisticCacheServer(t *testing.T) {
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	s.conf.CacheOptimistic = true
+	u := &countingUpstream{}
+	err := s.startWithUpstream(u)
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	assert.NotNil(t, s.cache)
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	req := createTestMessageWithType("cached.example.org.", dns.TypeA)
+	reply, err := dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reply.Answer))
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reply.Answer))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	// the expired response is returned and then refreshed in background
+	time.Sleep(1100 * time.Millisecond)
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reply.Answer))
+	assert.Equal(t, uint32(optimisticStaleTTL), reply.Answer[0].Header().Ttl)
+	for i := 0; i != 100 && atomic.LoadInt32(&u.n) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.n))
+}
+
+// Upstream that saves the last request and responds with the ECS option of the request
+type ecsTestUpstream struct {
+	req *dns.Msg
+}
+
+func (u *ecsTestUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	u.req = m
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	if e := getECS(m); e != nil {
+		_, ipnet, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", e.Address, e.SourceNetmask))
+		setECS(resp, ipnet)
+	}
+	return resp, nil
+}
+
+func (u *ecsTestUpstream) Address() string {
+	return "test"
+}
+
+func TestECS(t *testing.T) {
+	assert.NotNil(t, checkECSConfig("unknown", "", nil))
+	assert.NotNil(t, checkECSConfig(ecsModeCustom, "1.2.3", nil))
+	assert.Nil(t, checkECSConfig(ecsModeCustom, "1.2.3.0/24", nil))
+	assert.Nil(t, checkECSConfig("", "", []ECSUpstreamConfig{{Upstream: "1.1.1.1", Mode: ecsModeStrip}}))
+	assert.NotNil(t, checkECSConfig("", "", []ECSUpstreamConfig{{Upstream: "1.1.1.1", Mode: ecsModeAuto}}))
+	assert.NotNil(t, checkECSConfig("", "", []ECSUpstreamConfig{{Mode: ecsModeStrip}}))
+
+	ipnet, err := parseECSSubnet("1.2.3.4/24")
+	assert.Nil(t, err)
+	req := createTestMessage("example.org.")
+	setECS(req, ipnet)
+	setECS(req, ipnet)
+	opt := req.IsEdns0()
+	assert.NotNil(t, opt)
+	assert.Equal(t, 1, len(opt.Option))
+	e := getECS(req)
+	assert.Equal(t, "1.2.3.0", e.Address.String())
+	assert.Equal(t, uint8(24), e.SourceNetmask)
+	removeECS(req)
+	assert.Nil(t, getECS(req))
+
+	// global modes
+	s := &Server{}
+	s.conf.EDNSClientSubnetMode = ecsModeCustom
+	s.conf.ecsSubnet, _ = parseECSSubnet("2001:db8::/56")
+	req = createTestMessage("example.org.")
+	assert.True(t, s.prepareECS(req))
+	assert.Equal(t, "2001:db8::", getECS(req).Address.String())
+	s.conf.EDNSClientSubnetMode = ecsModeStrip
+	assert.True(t, s.prepareECS(req))
+	assert.Nil(t, getECS(req))
+	s.conf.EDNSClientSubnetMode = ecsModeForward
+	setECS(req, ipnet)
+	assert.True(t, s.prepareECS(req))
+	assert.NotNil(t, getECS(req))
+	s.conf.EDNSClientSubnetMode = ""
+	assert.False(t, s.prepareECS(req))
+
+	// per-upstream settings
+	s.conf.EnableEDNSClientSubnet = true
+	s.conf.EDNSClientSubnetUpstreams = []ECSUpstreamConfig{
+		{Upstream: "1.1.1.1", Mode: ecsModeStrip},
+		{Upstream: "tls://8.8.8.8", Mode: ecsModeCustom, Subnet: "5.6.7.0/24"},
+	}
+	f := s.ecsAddressToUpstream()
+	u, err := f("1.1.1.1", upstream.Options{})
+	assert.Nil(t, err)
+	_, ok := u.(*ecsUpstream)
+	assert.True(t, ok)
+	u, _ = f("9.9.9.9", upstream.Options{})
+	_, ok = u.(*ecsUpstream)
+	assert.False(t, ok)
+
+	tu := &ecsTestUpstream{}
+	ecsCustom, _ := parseECSSubnet("5.6.7.0/24")
+	u = &ecsUpstream{Upstream: tu, subnet: ecsCustom}
+	resp, err := u.Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "5.6.7.0", getECS(tu.req).Address.String())
+	assert.Equal(t, "1.2.3.0", getECS(req).Address.String()) // the original request isn't modified
+	assert.Nil(t, getECS(resp))
+
+	u = &ecsUpstream{Upstream: tu}
+	_, _ = u.Exchange(req)
+	assert.Nil(t, getECS(tu.req))
+}
+
+func TestBlockingModes(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.FilteringConfig.BlockingMode = "null_ip"
+	clientMode := ""
+	s.conf.GetBlockingModeByClient = func(clientAddr, clientID string) (string, net.IP, net.IP) {
+		return clientMode, net.IP{1, 2, 3, 4}, net.ParseIP("::1")
+	}
+	err := s.Start()
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	// null MX
+	reply, err := dns.Exchange(createTestMessageWithType("null.example.org.", dns.TypeMX), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, 1, len(reply.Answer))
+	mx, ok := reply.Answer[0].(*dns.MX)
+	assert.True(t, ok)
+	assert.Equal(t, ".", mx.Mx)
+	assert.Equal(t, uint16(0), mx.Preference)
+
+	// empty TXT response
+	reply, err = dns.Exchange(createTestMessageWithType("null.example.org.", dns.TypeTXT), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, 0, len(reply.Answer))
+
+	// the client's settings
+	clientMode = "custom_ip"
+	reply, err = dns.Exchange(createTestMessageWithType("null.example.org.", dns.TypeA), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reply.Answer))
+	a, ok := reply.Answer[0].(*dns.A)
+	assert.True(t, ok)
+	assert.Equal(t, "1.2.3.4", a.A.String())
+
+	clientMode = "refused"
+	reply, err = dns.Exchange(createTestMessageWithType("null.example.org.", dns.TypeA), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+
+	assert.True(t, ValidateBlockingMode("refused", "", ""))
+	assert.False(t, ValidateBlockingMode("custom_ip", "1.2.3.4", ""))
+	assert.False(t, ValidateBlockingMode("unknown", "", ""))
+}
+
+// Upstream that fails while it's down
+type switchableUpstream struct {
+	addr string
+	down int32
+	n    int32 // the number of requests
+}
+
+func (u *switchableUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.n, 1)
+	if atomic.LoadInt32(&u.down) != 0 {
+		return nil, fmt.Errorf("timeout")
+	}
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	return resp, nil
+}
+
+func (u *switchableUpstream) Address() string {
+	return u.addr
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	downLock := sync.Mutex{}
+	down := []string{}
+	h := newHealthChecker(time.Hour, 2, func(address string, err error) {
+		downLock.Lock()
+		down = append(down, address)
+		downLock.Unlock()
+	})
+	u1 := &switchableUpstream{addr: "1"}
+	u2 := &switchableUpstream{addr: "2"}
+	w1 := h.wrap("1", u1)
+	w2 := h.wrap("2", u2)
+	req := createTestMessage("example.org.")
+
+	// the upstream is down after 2 consecutive failures
+	atomic.StoreInt32(&u1.down, 1)
+	_, err := w1.Exchange(req)
+	assert.NotNil(t, err)
+	assert.True(t, h.byAddr["1"].isHealthy())
+	_, err = w1.Exchange(req)
+	assert.NotNil(t, err)
+	assert.False(t, h.byAddr["1"].isHealthy())
+	assert.Equal(t, []string{"1"}, down)
+
+	// requests aren't sent to the upstream while it's down
+	_, err = w1.Exchange(req)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u1.n))
+
+	// all upstream servers are down: requests are sent anyway
+	atomic.StoreInt32(&u2.down, 1)
+	_, _ = w2.Exchange(req)
+	_, _ = w2.Exchange(req)
+	assert.True(t, h.allDown())
+	assert.Equal(t, []string{"1", "2"}, down)
+	_, _ = w1.Exchange(req)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&u1.n))
+
+	// the upstream is up after a successful probe query
+	atomic.StoreInt32(&u1.down, 0)
+	h.probeAll()
+	assert.True(t, h.byAddr["1"].isHealthy())
+	assert.False(t, h.byAddr["2"].isHealthy())
+	_, err = w1.Exchange(req)
+	assert.Nil(t, err)
+
+	st := h.status()
+	assert.Equal(t, 2, len(st))
+	assert.True(t, st[0].Healthy)
+	assert.False(t, st[1].Healthy)
+	assert.Equal(t, "timeout", st[1].LastError)
+	assert.NotEqual(t, "", st[1].LastCheck)
+}
+
+// Start DNS server that responds to all requests with 1.2.3.4
+func startTestFallbackServer(t *testing.T, n *int32) (*dns.Server, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(n, 1)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1},
+			A:   net.IP{1, 2, 3, 4},
+		})
+		_ = w.WriteMsg(resp)
+	})
+	srv := &dns.Server{PacketConn: conn, Handler: mux}
+	go func() { _ = srv.ActivateAndServe() }()
+	return srv, conn.LocalAddr().String()
+}
+
+func TestFallbackServers(t *testing.T) {
+	var n int32
+	fallback, addr := startTestFallbackServer(t, &n)
+	defer func() { _ = fallback.Shutdown() }()
+
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	s.conf.UpstreamHealthCheckInterval = 3600
+	s.conf.FallbackDNS = []string{addr}
+	s.conf.CacheSize = 0
+	u := &switchableUpstream{addr: "main"}
+	err := s.startWithUpstream(u)
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	dnsAddr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	// fallback servers aren't used while the main servers respond
+	reply, err := dns.Exchange(createTestMessage("example.org."), dnsAddr)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(reply.Answer))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&n))
+
+	// the main servers have failed
+	atomic.StoreInt32(&u.down, 1)
+	reply, err = dns.Exchange(createTestMessage("example.com."), dnsAddr)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reply.Answer))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&n))
+
+	// fallback servers have their own health state
+	st := s.fallbackHealth.status()
+	assert.Equal(t, 1, len(st))
+	assert.Equal(t, addr, st[0].Address)
+	assert.True(t, st[0].Healthy)
+	for _, h := range s.health.status() {
+		assert.NotEqual(t, addr, h.Address)
+	}
+}
+
+func TestUpstreamGroup(t *testing.T) {
+	u1 := &switchableUpstream{addr: "1"}
+	u2 := &switchableUpstream{addr: "2"}
+	u3 := &switchableUpstream{addr: "3"}
+	list := []upstream.Upstream{u1, u2, u3}
+	addrs := map[upstream.Upstream]string{u1: "1", u2: "2", u3: "3"}
+	req := createTestMessage("example.org.")
+
+	assert.Nil(t, checkUpstreamMode(upstreamModeWeighted, map[string]uint{"1": 2}))
+	assert.NotNil(t, checkUpstreamMode(upstreamModeWeighted, map[string]uint{"1": 0}))
+	assert.NotNil(t, checkUpstreamMode("unknown", nil))
+
+	// lowest RTT: the list is passed to dnsproxy as is
+	assert.Equal(t, 3, len(applyUpstreamMode(upstreamModeLowestRTT, list, addrs, nil)))
+	assert.Equal(t, 1, len(applyUpstreamMode(upstreamModeStrictOrder, list[:1], addrs, nil)))
+
+	// strict order with failover
+	g := applyUpstreamMode(upstreamModeStrictOrder, list, addrs, nil)[0]
+	assert.Equal(t, "1, 2, 3", g.Address())
+	atomic.StoreInt32(&u1.down, 1)
+	_, err := g.Exchange(req)
+	assert.Nil(t, err)
+	_, err = g.Exchange(req)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u1.n))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u2.n))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u3.n))
+	atomic.StoreInt32(&u1.down, 0)
+
+	// round robin
+	g = applyUpstreamMode(upstreamModeRoundRobin, list, addrs, nil)[0]
+	for i := 0; i != 3; i++ {
+		_, err = g.Exchange(req)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&u1.n))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&u2.n))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u3.n))
+
+	// weighted: the server with the highest weight is selected first in most cases
+	ug := newUpstreamGroup(upstreamModeWeighted, list, addrs, map[string]uint{"1": 1000000, "2": 1, "3": 1})
+	assert.Equal(t, uint(1000002), ug.total)
+	n := 0
+	for i := 0; i != 100; i++ {
+		if ug.first() == 0 {
+			n++
+		}
+	}
+	assert.True(t, n > 90)
+
+	// all servers have failed
+	atomic.StoreInt32(&u1.down, 1)
+	atomic.StoreInt32(&u2.down, 1)
+	atomic.StoreInt32(&u3.down, 1)
+	_, err = g.Exchange(req)
+	assert.NotNil(t, err)
+}
+
+func TestForwardZones(t *testing.T) {
+	assert.Nil(t, checkForwardZones([]ForwardZone{{Zone: "corp.example.com", Upstreams: []string{"10.0.0.53"}}}))
+	assert.NotNil(t, checkForwardZones([]ForwardZone{{Zone: "corp.example.com"}}))
+	assert.NotNil(t, checkForwardZones([]ForwardZone{{Zone: "corp.example.com", Upstreams: []string{"[/host/]10.0.0.53"}}}))
+	assert.NotNil(t, checkForwardZones([]ForwardZone{
+		{Zone: "corp.example.com", Upstreams: []string{"10.0.0.53"}},
+		{Zone: "CORP.example.com.", Upstreams: []string{"10.0.0.54"}},
+	}))
+
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	s.conf.ForwardZones = []ForwardZone{
+		{Zone: "corp.example.com", Upstreams: []string{"10.0.0.53"}},
+		{Zone: "dev.corp.example.com", Upstreams: []string{"10.0.0.54"}},
+	}
+	u := &countingUpstream{}
+	err := s.startWithUpstream(u)
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+
+	assert.Equal(t, 2, len(s.zones))
+	assert.Nil(t, s.findForwardZone("example.com."))
+	assert.Equal(t, "corp.example.com.", s.findForwardZone("Host.Corp.example.com.").name)
+	assert.Equal(t, "dev.corp.example.com.", s.findForwardZone("host.dev.corp.example.com.").name)
+
+	zu := &countingUpstream{}
+	s.zones["corp.example.com."].upstreams = []upstream.Upstream{zu}
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	// the response from the zone's server is stored in the zone's cache
+	req := createTestMessageWithType("host.corp.example.com.", dns.TypeA)
+	for i := 0; i != 2; i++ {
+		reply, err := dns.Exchange(req, addr.String())
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(reply.Answer))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&zu.n))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+	resp, _ := s.zones["corp.example.com."].cache.get(req, time.Now())
+	assert.NotNil(t, resp)
+
+	req = createTestMessageWithType("example.com.", dns.TypeA)
+	_, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&zu.n))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+}
+
+// testQueryLog is a mock of query log: it stores the client addresses of the added entries
+type testQueryLog struct {
+	clients    []string
+	wouldBlock []*dnsfilter.Result
+}
+
+func (l *testQueryLog) Start()                                  {}
+func (l *testQueryLog) Close()                                  {}
+func (l *testQueryLog) WriteDiskConfig(dc *querylog.DiskConfig) {}
+func (l *testQueryLog) Add(params querylog.AddParams) {
+	l.clients = append(l.clients, params.ClientIP.String())
+	l.wouldBlock = append(l.wouldBlock, params.WouldBlock)
+}
+
+// testStats is a mock of statistics: it stores the client addresses of the entries
+type testStats struct {
+	clients []string
+	results []stats.Result
+}
+
+func (st *testStats) Start()                               {}
+func (st *testStats) Close()                               {}
+func (st *testStats) WriteDiskConfig(dc *stats.DiskConfig) {}
+func (st *testStats) GetTopClientsIP(limit uint) []string  { return nil }
+func (st *testStats) GetFilterHits() map[int64]uint64      { return nil }
+func (st *testStats) Update(e stats.Entry) {
+	st.clients = append(st.clients, e.Client.String())
+	st.results = append(st.results, e.Result)
+}
+
+func TestAnonymizeClientIP(t *testing.T) {
+	assert.Nil(t, checkAnonymizeMode(""))
+	assert.Nil(t, checkAnonymizeMode("hash"))
+	assert.NotNil(t, checkAnonymizeMode("unknown"))
+
+	assert.Equal(t, "192.168.1.0", maskIP(net.IP{192, 168, 1, 100}).String())
+	assert.Equal(t, "2001:db8:1::", maskIP(net.ParseIP("2001:db8:1:2:3:4:5:6")).String())
+
+	a := ipAnonymizer{}
+	h1 := a.hashIP(net.IP{192, 168, 1, 100})
+	assert.Equal(t, net.IPv6len, len(h1))
+	assert.Equal(t, byte(0xfd), h1[0])
+	assert.Equal(t, h1, a.hashIP(net.IP{192, 168, 1, 100}))
+	assert.NotEqual(t, h1, a.hashIP(net.IP{192, 168, 1, 101}))
+
+	// the salt is changed
+	a.saltTime = time.Now().Add(-anonymizeSaltPeriod)
+	assert.NotEqual(t, h1, a.hashIP(net.IP{192, 168, 1, 100}))
+}
+
+func TestQueryLogPrivacy(t *testing.T) {
+	s := createTestServer(t)
+	ql := &testQueryLog{}
+	st := &testStats{}
+	s.queryLog = ql
+	s.stats = st
+	s.conf.GetLogSettingsByClient = func(clientAddr, clientID string) (bool, bool) {
+		return clientAddr == "10.0.0.2", clientAddr == "10.0.0.3"
+	}
+
+	process := func(client string, res dnsfilter.Result) {
+		d := &proxy.DNSContext{
+			Req:  createTestMessage("example.org."),
+			Addr: &net.UDPAddr{IP: net.ParseIP(client), Port: 53},
+		}
+		ctx := &dnsContext{srv: s, proxyCtx: d, result: &res, startTime: time.Now()}
+		assert.Equal(t, resultDone, processQueryLogsAndStats(ctx))
+	}
+
+	process("10.0.0.1", dnsfilter.Result{})
+	process("10.0.0.2", dnsfilter.Result{})
+	process("10.0.0.3", dnsfilter.Result{})
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.3"}, ql.clients)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, st.clients)
+
+	// only the filtered requests are logged; the addresses are masked
+	ql.clients = nil
+	st.clients = nil
+	s.conf.QueryLogIgnoreAllowed = true
+	s.conf.AnonymizeClientIP = anonymizeModeMask
+	process("10.0.0.1", dnsfilter.Result{})
+	process("10.0.0.1", dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList})
+	assert.Equal(t, []string{"10.0.0.0"}, ql.clients)
+	assert.Equal(t, []string{"10.0.0.0", "10.0.0.0"}, st.clients)
+}
+
+func TestLocalPTR(t *testing.T) {
+	assert.Equal(t, "192.168.1.2", ipFromReverseName("2.1.168.192.in-addr.arpa.").String())
+	assert.Nil(t, ipFromReverseName("1.168.192.in-addr.arpa."))
+	assert.Equal(t, "fd00::1", ipFromReverseName(
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.").String())
+	assert.Nil(t, ipFromReverseName("example.org."))
+	assert.True(t, isLocalIP(net.ParseIP("192.168.1.2")))
+	assert.True(t, isLocalIP(net.ParseIP("fd00::1")))
+	assert.False(t, isLocalIP(net.ParseIP("8.8.8.8")))
+
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	s.conf.LocalPTREnabled = true
+	s.conf.GetHostnameByIP = func(clientAddr string) string {
+		if clientAddr == "192.168.1.2" {
+			return "laptop.lan"
+		}
+		return ""
+	}
+	u := &countingUpstream{}
+	err := s.startWithUpstream(u)
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	req := createTestMessageWithType("2.1.168.192.in-addr.arpa.", dns.TypePTR)
+	reply, err := dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reply.Answer))
+	ptr, ok := reply.Answer[0].(*dns.PTR)
+	assert.True(t, ok)
+	assert.Equal(t, "laptop.lan.", ptr.Ptr)
+
+	// unknown local address: the request isn't passed to upstream servers
+	req = createTestMessageWithType("3.1.168.192.in-addr.arpa.", dns.TypePTR)
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+
+	// public address
+	req = createTestMessageWithType("8.8.8.8.in-addr.arpa.", dns.TypePTR)
+	_, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	// unknown local address is passed to the local resolver
+	lu := &countingUpstream{}
+	s.localResolvers = []upstream.Upstream{lu}
+	req = createTestMessageWithType("3.1.168.192.in-addr.arpa.", dns.TypePTR)
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lu.n))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	// the responses of the local resolvers aren't stored in cache
+	_, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&lu.n))
+
+	// the networks of the network interfaces
+	s.localNetworks = []*net.IPNet{parseNetwork("203.0.113.0/24")}
+	req = createTestMessageWithType("5.113.0.203.in-addr.arpa.", dns.TypePTR)
+	_, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&lu.n))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+	for _, ipnet := range interfaceNetworks() {
+		assert.False(t, isLocalIP(ipnet.IP))
+	}
+}
+
+func TestLocalZones(t *testing.T) {
+	_, err := prepareLocalZones([]LocalZone{{Name: "home.lan", Records: []LocalRecord{{Name: "a", Type: "NS", Value: "ns"}}}})
+	assert.NotNil(t, err)
+	_, err = prepareLocalZones([]LocalZone{{Name: "home.lan", Records: []LocalRecord{{Name: "a", Type: "A", Value: "x"}}}})
+	assert.NotNil(t, err)
+	_, err = prepareLocalZones([]LocalZone{{Name: "home.lan", Records: []LocalRecord{
+		{Name: "a", Type: "A", Value: "192.168.1.2"},
+		{Name: "a", Type: "CNAME", Value: "b"},
+	}}})
+	assert.NotNil(t, err)
+
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	s.conf.LocalZones = []LocalZone{{Name: "home.lan", Records: []LocalRecord{
+		{Name: "@", Type: "MX", Value: "10 mail"},
+		{Name: "mail", Type: "A", Value: "192.168.1.2"},
+		{Name: "nas.storage", Type: "A", Value: "192.168.1.3", TTL: 60},
+		{Name: "www", Type: "CNAME", Value: "nas.storage"},
+		{Name: "_http._tcp", Type: "SRV", Value: "0 5 80 nas.storage"},
+		{Name: "ext", Type: "CNAME", Value: "example.org."},
+	}}}
+	u := &countingUpstream{}
+	err = s.startWithUpstream(u)
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		reply, err := dns.Exchange(createTestMessageWithType(name, qtype), addr.String())
+		assert.Nil(t, err)
+		assert.True(t, reply.Authoritative)
+		return reply
+	}
+
+	reply := exchange("home.lan.", dns.TypeMX)
+	assert.Equal(t, 1, len(reply.Answer))
+	assert.Equal(t, "mail.home.lan.", reply.Answer[0].(*dns.MX).Mx)
+
+	reply = exchange("WWW.home.lan.", dns.TypeA)
+	assert.Equal(t, "nas.storage.home.lan.", reply.Answer[0].(*dns.CNAME).Target)
+	assert.Equal(t, "192.168.1.3", reply.Answer[1].(*dns.A).A.String())
+	assert.Equal(t, uint32(60), reply.Answer[1].Header().Ttl)
+
+	reply = exchange("_http._tcp.home.lan.", dns.TypeSRV)
+	assert.Equal(t, 1, len(reply.Answer))
+
+	reply = exchange("ext.home.lan.", dns.TypeA)
+	assert.Equal(t, 1, len(reply.Answer))
+
+	// no data
+	reply = exchange("mail.home.lan.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, 0, len(reply.Answer))
+	assert.Equal(t, 1, len(reply.Ns))
+	reply = exchange("storage.home.lan.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+
+	reply = exchange("unknown.home.lan.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+}
+
+func TestMetrics(t *testing.T) {
+	s := &Server{}
+	u := s.metrics.wrap("1.1.1.1", &testUpstream{})
+	_, err := u.Exchange(createTestMessage("example.org."))
+	assert.Nil(t, err)
+
+	s.metrics.countRequest(&dnsfilter.Result{})
+	s.metrics.countRequest(&dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList})
+	s.metrics.countRequest(&dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredParental})
+	s.metrics.countCache(true)
+	s.metrics.countCache(false)
+	s.metrics.countCache(false)
+
+	buf := &bytes.Buffer{}
+	s.WriteMetrics(metrics.NewWriter(buf))
+	out := buf.String()
+	assert.True(t, strings.Contains(out, "\nadguardhome_dns_queries_total 3\n"))
+	assert.True(t, strings.Contains(out, "\nadguardhome_dns_cache_hits_total 1\n"))
+	assert.True(t, strings.Contains(out, "\nadguardhome_dns_cache_misses_total 2\n"))
+	assert.True(t, strings.Contains(out, "\nadguardhome_dns_blocked_total{reason=\"FilteredBlackList\"} 1\n"))
+	assert.True(t, strings.Contains(out, "\nadguardhome_dns_blocked_total{reason=\"FilteredParental\"} 1\n"))
+	assert.True(t, strings.Contains(out, "\nadguardhome_dns_upstream_duration_seconds_count{upstream=\"1.1.1.1\"} 1\n"))
+	assert.True(t, strings.Contains(out, "\nadguardhome_dns_upstream_errors_total{upstream=\"1.1.1.1\"} 0\n"))
+}
+
+func TestClientID(t *testing.T) {
+	assert.True(t, IsValidClientID("kids-tablet"))
+	assert.True(t, IsValidClientID("123"))
+	assert.False(t, IsValidClientID(""))
+	assert.False(t, IsValidClientID("-abc"))
+	assert.False(t, IsValidClientID("Abc"))
+	assert.False(t, IsValidClientID("a.b"))
+	assert.False(t, IsValidClientID(strings.Repeat("a", 64)))
+
+	assert.Equal(t, "phone", clientIDFromServerName("Phone.dns.example.org", "dns.example.org"))
+	assert.Equal(t, "", clientIDFromServerName("dns.example.org", "dns.example.org"))
+	assert.Equal(t, "", clientIDFromServerName("a.b.dns.example.org", "dns.example.org"))
+	assert.Equal(t, "", clientIDFromServerName("phone.example.org", "dns.example.org"))
+	assert.Equal(t, "", clientIDFromServerName("phone.dns.example.org", ""))
+
+	assert.Equal(t, "phone", clientIDFromDOHPath("/dns-query/phone"))
+	assert.Equal(t, "phone", clientIDFromDOHPath("/dns-query/phone/"))
+	assert.Equal(t, "", clientIDFromDOHPath("/dns-query"))
+	assert.Equal(t, "", clientIDFromDOHPath("/dns-query/"))
+	assert.Equal(t, "", clientIDFromDOHPath("/dns-query/a/b"))
+
+	s := &Server{}
+	s.conf.ServerName = "dns.example.org"
+	r, _ := http.NewRequest("GET", "https://tv.dns.example.org/dns-query", nil)
+	r.TLS = &tls.ConnectionState{ServerName: "tv.dns.example.org"}
+	d := &proxy.DNSContext{Proto: proxy.ProtoHTTPS, HTTPRequest: r}
+	assert.Equal(t, "tv", s.clientID(d))
+
+	// the path has a priority over the server name
+	r.URL.Path = "/dns-query/phone"
+	assert.Equal(t, "phone", s.clientID(d))
+
+	d = &proxy.DNSContext{Proto: proxy.ProtoUDP}
+	assert.Equal(t, "", s.clientID(d))
+}
+
+func TestRatelimiter(t *testing.T) {
+	conf := &FilteringConfig{
+		Ratelimit:              2,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitBanThreshold:  3,
+		RatelimitBanDuration:   60,
+		RatelimitWhitelist:     []string{"10.0.0.0/8"},
+	}
+	assert.Nil(t, checkRatelimitConfig(conf))
+	r := newRatelimiter(conf)
+	now := time.Unix(1000, 0)
+
+	// the requests from the same subnet are counted together
+	assert.False(t, r.isLimited(net.ParseIP("1.2.3.1"), true, now))
+	assert.False(t, r.isLimited(net.ParseIP("1.2.3.2"), true, now))
+	assert.True(t, r.isLimited(net.ParseIP("1.2.3.3"), true, now))
+	assert.False(t, r.isLimited(net.ParseIP("1.2.4.1"), true, now))
+
+	// TCP requests aren't limited
+	assert.False(t, r.isLimited(net.ParseIP("1.2.3.1"), false, now))
+
+	// the limit is per second
+	now = now.Add(time.Second)
+	assert.False(t, r.isLimited(net.ParseIP("1.2.3.1"), true, now))
+
+	// whitelisted
+	for i := 0; i != 10; i++ {
+		assert.False(t, r.isLimited(net.ParseIP("10.1.1.1"), true, now))
+	}
+
+	// banned: all requests are dropped
+	assert.False(t, r.isLimited(net.ParseIP("1.2.3.1"), true, now))
+	assert.True(t, r.isLimited(net.ParseIP("1.2.3.1"), true, now))
+	assert.True(t, r.isLimited(net.ParseIP("1.2.3.1"), true, now))
+	assert.Equal(t, []string{"1.2.3.0/24"}, r.banned(now))
+	now = now.Add(time.Second)
+	assert.True(t, r.isLimited(net.ParseIP("1.2.3.1"), false, now))
+	assert.True(t, r.isLimited(net.ParseIP("1.2.3.1"), true, now))
+
+	// the ban expires
+	now = now.Add(time.Minute)
+	assert.False(t, r.isLimited(net.ParseIP("1.2.3.1"), true, now))
+	assert.Equal(t, 0, len(r.banned(now)))
+
+	// disabled
+	r = newRatelimiter(&FilteringConfig{})
+	assert.False(t, r.isLimited(net.ParseIP("1.2.3.1"), true, now))
+
+	assert.NotNil(t, checkRatelimitConfig(&FilteringConfig{RatelimitSubnetLenIPv4: 33}))
+	assert.NotNil(t, checkRatelimitConfig(&FilteringConfig{RatelimitWhitelist: []string{"1.2.3"}}))
+}
+
+func TestLimitUDPResponse(t *testing.T) {
+	s := &Server{}
+	s.conf.MaxUDPResponseSize = 1232
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	newResp := func() *dns.Msg {
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		for i := 0; i != 100; i++ {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+				A:   net.IP{1, 2, 3, byte(i)},
+			})
+		}
+		return resp
+	}
+
+	d := &proxy.DNSContext{Proto: proxy.ProtoUDP, Req: req, Res: newResp()}
+	s.limitUDPResponse(d)
+	assert.True(t, d.Res.Truncated)
+	assert.True(t, d.Res.Len() <= 1232)
+
+	// TCP responses aren't truncated
+	d = &proxy.DNSContext{Proto: proxy.ProtoTCP, Req: req, Res: newResp()}
+	s.limitUDPResponse(d)
+	assert.False(t, d.Res.Truncated)
+	assert.Equal(t, 100, len(d.Res.Answer))
+
+	// no EDNS0: 512 bytes
+	req.Extra = nil
+	d = &proxy.DNSContext{Proto: proxy.ProtoUDP, Req: req, Res: newResp()}
+	s.limitUDPResponse(d)
+	assert.True(t, d.Res.Truncated)
+	assert.True(t, d.Res.Len() <= dns.MinMsgSize)
+}
+
+// Signed zones for DNSSEC tests
+type testDNSSECZones struct {
+	t       *testing.T
+	now     time.Time
+	keys    map[string]*dns.DNSKEY
+	signers map[string]crypto.Signer
+	answers map[string]*dns.Msg // by "name type"
+}
+
+func (z *testDNSSECZones) addZone(zone string) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	assert.Nil(z.t, err)
+	z.keys[zone] = key
+	z.signers[zone] = priv.(crypto.Signer)
+	z.set(zone, dns.TypeDNSKEY, zone, []dns.RR{key}, nil)
+}
+
+func (z *testDNSSECZones) sign(zone string, rrs []dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		Algorithm:  dns.ECDSAP256SHA256,
+		Expiration: uint32(z.now.Add(time.Hour).Unix()),
+		Inception:  uint32(z.now.Add(-time.Hour).Unix()),
+		KeyTag:     z.keys[zone].KeyTag(),
+		SignerName: zone,
+	}
+	assert.Nil(z.t, sig.Sign(z.signers[zone], rrs))
+	return append(rrs, sig)
+}
+
+// Set the response;  the records are signed by the zone if it's not empty
+func (z *testDNSSECZones) set(name string, qtype uint16, zone string, answer, ns []dns.RR) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	if len(zone) != 0 {
+		if len(answer) != 0 {
+			answer = z.sign(zone, answer)
+		}
+		signed := []dns.RR{}
+		for _, set := range makeRRSets(ns) {
+			signed = append(signed, z.sign(zone, set.rrs)...)
+		}
+		ns = signed
+	}
+	m.Answer = answer
+	m.Ns = ns
+	z.answers[fmt.Sprintf("%s %d", name, qtype)] = m
+	return m
+}
+
+func (z *testDNSSECZones) exchange(req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	m, ok := z.answers[fmt.Sprintf("%s %d", q.Name, q.Qtype)]
+	if !ok {
+		return nil, fmt.Errorf("no answer")
+	}
+	return m.Copy(), nil
+}
+
+func testSOA(zone string) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:  "ns." + zone, Mbox: "admin." + zone, Serial: 1, Refresh: 1, Retry: 1, Expire: 1, Minttl: 60,
+	}
+}
+
+func testA(name string) *dns.A {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+		A:   net.IP{1, 2, 3, 4},
+	}
+}
+
+func TestDNSSECValidation(t *testing.T) {
+	z := &testDNSSECZones{
+		t:       t,
+		now:     time.Now(),
+		keys:    map[string]*dns.DNSKEY{},
+		signers: map[string]crypto.Signer{},
+		answers: map[string]*dns.Msg{},
+	}
+	z.addZone(".")
+	z.addZone("org.")
+	z.addZone("example.org.")
+	z.set("org.", dns.TypeDS, ".", []dns.RR{z.keys["org."].ToDS(dns.SHA256)}, nil)
+	z.set("example.org.", dns.TypeDS, "org.", []dns.RR{z.keys["example.org."].ToDS(dns.SHA256)}, nil)
+
+	// insecure delegation
+	z.set("insecure.org.", dns.TypeDS, "org.", nil, []dns.RR{testSOA("org."), &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "insecure.org.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: "z.org.",
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+	}})
+	z.set("www.insecure.org.", dns.TypeDS, "", nil, []dns.RR{testSOA("insecure.org.")})
+
+	v := newDNSSECValidator(z.exchange)
+	v.anchors = []*dns.DS{z.keys["."].ToDS(dns.SHA256)}
+
+	resp := z.set("www.example.org.", dns.TypeA, "example.org.", []dns.RR{testA("www.example.org.")}, nil)
+	status, err := v.validate(resp, z.now)
+	assert.Nil(t, err)
+	assert.Equal(t, DNSSECSecure, status)
+
+	// the keys are stored in cache
+	delete(z.answers, "org. 48")
+	status, _ = v.validate(resp, z.now)
+	assert.Equal(t, DNSSECSecure, status)
+
+	// the record is modified
+	resp.Answer[0].(*dns.A).A = net.IP{1, 2, 3, 5}
+	status, err = v.validate(resp, z.now)
+	assert.NotNil(t, err)
+	assert.Equal(t, DNSSECBogus, status)
+
+	// the signature is expired
+	resp = z.set("www.example.org.", dns.TypeA, "example.org.", []dns.RR{testA("www.example.org.")}, nil)
+	status, _ = v.validate(resp, z.now.Add(2*time.Hour))
+	assert.Equal(t, DNSSECBogus, status)
+
+	// unsigned answer from the signed zone
+	resp = z.set("www.example.org.", dns.TypeA, "", []dns.RR{testA("www.example.org.")}, nil)
+	z.set("www.example.org.", dns.TypeDS, "example.org.", nil, []dns.RR{testSOA("example.org."), &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "www.example.org.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: "z.example.org.",
+		TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+	}})
+	status, _ = v.validate(resp, z.now)
+	assert.Equal(t, DNSSECBogus, status)
+
+	// unsigned zone
+	resp = z.set("www.insecure.org.", dns.TypeA, "", []dns.RR{testA("www.insecure.org.")}, nil)
+	status, err = v.validate(resp, z.now)
+	assert.Nil(t, err)
+	assert.Equal(t, DNSSECInsecure, status)
+
+	// NXDOMAIN with the proof
+	nsec := &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "a.example.org.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: "www.example.org.",
+		TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+	}
+	resp = z.set("b.example.org.", dns.TypeA, "example.org.", nil, []dns.RR{testSOA("example.org."), nsec})
+	resp.Rcode = dns.RcodeNameError
+	status, err = v.validate(resp, z.now)
+	assert.Nil(t, err)
+	assert.Equal(t, DNSSECSecure, status)
+
+	// NXDOMAIN: the name isn't covered by NSEC record
+	resp = z.set("x.example.org.", dns.TypeA, "example.org.", nil, []dns.RR{testSOA("example.org."), nsec})
+	resp.Rcode = dns.RcodeNameError
+	status, _ = v.validate(resp, z.now)
+	assert.Equal(t, DNSSECBogus, status)
+
+	// NODATA
+	resp = z.set("a.example.org.", dns.TypeAAAA, "example.org.", nil, []dns.RR{testSOA("example.org."), nsec})
+	status, _ = v.validate(resp, z.now)
+	assert.Equal(t, DNSSECSecure, status)
+	resp = z.set("a.example.org.", dns.TypeA, "example.org.", nil, []dns.RR{testSOA("example.org."), nsec})
+	status, _ = v.validate(resp, z.now)
+	assert.Equal(t, DNSSECBogus, status)
+
+	// the wildcard expansion: "*.example.org." is returned as "b.example.org."
+	wildcard := func(name string) []dns.RR {
+		rrs := z.sign("example.org.", []dns.RR{testA("*.example.org.")})
+		for _, rr := range rrs {
+			rr.Header().Name = name
+		}
+		return rrs
+	}
+	assert.Equal(t, "b.example.org.", nextCloserName("a.b.example.org.", 2))
+	resp = z.set("b.example.org.", dns.TypeA, "", wildcard("b.example.org."), nil)
+	resp.Ns = z.sign("example.org.", []dns.RR{nsec})
+	status, err = v.validate(resp, z.now)
+	assert.Nil(t, err)
+	assert.Equal(t, DNSSECSecure, status)
+
+	// the forged wildcard expansion: the name exists, there's no proof of non-existence
+	resp = z.set("www.example.org.", dns.TypeA, "", wildcard("www.example.org."), nil)
+	status, err = v.validate(resp, z.now)
+	assert.NotNil(t, err)
+	assert.Equal(t, DNSSECBogus, status)
+	resp.Ns = z.sign("example.org.", []dns.RR{nsec})
+	status, _ = v.validate(resp, z.now)
+	assert.Equal(t, DNSSECBogus, status)
+}
+
+func TestDNSSECRecords(t *testing.T) {
+	assert.Equal(t, -1, canonicalCompare("example.org.", "a.example.org."))
+	assert.Equal(t, -1, canonicalCompare("A.example.org.", "z.example.org."))
+	assert.Equal(t, 1, canonicalCompare("z.org.", "a.example.org."))
+	assert.Equal(t, 0, canonicalCompare("Example.org.", "example.org."))
+
+	// the client hasn't requested DNSSEC records
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	hasOPT, do := setDO(req)
+	assert.False(t, hasOPT)
+	assert.True(t, req.IsEdns0().Do())
+
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{testA("example.org."), &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET},
+		TypeCovered: dns.TypeA,
+	}}
+	resp.SetEdns0(4096, true)
+	removeDNSSECRecords(resp)
+	restoreDO(req, resp, hasOPT, do)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Nil(t, req.IsEdns0())
+	assert.Nil(t, resp.IsEdns0())
+
+	// the client uses EDNS0 without DO bit
+	req.SetEdns0(1232, false)
+	hasOPT, do = setDO(req)
+	assert.True(t, hasOPT)
+	assert.False(t, do)
+	resp.SetEdns0(4096, true)
+	restoreDO(req, resp, hasOPT, do)
+	assert.False(t, req.IsEdns0().Do())
+	assert.False(t, resp.IsEdns0().Do())
+}
+
+func TestConfigTx(t *testing.T) {
+	s := createTestServer(t)
+	modified := 0
+	s.conf.ConfigModified = func() { modified++ }
+	assert.Nil(t, s.Start())
+	defer func() { _ = s.Stop() }()
+
+	// invalid settings aren't applied
+	tx := s.beginConfigTx()
+	tx.conf.BlockingMode = "custom_ip"
+	tx.conf.BlockingIPv4 = "bad"
+	assert.NotNil(t, tx.validate())
+	tx.close()
+	assert.Equal(t, "", s.conf.BlockingMode)
+
+	tx = s.beginConfigTx()
+	tx.conf.RatelimitSubnetLenIPv4 = 33
+	assert.NotNil(t, tx.validate())
+	tx.close()
+
+	// the settings are applied and written once
+	tx = s.beginConfigTx()
+	tx.conf.ProtectionEnabled = false
+	tx.conf.RefuseAny = true
+	assert.Nil(t, tx.validate())
+	assert.Nil(t, tx.commit(true))
+	tx.close()
+	assert.Equal(t, 1, modified)
+	assert.False(t, s.conf.ProtectionEnabled)
+	assert.True(t, s.conf.RefuseAny)
+	assert.True(t, s.IsRunning())
+
+	// the previous settings are restored if DNS server fails to start
+	tx = s.beginConfigTx()
+	tx.conf.AllowedClients = []string{"1.2.3.4/99"}
+	assert.NotNil(t, tx.commit(true))
+	tx.close()
+	assert.Equal(t, 1, modified)
+	assert.Equal(t, 0, len(s.conf.AllowedClients))
+	assert.True(t, s.IsRunning())
+}
+
+type testMiddleware struct {
+	n      int32
+	result MiddlewareResult
+}
+
+func (m *testMiddleware) Process(d *proxy.DNSContext) (MiddlewareResult, error) {
+	atomic.AddInt32(&m.n, 1)
+	if d.Req.Question[0].Name == "mw.example.org." {
+		resp := &dns.Msg{}
+		resp.SetReply(d.Req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: d.Req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+			A:   net.ParseIP("1.2.3.4"),
+		})
+		d.Res = resp
+	}
+	return m.result, nil
+}
+
+func TestPipeline(t *testing.T) {
+	saved := customStages
+	defer func() { customStages = saved }()
+
+	def := DefaultPipeline()
+	assert.Equal(t, len(builtinStages), len(def))
+	assert.Equal(t, StageInitial, def[0])
+
+	_, err := buildPipeline([]string{StageInitial})
+	assert.NotNil(t, err) // missing stages
+	_, err = buildPipeline(append(def, StageQueryLog))
+	assert.NotNil(t, err) // duplicate
+	_, err = buildPipeline(append(def, "unknown"))
+	assert.NotNil(t, err)
+
+	m := &testMiddleware{result: MiddlewareContinue}
+	RegisterMiddleware("test", StageFiltering, m)
+	RegisterMiddleware("test_last", "", &testMiddleware{})
+	assert.Panics(t, func() { RegisterMiddleware("test", "", m) })
+	assert.Panics(t, func() { RegisterMiddleware(StageUpstream, "", m) })
+	assert.Panics(t, func() { RegisterMiddleware("test2", "unknown", m) })
+
+	def = DefaultPipeline()
+	assert.Equal(t, len(builtinStages)+2, len(def))
+	assert.Equal(t, "test", def[2])
+	assert.Equal(t, StageFiltering, def[3])
+	assert.Equal(t, "test_last", def[len(def)-1])
+
+	// a middleware which isn't listed isn't used
+	list, err := buildPipeline(append(def[:2:2], def[3:len(def)-1]...))
+	assert.Nil(t, err)
+	assert.Equal(t, len(builtinStages), len(list))
+
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	s.conf.Pipeline = def
+	u := &countingUpstream{}
+	err = s.startWithUpstream(u)
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	// the response set by the middleware isn't resolved by upstream
+	reply, err := dns.Exchange(createTestMessage("mw.example.org."), addr.String())
+	assert.Nil(t, err)
+	assertResponse(t, reply, "1.2.3.4")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&m.n))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+
+	// the filtering stage isn't performed after a middleware finishes processing
+	m.result = MiddlewareFinish
+	reply, err = dns.Exchange(createTestMessage("nxdomain.example.org."), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, reply.Rcode)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+}
+
+func TestQueryPolicy(t *testing.T) {
+	assert.Nil(t, checkBlockedTLDs([]string{"zip", "*.top", ".Mov"}))
+	assert.NotNil(t, checkBlockedTLDs([]string{"*"}))
+	assert.NotNil(t, checkBlockedTLDs([]string{"a*.top"}))
+	assert.Nil(t, CheckQueryTypes([]string{"ANY", "https", "SVCB"}))
+	assert.NotNil(t, CheckQueryTypes([]string{"unknown"}))
+	assert.Equal(t, "HTTPS", queryTypeName(65))
+	assert.Equal(t, "zip", matchBlockedTLD("files.example.zip", []string{"top", "*.zip"}))
+	assert.Equal(t, "", matchBlockedTLD("example.ziparchive", []string{"zip"}))
+
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	s.conf.BlockedTLDs = []string{"*.zip"}
+	s.conf.BlockedQueryTypes = []string{"HTTPS"}
+	pol := QueryPolicy{}
+	s.conf.GetQueryPolicyByClient = func(clientAddr, clientID string) QueryPolicy {
+		return pol
+	}
+	u := &countingUpstream{}
+	err := s.startWithUpstream(u)
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		reply, err := dns.Exchange(createTestMessageWithType(name, qtype), addr.String())
+		assert.Nil(t, err)
+		return reply
+	}
+
+	// blocked TLD
+	reply := exchange("files.example.zip.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+
+	// blocked query type: empty answer
+	reply = exchange("example.org.", 65) // HTTPS
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, 0, len(reply.Answer))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+
+	// the client's settings
+	pol = QueryPolicy{BlockedQueryTypes: []string{"TXT"}, IPv4Only: true}
+	reply = exchange("example.org.", dns.TypeTXT)
+	assert.Equal(t, 0, len(reply.Answer))
+	reply = exchange("example.org.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, 0, len(reply.Answer))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+
+	reply = exchange("example.org.", dns.TypeA)
+	assert.Equal(t, 1, len(reply.Answer))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	// the policies aren't applied when protection is disabled (except IPv4-only)
+	s.conf.ProtectionEnabled = false
+	reply = exchange("files.example.zip.", dns.TypeA)
+	assert.Equal(t, 1, len(reply.Answer))
+	reply = exchange("example.org.", dns.TypeAAAA)
+	assert.Equal(t, 0, len(reply.Answer))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.n))
+}
+
+// mxUpstream responds with MX record and the addresses of the mail server
+type mxUpstream struct{}
+
+func (u *mxUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	hdr := func(t uint16) dns.RR_Header {
+		return dns.RR_Header{Name: m.Question[0].Name, Rrtype: t, Class: dns.ClassINET, Ttl: 60}
+	}
+	resp.Answer = append(resp.Answer, &dns.MX{Hdr: hdr(dns.TypeMX), Preference: 10, Mx: m.Question[0].Name})
+	resp.Extra = append(resp.Extra, &dns.A{Hdr: hdr(dns.TypeA), A: net.IP{1, 2, 3, 4}})
+	resp.Extra = append(resp.Extra, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: net.ParseIP("2001:db8::1")})
+	return resp, nil
+}
+
+func (u *mxUpstream) Address() string {
+	return "test"
+}
+
+func TestAAAAFiltering(t *testing.T) {
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	ql := &testQueryLog{}
+	st := &testStats{}
+	s.queryLog = ql
+	s.stats = st
+	ipv4Only := false
+	s.conf.GetQueryPolicyByClient = func(clientAddr, clientID string) QueryPolicy {
+		return QueryPolicy{IPv4Only: ipv4Only}
+	}
+	err := s.startWithUpstream(&mxUpstream{})
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	reply, err := dns.Exchange(createTestMessageWithType("mail.example.org.", dns.TypeMX), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(reply.Extra))
+
+	ipv4Only = true
+	reply, err = dns.Exchange(createTestMessageWithType("mail.example.org.", dns.TypeAAAA), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, 0, len(reply.Answer))
+
+	// AAAA records are removed from the other responses
+	reply, err = dns.Exchange(createTestMessageWithType("mail2.example.org.", dns.TypeMX), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reply.Answer))
+	assert.Equal(t, 1, len(reply.Extra))
+	_, ok := reply.Extra[0].(*dns.A)
+	assert.True(t, ok)
+
+	// the empty AAAA response is counted in statistics separately and isn't written to query log
+	assert.Equal(t, []stats.Result{stats.RNotFiltered, stats.RFilteredAAAA, stats.RNotFiltered}, st.results)
+	assert.Equal(t, 2, len(ql.clients))
+}
+
+func TestAuditMode(t *testing.T) {
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	ql := &testQueryLog{}
+	st := &testStats{}
+	s.queryLog = ql
+	s.stats = st
+	s.conf.FilterHandler = func(clientAddr, clientID string, settings *dnsfilter.RequestFilteringSettings) {
+		settings.AuditMode = true
+	}
+	u := &countingUpstream{}
+	err := s.startWithUpstream(u)
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	// the blocked request is resolved by upstream
+	reply, err := dns.Exchange(createTestMessage("nxdomain.example.org."), addr.String())
+	assert.Nil(t, err)
+	assertResponse(t, reply, "1.2.3.4")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	reply, err = dns.Exchange(createTestMessage("example.org."), addr.String())
+	assert.Nil(t, err)
+	assertResponse(t, reply, "1.2.3.4")
+
+	// the filtering result is passed to query log, the requests are counted as not filtered
+	assert.Equal(t, 2, len(ql.wouldBlock))
+	assert.NotNil(t, ql.wouldBlock[0])
+	assert.Equal(t, dnsfilter.FilteredBlackList, ql.wouldBlock[0].Reason)
+	assert.Equal(t, "||nxdomain.example.org", ql.wouldBlock[0].Rule)
+	assert.Nil(t, ql.wouldBlock[1])
+	assert.Equal(t, []stats.Result{stats.RNotFiltered, stats.RNotFiltered}, st.results)
+}
+
+func TestCacheSettings(t *testing.T) {
+	assert.Nil(t, checkCacheConfig(&FilteringConfig{CacheMinTTL: 60, CacheMaxTTL: 3600, CacheServfailTTL: 30}))
+	assert.NotNil(t, checkCacheConfig(&FilteringConfig{CacheMinTTL: 60, CacheMaxTTL: 30}))
+	assert.NotNil(t, checkCacheConfig(&FilteringConfig{CacheServfailTTL: 600}))
+
+	c := newResponseCache(0)
+	c.ttls = cacheTTLs{min: 60, max: 300, negative: 30, servfail: 10}
+	now := time.Now()
+	response := func(name string, ttl uint32) (*dns.Msg, *dns.Msg) {
+		req := createTestMessageWithType(name, dns.TypeA)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		if ttl != 0 {
+			a := &dns.A{A: net.IP{1, 2, 3, 4}}
+			a.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
+			resp.Answer = append(resp.Answer, a)
+		}
+		return req, resp
+	}
+
+	// TTL is raised to the minimum
+	req, resp := response("min.example.org.", 10)
+	c.set(resp, now)
+	assert.Equal(t, uint32(60), resp.Answer[0].Header().Ttl)
+	r, _ := c.get(req, now.Add(50*time.Second))
+	assert.NotNil(t, r)
+	r, _ = c.get(req, now.Add(61*time.Second))
+	assert.Nil(t, r)
+
+	// TTL is lowered to the maximum
+	req, resp = response("max.example.org.", 3600)
+	c.set(resp, now)
+	r, _ = c.get(req, now)
+	assert.Equal(t, uint32(300), r.Answer[0].Header().Ttl)
+
+	// NODATA response is cached for the negative TTL
+	req2, resp := response("nodata.example.org.", 0)
+	c.set(resp, now)
+	r, _ = c.get(req2, now.Add(20*time.Second))
+	assert.NotNil(t, r)
+	r, _ = c.get(req2, now.Add(31*time.Second))
+	assert.Nil(t, r)
+
+	// SERVFAIL
+	req3 := createTestMessageWithType("servfail.example.org.", dns.TypeA)
+	resp = &dns.Msg{}
+	resp.SetRcode(req3, dns.RcodeServerFailure)
+	c.set(resp, now)
+	r, _ = c.get(req3, now.Add(5*time.Second))
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+	r, _ = c.get(req3, now.Add(11*time.Second))
+	assert.Nil(t, r)
+
+	info := cacheInfo{}
+	c.addInfo(&info)
+	assert.Equal(t, uint64(1), info.Entries)
+	assert.Equal(t, uint64(4), info.Hits)
+	assert.Equal(t, uint64(3), info.Misses)
+
+	// the responses for the name are deleted
+	c.clearName("MAX.example.org")
+	r, _ = c.get(req, now)
+	assert.Nil(t, r)
+	c.clear()
+	info = cacheInfo{}
+	c.addInfo(&info)
+	assert.Equal(t, cacheInfo{}, info)
+
+	// SERVFAIL responses aren't cached by default
+	c = newResponseCache(0)
+	c.set(resp, now)
+	r, _ = c.get(req3, now)
+	assert.Nil(t, r)
+}
+
+func TestCacheServfail(t *testing.T) {
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	s.conf.CacheServfailTTL = 60
+	u := &switchableUpstream{addr: "test", down: 1}
+	err := s.startWithUpstream(u)
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	for i := 0; i != 2; i++ {
+		reply, err := dns.Exchange(createTestMessageWithType("down.example.org.", dns.TypeA), addr.String())
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeServerFailure, reply.Rcode)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	w := httptest.NewRecorder()
+	s.handleCacheInfo(w, httptest.NewRequest("GET", "/control/cache_info", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	info := cacheInfoJSON{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.True(t, info.Enabled)
+	assert.Equal(t, uint64(1), info.Entries)
+	assert.Equal(t, uint64(1), info.Hits)
+
+	// the upstream server is available again, but the response is in cache until it's flushed
+	atomic.StoreInt32(&u.down, 0)
+	w = httptest.NewRecorder()
+	s.handleCacheFlush(w, httptest.NewRequest("POST", "/control/cache_flush", strings.NewReader(`{"name":"down.example.org"}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	reply, err := dns.Exchange(createTestMessageWithType("down.example.org.", dns.TypeA), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.n))
+}
+
+func TestCachePersistent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-dnscache")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "dnscache.bin")
+
+	now := time.Now()
+	response := func(name string, ttl uint32) (*dns.Msg, *dns.Msg) {
+		req := createTestMessageWithType(name, dns.TypeA)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		a := &dns.A{A: net.IP{1, 2, 3, 4}}
+		a.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
+		resp.Answer = append(resp.Answer, a)
+		return req, resp
+	}
+
+	s := &Server{}
+	s.conf.CachePersistent = true
+	s.conf.CacheFile = fn
+	s.cache = newResponseCache(0)
+	s.cache.trackKeys()
+	req1, resp1 := response("long.example.org.", 100)
+	s.cache.set(resp1, now)
+	req2, resp2 := response("short.example.org.", 10)
+	s.cache.set(resp2, now)
+	req3, resp3 := response("deleted.example.org.", 100)
+	s.cache.set(resp3, now)
+	s.cache.clearName("deleted.example.org")
+	s.saveCache()
+
+	// the expired response isn't loaded
+	c := newResponseCache(0)
+	n, err := c.load(fn, now.Add(50*time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	r, _ := c.get(req1, now.Add(50*time.Second))
+	assert.NotNil(t, r)
+	assert.Equal(t, uint32(50), r.Answer[0].Header().Ttl)
+	r, _ = c.get(req2, now.Add(50*time.Second))
+	assert.Nil(t, r)
+	r, _ = c.get(req3, now.Add(50*time.Second))
+	assert.Nil(t, r)
+
+	// the file is loaded only once
+	s.cache = newResponseCache(0)
+	s.loadCache()
+	r, _ = s.cache.get(req1, now)
+	assert.NotNil(t, r)
+	_, err = os.Stat(fn)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, ioutil.WriteFile(fn, []byte("AGHC\x01\x00\x10"), 0644))
+	_, err = c.load(fn, now)
+	assert.NotNil(t, err)
+	assert.Nil(t, ioutil.WriteFile(fn, []byte("invalid"), 0644))
+	_, err = c.load(fn, now)
+	assert.NotNil(t, err)
+}
+
+func TestCachePrefetch(t *testing.T) {
+	p := cachePrefetchFromConfig(&FilteringConfig{CachePrefetch: true})
+	assert.Equal(t, cachePrefetch{hits: 5, time: 10, qps: 10}, p)
+	assert.Equal(t, cachePrefetch{}, cachePrefetchFromConfig(&FilteringConfig{CachePrefetchHits: 2}))
+
+	// the number of prefetch requests per second is limited
+	c := newResponseCache(0)
+	c.prefetch = cachePrefetch{hits: 1, time: 10, qps: 1}
+	now := time.Now()
+	assert.False(t, c.needPrefetch([]byte("1"), 20, now))
+	assert.True(t, c.needPrefetch([]byte("1"), 10, now))
+	assert.False(t, c.needPrefetch([]byte("2"), 10, now))
+	assert.True(t, c.needPrefetch([]byte("2"), 10, now.Add(time.Second)))
+
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	s.conf.CacheNegativeTTL = 60
+	s.conf.CachePrefetch = true
+	s.conf.CachePrefetchHits = 2
+	s.conf.CachePrefetchTime = 60
+	u := &switchableUpstream{addr: "test"}
+	err := s.startWithUpstream(u)
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	// the response is refreshed after the second request from cache
+	for i := 0; i != 3; i++ {
+		reply, err := dns.Exchange(createTestMessageWithType("popular.example.org.", dns.TypeTXT), addr.String())
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	}
+	refreshing := func() int {
+		s.cache.lock.Lock()
+		defer s.cache.lock.Unlock()
+		return len(s.cache.refreshing)
+	}
+	for i := 0; i != 50 && (atomic.LoadInt32(&u.n) != 2 || refreshing() != 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.n))
+
+	info := cacheInfo{}
+	s.cache.addInfo(&info)
+	assert.Equal(t, uint64(1), info.Prefetches)
+	assert.Equal(t, uint64(2), info.Hits)
+}
+
+func TestListeners(t *testing.T) {
+	assert.Nil(t, checkListeners([]ListenerConfig{
+		{Address: "127.0.0.1", Port: 53},
+		{Interface: "eth0", Port: 53, PortDNSOverTLS: 853, PortDNSOverHTTPS: 8443},
+	}))
+	assert.NotNil(t, checkListeners([]ListenerConfig{{Port: 53}}))
+	assert.NotNil(t, checkListeners([]ListenerConfig{{Address: "127.0.0.1", Interface: "eth0", Port: 53}}))
+	assert.NotNil(t, checkListeners([]ListenerConfig{{Address: "localhost", Port: 53}}))
+	assert.NotNil(t, checkListeners([]ListenerConfig{{Address: "127.0.0.1"}}))
+	assert.NotNil(t, checkListeners([]ListenerConfig{{Address: "127.0.0.1", Port: 65536}}))
+
+	// DNS-over-TLS requires a certificate
+	_, err := listenerConfigs([]ListenerConfig{{Address: "127.0.0.1", PortDNSOverTLS: 853}}, proxy.Config{})
+	assert.NotNil(t, err)
+	confs, err := listenerConfigs([]ListenerConfig{{Address: "127.0.0.1", Port: 53, PortDNSOverTLS: 853}}, proxy.Config{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(confs))
+	assert.Equal(t, "127.0.0.1:53", confs[0].UDPListenAddr.String())
+	assert.Nil(t, confs[0].TLSListenAddr)
+
+	freePort := func() int {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		assert.Nil(t, err)
+		defer func() { _ = c.Close() }()
+		return c.LocalAddr().(*net.UDPAddr).Port
+	}
+	ports := []int{freePort(), freePort()}
+
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	s.conf.Listeners = []ListenerConfig{
+		{Address: "127.0.0.1", Port: ports[0]},
+		{Address: "127.0.0.1", Port: ports[1]},
+	}
+	u := &switchableUpstream{addr: "test"}
+	assert.Nil(t, s.Prepare(nil))
+	s.dnsProxy.Upstreams = []upstream.Upstream{u}
+	assert.Nil(t, s.startInternal())
+	defer func() { _ = s.Stop() }()
+	assert.Equal(t, 1, len(s.listeners))
+
+	// the requests to both addresses are passed to the upstream server
+	for _, port := range ports {
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+		reply, err := dns.Exchange(createTestMessageWithType("listener.example.org.", dns.TypeTXT), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.n))
+}
+
+func TestSockets(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer func() { _ = udp.Close() }()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer func() { _ = tcp.Close() }()
+
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	s.conf.Sockets = &Sockets{UDP: []net.PacketConn{udp}, TCP: []net.Listener{tcp}}
+	u := &switchableUpstream{addr: "test"}
+	assert.Nil(t, s.Prepare(nil))
+	assert.False(t, hasListenAddr(&s.dnsProxy.Config))
+	s.dnsProxy.Upstreams = []upstream.Upstream{u}
+	assert.Nil(t, s.startInternal())
+
+	exchange := func(net string) (*dns.Msg, error) {
+		addr := udp.LocalAddr().String()
+		if net == "tcp" {
+			addr = tcp.Addr().String()
+		}
+		c := dns.Client{Net: net, Timeout: time.Second}
+		reply, _, err := c.Exchange(createTestMessageWithType("socket.example.org.", dns.TypeTXT), addr)
+		return reply, err
+	}
+	for _, n := range []string{"udp", "tcp"} {
+		reply, err := exchange(n)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.n))
+
+	// the requests are dropped while the server is stopped
+	assert.Nil(t, s.Stop())
+	_, err = exchange("udp")
+	assert.NotNil(t, err)
+
+	// the sockets stay open after the server is closed
+	s.Close()
+	assert.Nil(t, s.sockets)
+	s2 := createTestServer(t)
+	s2.dnsFilter.SafeBrowsingEnabled = false
+	s2.conf.Sockets = &Sockets{UDP: []net.PacketConn{udp}, TCP: []net.Listener{tcp}}
+	assert.Nil(t, s2.Prepare(nil))
+	s2.dnsProxy.Upstreams = []upstream.Upstream{u}
+	assert.Nil(t, s2.startInternal())
+	defer s2.Close()
+	defer func() { _ = s2.Stop() }()
+	reply, err := exchange("tcp")
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+}
+
+func TestReload(t *testing.T) {
+	prev := FilteringConfig{UpstreamDNS: []string{"8.8.8.8"}}
+	conf := prev
+	conf.ProtectionEnabled = true
+	conf.BlockedTLDs = []string{"zip"}
+	conf.FilterHandler = func(clientAddr, clientID string, settings *dnsfilter.RequestFilteringSettings) {}
+	assert.False(t, needRestart(prev, conf))
+	conf.Ratelimit = 10
+	assert.True(t, needRestart(prev, conf))
+	conf = prev
+	conf.AllowedClients = []string{}
+	assert.False(t, needRestart(prev, conf))
+
+	s := createTestServer(t)
+	modified := 0
+	s.conf.ConfigModified = func() { modified++ }
+	assert.Nil(t, s.Start())
+	defer func() { _ = s.Stop() }()
+
+	// the settings are applied without restart
+	c := s.conf.FilteringConfig
+	c.BlockingMode = "custom_ip"
+	c.BlockingIPv4 = "1.2.3.4"
+	c.BlockingIPv6 = "::1"
+	p := s.dnsProxy
+	assert.Nil(t, s.Reload(&c))
+	assert.True(t, p == s.dnsProxy)
+	assert.Equal(t, "1.2.3.4", s.conf.BlockingIPAddrv4.String())
+	assert.Equal(t, 0, modified)
+
+	// DNS server is restarted
+	c.RefuseAny = true
+	assert.Nil(t, s.Reload(&c))
+	assert.False(t, p == s.dnsProxy)
+	assert.True(t, s.conf.RefuseAny)
+	assert.True(t, s.IsRunning())
+
+	// invalid settings aren't applied
+	c.BlockingIPv4 = "bad"
+	assert.NotNil(t, s.Reload(&c))
+	assert.Equal(t, "1.2.3.4", s.conf.BlockingIPv4)
+}
+
+func TestTrace(t *testing.T) {
+	assert.Nil(t, checkTraceConfig(TraceConfig{Enabled: true, Clients: []string{"127.0.0.1", "10.0.0.0/8", "phone"}}))
+	assert.NotNil(t, checkTraceConfig(TraceConfig{Enabled: true}))
+	assert.NotNil(t, checkTraceConfig(TraceConfig{Clients: []string{"Phone!"}}))
+	assert.NotNil(t, checkTraceConfig(TraceConfig{Domains: []string{"."}}))
+
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	u := &countingUpstream{}
+	err := s.startWithUpstream(u)
+	assert.Nil(t, err)
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	w := httptest.NewRecorder()
+	s.handleTraceConfigSet(w, httptest.NewRequest("POST", "/control/trace/config/set",
+		strings.NewReader(`{"enabled":true,"clients":["127.0.0.0/8","::1"],"domains":["Example.org."]}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"example.org"}, s.tracer.getConfig().Domains)
+
+	for _, host := range []string{"a.example.org.", "a.example.org.", "nxdomain.example.org.", "example.com."} {
+		_, err = dns.Exchange(createTestMessage(host), addr.String())
+		assert.Nil(t, err)
+	}
+
+	w = httptest.NewRecorder()
+	s.handleTraceList(w, httptest.NewRequest("GET", "/control/trace/list", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := traceListJSON{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 3, len(resp.Traces))
+
+	hasStep := func(tr *queryTrace, stage, msg string) bool {
+		for _, st := range tr.Steps {
+			if st.Stage == stage && strings.Contains(st.Message, msg) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the newest first
+	tr := resp.Traces[0]
+	assert.Equal(t, "nxdomain.example.org", tr.Name)
+	assert.Equal(t, "A", tr.Type)
+	assert.True(t, net.ParseIP(tr.Client).IsLoopback())
+	assert.True(t, hasStep(tr, StageFiltering, `rule "||nxdomain.example.org"`))
+	assert.False(t, hasStep(tr, StageUpstream, "looking up"))
+
+	tr = resp.Traces[1]
+	assert.True(t, hasStep(tr, StageUpstream, "response from cache"))
+	tr = resp.Traces[2]
+	assert.Equal(t, "test", tr.Upstream)
+	assert.Equal(t, "NOERROR", tr.Rcode)
+	assert.True(t, hasStep(tr, StageUpstream, "resolved by upstream server test"))
+	assert.Equal(t, len(DefaultPipeline()), countTraceStages(tr))
+
+	w = httptest.NewRecorder()
+	s.handleTraceClear(w, httptest.NewRequest("POST", "/control/trace/clear", nil))
+	assert.Equal(t, 0, len(s.tracer.list()))
+
+	// the request isn't traced when trace mode is disabled
+	s.tracer.setConfig(TraceConfig{Domains: []string{"example.org"}})
+	_, err = dns.Exchange(createTestMessage("b.example.org."), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(s.tracer.list()))
+}
+
+// Get the number of the stages which have been recorded in the trace
+func countTraceStages(tr *queryTrace) int {
+	stages := map[string]bool{}
+	for _, st := range tr.Steps {
+		stages[st.Stage] = true
+	}
+	return len(stages)
+}
+
+func TestProxyDoHUpstream(t *testing.T) {
+	// DNS-over-HTTPS server
+	accept := make(chan string, 1)
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept <- r.Header.Get("Accept")
+		data, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		req := dns.Msg{}
+		if req.Unpack(data) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := dns.Msg{}
+		resp.SetReply(&req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+			A:   net.IP{1, 2, 3, 4},
+		})
+		buf, _ := resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(buf)
+	}))
+	defer doh.Close()
+
+	// HTTP CONNECT proxy
+	connect := make(chan string, 1)
+	prx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		connect <- r.Host
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = dst.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(dst, conn)
+			_ = dst.Close()
+		}()
+		_, _ = io.Copy(conn, dst)
+		_ = conn.Close()
+	}))
+	defer prx.Close()
+
+	proxyURL, _ := url.Parse(prx.URL)
+	opts := upstream.Options{Timeout: 5 * time.Second}
+	u, err := AddressToUpstream(doh.URL+"/dns-query", opts, proxyURL)
+	assert.Nil(t, err)
+	pu, ok := u.(*proxyDoHUpstream)
+	assert.True(t, ok)
+	pu.client.Transport.(*http.Transport).TLSClientConfig = doh.Client().Transport.(*http.Transport).TLSClientConfig
+
+	resp, err := u.Exchange(createTestMessage("example.org."))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Answer))
+	a, ok := resp.Answer[0].(*dns.A)
+	assert.True(t, ok)
+	assert.Equal(t, "1.2.3.4", a.A.String())
+	assert.Equal(t, doh.Listener.Addr().String(), <-connect)
+	assert.Equal(t, "application/dns-message", <-accept)
+
+	// the other servers and DNS-over-HTTPS without the proxy use dnsproxy's upstream objects
+	u, err = AddressToUpstream("tls://1.1.1.1", opts, proxyURL)
+	assert.Nil(t, err)
+	_, ok = u.(*proxyDoHUpstream)
+	assert.False(t, ok)
+	u, err = AddressToUpstream("https://dns.example.org/dns-query", opts, nil)
+	assert.Nil(t, err)
+	_, ok = u.(*proxyDoHUpstream)
+	assert.False(t, ok)
+	_, err = AddressToUpstream("https:///dns-query", opts, proxyURL)
+	assert.NotNil(t, err)
+}
+
+// Create a self-signed certificate for the DNS names
+func createTestCertificate(t *testing.T, names ...string) ([]byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPem, keyPem
+}
+
+func TestTLSServerNames(t *testing.T) {
+	_, certPem, keyPem := createServerTLSConfig(t)
+	orgCert, orgKey := createTestCertificate(t, "dns.example.org", "*.dns.example.org")
+	comCert, comKey := createTestCertificate(t, "*.example.com")
+
+	s := createTestServer(t)
+	s.conf.TLSConfig = TLSConfig{
+		TLSListenAddr:        &net.TCPAddr{Port: 0},
+		StrictSNICheck:       true,
+		ServerName:           tlsServerName,
+		ClientIDMode:         ClientIDModeSNI,
+		CertificateChainData: certPem,
+		PrivateKeyData:       keyPem,
+		ServerNames: []TLSServerName{
+			{ServerName: "dns.example.org", ClientIDMode: ClientIDModePath, CertificateChainData: orgCert, PrivateKeyData: orgKey},
+			{ServerName: "dns.example.com", CertificateChainData: comCert, PrivateKeyData: comKey},
+		},
+	}
+	assert.Nil(t, s.Prepare(nil))
+	assert.Nil(t, s.Start())
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoTLS).String()
+
+	// the certificate is selected by the server name
+	serverCert := func(sni string) []byte {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: sni})
+		if err != nil {
+			return nil
+		}
+		defer conn.Close()
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: conn.ConnectionState().PeerCertificates[0].Raw})
+	}
+	assert.Equal(t, certPem, serverCert(tlsServerName))
+	assert.Equal(t, orgCert, serverCert("dns.example.org"))
+	assert.Equal(t, orgCert, serverCert("phone.dns.example.org"))
+	assert.Equal(t, comCert, serverCert("phone.dns.example.com"))
+	// the name from the wildcard certificate
+	assert.Equal(t, comCert, serverCert("www.example.com"))
+	// strict SNI check
+	assert.Nil(t, serverCert("unknown.example.net"))
+
+	// ClientID rules of the server names
+	clientID := func(sni, path string) string {
+		r, _ := http.NewRequest("GET", "https://"+sni+path, nil)
+		r.TLS = &tls.ConnectionState{ServerName: sni}
+		return s.clientID(&proxy.DNSContext{Proto: proxy.ProtoHTTPS, HTTPRequest: r})
+	}
+	assert.Equal(t, "", clientID("phone.dns.example.org", "/dns-query"))
+	assert.Equal(t, "tv", clientID("phone.dns.example.org", "/dns-query/tv"))
+	assert.Equal(t, "phone", clientID("phone.dns.example.com", "/dns-query"))
+	assert.Equal(t, "tv", clientID("phone.dns.example.com", "/dns-query/tv"))
+	assert.Equal(t, "phone", clientID("phone."+tlsServerName, "/dns-query/tv"))
+
+	// the server names are replaced without restarting the server
+	assert.Nil(t, s.UpdateServerNames(nil))
+	assert.Nil(t, serverCert("dns.example.org"))
+	assert.Equal(t, certPem, serverCert(tlsServerName))
+	assert.Equal(t, "", clientID("phone.dns.example.com", "/dns-query"))
+
+	_, err := NewTLSCertificates([]TLSServerName{{ServerName: "bad name", CertificateChainData: orgCert, PrivateKeyData: orgKey}})
+	assert.NotNil(t, err)
+	_, err = NewTLSCertificates([]TLSServerName{{ServerName: "dns.example.org", ClientIDMode: "ip", CertificateChainData: orgCert, PrivateKeyData: orgKey}})
+	assert.NotNil(t, err)
+	_, err = NewTLSCertificates([]TLSServerName{{ServerName: "dns.example.org", CertificateChainData: orgCert, PrivateKeyData: comKey}})
+	assert.NotNil(t, err)
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	_, certPem, keyPem := createServerTLSConfig(t)
+
+	// the CA and the client certificate signed by it
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "AdGuard Tests CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	caCert, _ := x509.ParseCertificate(caDer)
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer})
+
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	clientTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Kids Tablet"},
+		DNSNames:     []string{"kids-tablet." + tlsServerName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDer, err := x509.CreateCertificate(rand.Reader, clientTmpl, caCert, &clientKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	clientCert := tls.Certificate{Certificate: [][]byte{clientDer}, PrivateKey: clientKey}
+
+	s := createTestServer(t)
+	s.dnsFilter.SafeBrowsingEnabled = false // don't send requests to the real server
+	s.conf.TLSConfig = TLSConfig{
+		TLSListenAddr:        &net.TCPAddr{Port: 0},
+		ServerName:           tlsServerName,
+		CertificateChainData: certPem,
+		PrivateKeyData:       keyPem,
+		ClientAuth:           true,
+		ClientCAData:         caPem,
+	}
+	var clientID string
+	s.conf.FilterHandler = func(clientAddr, id string, settings *dnsfilter.RequestFilteringSettings) {
+		clientID = id
+	}
+	assert.Nil(t, s.startWithUpstream(&testUpstream{ipv4: testIPv4}))
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoTLS).String()
+
+	exchange := func(certs []tls.Certificate) error {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         tlsServerName,
+			Certificates:       certs,
+		})
+		if err != nil {
+			return err
+		}
+		dc := &dns.Conn{Conn: conn}
+		defer dc.Close()
+		_ = dc.SetDeadline(time.Now().Add(5 * time.Second))
+		req := &dns.Msg{}
+		req.SetQuestion("example.org.", dns.TypeA)
+		err = dc.WriteMsg(req)
+		if err != nil {
+			return err
+		}
+		_, err = dc.ReadMsg()
+		return err
+	}
+
+	// ClientID is taken from the certificate's SAN
+	assert.Nil(t, exchange([]tls.Certificate{clientCert}))
+	assert.Equal(t, "kids-tablet", clientID)
+
+	// the connection without a client certificate is rejected
+	clientID = "?"
+	assert.NotNil(t, exchange(nil))
+	assert.Equal(t, "?", clientID)
+
+	// the certificate names which can't be used as ClientID
+	state := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "phone"}}}}}
+	assert.Equal(t, "phone", s.clientIDFromCertificate(state))
+	state.VerifiedChains[0][0] = &x509.Certificate{DNSNames: []string{"phone.example.org"}}
+	assert.Equal(t, "", s.clientIDFromCertificate(state))
+	assert.Equal(t, "", s.clientIDFromCertificate(&tls.ConnectionState{}))
+
+	_, err = ParseClientCAs([]byte("invalid"))
+	assert.NotNil(t, err)
+}
+
+func TestDoHPaths(t *testing.T) {
+	assert.Nil(t, CheckDoHPaths("", nil))
+	assert.Nil(t, CheckDoHPaths("/resolve", []DoHEndpoint{{Path: "/resolve/kids", ClientID: "kids"}}))
+	assert.NotNil(t, CheckDoHPaths("resolve", nil))
+	assert.NotNil(t, CheckDoHPaths("/resolve/", nil))
+	assert.NotNil(t, CheckDoHPaths("/a//b", nil))
+	assert.NotNil(t, CheckDoHPaths("/dns.query", nil))
+	assert.NotNil(t, CheckDoHPaths("/control/dns", nil))
+	assert.NotNil(t, CheckDoHPaths("", []DoHEndpoint{{Path: "/dns-query", ClientID: "kids"}}))
+	assert.NotNil(t, CheckDoHPaths("", []DoHEndpoint{{Path: "/kids", ClientID: "Kids"}}))
+
+	endpoints := []DoHEndpoint{{Path: "/dns-query/kids", ClientID: "kids"}, {Path: "/family", ClientID: "family"}}
+	base, id := matchDoHPath("/dns-query/kids/tablet", "", endpoints)
+	assert.Equal(t, "/dns-query/kids", base)
+	assert.Equal(t, "kids", id)
+	base, id = matchDoHPath("/dns-query/phone", "", endpoints)
+	assert.Equal(t, "/dns-query", base)
+	assert.Equal(t, "", id)
+	assert.True(t, IsDoHPath("/family", "", endpoints))
+	assert.False(t, IsDoHPath("/dns-query-x", "", endpoints))
+	assert.False(t, IsDoHPath("/dns-query", "/resolve", nil))
+
+	s := createTestServer(t)
+	s.conf.ServerName = "dns.example.org"
+	s.conf.DoHEndpoints = endpoints
+	clientID := func(path string) string {
+		r, _ := http.NewRequest("GET", "https://dns.example.org"+path, nil)
+		return s.clientID(&proxy.DNSContext{Proto: proxy.ProtoHTTPS, HTTPRequest: r})
+	}
+	assert.Equal(t, "kids", clientID("/dns-query/kids"))
+	assert.Equal(t, "tablet", clientID("/dns-query/kids/tablet"))
+	assert.Equal(t, "family", clientID("/family"))
+	assert.Equal(t, "phone", clientID("/dns-query/phone"))
+	assert.Equal(t, "", clientID("/dns-query"))
+
+	// the requests with unknown paths are dropped
+	req := &dns.Msg{}
+	req.SetQuestion("example.org.", dns.TypeA)
+	r, _ := http.NewRequest("GET", "https://dns.example.org/unknown", nil)
+	d := &proxy.DNSContext{Proto: proxy.ProtoHTTPS, HTTPRequest: r, Req: req, Addr: &net.TCPAddr{IP: net.IP{127, 0, 0, 1}}}
+	ok, err := s.beforeRequestHandler(nil, d)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	r.URL.Path = "/family"
+	ok, _ = s.beforeRequestHandler(nil, d)
+	assert.True(t, ok)
+}
@@ -0,0 +1,737 @@
+// DNSSEC validation
+
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// DNSSEC validation status of a response
+const (
+	DNSSECSecure   = "secure"   // the response is signed and the chain of trust is valid
+	DNSSECInsecure = "insecure" // the domain isn't signed: there's a proof of it from the signed parent zone
+	DNSSECBogus    = "bogus"    // the validation failed
+)
+
+// The root zone trust anchor (KSK-2017)
+const dnssecRootAnchor = ". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+const (
+	dnssecMaxKeysTTL = 24 * 60 * 60 // the maximum time (in seconds) the validated keys are stored in cache
+	dnssecMaxKeys    = 10000        // the maximum number of zones in cache
+)
+
+// The validated state of a zone
+type dnssecZone struct {
+	keys     []*dns.DNSKEY // the validated keys (nil if the zone is insecure)
+	insecure bool
+	expire   time.Time
+}
+
+type dnssecValidator struct {
+	exchange func(req *dns.Msg) (*dns.Msg, error) // send a request to upstream servers
+	anchors  []*dns.DS
+
+	lock  sync.Mutex
+	zones map[string]*dnssecZone // by zone name (lowercase, with the trailing dot)
+}
+
+func newDNSSECValidator(exchange func(req *dns.Msg) (*dns.Msg, error)) *dnssecValidator {
+	v := &dnssecValidator{
+		exchange: exchange,
+		zones:    map[string]*dnssecZone{},
+	}
+	rr, _ := dns.NewRR(dnssecRootAnchor)
+	v.anchors = []*dns.DS{rr.(*dns.DS)}
+	return v
+}
+
+// Send a request for DNSSEC records to upstream servers
+func (v *dnssecValidator) query(name string, qtype uint16) (*dns.Msg, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(4096, true)
+	resp, err := v.exchange(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s %s: %s", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// Set of resource records with the same owner name, class and type
+type rrset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// Group resource records by sets.  DNSSEC signatures are added to the sets they cover.
+func makeRRSets(rrs []dns.RR) []*rrset {
+	sets := []*rrset{}
+	byKey := map[string]*rrset{}
+	get := func(name string, class, qtype uint16) *rrset {
+		key := fmt.Sprintf("%s %d %d", strings.ToLower(name), class, qtype)
+		set, ok := byKey[key]
+		if !ok {
+			set = &rrset{}
+			byKey[key] = set
+			sets = append(sets, set)
+		}
+		return set
+	}
+
+	for _, rr := range rrs {
+		h := rr.Header()
+		sig, ok := rr.(*dns.RRSIG)
+		if ok {
+			set := get(h.Name, h.Class, sig.TypeCovered)
+			set.sigs = append(set.sigs, sig)
+			continue
+		}
+		set := get(h.Name, h.Class, h.Rrtype)
+		set.rrs = append(set.rrs, rr)
+	}
+
+	// remove the signatures without records
+	result := sets[:0]
+	for _, set := range sets {
+		if len(set.rrs) != 0 {
+			result = append(result, set)
+		}
+	}
+	return result
+}
+
+// Return TRUE if the set is signed by one of the keys
+func (set *rrset) verify(keys []*dns.DNSKEY, now time.Time) bool {
+	return set.validSig(keys, now) != nil
+}
+
+// Get the signature of the set made by one of the keys;  nil if there's no valid signature
+// The number of labels in the signature can't be greater than the number of labels in the owner name (RFC 4035 5.3.1).
+func (set *rrset) validSig(keys []*dns.DNSKEY, now time.Time) *dns.RRSIG {
+	labels := ownerLabels(set.rrs[0].Header().Name)
+	for _, sig := range set.sigs {
+		if !sig.ValidityPeriod(now) || int(sig.Labels) > labels {
+			continue
+		}
+		for _, key := range keys {
+			if key.Algorithm == sig.Algorithm && key.KeyTag() == sig.KeyTag &&
+				strings.EqualFold(key.Hdr.Name, sig.SignerName) &&
+				sig.Verify(key, set.rrs) == nil {
+				return sig
+			}
+		}
+	}
+	return nil
+}
+
+// Get the number of labels in the owner name as it's counted in RRSIG record: the wildcard label isn't counted
+func ownerLabels(name string) int {
+	n := dns.CountLabel(name)
+	if strings.HasPrefix(name, "*.") {
+		n--
+	}
+	return n
+}
+
+// Get the next closer name of the wildcard expansion: the closest encloser (the wildcard name without "*")
+// with one more label of the owner name.  E.g. "a.b.example.org." signed by "*.example.org." -> "b.example.org."
+func nextCloserName(name string, sigLabels uint8) string {
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-int(sigLabels)-1:], "."))
+}
+
+// Get the name of the zone that signed the set (lowercase)
+func (set *rrset) signer() string {
+	if len(set.sigs) == 0 {
+		return ""
+	}
+	return strings.ToLower(set.sigs[0].SignerName)
+}
+
+// Get TTL of the set for storing in cache
+func (set *rrset) ttl() uint32 {
+	ttl := uint32(dnssecMaxKeysTTL)
+	for _, rr := range set.rrs {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+func (v *dnssecValidator) getZone(zone string, now time.Time) *dnssecZone {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	z, ok := v.zones[zone]
+	if !ok || now.After(z.expire) {
+		return nil
+	}
+	return z
+}
+
+func (v *dnssecValidator) setZone(zone string, z *dnssecZone) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if len(v.zones) >= dnssecMaxKeys {
+		v.zones = map[string]*dnssecZone{}
+	}
+	v.zones[zone] = z
+}
+
+// Find the validated keys of the zone whose DS records are in the set
+func (v *dnssecValidator) validateKeys(zone string, ds []*dns.DS, now time.Time) (*dnssecZone, error) {
+	resp, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range makeRRSets(resp.Answer) {
+		if set.rrs[0].Header().Rrtype != dns.TypeDNSKEY || !strings.EqualFold(set.rrs[0].Header().Name, zone) {
+			continue
+		}
+
+		keys := []*dns.DNSKEY{}
+		sepKeys := []*dns.DNSKEY{} // the keys which match DS records
+		for _, rr := range set.rrs {
+			key := rr.(*dns.DNSKEY)
+			keys = append(keys, key)
+			for _, d := range ds {
+				if d.KeyTag != key.KeyTag() || d.Algorithm != key.Algorithm {
+					continue
+				}
+				kds := key.ToDS(d.DigestType)
+				if kds != nil && strings.EqualFold(kds.Digest, d.Digest) {
+					sepKeys = append(sepKeys, key)
+				}
+			}
+		}
+		if !set.verify(sepKeys, now) {
+			return nil, fmt.Errorf("%s: DNSKEY records aren't signed by a key matching DS record", zone)
+		}
+		return &dnssecZone{keys: keys, expire: now.Add(time.Duration(set.ttl()) * time.Second)}, nil
+	}
+	return nil, fmt.Errorf("%s: no DNSKEY records", zone)
+}
+
+// Get the validated state of the zone
+// Its DS records are validated with the keys of the parent zone up to the root trust anchor.
+func (v *dnssecValidator) zoneState(zone string, now time.Time) (*dnssecZone, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	z := v.getZone(zone, now)
+	if z != nil {
+		return z, nil
+	}
+
+	var err error
+	if zone == "." {
+		z, err = v.validateKeys(zone, v.anchors, now)
+		if err != nil {
+			return nil, err
+		}
+		v.setZone(zone, z)
+		return z, nil
+	}
+
+	resp, err := v.query(zone, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, set := range makeRRSets(resp.Answer) {
+		if set.rrs[0].Header().Rrtype != dns.TypeDS || !strings.EqualFold(set.rrs[0].Header().Name, zone) {
+			continue
+		}
+		parent := set.signer()
+		if len(parent) == 0 || parent == zone || !dns.IsSubDomain(parent, zone) {
+			return nil, fmt.Errorf("%s: DS records aren't signed by the parent zone", zone)
+		}
+		pz, err := v.zoneState(parent, now)
+		if err != nil {
+			return nil, err
+		}
+		if pz.insecure {
+			z = &dnssecZone{insecure: true, expire: pz.expire}
+			v.setZone(zone, z)
+			return z, nil
+		}
+		if !set.verify(pz.keys, now) {
+			return nil, fmt.Errorf("%s: DS records: invalid signature", zone)
+		}
+
+		ds := []*dns.DS{}
+		for _, rr := range set.rrs {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		z, err = v.validateKeys(zone, ds, now)
+		if err != nil {
+			return nil, err
+		}
+		v.setZone(zone, z)
+		return z, nil
+	}
+
+	// there are no DS records: the zone is insecure if it's proven by its parent
+	insecure, ttl, err := v.denial(resp, zone, now)
+	if err != nil {
+		return nil, err
+	}
+	if !insecure {
+		return nil, fmt.Errorf("%s: no DS records", zone)
+	}
+	z = &dnssecZone{insecure: true, expire: now.Add(time.Duration(ttl) * time.Second)}
+	v.setZone(zone, z)
+	return z, nil
+}
+
+// Check the negative response to the request for a name inside a zone cut which has no DS records
+// Return TRUE if the name is insecure: the response is unsigned and the zone that sent it is insecure,
+// or the zone that sent it proves that the name is a delegation without DS records.
+func (v *dnssecValidator) denial(resp *dns.Msg, name string, now time.Time) (bool, uint32, error) {
+	zone := ""
+	for _, rr := range resp.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if ok {
+			zone = strings.ToLower(soa.Hdr.Name)
+			break
+		}
+	}
+	// the response must be sent by the parent zone
+	if len(zone) == 0 || zone == name || !dns.IsSubDomain(zone, name) {
+		return false, 0, fmt.Errorf("%s: invalid negative response", name)
+	}
+
+	sets := makeRRSets(resp.Ns)
+	signed := false
+	for _, set := range sets {
+		if len(set.sigs) != 0 {
+			signed = true
+		}
+	}
+
+	z, err := v.zoneState(zone, now)
+	if err != nil {
+		return false, 0, err
+	}
+	if z.insecure {
+		return true, uint32(time.Until(z.expire) / time.Second), nil
+	}
+	if !signed {
+		return false, 0, fmt.Errorf("%s: unsigned response from the secure zone %s", name, zone)
+	}
+
+	ttl := uint32(dnssecMaxKeysTTL)
+	var nsec []*dns.NSEC
+	var nsec3 []*dns.NSEC3
+	for _, set := range sets {
+		if !set.verify(z.keys, now) {
+			return false, 0, fmt.Errorf("%s: invalid signature", name)
+		}
+		if set.ttl() < ttl {
+			ttl = set.ttl()
+		}
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsec = append(nsec, rr)
+			case *dns.NSEC3:
+				nsec3 = append(nsec3, rr)
+			}
+		}
+	}
+
+	for _, n := range nsec {
+		if strings.EqualFold(n.Hdr.Name, name) {
+			// the name exists: it's an insecure delegation if there are NS records, but no DS records
+			return hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeDS) && !hasType(n.TypeBitMap, dns.TypeSOA),
+				ttl, nil
+		}
+	}
+	for _, n := range nsec3 {
+		if n.Match(name) {
+			return hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeDS) && !hasType(n.TypeBitMap, dns.TypeSOA),
+				ttl, nil
+		}
+	}
+	for _, n := range nsec3 {
+		// opt-out: the unsigned delegations aren't listed
+		if n.Flags&1 != 0 && n.Cover(name) {
+			return true, ttl, nil
+		}
+	}
+	return false, ttl, nil
+}
+
+// Check the proof of non-existence of a name or a type in negative response
+func verifyDenial(resp *dns.Msg, name string, qtype uint16) bool {
+	var nsec []*dns.NSEC
+	var nsec3 []*dns.NSEC3
+	for _, rr := range resp.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsec = append(nsec, rr)
+		case *dns.NSEC3:
+			nsec3 = append(nsec3, rr)
+		}
+	}
+
+	if resp.Rcode == dns.RcodeSuccess {
+		// NODATA: the name exists, but there are no records of this type
+		for _, n := range nsec {
+			if strings.EqualFold(n.Hdr.Name, name) {
+				return !hasType(n.TypeBitMap, qtype) && !hasType(n.TypeBitMap, dns.TypeCNAME)
+			}
+		}
+		for _, n := range nsec3 {
+			if n.Match(name) {
+				return !hasType(n.TypeBitMap, qtype) && !hasType(n.TypeBitMap, dns.TypeCNAME)
+			}
+		}
+		// the name may be covered by an opt-out range
+		for _, n := range nsec3 {
+			if n.Flags&1 != 0 && n.Cover(name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// NXDOMAIN: the name is covered by NSEC record
+	for _, n := range nsec {
+		if nsecCovers(n, name) {
+			return true
+		}
+	}
+	// NXDOMAIN: the closest encloser exists and the next closer name is covered by NSEC3 record
+	next := strings.ToLower(name)
+	for encloser := parentName(next); ; encloser = parentName(encloser) {
+		for _, m := range nsec3 {
+			if !m.Match(encloser) {
+				continue
+			}
+			for _, c := range nsec3 {
+				if c.Cover(next) {
+					return true
+				}
+			}
+			return false
+		}
+		if encloser == "." {
+			break
+		}
+		next = encloser
+	}
+	return false
+}
+
+// Check the proof that the name doesn't exist in the zone, so that the wildcard expansion is correct (RFC 4035 5.3.4)
+// The name must be covered by NSEC record, or the next closer name must be covered by NSEC3 record (RFC 5155 8.8).
+func verifyWildcard(resp *dns.Msg, name, nextCloser string) bool {
+	for _, rr := range resp.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if nsecCovers(rr, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if rr.Cover(nextCloser) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Compare domain names in canonical order (RFC 4034 6.1)
+// Return -1 if a < b, 0 if a == b, 1 if a > b
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		c := strings.Compare(la[len(la)-i], lb[len(lb)-i])
+		if c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(la) < len(lb):
+		return -1
+	case len(la) > len(lb):
+		return 1
+	}
+	return 0
+}
+
+// Return TRUE if the name is between the owner name and the next name of NSEC record
+func nsecCovers(n *dns.NSEC, name string) bool {
+	owner := canonicalCompare(n.Hdr.Name, name)
+	next := canonicalCompare(name, n.NextDomain)
+	if canonicalCompare(n.Hdr.Name, n.NextDomain) < 0 {
+		return owner < 0 && next < 0
+	}
+	// the last record in the zone: the next name is the zone apex
+	return owner < 0 || next < 0
+}
+
+// Return TRUE if there are records of this type for the name
+func hasRecords(rrs []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype && strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, tt := range types {
+		if tt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the name of the parent domain: "sub.example.org." -> "example.org."
+func parentName(name string) string {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+// Find the closest zone containing the name and check whether it's insecure
+func (v *dnssecValidator) isInsecure(name string, now time.Time) (bool, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+	// all subdomains of an insecure zone are insecure,
+	//  but a subdomain of a secure zone may be an insecure delegation
+	for zone := name; ; zone = parentName(zone) {
+		z := v.getZone(zone, now)
+		if z != nil && (z.insecure || zone == name) {
+			return z.insecure, nil
+		}
+		if zone == "." {
+			break
+		}
+	}
+
+	resp, err := v.query(name, dns.TypeDS)
+	if err != nil {
+		return false, err
+	}
+	for _, set := range makeRRSets(resp.Answer) {
+		if set.rrs[0].Header().Rrtype == dns.TypeDS {
+			// the name is a signed zone
+			z, err := v.zoneState(name, now)
+			if err != nil {
+				return false, err
+			}
+			return z.insecure, nil
+		}
+	}
+	insecure, _, err := v.denial(resp, name, now)
+	return insecure, err
+}
+
+// Validate the response
+// Return the validation status and the error (for bogus responses).
+// Return an empty string if the response can't be validated.
+func (v *dnssecValidator) validate(resp *dns.Msg, now time.Time) (string, error) {
+	if len(resp.Question) != 1 || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return "", nil
+	}
+	q := resp.Question[0]
+
+	// the name at the end of CNAME chain
+	name := q.Name
+	dname := false
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			if strings.EqualFold(rr.Hdr.Name, name) {
+				name = rr.Target
+			}
+		case *dns.DNAME:
+			dname = true
+		}
+	}
+
+	status := DNSSECSecure
+	signed := false
+	wildcards := map[string]string{} // the owner names of the wildcard expansions -> next closer names
+	for _, set := range makeRRSets(append(append([]dns.RR{}, resp.Answer...), resp.Ns...)) {
+		h := set.rrs[0].Header()
+		if len(set.sigs) == 0 {
+			if h.Rrtype == dns.TypeNS && len(resp.Answer) != 0 {
+				continue // unsigned NS records in authority section
+			}
+			if h.Rrtype == dns.TypeCNAME && dname {
+				continue // CNAME synthesized from the signed DNAME record
+			}
+			insecure, err := v.isInsecure(h.Name, now)
+			if err != nil {
+				return DNSSECBogus, err
+			}
+			if !insecure {
+				return DNSSECBogus, fmt.Errorf("%s %s: no signature", h.Name, dns.TypeToString[h.Rrtype])
+			}
+			status = DNSSECInsecure
+			continue
+		}
+		signed = true
+
+		signer := set.signer()
+		if !dns.IsSubDomain(signer, strings.ToLower(h.Name)) {
+			return DNSSECBogus, fmt.Errorf("%s %s: signed by %s", h.Name, dns.TypeToString[h.Rrtype], signer)
+		}
+		z, err := v.zoneState(signer, now)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if z.insecure {
+			status = DNSSECInsecure
+			continue
+		}
+		sig := set.validSig(z.keys, now)
+		if sig == nil {
+			return DNSSECBogus, fmt.Errorf("%s %s: invalid signature", h.Name, dns.TypeToString[h.Rrtype])
+		}
+		if int(sig.Labels) < ownerLabels(h.Name) {
+			wildcards[h.Name] = nextCloserName(h.Name, sig.Labels)
+		}
+	}
+
+	if !signed {
+		// no records or no signatures at all
+		insecure, err := v.isInsecure(q.Name, now)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if !insecure {
+			return DNSSECBogus, fmt.Errorf("%s: unsigned response", q.Name)
+		}
+		return DNSSECInsecure, nil
+	}
+
+	for owner, nextCloser := range wildcards {
+		if !verifyWildcard(resp, owner, nextCloser) {
+			return DNSSECBogus, fmt.Errorf("%s: wildcard expansion without proof of non-existence", owner)
+		}
+	}
+
+	negative := resp.Rcode == dns.RcodeNameError || strings.EqualFold(name, q.Name) && len(resp.Answer) == 0 ||
+		!strings.EqualFold(name, q.Name) && !hasRecords(resp.Answer, name, q.Qtype)
+	if status == DNSSECSecure && negative && !verifyDenial(resp, name, q.Qtype) {
+		return DNSSECBogus, fmt.Errorf("%s: no proof of non-existence", name)
+	}
+	return status, nil
+}
+
+// Remove DNSSEC records from the response for the client that didn't request them
+func removeDNSSECRecords(resp *dns.Msg) {
+	qtype := uint16(0)
+	if len(resp.Question) == 1 {
+		qtype = resp.Question[0].Qtype
+	}
+	filter := func(rrs []dns.RR) []dns.RR {
+		result := rrs[:0]
+		for _, rr := range rrs {
+			t := rr.Header().Rrtype
+			if t != qtype && (t == dns.TypeRRSIG || t == dns.TypeNSEC || t == dns.TypeNSEC3) {
+				continue
+			}
+			result = append(result, rr)
+		}
+		return result
+	}
+	resp.Answer = filter(resp.Answer)
+	resp.Ns = filter(resp.Ns)
+	resp.Extra = filter(resp.Extra)
+}
+
+// Set DO bit in the request for upstream servers;  return the original EDNS0 settings
+func setDO(req *dns.Msg) (hasOPT bool, do bool) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(4096, true)
+		return false, false
+	}
+	do = opt.Do()
+	opt.SetDo()
+	return true, do
+}
+
+// Restore EDNS0 settings of the request and the response
+func restoreDO(req, resp *dns.Msg, hasOPT bool, do bool) {
+	if !hasOPT {
+		removeOPT(req)
+		if resp != nil {
+			removeOPT(resp)
+		}
+		return
+	}
+	if do {
+		return
+	}
+	req.IsEdns0().SetDo(false)
+	if resp != nil {
+		opt := resp.IsEdns0()
+		if opt != nil {
+			opt.SetDo(false)
+		}
+	}
+}
+
+func removeOPT(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
+
+// Validate the response from upstream servers
+// Bogus response is replaced with SERVFAIL unless the client has disabled the validation (CD bit).
+func (s *Server) validateDNSSEC(ctx *dnsContext, clientDO bool) {
+	d := ctx.proxyCtx
+	var err error
+	ctx.dnssec, err = s.dnssec.validate(d.Res, time.Now())
+	if ctx.dnssec == DNSSECBogus {
+		log.Debug("DNSSEC: %s: bogus: %s", d.Req.Question[0].Name, err)
+		if !d.Req.CheckingDisabled {
+			ctx.origResp = d.Res
+			d.Res = s.genServerFailure(d.Req)
+		}
+	}
+
+	d.Res.AuthenticatedData = ctx.dnssec == DNSSECSecure && (clientDO || d.Req.AuthenticatedData)
+	if !clientDO {
+		removeDNSSECRecords(d.Res)
+	}
+}
+
+// Send internal request to upstream servers
+func (s *Server) exchangeDNSSEC(req *dns.Msg) (*dns.Msg, error) {
+	ctx := &proxy.DNSContext{
+		Proto:     "udp",
+		Req:       req,
+		StartTime: time.Now(),
+	}
+	err := s.dnsProxy.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.Res, nil
+}
@@ -0,0 +1,97 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DoHEndpoint is an additional path of DNS-over-HTTPS requests
+type DoHEndpoint struct {
+	// The path, e.g. "/dns-query/kids"
+	// The clients may use "<path>/clientid" to identify themselves.
+	Path string `yaml:"path" json:"path"`
+
+	// ClientID of the requests without ClientID
+	// The settings of the persistent client with this ClientID are applied.
+	ClientID string `yaml:"client_id" json:"client_id"`
+}
+
+// Check the path of DNS-over-HTTPS requests
+// The path consists of segments with letters, digits, '-' and '_'.
+// It can't be under "/control": the paths of HTTP API.
+func checkDoHPath(path string) error {
+	if len(path) < 2 || path[0] != '/' || path[len(path)-1] == '/' {
+		return fmt.Errorf("invalid path: %q", path)
+	}
+	for _, seg := range strings.Split(path[1:], "/") {
+		if len(seg) == 0 {
+			return fmt.Errorf("invalid path: %q", path)
+		}
+		for _, c := range seg {
+			if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_') {
+				return fmt.Errorf("invalid path: %q", path)
+			}
+		}
+	}
+	if path == "/control" || strings.HasPrefix(path, "/control/") {
+		return fmt.Errorf("path %q is reserved", path)
+	}
+	return nil
+}
+
+// CheckDoHPaths returns an error if the main path or the endpoints are invalid
+// mainPath: the path of DNS-over-HTTPS requests.  Empty: "/dns-query"
+func CheckDoHPaths(mainPath string, endpoints []DoHEndpoint) error {
+	if len(mainPath) == 0 {
+		mainPath = dohPath
+	}
+	err := checkDoHPath(mainPath)
+	if err != nil {
+		return err
+	}
+	paths := map[string]bool{mainPath: true}
+	for _, ep := range endpoints {
+		err = checkDoHPath(ep.Path)
+		if err != nil {
+			return err
+		}
+		if paths[ep.Path] {
+			return fmt.Errorf("duplicate path: %q", ep.Path)
+		}
+		paths[ep.Path] = true
+		if !IsValidClientID(ep.ClientID) {
+			return fmt.Errorf("%s: invalid ClientID: %q", ep.Path, ep.ClientID)
+		}
+	}
+	return nil
+}
+
+// Find the base path of DNS-over-HTTPS request: the main path or the endpoint's path
+// The request path is the base path itself or a path under it ("<base path>/clientid").
+// The longest base path is used: "/dns-query/kids/tablet" matches "/dns-query/kids" endpoint rather than "/dns-query".
+// Return an empty string if the path doesn't match; defaultID: the endpoint's ClientID.
+func matchDoHPath(path, mainPath string, endpoints []DoHEndpoint) (base, defaultID string) {
+	if len(mainPath) == 0 {
+		mainPath = dohPath
+	}
+	match := func(b string) bool {
+		return len(b) > len(base) && (path == b || strings.HasPrefix(path, b+"/"))
+	}
+	if match(mainPath) {
+		base = mainPath
+	}
+	for _, ep := range endpoints {
+		if match(ep.Path) {
+			base = ep.Path
+			defaultID = ep.ClientID
+		}
+	}
+	return base, defaultID
+}
+
+// IsDoHPath returns TRUE if the requests with this path are DNS-over-HTTPS requests
+// mainPath: the path of DNS-over-HTTPS requests.  Empty: "/dns-query"
+func IsDoHPath(path, mainPath string, endpoints []DoHEndpoint) bool {
+	base, _ := matchDoHPath(path, mainPath, endpoints)
+	return len(base) != 0
+}
@@ -0,0 +1,218 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// EDNS Client Subnet modes
+const (
+	ecsModeAuto    = "auto"    // pass the client's option or add the client's public IP subnet (dnsproxy's behaviour)
+	ecsModeForward = "forward" // pass the client's option as is, don't add anything
+	ecsModeStrip   = "strip"   // remove the option
+	ecsModeCustom  = "custom"  // replace the option with the configured subnet
+)
+
+// ECSUpstreamConfig - EDNS Client Subnet settings for an upstream server
+// They override the global settings for the requests sent to this upstream server.
+type ECSUpstreamConfig struct {
+	Upstream string `yaml:"upstream" json:"upstream"` // upstream address as it's written in upstream_dns
+	Mode     string `yaml:"mode" json:"mode"`         // "forward", "strip" or "custom"
+	Subnet   string `yaml:"subnet" json:"subnet"`     // subnet for "custom" mode, e.g. "1.2.3.0/24"
+}
+
+// Parse ECS subnet value
+func parseECSSubnet(s string) (*net.IPNet, error) {
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		ip = net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid subnet: %s", s)
+		}
+		n := 128
+		if ip.To4() != nil {
+			n = 32
+		}
+		ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(n, n)}
+	}
+	if ip.To4() != nil {
+		ipnet.IP = ipnet.IP.To4()
+	}
+	return ipnet, nil
+}
+
+// Check the mode and get the subnet for "custom" mode
+// forUpstream: the settings for an upstream server ("auto" mode isn't allowed)
+func checkECSMode(mode, subnet string, forUpstream bool) (*net.IPNet, error) {
+	switch mode {
+	case ecsModeForward, ecsModeStrip:
+		return nil, nil
+
+	case ecsModeCustom:
+		ipnet, err := parseECSSubnet(subnet)
+		if err != nil {
+			return nil, err
+		}
+		return ipnet, nil
+
+	case "", ecsModeAuto:
+		if !forUpstream {
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid EDNS Client Subnet mode: %s", mode)
+}
+
+// Check the ECS settings
+func checkECSConfig(mode, subnet string, upstreams []ECSUpstreamConfig) error {
+	_, err := checkECSMode(mode, subnet, false)
+	if err != nil {
+		return err
+	}
+	for _, u := range upstreams {
+		if len(u.Upstream) == 0 {
+			return fmt.Errorf("EDNS Client Subnet: upstream address is required")
+		}
+		_, err = checkECSMode(u.Mode, u.Subnet, true)
+		if err != nil {
+			return fmt.Errorf("EDNS Client Subnet: %s: %s", u.Upstream, err)
+		}
+	}
+	return nil
+}
+
+// Get EDNS Client Subnet option from the message
+func getECS(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, e := range opt.Option {
+		sn, ok := e.(*dns.EDNS0_SUBNET)
+		if ok {
+			return sn
+		}
+	}
+	return nil
+}
+
+// Remove EDNS Client Subnet option from the message
+func removeECS(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := []dns.EDNS0{}
+	for _, e := range opt.Option {
+		if _, ok := e.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, e)
+		}
+	}
+	opt.Option = options
+}
+
+// Replace EDNS Client Subnet option in the message
+func setECS(m *dns.Msg, ipnet *net.IPNet) {
+	removeECS(m)
+
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	n, _ := ipnet.Mask.Size()
+	e.SourceNetmask = uint8(n)
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		e.Family = 1
+		e.Address = ip4.Mask(ipnet.Mask)
+	} else {
+		e.Family = 2
+		e.Address = ipnet.IP.Mask(ipnet.Mask)
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = &dns.OPT{}
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		opt.SetUDPSize(4096)
+		m.Extra = append(m.Extra, opt)
+	}
+	opt.Option = append(opt.Option, e)
+}
+
+// Apply the global ECS mode to the request
+// Return TRUE if dnsproxy mustn't add the client's IP subnet to the request
+func (s *Server) prepareECS(req *dns.Msg) bool {
+	switch s.conf.EDNSClientSubnetMode {
+	case ecsModeForward:
+		return true
+
+	case ecsModeStrip:
+		removeECS(req)
+		return true
+
+	case ecsModeCustom:
+		setECS(req, s.conf.ecsSubnet)
+		return true
+	}
+	return false
+}
+
+// Pass the request to upstream servers, applying the forwarding zones and the ECS settings
+func (s *Server) resolve(d *proxy.DNSContext) error {
+	z := s.findForwardZone(d.Req.Question[0].Name)
+	if z != nil {
+		return s.resolveZone(z, d)
+	}
+
+	if s.conf.EnableEDNSClientSubnet && s.prepareECS(d.Req) {
+		// dnsproxy adds the client's IP subnet if the request has no ECS option
+		// and it uses the client address to do so
+		addr := d.Addr
+		d.Addr = nil
+		defer func() { d.Addr = addr }()
+	}
+	return s.resolveWithCache(d)
+}
+
+// Upstream server with its own ECS settings
+type ecsUpstream struct {
+	upstream.Upstream
+	subnet *net.IPNet // nil: remove the option
+}
+
+// Exchange - modify ECS option in the request and pass it to the upstream server
+// The ECS option is removed from the response so that dnsproxy stores it in cache for all client subnets:
+// the response doesn't depend on the client's subnet.
+func (u *ecsUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	req := m.Copy()
+	if u.subnet != nil {
+		setECS(req, u.subnet)
+	} else {
+		removeECS(req)
+	}
+	resp, err := u.Upstream.Exchange(req)
+	if resp != nil {
+		removeECS(resp)
+	}
+	return resp, err
+}
+
+// Get the function that creates upstream objects with their ECS settings
+func (s *Server) ecsAddressToUpstream() proxy.AddressToUpstreamFunction {
+	return func(address string, opts upstream.Options) (upstream.Upstream, error) {
+		u, err := AddressToUpstream(address, opts, s.conf.UpstreamProxy)
+		if err != nil || !s.conf.EnableEDNSClientSubnet {
+			return u, err
+		}
+		for _, c := range s.conf.EDNSClientSubnetUpstreams {
+			if c.Upstream != address || c.Mode == ecsModeForward {
+				continue
+			}
+			subnet, _ := checkECSMode(c.Mode, c.Subnet, true)
+			return &ecsUpstream{Upstream: u, subnet: subnet}, nil
+		}
+		return u, nil
+	}
+}
@@ -0,0 +1,129 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/utils"
+)
+
+// ForwardZone - conditional forwarding settings for a DNS zone
+// The requests for the zone and its subdomains are passed to the zone's upstream servers only.
+type ForwardZone struct {
+	Zone      string   `yaml:"zone" json:"zone"`           // e.g. "corp.example.com"
+	Upstreams []string `yaml:"upstreams" json:"upstreams"` // e.g. "10.0.0.53"
+}
+
+// Check the conditional forwarding settings
+func checkForwardZones(zones []ForwardZone) error {
+	names := map[string]bool{}
+	for _, z := range zones {
+		name := strings.ToLower(strings.TrimSuffix(z.Zone, "."))
+		err := utils.IsValidHostname(name)
+		if err != nil {
+			return fmt.Errorf("invalid forwarding zone %s: %s", z.Zone, err)
+		}
+		if names[name] {
+			return fmt.Errorf("duplicate forwarding zone: %s", z.Zone)
+		}
+		names[name] = true
+
+		if len(z.Upstreams) == 0 {
+			return fmt.Errorf("forwarding zone %s: no upstream servers", z.Zone)
+		}
+		for _, u := range z.Upstreams {
+			d, err := validateUpstream(u)
+			if err != nil || !d {
+				return fmt.Errorf("forwarding zone %s: wrong upstream specification: %s", z.Zone, u)
+			}
+		}
+	}
+	return nil
+}
+
+// Runtime data of a forwarding zone
+type forwardZone struct {
+	name      string // lowercase, with the trailing dot
+	upstreams []upstream.Upstream
+
+	// The responses from the zone's servers are stored here and never in the general cache
+	cache *optimisticCache
+}
+
+// Create the runtime objects for the forwarding zones
+// The returned map is keyed by the zone name in lowercase with the trailing dot.
+func (s *Server) prepareForwardZones(addrs map[upstream.Upstream]string) (map[string]*forwardZone, error) {
+	err := checkForwardZones(s.conf.ForwardZones)
+	if err != nil {
+		return nil, err
+	}
+
+	zones := map[string]*forwardZone{}
+	for _, z := range s.conf.ForwardZones {
+		conf, err := proxy.ParseUpstreamsConfigEx(z.Upstreams, s.conf.BootstrapDNS, DefaultTimeout,
+			s.addressToUpstream(addrs))
+		if err != nil {
+			return nil, fmt.Errorf("forwarding zone %s: proxy.ParseUpstreamsConfigEx: %s", z.Zone, err)
+		}
+
+		fz := &forwardZone{
+			name:      strings.ToLower(strings.TrimSuffix(z.Zone, ".")) + ".",
+			upstreams: applyUpstreamMode(s.conf.UpstreamMode, conf.Upstreams, addrs, s.conf.UpstreamWeights),
+		}
+		if s.conf.CacheOptimistic {
+			fz.cache = newOptimisticCache(s.conf.CacheSize, s.conf.CacheOptimisticMaxStale)
+		} else {
+			fz.cache = newResponseCache(s.conf.CacheSize)
+		}
+		fz.cache.ttls = cacheTTLsFromConfig(&s.conf.FilteringConfig)
+		fz.cache.prefetch = cachePrefetchFromConfig(&s.conf.FilteringConfig)
+		zones[fz.name] = fz
+		log.Debug("DNS: forwarding zone %s: %s", fz.name, strings.Join(z.Upstreams, ", "))
+	}
+	return zones, nil
+}
+
+// Find the most specific forwarding zone for the host name
+// Return nil if the name doesn't belong to any zone
+func (s *Server) findForwardZone(host string) *forwardZone {
+	if len(s.zones) == 0 {
+		return nil
+	}
+	name := strings.ToLower(host)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	for {
+		z, ok := s.zones[name]
+		if ok {
+			return z
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return nil
+		}
+		name = name[i+1:]
+	}
+}
+
+// Pass the request to the servers of the forwarding zone
+// The zone's servers take priority over the client's custom upstream servers.
+// The client's subnet isn't sent to the zone's servers.
+func (s *Server) resolveZone(z *forwardZone, d *proxy.DNSContext) error {
+	removeECS(d.Req)
+	if s.conf.EnableEDNSClientSubnet {
+		addr := d.Addr
+		d.Addr = nil
+		defer func() { d.Addr = addr }()
+	}
+
+	// dnsproxy doesn't use its cache for the requests with custom upstream servers
+	upstreams := d.Upstreams
+	d.Upstreams = z.upstreams
+	defer func() { d.Upstreams = upstreams }()
+
+	return z.cache.resolve(s.dnsProxy, d)
+}
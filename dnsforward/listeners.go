@@ -0,0 +1,133 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// ListenerConfig - the settings of a DNS listener
+type ListenerConfig struct {
+	Address   string `yaml:"address" json:"address"`     // IP address
+	Interface string `yaml:"interface" json:"interface"` // network interface name: listen on all its addresses
+
+	Port             int `yaml:"port" json:"port"`                               // plain DNS (UDP and TCP).  0: disabled
+	PortDNSOverTLS   int `yaml:"port_dns_over_tls" json:"port_dns_over_tls"`     // 0: disabled
+	PortDNSOverHTTPS int `yaml:"port_dns_over_https" json:"port_dns_over_https"` // 0: disabled
+}
+
+// Get the name of the listener for log and error messages
+func (l *ListenerConfig) name() string {
+	if len(l.Interface) != 0 {
+		return l.Interface
+	}
+	return l.Address
+}
+
+func checkListenerPort(port int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port: %d", port)
+	}
+	return nil
+}
+
+// Check the settings of the listeners
+func checkListeners(list []ListenerConfig) error {
+	for _, l := range list {
+		if (len(l.Address) == 0) == (len(l.Interface) == 0) {
+			return fmt.Errorf("listener %s: either address or interface is required", l.name())
+		}
+		if len(l.Address) != 0 && net.ParseIP(l.Address) == nil {
+			return fmt.Errorf("listener %s: invalid address", l.Address)
+		}
+		if l.Port == 0 && l.PortDNSOverTLS == 0 && l.PortDNSOverHTTPS == 0 {
+			return fmt.Errorf("listener %s: no ports are set", l.name())
+		}
+		for _, port := range []int{l.Port, l.PortDNSOverTLS, l.PortDNSOverHTTPS} {
+			err := checkListenerPort(port)
+			if err != nil {
+				return fmt.Errorf("listener %s: %s", l.name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// Return TRUE if a listener uses an encrypted protocol
+func listenersUseTLS(list []ListenerConfig) bool {
+	for _, l := range list {
+		if l.PortDNSOverTLS != 0 || l.PortDNSOverHTTPS != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the IP addresses the listener is bound to
+// The link-local addresses of the interface are skipped.
+func (l *ListenerConfig) ips() ([]net.IP, error) {
+	if len(l.Interface) == 0 {
+		return []net.IP{net.ParseIP(l.Address)}, nil
+	}
+
+	iface, err := net.InterfaceByName(l.Interface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if ok && !ipnet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("interface has no IP addresses")
+	}
+	return ips, nil
+}
+
+// Get the configurations of DNS proxy for the listeners: one for each IP address
+// base: the configuration with all the settings except the listen addresses
+func listenerConfigs(list []ListenerConfig, base proxy.Config) ([]proxy.Config, error) {
+	confs := []proxy.Config{}
+	for _, l := range list {
+		ips, err := l.ips()
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %s", l.name(), err)
+		}
+		if base.TLSConfig == nil && l.Port == 0 {
+			return nil, fmt.Errorf("listener %s: encryption settings are required for DNS-over-TLS and DNS-over-HTTPS", l.name())
+		}
+		if base.TLSConfig == nil && (l.PortDNSOverTLS != 0 || l.PortDNSOverHTTPS != 0) {
+			log.Info("DNS: listener %s: encryption settings aren't set: listening for plain DNS only", l.name())
+		}
+
+		for _, ip := range ips {
+			c := base
+			c.UDPListenAddr = nil
+			c.TCPListenAddr = nil
+			c.TLSListenAddr = nil
+			c.HTTPSListenAddr = nil
+			if l.Port != 0 {
+				c.UDPListenAddr = &net.UDPAddr{IP: ip, Port: l.Port}
+				c.TCPListenAddr = &net.TCPAddr{IP: ip, Port: l.Port}
+			}
+			if base.TLSConfig != nil && l.PortDNSOverTLS != 0 {
+				c.TLSListenAddr = &net.TCPAddr{IP: ip, Port: l.PortDNSOverTLS}
+			}
+			if base.TLSConfig != nil && l.PortDNSOverHTTPS != 0 {
+				c.HTTPSListenAddr = &net.TCPAddr{IP: ip, Port: l.PortDNSOverHTTPS}
+			}
+			log.Debug("DNS: listener %s: %s", l.name(), ip)
+			confs = append(confs, c)
+		}
+	}
+	return confs, nil
+}
@@ -0,0 +1,185 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// TTL of PTR records for local addresses (in seconds)
+const localPTRTTL = 60
+
+// The networks whose reverse lookups are answered locally
+var localNetworks = []*net.IPNet{
+	parseNetwork("10.0.0.0/8"),     // private network
+	parseNetwork("172.16.0.0/12"),  // private network
+	parseNetwork("192.168.0.0/16"), // private network
+	parseNetwork("127.0.0.0/8"),    // loopback
+	parseNetwork("169.254.0.0/16"), // link-local
+	parseNetwork("::1/128"),        // loopback
+	parseNetwork("fc00::/7"),       // unique local
+	parseNetwork("fe80::/10"),      // link-local
+}
+
+func parseNetwork(s string) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipnet
+}
+
+// Return TRUE if IP address belongs to a local network
+func isLocalIP(ip net.IP) bool {
+	for _, ipnet := range localNetworks {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the networks of the network interfaces, except those which are already in localNetworks
+func interfaceNetworks() []*net.IPNet {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Error("DNS: net.InterfaceAddrs: %s", err)
+		return nil
+	}
+	var nets []*net.IPNet
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || isLocalIP(ipnet.IP) {
+			continue
+		}
+		nets = append(nets, &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask})
+	}
+	return nets
+}
+
+// Return TRUE if PTR requests for IP address are answered locally
+func (s *Server) isLocalPTR(ip net.IP) bool {
+	if isLocalIP(ip) {
+		return true
+	}
+	for _, ipnet := range s.localNetworks {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get IP address from the name in a reverse zone, e.g. "4.3.2.1.in-addr.arpa." -> 1.2.3.4
+// Return nil if the name isn't a full reverse name of an address
+func ipFromReverseName(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if strings.HasSuffix(name, ".in-addr.arpa") {
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	}
+
+	if strings.HasSuffix(name, ".ip6.arpa") {
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(labels) != net.IPv6len*2 {
+			return nil
+		}
+		b := strings.Builder{}
+		for i := len(labels) - 1; i >= 0; i-- {
+			if len(labels[i]) != 1 {
+				return nil
+			}
+			b.WriteString(labels[i])
+			if i%4 == 0 && i != 0 {
+				b.WriteByte(':')
+			}
+		}
+		return net.ParseIP(b.String())
+	}
+
+	return nil
+}
+
+// Check the local resolvers settings
+func checkLocalResolvers(resolvers []string) error {
+	for _, u := range resolvers {
+		d, err := validateUpstream(u)
+		if err != nil || !d {
+			return fmt.Errorf("wrong local resolver specification: %s", u)
+		}
+	}
+	return nil
+}
+
+// Make the response with PTR record
+func (s *Server) genPTRRecord(request *dns.Msg, host string) *dns.Msg {
+	resp := s.makeResponse(request)
+	answer := new(dns.PTR)
+	answer.Hdr = dns.RR_Header{
+		Name:   request.Question[0].Name,
+		Rrtype: dns.TypePTR,
+		Ttl:    localPTRTTL,
+		Class:  dns.ClassINET,
+	}
+	answer.Ptr = dns.Fqdn(host)
+	resp.Answer = append(resp.Answer, answer)
+	return resp
+}
+
+// Respond to PTR requests for local addresses with the host names from DHCP leases and the clients registry
+// The requests for unknown local addresses are passed to the local resolvers (if enabled)
+// and are never passed to upstream servers.
+// The responses of the local resolvers aren't stored in cache, because the requests have custom upstreams.
+func processLocalPTR(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res != nil || !s.conf.LocalPTREnabled || d.Req.Question[0].Qtype != dns.TypePTR {
+		return resultDone
+	}
+	name := d.Req.Question[0].Name
+	ip := ipFromReverseName(name)
+	if ip == nil || !s.isLocalPTR(ip) || s.findForwardZone(name) != nil {
+		return resultDone
+	}
+
+	if s.conf.GetHostnameByIP != nil {
+		host := s.conf.GetHostnameByIP(ip.String())
+		if len(host) != 0 {
+			log.Debug("DNS: %s: local host name: %s", ip, host)
+			d.Res = s.genPTRRecord(d.Req, host)
+			return resultDone
+		}
+	}
+
+	if len(s.localResolvers) == 0 {
+		d.Res = s.genNXDomain(d.Req)
+		return resultDone
+	}
+
+	ctxLocal := &proxy.DNSContext{
+		Proto:     d.Proto,
+		Req:       d.Req,
+		StartTime: d.StartTime,
+		Upstreams: s.localResolvers,
+	}
+	err := s.dnsProxy.Resolve(ctxLocal)
+	if err != nil {
+		ctx.err = err
+		return resultError
+	}
+	d.Res = ctxLocal.Res
+	d.Upstream = ctxLocal.Upstream
+	ctx.responseFromUpstream = true
+	return resultDone
+}
@@ -0,0 +1,247 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/utils"
+	"github.com/miekg/dns"
+)
+
+const (
+	// TTL of the records of local zones if it's not set
+	localZoneDefaultTTL = 300
+
+	// The maximum number of CNAME records in a chain within local zones
+	localZoneMaxCNAMEs = 8
+)
+
+// LocalRecord - a resource record of a local zone
+type LocalRecord struct {
+	Name  string `yaml:"name" json:"name"`   // relative to the zone, e.g. "printer";  "@" or empty: the zone itself
+	Type  string `yaml:"type" json:"type"`   // "A", "AAAA", "CNAME", "MX", "TXT", "SRV" or "PTR"
+	Value string `yaml:"value" json:"value"` // record data in zone file format, e.g. "10 mail" for MX
+	TTL   uint32 `yaml:"ttl" json:"ttl"`     // 0: default (300)
+}
+
+// LocalZone - a DNS zone served by AdGuard Home authoritatively
+type LocalZone struct {
+	Name    string        `yaml:"name" json:"name"` // e.g. "home.lan"
+	Records []LocalRecord `yaml:"records" json:"records"`
+}
+
+// The record types that may be used in local zones
+var localRecordTypes = map[string]uint16{
+	"A":     dns.TypeA,
+	"AAAA":  dns.TypeAAAA,
+	"CNAME": dns.TypeCNAME,
+	"MX":    dns.TypeMX,
+	"TXT":   dns.TypeTXT,
+	"SRV":   dns.TypeSRV,
+	"PTR":   dns.TypePTR,
+}
+
+// Runtime data of a local zone
+type localZone struct {
+	name    string              // lowercase, with the trailing dot
+	soa     *dns.SOA            // SOA record for negative responses
+	records map[string][]dns.RR // owner name (lowercase, with the trailing dot) -> records
+	names   map[string]bool     // all existing names, including the names without records (RFC 8020)
+}
+
+// Parse a record of the zone
+func parseLocalRecord(zone string, r LocalRecord) (dns.RR, error) {
+	t, ok := localRecordTypes[strings.ToUpper(r.Type)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported record type: %s", r.Type)
+	}
+	name := r.Name
+	if len(name) == 0 {
+		name = "@"
+	}
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = localZoneDefaultTTL
+	}
+
+	line := fmt.Sprintf("%s %d IN %s %s", name, ttl, dns.TypeToString[t], r.Value)
+	zp := dns.NewZoneParser(strings.NewReader(line), zone, "")
+	rr, ok := zp.Next()
+	if !ok {
+		err := zp.Err()
+		if err == nil {
+			err = fmt.Errorf("no data")
+		}
+		return nil, fmt.Errorf("invalid record %s %s %s: %s", r.Name, r.Type, r.Value, err)
+	}
+	_, ok = zp.Next()
+	if ok {
+		return nil, fmt.Errorf("invalid record %s %s %s: more than one record", r.Name, r.Type, r.Value)
+	}
+
+	h := rr.Header()
+	h.Name = strings.ToLower(h.Name)
+	if !dns.IsSubDomain(zone, h.Name) {
+		return nil, fmt.Errorf("record %s is outside of zone %s", h.Name, zone)
+	}
+	return rr, nil
+}
+
+// Create the runtime object for the zone
+func newLocalZone(conf LocalZone) (*localZone, error) {
+	zname := strings.ToLower(strings.TrimSuffix(conf.Name, "."))
+	err := utils.IsValidHostname(zname)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zone name %s: %s", conf.Name, err)
+	}
+	zname += "."
+
+	z := &localZone{
+		name:    zname,
+		records: map[string][]dns.RR{},
+		names:   map[string]bool{zname: true},
+	}
+	for _, r := range conf.Records {
+		rr, err := parseLocalRecord(zname, r)
+		if err != nil {
+			return nil, fmt.Errorf("zone %s: %s", conf.Name, err)
+		}
+		name := rr.Header().Name
+		for _, existing := range z.records[name] {
+			if existing.Header().Rrtype == dns.TypeCNAME || rr.Header().Rrtype == dns.TypeCNAME {
+				return nil, fmt.Errorf("zone %s: CNAME record %s can't be used with other records", conf.Name, name)
+			}
+		}
+		z.records[name] = append(z.records[name], rr)
+
+		for n := name; n != zname; n = n[strings.IndexByte(n, '.')+1:] {
+			z.names[n] = true
+		}
+	}
+
+	z.soa = &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zname,
+			Rrtype: dns.TypeSOA,
+			Ttl:    localZoneDefaultTTL,
+			Class:  dns.ClassINET,
+		},
+		Ns:      "localhost.",
+		Mbox:    "hostmaster." + zname,
+		Serial:  1,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  localZoneDefaultTTL,
+	}
+	return z, nil
+}
+
+func copyLocalZones(zones []LocalZone) []LocalZone {
+	c := []LocalZone{}
+	for _, z := range zones {
+		c = append(c, LocalZone{Name: z.Name, Records: append([]LocalRecord{}, z.Records...)})
+	}
+	return c
+}
+
+// Create the runtime objects for the local zones
+// The returned map is keyed by the zone name in lowercase with the trailing dot.
+func prepareLocalZones(zones []LocalZone) (map[string]*localZone, error) {
+	m := map[string]*localZone{}
+	for _, conf := range zones {
+		z, err := newLocalZone(conf)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := m[z.name]; ok {
+			return nil, fmt.Errorf("duplicate zone: %s", conf.Name)
+		}
+		m[z.name] = z
+	}
+	return m, nil
+}
+
+// Find the most specific local zone for the host name
+// Return nil if the name doesn't belong to any zone
+func (s *Server) findLocalZone(host string) *localZone {
+	if len(s.localZones) == 0 {
+		return nil
+	}
+	name := strings.ToLower(dns.Fqdn(host))
+	for {
+		z, ok := s.localZones[name]
+		if ok {
+			return z
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return nil
+		}
+		name = name[i+1:]
+	}
+}
+
+// Make the authoritative response for the request to a local zone
+// CNAME records are followed within local zones.
+func (s *Server) genLocalZoneResponse(z *localZone, req *dns.Msg) *dns.Msg {
+	resp := s.makeResponse(req)
+	resp.Authoritative = true
+	qtype := req.Question[0].Qtype
+	name := strings.ToLower(req.Question[0].Name)
+
+	for i := 0; ; i++ {
+		rrs := z.records[name]
+		if len(rrs) == 1 && rrs[0].Header().Rrtype == dns.TypeCNAME && qtype != dns.TypeCNAME {
+			cname := rrs[0].(*dns.CNAME)
+			resp.Answer = append(resp.Answer, dns.Copy(cname))
+			target := strings.ToLower(cname.Target)
+			next := s.findLocalZone(target)
+			if next == nil || i == localZoneMaxCNAMEs {
+				// the target isn't in local zones or the chain is too long
+				return resp
+			}
+			z = next
+			name = target
+			continue
+		}
+
+		found := false
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == qtype {
+				resp.Answer = append(resp.Answer, dns.Copy(rr))
+				found = true
+			}
+		}
+		if !found {
+			if !z.names[name] {
+				resp.Rcode = dns.RcodeNameError
+			}
+			resp.Ns = append(resp.Ns, dns.Copy(z.soa))
+		}
+		return resp
+	}
+}
+
+// Respond to the requests for the names in local zones
+// The requests aren't filtered and aren't passed to upstream servers.
+func processLocalZones(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res != nil {
+		return resultDone // response is already set - nothing to do
+	}
+
+	s.RLock()
+	z := s.findLocalZone(d.Req.Question[0].Name)
+	if z != nil {
+		d.Res = s.genLocalZoneResponse(z, d.Req)
+	}
+	s.RUnlock()
+
+	if z != nil {
+		log.Debug("DNS: %s: response from local zone %s", d.Req.Question[0].Name, z.name)
+	}
+	return resultDone
+}
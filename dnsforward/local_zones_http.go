@@ -0,0 +1,133 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Get the list of local zones
+func (s *Server) handleZonesList(w http.ResponseWriter, r *http.Request) {
+	s.RLock()
+	zones := copyLocalZones(s.conf.LocalZones)
+	s.RUnlock()
+
+	js, err := json.Marshal(zones)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Marshal: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// Find the index of the zone by name
+// Return -1 if not found
+func findLocalZoneConf(zones []LocalZone, name string) int {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for i, z := range zones {
+		if strings.ToLower(strings.TrimSuffix(z.Name, ".")) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Apply the new list of local zones
+func (s *Server) setLocalZones(zones []LocalZone) error {
+	m, err := prepareLocalZones(zones)
+	if err != nil {
+		return err
+	}
+	s.conf.LocalZones = zones
+	s.localZones = m
+	return nil
+}
+
+// Add a new local zone
+func (s *Server) handleZoneAdd(w http.ResponseWriter, r *http.Request) {
+	z := LocalZone{}
+	err := json.NewDecoder(r.Body).Decode(&z)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	s.Lock()
+	if findLocalZoneConf(s.conf.LocalZones, z.Name) >= 0 {
+		s.Unlock()
+		httpError(r, w, http.StatusBadRequest, "zone %s already exists", z.Name)
+		return
+	}
+	zones := append(copyLocalZones(s.conf.LocalZones), z)
+	err = s.setLocalZones(zones)
+	s.Unlock()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	s.conf.ConfigModified()
+}
+
+type zoneNameJSON struct {
+	Name string `json:"name"`
+}
+
+// Remove a local zone
+func (s *Server) handleZoneDelete(w http.ResponseWriter, r *http.Request) {
+	req := zoneNameJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	s.Lock()
+	i := findLocalZoneConf(s.conf.LocalZones, req.Name)
+	if i < 0 {
+		s.Unlock()
+		httpError(r, w, http.StatusBadRequest, "zone %s not found", req.Name)
+		return
+	}
+	zones := copyLocalZones(s.conf.LocalZones)
+	zones = append(zones[:i], zones[i+1:]...)
+	err = s.setLocalZones(zones)
+	s.Unlock()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	s.conf.ConfigModified()
+}
+
+type zoneUpdateJSON struct {
+	Name string    `json:"name"`
+	Data LocalZone `json:"data"`
+}
+
+// Replace the settings of a local zone
+func (s *Server) handleZoneUpdate(w http.ResponseWriter, r *http.Request) {
+	req := zoneUpdateJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	s.Lock()
+	i := findLocalZoneConf(s.conf.LocalZones, req.Name)
+	if i < 0 {
+		s.Unlock()
+		httpError(r, w, http.StatusBadRequest, "zone %s not found", req.Name)
+		return
+	}
+	zones := copyLocalZones(s.conf.LocalZones)
+	zones[i] = req.Data
+	err = s.setLocalZones(zones)
+	s.Unlock()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	s.conf.ConfigModified()
+}
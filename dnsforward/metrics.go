@@ -0,0 +1,134 @@
+package dnsforward
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/metrics"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// The counters of DNS server for the metrics endpoint
+// The counters are never reset, so they are kept between the server's restarts.
+// The zero object is ready for use.
+type serverMetrics struct {
+	requests    uint64 // atomic
+	cacheHits   uint64 // atomic
+	cacheMisses uint64 // atomic
+
+	lock      sync.Mutex
+	blocked   map[string]uint64           // the number of blocked requests by the reason
+	upstreams map[string]*upstreamMetrics // by the address of the upstream server
+}
+
+// The counters of an upstream server
+type upstreamMetrics struct {
+	errors   uint64             // atomic
+	duration *metrics.Histogram // the durations of successful requests (in seconds)
+}
+
+// Count the processed request
+func (m *serverMetrics) countRequest(res *dnsfilter.Result) {
+	atomic.AddUint64(&m.requests, 1)
+	if res == nil || !res.IsFiltered {
+		return
+	}
+	m.lock.Lock()
+	if m.blocked == nil {
+		m.blocked = map[string]uint64{}
+	}
+	m.blocked[res.Reason.String()]++
+	m.lock.Unlock()
+}
+
+// Count the request that was passed to upstream servers or was served from cache
+func (m *serverMetrics) countCache(hit bool) {
+	if hit {
+		atomic.AddUint64(&m.cacheHits, 1)
+	} else {
+		atomic.AddUint64(&m.cacheMisses, 1)
+	}
+}
+
+// Upstream server that measures the durations of the requests
+type metricsUpstream struct {
+	upstream.Upstream
+	m *upstreamMetrics
+}
+
+// Exchange - pass the request to the upstream server and measure its duration
+func (u *metricsUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := u.Upstream.Exchange(req)
+	if err != nil {
+		atomic.AddUint64(&u.m.errors, 1)
+	} else {
+		u.m.duration.Observe(time.Since(start).Seconds())
+	}
+	return resp, err
+}
+
+// Add the measurement of request durations to the upstream server
+// The upstream servers with the same address share the same counters.
+func (m *serverMetrics) wrap(address string, u upstream.Upstream) upstream.Upstream {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.upstreams == nil {
+		m.upstreams = map[string]*upstreamMetrics{}
+	}
+	um, ok := m.upstreams[address]
+	if !ok {
+		um = &upstreamMetrics{duration: metrics.NewHistogram(metrics.DefaultDurationBuckets)}
+		m.upstreams[address] = um
+	}
+	return &metricsUpstream{Upstream: u, m: um}
+}
+
+// WriteMetrics - write the metrics of DNS server
+func (s *Server) WriteMetrics(w *metrics.Writer) {
+	m := &s.metrics
+
+	w.Header("adguardhome_dns_queries_total", metrics.Counter, "The number of processed DNS requests")
+	w.Value("adguardhome_dns_queries_total", float64(atomic.LoadUint64(&m.requests)))
+
+	w.Header("adguardhome_dns_cache_hits_total", metrics.Counter, "The number of DNS requests served from cache")
+	w.Value("adguardhome_dns_cache_hits_total", float64(atomic.LoadUint64(&m.cacheHits)))
+	w.Header("adguardhome_dns_cache_misses_total", metrics.Counter, "The number of DNS requests passed to upstream servers")
+	w.Value("adguardhome_dns_cache_misses_total", float64(atomic.LoadUint64(&m.cacheMisses)))
+
+	m.lock.Lock()
+	reasons := []string{}
+	blocked := map[string]uint64{}
+	for r, n := range m.blocked {
+		reasons = append(reasons, r)
+		blocked[r] = n
+	}
+	addrs := []string{}
+	upstreams := map[string]*upstreamMetrics{}
+	for a, um := range m.upstreams {
+		addrs = append(addrs, a)
+		upstreams[a] = um
+	}
+	m.lock.Unlock()
+	sort.Strings(reasons)
+	sort.Strings(addrs)
+
+	w.Header("adguardhome_dns_blocked_total", metrics.Counter, "The number of blocked DNS requests by reason")
+	for _, r := range reasons {
+		w.Value("adguardhome_dns_blocked_total", float64(blocked[r]), "reason", r)
+	}
+
+	w.Header("adguardhome_dns_upstream_duration_seconds", metrics.Hist, "The durations of successful requests to upstream servers")
+	for _, a := range addrs {
+		w.Histogram("adguardhome_dns_upstream_duration_seconds", upstreams[a].duration, "upstream", a)
+	}
+	w.Header("adguardhome_dns_upstream_errors_total", metrics.Counter, "The number of failed requests to upstream servers")
+	for _, a := range addrs {
+		w.Value("adguardhome_dns_upstream_errors_total", float64(atomic.LoadUint64(&upstreams[a].errors)), "upstream", a)
+	}
+}
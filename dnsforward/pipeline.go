@@ -0,0 +1,215 @@
+// DNS request processing pipeline
+
+package dnsforward
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// Names of the built-in pipeline stages
+const (
+	StageInitial           = "initial"            // AAAA filtering, query policies, Mozilla DoH canary domain
+	StageLocalZones        = "local_zones"        // authoritative local zones
+	StageFiltering         = "filtering"          // rewrites, filtering rules, blocked services, safe browsing, parental control
+	StageLocalPTR          = "local_ptr"          // PTR requests for local addresses
+	StageUpstream          = "upstream"           // cache, upstream servers, DNSSEC validation
+	StageDNS64             = "dns64"              // AAAA records synthesis
+	StageFilteringResponse = "filtering_response" // filtering of the response from upstream servers
+	StageQueryLog          = "querylog"           // query log and statistics
+)
+
+// MiddlewareResult is the result of a middleware call
+type MiddlewareResult int
+
+// Middleware results
+const (
+	// MiddlewareContinue - pass the request to the next stage
+	// If the middleware has set the response (d.Res), the stages that resolve and filter the request skip it,
+	// but post-processing and logging are still performed.
+	MiddlewareContinue MiddlewareResult = iota
+
+	// MiddlewareFinish - stop processing and respond with d.Res immediately: the request isn't logged.
+	// If d.Res isn't set, the client receives SERVFAIL response.
+	MiddlewareFinish
+)
+
+// Middleware processes DNS requests as a stage of the pipeline
+// A middleware is registered at build time by RegisterMiddleware() called from init() function,
+// e.g. in a file of "home" package built with a custom build tag:
+//
+//	// +build mymiddleware
+//
+//	package home
+//
+//	func init() {
+//		dnsforward.RegisterMiddleware("my_middleware", dnsforward.StageFiltering, &myMiddleware{})
+//	}
+//
+// Process() is called concurrently for different requests.
+type Middleware interface {
+	// Process the request: d.Req is the request, d.Res is the response (nil if it isn't set yet)
+	// An error stops processing: the client receives SERVFAIL response.
+	Process(d *proxy.DNSContext) (MiddlewareResult, error)
+}
+
+// A stage of the pipeline
+type stage struct {
+	name    string
+	process func(ctx *dnsContext) int
+}
+
+// The default order of the built-in stages
+var builtinStages = []stage{
+	{StageInitial, processInitial},
+	{StageLocalZones, processLocalZones},
+	{StageFiltering, processFilteringBeforeRequest},
+	{StageLocalPTR, processLocalPTR},
+	{StageUpstream, processUpstream},
+	{StageDNS64, processDNS64},
+	{StageFilteringResponse, processFilteringAfterResponse},
+	{StageQueryLog, processQueryLogsAndStats},
+}
+
+// A registered middleware
+type customStage struct {
+	name   string
+	before string // the name of the stage the middleware is inserted before in the default order
+	m      Middleware
+}
+
+var (
+	customStagesLock sync.Mutex
+	customStages     []customStage
+)
+
+// RegisterMiddleware adds the middleware to the pipeline
+// name: the unique name of the middleware used in "pipeline" setting
+// before: the middleware is inserted before this built-in stage in the default order.  Empty: at the end
+// Panics if the name is used already or the stage is unknown.
+func RegisterMiddleware(name, before string, m Middleware) {
+	customStagesLock.Lock()
+	defer customStagesLock.Unlock()
+
+	if len(name) == 0 || isBuiltinStage(name) || findCustomStage(name) != nil {
+		panic(fmt.Sprintf("dnsforward: invalid middleware name: %q", name))
+	}
+	if len(before) != 0 && !isBuiltinStage(before) {
+		panic(fmt.Sprintf("dnsforward: middleware %s: unknown stage: %s", name, before))
+	}
+	customStages = append(customStages, customStage{name: name, before: before, m: m})
+}
+
+func isBuiltinStage(name string) bool {
+	for _, st := range builtinStages {
+		if st.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func findCustomStage(name string) *customStage {
+	for i := range customStages {
+		if customStages[i].name == name {
+			return &customStages[i]
+		}
+	}
+	return nil
+}
+
+// Call the middleware
+func (c *customStage) process(ctx *dnsContext) int {
+	d := ctx.proxyCtx
+	r, err := c.m.Process(d)
+	if err != nil {
+		d.Res = ctx.srv.genServerFailure(d.Req)
+		ctx.err = fmt.Errorf("%s: %s", c.name, err)
+		return resultError
+	}
+	if r == MiddlewareFinish {
+		if d.Res == nil {
+			d.Res = ctx.srv.genServerFailure(d.Req)
+		}
+		return resultFinish
+	}
+	return resultDone
+}
+
+// Get the names of the stages in the default order
+func DefaultPipeline() []string {
+	list := []string{}
+	for _, st := range defaultStages() {
+		list = append(list, st.name)
+	}
+	return list
+}
+
+func defaultStages() []stage {
+	customStagesLock.Lock()
+	defer customStagesLock.Unlock()
+
+	list := []stage{}
+	for _, st := range builtinStages {
+		for i := range customStages {
+			c := &customStages[i]
+			if c.before == st.name {
+				list = append(list, stage{c.name, c.process})
+			}
+		}
+		list = append(list, st)
+	}
+	for i := range customStages {
+		c := &customStages[i]
+		if len(c.before) == 0 {
+			list = append(list, stage{c.name, c.process})
+		}
+	}
+	return list
+}
+
+// Create the pipeline with the stages in the specified order
+// order: empty: the default order.  Otherwise it must contain all built-in stages,
+// and the registered middlewares which aren't listed aren't used.
+func buildPipeline(order []string) ([]stage, error) {
+	if len(order) == 0 {
+		return defaultStages(), nil
+	}
+
+	customStagesLock.Lock()
+	defer customStagesLock.Unlock()
+
+	list := []stage{}
+	used := map[string]bool{}
+	for _, name := range order {
+		if used[name] {
+			return nil, fmt.Errorf("pipeline: duplicate stage: %s", name)
+		}
+		used[name] = true
+
+		found := false
+		for _, st := range builtinStages {
+			if st.name == name {
+				list = append(list, st)
+				found = true
+				break
+			}
+		}
+		if !found {
+			c := findCustomStage(name)
+			if c == nil {
+				return nil, fmt.Errorf("pipeline: unknown stage: %s", name)
+			}
+			list = append(list, stage{c.name, c.process})
+		}
+	}
+
+	for _, st := range builtinStages {
+		if !used[st.name] {
+			return nil, fmt.Errorf("pipeline: stage %s is missing", st.name)
+		}
+	}
+	return list, nil
+}
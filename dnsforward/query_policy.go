@@ -0,0 +1,169 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// QueryPolicy - the query policy settings of a client
+type QueryPolicy struct {
+	BlockedQueryTypes []string // e.g. "ANY", "HTTPS";  used in addition to the global list
+	IPv4Only          bool     // respond with an empty answer to AAAA requests, remove AAAA records from the other responses
+}
+
+// The query types which aren't known to the DNS library
+var extraQueryTypes = map[string]uint16{
+	"SVCB":  64,
+	"HTTPS": 65,
+}
+
+// Get the query type by name
+func parseQueryType(name string) (uint16, bool) {
+	name = strings.ToUpper(name)
+	t, ok := dns.StringToType[name]
+	if !ok {
+		t, ok = extraQueryTypes[name]
+	}
+	return t, ok
+}
+
+// Get the name of the query type
+func queryTypeName(qtype uint16) string {
+	name, ok := dns.TypeToString[qtype]
+	if ok {
+		return name
+	}
+	for name, t := range extraQueryTypes {
+		if t == qtype {
+			return name
+		}
+	}
+	return fmt.Sprintf("TYPE%d", qtype)
+}
+
+// CheckQueryTypes - check the list of query types
+func CheckQueryTypes(list []string) error {
+	for _, t := range list {
+		_, ok := parseQueryType(t)
+		if !ok {
+			return fmt.Errorf("invalid query type: %s", t)
+		}
+	}
+	return nil
+}
+
+// Get TLD in canonical form: lowercase, without "*." prefix and dots
+func normalizeTLD(tld string) string {
+	tld = strings.TrimPrefix(tld, "*")
+	tld = strings.Trim(tld, ".")
+	return strings.ToLower(tld)
+}
+
+// Check the list of blocked TLDs
+func checkBlockedTLDs(list []string) error {
+	for _, s := range list {
+		tld := normalizeTLD(s)
+		if len(tld) == 0 || strings.Contains(tld, "*") {
+			return fmt.Errorf("invalid TLD: %s", s)
+		}
+	}
+	return nil
+}
+
+// Get the blocked TLD the host belongs to
+// host: lowercase, without the trailing dot
+func matchBlockedTLD(host string, list []string) string {
+	for _, s := range list {
+		tld := normalizeTLD(s)
+		if host == tld || strings.HasSuffix(host, "."+tld) {
+			return tld
+		}
+	}
+	return ""
+}
+
+// Return TRUE if the query type is in the list
+func isQueryTypeIn(qtype uint16, list []string) bool {
+	for _, s := range list {
+		t, ok := parseQueryType(s)
+		if ok && t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the query policy settings for the client
+func (s *Server) getQueryPolicy(d *proxy.DNSContext) QueryPolicy {
+	if d.Addr != nil && s.conf.GetQueryPolicyByClient != nil {
+		return s.conf.GetQueryPolicyByClient(ipFromAddr(d.Addr), s.clientID(d))
+	}
+	return QueryPolicy{}
+}
+
+// Apply AAAA filtering, the query type and TLD blocking policies
+func (s *Server) applyQueryPolicy(ctx *dnsContext) {
+	d := ctx.proxyCtx
+	q := d.Req.Question[0]
+	pol := s.getQueryPolicy(d)
+
+	ctx.aaaaDisabled = s.conf.AAAADisabled || pol.IPv4Only
+	if ctx.aaaaDisabled && proxy.CheckDisabledAAAARequest(d, true) {
+		ctx.aaaaFiltered = true
+		return
+	}
+
+	if !s.conf.ProtectionEnabled {
+		return
+	}
+
+	if isQueryTypeIn(q.Qtype, s.conf.BlockedQueryTypes) || isQueryTypeIn(q.Qtype, pol.BlockedQueryTypes) {
+		ctx.result = &dnsfilter.Result{
+			IsFiltered: true,
+			Reason:     dnsfilter.FilteredQueryPolicy,
+			Rule:       "qtype: " + queryTypeName(q.Qtype),
+		}
+		d.Res = s.genNoData(d.Req)
+		return
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	tld := matchBlockedTLD(host, s.conf.BlockedTLDs)
+	if len(tld) != 0 {
+		ctx.result = &dnsfilter.Result{
+			IsFiltered: true,
+			Reason:     dnsfilter.FilteredQueryPolicy,
+			Rule:       "tld: " + tld,
+		}
+		d.Res = s.genDNSFilterMessage(d, ctx.result)
+	}
+}
+
+// Remove AAAA records and their signatures from the response
+// Returns TRUE if the response has been modified.
+func stripAAAA(m *dns.Msg) bool {
+	n := len(m.Answer) + len(m.Extra)
+	m.Answer = removeAAAA(m.Answer)
+	m.Extra = removeAAAA(m.Extra)
+	return len(m.Answer)+len(m.Extra) != n
+}
+
+func removeAAAA(rrs []dns.RR) []dns.RR {
+	list := rrs[:0]
+	for _, rr := range rrs {
+		switch v := rr.(type) {
+		case *dns.AAAA:
+			continue
+		case *dns.RRSIG:
+			if v.TypeCovered == dns.TypeAAAA {
+				continue
+			}
+		}
+		list = append(list, rr)
+	}
+	return list
+}
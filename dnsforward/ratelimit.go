@@ -0,0 +1,183 @@
+// Rate limiting of the requests by client subnets and temporary banning of abusers
+
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	ratelimitDefaultSubnetLenIPv4 = 32
+	ratelimitDefaultSubnetLenIPv6 = 128
+	ratelimitDefaultBanDuration   = 10 * 60 // in seconds
+
+	ratelimitMaxEntries = 100000      // the maximum number of subnets which are tracked at once
+	ratelimitBanWindow  = time.Minute // the interval during which the dropped requests are counted for banning
+)
+
+// The state of a client subnet
+type ratelimitEntry struct {
+	second   int64 // the current second (Unix time)
+	requests uint32
+
+	windowStart time.Time // the beginning of the interval for counting the dropped requests
+	dropped     uint32
+
+	bannedUntil time.Time
+	lastSeen    time.Time
+}
+
+// Rate limiter
+// The zero limit disables rate limiting, the zero ban threshold disables banning.
+type ratelimiter struct {
+	limit        uint32 // max number of requests per second from a subnet
+	subnetLen4   int
+	subnetLen6   int
+	banThreshold uint32 // the number of dropped requests during ratelimitBanWindow after which a subnet is banned
+	banDuration  time.Duration
+
+	whitelist      map[string]bool
+	whitelistIPNet []net.IPNet
+
+	lock    sync.Mutex
+	entries map[string]*ratelimitEntry // by subnet
+}
+
+func checkRatelimitConfig(conf *FilteringConfig) error {
+	if conf.RatelimitSubnetLenIPv4 > 32 {
+		return fmt.Errorf("ratelimit_subnet_len_ipv4: must be in range 0..32")
+	}
+	if conf.RatelimitSubnetLenIPv6 > 128 {
+		return fmt.Errorf("ratelimit_subnet_len_ipv6: must be in range 0..128")
+	}
+	return checkIPCIDRArray(conf.RatelimitWhitelist)
+}
+
+func newRatelimiter(conf *FilteringConfig) *ratelimiter {
+	r := &ratelimiter{
+		limit:        conf.Ratelimit,
+		subnetLen4:   int(conf.RatelimitSubnetLenIPv4),
+		subnetLen6:   int(conf.RatelimitSubnetLenIPv6),
+		banThreshold: conf.RatelimitBanThreshold,
+		banDuration:  time.Duration(conf.RatelimitBanDuration) * time.Second,
+		entries:      map[string]*ratelimitEntry{},
+	}
+	if r.subnetLen4 == 0 {
+		r.subnetLen4 = ratelimitDefaultSubnetLenIPv4
+	}
+	if r.subnetLen6 == 0 {
+		r.subnetLen6 = ratelimitDefaultSubnetLenIPv6
+	}
+	if r.banDuration == 0 {
+		r.banDuration = ratelimitDefaultBanDuration * time.Second
+	}
+	_ = processIPCIDRArray(&r.whitelist, &r.whitelistIPNet, conf.RatelimitWhitelist)
+	return r
+}
+
+// Get the subnet of the client: "1.2.3.0/24"
+func (r *ratelimiter) subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(r.subnetLen4, 32)), Mask: net.CIDRMask(r.subnetLen4, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(r.subnetLen6, 128)), Mask: net.CIDRMask(r.subnetLen6, 128)}).String()
+}
+
+func (r *ratelimiter) whitelisted(ip net.IP) bool {
+	if r.whitelist[ip.String()] {
+		return true
+	}
+	for _, ipnet := range r.whitelistIPNet {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the entries that aren't used anymore
+func (r *ratelimiter) cleanup(now time.Time) {
+	for k, e := range r.entries {
+		if now.Sub(e.lastSeen) > ratelimitBanWindow && now.After(e.bannedUntil) {
+			delete(r.entries, k)
+		}
+	}
+}
+
+// Return TRUE if the request must be dropped
+// limitRequests: count the request toward the limit (UDP requests);
+//  otherwise the request is dropped only if the subnet is banned.
+func (r *ratelimiter) isLimited(ip net.IP, limitRequests bool, now time.Time) bool {
+	if r == nil || r.limit == 0 || ip == nil || r.whitelisted(ip) {
+		return false
+	}
+	subnet := r.subnet(ip)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e, ok := r.entries[subnet]
+	if !ok {
+		if !limitRequests {
+			return false
+		}
+		if len(r.entries) >= ratelimitMaxEntries {
+			r.cleanup(now)
+		}
+		e = &ratelimitEntry{}
+		r.entries[subnet] = e
+	}
+	e.lastSeen = now
+
+	if now.Before(e.bannedUntil) {
+		return true
+	}
+	if !limitRequests {
+		return false
+	}
+
+	sec := now.Unix()
+	if e.second != sec {
+		e.second = sec
+		e.requests = 0
+	}
+	e.requests++
+	if e.requests <= r.limit {
+		return false
+	}
+
+	if r.banThreshold != 0 {
+		if now.Sub(e.windowStart) > ratelimitBanWindow {
+			e.windowStart = now
+			e.dropped = 0
+		}
+		e.dropped++
+		if e.dropped >= r.banThreshold {
+			e.bannedUntil = now.Add(r.banDuration)
+			e.dropped = 0
+			log.Info("DNS: ratelimit: subnet %s is banned for %s", subnet, r.banDuration)
+		}
+	}
+	return true
+}
+
+// Get the list of banned subnets
+func (r *ratelimiter) banned(now time.Time) []string {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var list []string
+	for k, e := range r.entries {
+		if now.Before(e.bannedUntil) {
+			list = append(list, k)
+		}
+	}
+	return list
+}
@@ -0,0 +1,250 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// The time after which an idle TCP connection is closed
+const socketConnTimeout = 10 * time.Second
+
+// Sockets - the listening sockets opened before DNS server is created:
+// passed by the service manager (systemd socket activation) or opened before the privileges are dropped.
+// They are used instead of the listen addresses and they stay open when DNS server is restarted.
+type Sockets struct {
+	UDP []net.PacketConn // plain DNS
+	TCP []net.Listener   // plain DNS
+	TLS []net.Listener   // DNS-over-TLS: TLS handshake is performed by DNS server
+}
+
+func (sk *Sockets) empty() bool {
+	return sk == nil || len(sk.UDP)+len(sk.TCP)+len(sk.TLS) == 0
+}
+
+// The loops which serve the requests received on the sockets
+type socketLoops struct {
+	sk   *Sockets
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// Return TRUE if DNS proxy listens on at least one address
+func hasListenAddr(c *proxy.Config) bool {
+	return c.UDPListenAddr != nil || c.TCPListenAddr != nil || c.TLSListenAddr != nil || c.HTTPSListenAddr != nil
+}
+
+// Start serving the requests received on the sockets
+// The loops keep running when DNS server is restarted.
+func (s *Server) startSockets() {
+	sk := s.conf.Sockets
+	if sk.empty() || s.sockets != nil {
+		return
+	}
+
+	l := &socketLoops{sk: sk, stop: make(chan bool)}
+	for _, c := range sk.UDP {
+		l.wg.Add(1)
+		go s.udpSocketLoop(l, c)
+	}
+	for _, ln := range sk.TCP {
+		l.wg.Add(1)
+		go s.tcpSocketLoop(l, ln, proxy.ProtoTCP)
+	}
+	for _, ln := range sk.TLS {
+		l.wg.Add(1)
+		go s.tcpSocketLoop(l, ln, proxy.ProtoTLS)
+	}
+	s.sockets = l
+}
+
+// Stop the loops without closing the sockets: they may be used by a new DNS server
+func (s *Server) stopSockets() {
+	l := s.sockets
+	if l == nil {
+		return
+	}
+	s.sockets = nil
+	close(l.stop)
+
+	// unblock the pending reads
+	sk := l.sk
+	for _, c := range sk.UDP {
+		_ = c.SetReadDeadline(time.Now())
+	}
+	for _, ln := range append(sk.TCP, sk.TLS...) {
+		if d, ok := ln.(deadliner); ok {
+			_ = d.SetDeadline(time.Now())
+		}
+	}
+	l.wg.Wait()
+
+	for _, c := range sk.UDP {
+		_ = c.SetReadDeadline(time.Time{})
+	}
+	for _, ln := range append(sk.TCP, sk.TLS...) {
+		if d, ok := ln.(deadliner); ok {
+			_ = d.SetDeadline(time.Time{})
+		}
+	}
+}
+
+func (l *socketLoops) stopped() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) udpSocketLoop(l *socketLoops, c net.PacketConn) {
+	defer l.wg.Done()
+	log.Info("DNS: serving UDP requests on %s", c.LocalAddr())
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			if !l.stopped() {
+				log.Debug("DNS: %s: %s", c.LocalAddr(), err)
+			}
+			return
+		}
+
+		req := &dns.Msg{}
+		if req.Unpack(append([]byte{}, buf[:n]...)) != nil {
+			continue
+		}
+		go func() {
+			d := &proxy.DNSContext{Proto: proxy.ProtoUDP, Req: req, Addr: addr}
+			if uc, ok := c.(*net.UDPConn); ok {
+				d.Conn = uc
+			}
+			s.handleSocketRequest(d)
+			if d.Res == nil {
+				return
+			}
+			b, err := d.Res.Pack()
+			if err == nil {
+				_, err = c.WriteTo(b, addr)
+			}
+			if err != nil {
+				log.Debug("DNS: %s: %s", addr, err)
+			}
+		}()
+	}
+}
+
+func (s *Server) tcpSocketLoop(l *socketLoops, ln net.Listener, proto string) {
+	defer l.wg.Done()
+	log.Info("DNS: serving %s requests on %s", proto, ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !l.stopped() {
+				log.Debug("DNS: %s: %s", ln.Addr(), err)
+			}
+			return
+		}
+		go s.handleSocketConn(conn, proto)
+	}
+}
+
+// Process the requests received on TCP connection
+func (s *Server) handleSocketConn(conn net.Conn, proto string) {
+	defer func() { _ = conn.Close() }()
+
+	if proto == proxy.ProtoTLS {
+		s.RLock()
+		p := s.dnsProxy
+		s.RUnlock()
+		if p == nil || p.TLSConfig == nil {
+			log.Debug("DNS: %s: encryption settings aren't set", conn.LocalAddr())
+			return
+		}
+		conn = tls.Server(conn, p.TLSConfig)
+	}
+
+	for {
+		_ = conn.SetDeadline(time.Now().Add(socketConnTimeout))
+		var n uint16
+		err := binary.Read(conn, binary.BigEndian, &n)
+		if err != nil {
+			return
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(conn, b)
+		if err != nil {
+			return
+		}
+		req := &dns.Msg{}
+		if req.Unpack(b) != nil {
+			return
+		}
+
+		d := &proxy.DNSContext{Proto: proto, Req: req, Addr: conn.RemoteAddr(), Conn: conn}
+		s.handleSocketRequest(d)
+		if d.Res == nil {
+			continue
+		}
+		b, err = d.Res.Pack()
+		if err != nil {
+			return
+		}
+		data := make([]byte, 2+len(b))
+		binary.BigEndian.PutUint16(data, uint16(len(b)))
+		copy(data[2:], b)
+		_, err = conn.Write(data)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Process the request received on a socket in the same way dnsproxy does
+func (s *Server) handleSocketRequest(d *proxy.DNSContext) {
+	s.RLock()
+	p := s.dnsProxy
+	running := s.isRunning
+	s.RUnlock()
+	if p == nil || !running {
+		return
+	}
+	d.StartTime = time.Now()
+
+	ok, err := s.beforeRequestHandler(p, d)
+	if err != nil {
+		log.Error("DNS: %s", err)
+		d.Res = s.genServerFailure(d.Req)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	if len(d.Req.Question) != 1 {
+		d.Res = s.genServerFailure(d.Req)
+		return
+	}
+	if p.RefuseAny && d.Req.Question[0].Qtype == dns.TypeANY {
+		d.Res = &dns.Msg{}
+		d.Res.SetRcode(d.Req, dns.RcodeNotImplemented)
+		return
+	}
+
+	err = s.handleDNSRequest(p, d)
+	if err != nil {
+		log.Debug("DNS: %s", err)
+	}
+}
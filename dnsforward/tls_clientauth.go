@@ -0,0 +1,50 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// ParseClientCAs parses PEM-encoded CA certificates which sign the client certificates
+func ParseClientCAs(data []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no valid CA certificates")
+	}
+	return pool, nil
+}
+
+// Get ClientID from the verified client certificate
+// The names are checked in order: CN value from Subject, then DNS names (SAN).
+// A name is used if it's a valid ClientID ("kids-tablet") or has the form "clientid.<server name>".
+// Return an empty string if there's no ClientID.
+func (s *Server) clientIDFromCertificate(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+
+	serverNames := []string{strings.ToLower(strings.TrimSuffix(s.conf.ServerName, "."))}
+	s.certLock.RLock()
+	for _, n := range s.conf.ServerNames {
+		serverNames = append(serverNames, strings.ToLower(strings.TrimSuffix(n.ServerName, ".")))
+	}
+	s.certLock.RUnlock()
+
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if IsValidClientID(name) {
+			return name
+		}
+		for _, sn := range serverNames {
+			id := clientIDFromServerName(name, sn)
+			if len(id) != 0 {
+				return id
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,161 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/utils"
+)
+
+// The sources of ClientID (see TLSConfig.ClientIDMode)
+const (
+	ClientIDModeAll  = ""     // the server name and the path of DNS-over-HTTPS request
+	ClientIDModeSNI  = "sni"  // the server name only
+	ClientIDModePath = "path" // the path of DNS-over-HTTPS request only
+	ClientIDModeNone = "none" // ClientID isn't used
+)
+
+// TLSServerName is an additional server name of DNS-over-TLS and DNS-over-HTTPS servers
+// It has its own certificate, which is selected by the server name (SNI) in Client Hello.
+type TLSServerName struct {
+	// The server name, e.g. "dns.example.com"
+	// The clients may use "clientid.<server name>" to identify themselves.
+	ServerName string `yaml:"server_name" json:"server_name"`
+
+	CertificateChain string `yaml:"certificate_chain" json:"certificate_chain"` // PEM-encoded certificates chain
+	PrivateKey       string `yaml:"private_key" json:"private_key"`             // PEM-encoded private key
+	CertificatePath  string `yaml:"certificate_path" json:"certificate_path"`   // certificate file name
+	PrivateKeyPath   string `yaml:"private_key_path" json:"private_key_path"`   // private key file name
+
+	// The sources of ClientID for this server name: "" (all), "sni", "path", "none"
+	ClientIDMode string `yaml:"client_id_mode" json:"client_id_mode"`
+
+	CertificateChainData []byte `yaml:"-" json:"-"`
+	PrivateKeyData       []byte `yaml:"-" json:"-"`
+}
+
+// CheckClientIDMode returns an error if the ClientID mode is unknown
+func CheckClientIDMode(mode string) error {
+	switch mode {
+	case ClientIDModeAll, ClientIDModeSNI, ClientIDModePath, ClientIDModeNone:
+		return nil
+	}
+	return fmt.Errorf("unknown ClientID mode: %q", mode)
+}
+
+// A parsed server name with its certificate
+type tlsName struct {
+	serverName   string // lowercase, without the trailing dot
+	clientIDMode string
+	cert         tls.Certificate
+	dnsNames     []string // DNS names from certificate (SAN) or CN value from Subject, sorted
+}
+
+// TLSCertificates selects the certificate of an additional server name by SNI value
+type TLSCertificates struct {
+	names []tlsName // sorted by the length of server name: the longest one first
+}
+
+// NewTLSCertificates parses the certificates of the server names
+func NewTLSCertificates(names []TLSServerName) (*TLSCertificates, error) {
+	c := &TLSCertificates{}
+	for _, n := range names {
+		name := strings.ToLower(strings.TrimSuffix(n.ServerName, "."))
+		if utils.IsValidHostname(name) != nil {
+			return nil, fmt.Errorf("invalid server name: %q", n.ServerName)
+		}
+		err := CheckClientIDMode(n.ClientIDMode)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		cert, err := tls.X509KeyPair(n.CertificateChainData, n.PrivateKeyData)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to parse TLS keypair: %s", name, err)
+		}
+		x, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: x509.ParseCertificate(): %s", name, err)
+		}
+		dnsNames := x.DNSNames
+		if len(dnsNames) == 0 {
+			dnsNames = []string{x.Subject.CommonName}
+		}
+		dnsNames = append([]string{}, dnsNames...)
+		sort.Strings(dnsNames)
+
+		c.names = append(c.names, tlsName{
+			serverName:   name,
+			clientIDMode: n.ClientIDMode,
+			cert:         cert,
+			dnsNames:     dnsNames,
+		})
+	}
+	sort.SliceStable(c.names, func(i, j int) bool {
+		return len(c.names[i].serverName) > len(c.names[j].serverName)
+	})
+	return c, nil
+}
+
+// Find the server name for SNI value: the name itself or "clientid.<server name>"
+func (c *TLSCertificates) find(sni string) *tlsName {
+	if c == nil {
+		return nil
+	}
+	sni = strings.ToLower(strings.TrimSuffix(sni, "."))
+	for i := range c.names {
+		n := &c.names[i]
+		if sni == n.serverName || strings.HasSuffix(sni, "."+n.serverName) {
+			return n
+		}
+	}
+	return nil
+}
+
+// Get returns the certificate for SNI value or nil if SNI doesn't match any of the server names
+// The server names are checked first, then the names from the certificates (e.g. "*.example.com").
+func (c *TLSCertificates) Get(sni string) *tls.Certificate {
+	if c == nil {
+		return nil
+	}
+	n := c.find(sni)
+	if n == nil {
+		for i := range c.names {
+			if matchDNSName(c.names[i].dnsNames, strings.ToLower(sni)) {
+				n = &c.names[i]
+				break
+			}
+		}
+	}
+	if n == nil {
+		return nil
+	}
+	cert := n.cert
+	return &cert
+}
+
+// Get the server name and ClientID mode for the client's SNI value
+func (s *Server) clientIDRule(sni string) (serverName, mode string) {
+	s.certLock.RLock()
+	n := s.conf.tlsNames.find(sni)
+	s.certLock.RUnlock()
+	if n != nil {
+		return n.serverName, n.clientIDMode
+	}
+	return strings.ToLower(strings.TrimSuffix(s.conf.ServerName, ".")), s.conf.ClientIDMode
+}
+
+// UpdateServerNames replaces the additional server names and their certificates without restarting the servers
+func (s *Server) UpdateServerNames(names []TLSServerName) error {
+	c, err := NewTLSCertificates(names)
+	if err != nil {
+		return err
+	}
+	s.certLock.Lock()
+	s.conf.tlsNames = c
+	s.conf.ServerNames = names
+	s.certLock.Unlock()
+	return nil
+}
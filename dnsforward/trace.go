@@ -0,0 +1,342 @@
+// Query processing trace mode
+
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// The maximum number of stored traces: the oldest ones are removed
+const traceMaxEntries = 100
+
+// TraceConfig - the settings of trace mode
+// A request is traced if it's received from any of the clients (if the list isn't empty)
+// and it's for any of the domains or their subdomains (if the list isn't empty).
+type TraceConfig struct {
+	Enabled bool     `json:"enabled"`
+	Clients []string `json:"clients"` // IP addresses, CIDR ranges or ClientIDs
+	Domains []string `json:"domains"`
+}
+
+// A filtering rule consulted on a step
+type traceRule struct {
+	Text     string `json:"text"`
+	FilterID int64  `json:"filter_id"`
+}
+
+// A processing step of the traced request
+type traceStep struct {
+	Stage    string      `json:"stage"`
+	Message  string      `json:"message"`
+	Rules    []traceRule `json:"rules,omitempty"`
+	Elapsed  float64     `json:"elapsed_ms"`  // since the request was received
+	Duration float64     `json:"duration_ms"` // the duration of the stage for the last step of a stage;  0 for the other steps
+}
+
+// The trace of a request
+type queryTrace struct {
+	Time     time.Time   `json:"time"`
+	Client   string      `json:"client"`
+	ClientID string      `json:"client_id,omitempty"`
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Upstream string      `json:"upstream,omitempty"`
+	Rcode    string      `json:"rcode,omitempty"`
+	Elapsed  float64     `json:"elapsed_ms"`
+	Steps    []traceStep `json:"steps"`
+
+	stage      string    // the current stage
+	stageStart time.Time // the time the current stage has started
+}
+
+// Record a step.  It's safe to call it for a nil object.
+func (t *queryTrace) add(format string, args ...interface{}) {
+	t.addRules(nil, format, args...)
+}
+
+// Record a step with the filtering rules.  It's safe to call it for a nil object.
+func (t *queryTrace) addRules(rules []dnsfilter.MatchedRule, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	st := traceStep{
+		Stage:   t.stage,
+		Message: fmt.Sprintf(format, args...),
+		Elapsed: durationMS(time.Since(t.Time)),
+	}
+	for _, r := range rules {
+		st.Rules = append(st.Rules, traceRule{Text: r.Text, FilterID: r.FilterID})
+	}
+	t.Steps = append(t.Steps, st)
+}
+
+// Record the filtering steps performed by dnsfilter
+func (t *queryTrace) addFiltering(host string, trace dnsfilter.Trace) {
+	if t == nil {
+		return
+	}
+	for _, st := range trace.Steps {
+		msg := fmt.Sprintf("%s: %s: %s", host, st.Name, st.Result.Reason)
+		if len(st.Result.Rule) != 0 {
+			msg += fmt.Sprintf(": rule %q (filter %d)", st.Result.Rule, st.Result.FilterID)
+		}
+		if len(st.Error) != 0 {
+			msg += ": error: " + st.Error
+		}
+		t.addRules(st.Rules, "%s", msg)
+	}
+}
+
+// Start recording the steps of the stage
+func (t *queryTrace) startStage(name string) {
+	if t == nil {
+		return
+	}
+	t.stage = name
+	t.stageStart = time.Now()
+}
+
+// Record the result of the stage
+func (t *queryTrace) endStage(d *proxy.DNSContext, hadRes bool, r int, err error) {
+	if t == nil {
+		return
+	}
+	msg := "done"
+	switch r {
+	case resultFinish:
+		msg = "finished processing"
+	case resultError:
+		msg = fmt.Sprintf("error: %s", err)
+	}
+	if !hadRes && d.Res != nil {
+		msg += ": response is set: " + describeResponse(d.Res)
+	}
+	t.add("%s", msg)
+	t.Steps[len(t.Steps)-1].Duration = durationMS(time.Since(t.stageStart))
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Get the short description of the response: "NOERROR, 2 answers"
+func describeResponse(m *dns.Msg) string {
+	if m == nil {
+		return "no response"
+	}
+	return fmt.Sprintf("%s, %d answers", dns.RcodeToString[m.Rcode], len(m.Answer))
+}
+
+// Trace mode settings and the traces of the requests
+type queryTracer struct {
+	lock     sync.Mutex
+	conf     TraceConfig
+	networks []*net.IPNet // the CIDR ranges from conf.Clients
+	traces   []*queryTrace
+}
+
+// Check the settings of trace mode
+func checkTraceConfig(c TraceConfig) error {
+	for _, cl := range c.Clients {
+		if net.ParseIP(cl) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(cl); err == nil {
+			continue
+		}
+		if !IsValidClientID(cl) {
+			return fmt.Errorf("invalid client: %q", cl)
+		}
+	}
+	for _, d := range c.Domains {
+		if len(normalizeTraceDomain(d)) == 0 {
+			return fmt.Errorf("invalid domain: %q", d)
+		}
+	}
+	if c.Enabled && len(c.Clients) == 0 && len(c.Domains) == 0 {
+		return fmt.Errorf("no clients or domains are specified")
+	}
+	return nil
+}
+
+func normalizeTraceDomain(d string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), "."))
+}
+
+// Apply the settings.  The stored traces are kept.
+func (t *queryTracer) setConfig(c TraceConfig) {
+	conf := TraceConfig{Enabled: c.Enabled}
+	networks := []*net.IPNet{}
+	for _, cl := range c.Clients {
+		if _, n, err := net.ParseCIDR(cl); err == nil {
+			networks = append(networks, n)
+		}
+		conf.Clients = append(conf.Clients, cl)
+	}
+	for _, d := range c.Domains {
+		conf.Domains = append(conf.Domains, normalizeTraceDomain(d))
+	}
+
+	t.lock.Lock()
+	t.conf = conf
+	t.networks = networks
+	t.lock.Unlock()
+}
+
+func (t *queryTracer) getConfig() TraceConfig {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	c := t.conf
+	c.Clients = stringArrayDup(c.Clients)
+	c.Domains = stringArrayDup(c.Domains)
+	return c
+}
+
+// Return TRUE if the request must be traced
+func (t *queryTracer) match(ip net.IP, clientID, host string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.conf.Enabled {
+		return false
+	}
+	return t.matchClient(ip, clientID) && t.matchDomain(host)
+}
+
+func (t *queryTracer) matchClient(ip net.IP, clientID string) bool {
+	if len(t.conf.Clients) == 0 {
+		return true
+	}
+	for _, cl := range t.conf.Clients {
+		if (len(clientID) != 0 && cl == clientID) || (ip != nil && ip.Equal(net.ParseIP(cl))) {
+			return true
+		}
+	}
+	for _, n := range t.networks {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *queryTracer) matchDomain(host string) bool {
+	if len(t.conf.Domains) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, d := range t.conf.Domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start tracing the request
+// Return nil if the request isn't traced
+func (s *Server) startTrace(ctx *dnsContext) *queryTrace {
+	d := ctx.proxyCtx
+	if len(d.Req.Question) != 1 {
+		return nil
+	}
+	ip := getIP(d.Addr)
+	clientID := s.clientID(d)
+	q := d.Req.Question[0]
+	host := strings.TrimSuffix(q.Name, ".")
+	if !s.tracer.match(ip, clientID, host) {
+		return nil
+	}
+
+	t := &queryTrace{
+		Time:     ctx.startTime,
+		ClientID: clientID,
+		Name:     host,
+		Type:     queryTypeName(q.Qtype),
+	}
+	s.RLock()
+	if ip != nil {
+		t.Client = s.anonymizeIP(ip).String()
+	}
+	s.RUnlock()
+	return t
+}
+
+// Store the trace of the processed request
+func (s *Server) finishTrace(ctx *dnsContext) {
+	t := ctx.trace
+	if t == nil {
+		return
+	}
+	d := ctx.proxyCtx
+	t.stage = ""
+	t.Elapsed = durationMS(time.Since(t.Time))
+	if d.Res != nil {
+		t.Rcode = dns.RcodeToString[d.Res.Rcode]
+	}
+	if d.Upstream != nil {
+		t.Upstream = d.Upstream.Address()
+	}
+
+	s.tracer.lock.Lock()
+	s.tracer.traces = append(s.tracer.traces, t)
+	if len(s.tracer.traces) > traceMaxEntries {
+		s.tracer.traces = s.tracer.traces[len(s.tracer.traces)-traceMaxEntries:]
+	}
+	s.tracer.lock.Unlock()
+}
+
+// Get the stored traces (the newest first)
+func (t *queryTracer) list() []*queryTrace {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	list := make([]*queryTrace, 0, len(t.traces))
+	for i := len(t.traces) - 1; i >= 0; i-- {
+		list = append(list, t.traces[i])
+	}
+	return list
+}
+
+// Remove the stored traces
+func (t *queryTracer) clear() {
+	t.lock.Lock()
+	t.traces = nil
+	t.lock.Unlock()
+}
+
+// Record how the request is going to be resolved
+func (s *Server) traceResolve(ctx *dnsContext) {
+	d := ctx.proxyCtx
+	z := s.findForwardZone(d.Req.Question[0].Name)
+	switch {
+	case z != nil:
+		ctx.trace.add("forwarding zone %s: %d upstream servers, looking up the zone's cache", z.name, len(z.upstreams))
+	case len(d.Upstreams) != 0:
+		ctx.trace.add("custom upstream servers: the cache isn't used")
+	case s.cache == nil:
+		ctx.trace.add("EDNS Client Subnet is enabled: looking up dnsproxy's cache")
+	default:
+		ctx.trace.add("looking up the cache")
+	}
+}
+
+// Record the result of resolving the request
+func (s *Server) traceResolved(ctx *dnsContext, elapsed time.Duration, err error) {
+	d := ctx.proxyCtx
+	switch {
+	case err != nil:
+		ctx.trace.add("couldn't resolve in %.3f ms: %s", durationMS(elapsed), err)
+	case d.Upstream == nil:
+		ctx.trace.add("response from cache: %s", describeResponse(d.Res))
+	default:
+		ctx.trace.add("resolved by upstream server %s in %.3f ms: %s",
+			d.Upstream.Address(), durationMS(elapsed), describeResponse(d.Res))
+	}
+}
@@ -0,0 +1,56 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Get the settings of trace mode
+func (s *Server) handleTraceConfig(w http.ResponseWriter, r *http.Request) {
+	js, err := json.Marshal(s.tracer.getConfig())
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Marshal: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// Change the settings of trace mode
+func (s *Server) handleTraceConfigSet(w http.ResponseWriter, r *http.Request) {
+	req := TraceConfig{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	err = checkTraceConfig(req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	s.tracer.setConfig(req)
+	log.Info("DNS: trace mode: enabled:%t clients:%v domains:%v", req.Enabled, req.Clients, req.Domains)
+}
+
+type traceListJSON struct {
+	Traces []*queryTrace `json:"traces"` // the newest first
+}
+
+// Get the traces of the requests
+func (s *Server) handleTraceList(w http.ResponseWriter, r *http.Request) {
+	js, err := json.Marshal(traceListJSON{Traces: s.tracer.list()})
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Marshal: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// Remove the traces
+func (s *Server) handleTraceClear(w http.ResponseWriter, r *http.Request) {
+	s.tracer.clear()
+}
@@ -0,0 +1,128 @@
+package dnsforward
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// Upstream selection policies
+const (
+	upstreamModeLowestRTT   = "lowest_rtt"   // the fastest server first (dnsproxy's behaviour)
+	upstreamModeParallel    = "parallel"     // send the request to all servers and use the first response
+	upstreamModeRoundRobin  = "round_robin"  // the servers are used in turn
+	upstreamModeWeighted    = "weighted"     // the server is selected randomly according to its weight
+	upstreamModeStrictOrder = "strict_order" // the servers are used in the configured order
+)
+
+// Check the upstream selection policy
+func checkUpstreamMode(mode string, weights map[string]uint) error {
+	switch mode {
+	case "", upstreamModeLowestRTT, upstreamModeParallel, upstreamModeRoundRobin, upstreamModeStrictOrder:
+		//
+
+	case upstreamModeWeighted:
+		for addr, w := range weights {
+			if w == 0 {
+				return fmt.Errorf("invalid weight of %s: 0", addr)
+			}
+		}
+
+	default:
+		return fmt.Errorf("invalid upstream mode: %s", mode)
+	}
+	return nil
+}
+
+// A group of upstream servers with a selection policy
+// The request is passed to the selected server;
+// if it fails, the request is passed to the other servers in order.
+type upstreamGroup struct {
+	mode      string
+	upstreams []upstream.Upstream
+	weights   []uint // for "weighted" mode
+	total     uint   // the sum of the weights
+	next      uint32 // the index of the next server for "round_robin" mode
+}
+
+// Create a group of upstream servers
+// addrs: the addresses from the configuration for the upstream objects
+// weights: the weights of the upstream servers by the address (1 by default)
+func newUpstreamGroup(mode string, upstreams []upstream.Upstream,
+	addrs map[upstream.Upstream]string, weights map[string]uint) *upstreamGroup {
+
+	g := &upstreamGroup{
+		mode:      mode,
+		upstreams: upstreams,
+	}
+	for _, u := range upstreams {
+		w, ok := weights[addrs[u]]
+		if !ok || w == 0 {
+			w = 1
+		}
+		g.weights = append(g.weights, w)
+		g.total += w
+	}
+	return g
+}
+
+// Get the index of the server to which the request is passed first
+func (g *upstreamGroup) first() int {
+	switch g.mode {
+	case upstreamModeRoundRobin:
+		n := atomic.AddUint32(&g.next, 1) - 1
+		return int(n % uint32(len(g.upstreams)))
+
+	case upstreamModeWeighted:
+		r := uint(rand.Int63n(int64(g.total)))
+		for i, w := range g.weights {
+			if r < w {
+				return i
+			}
+			r -= w
+		}
+	}
+	return 0
+}
+
+// Exchange - pass the request to the servers of the group according to the policy
+func (g *upstreamGroup) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	first := g.first()
+	errs := []error{}
+	for i := 0; i != len(g.upstreams); i++ {
+		u := g.upstreams[(first+i)%len(g.upstreams)]
+		resp, err := u.Exchange(m)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errorx.DecorateMany("all upstreams failed to exchange request", errs...)
+}
+
+// Address - get the addresses of the servers of the group
+func (g *upstreamGroup) Address() string {
+	addrs := []string{}
+	for _, u := range g.upstreams {
+		addrs = append(addrs, u.Address())
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// Apply the upstream selection policy to the list of upstream servers
+func applyUpstreamMode(mode string, upstreams []upstream.Upstream,
+	addrs map[upstream.Upstream]string, weights map[string]uint) []upstream.Upstream {
+
+	switch mode {
+	case upstreamModeRoundRobin, upstreamModeWeighted, upstreamModeStrictOrder:
+		if len(upstreams) > 1 {
+			return []upstream.Upstream{newUpstreamGroup(mode, upstreams, addrs, weights)}
+		}
+	}
+	return upstreams
+}
@@ -0,0 +1,246 @@
+package dnsforward
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// The name that is resolved by probe queries
+	healthCheckHost = "google-public-dns-a.google.com."
+
+	// The default number of consecutive failures after which an upstream server is considered down
+	healthDefaultMaxFailures = 3
+)
+
+// The health state of an upstream server
+type upstreamHealth struct {
+	address string
+	u       upstream.Upstream // the object used for probe queries
+
+	lock      sync.Mutex
+	healthy   bool
+	failures  uint32        // the number of consecutive failures
+	rtt       time.Duration // smoothed round-trip time of successful requests
+	lastError string
+	lastCheck time.Time // the time of the last probe query
+}
+
+// Update the state after a request
+// Return TRUE if the server has just been considered down
+func (st *upstreamHealth) update(elapsed time.Duration, err error, maxFailures uint32) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if err != nil {
+		st.failures++
+		st.lastError = err.Error()
+		if st.healthy && st.failures >= maxFailures {
+			st.healthy = false
+			log.Info("DNS: upstream %s is down: %s", st.address, err)
+			return true
+		}
+		return false
+	}
+
+	if !st.healthy {
+		log.Info("DNS: upstream %s is up", st.address)
+	}
+	st.healthy = true
+	st.failures = 0
+	st.lastError = ""
+	if st.rtt == 0 {
+		st.rtt = elapsed
+	} else {
+		st.rtt = (st.rtt*7 + elapsed) / 8
+	}
+	return false
+}
+
+func (st *upstreamHealth) isHealthy() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.healthy
+}
+
+// Active health checking of upstream servers:
+// . an upstream server is considered down after several consecutive failures
+// . requests aren't sent to an upstream server while it's down (unless all upstream servers are down)
+// . all upstream servers are periodically checked by probe queries:
+// an upstream server is up again after a successful probe query
+type healthChecker struct {
+	interval    time.Duration // interval between probe queries
+	maxFailures uint32
+	onDown      func(address string, err error) // called when an upstream server is considered down (optional)
+
+	lock   sync.Mutex
+	list   []*upstreamHealth
+	byAddr map[string]*upstreamHealth
+	stop   chan bool // nil: not started
+}
+
+func newHealthChecker(interval time.Duration, maxFailures uint32, onDown func(string, error)) *healthChecker {
+	if maxFailures == 0 {
+		maxFailures = healthDefaultMaxFailures
+	}
+	return &healthChecker{
+		interval:    interval,
+		maxFailures: maxFailures,
+		onDown:      onDown,
+		byAddr:      map[string]*upstreamHealth{},
+	}
+}
+
+// Upstream server with health tracking
+type healthUpstream struct {
+	upstream.Upstream
+	h  *healthChecker
+	st *upstreamHealth
+}
+
+// Exchange - pass the request to the upstream server if it's up
+func (u *healthUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if !u.st.isHealthy() && !u.h.allDown() {
+		return nil, fmt.Errorf("upstream %s is down", u.st.address)
+	}
+
+	start := time.Now()
+	resp, err := u.Upstream.Exchange(m)
+	u.h.update(u.st, time.Since(start), err)
+	return resp, err
+}
+
+// Update the state of the upstream server after a request
+func (h *healthChecker) update(st *upstreamHealth, elapsed time.Duration, err error) {
+	if st.update(elapsed, err, h.maxFailures) && h.onDown != nil {
+		h.onDown(st.address, err)
+	}
+}
+
+// Add health tracking to the upstream server
+// The upstream servers with the same address share the same state.
+func (h *healthChecker) wrap(address string, u upstream.Upstream) upstream.Upstream {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	st, ok := h.byAddr[address]
+	if !ok {
+		st = &upstreamHealth{address: address, u: u, healthy: true}
+		h.byAddr[address] = st
+		h.list = append(h.list, st)
+	}
+	return &healthUpstream{Upstream: u, h: h, st: st}
+}
+
+// Return TRUE if all upstream servers are down
+func (h *healthChecker) allDown() bool {
+	h.lock.Lock()
+	list := h.list
+	h.lock.Unlock()
+
+	for _, st := range list {
+		if st.isHealthy() {
+			return false
+		}
+	}
+	return len(list) != 0
+}
+
+// Send a probe query to each upstream server
+func (h *healthChecker) probeAll() {
+	h.lock.Lock()
+	list := h.list
+	h.lock.Unlock()
+
+	wg := sync.WaitGroup{}
+	for _, st := range list {
+		wg.Add(1)
+		go func(st *upstreamHealth) {
+			defer wg.Done()
+			req := &dns.Msg{}
+			req.SetQuestion(healthCheckHost, dns.TypeA)
+			req.RecursionDesired = true
+
+			start := time.Now()
+			_, err := st.u.Exchange(req)
+			h.update(st, time.Since(start), err)
+
+			st.lock.Lock()
+			st.lastCheck = time.Now()
+			st.lock.Unlock()
+		}(st)
+	}
+	wg.Wait()
+}
+
+func (h *healthChecker) start() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.stop != nil || h.interval == 0 {
+		return
+	}
+	stop := make(chan bool)
+	h.stop = stop
+
+	go func() {
+		t := time.NewTicker(h.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				h.probeAll()
+			}
+		}
+	}()
+}
+
+func (h *healthChecker) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+}
+
+// The state of an upstream server for HTTP API
+type upstreamHealthJSON struct {
+	Address   string `json:"address"`
+	Healthy   bool   `json:"healthy"`
+	RTT       uint32 `json:"rtt"` // in milliseconds
+	Failures  uint32 `json:"failures"`
+	LastError string `json:"last_error"`
+	LastCheck string `json:"last_check"` // RFC3339 time.  Empty: not checked yet
+}
+
+// Get the state of all upstream servers
+func (h *healthChecker) status() []upstreamHealthJSON {
+	h.lock.Lock()
+	list := h.list
+	h.lock.Unlock()
+
+	r := []upstreamHealthJSON{}
+	for _, st := range list {
+		st.lock.Lock()
+		j := upstreamHealthJSON{
+			Address:   st.address,
+			Healthy:   st.healthy,
+			RTT:       uint32(st.rtt / time.Millisecond),
+			Failures:  st.failures,
+			LastError: st.lastError,
+		}
+		if !st.lastCheck.IsZero() {
+			j.LastCheck = st.lastCheck.Format(time.RFC3339)
+		}
+		st.lock.Unlock()
+		r = append(r, j)
+	}
+	return r
+}
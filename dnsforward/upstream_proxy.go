@@ -0,0 +1,106 @@
+package dnsforward
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// The maximum size of a DNS message
+const dohMaxResponseSize = 64 * 1024
+
+// DNS-over-HTTPS upstream server connected through an outbound proxy
+// dnsproxy connects to DNS-over-HTTPS servers directly, so the requests are sent by our own HTTP client.
+// The server's host name is resolved by the proxy, so bootstrap DNS servers aren't used.
+type proxyDoHUpstream struct {
+	address string
+	client  *http.Client
+}
+
+func newProxyDoHUpstream(address string, timeout time.Duration, proxyURL *url.URL) *proxyDoHUpstream {
+	return &proxyDoHUpstream{
+		address: address,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:              http.ProxyURL(proxyURL),
+				ForceAttemptHTTP2:  true,
+				DisableCompression: true,
+				MaxIdleConns:       1,
+			},
+		},
+	}
+}
+
+// AddressToUpstream creates an upstream object for the address
+// proxyURL: the outbound proxy for DNS-over-HTTPS servers ("https://" addresses).  nil: they're connected directly
+func AddressToUpstream(address string, opts upstream.Options, proxyURL *url.URL) (upstream.Upstream, error) {
+	if proxyURL == nil || !strings.HasPrefix(address, "https://") {
+		return upstream.AddressToUpstream(address, opts)
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", address, err)
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("%s: no host name", address)
+	}
+	return newProxyDoHUpstream(address, opts.Timeout, proxyURL), nil
+}
+
+// Address returns the address of the upstream server
+func (u *proxyDoHUpstream) Address() string {
+	return u.address
+}
+
+// Exchange sends the request as RFC 8484 GET request
+func (u *proxyDoHUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't pack request msg: %s", err)
+	}
+
+	sep := "?"
+	if strings.Contains(u.address, "?") {
+		sep = "&"
+	}
+	req, err := http.NewRequest("GET", u.address+sep+"dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create a HTTP request to %s: %s", u.address, err)
+	}
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't do a GET request to %s: %s", u.address, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got an unexpected HTTP status code %d from %s", resp.StatusCode, u.address)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dohMaxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read body contents for %s: %s", u.address, err)
+	}
+	reply := &dns.Msg{}
+	err = reply.Unpack(body)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't unpack DNS response from %s: %s", u.address, err)
+	}
+	if reply.Id != m.Id {
+		return nil, dns.ErrId
+	}
+	return reply, nil
+}
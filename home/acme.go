@@ -0,0 +1,644 @@
+// ACME (RFC 8555) automatic certificate management: the certificate is obtained and renewed in background
+
+package home
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	acmeLetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+	acmeChallengeHTTP01 = "http-01"
+	acmeChallengeDNS01  = "dns-01"
+
+	acmeChallengePath = "/.well-known/acme-challenge/"
+
+	acmeDefaultRenewDays        = 30
+	acmeDefaultPropagationDelay = 60 // in seconds
+	acmeCheckInterval           = 12 * time.Hour
+	acmeRetryInterval           = 1 * time.Hour
+	acmeTimeout                 = 10 * time.Minute
+	acmeDNSProviderTimeout      = 1 * time.Minute
+
+	acmeDir             = "acme" // in the data directory
+	acmeAccountKeyFile  = "account.key"
+	acmeCertificateFile = "certificate.pem"
+	acmePrivateKeyFile  = "private.key"
+)
+
+// ACME states
+const (
+	acmeStateInProgress = "in_progress"
+	acmeStateOK         = "ok"
+	acmeStateError      = "error"
+)
+
+// Settings of automatic certificate management
+type acmeConfig struct {
+	Enabled      bool   `yaml:"enabled" json:"enabled"`
+	Email        string `yaml:"email" json:"email"`                 // the contact of ACME account (optional)
+	DirectoryURL string `yaml:"directory_url" json:"directory_url"` // ACME server.  Empty: Let's Encrypt
+	Challenge    string `yaml:"challenge" json:"challenge"`         // "http-01" or "dns-01".  Empty: "http-01"
+
+	// The names which the certificate is issued for.  Empty: server_name
+	// Wildcard names ("*.example.org") require "dns-01" challenge.
+	Domains []string `yaml:"domains" json:"domains"`
+
+	// The DNS provider which creates TXT records for "dns-01" challenge and its settings
+	DNSProvider       string            `yaml:"dns_provider" json:"dns_provider"`
+	DNSProviderConfig map[string]string `yaml:"dns_provider_config" json:"dns_provider_config"`
+
+	// Time to wait for TXT records to propagate before asking ACME server to check them (in seconds).  0: default (60)
+	DNSPropagationDelay uint32 `yaml:"dns_propagation_delay" json:"dns_propagation_delay"`
+
+	// The certificate is renewed when it expires in less than this number of days.  0: default (30)
+	RenewBeforeDays uint32 `yaml:"renew_before_days" json:"renew_before_days"`
+}
+
+// The state of automatic certificate management
+type acmeStatus struct {
+	State       string    `json:"state"` // "in_progress", "ok" or "error".  Empty: the certificate hasn't been requested yet
+	LastError   string    `json:"last_error,omitempty"`
+	LastRenewal time.Time `json:"last_renewal,omitempty"` // the time when the certificate was obtained
+	NextRenewal time.Time `json:"next_renewal,omitempty"` // the time of the next attempt
+}
+
+// DNS provider for "dns-01" challenge: creates and removes TXT records
+type acmeDNSProvider interface {
+	Present(fqdn, value string) error
+	CleanUp(fqdn, value string) error
+}
+
+// The constructors of DNS providers by name
+var acmeDNSProviders = map[string]func(conf map[string]string) (acmeDNSProvider, error){
+	"exec":    newACMEExecProvider,
+	"httpreq": newACMEHTTPReqProvider,
+}
+
+// ACME module
+type acmeManager struct {
+	lock   sync.Mutex
+	status acmeStatus
+	tokens map[string]string // HTTP-01 key authorizations by token
+
+	wake chan bool // wake up the check loop after the settings have changed
+}
+
+func newACMEManager() *acmeManager {
+	return &acmeManager{
+		tokens: map[string]string{},
+		wake:   make(chan bool, 1),
+	}
+}
+
+// Check ACME settings
+func checkACMEConfig(c acmeConfig, serverName string) error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if len(c.DirectoryURL) != 0 {
+		u, err := url.Parse(c.DirectoryURL)
+		if err != nil || u.Scheme != "https" || len(u.Host) == 0 {
+			return fmt.Errorf("acme: invalid directory_url: %s", c.DirectoryURL)
+		}
+	}
+
+	switch c.Challenge {
+	case "", acmeChallengeHTTP01:
+		//
+	case acmeChallengeDNS01:
+		_, err := newACMEDNSProvider(c)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("acme: invalid challenge: %s", c.Challenge)
+	}
+
+	domains := acmeDomains(c, serverName)
+	if len(domains) == 0 {
+		return fmt.Errorf("acme: no domains: set domains or server_name")
+	}
+	for _, d := range domains {
+		name := d
+		if strings.HasPrefix(d, "*.") {
+			if c.Challenge != acmeChallengeDNS01 {
+				return fmt.Errorf("acme: %s: wildcard names require dns-01 challenge", d)
+			}
+			name = d[2:]
+		}
+		if !isValidDomainName(name) {
+			return fmt.Errorf("acme: invalid domain: %s", d)
+		}
+	}
+	return nil
+}
+
+// Get the names which the certificate is issued for (lowercase, sorted)
+func acmeDomains(c acmeConfig, serverName string) []string {
+	list := c.Domains
+	if len(list) == 0 && len(serverName) != 0 {
+		list = []string{serverName}
+	}
+	domains := []string{}
+	for _, d := range list {
+		domains = append(domains, strings.ToLower(strings.TrimSuffix(d, ".")))
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+func newACMEDNSProvider(c acmeConfig) (acmeDNSProvider, error) {
+	create, ok := acmeDNSProviders[c.DNSProvider]
+	if !ok {
+		return nil, fmt.Errorf("acme: invalid dns_provider: %s", c.DNSProvider)
+	}
+	p, err := create(c.DNSProviderConfig)
+	if err != nil {
+		return nil, fmt.Errorf("acme: dns_provider %s: %s", c.DNSProvider, err)
+	}
+	return p, nil
+}
+
+// "exec" DNS provider: runs the command "<command> present|cleanup <fqdn> <value>"
+type acmeExecProvider struct {
+	command string
+}
+
+func newACMEExecProvider(conf map[string]string) (acmeDNSProvider, error) {
+	p := &acmeExecProvider{command: conf["command"]}
+	if len(p.command) == 0 {
+		return nil, fmt.Errorf("command is not set")
+	}
+	return p, nil
+}
+
+func (p *acmeExecProvider) run(action, fqdn, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeDNSProviderTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, p.command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %s: %s", p.command, action, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (p *acmeExecProvider) Present(fqdn, value string) error {
+	return p.run("present", fqdn, value)
+}
+
+func (p *acmeExecProvider) CleanUp(fqdn, value string) error {
+	return p.run("cleanup", fqdn, value)
+}
+
+// "httpreq" DNS provider: sends {"fqdn":"...","value":"..."} to "<endpoint>/present" and "<endpoint>/cleanup"
+type acmeHTTPReqProvider struct {
+	endpoint string
+	username string
+	password string
+	client   *http.Client
+}
+
+func newACMEHTTPReqProvider(conf map[string]string) (acmeDNSProvider, error) {
+	p := &acmeHTTPReqProvider{
+		endpoint: strings.TrimSuffix(conf["endpoint"], "/"),
+		username: conf["username"],
+		password: conf["password"],
+		client:   &http.Client{Timeout: acmeDNSProviderTimeout},
+	}
+	u, err := url.Parse(p.endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid endpoint: %s", p.endpoint)
+	}
+	return p, nil
+}
+
+func (p *acmeHTTPReqProvider) send(action, fqdn, value string) error {
+	body, _ := json.Marshal(map[string]string{"fqdn": fqdn, "value": value})
+	req, err := http.NewRequest(http.MethodPost, p.endpoint+"/"+action, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(p.username) != 0 {
+		req.SetBasicAuth(p.username, p.password)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: status code %d", req.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *acmeHTTPReqProvider) Present(fqdn, value string) error {
+	return p.send("present", fqdn, value)
+}
+
+func (p *acmeHTTPReqProvider) CleanUp(fqdn, value string) error {
+	return p.send("cleanup", fqdn, value)
+}
+
+func acmeFilePath(name string) string {
+	return filepath.Join(Context.getDataDir(), acmeDir, name)
+}
+
+// Load the certificate and the private key obtained from ACME server
+// Return nil if they don't exist yet.
+func acmeLoadCertificate() ([]byte, []byte) {
+	cert, err := ioutil.ReadFile(acmeFilePath(acmeCertificateFile))
+	if err != nil {
+		return nil, nil
+	}
+	key, err := ioutil.ReadFile(acmeFilePath(acmePrivateKeyFile))
+	if err != nil {
+		return nil, nil
+	}
+	return cert, key
+}
+
+// Load the key from file or generate a new one
+func acmeLoadKey(name string) (*ecdsa.PrivateKey, error) {
+	fn := acmeFilePath(name)
+	data, err := ioutil.ReadFile(fn)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: invalid key", fn)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = acmeWriteFile(name, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func acmeWriteFile(name string, data []byte) error {
+	err := os.MkdirAll(filepath.Join(Context.getDataDir(), acmeDir), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(acmeFilePath(name), data, 0600)
+}
+
+// Get the time when the certificate must be renewed
+// Return zero time if the certificate must be obtained right now
+// (it doesn't exist, it can't be parsed or it's issued for the other names).
+func acmeRenewalTime(certPEM []byte, domains []string, renewDays uint32) time.Time {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return time.Time{}
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}
+	}
+
+	names := []string{}
+	for _, n := range cert.DNSNames {
+		names = append(names, strings.ToLower(n))
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != strings.Join(domains, ",") {
+		return time.Time{}
+	}
+
+	if renewDays == 0 {
+		renewDays = acmeDefaultRenewDays
+	}
+	return cert.NotAfter.Add(-time.Duration(renewDays) * 24 * time.Hour)
+}
+
+// Start the check loop
+func (m *acmeManager) start() {
+	go m.loop()
+}
+
+// Wake up the check loop after the settings have changed
+func (m *acmeManager) wakeup() {
+	if m == nil {
+		return
+	}
+	select {
+	case m.wake <- true:
+		//
+	default:
+		//
+	}
+}
+
+func (m *acmeManager) getStatus() acmeStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.status
+}
+
+func (m *acmeManager) setStatus(state string, err error, next time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.status.State = state
+	m.status.LastError = ""
+	if err != nil {
+		m.status.LastError = err.Error()
+	}
+	m.status.NextRenewal = next
+	if state == acmeStateOK {
+		m.status.LastRenewal = time.Now()
+	}
+}
+
+func (m *acmeManager) loop() {
+	for {
+		wait := m.check()
+		select {
+		case <-m.wake:
+			//
+		case <-time.After(wait):
+			//
+		}
+	}
+}
+
+// Obtain the certificate if it doesn't exist or it's time to renew it
+// Return the time to wait until the next check.
+func (m *acmeManager) check() time.Duration {
+	config.RLock()
+	conf := config.TLS.ACME
+	serverName := config.TLS.ServerName
+	config.RUnlock()
+
+	if !conf.Enabled {
+		m.setStatus("", nil, time.Time{})
+		return acmeCheckInterval
+	}
+	err := checkACMEConfig(conf, serverName)
+	if err != nil {
+		m.setStatus(acmeStateError, err, time.Time{})
+		return acmeCheckInterval
+	}
+
+	domains := acmeDomains(conf, serverName)
+	certPEM, _ := acmeLoadCertificate()
+	renewAt := acmeRenewalTime(certPEM, domains, conf.RenewBeforeDays)
+	now := time.Now()
+	if now.Before(renewAt) {
+		m.lock.Lock()
+		if m.status.State == "" {
+			m.status.State = acmeStateOK
+		}
+		m.status.NextRenewal = renewAt
+		m.lock.Unlock()
+		return minDuration(renewAt.Sub(now), acmeCheckInterval)
+	}
+
+	m.setStatus(acmeStateInProgress, nil, time.Time{})
+	log.Info("ACME: requesting certificate for %v", domains)
+	certPEM, keyPEM, err := m.obtain(conf, domains)
+	if err != nil {
+		log.Error("ACME: %s", err)
+		m.setStatus(acmeStateError, err, now.Add(acmeRetryInterval))
+		return acmeRetryInterval
+	}
+	log.Info("ACME: the certificate has been obtained")
+
+	err = acmeWriteFile(acmePrivateKeyFile, keyPEM)
+	if err == nil {
+		err = acmeWriteFile(acmeCertificateFile, certPEM)
+	}
+	if err != nil {
+		log.Error("ACME: %s", err)
+		m.setStatus(acmeStateError, err, now.Add(acmeRetryInterval))
+		return acmeRetryInterval
+	}
+	err = tlsUpdateCertificate(certPEM, keyPEM)
+	if err != nil {
+		log.Error("ACME: %s", err)
+	}
+
+	renewAt = acmeRenewalTime(certPEM, domains, conf.RenewBeforeDays)
+	m.setStatus(acmeStateOK, nil, renewAt)
+	return minDuration(renewAt.Sub(time.Now()), acmeCheckInterval)
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Get the certificate from ACME server
+// Return PEM-encoded certificate chain and private key.
+func (m *acmeManager) obtain(conf acmeConfig, domains []string) ([]byte, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+	defer cancel()
+
+	accountKey, err := acmeLoadKey(acmeAccountKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("account key: %s", err)
+	}
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: conf.DirectoryURL,
+		HTTPClient:   Context.client,
+	}
+	if len(client.DirectoryURL) == 0 {
+		client.DirectoryURL = acmeLetsEncryptURL
+	}
+
+	acct := &acme.Account{}
+	if len(conf.Email) != 0 {
+		acct.Contact = []string{"mailto:" + conf.Email}
+	}
+	_, err = client.Register(ctx, acct, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, nil, fmt.Errorf("register: %s", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("order: %s", err)
+	}
+	for _, u := range order.AuthzURLs {
+		err = m.authorize(ctx, client, conf, u)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("order: %s", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: strings.TrimPrefix(domains[0], "*.")},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("certificate: %s", err)
+	}
+
+	certPEM := []byte{}
+	for _, b := range der {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// Pass the challenge of the authorization
+func (m *acmeManager) authorize(ctx context.Context, client *acme.Client, conf acmeConfig, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("authorization: %s", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	domain := authz.Identifier.Value
+
+	typ := conf.Challenge
+	if len(typ) == 0 {
+		typ = acmeChallengeHTTP01
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == typ {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("%s: %s challenge isn't offered by ACME server", domain, typ)
+	}
+
+	switch typ {
+	case acmeChallengeHTTP01:
+		resp, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		m.lock.Lock()
+		m.tokens[chal.Token] = resp
+		m.lock.Unlock()
+		defer func() {
+			m.lock.Lock()
+			delete(m.tokens, chal.Token)
+			m.lock.Unlock()
+		}()
+
+	case acmeChallengeDNS01:
+		p, err := newACMEDNSProvider(conf)
+		if err != nil {
+			return err
+		}
+		value, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		// the wildcard name is authorized by the record for the base domain
+		fqdn := "_acme-challenge." + strings.TrimPrefix(domain, "*.") + "."
+		err = p.Present(fqdn, value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", domain, err)
+		}
+		defer func() {
+			err := p.CleanUp(fqdn, value)
+			if err != nil {
+				log.Error("ACME: %s: %s", domain, err)
+			}
+		}()
+
+		delay := conf.DNSPropagationDelay
+		if delay == 0 {
+			delay = acmeDefaultPropagationDelay
+		}
+		select {
+		case <-time.After(time.Duration(delay) * time.Second):
+			//
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	_, err = client.Accept(ctx, chal)
+	if err != nil {
+		return fmt.Errorf("%s: accept: %s", domain, err)
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	if err != nil {
+		return fmt.Errorf("%s: %s", domain, err)
+	}
+	return nil
+}
+
+// Respond to HTTP-01 challenge requests: "GET /.well-known/acme-challenge/<token>"
+func (m *acmeManager) handleHTTP01(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+	m.lock.Lock()
+	resp, ok := m.tokens[token]
+	m.lock.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(resp))
+}
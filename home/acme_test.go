@@ -0,0 +1,245 @@
+package home
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACMEConfig(t *testing.T) {
+	c := acmeConfig{Enabled: true}
+	assert.NotNil(t, checkACMEConfig(c, ""))
+	assert.Nil(t, checkACMEConfig(c, "dns.example.org"))
+	assert.Equal(t, []string{"dns.example.org"}, acmeDomains(c, "DNS.example.org."))
+
+	c.Domains = []string{"b.example.org", "A.example.org"}
+	assert.Equal(t, []string{"a.example.org", "b.example.org"}, acmeDomains(c, "dns.example.org"))
+
+	// wildcard names require dns-01 challenge
+	c.Domains = []string{"*.example.org"}
+	assert.NotNil(t, checkACMEConfig(c, ""))
+	c.Challenge = acmeChallengeDNS01
+	assert.NotNil(t, checkACMEConfig(c, ""))
+	c.DNSProvider = "httpreq"
+	assert.NotNil(t, checkACMEConfig(c, ""))
+	c.DNSProviderConfig = map[string]string{"endpoint": "https://dns.example.org/acme"}
+	assert.Nil(t, checkACMEConfig(c, ""))
+
+	c.Challenge = "tls-alpn-01"
+	assert.NotNil(t, checkACMEConfig(c, ""))
+	c.Challenge = ""
+	c.Domains = []string{"bad_name!"}
+	assert.NotNil(t, checkACMEConfig(c, ""))
+	c.Domains = nil
+	c.DirectoryURL = "http://acme.example.org/directory"
+	assert.NotNil(t, checkACMEConfig(c, "dns.example.org"))
+}
+
+// Create a certificate for the public key signed by the key
+func testACMECertificate(t *testing.T, pub interface{}, key *ecdsa.PrivateKey, names []string, notAfter time.Time) []byte {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestACMERenewalTime(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	notAfter := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	cert := testACMECertificate(t, key.Public(), key, []string{"b.example.org", "a.example.org"}, notAfter)
+
+	renewAt := acmeRenewalTime(cert, []string{"a.example.org", "b.example.org"}, 0)
+	assert.True(t, renewAt.Equal(notAfter.Add(-30*24*time.Hour).UTC()))
+	renewAt = acmeRenewalTime(cert, []string{"a.example.org", "b.example.org"}, 10)
+	assert.True(t, renewAt.Equal(notAfter.Add(-10*24*time.Hour).UTC()))
+
+	// the names have changed
+	assert.True(t, acmeRenewalTime(cert, []string{"a.example.org"}, 0).IsZero())
+	assert.True(t, acmeRenewalTime(nil, []string{"a.example.org"}, 0).IsZero())
+}
+
+func TestACMEHTTPReqProvider(t *testing.T) {
+	var reqs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		body, _ := ioutil.ReadAll(r.Body)
+		reqs = append(reqs, r.URL.Path+" "+user+":"+pass+" "+string(body))
+	}))
+	defer srv.Close()
+
+	p, err := newACMEHTTPReqProvider(map[string]string{"endpoint": srv.URL + "/", "username": "u", "password": "p"})
+	assert.Nil(t, err)
+	assert.Nil(t, p.Present("_acme-challenge.example.org.", "value"))
+	assert.Nil(t, p.CleanUp("_acme-challenge.example.org.", "value"))
+	assert.Equal(t, []string{
+		`/present u:p {"fqdn":"_acme-challenge.example.org.","value":"value"}`,
+		`/cleanup u:p {"fqdn":"_acme-challenge.example.org.","value":"value"}`,
+	}, reqs)
+
+	_, err = newACMEHTTPReqProvider(map[string]string{"endpoint": "example.org"})
+	assert.NotNil(t, err)
+}
+
+// ACME server which issues certificates after HTTP-01 challenge
+type testACMEServer struct {
+	t       *testing.T
+	srv     *httptest.Server
+	m       *acmeManager
+	key     *ecdsa.PrivateKey // CA key
+	lock    sync.Mutex
+	authzOK bool
+	cert    []byte
+}
+
+// Get the payload of JWS request
+func (s *testACMEServer) payload(r *http.Request) []byte {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&jws)
+	assert.Nil(s.t, err)
+	data, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	assert.Nil(s.t, err)
+	return data
+}
+
+func (s *testACMEServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	base := s.srv.URL
+	w.Header().Set("Replay-Nonce", "nonce")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	status := "pending"
+	if s.authzOK {
+		status = "valid"
+	}
+	order := map[string]interface{}{
+		"status":         "pending",
+		"identifiers":    []map[string]string{{"type": "dns", "value": "dns.example.org"}},
+		"authorizations": []string{base + "/authz/1"},
+		"finalize":       base + "/finalize/1",
+	}
+	if s.authzOK {
+		order["status"] = "ready"
+	}
+
+	switch r.URL.Path {
+	case "/directory":
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   base + "/nonce",
+			"newAccount": base + "/account",
+			"newOrder":   base + "/order",
+		})
+		return
+
+	case "/account":
+		w.Header().Set("Location", base+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"status":"valid"}`))
+		return
+
+	case "/order":
+		w.Header().Set("Location", base+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+
+	case "/order/1":
+		w.Header().Set("Location", base+"/order/1")
+
+	case "/authz/1":
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": "dns.example.org"},
+			"challenges": []map[string]string{
+				{"type": "dns-01", "url": base + "/chal/2", "token": "token2", "status": "pending"},
+				{"type": "http-01", "url": base + "/chal/1", "token": "token1", "status": status},
+			},
+		})
+		return
+
+	case "/chal/1":
+		// get the key authorization from AdGuard Home
+		rec := httptest.NewRecorder()
+		s.m.handleHTTP01(rec, httptest.NewRequest(http.MethodGet, acmeChallengePath+"token1", nil))
+		s.authzOK = strings.HasPrefix(rec.Body.String(), "token1.")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"type": "http-01", "url": base + "/chal/1", "token": "token1", "status": "processing",
+		})
+		return
+
+	case "/finalize/1":
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		_ = json.Unmarshal(s.payload(r), &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		assert.Nil(s.t, err)
+		s.cert = testACMECertificate(s.t, csr.PublicKey, s.key, csr.DNSNames, time.Now().Add(90*24*time.Hour))
+		w.Header().Set("Location", base+"/order/1")
+		order["status"] = "valid"
+		order["certificate"] = base + "/cert/1"
+
+	case "/cert/1":
+		_, _ = w.Write(s.cert)
+		return
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(order)
+}
+
+func TestACMEObtain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-acme")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	prevWorkDir := Context.workDir
+	Context.workDir = dir
+	defer func() { Context.workDir = prevWorkDir }()
+
+	m := newACMEManager()
+	s := &testACMEServer{t: t, m: m}
+	s.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.srv = httptest.NewServer(s)
+	defer s.srv.Close()
+
+	conf := acmeConfig{Enabled: true, DirectoryURL: s.srv.URL + "/directory", Email: "admin@example.org"}
+	certPEM, keyPEM, err := m.obtain(conf, []string{"dns.example.org"})
+	assert.Nil(t, err)
+	assert.True(t, s.authzOK)
+	assert.Equal(t, 0, len(m.tokens))
+
+	st := validateCertificates(string(certPEM), string(keyPEM), "")
+	assert.True(t, st.ValidPair)
+	assert.Equal(t, []string{"dns.example.org"}, st.DNSNames)
+
+	// the account key is kept
+	_, err = os.Stat(acmeFilePath(acmeAccountKeyFile))
+	assert.Nil(t, err)
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -23,19 +24,22 @@ const sessionCookieName = "agh_session"
 type session struct {
 	userName string
 	expire   uint32 // expiration time (in seconds)
+	totp     uint32 // 2FA state of the user at the time of log-in
 }
 
 /*
 expire byte[4]
 name_len byte[2]
 name byte[]
+totp byte[4] // optional
 */
 func (s *session) serialize() []byte {
 	var data []byte
-	data = make([]byte, 4+2+len(s.userName))
+	data = make([]byte, 4+2+len(s.userName)+4)
 	binary.BigEndian.PutUint32(data[0:4], s.expire)
 	binary.BigEndian.PutUint16(data[4:6], uint16(len(s.userName)))
 	copy(data[6:], []byte(s.userName))
+	binary.BigEndian.PutUint32(data[6+len(s.userName):], s.totp)
 	return data
 }
 
@@ -50,7 +54,12 @@ func (s *session) deserialize(data []byte) bool {
 	if len(data) < int(nameLen) {
 		return false
 	}
-	s.userName = string(data)
+	s.userName = string(data[:nameLen])
+	data = data[nameLen:]
+
+	if len(data) >= 4 {
+		s.totp = binary.BigEndian.Uint32(data[0:4])
+	}
 	return true
 }
 
@@ -61,12 +70,24 @@ type Auth struct {
 	lock       sync.Mutex
 	users      []User
 	sessionTTL uint32 // in seconds
+
+	totpPending map[string]string // user name -> 2FA secret waiting for confirmation
+	totpLast    map[string]uint64 // user name -> the last used 2FA counter value
+
+	tokens         []apiToken
+	tokensLastUsed map[string]uint32 // token ID -> the last use time (in seconds)
 }
 
 // User object
 type User struct {
 	Name         string `yaml:"name"`
-	PasswordHash string `yaml:"password"` // bcrypt hash
+	PasswordHash string `yaml:"password"`       // bcrypt hash
+	Role         string `yaml:"role,omitempty"` // "admin", "operator" or "read-only".  Empty: "admin"
+
+	TOTPSecret      string   `yaml:"totp_secret,omitempty"`       // base32-encoded 2FA secret.  Empty: 2FA is disabled
+	TOTPBackupCodes []string `yaml:"totp_backup_codes,omitempty"` // SHA-256 hashes of unused backup codes
+
+	tokenScope string // the scope of API token which makes the request on behalf of this user
 }
 
 // InitAuth - create a global object
@@ -74,6 +95,9 @@ func InitAuth(dbFilename string, users []User, sessionTTL uint32) *Auth {
 	a := Auth{}
 	a.sessionTTL = sessionTTL
 	a.sessions = make(map[string]*session)
+	a.totpPending = make(map[string]string)
+	a.totpLast = make(map[string]uint64)
+	a.tokensLastUsed = make(map[string]uint32)
 	rand.Seed(time.Now().UTC().Unix())
 	var err error
 	a.db, err = bbolt.Open(dbFilename, 0644, nil)
@@ -236,6 +260,16 @@ func (a *Auth) CheckSession(sess string) int {
 		a.lock.Unlock()
 		return 1
 	}
+	for _, u := range a.users {
+		if u.Name == s.userName && totpState(u) != s.totp {
+			// 2FA has been enabled or disabled after log-in
+			delete(a.sessions, sess)
+			key, _ := hex.DecodeString(sess)
+			a.removeSession(key)
+			a.lock.Unlock()
+			return -1
+		}
+	}
 
 	newExpire := now + a.sessionTTL
 	if s.expire/(24*60*60) != newExpire/(24*60*60) {
@@ -268,6 +302,7 @@ func (a *Auth) RemoveSession(sess string) {
 type loginJSON struct {
 	Name     string `json:"name"`
 	Password string `json:"password"`
+	TOTP     string `json:"totp"` // 2FA code or backup code
 }
 
 func getSession(u *User) []byte {
@@ -276,10 +311,33 @@ func getSession(u *User) []byte {
 	return hash[:]
 }
 
-func (a *Auth) httpCookie(req loginJSON) string {
-	u := a.UserFind(req.Name, req.Password)
+// Check the user name, password and 2FA code
+// Return an empty user if they are invalid.
+// Return backup=TRUE if backup code is used and the configuration must be saved.
+func (a *Auth) checkLogin(req loginJSON) (u User, backup bool, err error) {
+	u = a.UserFind(req.Name, req.Password)
 	if len(u.Name) == 0 {
-		return ""
+		return User{}, false, nil
+	}
+	if len(u.TOTPSecret) != 0 {
+		// a missing code is handled as an invalid one:
+		// otherwise the response would tell that the password is correct
+		var ok bool
+		ok, backup = a.checkTOTP(u, req.TOTP)
+		if !ok {
+			return User{}, false, nil
+		}
+	}
+	return u, backup, nil
+}
+
+// Create a session for the user
+// Return an empty string if the user name, password or 2FA code is invalid.
+// Return backup=TRUE if backup code is used and the configuration must be saved.
+func (a *Auth) httpCookie(req loginJSON) (cookie string, backup bool, err error) {
+	u, backup, err := a.checkLogin(req)
+	if err != nil || len(u.Name) == 0 {
+		return "", false, err
 	}
 
 	sess := getSession(&u)
@@ -293,10 +351,11 @@ func (a *Auth) httpCookie(req loginJSON) string {
 	s := session{}
 	s.userName = u.Name
 	s.expire = uint32(now.Unix()) + a.sessionTTL
+	s.totp = totpState(u)
 	a.addSession(sess, &s)
 
 	return fmt.Sprintf("%s=%s; Path=/; HttpOnly; Expires=%s",
-		sessionCookieName, hex.EncodeToString(sess), expstr)
+		sessionCookieName, hex.EncodeToString(sess), expstr), backup, nil
 }
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -307,13 +366,32 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cookie := Context.auth.httpCookie(req)
+	ip := requestIP(r)
+	if left := Context.authLimiter.check(ip, time.Now()); left > 0 {
+		addLoginAttempt(r, req.Name, loginBlocked)
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(left.Seconds())+1))
+		http.Error(w, "too many failed log-in attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	cookie, backup, err := Context.auth.httpCookie(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if len(cookie) == 0 {
-		log.Info("Auth: invalid user name or password: name='%s'", req.Name)
+		log.Info("Auth: invalid user name, password or 2FA code: name='%s'", req.Name)
+		Context.authLimiter.inc(ip, time.Now())
+		addLoginAttempt(r, req.Name, loginFailure)
 		time.Sleep(1 * time.Second)
-		http.Error(w, "invalid user name or password", http.StatusBadRequest)
+		http.Error(w, "invalid user name, password or 2FA code", http.StatusBadRequest)
 		return
 	}
+	Context.authLimiter.remove(ip)
+	addLoginAttempt(r, req.Name, loginSuccess)
+	if backup {
+		onConfigModified()
+	}
 
 	w.Header().Set("Set-Cookie", cookie)
 
@@ -343,6 +421,7 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
 func RegisterAuthHandlers() {
 	http.Handle("/control/login", postInstallHandler(ensureHandler("POST", handleLogin)))
 	httpRegister("GET", "/control/logout", handleLogout)
+	httpRegister(http.MethodGet, "/control/users/login_attempts", handleLoginAttempts)
 }
 
 func parseCookie(cookie string) string {
@@ -394,15 +473,21 @@ func optionalAuth(handler func(http.ResponseWriter, *http.Request)) func(http.Re
 				} else if r < 0 {
 					log.Info("Auth: invalid cookie value: %s", cookie)
 				}
+			} else if _, ok2 := Context.auth.findToken(r); ok2 {
+				ok = true
 			} else {
 				// there's no Cookie, check Basic authentication
 				user, pass, ok2 := r.BasicAuth()
-				if ok2 {
-					u := Context.auth.UserFind(user, pass)
+				ip := requestIP(r)
+				if ok2 && Context.authLimiter.check(ip, time.Now()) > 0 {
+					log.Info("Auth: %s: Basic authentication is blocked", ip)
+				} else if ok2 {
+					u := Context.auth.basicAuthUser(user, pass)
 					if len(u.Name) != 0 {
 						ok = true
 					} else {
 						log.Info("Auth: invalid Basic Authorization value")
+						Context.authLimiter.inc(ip, time.Now())
 					}
 				}
 			}
@@ -467,14 +552,28 @@ func (a *Auth) UserFind(login string, password string) User {
 	return User{}
 }
 
+// Find a user for Basic authentication
+// Basic authentication isn't allowed for the users with 2FA enabled.
+func (a *Auth) basicAuthUser(login string, password string) User {
+	u := a.UserFind(login, password)
+	if len(u.TOTPSecret) != 0 {
+		log.Info("Auth: %s: Basic authentication isn't allowed with 2FA", u.Name)
+		return User{}
+	}
+	return u
+}
+
 // GetCurrentUser - get the current user
 func (a *Auth) GetCurrentUser(r *http.Request) User {
 	cookie, err := r.Cookie(sessionCookieName)
 	if err != nil {
+		if t, ok := a.findToken(r); ok {
+			return t.user()
+		}
 		// there's no Cookie, check Basic authentication
 		user, pass, ok := r.BasicAuth()
 		if ok {
-			u := Context.auth.UserFind(user, pass)
+			u := Context.auth.basicAuthUser(user, pass)
 			return u
 		}
 		return User{}
@@ -496,6 +595,119 @@ func (a *Auth) GetCurrentUser(r *http.Request) User {
 	return User{}
 }
 
+// Find a user by name
+func (a *Auth) userByName(name string) (User, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, u := range a.users {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+// Replace the list of users
+// The sessions of the users that have been removed or whose password has changed are removed.
+func (a *Auth) setUsers(users []User) {
+	a.lock.Lock()
+	hashes := map[string]string{}
+	for _, u := range users {
+		hashes[u.Name] = u.PasswordHash
+	}
+	var removed []string
+	for _, u := range a.users {
+		if hashes[u.Name] != u.PasswordHash {
+			removed = append(removed, u.Name)
+		}
+	}
+	a.users = users
+	a.lock.Unlock()
+
+	for _, name := range removed {
+		a.removeUserSessions(name, "")
+	}
+}
+
+// Remove all sessions of the user except the specified one
+func (a *Auth) removeUserSessions(name string, except string) {
+	var keys []string
+	a.lock.Lock()
+	for k, s := range a.sessions {
+		if s.userName == name && k != except {
+			keys = append(keys, k)
+			delete(a.sessions, k)
+		}
+	}
+	a.lock.Unlock()
+
+	for _, k := range keys {
+		key, _ := hex.DecodeString(k)
+		a.removeSession(key)
+	}
+}
+
+// Get the session ID that is shown to users: the session name itself is a secret
+func sessionID(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(hash[:8])
+}
+
+// Information about a session
+type sessionInfo struct {
+	ID      string `json:"id"`
+	User    string `json:"user"`
+	Expire  string `json:"expire"`  // RFC3339
+	Current bool   `json:"current"` // the session of this request
+}
+
+// Get the list of sessions
+// Empty user name: the sessions of all users.
+func (a *Auth) getSessions(user string, current string) []sessionInfo {
+	list := []sessionInfo{}
+	now := uint32(time.Now().UTC().Unix())
+	a.lock.Lock()
+	for k, s := range a.sessions {
+		if (len(user) != 0 && s.userName != user) || s.expire <= now {
+			continue
+		}
+		list = append(list, sessionInfo{
+			ID:      sessionID(k),
+			User:    s.userName,
+			Expire:  time.Unix(int64(s.expire), 0).Format(time.RFC3339),
+			Current: k == current,
+		})
+	}
+	a.lock.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].User != list[j].User {
+			return list[i].User < list[j].User
+		}
+		return list[i].Expire < list[j].Expire
+	})
+	return list
+}
+
+// Remove the session by its ID
+// Empty user name: the session of any user.
+// Return FALSE if there's no such session.
+func (a *Auth) removeSessionByID(id string, user string) bool {
+	a.lock.Lock()
+	name := ""
+	for k, s := range a.sessions {
+		if sessionID(k) == id && (len(user) == 0 || s.userName == user) {
+			name = k
+			break
+		}
+	}
+	a.lock.Unlock()
+	if len(name) == 0 {
+		return false
+	}
+	a.RemoveSession(name)
+	return true
+}
+
 // GetUsers - get users
 func (a *Auth) GetUsers() []User {
 	a.lock.Lock()
@@ -0,0 +1,206 @@
+// Brute-force protection of log-in and the log of log-in attempts
+
+package home
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	authDefaultAttempts = 5  // the default number of failed log-in attempts after which the IP address is blocked
+	authDefaultBlockMin = 15 // the default blocking time (in minutes)
+
+	loginLogFile       = "login_attempts.json" // in the data directory
+	loginLogMaxEntries = 1000                  // the number of entries kept in memory
+)
+
+// The results of log-in attempts
+const (
+	loginSuccess = "success"
+	loginFailure = "failure"
+	loginBlocked = "blocked" // the request has been rejected because the IP address is blocked
+)
+
+type authAttempts struct {
+	failures int       // the number of failed attempts
+	start    time.Time // the time of the first failed attempt
+	until    time.Time // the IP address is blocked until this time
+}
+
+// Limit the number of failed log-in attempts from an IP address
+type authRateLimiter struct {
+	lock     sync.Mutex
+	ips      map[string]*authAttempts
+	attempts int           // failed attempts within blockDur after which the IP address is blocked.  0: disabled
+	blockDur time.Duration // blocking time
+}
+
+func newAuthRateLimiter(attempts int, blockMin uint32) *authRateLimiter {
+	return &authRateLimiter{
+		ips:      map[string]*authAttempts{},
+		attempts: attempts,
+		blockDur: time.Duration(blockMin) * time.Minute,
+	}
+}
+
+// Get the time left until the IP address is unblocked
+// Return 0 if the IP address isn't blocked.
+func (l *authRateLimiter) check(ip string, now time.Time) time.Duration {
+	if l == nil || l.attempts <= 0 {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	a, ok := l.ips[ip]
+	if !ok || !now.Before(a.until) {
+		return 0
+	}
+	return a.until.Sub(now)
+}
+
+// Count a failed attempt
+func (l *authRateLimiter) inc(ip string, now time.Time) {
+	if l == nil || l.attempts <= 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// remove old entries
+	for k, a := range l.ips {
+		if now.Sub(a.start) >= l.blockDur && !now.Before(a.until) {
+			delete(l.ips, k)
+		}
+	}
+
+	a, ok := l.ips[ip]
+	if !ok {
+		a = &authAttempts{start: now}
+		l.ips[ip] = a
+	}
+	a.failures++
+	if a.failures >= l.attempts {
+		a.until = now.Add(l.blockDur)
+		a.failures = 0
+		a.start = now
+		log.Info("Auth: %s: blocked for %s after %d failed log-in attempts", ip, l.blockDur, l.attempts)
+	}
+}
+
+// Reset the counter after successful log-in
+func (l *authRateLimiter) remove(ip string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	delete(l.ips, ip)
+	l.lock.Unlock()
+}
+
+// Log-in attempt
+type loginEntry struct {
+	Time   string `json:"time"` // RFC3339
+	User   string `json:"user"` // the user name entered
+	IP     string `json:"ip"`
+	Result string `json:"result"` // "success", "failure" or "blocked"
+}
+
+// The log of log-in attempts
+// The entries are appended to the file and the last entries are kept in memory.
+type loginLog struct {
+	lock     sync.Mutex
+	filename string
+	entries  []loginEntry
+}
+
+func newLoginLog(filename string) *loginLog {
+	l := &loginLog{filename: filename}
+	readLines(filename, func(line []byte) {
+		e := loginEntry{}
+		if json.Unmarshal(line, &e) != nil {
+			return
+		}
+		l.entries = append(l.entries, e)
+		if len(l.entries) > loginLogMaxEntries {
+			l.entries = l.entries[1:]
+		}
+	})
+	return l
+}
+
+func (l *loginLog) add(e loginEntry) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = append(l.entries, e)
+	if len(l.entries) > loginLogMaxEntries {
+		l.entries = l.entries[1:]
+	}
+
+	err := appendJSONLine(l.filename, e)
+	if err != nil {
+		log.Error("Auth: %s", err)
+	}
+}
+
+// Get the entries, the newest first
+func (l *loginLog) get() []loginEntry {
+	list := []loginEntry{}
+	if l == nil {
+		return list
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		list = append(list, l.entries[i])
+	}
+	return list
+}
+
+// Get IP address of the client
+func requestIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// Record log-in attempt
+func addLoginAttempt(r *http.Request, user string, result string) {
+	Context.loginLog.add(loginEntry{
+		Time:   time.Now().Format(time.RFC3339),
+		User:   user,
+		IP:     requestIP(r),
+		Result: result,
+	})
+}
+
+func handleLoginAttempts(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		httpError(w, http.StatusForbidden, "not allowed")
+		return
+	}
+	writeJSON(w, Context.loginLog.get())
+}
+
+// Open the log of log-in attempts in the data directory and initialize rate limiter
+func initLoginProtection() {
+	config.RLock()
+	attempts := config.AuthAttempts
+	blockMin := config.AuthBlockMin
+	config.RUnlock()
+
+	Context.loginLog = newLoginLog(filepath.Join(Context.getDataDir(), loginLogFile))
+	Context.authLimiter = newAuthRateLimiter(attempts, blockMin)
+}
@@ -0,0 +1,88 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthRateLimiter(t *testing.T) {
+	l := newAuthRateLimiter(3, 10)
+	now := time.Now()
+	l.inc("1.2.3.4", now)
+	l.inc("1.2.3.4", now)
+	assert.Equal(t, time.Duration(0), l.check("1.2.3.4", now))
+	l.inc("1.2.3.4", now)
+	assert.Equal(t, 10*time.Minute, l.check("1.2.3.4", now))
+	assert.Equal(t, time.Duration(0), l.check("1.1.1.1", now))
+
+	// unblocked after the blocking time
+	assert.Equal(t, time.Duration(0), l.check("1.2.3.4", now.Add(10*time.Minute)))
+
+	// the counter is reset after successful log-in
+	l.inc("1.1.1.1", now)
+	l.inc("1.1.1.1", now)
+	l.remove("1.1.1.1")
+	l.inc("1.1.1.1", now)
+	assert.Equal(t, time.Duration(0), l.check("1.1.1.1", now))
+
+	// the old failures are forgotten
+	l.inc("1.1.1.1", now.Add(20*time.Minute))
+	l.inc("1.1.1.1", now.Add(20*time.Minute))
+	assert.Equal(t, time.Duration(0), l.check("1.1.1.1", now.Add(20*time.Minute)))
+
+	// disabled
+	l = newAuthRateLimiter(0, 10)
+	l.inc("1.2.3.4", now)
+	assert.Equal(t, time.Duration(0), l.check("1.2.3.4", now))
+}
+
+func TestAuthLoginAttempts(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	a := InitAuth(filepath.Join(dir, "sessions.db"), []User{User{Name: "name", PasswordHash: string(hash)}}, 60)
+	defer a.Close()
+	prevAuth, prevLog, prevLimiter := Context.auth, Context.loginLog, Context.authLimiter
+	Context.auth = a
+	Context.loginLog = newLoginLog(filepath.Join(dir, loginLogFile))
+	Context.authLimiter = newAuthRateLimiter(2, 1)
+	defer func() {
+		Context.auth, Context.loginLog, Context.authLimiter = prevAuth, prevLog, prevLimiter
+	}()
+
+	login := func(password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/control/login",
+			strings.NewReader(`{"name":"name","password":"`+password+`"}`))
+		r.RemoteAddr = "1.2.3.4:5678"
+		w := httptest.NewRecorder()
+		handleLogin(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, login("password").Code)
+	assert.Equal(t, http.StatusBadRequest, login("bad").Code)
+	assert.Equal(t, http.StatusBadRequest, login("bad").Code)
+	w := login("password")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEqual(t, "", w.Header().Get("Retry-After"))
+
+	list := Context.loginLog.get()
+	assert.Equal(t, 4, len(list))
+	assert.Equal(t, loginBlocked, list[0].Result)
+	assert.Equal(t, loginFailure, list[1].Result)
+	assert.Equal(t, loginSuccess, list[3].Result)
+	assert.Equal(t, "name", list[3].User)
+	assert.Equal(t, "1.2.3.4", list[3].IP)
+
+	// the log is loaded from file
+	assert.Equal(t, list, newLoginLog(filepath.Join(dir, loginLogFile)).get())
+}
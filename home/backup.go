@@ -0,0 +1,493 @@
+// Configuration backup, restore and scheduled snapshots
+
+package home
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/AdguardTeam/golibs/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	backupConfigFile   = "AdGuardHome.yaml"
+	backupLeasesFile   = "leases.db" // DHCP server stores the leases in this file in the working directory
+	backupManifestFile = "manifest.json"
+
+	backupDir           = "backups" // snapshots, in the data directory
+	backupPrefix        = "backup-"
+	backupSuffix        = ".tar.gz"
+	backupTimeFormat    = "20060102-150405"
+	backupMaxSize       = 64 * 1024 * 1024 // the maximum size of an archive
+	backupCheckInterval = 10 * time.Minute // the interval of checking whether a snapshot must be created
+
+	backupDefaultInterval = 24 // in hours
+	backupDefaultKeep     = 7
+)
+
+// Settings of scheduled snapshots
+type backupConfig struct {
+	Interval uint32 `yaml:"interval" json:"interval"` // in hours.  0: snapshots are disabled
+	Keep     uint32 `yaml:"keep" json:"keep"`         // the number of snapshots to keep
+}
+
+func checkBackupConfig(conf backupConfig) error {
+	if conf.Interval != 0 && conf.Keep == 0 {
+		return fmt.Errorf("keep must be greater than 0")
+	}
+	return nil
+}
+
+// The description of the archive
+type backupManifest struct {
+	Version       string `json:"version"` // the version of AdGuard Home which created the archive
+	SchemaVersion int    `json:"schema_version"`
+	Time          string `json:"time"` // RFC3339
+}
+
+// The data of the archive
+type backupArchive struct {
+	manifest backupManifest
+	config   []byte            // AdGuardHome.yaml
+	leases   []json.RawMessage // static DHCP leases
+}
+
+// Get static leases from DHCP leases file
+func backupStaticLeases(fn string) ([]json.RawMessage, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var list []json.RawMessage
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	static := []json.RawMessage{}
+	for _, l := range list {
+		if isStaticLease(l) {
+			static = append(static, l)
+		}
+	}
+	return static, nil
+}
+
+// Return TRUE if the lease object from leases file is static
+func isStaticLease(data []byte) bool {
+	lease := struct {
+		Expiry int64 `json:"exp"`
+	}{}
+	return json.Unmarshal(data, &lease) == nil && lease.Expiry == 1
+}
+
+// Create an archive with the current configuration
+func backupCreate() ([]byte, error) {
+	conf, err := config.marshal()
+	if err != nil {
+		return nil, err
+	}
+	leases, err := backupStaticLeases(filepath.Join(Context.workDir, backupLeasesFile))
+	if err != nil {
+		return nil, err
+	}
+	leasesData, _ := json.Marshal(leases)
+
+	manifest, _ := json.Marshal(backupManifest{
+		Version:       versionString,
+		SchemaVersion: currentSchemaVersion,
+		Time:          time.Now().Format(time.RFC3339),
+	})
+
+	return backupPack([]backupFile{
+		{backupManifestFile, manifest},
+		{backupConfigFile, conf},
+		{backupLeasesFile, leasesData},
+	})
+}
+
+type backupFile struct {
+	name string
+	data []byte
+}
+
+// Pack files into tar.gz archive
+func backupPack(files []backupFile) ([]byte, error) {
+	now := time.Now()
+	buf := bytes.Buffer{}
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    f.name,
+			Mode:    0600,
+			Size:    int64(len(f.data)),
+			ModTime: now,
+		}
+		err := tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = tw.Write(f.data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Parse and validate the archive
+func backupParse(data []byte) (*backupArchive, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive: %s", err)
+	}
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive: %s", err)
+		}
+		d, err := ioutil.ReadAll(io.LimitReader(tr, backupMaxSize))
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive: %s", err)
+		}
+		files[hdr.Name] = d
+	}
+
+	b := &backupArchive{}
+	err = json.Unmarshal(files[backupManifestFile], &b.manifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", backupManifestFile, err)
+	}
+	b.config = files[backupConfigFile]
+	if len(b.config) == 0 {
+		return nil, fmt.Errorf("%s not found", backupConfigFile)
+	}
+	err = backupCheckConfig(b.config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", backupConfigFile, err)
+	}
+
+	leases, ok := files[backupLeasesFile]
+	if ok {
+		err = json.Unmarshal(leases, &b.leases)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", backupLeasesFile, err)
+		}
+		for _, l := range b.leases {
+			if !isStaticLease(l) {
+				return nil, fmt.Errorf("invalid %s: not a static lease: %s", backupLeasesFile, l)
+			}
+		}
+	}
+	return b, nil
+}
+
+// Check the configuration file from the archive
+// The configuration of an older schema is upgraded on start.
+func backupCheckConfig(data []byte) error {
+	diskConfig := map[string]interface{}{}
+	err := yaml.Unmarshal(data, &diskConfig)
+	if err != nil {
+		return err
+	}
+	schemaVersion := 0
+	if v, ok := diskConfig["schema_version"]; ok {
+		schemaVersion, ok = v.(int)
+		if !ok {
+			return fmt.Errorf("invalid schema_version")
+		}
+	}
+	if schemaVersion > currentSchemaVersion {
+		return fmt.Errorf("schema_version %d is newer than supported %d", schemaVersion, currentSchemaVersion)
+	}
+	if schemaVersion != currentSchemaVersion {
+		return nil
+	}
+
+	conf := configuration{}
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		return err
+	}
+	if conf.BindPort <= 0 || conf.BindPort > 0xffff {
+		return fmt.Errorf("invalid bind_port: %d", conf.BindPort)
+	}
+	if conf.DNS.Port < 0 || conf.DNS.Port > 0xffff {
+		return fmt.Errorf("invalid dns.port: %d", conf.DNS.Port)
+	}
+	for _, u := range conf.Users {
+		if len(u.Name) == 0 || !isValidRole(u.Role) {
+			return fmt.Errorf("invalid user %q", u.Name)
+		}
+	}
+	return nil
+}
+
+// Write the files from the archive
+// Static leases in the leases file are replaced, dynamic leases are kept.
+func backupApply(b *backupArchive) error {
+	if b.leases != nil {
+		fn := filepath.Join(Context.workDir, backupLeasesFile)
+		var list []json.RawMessage
+		data, err := ioutil.ReadFile(fn)
+		if err == nil {
+			_ = json.Unmarshal(data, &list)
+		}
+		leases := append([]json.RawMessage{}, b.leases...)
+		for _, l := range list {
+			if !isStaticLease(l) {
+				leases = append(leases, l)
+			}
+		}
+		data, _ = json.Marshal(leases)
+		err = file.SafeWrite(fn, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return file.SafeWrite(config.getConfigFilename(), b.config)
+}
+
+// Get the list of snapshots, the newest first
+func backupSnapshots() []backupSnapshotJSON {
+	dir := filepath.Join(Context.getDataDir(), backupDir)
+	files, _ := ioutil.ReadDir(dir)
+	list := []backupSnapshotJSON{}
+	for _, f := range files {
+		t, ok := backupSnapshotTime(f.Name())
+		if !ok {
+			continue
+		}
+		list = append(list, backupSnapshotJSON{
+			Name: f.Name(),
+			Time: t.Format(time.RFC3339),
+			Size: f.Size(),
+			t:    t,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].t.After(list[j].t)
+	})
+	return list
+}
+
+// Get the time of snapshot from its file name
+func backupSnapshotTime(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+		return time.Time{}, false
+	}
+	s := name[len(backupPrefix) : len(name)-len(backupSuffix)]
+	t, err := time.Parse(backupTimeFormat, s)
+	return t, err == nil
+}
+
+// Create a snapshot and remove the old ones
+func backupCreateSnapshot(keep uint32) error {
+	data, err := backupCreate()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(Context.getDataDir(), backupDir)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	name := backupPrefix + time.Now().UTC().Format(backupTimeFormat) + backupSuffix
+	err = file.SafeWrite(filepath.Join(dir, name), data)
+	if err != nil {
+		return err
+	}
+	log.Debug("Backup: created snapshot %s", name)
+
+	list := backupSnapshots()
+	for i := int(keep); i < len(list); i++ {
+		err = os.Remove(filepath.Join(dir, list[i].Name))
+		if err != nil {
+			log.Error("Backup: %s", err)
+		}
+	}
+	return nil
+}
+
+// Create snapshots periodically
+func backupLoop() {
+	for {
+		time.Sleep(backupCheckInterval)
+
+		config.RLock()
+		conf := config.Backup
+		config.RUnlock()
+		if conf.Interval == 0 {
+			continue
+		}
+
+		list := backupSnapshots()
+		if len(list) != 0 && time.Since(list[0].t) < time.Duration(conf.Interval)*time.Hour {
+			continue
+		}
+		err := backupCreateSnapshot(conf.Keep)
+		if err != nil {
+			log.Error("Backup: can't create snapshot: %s", err)
+		}
+	}
+}
+
+type backupSnapshotJSON struct {
+	Name string `json:"name"`
+	Time string `json:"time"` // RFC3339
+	Size int64  `json:"size"` // in bytes
+
+	t time.Time
+}
+
+// Download the archive with the current configuration or a snapshot
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		httpError(w, http.StatusForbidden, "not allowed")
+		return
+	}
+
+	var data []byte
+	var err error
+	name := r.URL.Query().Get("snapshot")
+	if len(name) != 0 {
+		if _, ok := backupSnapshotTime(name); !ok || strings.ContainsAny(name, `/\`) {
+			httpError(w, http.StatusBadRequest, "invalid snapshot name")
+			return
+		}
+		data, err = ioutil.ReadFile(filepath.Join(Context.getDataDir(), backupDir, name))
+	} else {
+		name = backupPrefix + time.Now().UTC().Format(backupTimeFormat) + backupSuffix
+		data, err = backupCreate()
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	_, _ = w.Write(data)
+}
+
+// Restore the configuration from the archive (request body) or a snapshot and restart
+func handleBackupRestore(w http.ResponseWriter, r *http.Request) {
+	var data []byte
+	var err error
+	name := r.URL.Query().Get("snapshot")
+	if len(name) != 0 {
+		if _, ok := backupSnapshotTime(name); !ok || strings.ContainsAny(name, `/\`) {
+			httpError(w, http.StatusBadRequest, "invalid snapshot name")
+			return
+		}
+		data, err = ioutil.ReadFile(filepath.Join(Context.getDataDir(), backupDir, name))
+	} else {
+		data, err = ioutil.ReadAll(io.LimitReader(r.Body, backupMaxSize))
+	}
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	b, err := backupParse(data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	log.Info("Backup: restoring configuration from the archive created by %s at %s", b.manifest.Version, b.manifest.Time)
+
+	returnOK(w)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	go func() {
+		Context.controlLock.Lock()
+		log.Info("Stopping all tasks")
+		cleanup()
+		stopHTTPServer()
+		err := backupApply(b)
+		if err != nil {
+			log.Error("Backup: can't restore configuration: %s", err)
+		}
+		cleanupAlways()
+		binName, err := os.Executable()
+		if err != nil {
+			log.Fatalf("os.Executable(): %s", err)
+		}
+		restartProcess(binName)
+	}()
+}
+
+func handleBackupSnapshots(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		httpError(w, http.StatusForbidden, "not allowed")
+		return
+	}
+	writeJSON(w, backupSnapshots())
+}
+
+func handleBackupConfig(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	conf := config.Backup
+	config.RUnlock()
+	writeJSON(w, conf)
+}
+
+func handleBackupSetConfig(w http.ResponseWriter, r *http.Request) {
+	conf := backupConfig{}
+	err := json.NewDecoder(r.Body).Decode(&conf)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+	err = checkBackupConfig(conf)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	config.Backup = conf
+	config.Unlock()
+	onConfigModified()
+	returnOK(w)
+}
+
+// RegisterBackupHandlers - register handlers
+func RegisterBackupHandlers() {
+	httpRegister(http.MethodGet, "/control/backup", handleBackup)
+	httpRegister(http.MethodPost, "/control/backup/restore", handleBackupRestore)
+	httpRegister(http.MethodGet, "/control/backup/snapshots", handleBackupSnapshots)
+	httpRegister(http.MethodGet, "/control/backup/status", handleBackupConfig)
+	httpRegister(http.MethodPost, "/control/backup/config", handleBackupSetConfig)
+}
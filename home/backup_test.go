@@ -0,0 +1,96 @@
+package home
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackup(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	prevWorkDir, prevConfigFilename := Context.workDir, Context.configFilename
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	defer func() {
+		Context.workDir, Context.configFilename = prevWorkDir, prevConfigFilename
+	}()
+
+	leasesFile := filepath.Join(dir, backupLeasesFile)
+	_ = ioutil.WriteFile(leasesFile, []byte(`[{"mac":"AA==","ip":"AQIDBA==","host":"static","exp":1},{"mac":"AQ==","ip":"AQIDBQ==","host":"dynamic","exp":1600000000}]`), 0644)
+
+	data, err := backupCreate()
+	assert.Nil(t, err)
+	b, err := backupParse(data)
+	assert.Nil(t, err)
+	assert.Equal(t, currentSchemaVersion, b.manifest.SchemaVersion)
+	assert.Equal(t, 1, len(b.leases))
+	assert.Equal(t, `{"mac":"AA==","ip":"AQIDBA==","host":"static","exp":1}`, string(b.leases[0]))
+
+	// static leases are replaced, dynamic leases are kept
+	_ = ioutil.WriteFile(leasesFile, []byte(`[{"mac":"Ag==","ip":"AQIDBg==","host":"static2","exp":1},{"mac":"Aw==","ip":"AQIDBw==","host":"dynamic2","exp":1600000000}]`), 0644)
+	assert.Nil(t, backupApply(b))
+	leases, _ := ioutil.ReadFile(leasesFile)
+	assert.Equal(t, `[{"mac":"AA==","ip":"AQIDBA==","host":"static","exp":1},{"mac":"Aw==","ip":"AQIDBw==","host":"dynamic2","exp":1600000000}]`, string(leases))
+	conf, _ := ioutil.ReadFile(config.getConfigFilename())
+	assert.Equal(t, string(b.config), string(conf))
+
+	// invalid archives
+	manifest, _ := json.Marshal(backupManifest{SchemaVersion: currentSchemaVersion})
+	check := func(files []backupFile) error {
+		data, _ := backupPack(files)
+		_, err := backupParse(data)
+		return err
+	}
+	_, err = backupParse([]byte("not an archive"))
+	assert.NotNil(t, err)
+	assert.NotNil(t, check([]backupFile{{backupManifestFile, manifest}}))
+	assert.NotNil(t, check([]backupFile{{backupConfigFile, b.config}}))
+	assert.NotNil(t, check([]backupFile{{backupManifestFile, manifest}, {backupConfigFile, []byte("schema_version: 100\n")}}))
+	assert.NotNil(t, check([]backupFile{{backupManifestFile, manifest}, {backupConfigFile, []byte("schema_version: 6\nbind_port: 100000\n")}}))
+	assert.NotNil(t, check([]backupFile{{backupManifestFile, manifest}, {backupConfigFile, b.config}, {backupLeasesFile, []byte(`[{"exp":100}]`)}}))
+	assert.NotNil(t, check([]backupFile{{backupManifestFile, manifest}, {backupConfigFile, b.config}, {backupLeasesFile, []byte(`{}`)}}))
+
+	// the configuration of an older schema is upgraded on start
+	assert.Nil(t, check([]backupFile{{backupManifestFile, manifest}, {backupConfigFile, []byte("schema_version: 3\n")}}))
+}
+
+func TestBackupSnapshots(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	prevWorkDir, prevConfigFilename := Context.workDir, Context.configFilename
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	defer func() {
+		Context.workDir, Context.configFilename = prevWorkDir, prevConfigFilename
+	}()
+
+	snapshotsDir := filepath.Join(Context.getDataDir(), backupDir)
+	_ = os.MkdirAll(snapshotsDir, 0755)
+	now := time.Now().UTC()
+	for i := 1; i <= 3; i++ {
+		name := backupPrefix + now.Add(-time.Duration(i)*time.Hour).Format(backupTimeFormat) + backupSuffix
+		_ = ioutil.WriteFile(filepath.Join(snapshotsDir, name), []byte("data"), 0644)
+	}
+	_ = ioutil.WriteFile(filepath.Join(snapshotsDir, "other.tar.gz"), []byte("data"), 0644)
+
+	assert.Nil(t, backupCreateSnapshot(2))
+	list := backupSnapshots()
+	assert.Equal(t, 2, len(list))
+	assert.True(t, list[0].t.After(list[1].t))
+	assert.Equal(t, backupPrefix+now.Add(-time.Hour).Format(backupTimeFormat)+backupSuffix, list[1].Name)
+
+	// other files are kept
+	_, err := os.Stat(filepath.Join(snapshotsDir, "other.tar.gz"))
+	assert.Nil(t, err)
+
+	_, ok := backupSnapshotTime("backup-20200101-000000.tar.gz")
+	assert.True(t, ok)
+	_, ok = backupSnapshotTime("backup-x.tar.gz")
+	assert.False(t, ok)
+}
@@ -2,14 +2,29 @@ package home
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"regexp"
+	"strings"
+	"sync"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/utils"
 	"github.com/AdguardTeam/urlfilter/rules"
 )
 
-var serviceRules map[string][]*rules.NetworkRule // service name -> filtering rules
+var serviceRules map[string][]*rules.NetworkRule // service name -> filtering rules (built-in and custom services)
+var serviceRulesLock sync.RWMutex
+
+// customService - the service defined by the user
+// It's used the same way as the built-in services.
+type customService struct {
+	Name    string   `yaml:"name" json:"name"`       // e.g. "my_game"
+	Domains []string `yaml:"domains" json:"domains"` // the domain names (with subdomains) of the service
+}
+
+var serviceNameRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
 
 type svc struct {
 	name  string
@@ -119,26 +134,107 @@ var serviceRulesArray = []svc{
 	}},
 }
 
+// Create filtering rules from the list of rule strings
+func parseServiceRules(list []string) []*rules.NetworkRule {
+	netRules := []*rules.NetworkRule{}
+	for _, text := range list {
+		rule, err := rules.NewNetworkRule(text, 0)
+		if err != nil {
+			log.Error("rules.NewNetworkRule: %s  rule: %s", err, text)
+			continue
+		}
+		netRules = append(netRules, rule)
+	}
+	return netRules
+}
+
 // convert array to map
 func initServices() {
-	serviceRules = make(map[string][]*rules.NetworkRule)
+	_ = setCustomServices(nil)
+}
+
+// Return TRUE if the service is one of the built-in services
+func isBuiltinService(name string) bool {
 	for _, s := range serviceRulesArray {
-		netRules := []*rules.NetworkRule{}
-		for _, text := range s.rules {
-			rule, err := rules.NewNetworkRule(text, 0)
+		if s.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Return TRUE if the service (built-in or custom) exists
+func serviceExists(name string) bool {
+	serviceRulesLock.RLock()
+	_, ok := serviceRules[name]
+	serviceRulesLock.RUnlock()
+	return ok
+}
+
+// Check the custom services
+func checkCustomServices(list []customService) error {
+	names := map[string]bool{}
+	for _, s := range list {
+		if !serviceNameRegexp.MatchString(s.Name) {
+			return fmt.Errorf("invalid service name: %s", s.Name)
+		}
+		if isBuiltinService(s.Name) {
+			return fmt.Errorf("service %s is a built-in service", s.Name)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("duplicate service: %s", s.Name)
+		}
+		names[s.Name] = true
+
+		if len(s.Domains) == 0 {
+			return fmt.Errorf("service %s: no domain names", s.Name)
+		}
+		for _, d := range s.Domains {
+			err := utils.IsValidHostname(d)
 			if err != nil {
-				log.Error("rules.NewNetworkRule: %s  rule: %s", err, text)
-				continue
+				return fmt.Errorf("service %s: invalid domain name %s: %s", s.Name, d, err)
 			}
-			netRules = append(netRules, rule)
 		}
-		serviceRules[s.name] = netRules
 	}
+	return nil
+}
+
+// Set the custom services: the built-in services and the specified custom services are available after this call
+func setCustomServices(list []customService) error {
+	err := checkCustomServices(list)
+	if err != nil {
+		return err
+	}
+
+	m := make(map[string][]*rules.NetworkRule)
+	for _, s := range serviceRulesArray {
+		m[s.name] = parseServiceRules(s.rules)
+	}
+	for _, s := range list {
+		texts := []string{}
+		for _, d := range s.Domains {
+			texts = append(texts, "||"+strings.ToLower(d)+"^")
+		}
+		m[s.Name] = parseServiceRules(texts)
+	}
+
+	serviceRulesLock.Lock()
+	serviceRules = m
+	serviceRulesLock.Unlock()
+	return nil
 }
 
 // ApplyBlockedServices - set blocked services settings for this DNS request
 func ApplyBlockedServices(setts *dnsfilter.RequestFilteringSettings, list []string) {
 	setts.ServicesRules = []dnsfilter.ServiceEntry{}
+	addBlockedServices(setts, list)
+}
+
+// Add services to the list of blocked services for this DNS request
+func addBlockedServices(setts *dnsfilter.RequestFilteringSettings, list []string) {
+	serviceRulesLock.RLock()
+	defer serviceRulesLock.RUnlock()
+
 	for _, name := range list {
 		rules, ok := serviceRules[name]
 
@@ -147,6 +243,10 @@ func ApplyBlockedServices(setts *dnsfilter.RequestFilteringSettings, list []stri
 			continue
 		}
 
+		if hasService(setts.ServicesRules, name) {
+			continue
+		}
+
 		s := dnsfilter.ServiceEntry{}
 		s.Name = name
 		s.Rules = rules
@@ -175,13 +275,78 @@ func handleBlockedServicesSet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tx := beginConfigTx()
 	config.Lock()
 	config.DNS.BlockedServices = list
 	config.Unlock()
 
 	log.Debug("Updated blocked services list: %d", len(list))
 
-	err = writeAllConfigsAndReloadDNS()
+	err = tx.commit()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	httpOK(r, w)
+}
+
+// Get the names of all available services (built-in and custom)
+func handleBlockedServicesServices(w http.ResponseWriter, r *http.Request) {
+	list := []string{}
+	for _, s := range serviceRulesArray {
+		list = append(list, s.name)
+	}
+	config.RLock()
+	for _, s := range config.DNS.CustomServices {
+		list = append(list, s.Name)
+	}
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleBlockedServicesCustom(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	list := append([]customService{}, config.DNS.CustomServices...)
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleBlockedServicesCustomSet(w http.ResponseWriter, r *http.Request) {
+	list := []customService{}
+	err := json.NewDecoder(r.Body).Decode(&list)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	tx := beginConfigTx()
+	config.Lock()
+	err = setCustomServices(list)
+	if err == nil {
+		config.DNS.CustomServices = list
+	}
+	config.Unlock()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	log.Debug("Updated custom services: %d", len(list))
+
+	err = tx.commit()
 	if err != nil {
 		httpError(w, http.StatusBadRequest, "%s", err)
 		return
@@ -194,4 +359,17 @@ func handleBlockedServicesSet(w http.ResponseWriter, r *http.Request) {
 func RegisterBlockedServicesHandlers() {
 	httpRegister(http.MethodGet, "/control/blocked_services/list", handleBlockedServicesList)
 	httpRegister(http.MethodPost, "/control/blocked_services/set", handleBlockedServicesSet)
+	httpRegister(http.MethodGet, "/control/blocked_services/services", handleBlockedServicesServices)
+	httpRegister(http.MethodGet, "/control/blocked_services/custom", handleBlockedServicesCustom)
+	httpRegister(http.MethodPost, "/control/blocked_services/custom/set", handleBlockedServicesCustomSet)
+}
+
+// Return TRUE if the service is in the list
+func hasService(list []dnsfilter.ServiceEntry, name string) bool {
+	for _, s := range list {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,51 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCustomServices(t *testing.T) {
+	initServices()
+	defer initServices()
+
+	for _, list := range [][]customService{
+		{{Name: "", Domains: []string{"example.org"}}},
+		{{Name: "My Game", Domains: []string{"example.org"}}},
+		{{Name: "youtube", Domains: []string{"example.org"}}},
+		{{Name: "game", Domains: []string{"example.org"}}, {Name: "game", Domains: []string{"example.net"}}},
+		{{Name: "game"}},
+		{{Name: "game", Domains: []string{"bad..host"}}},
+	} {
+		assert.NotNil(t, setCustomServices(list), "%v", list)
+	}
+	assert.False(t, serviceExists("game"))
+
+	assert.Nil(t, setCustomServices([]customService{{Name: "game", Domains: []string{"Game.example.org", "cdn.example.net"}}}))
+	assert.True(t, serviceExists("game"))
+	assert.True(t, serviceExists("youtube"))
+
+	setts := dnsfilter.RequestFilteringSettings{}
+	ApplyBlockedServices(&setts, []string{"game", "unknown"})
+	assert.Equal(t, 1, len(setts.ServicesRules))
+	assert.Equal(t, "game", setts.ServicesRules[0].Name)
+	assert.Equal(t, 2, len(setts.ServicesRules[0].Rules))
+	assert.True(t, setts.ServicesRules[0].Rules[0].Match(rules.NewRequestForHostname("www.game.example.org")))
+	assert.False(t, setts.ServicesRules[0].Rules[0].Match(rules.NewRequestForHostname("example.org")))
+
+	// the custom services are removed
+	initServices()
+	assert.False(t, serviceExists("game"))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/control/blocked_services/custom/set", strings.NewReader(`[{"name":"youtube","domains":["example.org"]}]`))
+	handleBlockedServicesCustomSet(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 0, len(config.DNS.CustomServices))
+}
@@ -0,0 +1,401 @@
+// Block page: HTTP(S) server that answers the requests to the blocked domains
+
+package home
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	blockPageDefaultUnblockMin = 60
+	blockPageMaxUnblockMin     = 24 * 60
+	blockPageUnblockPath       = "/__adguard_home/unblock"
+)
+
+// Settings of the block page server
+// The server is useful when the blocked domains are resolved to the address of AdGuard Home
+// ("custom_ip" blocking mode).
+type blockPageConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	BindHost  string `yaml:"bind_host"`  // empty: all interfaces
+	PortHTTP  int    `yaml:"port_http"`  // 0: disabled
+	PortHTTPS int    `yaml:"port_https"` // 0: disabled.  The certificate from encryption settings is used.
+
+	Title   string `yaml:"title"`   // the title of the page.  Empty: the default title
+	Contact string `yaml:"contact"` // the contact information of the administrator shown on the page
+
+	// If TRUE, the page allows a user with the credentials of the web interface
+	// to unblock the domain for some time (for all clients)
+	AllowUnblock bool   `yaml:"allow_unblock"`
+	UnblockMin   uint32 `yaml:"unblock_min"` // for how long the domain is unblocked (in minutes)
+}
+
+// Check the settings of the block page server
+func checkBlockPageConfig(c blockPageConfig, webPorts ...int) error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.BindHost) != 0 && net.ParseIP(c.BindHost) == nil {
+		return fmt.Errorf("invalid bind_host: %s", c.BindHost)
+	}
+	if c.PortHTTP < 0 || c.PortHTTP > 65535 || c.PortHTTPS < 0 || c.PortHTTPS > 65535 {
+		return fmt.Errorf("invalid port")
+	}
+	if c.PortHTTP == 0 && c.PortHTTPS == 0 {
+		return fmt.Errorf("port_http or port_https must be set")
+	}
+	if c.PortHTTP == c.PortHTTPS {
+		return fmt.Errorf("port_http and port_https must be different")
+	}
+	for _, p := range webPorts {
+		if p != 0 && (p == c.PortHTTP || p == c.PortHTTPS) {
+			return fmt.Errorf("port %d is used by the web interface", p)
+		}
+	}
+	if c.UnblockMin == 0 || c.UnblockMin > blockPageMaxUnblockMin {
+		return fmt.Errorf("unblock_min must be in range 1..%d", blockPageMaxUnblockMin)
+	}
+	return nil
+}
+
+// Return TRUE if the certificate for HTTPS block page is configured
+func blockPageTLSReady() bool {
+	return config.TLS.Enabled &&
+		len(config.TLS.CertificateChainData) != 0 &&
+		len(config.TLS.PrivateKeyData) != 0
+}
+
+// The block page servers (HTTP and HTTPS)
+type blockPageServer struct {
+	lock    sync.Mutex
+	servers []*http.Server
+}
+
+// Start the block page servers
+// The sockets opened on startup are used if they exist.
+func (b *blockPageServer) start() error {
+	config.RLock()
+	c := config.BlockPage
+	config.RUnlock()
+	if !c.Enabled {
+		return nil
+	}
+
+	ln, lnTLS := Context.sockets.takeBlockPage()
+	var err error
+	if ln == nil && c.PortHTTP != 0 {
+		ln, err = net.Listen("tcp", net.JoinHostPort(c.BindHost, strconv.Itoa(c.PortHTTP)))
+		if err != nil {
+			return err
+		}
+	}
+	if lnTLS == nil && c.PortHTTPS != 0 && blockPageTLSReady() {
+		lnTLS, err = net.Listen("tcp", net.JoinHostPort(c.BindHost, strconv.Itoa(c.PortHTTPS)))
+		if err != nil {
+			if ln != nil {
+				_ = ln.Close()
+			}
+			return err
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ln != nil {
+		srv := &http.Server{Handler: http.HandlerFunc(handleBlockPage)}
+		b.servers = append(b.servers, srv)
+		go b.serve(srv, ln)
+		log.Info("Block page: serving HTTP on %s", ln.Addr())
+	}
+	if lnTLS != nil {
+		cert, err := tls.X509KeyPair(config.TLS.CertificateChainData, config.TLS.PrivateKeyData)
+		if err != nil {
+			_ = lnTLS.Close()
+			return err
+		}
+		// the certificate is updated when it's reloaded from files
+		Context.httpsServer.setCertificate(cert)
+		srv := &http.Server{Handler: http.HandlerFunc(handleBlockPage)}
+		b.servers = append(b.servers, srv)
+		go b.serve(srv, tls.NewListener(lnTLS, &tls.Config{
+			GetCertificate: Context.httpsServer.getCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}))
+		log.Info("Block page: serving HTTPS on %s", lnTLS.Addr())
+	}
+	return nil
+}
+
+func (b *blockPageServer) serve(srv *http.Server, ln net.Listener) {
+	err := srv.Serve(ln)
+	if err != http.ErrServerClosed {
+		log.Error("Block page: %s", err)
+	}
+}
+
+// Stop the block page servers
+func (b *blockPageServer) stop() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, srv := range b.servers {
+		_ = srv.Shutdown(context.TODO())
+	}
+	b.servers = nil
+}
+
+// The data of the block page
+type blockPageData struct {
+	Title       string
+	Host        string
+	Reason      string
+	Rule        string
+	FilterName  string
+	Client      string
+	Time        string
+	Contact     string
+	Unblock     bool // show the form to unblock the domain
+	UnblockMin  uint32
+	AuthNeeded  bool   // the form requires the credentials
+	Message     string // the result of unblock request
+	MessageFail bool
+}
+
+var blockPageTemplate = template.Must(template.New("blockpage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; background: #f5f5f5; color: #333; margin: 0; }
+.card { max-width: 560px; margin: 60px auto; padding: 32px; background: #fff; border-radius: 8px; box-shadow: 0 2px 8px rgba(0,0,0,.1); }
+h1 { color: #67b279; font-size: 24px; margin-top: 0; }
+dt { font-weight: bold; margin-top: 8px; }
+dd { margin: 0; word-break: break-all; }
+.note { font-size: 13px; color: #777; }
+.fail { color: #c23814; }
+input { display: block; margin: 8px 0; padding: 6px; width: 100%; box-sizing: border-box; }
+</style>
+</head>
+<body>
+<div class="card">
+<h1>{{.Title}}</h1>
+<p>Access to <b>{{.Host}}</b> has been blocked by AdGuard Home.</p>
+<dl>
+<dt>Reason</dt><dd>{{.Reason}}</dd>
+{{if .Rule}}<dt>Rule</dt><dd>{{.Rule}}</dd>{{end}}
+{{if .FilterName}}<dt>Filter</dt><dd>{{.FilterName}}</dd>{{end}}
+<dt>Client</dt><dd>{{.Client}}</dd>
+<dt>Time</dt><dd>{{.Time}}</dd>
+</dl>
+{{if .Contact}}<p>If you think this is a mistake, contact the administrator: {{.Contact}}</p>{{end}}
+{{if .Message}}<p{{if .MessageFail}} class="fail"{{end}}>{{.Message}}</p>{{end}}
+{{if .Unblock}}
+<form method="post" action="` + blockPageUnblockPath + `">
+{{if .AuthNeeded}}
+<input name="name" placeholder="User name" autocomplete="username" required>
+<input name="password" type="password" placeholder="Password" autocomplete="current-password" required>
+<input name="totp" placeholder="2FA code (if enabled)" autocomplete="one-time-code">
+{{end}}
+<input type="submit" value="Unblock for {{.UnblockMin}} minutes">
+</form>
+<p class="note">The domain is unblocked for all clients.  The change may take some time to apply because of DNS caches in the browser and the operating system.</p>
+{{end}}
+</div>
+</body>
+</html>
+`))
+
+// Get the description of the filtering result
+func blockReasonDescription(res dnsfilter.Result) string {
+	switch res.Reason {
+	case dnsfilter.FilteredBlackList:
+		return "The domain is blocked by a filtering rule"
+	case dnsfilter.FilteredBlockedService:
+		return fmt.Sprintf("The domain belongs to the blocked service %s", res.ServiceName)
+	case dnsfilter.FilteredSafeBrowsing:
+		return "The domain is known to distribute malware or to be used for phishing"
+	case dnsfilter.FilteredParental:
+		return "The domain has adult content"
+	case dnsfilter.FilteredSafeSearch:
+		return "Safe search is enforced for this domain"
+	case dnsfilter.FilteredInvalid:
+		return "The domain name is invalid"
+	}
+	return "The domain isn't blocked: the blocking may have been removed, but the browser may still use the old DNS response"
+}
+
+// Get the host name from "Host" header
+func requestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Check the host name just like DNS server does for the client
+func blockPageCheckHost(host, client string) (dnsfilter.Result, error) {
+	setts := Context.dnsFilter.GetConfig()
+	setts.FilteringEnabled = true
+	applyAdditionalFiltering(client, "", &setts)
+	return Context.dnsFilter.CheckHost(host, dns.TypeA, &setts)
+}
+
+// Serve the block page for any path
+func handleBlockPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == blockPageUnblockPath && r.Method == http.MethodPost {
+		handleBlockPageUnblock(w, r)
+		return
+	}
+	renderBlockPage(w, r, "", false)
+}
+
+func renderBlockPage(w http.ResponseWriter, r *http.Request, msg string, fail bool) {
+	config.RLock()
+	c := config.BlockPage
+	config.RUnlock()
+
+	host := requestHost(r)
+	client := requestIP(r)
+	d := blockPageData{
+		Title:       c.Title,
+		Host:        host,
+		Client:      client,
+		Time:        time.Now().Format(time.RFC1123),
+		Contact:     c.Contact,
+		UnblockMin:  c.UnblockMin,
+		AuthNeeded:  Context.auth != nil && Context.auth.AuthRequired(),
+		Message:     msg,
+		MessageFail: fail,
+	}
+	if len(d.Title) == 0 {
+		d.Title = "Blocked by AdGuard Home"
+	}
+
+	res, err := blockPageCheckHost(host, client)
+	if err != nil {
+		log.Debug("Block page: %s: %s", host, err)
+		d.Reason = blockReasonDescription(dnsfilter.Result{Reason: dnsfilter.FilteredInvalid})
+	} else {
+		d.Reason = blockReasonDescription(res)
+		if res.Reason == dnsfilter.FilteredBlackList || res.Reason == dnsfilter.FilteredBlockedService {
+			d.Rule = res.Rule
+			d.FilterName = filterNameByID(res.FilterID)
+			if res.FilterID == 0 {
+				d.FilterName = "Custom filtering rules"
+			}
+		}
+		d.Unblock = c.AllowUnblock && res.Reason == dnsfilter.FilteredBlackList && len(msg) == 0
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	err = blockPageTemplate.Execute(w, d)
+	if err != nil {
+		log.Debug("Block page: template: %s", err)
+	}
+}
+
+// Unblock the domain for some time: add a temporary allowlist user rule
+// The user name, password and 2FA code of a user who may change the settings are required
+// if the authentication is configured.
+func handleBlockPageUnblock(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	c := config.BlockPage
+	config.RUnlock()
+	if !c.AllowUnblock {
+		http.Error(w, "unblocking is disabled", http.StatusForbidden)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	host := requestHost(r)
+	res, err := blockPageCheckHost(host, requestIP(r))
+	if err != nil || res.Reason != dnsfilter.FilteredBlackList {
+		renderBlockPage(w, r, "The domain can't be unblocked", true)
+		return
+	}
+
+	if Context.auth != nil && Context.auth.AuthRequired() {
+		req := loginJSON{
+			Name:     r.PostForm.Get("name"),
+			Password: r.PostForm.Get("password"),
+			TOTP:     r.PostForm.Get("totp"),
+		}
+		ip := requestIP(r)
+		if left := Context.authLimiter.check(ip, time.Now()); left > 0 {
+			addLoginAttempt(r, req.Name, loginBlocked)
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(left.Seconds())+1))
+			http.Error(w, "too many failed log-in attempts, try again later", http.StatusTooManyRequests)
+			return
+		}
+		u, backup, err := Context.auth.checkLogin(req)
+		if err != nil {
+			renderBlockPage(w, r, err.Error(), true)
+			return
+		}
+		if len(u.Name) == 0 {
+			log.Info("Block page: invalid user name, password or 2FA code: name='%s'", req.Name)
+			Context.authLimiter.inc(ip, time.Now())
+			addLoginAttempt(r, req.Name, loginFailure)
+			time.Sleep(1 * time.Second)
+			renderBlockPage(w, r, "Invalid user name, password or 2FA code", true)
+			return
+		}
+		Context.authLimiter.remove(ip)
+		addLoginAttempt(r, req.Name, loginSuccess)
+		if backup {
+			onConfigModified()
+		}
+		if u.role() == roleReadOnly {
+			renderBlockPage(w, r, "The user isn't allowed to change the settings", true)
+			return
+		}
+	}
+
+	ur := addTemporaryUserRule(pauseDomainRule(host), "Unblocked from block page",
+		time.Duration(c.UnblockMin)*time.Minute)
+	log.Info("Block page: %s unblocked %s until %s", requestIP(r), host, ur.Expires.Format(time.RFC3339))
+	applyUserRules()
+
+	msg := fmt.Sprintf("%s has been unblocked until %s.  Reload the page in a minute.", host, ur.Expires.Format("15:04"))
+	renderBlockPage(w, r, msg, false)
+}
+
+// Add the user rule which is removed after the specified time
+func addTemporaryUserRule(text, comment string, d time.Duration) userRule {
+	now := time.Now()
+	ur := userRule{
+		Text:    text,
+		Enabled: true,
+		Comment: comment,
+		Created: now,
+		Expires: now.Add(d),
+	}
+	config.Lock()
+	ur.ID = nextUserRuleID
+	nextUserRuleID++
+	config.UserRules = append(config.UserRules, ur)
+	config.Unlock()
+	return ur
+}
@@ -0,0 +1,115 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockPageConfig(t *testing.T) {
+	c := blockPageConfig{Enabled: true, PortHTTP: 80, UnblockMin: 60}
+	assert.Nil(t, checkBlockPageConfig(c, 3000, 443))
+	assert.NotNil(t, checkBlockPageConfig(c, 80))
+
+	c.BindHost = "host"
+	assert.NotNil(t, checkBlockPageConfig(c))
+	c.BindHost = "192.168.1.1"
+	assert.Nil(t, checkBlockPageConfig(c))
+
+	c.PortHTTPS = 80
+	assert.NotNil(t, checkBlockPageConfig(c))
+	c.PortHTTP, c.PortHTTPS = 0, 0
+	assert.NotNil(t, checkBlockPageConfig(c))
+	c.PortHTTPS = 8443
+	assert.Nil(t, checkBlockPageConfig(c))
+
+	c.UnblockMin = 0
+	assert.NotNil(t, checkBlockPageConfig(c))
+	c.UnblockMin = blockPageMaxUnblockMin + 1
+	assert.NotNil(t, checkBlockPageConfig(c))
+
+	// the settings aren't checked when the server is disabled
+	c.Enabled = false
+	assert.Nil(t, checkBlockPageConfig(c))
+}
+
+func TestBlockPage(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	Context.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, []dnsfilter.Filter{
+		{ID: 0, Data: []byte("||blocked.example^")},
+	})
+	Context.dnsFilter.Start()
+	defer func() {
+		Context.dnsFilter.Close()
+		Context.dnsFilter = nil
+	}()
+	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0755)
+	config.DNS.FilteringEnabled = true
+	config.UserRules = nil
+	prevConf := config.BlockPage
+	config.BlockPage = blockPageConfig{Enabled: true, PortHTTP: 80, UnblockMin: 60, Contact: "admin@example.org"}
+	defer func() {
+		config.UserRules = nil
+		config.BlockPage = prevConf
+	}()
+
+	get := func(host string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://"+host+"/path?q=1", nil)
+		handleBlockPage(w, r)
+		return w
+	}
+	w := get("blocked.example")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	body := w.Body.String()
+	assert.True(t, strings.Contains(body, "<b>blocked.example</b>"))
+	assert.True(t, strings.Contains(body, "||blocked.example^"))
+	assert.True(t, strings.Contains(body, "Custom filtering rules"))
+	assert.True(t, strings.Contains(body, "admin@example.org"))
+	assert.False(t, strings.Contains(body, blockPageUnblockPath))
+
+	// the host name is escaped
+	w = get("<script>:80")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.False(t, strings.Contains(w.Body.String(), "<script>"))
+
+	// unblock is disabled
+	unblock := func() int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "http://blocked.example"+blockPageUnblockPath, strings.NewReader(""))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		handleBlockPage(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusForbidden, unblock())
+	assert.Equal(t, 0, len(config.UserRules))
+
+	config.BlockPage.AllowUnblock = true
+	w = get("blocked.example")
+	assert.True(t, strings.Contains(w.Body.String(), blockPageUnblockPath))
+
+	// the authentication isn't configured: a temporary allowlist rule is added
+	unblock()
+	assert.Equal(t, 1, len(config.UserRules))
+	ur := config.UserRules[0]
+	assert.Equal(t, "@@||blocked.example^$important", ur.Text)
+	assert.True(t, ur.Enabled)
+	assert.True(t, ur.Expires.Sub(ur.Created) == 60*time.Minute)
+	assert.True(t, strings.Contains(userRulesData(config.UserRules), "@@||blocked.example^$important"))
+
+	// the rule is removed after it has expired
+	assert.Equal(t, 0, removeExpiredUserRules(time.Now()))
+	assert.Equal(t, 1, removeExpiredUserRules(ur.Expires))
+	assert.Equal(t, 0, len(config.UserRules))
+}
@@ -38,6 +38,26 @@ type Client struct {
 	UseOwnBlockedServices bool // false: use global settings
 	BlockedServices       []string
 
+	// Weekly schedule of filtering settings.  nil: use global settings
+	// (unlike the other settings, there's no separate flag, so the clients created by an older version use global settings)
+	Schedule *filteringSchedule
+
+	// Blocking mode for the client's requests.  Empty: use global settings
+	BlockingMode string
+	BlockingIPv4 string // for "custom_ip" mode
+	BlockingIPv6 string // for "custom_ip" mode
+
+	// Query policy: the query types blocked for the client (in addition to the global list)
+	BlockedQueryTypes []string
+	IPv4Only          bool // respond with an empty answer to AAAA requests (for the clients with broken IPv6)
+
+	IgnoreQueryLog   bool // don't write the client's requests to query log
+	IgnoreStatistics bool // don't count the client's requests in statistics
+
+	// Audit mode: the client's requests aren't blocked, but the requests that would have been blocked
+	// are marked in query log
+	AuditMode bool
+
 	Upstreams []string // list of upstream servers to be used for the client's requests
 	// Upstream objects:
 	// nil: not yet initialized
@@ -50,9 +70,11 @@ type clientSource uint
 
 // Client sources
 const (
-	// Priority: etc/hosts > DHCP > ARP > rDNS > WHOIS
+	// Priority: etc/hosts > ARP > DHCP > mDNS > NetBIOS > rDNS > WHOIS
 	ClientSourceWHOIS     clientSource = iota // from WHOIS
 	ClientSourceRDNS                          // from rDNS
+	ClientSourceNetBIOS                       // from NetBIOS
+	ClientSourceMDNS                          // from mDNS
 	ClientSourceDHCP                          // from DHCP
 	ClientSourceARP                           // from 'arp -a'
 	ClientSourceHostsFile                     // from /etc/hosts
@@ -60,9 +82,10 @@ const (
 
 // ClientHost information
 type ClientHost struct {
-	Host      string
-	Source    clientSource
-	WhoisInfo [][]string // [[key,value], ...]
+	Host       string
+	Source     clientSource
+	WhoisInfo  [][]string // [[key,value], ...]
+	DeviceType string     // detected by clients discovery, e.g. "printer"
 }
 
 type clientsContainer struct {
@@ -99,6 +122,9 @@ func (clients *clientsContainer) Init(objects []clientObject, dhcpServer *dhcpd.
 
 	if !clients.testing {
 		go clients.periodicUpdate()
+		if config.ClientsDiscovery.Enabled {
+			go clients.discoveryLoop(config.ClientsDiscovery)
+		}
 
 		clients.addFromDHCP()
 		clients.dhcpServer.SetOnLeaseChanged(clients.onDHCPLeaseChanged)
@@ -120,6 +146,20 @@ type clientObject struct {
 	UseGlobalBlockedServices bool     `yaml:"use_global_blocked_services"`
 	BlockedServices          []string `yaml:"blocked_services"`
 
+	Schedule *filteringSchedule `yaml:"schedule,omitempty"`
+
+	BlockingMode string `yaml:"blocking_mode,omitempty"`
+	BlockingIPv4 string `yaml:"blocking_ipv4,omitempty"`
+	BlockingIPv6 string `yaml:"blocking_ipv6,omitempty"`
+
+	BlockedQueryTypes []string `yaml:"blocked_query_types,omitempty"`
+	IPv4Only          bool     `yaml:"ipv4_only"`
+
+	IgnoreQueryLog   bool `yaml:"ignore_querylog"`
+	IgnoreStatistics bool `yaml:"ignore_statistics"`
+
+	AuditMode bool `yaml:"audit_mode"`
+
 	Upstreams []string `yaml:"upstreams"`
 }
 
@@ -130,35 +170,63 @@ func (clients *clientsContainer) tagKnown(tag string) bool {
 
 func (clients *clientsContainer) addFromConfig(objects []clientObject) {
 	for _, cy := range objects {
-		cli := Client{
-			Name:                cy.Name,
-			IDs:                 cy.IDs,
-			UseOwnSettings:      !cy.UseGlobalSettings,
-			FilteringEnabled:    cy.FilteringEnabled,
-			ParentalEnabled:     cy.ParentalEnabled,
-			SafeSearchEnabled:   cy.SafeSearchEnabled,
-			SafeBrowsingEnabled: cy.SafeBrowsingEnabled,
+		_, err := clients.Add(clients.fromObject(cy))
+		if err != nil {
+			log.Tracef("clientAdd: %s", err)
+		}
+	}
+}
 
-			UseOwnBlockedServices: !cy.UseGlobalBlockedServices,
-			BlockedServices:       cy.BlockedServices,
+// Replace all clients with the ones from configuration file (e.g. after it has been reloaded)
+func (clients *clientsContainer) setFromConfig(objects []clientObject) error {
+	list := []Client{}
+	for _, cy := range objects {
+		list = append(list, clients.fromObject(cy))
+	}
+	return clients.SetAll(list)
+}
 
-			Upstreams: cy.Upstreams,
-		}
+// Get the client object from its configuration
+// The unknown tags are skipped.
+func (clients *clientsContainer) fromObject(cy clientObject) Client {
+	cli := Client{
+		Name:                cy.Name,
+		IDs:                 cy.IDs,
+		UseOwnSettings:      !cy.UseGlobalSettings,
+		FilteringEnabled:    cy.FilteringEnabled,
+		ParentalEnabled:     cy.ParentalEnabled,
+		SafeSearchEnabled:   cy.SafeSearchEnabled,
+		SafeBrowsingEnabled: cy.SafeBrowsingEnabled,
 
-		for _, t := range cy.Tags {
-			if !clients.tagKnown(t) {
-				log.Debug("Clients: skipping unknown tag '%s'", t)
-				continue
-			}
-			cli.Tags = append(cli.Tags, t)
-		}
-		sort.Strings(cli.Tags)
+		UseOwnBlockedServices: !cy.UseGlobalBlockedServices,
+		BlockedServices:       cy.BlockedServices,
 
-		_, err := clients.Add(cli)
-		if err != nil {
-			log.Tracef("clientAdd: %s", err)
+		Schedule: cy.Schedule,
+
+		BlockingMode: cy.BlockingMode,
+		BlockingIPv4: cy.BlockingIPv4,
+		BlockingIPv6: cy.BlockingIPv6,
+
+		BlockedQueryTypes: cy.BlockedQueryTypes,
+		IPv4Only:          cy.IPv4Only,
+
+		IgnoreQueryLog:   cy.IgnoreQueryLog,
+		IgnoreStatistics: cy.IgnoreStatistics,
+
+		AuditMode: cy.AuditMode,
+
+		Upstreams: cy.Upstreams,
+	}
+
+	for _, t := range cy.Tags {
+		if !clients.tagKnown(t) {
+			log.Debug("Clients: skipping unknown tag '%s'", t)
+			continue
 		}
+		cli.Tags = append(cli.Tags, t)
 	}
+	sort.Strings(cli.Tags)
+	return cli
 }
 
 // WriteDiskConfig - write configuration
@@ -173,12 +241,28 @@ func (clients *clientsContainer) WriteDiskConfig(objects *[]clientObject) {
 			SafeSearchEnabled:        cli.SafeSearchEnabled,
 			SafeBrowsingEnabled:      cli.SafeBrowsingEnabled,
 			UseGlobalBlockedServices: !cli.UseOwnBlockedServices,
+
+			Schedule: cli.Schedule,
+
+			BlockingMode: cli.BlockingMode,
+			BlockingIPv4: cli.BlockingIPv4,
+			BlockingIPv6: cli.BlockingIPv6,
+
+			IPv4Only: cli.IPv4Only,
+
+			IgnoreQueryLog:   cli.IgnoreQueryLog,
+			IgnoreStatistics: cli.IgnoreStatistics,
+
+			AuditMode: cli.AuditMode,
 		}
 
 		cy.Tags = stringArrayDup(cli.Tags)
 		cy.IDs = stringArrayDup(cli.IDs)
 		cy.BlockedServices = stringArrayDup(cli.BlockedServices)
 		cy.Upstreams = stringArrayDup(cli.Upstreams)
+		if len(cli.BlockedQueryTypes) != 0 {
+			cy.BlockedQueryTypes = stringArrayDup(cli.BlockedQueryTypes)
+		}
 
 		*objects = append(*objects, cy)
 	}
@@ -228,12 +312,12 @@ func stringArrayDup(a []string) []string {
 	return a2
 }
 
-// Find searches for a client by IP
-func (clients *clientsContainer) Find(ip string) (Client, bool) {
+// Find searches for a client by ClientID (if it's not empty), then by IP
+func (clients *clientsContainer) Find(ip, clientID string) (Client, bool) {
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
-	c, ok := clients.findByIP(ip)
+	c, ok := clients.find(ip, clientID)
 	if !ok {
 		return Client{}, false
 	}
@@ -253,11 +337,11 @@ func upstreamArrayCopy(a []upstream.Upstream) []upstream.Upstream {
 // FindUpstreams looks for upstreams configured for the client
 // If no client found for this IP, or if no custom upstreams are configured,
 // this method returns nil
-func (clients *clientsContainer) FindUpstreams(ip string) []upstream.Upstream {
+func (clients *clientsContainer) FindUpstreams(ip, clientID string) []upstream.Upstream {
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
-	c, ok := clients.findByIP(ip)
+	c, ok := clients.find(ip, clientID)
 	if !ok {
 		return nil
 	}
@@ -265,9 +349,9 @@ func (clients *clientsContainer) FindUpstreams(ip string) []upstream.Upstream {
 	if c.upstreamObjects == nil {
 		c.upstreamObjects = make([]upstream.Upstream, 0)
 		for _, us := range c.Upstreams {
-			u, err := upstream.AddressToUpstream(us, upstream.Options{Timeout: dnsforward.DefaultTimeout})
+			u, err := dnsforward.AddressToUpstream(us, upstream.Options{Timeout: dnsforward.DefaultTimeout}, upstreamProxy())
 			if err != nil {
-				log.Error("upstream.AddressToUpstream: %s: %s", us, err)
+				log.Error("dnsforward.AddressToUpstream: %s: %s", us, err)
 				continue
 			}
 			c.upstreamObjects = append(c.upstreamObjects, u)
@@ -280,6 +364,58 @@ func (clients *clientsContainer) FindUpstreams(ip string) []upstream.Upstream {
 	return upstreamArrayCopy(c.upstreamObjects)
 }
 
+// FindBlockingMode - get blocking mode settings for the client
+// Return an empty mode if the client uses global settings
+func (clients *clientsContainer) FindBlockingMode(ip, clientID string) (string, net.IP, net.IP) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.find(ip, clientID)
+	if !ok || len(c.BlockingMode) == 0 {
+		return "", nil, nil
+	}
+	return c.BlockingMode, net.ParseIP(c.BlockingIPv4), net.ParseIP(c.BlockingIPv6)
+}
+
+// FindQueryPolicy - get query policy settings for the client
+func (clients *clientsContainer) FindQueryPolicy(ip, clientID string) dnsforward.QueryPolicy {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.find(ip, clientID)
+	if !ok {
+		return dnsforward.QueryPolicy{}
+	}
+	return dnsforward.QueryPolicy{
+		BlockedQueryTypes: stringArrayDup(c.BlockedQueryTypes),
+		IPv4Only:          c.IPv4Only,
+	}
+}
+
+// FindLogSettings - get query log and statistics settings for the client
+// Return TRUE if the client's requests must not be written to query log or counted in statistics
+func (clients *clientsContainer) FindLogSettings(ip, clientID string) (ignoreQueryLog, ignoreStats bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.find(ip, clientID)
+	if !ok {
+		return false, false
+	}
+	return c.IgnoreQueryLog, c.IgnoreStatistics
+}
+
+// Find searches for a client by ClientID, then by IP (and does not lock anything)
+func (clients *clientsContainer) find(ip, clientID string) (Client, bool) {
+	if len(clientID) != 0 {
+		c, ok := clients.idIndex[clientID]
+		if ok {
+			return *c, true
+		}
+	}
+	return clients.findByIP(ip)
+}
+
 // Find searches for a client by IP (and does not lock anything)
 func (clients *clientsContainer) findByIP(ip string) (Client, bool) {
 	ipAddr := net.ParseIP(ip)
@@ -343,6 +479,26 @@ func (clients *clientsContainer) FindAutoClient(ip string) (ClientHost, bool) {
 	return ClientHost{}, false
 }
 
+// FindLocalHostname - get the host name of a local client by IP
+// The host names from /etc/hosts, DHCP leases, ARP table, mDNS and NetBIOS are used first,
+// then the names of the persistent clients with this IP address.
+// Return an empty string if the host name is unknown.
+func (clients *clientsContainer) FindLocalHostname(ip string) string {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	ch, ok := clients.ipHost[ip]
+	if ok && ch.Source >= ClientSourceNetBIOS && len(ch.Host) != 0 {
+		return ch.Host
+	}
+
+	c, ok := clients.idIndex[ip]
+	if ok && utils.IsValidHostname(c.Name) == nil {
+		return c.Name
+	}
+	return ""
+}
+
 // Check if Client object's fields are correct
 func (clients *clientsContainer) check(c *Client) error {
 	if len(c.Name) == 0 {
@@ -370,6 +526,10 @@ func (clients *clientsContainer) check(c *Client) error {
 			continue
 		}
 
+		if dnsforward.IsValidClientID(id) {
+			continue
+		}
+
 		return fmt.Errorf("Invalid ID: %s", id)
 	}
 
@@ -387,6 +547,23 @@ func (clients *clientsContainer) check(c *Client) error {
 		}
 	}
 
+	if c.Schedule != nil {
+		err := c.Schedule.init()
+		if err != nil {
+			return fmt.Errorf("Invalid schedule: %s", err)
+		}
+	}
+
+	if len(c.BlockingMode) != 0 &&
+		!dnsforward.ValidateBlockingMode(c.BlockingMode, c.BlockingIPv4, c.BlockingIPv6) {
+		return fmt.Errorf("Invalid blocking mode")
+	}
+
+	err := dnsforward.CheckQueryTypes(c.BlockedQueryTypes)
+	if err != nil {
+		return fmt.Errorf("Invalid blocked query types: %s", err)
+	}
+
 	return nil
 }
 
@@ -514,6 +691,46 @@ func (clients *clientsContainer) Update(name string, c Client) error {
 	return nil
 }
 
+// SetAll replaces all persistent clients
+// The new clients are checked first: on error the current clients are kept.
+func (clients *clientsContainer) SetAll(list []Client) error {
+	ids := map[string]string{}
+	names := map[string]bool{}
+	for i := range list {
+		c := &list[i]
+		err := clients.check(c)
+		if err != nil {
+			return fmt.Errorf("client %s: %s", c.Name, err)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("Client already exists: %s", c.Name)
+		}
+		names[c.Name] = true
+		for _, id := range c.IDs {
+			name, ok := ids[id]
+			if ok {
+				return fmt.Errorf("Another client uses the same ID (%s): %s", id, name)
+			}
+			ids[id] = c.Name
+		}
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	clients.list = make(map[string]*Client)
+	clients.idIndex = make(map[string]*Client)
+	for i := range list {
+		c := &list[i]
+		clients.list[c.Name] = c
+		for _, id := range c.IDs {
+			clients.idIndex[id] = c
+		}
+	}
+	log.Debug("Clients: replaced all clients [%d]", len(clients.list))
+	return nil
+}
+
 // SetWhoisInfo - associate WHOIS information with a client
 func (clients *clientsContainer) SetWhoisInfo(ip string, info [][]string) {
 	clients.lock.Lock()
@@ -557,6 +774,7 @@ func (clients *clientsContainer) addHost(ip, host string, source clientSource) (
 	if ok && ch.Source > source {
 		return false, nil
 	} else if ok {
+		ch.Host = host
 		ch.Source = source
 	} else {
 		ch = &ClientHost{
@@ -685,6 +903,7 @@ func (clients *clientsContainer) addFromDHCP() {
 	_ = clients.rmHosts(ClientSourceDHCP)
 
 	leases := clients.dhcpServer.Leases(dhcpd.LeasesAll)
+	leases = append(leases, clients.dhcpServer.Leases6()...)
 	n := 0
 	for _, l := range leases {
 		if len(l.Hostname) == 0 {
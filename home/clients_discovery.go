@@ -0,0 +1,426 @@
+// Client auto-discovery: the names and types of the devices in the local network
+
+package home
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/utils"
+	"github.com/miekg/dns"
+)
+
+const (
+	discoveryDefaultInterval = 10 // in minutes
+	discoveryTimeout         = 1 * time.Second
+	discoveryMaxHosts        = 1024 // the maximum number of neighbors scanned at once
+	discoveryWorkers         = 16
+
+	mdnsPort    = 5353
+	netbiosPort = 137
+)
+
+// Device types
+const (
+	deviceComputer = "computer"
+	devicePhone    = "phone"
+	deviceMedia    = "media"
+	devicePrinter  = "printer"
+	deviceCamera   = "camera"
+	deviceIoT      = "iot"
+)
+
+// The device types by mDNS service types
+// If a device provides several services, the type which is listed first wins.
+var mdnsServiceDevices = []struct {
+	service string
+	device  string
+}{
+	{"_ipp", devicePrinter},
+	{"_ipps", devicePrinter},
+	{"_printer", devicePrinter},
+	{"_pdl-datastream", devicePrinter},
+	{"_scanner", devicePrinter},
+	{"_axis-video", deviceCamera},
+	{"_rtsp", deviceCamera},
+	{"_googlecast", deviceMedia},
+	{"_airplay", deviceMedia},
+	{"_raop", deviceMedia},
+	{"_spotify-connect", deviceMedia},
+	{"_amzn-wplay", deviceMedia},
+	{"_apple-mobdev2", devicePhone},
+	{"_hap", deviceIoT},
+	{"_homekit", deviceIoT},
+	{"_smb", deviceComputer},
+	{"_afpovertcp", deviceComputer},
+	{"_workstation", deviceComputer},
+	{"_rfb", deviceComputer},
+	{"_ssh", deviceComputer},
+}
+
+type clientsDiscoveryConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Interval uint32 `yaml:"interval"` // in minutes
+	MDNS     bool   `yaml:"mdns"`     // query the names and the services via mDNS
+	NetBIOS  bool   `yaml:"netbios"`  // query the names via NetBIOS
+}
+
+func checkClientsDiscoveryConfig(conf clientsDiscoveryConfig) error {
+	if conf.Enabled && conf.Interval == 0 {
+		return fmt.Errorf("interval must be greater than 0")
+	}
+	return nil
+}
+
+// The result of the discovery of a device
+type discoveredHost struct {
+	ip         string
+	host       string
+	source     clientSource
+	deviceType string
+}
+
+// The ports of the services to query (changed by tests)
+var (
+	discoveryMDNSPort    = mdnsPort
+	discoveryNetBIOSPort = netbiosPort
+)
+
+func (clients *clientsContainer) discoveryLoop(conf clientsDiscoveryConfig) {
+	log.Debug("Clients: discovery is enabled, interval: %d minutes", conf.Interval)
+	for {
+		clients.discover(conf, getARPNeighbors())
+		time.Sleep(time.Duration(conf.Interval) * time.Minute)
+	}
+}
+
+// Scan the neighbors and update the auto-clients
+func (clients *clientsContainer) discover(conf clientsDiscoveryConfig, ips []string) {
+	if len(ips) > discoveryMaxHosts {
+		ips = ips[:discoveryMaxHosts]
+	}
+
+	ch := make(chan string)
+	var results []discoveredHost
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i != discoveryWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range ch {
+				dh := discoverHost(conf, ip)
+				if dh == nil {
+					continue
+				}
+				lock.Lock()
+				results = append(results, *dh)
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, ip := range ips {
+		if Context.rdns != nil {
+			Context.rdns.Begin(ip)
+		}
+		ch <- ip
+	}
+	close(ch)
+	wg.Wait()
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+	_ = clients.rmHosts(ClientSourceMDNS)
+	_ = clients.rmHosts(ClientSourceNetBIOS)
+
+	n := 0
+	for _, dh := range results {
+		if len(dh.host) != 0 {
+			ok, _ := clients.addHost(dh.ip, dh.host, dh.source)
+			if ok {
+				n++
+			}
+		}
+		h, ok := clients.ipHost[dh.ip]
+		if ok && len(dh.deviceType) != 0 {
+			h.DeviceType = dh.deviceType
+		}
+	}
+	log.Debug("Clients: discovered %d names of %d devices", n, len(ips))
+}
+
+// Get the name and the type of the device
+// Return nil if nothing is found.
+func discoverHost(conf clientsDiscoveryConfig, ip string) *discoveredHost {
+	dh := discoveredHost{ip: ip}
+
+	if conf.MDNS {
+		addr := net.JoinHostPort(ip, fmt.Sprintf("%d", discoveryMDNSPort))
+		host := mdnsLookupName(addr, ip)
+		if len(host) != 0 {
+			dh.host = host
+			dh.source = ClientSourceMDNS
+		}
+		dh.deviceType = deviceTypeByServices(mdnsLookupServices(addr))
+	}
+
+	if conf.NetBIOS && len(dh.host) == 0 && net.ParseIP(ip).To4() != nil {
+		host := netbiosLookupName(net.JoinHostPort(ip, fmt.Sprintf("%d", discoveryNetBIOSPort)))
+		if len(host) != 0 {
+			dh.host = host
+			dh.source = ClientSourceNetBIOS
+			if len(dh.deviceType) == 0 {
+				dh.deviceType = deviceComputer
+			}
+		}
+	}
+
+	if len(dh.host) == 0 && len(dh.deviceType) == 0 {
+		return nil
+	}
+	log.Tracef("Clients: discovered %s: %q type:%q", ip, dh.host, dh.deviceType)
+	return &dh
+}
+
+// Send a unicast mDNS query to the device (RFC 6762 section 6.7)
+func mdnsExchange(addr string, name string, qtype uint16) *dns.Msg {
+	req := dns.Msg{}
+	req.Id = dns.Id()
+	req.Question = []dns.Question{
+		{Name: name, Qtype: qtype, Qclass: dns.ClassINET},
+	}
+	c := dns.Client{Net: "udp", Timeout: discoveryTimeout}
+	resp, _, err := c.Exchange(&req, addr)
+	if err != nil {
+		log.Tracef("mDNS: %s: %s", addr, err)
+		return nil
+	}
+	return resp
+}
+
+// Get the host name of the device by its IP address: "host.local." -> "host"
+func mdnsLookupName(addr string, ip string) string {
+	name, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	resp := mdnsExchange(addr, name, dns.TypePTR)
+	if resp == nil {
+		return ""
+	}
+	for _, a := range resp.Answer {
+		ptr, ok := a.(*dns.PTR)
+		if !ok {
+			continue
+		}
+		host := strings.TrimSuffix(strings.TrimSuffix(ptr.Ptr, "."), ".local")
+		host = strings.ToLower(host)
+		if utils.IsValidHostname(host) == nil {
+			return host
+		}
+	}
+	return ""
+}
+
+// Get the list of the service types provided by the device, e.g. "_ipp._tcp"
+func mdnsLookupServices(addr string) []string {
+	resp := mdnsExchange(addr, "_services._dns-sd._udp.local.", dns.TypePTR)
+	if resp == nil {
+		return nil
+	}
+	var services []string
+	for _, a := range resp.Answer {
+		ptr, ok := a.(*dns.PTR)
+		if ok {
+			services = append(services, strings.TrimSuffix(ptr.Ptr, ".local."))
+		}
+	}
+	return services
+}
+
+// Get the device type by the list of mDNS services
+func deviceTypeByServices(services []string) string {
+	for _, sd := range mdnsServiceDevices {
+		for _, s := range services {
+			if strings.Split(s, ".")[0] == sd.service {
+				return sd.device
+			}
+		}
+	}
+	return ""
+}
+
+// Get NetBIOS Node Status request (RFC 1002 section 4.2.17)
+func netbiosStatusRequest(id uint16) []byte {
+	data := make([]byte, 12, 50)
+	binary.BigEndian.PutUint16(data, id)
+	binary.BigEndian.PutUint16(data[4:], 1) // QDCOUNT
+
+	// the encoded name "*" padded with zeros
+	data = append(data, 32)
+	name := make([]byte, 16)
+	name[0] = '*'
+	for _, c := range name {
+		data = append(data, 'A'+(c>>4), 'A'+(c&0x0f))
+	}
+	data = append(data, 0)
+
+	data = append(data, 0, 0x21) // NBSTAT
+	data = append(data, 0, 0x01) // IN
+	return data
+}
+
+// Get the computer name from NetBIOS Node Status response
+func parseNetBIOSStatusResponse(data []byte, id uint16) (string, error) {
+	if len(data) < 12 || binary.BigEndian.Uint16(data) != id {
+		return "", fmt.Errorf("invalid response")
+	}
+	if binary.BigEndian.Uint16(data[6:]) == 0 {
+		return "", fmt.Errorf("no answer")
+	}
+
+	// skip the question name
+	pos := 12
+	for {
+		if pos >= len(data) {
+			return "", fmt.Errorf("response is too short")
+		}
+		n := int(data[pos])
+		if n&0xc0 == 0xc0 {
+			pos += 2
+			break
+		}
+		pos += 1 + n
+		if n == 0 {
+			break
+		}
+	}
+
+	// type, class, TTL, length, the number of names
+	pos += 10
+	if pos >= len(data) {
+		return "", fmt.Errorf("response is too short")
+	}
+	num := int(data[pos])
+	pos++
+
+	for i := 0; i != num; i++ {
+		if pos+18 > len(data) {
+			return "", fmt.Errorf("response is too short")
+		}
+		entry := data[pos : pos+18]
+		pos += 18
+
+		const groupFlag = 0x80
+		if entry[15] != 0 || entry[16]&groupFlag != 0 {
+			continue // not a workstation name
+		}
+		name := string(bytes.TrimRight(entry[:15], " \x00"))
+		return strings.ToLower(name), nil
+	}
+	return "", fmt.Errorf("no workstation name")
+}
+
+// Get the computer name via NetBIOS
+func netbiosLookupName(addr string) string {
+	conn, err := net.DialTimeout("udp", addr, discoveryTimeout)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(discoveryTimeout))
+
+	id := dns.Id()
+	_, err = conn.Write(netbiosStatusRequest(id))
+	if err != nil {
+		return ""
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		log.Tracef("NetBIOS: %s: %s", addr, err)
+		return ""
+	}
+	host, err := parseNetBIOSStatusResponse(buf[:n], id)
+	if err != nil {
+		log.Tracef("NetBIOS: %s: %s", addr, err)
+		return ""
+	}
+	if utils.IsValidHostname(host) != nil {
+		return ""
+	}
+	return host
+}
+
+// Get IP addresses of the neighbors from the system ARP table
+func getARPNeighbors() []string {
+	if runtime.GOOS == "linux" {
+		data, err := ioutil.ReadFile("/proc/net/arp")
+		if err == nil {
+			return parseProcNetARP(string(data))
+		}
+	}
+
+	cmd := exec.Command("arp", "-a")
+	log.Tracef("executing %s %v", cmd.Path, cmd.Args)
+	data, err := cmd.Output()
+	if err != nil {
+		log.Debug("command %s has failed: %v", cmd.Path, err)
+		return nil
+	}
+	return parseARPOutput(string(data))
+}
+
+// Parse /proc/net/arp:
+// IP address       HW type     Flags       HW address            Mask     Device
+// 192.168.1.2      0x1         0x2         00:11:22:33:44:55     *        eth0
+func parseProcNetARP(data string) []string {
+	var ips []string
+	for _, ln := range strings.Split(data, "\n") {
+		fields := strings.Fields(ln)
+		if len(fields) < 4 || fields[2] == "0x0" || fields[3] == "00:00:00:00:00:00" {
+			continue // incomplete entry
+		}
+		if net.ParseIP(fields[0]) != nil {
+			ips = append(ips, fields[0])
+		}
+	}
+	return ips
+}
+
+// Parse the output of 'arp -a' command:
+//
+//	host (192.168.1.2) at 00:11:22:33:44:55 [ether] on eth0
+//
+// or on Windows:
+//
+//	192.168.1.2           00-11-22-33-44-55     dynamic
+func parseARPOutput(data string) []string {
+	var ips []string
+	for _, ln := range strings.Split(data, "\n") {
+		open := strings.Index(ln, "(")
+		close := strings.Index(ln, ")")
+		if open != -1 && close > open {
+			ip := ln[open+1 : close]
+			if net.ParseIP(ip) != nil && !strings.Contains(ln, "incomplete") {
+				ips = append(ips, ip)
+			}
+			continue
+		}
+
+		fields := strings.Fields(ln)
+		if len(fields) == 3 && net.ParseIP(fields[0]) != nil && fields[2] == "dynamic" {
+			ips = append(ips, fields[0])
+		}
+	}
+	return ips
+}
@@ -0,0 +1,166 @@
+package home
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// Get NetBIOS Node Status response with the names
+func makeNetBIOSStatusResponse(id uint16, names []string, flags []byte) []byte {
+	data := netbiosStatusRequest(id)
+	binary.BigEndian.PutUint16(data[4:], 0) // QDCOUNT
+	binary.BigEndian.PutUint16(data[6:], 1) // ANCOUNT
+	data = append(data, 0, 0, 0, 0, 0, 0)   // TTL, length
+	data = append(data, byte(len(names)))
+	for i, n := range names {
+		entry := make([]byte, 18)
+		copy(entry, "               ")
+		copy(entry, n)
+		entry[15] = 0
+		entry[16] = flags[i]
+		data = append(data, entry...)
+	}
+	return data
+}
+
+func TestNetBIOSStatus(t *testing.T) {
+	req := netbiosStatusRequest(0x1234)
+	assert.Equal(t, 50, len(req))
+	assert.Equal(t, []byte{0x12, 0x34}, req[:2])
+	assert.Equal(t, []byte{32, 'C', 'K', 'A', 'A'}, req[12:17])
+	assert.Equal(t, []byte{0, 0, 0x21, 0, 1}, req[45:])
+
+	// the first unique name is the computer name
+	resp := makeNetBIOSStatusResponse(0x1234, []string{"WORKGROUP", "DESKTOP-1"}, []byte{0x80, 0x04})
+	host, err := parseNetBIOSStatusResponse(resp, 0x1234)
+	assert.Nil(t, err)
+	assert.Equal(t, "desktop-1", host)
+
+	_, err = parseNetBIOSStatusResponse(resp, 0x4321)
+	assert.NotNil(t, err)
+	_, err = parseNetBIOSStatusResponse(resp[:len(resp)-1], 0x1234)
+	assert.NotNil(t, err)
+	_, err = parseNetBIOSStatusResponse(makeNetBIOSStatusResponse(1, []string{"WORKGROUP"}, []byte{0x80}), 1)
+	assert.NotNil(t, err)
+}
+
+func TestParseARP(t *testing.T) {
+	procARP := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.1      0x1         0x2         00:11:22:33:44:55     *        eth0
+192.168.1.3      0x1         0x0         00:00:00:00:00:00     *        eth0
+192.168.1.4      0x1         0x2         00:11:22:33:44:66     *        eth0
+`
+	assert.Equal(t, []string{"192.168.1.1", "192.168.1.4"}, parseProcNetARP(procARP))
+
+	arpOutput := `router.lan (192.168.1.1) at 00:11:22:33:44:55 [ether] on eth0
+? (192.168.1.3) at <incomplete> on eth0
+? (192.168.1.4) at 00:11:22:33:44:66 [ether] on eth0
+`
+	assert.Equal(t, []string{"192.168.1.1", "192.168.1.4"}, parseARPOutput(arpOutput))
+
+	arpWindows := `Interface: 192.168.1.2 --- 0x4
+  Internet Address      Physical Address      Type
+  192.168.1.1           00-11-22-33-44-55     dynamic
+  192.168.1.255         ff-ff-ff-ff-ff-ff     static
+`
+	assert.Equal(t, []string{"192.168.1.1"}, parseARPOutput(arpWindows))
+}
+
+func TestDeviceTypeByServices(t *testing.T) {
+	assert.Equal(t, devicePrinter, deviceTypeByServices([]string{"_http._tcp", "_ipp._tcp"}))
+	assert.Equal(t, deviceMedia, deviceTypeByServices([]string{"_googlecast._tcp"}))
+	assert.Equal(t, deviceMedia, deviceTypeByServices([]string{"_smb._tcp", "_airplay._tcp"}))
+	assert.Equal(t, "", deviceTypeByServices([]string{"_http._tcp"}))
+	assert.Equal(t, "", deviceTypeByServices(nil))
+}
+
+// Start mDNS responder for 127.0.0.1 and NetBIOS responder
+func startTestDiscoveryServers(t *testing.T) (*dns.Server, net.PacketConn) {
+	mdnsConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := dns.Msg{}
+		resp.SetReply(req)
+		q := req.Question[0]
+		switch q.Name {
+		case "1.0.0.127.in-addr.arpa.":
+			resp.Answer = append(resp.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 120},
+				Ptr: "Printer.local.",
+			})
+		case "_services._dns-sd._udp.local.":
+			resp.Answer = append(resp.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 120},
+				Ptr: "_ipp._tcp.local.",
+			})
+		}
+		_ = w.WriteMsg(&resp)
+	})
+	mdns := &dns.Server{PacketConn: mdnsConn, Handler: mux}
+	go func() { _ = mdns.ActivateAndServe() }()
+
+	nbConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := nbConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 2 {
+				continue
+			}
+			id := binary.BigEndian.Uint16(buf)
+			_, _ = nbConn.WriteTo(makeNetBIOSStatusResponse(id, []string{"PC"}, []byte{0}), addr)
+		}
+	}()
+
+	discoveryMDNSPort = mdnsConn.LocalAddr().(*net.UDPAddr).Port
+	discoveryNetBIOSPort = nbConn.LocalAddr().(*net.UDPAddr).Port
+	return mdns, nbConn
+}
+
+func TestClientsDiscovery(t *testing.T) {
+	mdns, nbConn := startTestDiscoveryServers(t)
+	defer func() {
+		_ = mdns.Shutdown()
+		_ = nbConn.Close()
+		discoveryMDNSPort = mdnsPort
+		discoveryNetBIOSPort = netbiosPort
+	}()
+
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil)
+
+	// mDNS: the name and the device type
+	conf := clientsDiscoveryConfig{Enabled: true, Interval: 1, MDNS: true, NetBIOS: true}
+	clients.discover(conf, []string{"127.0.0.1"})
+	ch, ok := clients.FindAutoClient("127.0.0.1")
+	assert.True(t, ok)
+	assert.Equal(t, "printer", ch.Host)
+	assert.Equal(t, ClientSourceMDNS, ch.Source)
+	assert.Equal(t, devicePrinter, ch.DeviceType)
+
+	// NetBIOS: the name only
+	conf.MDNS = false
+	clients.discover(conf, []string{"127.0.0.1"})
+	ch, ok = clients.FindAutoClient("127.0.0.1")
+	assert.True(t, ok)
+	assert.Equal(t, "pc", ch.Host)
+	assert.Equal(t, ClientSourceNetBIOS, ch.Source)
+	assert.Equal(t, deviceComputer, ch.DeviceType)
+
+	// the names from the sources with a higher priority aren't overwritten
+	_, _ = clients.AddHost("127.0.0.1", "localhost", ClientSourceHostsFile)
+	clients.discover(conf, []string{"127.0.0.1"})
+	ch, _ = clients.FindAutoClient("127.0.0.1")
+	assert.Equal(t, "localhost", ch.Host)
+	assert.Equal(t, deviceComputer, ch.DeviceType)
+}
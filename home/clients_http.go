@@ -20,6 +20,20 @@ type clientJSON struct {
 	UseGlobalBlockedServices bool     `json:"use_global_blocked_services"`
 	BlockedServices          []string `json:"blocked_services"`
 
+	Schedule *filteringSchedule `json:"schedule"` // null: use global settings
+
+	BlockingMode string `json:"blocking_mode"` // empty: use global settings
+	BlockingIPv4 string `json:"blocking_ipv4"`
+	BlockingIPv6 string `json:"blocking_ipv6"`
+
+	BlockedQueryTypes []string `json:"blocked_query_types"`
+	IPv4Only          bool     `json:"ipv4_only"`
+
+	IgnoreQueryLog   bool `json:"ignore_querylog"`
+	IgnoreStatistics bool `json:"ignore_statistics"`
+
+	AuditMode bool `json:"audit_mode"`
+
 	Upstreams []string `json:"upstreams"`
 }
 
@@ -28,7 +42,8 @@ type clientHostJSON struct {
 	Name   string `json:"name"`
 	Source string `json:"source"`
 
-	WhoisInfo map[string]interface{} `json:"whois_info"`
+	WhoisInfo  map[string]interface{} `json:"whois_info"`
+	DeviceType string                 `json:"device_type"`
 }
 
 type clientListJSON struct {
@@ -48,8 +63,9 @@ func (clients *clientsContainer) handleGetClients(w http.ResponseWriter, r *http
 	}
 	for ip, ch := range clients.ipHost {
 		cj := clientHostJSON{
-			IP:   ip,
-			Name: ch.Host,
+			IP:         ip,
+			Name:       ch.Host,
+			DeviceType: ch.DeviceType,
 		}
 
 		cj.Source = "etc/hosts"
@@ -60,6 +76,10 @@ func (clients *clientsContainer) handleGetClients(w http.ResponseWriter, r *http
 			cj.Source = "rDNS"
 		case ClientSourceARP:
 			cj.Source = "ARP"
+		case ClientSourceMDNS:
+			cj.Source = "mDNS"
+		case ClientSourceNetBIOS:
+			cj.Source = "NetBIOS"
 		case ClientSourceWHOIS:
 			cj.Source = "WHOIS"
 		}
@@ -98,6 +118,20 @@ func jsonToClient(cj clientJSON) (*Client, error) {
 		UseOwnBlockedServices: !cj.UseGlobalBlockedServices,
 		BlockedServices:       cj.BlockedServices,
 
+		Schedule: cj.Schedule,
+
+		BlockingMode: cj.BlockingMode,
+		BlockingIPv4: cj.BlockingIPv4,
+		BlockingIPv6: cj.BlockingIPv6,
+
+		BlockedQueryTypes: cj.BlockedQueryTypes,
+		IPv4Only:          cj.IPv4Only,
+
+		IgnoreQueryLog:   cj.IgnoreQueryLog,
+		IgnoreStatistics: cj.IgnoreStatistics,
+
+		AuditMode: cj.AuditMode,
+
 		Upstreams: cj.Upstreams,
 	}
 	return &c, nil
@@ -118,22 +152,38 @@ func clientToJSON(c *Client) clientJSON {
 		UseGlobalBlockedServices: !c.UseOwnBlockedServices,
 		BlockedServices:          c.BlockedServices,
 
+		Schedule: c.Schedule,
+
+		BlockingMode: c.BlockingMode,
+		BlockingIPv4: c.BlockingIPv4,
+		BlockingIPv6: c.BlockingIPv6,
+
+		BlockedQueryTypes: c.BlockedQueryTypes,
+		IPv4Only:          c.IPv4Only,
+
+		IgnoreQueryLog:   c.IgnoreQueryLog,
+		IgnoreStatistics: c.IgnoreStatistics,
+
+		AuditMode: c.AuditMode,
+
 		Upstreams: c.Upstreams,
 	}
 	return cj
 }
 
 type clientHostJSONWithID struct {
-	IDs       []string               `json:"ids"`
-	Name      string                 `json:"name"`
-	WhoisInfo map[string]interface{} `json:"whois_info"`
+	IDs        []string               `json:"ids"`
+	Name       string                 `json:"name"`
+	WhoisInfo  map[string]interface{} `json:"whois_info"`
+	DeviceType string                 `json:"device_type"`
 }
 
 // Convert ClientHost object to JSON
 func clientHostToJSON(ip string, ch ClientHost) clientHostJSONWithID {
 	cj := clientHostJSONWithID{
-		Name: ch.Host,
-		IDs:  []string{ip},
+		Name:       ch.Host,
+		IDs:        []string{ip},
+		DeviceType: ch.DeviceType,
 	}
 
 	cj.WhoisInfo = make(map[string]interface{})
@@ -248,7 +298,7 @@ func (clients *clientsContainer) handleFindClient(w http.ResponseWriter, r *http
 			break
 		}
 		el := map[string]interface{}{}
-		c, ok := clients.Find(ip)
+		c, ok := clients.Find(ip, "")
 		if !ok {
 			ch, ok := clients.FindAutoClient(ip)
 			if !ok {
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -40,13 +41,13 @@ func TestClients(t *testing.T) {
 		t.Fatalf("Add #2")
 	}
 
-	c, b = clients.Find("1.1.1.1")
+	c, b = clients.Find("1.1.1.1", "")
 	assert.True(t, b && c.Name == "client1")
 
-	c, b = clients.Find("1:2:3::4")
+	c, b = clients.Find("1:2:3::4", "")
 	assert.True(t, b && c.Name == "client1")
 
-	c, b = clients.Find("2.2.2.2")
+	c, b = clients.Find("2.2.2.2", "")
 	assert.True(t, b && c.Name == "client2")
 
 	// failed add - name in use
@@ -112,7 +113,7 @@ func TestClients(t *testing.T) {
 	c.UseOwnSettings = true
 	assert.True(t, clients.Update("client1", c) == nil)
 	c = Client{}
-	c, b = clients.Find("1.1.1.2")
+	c, b = clients.Find("1.1.1.2", "")
 	assert.True(t, b && c.Name == "client1-renamed" && c.IDs[0] == "1.1.1.2" && c.UseOwnSettings)
 	assert.True(t, clients.list["client1"] == nil)
 
@@ -236,3 +237,188 @@ func TestClientsAddExisting(t *testing.T) {
 	assert.True(t, ok)
 	assert.Nil(t, err)
 }
+
+func TestClientsBlockingMode(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil)
+
+	c := Client{
+		IDs:          []string{"1.1.1.1"},
+		Name:         "client1",
+		BlockingMode: "custom_ip",
+		BlockingIPv4: "1.2.3.4",
+	}
+	_, err := clients.Add(c)
+	assert.NotNil(t, err)
+
+	c.BlockingIPv6 = "::1"
+	ok, err := clients.Add(c)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	mode, ipv4, ipv6 := clients.FindBlockingMode("1.1.1.1", "")
+	assert.Equal(t, "custom_ip", mode)
+	assert.Equal(t, "1.2.3.4", ipv4.String())
+	assert.Equal(t, "::1", ipv6.String())
+
+	mode, _, _ = clients.FindBlockingMode("2.2.2.2", "")
+	assert.Equal(t, "", mode)
+}
+
+func TestClientsLogSettings(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil)
+
+	c := Client{
+		IDs:            []string{"1.1.1.1"},
+		Name:           "client1",
+		IgnoreQueryLog: true,
+	}
+	ok, err := clients.Add(c)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	ignoreQueryLog, ignoreStats := clients.FindLogSettings("1.1.1.1", "")
+	assert.True(t, ignoreQueryLog)
+	assert.False(t, ignoreStats)
+
+	ignoreQueryLog, ignoreStats = clients.FindLogSettings("2.2.2.2", "")
+	assert.False(t, ignoreQueryLog)
+	assert.False(t, ignoreStats)
+}
+
+func TestClientsFindLocalHostname(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil)
+
+	ok, err := clients.Add(Client{IDs: []string{"192.168.1.2"}, Name: "laptop"})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	ok, err = clients.Add(Client{IDs: []string{"192.168.1.3"}, Name: "My Phone"})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	ok, err = clients.AddHost("192.168.1.2", "laptop.lan", ClientSourceDHCP)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	ok, err = clients.AddHost("192.168.1.4", "host.example.org", ClientSourceRDNS)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "laptop.lan", clients.FindLocalHostname("192.168.1.2"))
+	assert.Equal(t, "", clients.FindLocalHostname("192.168.1.3"))
+	assert.Equal(t, "", clients.FindLocalHostname("192.168.1.4"))
+}
+
+func TestClientsClientID(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil)
+
+	ok, err := clients.Add(Client{IDs: []string{"1.1.1.1"}, Name: "router"})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	ok, err = clients.Add(Client{IDs: []string{"kids-tablet"}, Name: "tablet", IgnoreQueryLog: true})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	// invalid ClientID
+	_, err = clients.Add(Client{IDs: []string{"Kids_Phone"}, Name: "phone"})
+	assert.NotNil(t, err)
+
+	// ClientID has a priority over IP address
+	c, ok := clients.Find("1.1.1.1", "kids-tablet")
+	assert.True(t, ok)
+	assert.Equal(t, "tablet", c.Name)
+	ignoreQueryLog, _ := clients.FindLogSettings("1.1.1.1", "kids-tablet")
+	assert.True(t, ignoreQueryLog)
+
+	// unknown ClientID: search by IP address
+	c, ok = clients.Find("1.1.1.1", "unknown")
+	assert.True(t, ok)
+	assert.Equal(t, "router", c.Name)
+
+	_, ok = clients.Find("2.2.2.2", "")
+	assert.False(t, ok)
+}
+
+func TestClientsTags(t *testing.T) {
+	initServices()
+	Context = homeContext{}
+	Context.clients.testing = true
+	Context.clients.Init(nil, nil)
+
+	ok, err := Context.clients.Add(Client{IDs: []string{"1.1.1.1"}, Name: "tv", Tags: []string{"user_child", "device_tv"}})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	// unknown tag
+	_, err = Context.clients.Add(Client{IDs: []string{"2.2.2.2"}, Name: "phone", Tags: []string{"device_unknown"}})
+	assert.NotNil(t, err)
+
+	// the tags are sorted for matching $ctag rules
+	setts := dnsfilter.RequestFilteringSettings{FilteringEnabled: true}
+	applyAdditionalFiltering("1.1.1.1", "", &setts)
+	assert.Equal(t, []string{"device_tv", "user_child"}, setts.ClientTags)
+
+	setts = dnsfilter.RequestFilteringSettings{FilteringEnabled: true}
+	applyAdditionalFiltering("2.2.2.2", "", &setts)
+	assert.Nil(t, setts.ClientTags)
+}
+
+func TestClientsSetAll(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil)
+	_, _ = clients.Add(Client{IDs: []string{"1.1.1.1"}, Name: "client1"})
+
+	// the current clients are kept on error
+	assert.NotNil(t, clients.SetAll([]Client{
+		{IDs: []string{"2.2.2.2"}, Name: "client2"},
+		{IDs: []string{"2.2.2.2"}, Name: "client3"},
+	}))
+	assert.NotNil(t, clients.SetAll([]Client{
+		{IDs: []string{"2.2.2.2"}, Name: "client2"},
+		{IDs: []string{"3.3.3.3"}, Name: "client2"},
+	}))
+	assert.NotNil(t, clients.SetAll([]Client{{Name: "client2"}}))
+	_, ok := clients.Find("1.1.1.1", "")
+	assert.True(t, ok)
+
+	assert.Nil(t, clients.SetAll([]Client{{IDs: []string{"2.2.2.2"}, Name: "client2"}}))
+	_, ok = clients.Find("1.1.1.1", "")
+	assert.False(t, ok)
+	c, ok := clients.Find("2.2.2.2", "")
+	assert.True(t, ok)
+	assert.Equal(t, "client2", c.Name)
+}
+
+func TestClientsQueryPolicy(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+	clients.Init(nil, nil)
+
+	c := Client{
+		IDs:               []string{"1.1.1.1"},
+		Name:              "iot",
+		BlockedQueryTypes: []string{"ANY", "unknown"},
+		IPv4Only:          true,
+	}
+	_, err := clients.Add(c)
+	assert.NotNil(t, err)
+
+	c.BlockedQueryTypes = []string{"ANY", "HTTPS", "SVCB"}
+	ok, err := clients.Add(c)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	pol := clients.FindQueryPolicy("1.1.1.1", "")
+	assert.Equal(t, []string{"ANY", "HTTPS", "SVCB"}, pol.BlockedQueryTypes)
+	assert.True(t, pol.IPv4Only)
+
+	pol = clients.FindQueryPolicy("2.2.2.2", "")
+	assert.Equal(t, 0, len(pol.BlockedQueryTypes))
+	assert.False(t, pol.IPv4Only)
+}
@@ -1,6 +1,7 @@
 package home
 
 import (
+	"crypto/tls"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -27,6 +28,14 @@ const (
 type logSettings struct {
 	LogFile string `yaml:"log_file"` // Path to the log file. If empty, write to stdout. If "syslog", writes to syslog
 	Verbose bool   `yaml:"verbose"`  // If true, verbose logging is enabled
+
+	LogFormat string            `yaml:"log_format"` // "text" or "json";  empty: "text"
+	LogLevels map[string]string `yaml:"log_levels"` // module -> level ("error", "info" or "debug")
+
+	// Log file rotation: the file is rotated when its size exceeds LogMaxSize megabytes (0: not rotated),
+	// the rotated files older than LogMaxAge days are removed (0: they are kept)
+	LogMaxSize uint32 `yaml:"log_max_size"`
+	LogMaxAge  uint32 `yaml:"log_max_age"`
 }
 
 // HTTPSServer - HTTPS Server
@@ -35,6 +44,10 @@ type HTTPSServer struct {
 	cond       *sync.Cond // reacts to config.TLS.Enabled, PortHTTPS, CertificateChain and PrivateKey
 	sync.Mutex            // protects config.TLS
 	shutdown   bool       // if TRUE, don't restart the server
+
+	certLock sync.RWMutex
+	cert     tls.Certificate             // the current certificate;  it's replaced without restarting the server
+	names    *dnsforward.TLSCertificates // the certificates of the additional server names
 }
 
 // configuration is loaded from YAML
@@ -48,25 +61,69 @@ type configuration struct {
 	versionCheckJSON     []byte
 	versionCheckLastTime time.Time
 
+	includes configIncludes // the state of the included files
+
+	// The files merged into the configuration;  the values from this file take priority over them
+	Include []string `yaml:"include,omitempty"`
+
 	BindHost     string `yaml:"bind_host"`     // BindHost is the IP address of the HTTP server to bind to
 	BindPort     int    `yaml:"bind_port"`     // BindPort is the port the HTTP server
 	Users        []User `yaml:"users"`         // Users that can access HTTP server
 	Language     string `yaml:"language"`      // two-letter ISO 639-1 language code
 	RlimitNoFile uint   `yaml:"rlimit_nofile"` // Maximum number of opened fd's per process (0: default)
 
+	// The user and the group the process runs as after the listening sockets are opened (Unix only)
+	// Empty: the privileges aren't dropped
+	UserName  string `yaml:"user_name"`
+	GroupName string `yaml:"group_name"`
+
 	// TTL for a web session (in hours)
 	// An active session is automatically refreshed once a day.
 	WebSessionTTLHours uint32 `yaml:"web_session_ttl"`
 
+	// Brute-force protection: the IP address is blocked for AuthBlockMin minutes
+	// after AuthAttempts failed log-in attempts.  0: disabled
+	AuthAttempts int    `yaml:"auth_attempts"`
+	AuthBlockMin uint32 `yaml:"block_auth_min"`
+
+	// API tokens for scripts and integrations
+	// Note: this array is filled only before file read/write and then it's cleared
+	APITokens []apiToken `yaml:"api_tokens"`
+
 	DNS dnsConfig `yaml:"dns"`
 	TLS tlsConfig `yaml:"tls"`
 
-	Filters          []filter `yaml:"filters"`
-	WhitelistFilters []filter `yaml:"whitelist_filters"`
-	UserRules        []string `yaml:"user_rules"`
+	Filters          []filter   `yaml:"filters"`
+	WhitelistFilters []filter   `yaml:"whitelist_filters"`
+	UserRules        []userRule `yaml:"user_rules"`
+
+	FiltersCatalog filtersCatalogConfig `yaml:"filters_catalog"`
 
 	DHCP dhcpd.ServerConfig `yaml:"dhcp"`
 
+	Metrics metricsConfig `yaml:"metrics"`
+
+	BlockPage blockPageConfig `yaml:"block_page"`
+
+	Notifications notificationsConfig `yaml:"notifications"`
+
+	ClientsDiscovery clientsDiscoveryConfig `yaml:"clients_discovery"`
+
+	Backup backupConfig `yaml:"backup"`
+
+	Sync syncConfig `yaml:"sync"`
+
+	HA haConfig `yaml:"ha"`
+
+	Update updateConfig `yaml:"update"`
+
+	// Outbound proxy for filter downloads, version checks and (optionally) DNS-over-HTTPS upstream servers
+	Proxy proxyConfig `yaml:"proxy"`
+
+	// External hooks
+	// They can be changed in configuration file only, because the programs are executed with the privileges of AdGuard Home.
+	Hooks []hook `yaml:"hooks"`
+
 	// Note: this array is filled only before file read/write and then it's cleared
 	Clients []clientObject `yaml:"clients"`
 
@@ -88,16 +145,38 @@ type dnsConfig struct {
 	QueryLogEnabled  bool   `yaml:"querylog_enabled"`  // if true, query log is enabled
 	QueryLogInterval uint32 `yaml:"querylog_interval"` // time interval for query log (in days)
 	QueryLogMemSize  uint32 `yaml:"querylog_memsize"`  // number of entries kept in memory before they are flushed to disk
+	QueryLogMaxSize  uint32 `yaml:"querylog_max_size"` // maximum size of query log file (in bytes) after which it's rotated.  0: no limit
+
+	// The storage of query log entries.  By default the entries are stored in a file in the data directory.
+	QueryLogStorage querylog.StorageConfig `yaml:"querylog_storage"`
+
+	// Destinations to which query log entries are forwarded
+	QueryLogForward []querylog.ForwardConfig `yaml:"querylog_forward"`
 
 	dnsforward.FilteringConfig `yaml:",inline"`
 
 	FilteringEnabled           bool             `yaml:"filtering_enabled"`       // whether or not use filter lists
 	FiltersUpdateIntervalHours uint32           `yaml:"filters_update_interval"` // time period to update filters (in hours)
+	FiltersUpdateSchedule      string           `yaml:"filters_update_schedule"` // cron expression.  Empty: the interval is used
+	FiltersUpdateJitter        uint32           `yaml:"filters_update_jitter"`   // the maximum random delay of the updates (in minutes)
+	FiltersCompress            bool             `yaml:"filters_compress"`        // store filter files on disk compressed with gzip
+	FiltersMaxSize             uint32           `yaml:"filters_max_size"`        // maximum size of filter data (in bytes).  0: no limit
+	FiltersMaxRules            uint32           `yaml:"filters_max_rules"`       // maximum number of rules in a filter.  0: no limit
+	FiltersChangesFull         bool             `yaml:"filters_changes_full"`    // store the lists of added and removed rules for filter changes
+	FiltersLocalDir            string           `yaml:"filters_local_dir"`       // the directory with local filter files.  Empty: local files can't be used
 	DnsfilterConf              dnsfilter.Config `yaml:",inline"`
 
 	// Names of services to block (globally).
 	// Per-client settings can override this configuration.
 	BlockedServices []string `yaml:"blocked_services"`
+
+	// Services defined by the user.
+	// They can be blocked the same way as the built-in services.
+	CustomServices []customService `yaml:"custom_services"`
+
+	// Weekly schedule of filtering settings (globally).
+	// Per-client settings can override this configuration.
+	Schedule filteringSchedule `yaml:"schedule"`
 }
 
 type tlsConfigSettings struct {
@@ -110,6 +189,9 @@ type tlsConfigSettings struct {
 	// Allow DOH queries via unencrypted HTTP (e.g. for reverse proxying)
 	AllowUnencryptedDOH bool `yaml:"allow_unencrypted_doh" json:"allow_unencrypted_doh"`
 
+	// Obtain and renew the certificate automatically from ACME server (e.g. Let's Encrypt)
+	ACME acmeConfig `yaml:"acme" json:"acme"`
+
 	dnsforward.TLSConfig `yaml:",inline" json:",inline"`
 }
 
@@ -138,12 +220,17 @@ type tlsConfigStatus struct {
 type tlsConfig struct {
 	tlsConfigSettings `yaml:",inline" json:",inline"`
 	tlsConfigStatus   `yaml:"-" json:",inline"`
+
+	ACMEStatus  *acmeStatus `yaml:"-" json:"acme_status,omitempty"` // nil if ACME is disabled
+	ExpiresSoon bool        `yaml:"-" json:"expires_soon"`          // the certificate expires in less than certificate_expire_days
 }
 
 // initialize to default values, will be changed later when reading config or parsing command line
 var config = configuration{
-	BindPort: 3000,
-	BindHost: "0.0.0.0",
+	BindPort:     3000,
+	BindHost:     "0.0.0.0",
+	AuthAttempts: authDefaultAttempts,
+	AuthBlockMin: authDefaultBlockMin,
 	DNS: dnsConfig{
 		BindHost:      "0.0.0.0",
 		Port:          53,
@@ -155,9 +242,15 @@ var config = configuration{
 			Ratelimit:          20,
 			RefuseAny:          true,
 			AllServers:         false,
+
+			RatelimitSubnetLenIPv4: 32,
+			RatelimitSubnetLenIPv6: 128,
+			RatelimitBanDuration:   10 * 60,
 		},
 		FilteringEnabled:           true, // whether or not use filter lists
 		FiltersUpdateIntervalHours: 24,
+		FiltersUpdateJitter:        10,
+		FiltersMaxSize:             100 * 1024 * 1024,
 	},
 	TLS: tlsConfig{
 		tlsConfigSettings: tlsConfigSettings{
@@ -169,6 +262,34 @@ var config = configuration{
 		LeaseDuration: 86400,
 		ICMPTimeout:   1000,
 	},
+	Metrics: metricsConfig{
+		RequireAuth: true,
+	},
+	BlockPage: blockPageConfig{
+		PortHTTP:   80,
+		UnblockMin: blockPageDefaultUnblockMin,
+	},
+	Notifications: notificationsConfig{
+		DiskFreeMinPercent:    notifyDefaultDiskFree,
+		CertificateExpireDays: notifyDefaultCertDays,
+	},
+	ClientsDiscovery: clientsDiscoveryConfig{
+		Enabled:  true,
+		Interval: discoveryDefaultInterval,
+		MDNS:     true,
+		NetBIOS:  true,
+	},
+	Backup: backupConfig{
+		Interval: backupDefaultInterval,
+		Keep:     backupDefaultKeep,
+	},
+	Sync: syncConfig{
+		Interval: syncDefaultInterval,
+	},
+	FiltersCatalog: filtersCatalogConfig{
+		URL:       catalogDefaultURL,
+		PublicKey: catalogDefaultPublicKey,
+	},
 	SchemaVersion: currentSchemaVersion,
 }
 
@@ -181,6 +302,9 @@ func initConfig() {
 	config.DNS.QueryLogMemSize = 1000
 
 	config.DNS.CacheSize = 4 * 1024 * 1024
+	config.DNS.CacheOptimisticMaxStale = 24 * 60 * 60
+	config.DNS.UpstreamHealthCheckInterval = 60
+	config.DNS.LocalPTREnabled = true
 	config.DNS.DnsfilterConf.SafeBrowsingCacheSize = 1 * 1024 * 1024
 	config.DNS.DnsfilterConf.SafeSearchCacheSize = 1 * 1024 * 1024
 	config.DNS.DnsfilterConf.ParentalCacheSize = 1 * 1024 * 1024
@@ -211,6 +335,12 @@ func getLogSettings() logSettings {
 	if err != nil {
 		return l
 	}
+	ci := configIncludes{}
+	yamlFile, err = ci.load(yamlFile, filepath.Dir(config.getConfigFilename()))
+	if err != nil {
+		log.Error("Couldn't get logging settings from the configuration: %s", err)
+		return l
+	}
 	err = yaml.Unmarshal(yamlFile, &l)
 	if err != nil {
 		log.Error("Couldn't get logging settings from the configuration: %s", err)
@@ -227,6 +357,11 @@ func parseConfig() error {
 		return err
 	}
 	config.fileData = nil
+	yamlFile, err = config.includes.load(yamlFile, filepath.Dir(configFile))
+	if err != nil {
+		log.Error("Couldn't read config file: %s", err)
+		return err
+	}
 	err = yaml.Unmarshal(yamlFile, &config)
 	if err != nil {
 		log.Error("Couldn't parse config file: %s", err)
@@ -236,6 +371,86 @@ func parseConfig() error {
 	if !checkFiltersUpdateIntervalHours(config.DNS.FiltersUpdateIntervalHours) {
 		config.DNS.FiltersUpdateIntervalHours = 24
 	}
+	err = checkFiltersUpdateSchedule(config.DNS.FiltersUpdateSchedule, config.DNS.FiltersUpdateJitter)
+	if err != nil {
+		log.Error("filters_update_schedule: %s: the update interval is used", err)
+		config.DNS.FiltersUpdateSchedule = ""
+		config.DNS.FiltersUpdateJitter = 0
+	}
+
+	assignUserRuleIDs(config.UserRules)
+
+	err = setCustomServices(config.DNS.CustomServices)
+	if err != nil {
+		log.Error("Invalid custom services: %s", err)
+		config.DNS.CustomServices = nil
+	}
+
+	err = config.DNS.Schedule.init()
+	if err != nil {
+		log.Error("Invalid schedule: %s", err)
+		config.DNS.Schedule = filteringSchedule{}
+	}
+
+	err = querylog.CheckForwardConfig(config.DNS.QueryLogForward)
+	if err != nil {
+		log.Error("Invalid query log forwarding settings: %s", err)
+		config.DNS.QueryLogForward = nil
+	}
+
+	err = checkMetricsConfig(config.Metrics)
+	if err != nil {
+		log.Error("Invalid metrics settings: %s", err)
+		config.Metrics.Enabled = false
+	}
+
+	err = checkBlockPageConfig(config.BlockPage, config.BindPort, config.TLS.PortHTTPS)
+	if err != nil {
+		log.Error("Invalid block page settings: %s", err)
+		config.BlockPage.Enabled = false
+	}
+
+	err = checkNotificationsConfig(config.Notifications)
+	if err != nil {
+		log.Error("Invalid notifications settings: %s", err)
+		config.Notifications = notificationsConfig{}
+	}
+
+	err = checkClientsDiscoveryConfig(config.ClientsDiscovery)
+	if err != nil {
+		log.Error("Invalid clients discovery settings: %s", err)
+		config.ClientsDiscovery.Enabled = false
+	}
+
+	err = checkBackupConfig(config.Backup)
+	if err != nil {
+		log.Error("Invalid backup settings: %s", err)
+		config.Backup.Interval = 0
+	}
+
+	err = checkSyncConfig(config.Sync)
+	if err != nil {
+		log.Error("Invalid sync settings: %s", err)
+		config.Sync.LeaderURL = ""
+	}
+
+	err = checkHAConfig(config.HA)
+	if err != nil {
+		log.Error("Invalid high availability settings: %s", err)
+		config.HA = haConfig{}
+	}
+
+	err = checkProxyConfig(config.Proxy)
+	if err != nil {
+		log.Error("Invalid proxy settings: %s", err)
+		config.Proxy = proxyConfig{}
+	}
+
+	err = checkHooksConfig(config.Hooks)
+	if err != nil {
+		log.Error("Invalid hooks settings: %s", err)
+		config.Hooks = nil
+	}
 
 	status := tlsConfigStatus{}
 	if !tlsLoadConfig(&config.TLS, &status) {
@@ -266,10 +481,42 @@ func (c *configuration) write() error {
 	c.Lock()
 	defer c.Unlock()
 
+	yamlText, err := c.marshalLocked()
+	if err != nil {
+		return err
+	}
+	yamlText, err = c.includes.strip(yamlText)
+	if err != nil {
+		log.Error("Couldn't generate YAML file: %s", err)
+		return err
+	}
+
+	configFile := config.getConfigFilename()
+	log.Debug("Writing YAML file: %s", configFile)
+	err = file.SafeWrite(configFile, yamlText)
+	if err != nil {
+		log.Error("Couldn't save YAML config: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// Get the current configuration in YAML format
+func (c *configuration) marshal() ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.marshalLocked()
+}
+
+// Get the current configuration of all modules in YAML format
+// The configuration must be locked.
+func (c *configuration) marshalLocked() ([]byte, error) {
 	Context.clients.WriteDiskConfig(&config.Clients)
 
 	if Context.auth != nil {
 		config.Users = Context.auth.GetUsers()
+		config.APITokens = Context.auth.getTokens()
 	}
 
 	if Context.stats != nil {
@@ -284,6 +531,7 @@ func (c *configuration) write() error {
 		config.DNS.QueryLogEnabled = dc.Enabled
 		config.DNS.QueryLogInterval = dc.Interval
 		config.DNS.QueryLogMemSize = dc.MemSize
+		config.DNS.QueryLogMaxSize = dc.MaxSize
 	}
 
 	if Context.dnsFilter != nil {
@@ -304,21 +552,13 @@ func (c *configuration) write() error {
 		config.DHCP = c
 	}
 
-	configFile := config.getConfigFilename()
-	log.Debug("Writing YAML file: %s", configFile)
 	yamlText, err := yaml.Marshal(&config)
 	config.Clients = nil
 	if err != nil {
 		log.Error("Couldn't generate YAML file: %s", err)
-		return err
-	}
-	err = file.SafeWrite(configFile, yamlText)
-	if err != nil {
-		log.Error("Couldn't save YAML config: %s", err)
-		return err
+		return nil, err
 	}
-
-	return nil
+	return yamlText, nil
 }
 
 func writeAllConfigs() error {
@@ -0,0 +1,324 @@
+// Configuration file includes and environment variables
+
+package home
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ${NAME} or ${NAME:-default};  $${NAME} is not substituted
+var configEnvRegexp = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// The state of the configuration files read from disk
+// The included files and the main file are merged: the values from the main file take priority.
+// The included files are never written.  When the configuration is written,
+// the values from the included files which haven't been changed are omitted,
+// and the values from the main file which haven't been changed are written as is,
+// so the references to environment variables are kept.
+type configIncludes struct {
+	used     bool          // the main file has includes or references to environment variables
+	included yaml.MapSlice // the merged contents of the included files
+	mainRaw  yaml.MapSlice // the contents of the main file as is
+	loaded   yaml.MapSlice // the merged configuration in the form it's written in
+}
+
+// Substitute environment variables in the string values of the decoded configuration
+// The keys are never changed, and the comments aren't seen at all.
+// Return TRUE if any value has been changed.
+func expandEnv(m yaml.MapSlice) (yaml.MapSlice, bool, error) {
+	changed := false
+	v, err := expandEnvValue(m, &changed)
+	if err != nil {
+		return nil, false, err
+	}
+	return v.(yaml.MapSlice), changed, nil
+}
+
+func expandEnvValue(v interface{}, changed *bool) (interface{}, error) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		res := make(yaml.MapSlice, len(v))
+		for i, it := range v {
+			val, err := expandEnvValue(it.Value, changed)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %s", it.Key, err)
+			}
+			res[i] = yaml.MapItem{Key: it.Key, Value: val}
+		}
+		return res, nil
+
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, it := range v {
+			val, err := expandEnvValue(it, changed)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = val
+		}
+		return res, nil
+
+	case string:
+		return expandEnvString(v, changed)
+	}
+	return v, nil
+}
+
+// Substitute environment variables in a string value
+// If the whole value is a reference (port: ${PORT}), the result is decoded as YAML scalar, so it may be a number or a boolean.
+// Otherwise, and if the result isn't a plain scalar (e.g. it has line breaks or "key: value"), it's kept as a string.
+func expandEnvString(s string, changed *bool) (interface{}, error) {
+	if !configEnvRegexp.MatchString(s) {
+		return s, nil
+	}
+	*changed = true
+
+	var err error
+	refs := 0
+	res := configEnvRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		if m[1] == '$' {
+			return m[1:]
+		}
+		refs++
+		sub := configEnvRegexp.FindStringSubmatchIndex(m)
+		name := m[sub[2]:sub[3]]
+		val, ok := os.LookupEnv(name)
+		if ok {
+			return val
+		}
+		if sub[4] >= 0 {
+			return m[sub[4]:sub[5]]
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return ""
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if refs != 1 || configEnvRegexp.FindString(s) != s {
+		return res, nil
+	}
+	var val interface{}
+	err = yaml.Unmarshal([]byte(res), &val)
+	if err != nil || val == nil {
+		return res, nil
+	}
+	switch val.(type) {
+	case int, int64, uint64, float64, bool:
+		// the value is used only if it's written back the same way, e.g. "0123" is kept as a string
+		d, _ := yaml.Marshal(val)
+		if strings.TrimSuffix(string(d), "\n") == res {
+			return val, nil
+		}
+	}
+	return res, nil
+}
+
+// Read the included files, substitute environment variables and merge the files
+// dir: the directory of the main file, relative paths of the included files are resolved against it
+func (ci *configIncludes) load(data []byte, dir string) ([]byte, error) {
+	*ci = configIncludes{}
+
+	main := yaml.MapSlice{}
+	err := yaml.Unmarshal(data, &main)
+	if err != nil {
+		return nil, err
+	}
+	main, changed, err := expandEnv(main)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	v, _ := yamlGet(main, "include")
+	if v != nil {
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("include: must be a list of file names")
+		}
+		for _, f := range list {
+			fn, ok := f.(string)
+			if !ok || len(fn) == 0 {
+				return nil, fmt.Errorf("include: invalid file name: %v", f)
+			}
+			files = append(files, fn)
+		}
+	}
+
+	ci.used = len(files) != 0 || changed
+	if !ci.used {
+		return data, nil
+	}
+
+	err = yaml.Unmarshal(data, &ci.mainRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fn := range files {
+		if !filepath.IsAbs(fn) {
+			fn = filepath.Join(dir, fn)
+		}
+		d, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("include: %s", err)
+		}
+		m := yaml.MapSlice{}
+		err = yaml.Unmarshal(d, &m)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+		m, _, err = expandEnv(m)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+		if _, ok := yamlGet(m, "include"); ok {
+			return nil, fmt.Errorf("%s: nested includes aren't supported", fn)
+		}
+		ci.included = yamlMerge(ci.included, m)
+		log.Debug("Included configuration file %s", fn)
+	}
+
+	merged, err := yaml.Marshal(yamlMerge(ci.included, main))
+	if err != nil {
+		return nil, err
+	}
+
+	// the values are compared with the current configuration in the same form
+	conf := configuration{}
+	err = yaml.Unmarshal(merged, &conf)
+	if err != nil {
+		return nil, err
+	}
+	d, err := yaml.Marshal(&conf)
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(d, &ci.loaded)
+	if err != nil {
+		return nil, err
+	}
+
+	return merged, nil
+}
+
+// Prepare the configuration for writing to the main file:
+// remove the values from the included files and restore the references to environment variables
+func (ci *configIncludes) strip(data []byte) ([]byte, error) {
+	if !ci.used {
+		return data, nil
+	}
+
+	cur := yaml.MapSlice{}
+	err := yaml.Unmarshal(data, &cur)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(yamlStrip(cur, ci.loaded, ci.included, ci.mainRaw))
+}
+
+func yamlGet(m yaml.MapSlice, key interface{}) (interface{}, bool) {
+	for _, it := range m {
+		if it.Key == key {
+			return it.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Merge the mappings recursively: the values from "over" take priority
+func yamlMerge(base yaml.MapSlice, over yaml.MapSlice) yaml.MapSlice {
+	res := append(yaml.MapSlice{}, base...)
+	for _, it := range over {
+		found := false
+		for i := range res {
+			if res[i].Key != it.Key {
+				continue
+			}
+			bm, ok1 := res[i].Value.(yaml.MapSlice)
+			om, ok2 := it.Value.(yaml.MapSlice)
+			if ok1 && ok2 {
+				res[i].Value = yamlMerge(bm, om)
+			} else {
+				res[i].Value = it.Value
+			}
+			found = true
+			break
+		}
+		if !found {
+			res = append(res, it)
+		}
+	}
+	return res
+}
+
+// Compare the current values with the loaded ones:
+// the changed values and the values which aren't set in any file are kept,
+// the unchanged values from the included files are removed,
+// the unchanged values from the main file are replaced with the values as is
+func yamlStrip(cur, loaded, included, raw yaml.MapSlice) yaml.MapSlice {
+	res := yaml.MapSlice{}
+	for _, it := range cur {
+		loadedVal, _ := yamlGet(loaded, it.Key)
+		incVal, inIncluded := yamlGet(included, it.Key)
+		rawVal, inMain := yamlGet(raw, it.Key)
+
+		cm, ok := it.Value.(yaml.MapSlice)
+		if ok && (inMain || inIncluded) {
+			lm, _ := loadedVal.(yaml.MapSlice)
+			im, ok1 := incVal.(yaml.MapSlice)
+			rm, ok2 := rawVal.(yaml.MapSlice)
+			if (ok1 || !inIncluded) && (ok2 || !inMain) {
+				sub := yamlStrip(cm, lm, im, rm)
+				if len(sub) != 0 || inMain {
+					res = append(res, yaml.MapItem{Key: it.Key, Value: sub})
+				}
+				continue
+			}
+		}
+
+		if !yamlEqual(it.Value, loadedVal) {
+			res = append(res, it)
+		} else if inMain {
+			res = append(res, yaml.MapItem{Key: it.Key, Value: rawVal})
+		} else if !inIncluded {
+			res = append(res, it)
+		}
+	}
+	return res
+}
+
+// Compare the values ignoring the order of keys in mappings
+func yamlEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(yamlNormalize(a), yamlNormalize(b))
+}
+
+func yamlNormalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		m := map[interface{}]interface{}{}
+		for _, it := range v {
+			m[it.Key] = yamlNormalize(it.Value)
+		}
+		return m
+	case []interface{}:
+		list := []interface{}{}
+		for _, it := range v {
+			list = append(list, yamlNormalize(it))
+		}
+		return list
+	}
+	return v
+}
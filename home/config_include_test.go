@@ -0,0 +1,132 @@
+package home
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestConfigIncludeEnv(t *testing.T) {
+	_ = os.Setenv("AGH_TEST_PORT", "3000")
+	_ = os.Setenv("AGH_TEST_VALUE", "x\nbind_host: 0.0.0.0 # ${AGH_TEST_PORT}")
+	_ = os.Unsetenv("AGH_TEST_UNSET")
+	defer func() {
+		_ = os.Unsetenv("AGH_TEST_PORT")
+		_ = os.Unsetenv("AGH_TEST_VALUE")
+	}()
+
+	m := mustYAML(t, "a: ${AGH_TEST_PORT}\nb: ${AGH_TEST_UNSET:-x}\nc: ${AGH_TEST_UNSET:-}\nd: $${AGH_TEST_PORT}\ne: tcp://${AGH_TEST_PORT}\n# ${AGH_TEST_UNSET}\n")
+	m, changed, err := expandEnv(m)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, yaml.MapSlice{
+		{Key: "a", Value: 3000},
+		{Key: "b", Value: "x"},
+		{Key: "c", Value: ""},
+		{Key: "d", Value: "${AGH_TEST_PORT}"},
+		{Key: "e", Value: "tcp://3000"},
+	}, m)
+
+	// the value can't add new keys: it's kept as a string with all its characters
+	m, _, err = expandEnv(mustYAML(t, "dns:\n  upstream_dns:\n  - ${AGH_TEST_VALUE}\n"))
+	assert.Nil(t, err)
+	v, _ := yamlGet(m, "dns")
+	assert.Equal(t, yaml.MapSlice{{Key: "upstream_dns", Value: []interface{}{"x\nbind_host: 0.0.0.0 # ${AGH_TEST_PORT}"}}}, v)
+	d, _ := yaml.Marshal(m)
+	conf := configuration{}
+	assert.Nil(t, yaml.Unmarshal(d, &conf))
+	assert.Equal(t, []string{"x\nbind_host: 0.0.0.0 # ${AGH_TEST_PORT}"}, conf.DNS.UpstreamDNS)
+	assert.Equal(t, "", conf.DNS.BindHost)
+
+	_, _, err = expandEnv(mustYAML(t, "a: ${AGH_TEST_UNSET}\n"))
+	assert.NotNil(t, err)
+
+	_, changed, _ = expandEnv(mustYAML(t, "a: 1\n"))
+	assert.False(t, changed)
+}
+
+func TestConfigInclude(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	_ = os.Setenv("AGH_TEST_PORT", "3000")
+	defer func() { _ = os.Unsetenv("AGH_TEST_PORT") }()
+
+	_ = ioutil.WriteFile(filepath.Join(dir, "clients.yaml"), []byte("clients:\n- name: c1\n  ids:\n  - 1.2.3.4\n"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, "dns.yaml"), []byte("dns:\n  bind_host: 0.0.0.0\n  port: 53\n"), 0644)
+	main := "include:\n- clients.yaml\n- dns.yaml\nbind_port: ${AGH_TEST_PORT}\ndns:\n  port: 5353\n"
+
+	ci := configIncludes{}
+	data, err := ci.load([]byte(main), dir)
+	assert.Nil(t, err)
+	assert.True(t, ci.used)
+
+	// the values from the main file take priority
+	conf := configuration{}
+	assert.Nil(t, yaml.Unmarshal(data, &conf))
+	assert.Equal(t, 3000, conf.BindPort)
+	assert.Equal(t, "0.0.0.0", conf.DNS.BindHost)
+	assert.Equal(t, 5353, conf.DNS.Port)
+	assert.Equal(t, 1, len(conf.Clients))
+
+	// the included values and the references to environment variables are kept
+	data, _ = yaml.Marshal(&conf)
+	out, err := ci.strip(data)
+	assert.Nil(t, err)
+	m := mustYAML(t, string(out))
+	v, _ := yamlGet(m, "bind_port")
+	assert.Equal(t, "${AGH_TEST_PORT}", v)
+	_, ok := yamlGet(m, "clients")
+	assert.False(t, ok)
+	v, _ = yamlGet(m, "dns")
+	dns := v.(yaml.MapSlice)
+	_, ok = yamlGet(dns, "bind_host")
+	assert.False(t, ok)
+	v, _ = yamlGet(dns, "port")
+	assert.Equal(t, 5353, v)
+	v, _ = yamlGet(m, "include")
+	assert.Equal(t, []interface{}{"clients.yaml", "dns.yaml"}, v)
+
+	// the changed values are written
+	conf.DNS.BindHost = "127.0.0.1"
+	conf.BindPort = 80
+	data, _ = yaml.Marshal(&conf)
+	out, err = ci.strip(data)
+	assert.Nil(t, err)
+	m = mustYAML(t, string(out))
+	v, _ = yamlGet(m, "bind_port")
+	assert.Equal(t, 80, v)
+	v, _ = yamlGet(m, "dns")
+	v, _ = yamlGet(v.(yaml.MapSlice), "bind_host")
+	assert.Equal(t, "127.0.0.1", v)
+
+	// the configuration without includes is kept as is
+	ci = configIncludes{}
+	data, err = ci.load([]byte("bind_port: 80\n"), dir)
+	assert.Nil(t, err)
+	assert.False(t, ci.used)
+	assert.Equal(t, "bind_port: 80\n", string(data))
+
+	// errors
+	_, err = ci.load([]byte("include:\n- missing.yaml\n"), dir)
+	assert.NotNil(t, err)
+	_, err = ci.load([]byte("include: clients.yaml\n"), dir)
+	assert.NotNil(t, err)
+	_ = ioutil.WriteFile(filepath.Join(dir, "nested.yaml"), []byte("include:\n- clients.yaml\n"), 0644)
+	_, err = ci.load([]byte("include:\n- nested.yaml\n"), dir)
+	assert.NotNil(t, err)
+}
+
+func TestYAMLEqual(t *testing.T) {
+	assert.True(t, yamlEqual(mustYAML(t, "a: 1\nb:\n  c: 2\n  d: 3\n"), mustYAML(t, "b:\n  d: 3\n  c: 2\na: 1\n")))
+	assert.False(t, yamlEqual(mustYAML(t, "a: [1, 2]\n"), mustYAML(t, "a: [2, 1]\n")))
+}
+
+func mustYAML(t *testing.T, s string) yaml.MapSlice {
+	m := yaml.MapSlice{}
+	assert.Nil(t, yaml.Unmarshal([]byte(s), &m))
+	return m
+}
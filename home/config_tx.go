@@ -0,0 +1,162 @@
+package home
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Configuration transaction
+// The changes of DNS and TLS settings are validated as a whole,
+// applied to DNS server and written to disk once.
+// If DNS server fails to start with the new settings, the previous settings are restored.
+type configTx struct {
+	dns dnsConfig
+	tls tlsConfig
+}
+
+// Start a transaction: save the current settings
+// The changes must be made under config lock after the transaction has been started.
+func beginConfigTx() *configTx {
+	config.RLock()
+	tx := &configTx{
+		dns: config.DNS,
+		tls: config.TLS,
+	}
+	config.RUnlock()
+	return tx
+}
+
+// Check the new settings
+func (tx *configTx) validate() error {
+	newconfig := generateServerConfig()
+	err := dnsforward.ValidateConfig(&newconfig.FilteringConfig)
+	if err != nil {
+		return err
+	}
+
+	config.RLock()
+	tls := config.TLS
+	bindHost := config.DNS.BindHost
+	port := config.DNS.Port
+	listeners := len(config.DNS.Listeners) != 0
+	config.RUnlock()
+
+	// DNS server is restarted on the new address: check it before the current sockets are closed
+	if (bindHost != tx.dns.BindHost || port != tx.dns.Port) && port != 0 && !listeners {
+		err = tx.checkDNSAddress(bindHost, port)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the port is already used by our DNS server if it hasn't been changed
+	if tls.Enabled && tls.PortDNSOverTLS != 0 &&
+		!(tx.tls.Enabled && tx.tls.PortDNSOverTLS == tls.PortDNSOverTLS && isRunning()) {
+		err = util.CheckPortAvailable(bindHost, tls.PortDNSOverTLS)
+		if err != nil {
+			return fmt.Errorf("port %d is not available, cannot enable DNS-over-TLS on it", tls.PortDNSOverTLS)
+		}
+	}
+	return nil
+}
+
+// Check if DNS server can listen on the new address
+func (tx *configTx) checkDNSAddress(host string, port int) error {
+	if Context.sockets.dnsSockets() != nil {
+		return fmt.Errorf("DNS server uses the sockets opened in advance: its address can't be changed without restart")
+	}
+	// the port is already used by our DNS server if only the host has been changed
+	if port == tx.dns.Port && isRunning() {
+		return nil
+	}
+	err := checkDNSPortAvailable(host, port, true)
+	if err == nil {
+		err = checkDNSPortAvailable(host, port, false)
+	}
+	if err != nil {
+		return fmt.Errorf("port %d is not available, cannot run DNS server on it: %s", port, err)
+	}
+	return nil
+}
+
+// Restore the previous settings
+func (tx *configTx) rollback() {
+	config.Lock()
+	customChanged := !reflect.DeepEqual(config.DNS.CustomServices, tx.dns.CustomServices)
+	config.DNS = tx.dns
+	config.TLS = tx.tls
+	if customChanged {
+		_ = setCustomServices(tx.dns.CustomServices)
+	}
+	config.Unlock()
+}
+
+// Validate and apply the new settings, then write the configuration
+// On error the previous settings are restored.
+func (tx *configTx) commit() error {
+	err := tx.validate()
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	if isRunning() {
+		err = tx.restart()
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeAllConfigs()
+}
+
+// Restart DNS server with the new settings
+// On error the previous settings are restored.
+func (tx *configTx) restart() error {
+	err := reconfigureDNSServer()
+	if err != nil {
+		log.Error("%s: restoring the previous settings", err)
+		tx.rollback()
+		err2 := reconfigureDNSServer()
+		if err2 != nil {
+			log.Error("Can't restore the previous settings: %s", err2)
+		}
+		return err
+	}
+	return nil
+}
+
+// Validate and apply the settings reloaded from configuration file
+// DNS server is restarted only if its listen addresses or encryption settings have changed,
+// otherwise the requests in progress aren't affected.
+// The configuration isn't written.
+func (tx *configTx) reload() error {
+	err := tx.validate()
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	if !isRunning() {
+		return nil
+	}
+
+	config.RLock()
+	restart := tx.dns.BindHost != config.DNS.BindHost || tx.dns.Port != config.DNS.Port ||
+		!tlsSettingsEqual(tx.tls.tlsConfigSettings, config.TLS.tlsConfigSettings)
+	config.RUnlock()
+	if restart {
+		return tx.restart()
+	}
+
+	newconfig := generateServerConfig()
+	err = Context.dnsServer.Reload(&newconfig.FilteringConfig)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	return nil
+}
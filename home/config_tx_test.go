@@ -0,0 +1,31 @@
+package home
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigTx(t *testing.T) {
+	initServices()
+	defer initServices()
+	prevDNS := config.DNS
+	defer func() { config.DNS = prevDNS }()
+
+	// the previous settings are restored if the new settings are invalid
+	tx := beginConfigTx()
+	config.Lock()
+	config.DNS.BlockedServices = []string{"youtube"}
+	config.DNS.UpstreamMode = "unknown"
+	list := []customService{{Name: "game", Domains: []string{"example.org"}}}
+	assert.Nil(t, setCustomServices(list))
+	config.DNS.CustomServices = list
+	config.Unlock()
+	assert.True(t, serviceExists("game"))
+
+	assert.NotNil(t, tx.commit())
+	assert.Equal(t, prevDNS.BlockedServices, config.DNS.BlockedServices)
+	assert.Equal(t, prevDNS.UpstreamMode, config.DNS.UpstreamMode)
+	assert.Equal(t, 0, len(config.DNS.CustomServices))
+	assert.False(t, serviceExists("game"))
+}
@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/util"
 
@@ -39,15 +40,6 @@ func httpError(w http.ResponseWriter, code int, format string, args ...interface
 // ---------------
 // dns run control
 // ---------------
-func writeAllConfigsAndReloadDNS() error {
-	err := writeAllConfigs()
-	if err != nil {
-		log.Error("Couldn't write all configs: %s", err)
-		return err
-	}
-	return reconfigureDNSServer()
-}
-
 func addDNSAddress(dnsAddresses *[]string, addr string) {
 	if config.DNS.Port != 53 {
 		addr = fmt.Sprintf("%s:%d", addr, config.DNS.Port)
@@ -55,11 +47,43 @@ func addDNSAddress(dnsAddresses *[]string, addr string) {
 	*dnsAddresses = append(*dnsAddresses, addr)
 }
 
+// Get the plain DNS addresses of the listeners
+func getListenerAddresses(list []dnsforward.ListenerConfig, ifaces []util.NetInterface) []string {
+	addrs := []string{}
+	for _, l := range list {
+		if l.Port == 0 {
+			continue
+		}
+		ips := []string{l.Address}
+		if len(l.Interface) != 0 {
+			ips = nil
+			for _, iface := range ifaces {
+				if iface.Name == l.Interface {
+					ips = iface.Addresses
+				}
+			}
+		}
+		for _, ip := range ips {
+			if l.Port != 53 {
+				ip = net.JoinHostPort(ip, strconv.Itoa(l.Port))
+			}
+			addrs = append(addrs, ip)
+		}
+	}
+	return addrs
+}
+
 // Get the list of DNS addresses the server is listening on
 func getDNSAddresses() []string {
 	dnsAddresses := []string{}
 
-	if config.DNS.BindHost == "0.0.0.0" {
+	if len(config.DNS.Listeners) != 0 {
+		ifaces, e := util.GetValidNetInterfacesForWeb()
+		if e != nil {
+			log.Error("Couldn't get network interfaces: %v", e)
+		}
+		dnsAddresses = getListenerAddresses(config.DNS.Listeners, ifaces)
+	} else if config.DNS.BindHost == "0.0.0.0" {
 		ifaces, e := util.GetValidNetInterfacesForWeb()
 		if e != nil {
 			log.Error("Couldn't get network interfaces: %v", e)
@@ -76,25 +100,79 @@ func getDNSAddresses() []string {
 	}
 
 	if config.TLS.Enabled && len(config.TLS.ServerName) != 0 {
-
-		if config.TLS.PortHTTPS != 0 {
-			addr := config.TLS.ServerName
-			if config.TLS.PortHTTPS != 443 {
-				addr = fmt.Sprintf("%s:%d", addr, config.TLS.PortHTTPS)
-			}
-			addr = fmt.Sprintf("https://%s/dns-query", addr)
-			dnsAddresses = append(dnsAddresses, addr)
+		serverNames := []string{config.TLS.ServerName}
+		for _, n := range config.TLS.ServerNames {
+			serverNames = append(serverNames, n.ServerName)
+		}
+		for _, serverName := range serverNames {
+			dnsAddresses = append(dnsAddresses, encryptedDNSAddresses(serverName)...)
 		}
+	}
+
+	return dnsAddresses
+}
 
-		if config.TLS.PortDNSOverTLS != 0 {
-			addr := fmt.Sprintf("tls://%s:%d", config.TLS.ServerName, config.TLS.PortDNSOverTLS)
-			dnsAddresses = append(dnsAddresses, addr)
+// Get the path of DNS-over-HTTPS requests
+func dohURLPath() string {
+	if len(config.TLS.DoHPath) != 0 {
+		return config.TLS.DoHPath
+	}
+	return "/dns-query"
+}
+
+// Get the addresses of DNS-over-HTTPS and DNS-over-TLS servers for the server name
+func encryptedDNSAddresses(serverName string) []string {
+	dnsAddresses := []string{}
+	if config.TLS.PortHTTPS != 0 {
+		addr := serverName
+		if config.TLS.PortHTTPS != 443 {
+			addr = fmt.Sprintf("%s:%d", addr, config.TLS.PortHTTPS)
 		}
+		addr = fmt.Sprintf("https://%s%s", addr, dohURLPath())
+		dnsAddresses = append(dnsAddresses, addr)
 	}
 
+	// the listeners replace DNS-over-TLS port setting
+	if config.TLS.PortDNSOverTLS != 0 && len(config.DNS.Listeners) == 0 {
+		addr := fmt.Sprintf("tls://%s:%d", serverName, config.TLS.PortDNSOverTLS)
+		dnsAddresses = append(dnsAddresses, addr)
+	}
+
+	added := map[string]bool{}
+	for _, l := range config.DNS.Listeners {
+		addrs := []string{}
+		if l.PortDNSOverTLS != 0 {
+			addrs = append(addrs, fmt.Sprintf("tls://%s:%d", serverName, l.PortDNSOverTLS))
+		}
+		if l.PortDNSOverHTTPS != 0 {
+			addrs = append(addrs, fmt.Sprintf("https://%s:%d%s", serverName, l.PortDNSOverHTTPS, dohURLPath()))
+		}
+		for _, addr := range addrs {
+			if !added[addr] {
+				added[addr] = true
+				dnsAddresses = append(dnsAddresses, addr)
+			}
+		}
+	}
 	return dnsAddresses
 }
 
+// Get the network interfaces for DNS listener settings
+func handleGetInterfaces(w http.ResponseWriter, r *http.Request) {
+	ifaces, err := getNetInterfaces()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't get interfaces: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(ifaces)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
 func handleStatus(w http.ResponseWriter, r *http.Request) {
 	c := dnsforward.FilteringConfig{}
 	if Context.dnsServer != nil {
@@ -112,6 +190,12 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		"bootstrap_dns":      c.BootstrapDNS,
 		"upstream_dns":       c.UpstreamDNS,
 		"all_servers":        c.AllServers,
+		"fallback_dns":       c.FallbackDNS,
+		"upstream_mode":      c.UpstreamMode,
+		"upstream_weights":   c.UpstreamWeights,
+		"forward_zones":      c.ForwardZones,
+
+		"filtering_paused_until": getFilteringPause(time.Now()).Until, // empty: filtering isn't paused globally
 	}
 
 	jsonVal, err := json.Marshal(data)
@@ -129,12 +213,14 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 
 type profileJSON struct {
 	Name string `json:"name"`
+	Role string `json:"role"`
 }
 
 func handleGetProfile(w http.ResponseWriter, r *http.Request) {
 	pj := profileJSON{}
 	u := Context.auth.GetCurrentUser(r)
 	pj.Name = u.Name
+	pj.Role = u.role()
 
 	data, err := json.Marshal(pj)
 	if err != nil {
@@ -147,12 +233,43 @@ func handleGetProfile(w http.ResponseWriter, r *http.Request) {
 // --------------
 // DNS-over-HTTPS
 // --------------
+
+// Return TRUE if the request path is DNS-over-HTTPS path: doh_path ("/dns-query"), an endpoint's path or a path under them
+func isDoHPath(path string) bool {
+	config.RLock()
+	defer config.RUnlock()
+	return dnsforward.IsDoHPath(path, config.TLS.DoHPath, config.TLS.DoHEndpoints)
+}
+
+type dohPathHandlerStruct struct {
+	handler http.Handler
+}
+
+func (h *dohPathHandlerStruct) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isDoHPath(r.URL.Path) {
+		postInstall(handleDOH)(w, r)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// dohPathHandler passes DNS-over-HTTPS requests to handleDOH() and the other requests to the handler
+func dohPathHandler(handler http.Handler) http.Handler {
+	return &dohPathHandlerStruct{handler}
+}
+
 func handleDOH(w http.ResponseWriter, r *http.Request) {
 	if !config.TLS.AllowUnencryptedDOH && r.TLS == nil {
 		httpError(w, http.StatusNotFound, "Not Found")
 		return
 	}
 
+	// mutual TLS: the client certificate has been verified during TLS handshake
+	if config.TLS.ClientAuth && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		httpError(w, http.StatusForbidden, "Client certificate is required")
+		return
+	}
+
 	if !isRunning() {
 		httpError(w, http.StatusInternalServerError, "DNS server is not running")
 		return
@@ -172,17 +289,33 @@ func registerControlHandlers() {
 	httpRegister(http.MethodPost, "/control/update", handleUpdate)
 
 	httpRegister("GET", "/control/profile", handleGetProfile)
+	httpRegister(http.MethodGet, "/control/interfaces", handleGetInterfaces)
 
 	RegisterFilteringHandlers()
+	RegisterUserRulesHandlers()
+	RegisterFilteringPauseHandlers()
 	RegisterTLSHandlers()
 	RegisterBlockedServicesHandlers()
+	RegisterScheduleHandlers()
+	RegisterAddressesHandlers()
+	RegisterMetricsHandlers()
+	RegisterNotificationsHandlers()
+	RegisterHooksHandlers()
 	RegisterAuthHandlers()
+	RegisterUsersHandlers()
+	RegisterTOTPHandlers()
+	RegisterTokensHandlers()
+	RegisterBackupHandlers()
+	RegisterSyncHandlers()
+	RegisterHAHandlers()
+	RegisterUpdateHandlers()
+	RegisterLogHandlers()
+	RegisterDebugHandlers()
 
-	http.HandleFunc("/dns-query", postInstall(handleDOH))
 }
 
 func httpRegister(method string, url string, handler func(http.ResponseWriter, *http.Request)) {
-	http.Handle(url, postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureHandler(method, handler)))))
+	http.Handle(url, postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureHandler(method, auditHandler(routeRole(url), handler))))))
 }
 
 // ----------------------------------
@@ -13,6 +13,7 @@ import (
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
+	yaml "gopkg.in/yaml.v2"
 )
 
 // IsValidURL - return TRUE if URL is valid
@@ -27,10 +28,18 @@ func IsValidURL(rawurl string) bool {
 	return true
 }
 
+// Return TRUE if filter URL is valid: it's either a valid URL or an absolute path to a local file
+func isValidFilterURL(u string) bool {
+	return filterLocalPath(u) != "" || IsValidURL(u)
+}
+
 type filterAddJSON struct {
 	Name      string `json:"name"`
 	URL       string `json:"url"`
 	Whitelist bool   `json:"whitelist"`
+
+	// ID of the filter in catalog.  If set, "name" and "url" are taken from the catalog.
+	CatalogID string `json:"catalog_id"`
 }
 
 func handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
@@ -41,7 +50,17 @@ func handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !IsValidURL(fj.URL) {
+	if len(fj.CatalogID) != 0 {
+		cf, err := Context.filtersCatalog.find(fj.CatalogID)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		fj.URL = cf.URL
+		fj.Name = cf.Name
+	}
+
+	if !isValidFilterURL(fj.URL) {
 		http.Error(w, "Invalid URL", http.StatusBadRequest)
 		return
 	}
@@ -111,7 +130,7 @@ func handleFilteringRemoveURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !IsValidURL(req.URL) {
+	if !isValidFilterURL(req.URL) {
 		http.Error(w, "URL parameter is not valid request URL", http.StatusBadRequest)
 		return
 	}
@@ -164,7 +183,7 @@ func handleFilteringSetURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !IsValidURL(fj.URL) {
+	if !isValidFilterURL(fj.URL) {
 		http.Error(w, "invalid URL", http.StatusBadRequest)
 		return
 	}
@@ -216,14 +235,10 @@ func handleFilteringSetRules(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	config.UserRules = strings.Split(string(body), "\n")
-	onConfigModified()
-	userFilter := userFilter()
-	err = userFilter.save()
-	if err != nil {
-		log.Error("Couldn't save the user filter: %s", err)
-	}
-	enableFilters(true)
+	config.Lock()
+	config.UserRules = userRulesFromTexts(config.UserRules, strings.Split(string(body), "\n"))
+	config.Unlock()
+	applyUserRules()
 }
 
 func handleFilteringRefresh(w http.ResponseWriter, r *http.Request) {
@@ -264,6 +279,205 @@ func handleFilteringRefresh(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(js)
 }
 
+func handleFilteringRefreshOne(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		ID  int64  `json:"id"`
+		URL string `json:"url"`
+	}
+	type Resp struct {
+		Updated bool `json:"updated"`
+	}
+	resp := Resp{}
+
+	req := Req{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+	if req.ID == 0 && len(req.URL) == 0 {
+		httpError(w, http.StatusBadRequest, "filter ID or URL is required")
+		return
+	}
+
+	Context.controlLock.Unlock()
+	resp.Updated, err = refreshFilter(req.ID, req.URL)
+	Context.controlLock.Lock()
+	if err == errFiltersUpdating {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	} else if err != nil {
+		httpError(w, http.StatusBadRequest, "Couldn't refresh filter: %s", err)
+		return
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// Filters bundle: the list of filter subscriptions and user rules
+// It's used to transfer filtering settings from one instance to another.
+type filtersBundleEntry struct {
+	Name    string `json:"name" yaml:"name"`
+	URL     string `json:"url" yaml:"url"`
+	Enabled bool   `json:"enabled" yaml:"enabled"`
+}
+
+type filtersBundle struct {
+	Filters          []filtersBundleEntry `json:"filters" yaml:"filters"`
+	WhitelistFilters []filtersBundleEntry `json:"whitelist_filters" yaml:"whitelist_filters"`
+	UserRules        []string             `json:"user_rules" yaml:"user_rules"`
+}
+
+func filtersToBundle(filters []filter) []filtersBundleEntry {
+	entries := []filtersBundleEntry{}
+	for _, f := range filters {
+		entries = append(entries, filtersBundleEntry{
+			Name:    f.Name,
+			URL:     f.URL,
+			Enabled: f.Enabled,
+		})
+	}
+	return entries
+}
+
+// Export filter subscriptions and user rules
+// "format" parameter: "json" (default) or "yaml"
+func handleFilteringExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "yaml" {
+		httpError(w, http.StatusBadRequest, "Unsupported format: %s", format)
+		return
+	}
+
+	b := filtersBundle{}
+	config.RLock()
+	b.Filters = filtersToBundle(config.Filters)
+	b.WhitelistFilters = filtersToBundle(config.WhitelistFilters)
+	b.UserRules = userRulesTexts(config.UserRules)
+	config.RUnlock()
+
+	var data []byte
+	var err error
+	if format == "yaml" {
+		data, err = yaml.Marshal(b)
+		w.Header().Set("Content-Type", "application/x-yaml")
+	} else {
+		data, err = json.Marshal(b)
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s encode: %s", format, err)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=filters."+format)
+	_, _ = w.Write(data)
+}
+
+// Import filter subscriptions and user rules
+// The bundle is in JSON format, or in YAML format if Content-Type is "application/x-yaml".
+// Filters with URLs that already exist are skipped.
+// User rules that don't exist yet are appended to the current user rules.
+func handleFilteringImport(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to read request body: %s", err)
+		return
+	}
+
+	b := filtersBundle{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-yaml") {
+		err = yaml.Unmarshal(body, &b)
+	} else {
+		err = json.Unmarshal(body, &b)
+	}
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse the bundle: %s", err)
+		return
+	}
+
+	var filters []filter
+	enabled := false // TRUE if there are enabled filters
+	for _, arr := range []struct {
+		entries []filtersBundleEntry
+		white   bool
+	}{
+		{b.Filters, false},
+		{b.WhitelistFilters, true},
+	} {
+		for _, e := range arr.entries {
+			if !isValidFilterURL(e.URL) {
+				httpError(w, http.StatusBadRequest, "Invalid URL: %s", e.URL)
+				return
+			}
+			filters = append(filters, filter{
+				Enabled: e.Enabled,
+				URL:     e.URL,
+				Name:    e.Name,
+				white:   arr.white,
+			})
+			enabled = enabled || e.Enabled
+		}
+	}
+
+	type Resp struct {
+		Added          int `json:"added"`
+		UserRulesAdded int `json:"user_rules_added"`
+	}
+	resp := Resp{}
+	resp.Added = filterAddBulk(filters)
+
+	config.Lock()
+	existing := map[string]bool{}
+	for _, rule := range config.UserRules {
+		existing[rule.Text] = true
+	}
+	var newRules []string
+	for _, rule := range b.UserRules {
+		rule = strings.TrimSpace(rule)
+		if len(rule) == 0 || existing[rule] {
+			continue
+		}
+		existing[rule] = true
+		newRules = append(newRules, rule)
+	}
+	config.UserRules = append(config.UserRules, userRulesFromTexts(nil, newRules)...)
+	resp.UserRulesAdded = len(newRules)
+	config.Unlock()
+
+	onConfigModified()
+	if resp.UserRulesAdded != 0 {
+		userFilter := userFilter()
+		err = userFilter.save()
+		if err != nil {
+			log.Error("Couldn't save the user filter: %s", err)
+		}
+		enableFilters(true)
+	}
+	if resp.Added != 0 && enabled {
+		// new filters have never been updated, so they'll be downloaded now
+		go func() {
+			_, _ = refreshFilters(FilterRefreshBlocklists|FilterRefreshAllowlists, true)
+		}()
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
 type filterJSON struct {
 	ID          int64  `json:"id"`
 	Enabled     bool   `json:"enabled"`
@@ -271,6 +485,23 @@ type filterJSON struct {
 	Name        string `json:"name"`
 	RulesCount  uint32 `json:"rules_count"`
 	LastUpdated string `json:"last_updated"`
+	Format      string `json:"format"`       // format of the source data: adblock, hosts, dnsmasq, domains
+	LastAttempt string `json:"last_attempt"` // the time of the last update attempt
+	LastError   string `json:"last_error"`   // the error that occurred during the last update attempt
+	MaxSize     uint32 `json:"max_size"`
+	MaxRules    uint32 `json:"max_rules"`
+	Expires     uint32 `json:"expires"` // update interval specified in filter data (in hours).  0: the global interval is used
+
+	// The result of verification of filter data: "" (not verified), "checksum", "signature"
+	Verification string `json:"verification"`
+
+	// Alternate URLs and the one the current data was downloaded from ("": the main URL)
+	Mirrors    []string `json:"mirrors"`
+	LastMirror string   `json:"last_mirror"`
+
+	// Invalid rules found during the last update
+	InvalidRulesCount int           `json:"invalid_rules_count"`
+	InvalidRules      []invalidRule `json:"invalid_rules"`
 }
 
 type filteringConfig struct {
@@ -288,11 +519,33 @@ func filterToJSON(f filter) filterJSON {
 		URL:        f.URL,
 		Name:       f.Name,
 		RulesCount: uint32(f.RulesCount),
+		Format:     f.Format,
+		LastError:  f.LastError,
+		MaxSize:    f.MaxSize,
+		MaxRules:   f.MaxRules,
+		Expires:    uint32(f.expires / time.Hour),
+
+		Verification: f.Verification,
+
+		Mirrors:    f.Mirrors,
+		LastMirror: f.LastMirror,
+
+		InvalidRulesCount: f.invalidRulesCount,
+		InvalidRules:      f.invalidRules,
+	}
+	if fj.InvalidRules == nil {
+		fj.InvalidRules = []invalidRule{}
+	}
+	if fj.Mirrors == nil {
+		fj.Mirrors = []string{}
 	}
 
 	if !f.LastUpdated.IsZero() {
 		fj.LastUpdated = f.LastUpdated.Format(time.RFC3339)
 	}
+	if !f.LastAttempt.IsZero() {
+		fj.LastAttempt = f.LastAttempt.Format(time.RFC3339)
+	}
 
 	return fj
 }
@@ -311,7 +564,7 @@ func handleFilteringStatus(w http.ResponseWriter, r *http.Request) {
 		fj := filterToJSON(f)
 		resp.WhitelistFilters = append(resp.WhitelistFilters, fj)
 	}
-	resp.UserRules = config.UserRules
+	resp.UserRules = userRulesTexts(config.UserRules)
 	config.RUnlock()
 
 	jsonVal, err := json.Marshal(resp)
@@ -344,6 +597,54 @@ func handleFilteringConfig(w http.ResponseWriter, r *http.Request) {
 	config.DNS.FiltersUpdateIntervalHours = req.Interval
 	onConfigModified()
 	enableFilters(true)
+	wakeRefresh()
+}
+
+type filterHitsJSON struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Enabled   bool   `json:"enabled"`
+	Whitelist bool   `json:"whitelist"`
+	Hits      uint64 `json:"hits"` // number of requests matched by the rules of this filter
+}
+
+type filteringStatsJSON struct {
+	Filters       []filterHitsJSON `json:"filters"`
+	UserRulesHits uint64           `json:"user_rules_hits"`
+}
+
+// Get the number of matched rules per filter for the current statistics interval
+func handleFilteringStats(w http.ResponseWriter, r *http.Request) {
+	if Context.stats == nil {
+		httpError(w, http.StatusInternalServerError, "Statistics module is not initialized")
+		return
+	}
+	hits := Context.stats.GetFilterHits()
+	if hits == nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't get statistics data")
+		return
+	}
+
+	resp := filteringStatsJSON{}
+	resp.Filters = []filterHitsJSON{}
+	resp.UserRulesHits = hits[userFilter().ID]
+	config.RLock()
+	for _, f := range config.Filters {
+		resp.Filters = append(resp.Filters, filterHitsJSON{ID: f.ID, Name: f.Name, URL: f.URL, Enabled: f.Enabled, Hits: hits[f.ID]})
+	}
+	for _, f := range config.WhitelistFilters {
+		resp.Filters = append(resp.Filters, filterHitsJSON{ID: f.ID, Name: f.Name, URL: f.URL, Enabled: f.Enabled, Whitelist: true, Hits: hits[f.ID]})
+	}
+	config.RUnlock()
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
 }
 
 type checkHostResp struct {
@@ -388,6 +689,125 @@ func handleCheckHost(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(js)
 }
 
+type matchedRuleJSON struct {
+	Text       string `json:"text"`
+	FilterID   int64  `json:"filter_id"`
+	FilterName string `json:"filter_name"`
+}
+
+type checkHostStepJSON struct {
+	Name       string            `json:"name"` // see dnsfilter.Trace*
+	Reason     string            `json:"reason"`
+	Rule       string            `json:"rule"`
+	FilterID   int64             `json:"filter_id"`
+	FilterName string            `json:"filter_name"`
+	SvcName    string            `json:"service_name"`
+	Rules      []matchedRuleJSON `json:"rules"` // all rules from filter lists matched on this step
+	Error      string            `json:"error,omitempty"`
+}
+
+type checkHostVerboseResp struct {
+	checkHostResp
+	FilterName string              `json:"filter_name"`
+	ClientName string              `json:"client_name"` // the name of the client whose settings were used
+	Steps      []checkHostStepJSON `json:"steps"`       // in the order of evaluation
+}
+
+// Get the name of the filter with the specified ID
+// Return an empty string for user rules and the filters that don't exist
+func filterNameByID(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	config.RLock()
+	defer config.RUnlock()
+	for _, arr := range [][]filter{config.Filters, config.WhitelistFilters} {
+		for _, f := range arr {
+			if f.ID == id {
+				return f.Name
+			}
+		}
+	}
+	return ""
+}
+
+// Check the host name just like DNS server does for the specified client and query type.
+// Return the result and all filtering steps that were performed.
+func handleCheckHostVerbose(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	host := q.Get("name")
+	client := q.Get("client")
+	qtype := dns.TypeA
+	if s := q.Get("qtype"); len(s) != 0 {
+		t, ok := dns.StringToType[strings.ToUpper(s)]
+		if !ok {
+			httpError(w, http.StatusBadRequest, "invalid query type: %s", s)
+			return
+		}
+		qtype = t
+	}
+	if len(client) != 0 && net.ParseIP(client) == nil {
+		httpError(w, http.StatusBadRequest, "invalid client IP address: %s", client)
+		return
+	}
+
+	// the same settings as DNS server uses for a request from this client
+	setts := Context.dnsFilter.GetConfig()
+	setts.FilteringEnabled = true
+	applyAdditionalFiltering(client, "", &setts)
+
+	result, trace, err := Context.dnsFilter.CheckHostTrace(host, qtype, &setts)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "couldn't apply filtering: %s: %s", host, err)
+		return
+	}
+
+	resp := checkHostVerboseResp{}
+	resp.Reason = result.Reason.String()
+	resp.FilterID = result.FilterID
+	resp.Rule = result.Rule
+	resp.SvcName = result.ServiceName
+	resp.CanonName = result.CanonName
+	resp.IPList = result.IPList
+	resp.FilterName = filterNameByID(result.FilterID)
+	if len(client) != 0 {
+		c, ok := Context.clients.Find(client, "")
+		if ok {
+			resp.ClientName = c.Name
+		}
+	}
+
+	resp.Steps = []checkHostStepJSON{}
+	for _, st := range trace.Steps {
+		sj := checkHostStepJSON{
+			Name:       st.Name,
+			Reason:     st.Result.Reason.String(),
+			Rule:       st.Result.Rule,
+			FilterID:   st.Result.FilterID,
+			FilterName: filterNameByID(st.Result.FilterID),
+			SvcName:    st.Result.ServiceName,
+			Rules:      []matchedRuleJSON{},
+			Error:      st.Error,
+		}
+		for _, mr := range st.Rules {
+			sj.Rules = append(sj.Rules, matchedRuleJSON{
+				Text:       mr.Text,
+				FilterID:   mr.FilterID,
+				FilterName: filterNameByID(mr.FilterID),
+			})
+		}
+		resp.Steps = append(resp.Steps, sj)
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
 // RegisterFilteringHandlers - register handlers
 func RegisterFilteringHandlers() {
 	httpRegister("GET", "/control/filtering/status", handleFilteringStatus)
@@ -396,8 +816,19 @@ func RegisterFilteringHandlers() {
 	httpRegister("POST", "/control/filtering/remove_url", handleFilteringRemoveURL)
 	httpRegister("POST", "/control/filtering/set_url", handleFilteringSetURL)
 	httpRegister("POST", "/control/filtering/refresh", handleFilteringRefresh)
+	httpRegister("POST", "/control/filtering/refresh_one", handleFilteringRefreshOne)
 	httpRegister("POST", "/control/filtering/set_rules", handleFilteringSetRules)
+	httpRegister("GET", "/control/filtering/catalog", handleFilteringCatalog)
+	httpRegister("GET", "/control/filtering/stats", handleFilteringStats)
+	httpRegister("GET", "/control/filtering/changes", handleFilteringChanges)
+	httpRegister("GET", "/control/filtering/export", handleFilteringExport)
+	httpRegister("POST", "/control/filtering/import", handleFilteringImport)
 	httpRegister("GET", "/control/filtering/check_host", handleCheckHost)
+	httpRegister("GET", "/control/filtering/check_host_verbose", handleCheckHostVerbose)
+	httpRegister("GET", "/control/filtering/profile", handleFilteringProfile)
+	httpRegister("POST", "/control/filtering/benchmark", handleFilteringBenchmark)
+	httpRegister("GET", "/control/filtering/update_schedule", handleUpdateScheduleGet)
+	httpRegister("POST", "/control/filtering/update_schedule/set", handleUpdateScheduleSet)
 }
 
 func checkFiltersUpdateIntervalHours(i uint32) bool {
@@ -1,17 +1,14 @@
 package home
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
-	"strconv"
 
 	"github.com/AdguardTeam/AdGuardHome/util"
 
@@ -34,13 +31,34 @@ type netInterfaceJSON struct {
 	Flags        string   `json:"flags"`
 }
 
+// Get the network interfaces the servers may listen on
+func getNetInterfaces() ([]netInterfaceJSON, error) {
+	ifaces, err := util.GetValidNetInterfacesForWeb()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []netInterfaceJSON{}
+	for _, iface := range ifaces {
+		ifaceJSON := netInterfaceJSON{
+			Name:         iface.Name,
+			MTU:          iface.MTU,
+			HardwareAddr: iface.HardwareAddr,
+			Addresses:    iface.Addresses,
+			Flags:        iface.Flags,
+		}
+		list = append(list, ifaceJSON)
+	}
+	return list, nil
+}
+
 // Get initial installation settings
 func handleInstallGetAddresses(w http.ResponseWriter, r *http.Request) {
 	data := firstRunData{}
 	data.WebPort = 80
 	data.DNSPort = 53
 
-	ifaces, err := util.GetValidNetInterfacesForWeb()
+	ifaces, err := getNetInterfaces()
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "Couldn't get interfaces: %s", err)
 		return
@@ -48,14 +66,7 @@ func handleInstallGetAddresses(w http.ResponseWriter, r *http.Request) {
 
 	data.Interfaces = make(map[string]interface{})
 	for _, iface := range ifaces {
-		ifaceJSON := netInterfaceJSON{
-			Name:         iface.Name,
-			MTU:          iface.MTU,
-			HardwareAddr: iface.HardwareAddr,
-			Addresses:    iface.Addresses,
-			Flags:        iface.Flags,
-		}
-		data.Interfaces[iface.Name] = ifaceJSON
+		data.Interfaces[iface.Name] = iface
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -110,7 +121,7 @@ func handleInstallCheckConfig(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if reqData.DNS.Port != 0 {
-		err = util.CheckPacketPortAvailable(reqData.DNS.IP, reqData.DNS.Port)
+		err = checkDNSPortAvailable(reqData.DNS.IP, reqData.DNS.Port, true)
 
 		if util.ErrorIsAddrInUse(err) {
 			canAutofix := checkDNSStubListener()
@@ -129,7 +140,7 @@ func handleInstallCheckConfig(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err == nil {
-			err = util.CheckPortAvailable(reqData.DNS.IP, reqData.DNS.Port)
+			err = checkDNSPortAvailable(reqData.DNS.IP, reqData.DNS.Port, false)
 		}
 
 		if err != nil {
@@ -288,34 +299,28 @@ func handleInstallConfigure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	restartHTTP := true
-	if config.BindHost == newSettings.Web.IP && config.BindPort == newSettings.Web.Port {
-		// no need to rebind
-		restartHTTP = false
-	}
-
-	// validate that hosts and ports are bindable
-	if restartHTTP {
-		err = util.CheckPortAvailable(newSettings.Web.IP, newSettings.Web.Port)
-		if err != nil {
-			httpError(w, http.StatusBadRequest, "Impossible to listen on IP:port %s due to %s",
-				net.JoinHostPort(newSettings.Web.IP, strconv.Itoa(newSettings.Web.Port)), err)
-			return
-		}
-	}
-
-	err = util.CheckPacketPortAvailable(newSettings.DNS.IP, newSettings.DNS.Port)
+	err = checkDNSPortAvailable(newSettings.DNS.IP, newSettings.DNS.Port, true)
 	if err != nil {
 		httpError(w, http.StatusBadRequest, "%s", err)
 		return
 	}
 
-	err = util.CheckPortAvailable(newSettings.DNS.IP, newSettings.DNS.Port)
+	err = checkDNSPortAvailable(newSettings.DNS.IP, newSettings.DNS.Port, false)
 	if err != nil {
 		httpError(w, http.StatusBadRequest, "%s", err)
 		return
 	}
 
+	// the new address of the web interface is bound before the current server is stopped
+	var wr *webRebind
+	if config.BindHost != newSettings.Web.IP || config.BindPort != newSettings.Web.Port {
+		wr, err = prepareWebRebind(newSettings.Web.IP, newSettings.Web.Port)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+	}
+
 	var curConfig configuration
 	copyInstallSettings(&curConfig, &config)
 
@@ -336,6 +341,7 @@ func handleInstallConfigure(w http.ResponseWriter, r *http.Request) {
 	if err != nil || err2 != nil {
 		Context.firstRun = true
 		copyInstallSettings(&config, &curConfig)
+		wr.cancel()
 		if err != nil {
 			httpError(w, http.StatusInternalServerError, "Couldn't initialize DNS server: %s", err)
 		} else {
@@ -352,16 +358,15 @@ func handleInstallConfigure(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		Context.firstRun = true
 		copyInstallSettings(&config, &curConfig)
+		wr.cancel()
 		httpError(w, http.StatusInternalServerError, "Couldn't write config: %s", err)
 		return
 	}
 
-	// this needs to be done in a goroutine because Shutdown() is a blocking call, and it will block
+	// the server is stopped in a goroutine because Shutdown() is a blocking call, and it will block
 	// until all requests are finished, and _we_ are inside a request right now, so it will block indefinitely
-	if restartHTTP {
-		go func() {
-			_ = Context.httpServer.Shutdown(context.TODO())
-		}()
+	if wr != nil {
+		wr.apply()
 	}
 
 	returnOK(w)
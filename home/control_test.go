@@ -1,8 +1,14 @@
 package home
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/stretchr/testify/assert"
 )
 
 /* Tests performed:
@@ -75,3 +81,49 @@ kXS9jgARhhiWXJrk
 		t.Fatalf("valid cert & priv key: validateCertificates(): %v", data)
 	}
 }
+
+func TestGetListenerAddresses(t *testing.T) {
+	ifaces := []util.NetInterface{{Name: "eth0", Addresses: []string{"192.168.1.1", "192.168.2.1"}}}
+	addrs := getListenerAddresses([]dnsforward.ListenerConfig{
+		{Address: "127.0.0.1", Port: 53},
+		{Interface: "eth0", Port: 5353},
+		{Interface: "eth1", Port: 53},
+		{Address: "::1", PortDNSOverTLS: 853},
+	}, ifaces)
+	assert.Equal(t, []string{"127.0.0.1", "192.168.1.1:5353", "192.168.2.1:5353"}, addrs)
+}
+
+func TestDoHPathHandler(t *testing.T) {
+	prevTLS := config.TLS
+	defer func() { config.TLS = prevTLS }()
+	config.TLS = tlsConfig{}
+	config.TLS.DoHPath = "/resolve"
+	config.TLS.DoHEndpoints = []dnsforward.DoHEndpoint{{Path: "/resolve/kids", ClientID: "kids"}}
+
+	passed := false
+	h := dohPathHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passed = true
+	}))
+	serve := func(path string) int {
+		passed = false
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	// DNS-over-HTTPS requests are handled by handleDOH(): unencrypted requests aren't allowed
+	assert.Equal(t, http.StatusNotFound, serve("/resolve/kids/tablet"))
+	assert.False(t, passed)
+	assert.Equal(t, http.StatusNotFound, serve("/resolve"))
+	assert.False(t, passed)
+	// the default path isn't used
+	serve("/dns-query")
+	assert.True(t, passed)
+	assert.Equal(t, "/resolve", dohURLPath())
+
+	conf := tlsConfig{}
+	conf.DoHPath = "/control/dns"
+	status := tlsConfigStatus{}
+	assert.False(t, tlsLoadConfig(&conf, &status))
+	assert.Equal(t, `doh_path: path "/control/dns" is reserved`, status.WarningValidation)
+}
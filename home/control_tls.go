@@ -20,6 +20,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/AdGuardHome/util"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -28,10 +29,45 @@ import (
 
 // Set certificate and private key data
 func tlsLoadConfig(tls *tlsConfig, status *tlsConfigStatus) bool {
+	err := dnsforward.CheckClientIDMode(tls.ClientIDMode)
+	if err != nil {
+		status.WarningValidation = err.Error()
+		return false
+	}
+	err = tlsLoadServerNames(tls)
+	if err != nil {
+		status.WarningValidation = fmt.Sprintf("server_names: %s", err)
+		return false
+	}
+	err = dnsforward.CheckDoHPaths(tls.DoHPath, tls.DoHEndpoints)
+	if err != nil {
+		status.WarningValidation = fmt.Sprintf("doh_path: %s", err)
+		return false
+	}
+	err = tlsLoadClientCA(tls)
+	if err != nil {
+		status.WarningValidation = fmt.Sprintf("client CA: %s", err)
+		return false
+	}
+
+	if tls.ACME.Enabled {
+		if tls.CertificateChain != "" || tls.PrivateKey != "" || tls.CertificatePath != "" || tls.PrivateKeyPath != "" {
+			status.WarningValidation = "certificate and ACME can't be set together"
+			return false
+		}
+		err := checkACMEConfig(tls.ACME, tls.ServerName)
+		if err != nil {
+			status.WarningValidation = err.Error()
+			return false
+		}
+		// the certificate may be not obtained yet
+		tls.CertificateChainData, tls.PrivateKeyData = acmeLoadCertificate()
+		return true
+	}
+
 	tls.CertificateChainData = []byte(tls.CertificateChain)
 	tls.PrivateKeyData = []byte(tls.PrivateKey)
 
-	var err error
 	if tls.CertificatePath != "" {
 		if tls.CertificateChain != "" {
 			status.WarningValidation = "certificate data and file can't be set together"
@@ -61,6 +97,83 @@ func tlsLoadConfig(tls *tlsConfig, status *tlsConfigStatus) bool {
 	return true
 }
 
+// Set certificate and private key data of the additional server names and check them
+// The names must be unique and must differ from the main server name.
+func tlsLoadServerNames(tls *tlsConfig) error {
+	if len(tls.ServerNames) == 0 {
+		return nil
+	}
+	// the data is set in a copy: the array may be shared with the current configuration
+	tls.ServerNames = append([]dnsforward.TLSServerName{}, tls.ServerNames...)
+
+	names := map[string]bool{}
+	if len(tls.ServerName) != 0 {
+		names[strings.ToLower(strings.TrimSuffix(tls.ServerName, "."))] = true
+	}
+	for i := range tls.ServerNames {
+		n := &tls.ServerNames[i]
+		name := strings.ToLower(strings.TrimSuffix(n.ServerName, "."))
+		if names[name] {
+			return fmt.Errorf("%s: duplicate server name", name)
+		}
+		names[name] = true
+
+		n.CertificateChainData = []byte(n.CertificateChain)
+		n.PrivateKeyData = []byte(n.PrivateKey)
+		var err error
+		if n.CertificatePath != "" {
+			if n.CertificateChain != "" {
+				return fmt.Errorf("%s: certificate data and file can't be set together", name)
+			}
+			n.CertificateChainData, err = ioutil.ReadFile(n.CertificatePath)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+		if n.PrivateKeyPath != "" {
+			if n.PrivateKey != "" {
+				return fmt.Errorf("%s: private key data and file can't be set together", name)
+			}
+			n.PrivateKeyData, err = ioutil.ReadFile(n.PrivateKeyPath)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+		if len(n.CertificateChainData) == 0 || len(n.PrivateKeyData) == 0 {
+			return fmt.Errorf("%s: certificate and private key are required", name)
+		}
+
+		status := validateCertificates(string(n.CertificateChainData), string(n.PrivateKeyData), name)
+		if !status.ValidPair {
+			return fmt.Errorf("%s: %s", name, status.WarningValidation)
+		}
+	}
+
+	// check the names and ClientID modes
+	_, err := dnsforward.NewTLSCertificates(tls.ServerNames)
+	return err
+}
+
+// Set CA certificates data for client authentication and check it
+func tlsLoadClientCA(tls *tlsConfig) error {
+	tls.ClientCAData = []byte(tls.ClientCA)
+	if tls.ClientCAPath != "" {
+		if tls.ClientCA != "" {
+			return fmt.Errorf("certificate data and file can't be set together")
+		}
+		var err error
+		tls.ClientCAData, err = ioutil.ReadFile(tls.ClientCAPath)
+		if err != nil {
+			return err
+		}
+	}
+	if !tls.ClientAuth {
+		return nil
+	}
+	_, err := dnsforward.ParseClientCAs(tls.ClientCAData)
+	return err
+}
+
 // RegisterTLSHandlers registers HTTP handlers for TLS configuration
 func RegisterTLSHandlers() {
 	httpRegister(http.MethodGet, "/control/tls/status", handleTLSStatus)
@@ -69,7 +182,27 @@ func RegisterTLSHandlers() {
 }
 
 func handleTLSStatus(w http.ResponseWriter, r *http.Request) {
-	marshalTLS(w, config.TLS)
+	data := config.TLS
+	if !isAdminRequest(r) {
+		data = withoutTLSSecrets(data)
+	}
+	marshalTLS(w, data)
+}
+
+// Remove the private keys and the credentials of DNS provider from TLS settings
+// Only admins may get them.
+func withoutTLSSecrets(data tlsConfig) tlsConfig {
+	data.PrivateKey = ""
+	data.ACME.DNSProviderConfig = nil
+
+	// the array is shared with the current configuration
+	names := make([]dnsforward.TLSServerName, len(data.ServerNames))
+	for i, n := range data.ServerNames {
+		n.PrivateKey = ""
+		names[i] = n
+	}
+	data.ServerNames = names
+	return data
 }
 
 func handleTLSValidate(w http.ResponseWriter, r *http.Request) {
@@ -130,33 +263,42 @@ func handleTLSConfigure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	data.tlsConfigStatus = validateCertificates(string(data.CertificateChainData), string(data.PrivateKeyData), data.ServerName)
-	restartHTTPS := false
+	restart := false
 	if !reflect.DeepEqual(config.TLS.tlsConfigSettings, data.tlsConfigSettings) {
 		log.Printf("tls config settings have changed, will restart HTTPS server")
-		restartHTTPS = true
+		restart = true
 	}
+	tx := beginConfigTx()
+	config.Lock()
 	config.TLS = data
-	err = writeAllConfigsAndReloadDNS()
+	config.Unlock()
+	err = tx.commit()
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		httpError(w, http.StatusInternalServerError, "Couldn't apply TLS settings: %s", err)
 		return
 	}
 	marshalTLS(w, data)
+	Context.acme.wakeup()
 	// this needs to be done in a goroutine because Shutdown() is a blocking call, and it will block
 	// until all requests are finished, and _we_ are inside a request right now, so it will block indefinitely
-	if restartHTTPS {
+	if restart {
 		go func() {
 			time.Sleep(time.Second) // TODO: could not find a way to reliably know that data was fully sent to client by https server, so we wait a bit to let response through before closing the server
-			Context.httpsServer.cond.L.Lock()
-			Context.httpsServer.cond.Broadcast()
-			if Context.httpsServer.server != nil {
-				Context.httpsServer.server.Shutdown(context.TODO())
-			}
-			Context.httpsServer.cond.L.Unlock()
+			restartHTTPS()
 		}()
 	}
 }
 
+// Restart HTTPS server with the current TLS settings
+func restartHTTPS() {
+	Context.httpsServer.cond.L.Lock()
+	Context.httpsServer.cond.Broadcast()
+	if Context.httpsServer.server != nil {
+		Context.httpsServer.server.Shutdown(context.TODO())
+	}
+	Context.httpsServer.cond.L.Unlock()
+}
+
 func verifyCertChain(data *tlsConfigStatus, certChain string, serverName string) error {
 	log.Tracef("TLS: got certificate: %d bytes", len(certChain))
 
@@ -201,6 +343,10 @@ func verifyCertChain(data *tlsConfigStatus, certChain string, serverName string)
 	opts := x509.VerifyOptions{
 		DNSName: serverName,
 	}
+	// the wildcard certificate for the names with ClientID (*.<server name>) is valid for the server name too
+	if len(serverName) != 0 && coversSubdomains(parsedCerts[0], serverName) {
+		opts.DNSName = ""
+	}
 
 	log.Printf("number of certs - %d", len(parsedCerts))
 	if len(parsedCerts) > 1 {
@@ -237,6 +383,17 @@ func verifyCertChain(data *tlsConfigStatus, certChain string, serverName string)
 	return nil
 }
 
+// Return TRUE if the certificate is valid for the subdomains of the host name, i.e. it contains "*.<host>"
+func coversSubdomains(cert *x509.Certificate, host string) bool {
+	wildcard := "*." + strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, n := range cert.DNSNames {
+		if strings.ToLower(n) == wildcard {
+			return true
+		}
+	}
+	return false
+}
+
 func validatePkey(data *tlsConfigStatus, pkey string) error {
 	// now do a more extended validation
 	var key *pem.Block        // PEM-encoded certificates
@@ -366,12 +523,43 @@ func unmarshalTLS(r *http.Request) (tlsConfig, error) {
 		}
 	}
 
+	if data.ClientCA != "" {
+		caPEM, err := base64.StdEncoding.DecodeString(data.ClientCA)
+		if err != nil {
+			return data, errorx.Decorate(err, "Failed to base64-decode client CA certificates")
+		}
+		data.ClientCA = string(caPEM)
+		if data.ClientCAPath != "" {
+			return data, fmt.Errorf("client CA data and file can't be set together")
+		}
+	}
+
+	for i := range data.ServerNames {
+		n := &data.ServerNames[i]
+		certPEM, err := base64.StdEncoding.DecodeString(n.CertificateChain)
+		if err != nil {
+			return data, errorx.Decorate(err, "%s: failed to base64-decode certificate chain", n.ServerName)
+		}
+		keyPEM, err := base64.StdEncoding.DecodeString(n.PrivateKey)
+		if err != nil {
+			return data, errorx.Decorate(err, "%s: failed to base64-decode private key", n.ServerName)
+		}
+		n.CertificateChain = string(certPEM)
+		n.PrivateKey = string(keyPEM)
+	}
+
 	return data, nil
 }
 
 func marshalTLS(w http.ResponseWriter, data tlsConfig) {
 	w.Header().Set("Content-Type", "application/json")
 
+	if data.ACME.Enabled && Context.acme != nil {
+		st := Context.acme.getStatus()
+		data.ACMEStatus = &st
+	}
+	data.ExpiresSoon = tlsExpiresSoon(data.NotAfter)
+
 	if data.CertificateChain != "" {
 		encoded := base64.StdEncoding.EncodeToString([]byte(data.CertificateChain))
 		data.CertificateChain = encoded
@@ -382,6 +570,19 @@ func marshalTLS(w http.ResponseWriter, data tlsConfig) {
 		data.PrivateKey = encoded
 	}
 
+	if data.ClientCA != "" {
+		data.ClientCA = base64.StdEncoding.EncodeToString([]byte(data.ClientCA))
+	}
+
+	// the array is shared with the current configuration
+	names := make([]dnsforward.TLSServerName, len(data.ServerNames))
+	for i, n := range data.ServerNames {
+		n.CertificateChain = base64.StdEncoding.EncodeToString([]byte(n.CertificateChain))
+		n.PrivateKey = base64.StdEncoding.EncodeToString([]byte(n.PrivateKey))
+		names[i] = n
+	}
+	data.ServerNames = names
+
 	err := json.NewEncoder(w).Encode(data)
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "Failed to marshal json with TLS status: %s", err)
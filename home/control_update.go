@@ -92,6 +92,7 @@ func handleGetVersionJSON(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	versionCheckURL := getVersionCheckURL()
 	var resp *http.Response
 	for i := 0; i != 3; i++ {
 		log.Tracef("Downloading data from %s", versionCheckURL)
@@ -401,6 +402,10 @@ func doUpdate(u *updateInfo) error {
 	if err != nil {
 		return err
 	}
+	err = verifyPackage(u)
+	if err != nil {
+		return err
+	}
 
 	log.Tracef("Unpacking the package")
 	_, file := filepath.Split(u.pkgName)
@@ -478,7 +483,11 @@ func finishUpdate(u *updateInfo) {
 	cleanup()
 	stopHTTPServer()
 	cleanupAlways()
+	restartProcess(u.curBinName)
+}
 
+// Start a new process of AdGuard Home with the same arguments
+func restartProcess(binName string) {
 	if runtime.GOOS == "windows" {
 		if Context.runningAsService {
 			// Note:
@@ -492,7 +501,7 @@ func finishUpdate(u *updateInfo) {
 			os.Exit(0)
 		}
 
-		cmd := exec.Command(u.curBinName, os.Args[1:]...)
+		cmd := exec.Command(binName, os.Args[1:]...)
 		log.Info("Restarting: %v", cmd.Args)
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
@@ -506,7 +515,7 @@ func finishUpdate(u *updateInfo) {
 	} else {
 
 		log.Info("Restarting: %v", os.Args)
-		err := syscall.Exec(u.curBinName, os.Args, os.Environ())
+		err := syscall.Exec(binName, os.Args, os.Environ())
 		if err != nil {
 			log.Fatalf("syscall.Exec() failed: %s", err)
 		}
@@ -528,11 +537,20 @@ func handleUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	Context.updater.lock.Lock()
+	Context.updater.inProgress = true
+	Context.updater.lock.Unlock()
 	err = doUpdate(u)
+	Context.updater.lock.Lock()
+	Context.updater.inProgress = false
+	Context.updater.lock.Unlock()
 	if err != nil {
+		Context.updater.setFailed(u.newVer, err)
 		httpError(w, http.StatusInternalServerError, "%s", err)
 		return
 	}
+	// the new version is checked on the first start
+	Context.updater.setPending(u.newVer)
 
 	returnOK(w)
 
@@ -0,0 +1,392 @@
+// Runtime diagnostics, profiles and support bundle
+
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	debugAllocSites   = 20 // the number of the allocation sites in the summary
+	debugMaxSeconds   = 60 // the maximum duration of CPU profile and execution trace
+	debugRedacted     = "REDACTED"
+	debugBundlePrefix = "support-"
+)
+
+// The time the process has started
+var debugStartTime = time.Now()
+
+// The settings which are replaced with debugRedacted in the configuration of support bundle
+var debugSecretKeys = map[string]bool{
+	"password":          true,
+	"private_key":       true,
+	"hash":              true,
+	"token":             true,
+	"totp_secret":       true,
+	"totp_backup_codes": true,
+}
+
+type debugAllocSite struct {
+	Function     string `json:"function"`
+	InUseBytes   int64  `json:"inuse_bytes"`
+	InUseObjects int64  `json:"inuse_objects"`
+	AllocBytes   int64  `json:"alloc_bytes"`
+	AllocObjects int64  `json:"alloc_objects"`
+}
+
+type debugRuntimeJSON struct {
+	Version    string  `json:"version"`
+	GoVersion  string  `json:"go_version"`
+	OS         string  `json:"os"`
+	Arch       string  `json:"arch"`
+	NumCPU     int     `json:"num_cpu"`
+	GOMAXPROCS int     `json:"gomaxprocs"`
+	Goroutines int     `json:"goroutines"`
+	Uptime     float64 `json:"uptime"` // in seconds
+
+	Memory struct {
+		Sys          uint64 `json:"sys"`
+		HeapAlloc    uint64 `json:"heap_alloc"`
+		HeapInuse    uint64 `json:"heap_inuse"`
+		HeapIdle     uint64 `json:"heap_idle"`
+		HeapReleased uint64 `json:"heap_released"`
+		HeapObjects  uint64 `json:"heap_objects"`
+		StackInuse   uint64 `json:"stack_inuse"`
+		TotalAlloc   uint64 `json:"total_alloc"`
+		Mallocs      uint64 `json:"mallocs"`
+		Frees        uint64 `json:"frees"`
+	} `json:"memory"`
+
+	GC struct {
+		NumGC       uint32    `json:"num_gc"`
+		LastGC      string    `json:"last_gc"` // RFC3339;  empty if GC hasn't run yet
+		NextGC      uint64    `json:"next_gc"` // the target heap size
+		PauseTotal  float64   `json:"pause_total_ms"`
+		LastPauses  []float64 `json:"last_pauses_ms"` // the newest first
+		CPUFraction float64   `json:"cpu_fraction"`
+	} `json:"gc"`
+
+	// the sites which hold the largest amount of memory (sampled by the memory profiler)
+	Allocations []debugAllocSite `json:"allocations"`
+}
+
+// Get the runtime state
+func debugRuntime() debugRuntimeJSON {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+
+	d := debugRuntimeJSON{
+		Version:    versionString,
+		GoVersion:  runtime.Version(),
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		NumCPU:     runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Goroutines: runtime.NumGoroutine(),
+		Uptime:     time.Since(debugStartTime).Seconds(),
+	}
+
+	d.Memory.Sys = ms.Sys
+	d.Memory.HeapAlloc = ms.HeapAlloc
+	d.Memory.HeapInuse = ms.HeapInuse
+	d.Memory.HeapIdle = ms.HeapIdle
+	d.Memory.HeapReleased = ms.HeapReleased
+	d.Memory.HeapObjects = ms.HeapObjects
+	d.Memory.StackInuse = ms.StackInuse
+	d.Memory.TotalAlloc = ms.TotalAlloc
+	d.Memory.Mallocs = ms.Mallocs
+	d.Memory.Frees = ms.Frees
+
+	d.GC.NumGC = ms.NumGC
+	if ms.LastGC != 0 {
+		d.GC.LastGC = time.Unix(0, int64(ms.LastGC)).Format(time.RFC3339)
+	}
+	d.GC.NextGC = ms.NextGC
+	d.GC.PauseTotal = float64(ms.PauseTotalNs) / 1e6
+	d.GC.LastPauses = []float64{}
+	n := ms.NumGC
+	if n > 10 {
+		n = 10
+	}
+	for i := uint32(0); i != n; i++ {
+		// the most recent pause is at PauseNs[(NumGC+255)%256]
+		p := ms.PauseNs[(ms.NumGC-i+255)%256]
+		d.GC.LastPauses = append(d.GC.LastPauses, float64(p)/1e6)
+	}
+	d.GC.CPUFraction = ms.GCCPUFraction
+
+	d.Allocations = debugAllocSummary(debugAllocSites)
+	return d
+}
+
+// Get the allocation sites with the largest amount of memory in use
+// The sites are the first functions of the call stacks which aren't from Go runtime.
+func debugAllocSummary(max int) []debugAllocSite {
+	var records []runtime.MemProfileRecord
+	n, _ := runtime.MemProfile(nil, true)
+	for {
+		records = make([]runtime.MemProfileRecord, n+50)
+		var ok bool
+		n, ok = runtime.MemProfile(records, true)
+		if ok {
+			records = records[:n]
+			break
+		}
+	}
+
+	sites := map[string]*debugAllocSite{}
+	for i := range records {
+		r := &records[i]
+		fn := debugAllocFunction(r.Stack())
+		s, ok := sites[fn]
+		if !ok {
+			s = &debugAllocSite{Function: fn}
+			sites[fn] = s
+		}
+		s.InUseBytes += r.InUseBytes()
+		s.InUseObjects += r.InUseObjects()
+		s.AllocBytes += r.AllocBytes
+		s.AllocObjects += r.AllocObjects
+	}
+
+	list := []debugAllocSite{}
+	for _, s := range sites {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].InUseBytes == list[j].InUseBytes {
+			return list[i].AllocBytes > list[j].AllocBytes
+		}
+		return list[i].InUseBytes > list[j].InUseBytes
+	})
+	if len(list) > max {
+		list = list[:max]
+	}
+	return list
+}
+
+func debugAllocFunction(stack []uintptr) string {
+	frames := runtime.CallersFrames(stack)
+	name := "unknown"
+	for {
+		f, more := frames.Next()
+		if len(f.Function) != 0 {
+			name = f.Function
+			if !strings.HasPrefix(f.Function, "runtime.") {
+				return name
+			}
+		}
+		if !more {
+			return name
+		}
+	}
+}
+
+// Replace the secrets in the configuration (YAML) with debugRedacted
+func debugRedactConfig(data []byte) ([]byte, error) {
+	conf := yaml.MapSlice{}
+	err := yaml.Unmarshal(data, &conf)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(debugRedact("", conf))
+}
+
+// Replace the secrets in the value of the setting
+func debugRedact(key string, v interface{}) interface{} {
+	switch val := v.(type) {
+	case yaml.MapSlice:
+		for i := range val {
+			k, _ := val[i].Key.(string)
+			if debugSecretKeys[k] || (key == "webhooks" && k == "url") {
+				// webhook URLs contain the access tokens of the services
+				if val[i].Value != nil && val[i].Value != "" {
+					val[i].Value = debugRedacted
+				}
+				continue
+			}
+			val[i].Value = debugRedact(k, val[i].Value)
+		}
+		return val
+	case []interface{}:
+		for i := range val {
+			val[i] = debugRedact(key, val[i])
+		}
+		return val
+	}
+	return v
+}
+
+// Get the data of the profile
+func debugProfile(name string, debug int) ([]byte, error) {
+	p := pprof.Lookup(name)
+	if p == nil {
+		return nil, fmt.Errorf("unknown profile: %s", name)
+	}
+	buf := bytes.Buffer{}
+	err := p.WriteTo(&buf, debug)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Create support bundle: the state of the process, logs, configuration (without secrets) and profiles
+func debugBundle() ([]byte, error) {
+	conf, err := config.marshal()
+	if err != nil {
+		return nil, err
+	}
+	conf, err = debugRedactConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	rt, _ := json.MarshalIndent(debugRuntime(), "", "\t")
+
+	files := []backupFile{
+		{"runtime.json", rt},
+		{backupConfigFile, conf},
+		{"log.txt", Context.logger.recentMessages()},
+	}
+	profiles := []struct {
+		name  string
+		file  string
+		debug int
+	}{
+		{"goroutine", "goroutine.txt", 2},
+		{"heap", "heap.pb.gz", 0},
+		{"allocs", "allocs.pb.gz", 0},
+	}
+	for _, p := range profiles {
+		data, err := debugProfile(p.name, p.debug)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, backupFile{p.file, data})
+	}
+	return backupPack(files)
+}
+
+// Get the runtime state
+func handleDebugRuntime(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		httpError(w, http.StatusForbidden, "not allowed")
+		return
+	}
+
+	js, err := json.Marshal(debugRuntime())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// Get the profile
+// name: "profile" (CPU profile) or "trace" (execution trace) - collected during "seconds" (30 by default);
+// or the name of a runtime profile: "goroutine", "heap", "allocs", "threadcreate", "block", "mutex"
+// ("debug" parameter: 0 - protobuf format, 1 - text format, 2 - goroutine stack dump).
+// net/http/pprof isn't used because it registers its handlers without authentication.
+func handleDebugPprof(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		httpError(w, http.StatusForbidden, "not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	name := q.Get("name")
+	if name == "profile" || name == "trace" {
+		sec := 30
+		if v := q.Get("seconds"); len(v) != 0 {
+			var err error
+			sec, err = strconv.Atoi(v)
+			if err != nil || sec <= 0 || sec > debugMaxSeconds {
+				httpError(w, http.StatusBadRequest, "invalid seconds: %s", v)
+				return
+			}
+		}
+		debugCollect(w, name, time.Duration(sec)*time.Second)
+		return
+	}
+
+	debug, _ := strconv.Atoi(q.Get("debug"))
+	data, err := debugProfile(name, debug)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if debug != 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	}
+	_, _ = w.Write(data)
+}
+
+// Collect CPU profile or execution trace
+func debugCollect(w http.ResponseWriter, name string, dur time.Duration) {
+	buf := bytes.Buffer{}
+	var err error
+	if name == "profile" {
+		err = pprof.StartCPUProfile(&buf)
+	} else {
+		err = trace.Start(&buf)
+	}
+	if err != nil {
+		// another profile is being collected
+		httpError(w, http.StatusInternalServerError, "%s: %s", name, err)
+		return
+	}
+	time.Sleep(dur)
+	if name == "profile" {
+		pprof.StopCPUProfile()
+	} else {
+		trace.Stop()
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	_, _ = w.Write(buf.Bytes())
+}
+
+// Download support bundle
+func handleDebugBundle(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		httpError(w, http.StatusForbidden, "not allowed")
+		return
+	}
+
+	data, err := debugBundle()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	log.Info("Created support bundle")
+
+	name := debugBundlePrefix + time.Now().UTC().Format(backupTimeFormat) + backupSuffix
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	_, _ = w.Write(data)
+}
+
+// RegisterDebugHandlers - register HTTP handlers
+func RegisterDebugHandlers() {
+	httpRegister(http.MethodGet, "/control/debug/runtime", handleDebugRuntime)
+	httpRegister(http.MethodGet, "/control/debug/pprof", handleDebugPprof)
+	httpRegister(http.MethodGet, "/control/debug/bundle", handleDebugBundle)
+}
@@ -0,0 +1,98 @@
+package home
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugRedactConfig(t *testing.T) {
+	conf := `users:
+- name: admin
+  password: $2y$10$hash
+  totp_secret: SECRET
+api_tokens:
+- name: t
+  hash: abcd
+sync:
+  leader_url: http://leader
+  token: agh_token
+notifications:
+  webhooks:
+  - name: slack
+    url: https://hooks.slack.com/services/secret
+filters:
+- url: https://example.org/filter.txt
+tls:
+  private_key: ""
+`
+	data, err := debugRedactConfig([]byte(conf))
+	assert.Nil(t, err)
+	s := string(data)
+	assert.False(t, strings.Contains(s, "$2y$10$hash"))
+	assert.False(t, strings.Contains(s, "SECRET"))
+	assert.False(t, strings.Contains(s, "abcd"))
+	assert.False(t, strings.Contains(s, "agh_token"))
+	assert.False(t, strings.Contains(s, "hooks.slack.com"))
+	assert.True(t, strings.Contains(s, "name: admin"))
+	assert.True(t, strings.Contains(s, "http://leader"))
+	assert.True(t, strings.Contains(s, "https://example.org/filter.txt"))
+	assert.True(t, strings.Contains(s, `private_key: ""`))
+}
+
+func TestDebugRuntime(t *testing.T) {
+	d := debugRuntime()
+	assert.True(t, d.Goroutines > 0)
+	assert.True(t, d.Memory.HeapAlloc > 0)
+	assert.True(t, len(d.Allocations) <= debugAllocSites)
+
+	w := httptest.NewRecorder()
+	handleDebugPprof(w, httptest.NewRequest("GET", "/control/debug/pprof?name=goroutine&debug=2", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "goroutine "))
+
+	w = httptest.NewRecorder()
+	handleDebugPprof(w, httptest.NewRequest("GET", "/control/debug/pprof?name=unknown", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = httptest.NewRecorder()
+	handleDebugPprof(w, httptest.NewRequest("GET", "/control/debug/pprof?name=profile&seconds=600", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDebugBundle(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	prevWorkDir := Context.workDir
+	Context.workDir = dir
+	defer func() { Context.workDir = prevWorkDir }()
+
+	data, err := debugBundle()
+	assert.Nil(t, err)
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		files[hdr.Name], _ = ioutil.ReadAll(tr)
+	}
+	for _, name := range []string{"runtime.json", backupConfigFile, "log.txt", "goroutine.txt", "heap.pb.gz", "allocs.pb.gz"} {
+		_, ok := files[name]
+		assert.True(t, ok, name)
+	}
+	assert.True(t, len(files["goroutine.txt"]) != 0)
+}
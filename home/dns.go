@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
@@ -47,6 +48,9 @@ func initDNSServer() error {
 		BaseDir:        baseDir,
 		Interval:       config.DNS.QueryLogInterval,
 		MemSize:        config.DNS.QueryLogMemSize,
+		MaxSize:        config.DNS.QueryLogMaxSize,
+		Storage:        config.DNS.QueryLogStorage,
+		Forward:        config.DNS.QueryLogForward,
 		ConfigModified: onConfigModified,
 		HTTPRegister:   httpRegister,
 	}
@@ -60,6 +64,7 @@ func initDNSServer() error {
 	filterConf.ResolverAddress = fmt.Sprintf("%s:%d", bindhost, config.DNS.Port)
 	filterConf.ConfigModified = onConfigModified
 	filterConf.HTTPRegister = httpRegister
+	filterConf.ResolveHost = resolveHost
 	Context.dnsFilter = dnsfilter.New(&filterConf, nil)
 
 	Context.dnsServer = dnsforward.NewServer(Context.dnsFilter, Context.stats, Context.queryLog)
@@ -77,6 +82,8 @@ func initDNSServer() error {
 		return fmt.Errorf("Couldn't initialize Auth module")
 	}
 	config.Users = nil
+	Context.auth.setTokens(config.APITokens)
+	config.APITokens = nil
 
 	Context.rdns = InitRDNS(Context.dnsServer, &Context.clients)
 	Context.whois = initWhois(&Context.clients)
@@ -157,6 +164,8 @@ func onDNSRequest(d *proxy.DNSContext) {
 	if isPublicIP(ipAddr) {
 		Context.whois.Begin(ip)
 	}
+	Context.notifier.clientSeen(ip)
+	Context.hooks.clientSeen(ip)
 }
 
 func generateServerConfig() dnsforward.ServerConfig {
@@ -167,44 +176,100 @@ func generateServerConfig() dnsforward.ServerConfig {
 		ConfigModified:  onConfigModified,
 		HTTPRegister:    httpRegister,
 		OnDNSRequest:    onDNSRequest,
+		OnUpstreamDown:  onUpstreamDown,
+		OnDNSBlocked:    onDNSBlocked,
+		CacheFile:       filepath.Join(Context.getDataDir(), "dnscache.bin"),
+		Sockets:         Context.sockets.dnsSockets(),
+		UpstreamProxy:   upstreamProxy(),
 	}
 
 	if config.TLS.Enabled {
 		newconfig.TLSConfig = config.TLS.TLSConfig
+		newconfig.TLSConfig.ServerName = config.TLS.ServerName
 		if config.TLS.PortDNSOverTLS != 0 {
 			newconfig.TLSListenAddr = &net.TCPAddr{IP: net.ParseIP(config.DNS.BindHost), Port: config.TLS.PortDNSOverTLS}
 		}
 	}
+	// unencrypted DNS-over-HTTPS requests may be allowed without TLS
+	newconfig.DoHPath = config.TLS.DoHPath
+	newconfig.DoHEndpoints = config.TLS.DoHEndpoints
 
 	newconfig.FilterHandler = applyAdditionalFiltering
 	newconfig.GetUpstreamsByClient = getUpstreamsByClient
+	newconfig.GetBlockingModeByClient = getBlockingModeByClient
+	newconfig.GetHostnameByIP = getHostnameByIP
+	newconfig.GetLogSettingsByClient = getLogSettingsByClient
+	newconfig.GetQueryPolicyByClient = getQueryPolicyByClient
 	return newconfig
 }
 
-func getUpstreamsByClient(clientAddr string) []upstream.Upstream {
-	return Context.clients.FindUpstreams(clientAddr)
+func getUpstreamsByClient(clientAddr, clientID string) []upstream.Upstream {
+	return Context.clients.FindUpstreams(clientAddr, clientID)
+}
+
+func getBlockingModeByClient(clientAddr, clientID string) (string, net.IP, net.IP) {
+	return Context.clients.FindBlockingMode(clientAddr, clientID)
+}
+
+func getQueryPolicyByClient(clientAddr, clientID string) dnsforward.QueryPolicy {
+	return Context.clients.FindQueryPolicy(clientAddr, clientID)
+}
+
+// Get IP addresses by host name from upstream servers
+func resolveHost(host string) ([]net.IPAddr, error) {
+	if Context.dnsServer == nil {
+		return nil, fmt.Errorf("DNS server isn't initialized")
+	}
+	return Context.dnsServer.Resolve(host)
+}
+
+// The queries aren't written to query log and statistics while the instance is standby
+func getLogSettingsByClient(clientAddr, clientID string) (bool, bool) {
+	if Context.ha.isStandby() {
+		return true, true
+	}
+	return Context.clients.FindLogSettings(clientAddr, clientID)
+}
+
+func getHostnameByIP(clientAddr string) string {
+	return Context.clients.FindLocalHostname(clientAddr)
 }
 
 // If a client has his own settings, apply them
-func applyAdditionalFiltering(clientAddr string, setts *dnsfilter.RequestFilteringSettings) {
+// Then apply the schedule (either client's or global one)
+func applyAdditionalFiltering(clientAddr, clientID string, setts *dnsfilter.RequestFilteringSettings) {
 	ApplyBlockedServices(setts, config.DNS.BlockedServices)
 
-	if len(clientAddr) == 0 {
+	sched := &config.DNS.Schedule
+	var clientName string
+	defer func() {
+		now := time.Now()
+		sched.apply(setts, now)
+		Context.filteringPause.apply(setts, now, clientAddr, clientName)
+	}()
+
+	if len(clientAddr) == 0 && len(clientID) == 0 {
 		return
 	}
 
-	c, ok := Context.clients.Find(clientAddr)
+	c, ok := Context.clients.Find(clientAddr, clientID)
 	if !ok {
 		return
 	}
 
-	log.Debug("Using settings for client with IP %s", clientAddr)
+	log.Debug("Using settings for client %s (IP %s, ClientID %q)", c.Name, clientAddr, clientID)
+	clientName = c.Name
+
+	if c.Schedule != nil {
+		sched = c.Schedule
+	}
 
 	if c.UseOwnBlockedServices {
 		ApplyBlockedServices(setts, c.BlockedServices)
 	}
 
 	setts.ClientTags = c.Tags
+	setts.AuditMode = c.AuditMode
 
 	if !c.UseOwnSettings {
 		return
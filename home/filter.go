@@ -1,12 +1,17 @@
 package home
 
 import (
+	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,6 +22,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/AdguardTeam/golibs/file"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter/rules"
 )
 
 var (
@@ -24,6 +30,11 @@ var (
 	filterTitleRegexp = regexp.MustCompile(`^! Title: +(.*)$`)
 	refreshStatus     uint32 // 0:none; 1:in progress
 	refreshLock       sync.Mutex
+
+	// "! Expires: 4 days", "! Expires: 12 hours (update frequency)"
+	filterExpiresRegexp = regexp.MustCompile(`(?i)^[!#] *Expires: *(\d+) *([a-z]*)`)
+
+	errFiltersUpdating = errors.New("Filters update procedure is already running")
 )
 
 func initFiltering() {
@@ -45,8 +56,6 @@ func defaultFilters() []filter {
 	return []filter{
 		{Filter: dnsfilter.Filter{ID: 1}, Enabled: true, URL: "https://adguardteam.github.io/AdGuardSDNSFilter/Filters/filter.txt", Name: "AdGuard Simplified Domain Names filter"},
 		{Filter: dnsfilter.Filter{ID: 2}, Enabled: false, URL: "https://adaway.org/hosts.txt", Name: "AdAway"},
-		{Filter: dnsfilter.Filter{ID: 3}, Enabled: false, URL: "https://hosts-file.net/ad_servers.txt", Name: "hpHosts - Ad and Tracking servers only"},
-		{Filter: dnsfilter.Filter{ID: 4}, Enabled: false, URL: "https://www.malwaredomainlist.com/hostslist/hosts.txt", Name: "MalwareDomainList.com Hosts List"},
 	}
 }
 
@@ -60,6 +69,56 @@ type filter struct {
 	checksum    uint32    // checksum of the file data
 	white       bool
 
+	// Values of ETag and Last-Modified HTTP headers received with the last accepted download.
+	// They are used for conditional requests, so that the server can respond with 304
+	//  if the filter data hasn't been changed.
+	ETag         string `yaml:"etag,omitempty"`
+	LastModified string `yaml:"last_modified,omitempty"`
+
+	// Alternate URLs of the filter data.  They are tried in order if the download from the main URL fails.
+	Mirrors []string `yaml:"mirrors,omitempty"`
+	// The mirror the last accepted data was downloaded from (empty: the main URL).
+	// ETag and Last-Modified values were received from it, so the conditional requests are sent only to it.
+	LastMirror string `yaml:"last_mirror,omitempty"`
+
+	// The time of the last update attempt (either successful or not)
+	//  and the error that occurred during it (empty if the attempt was successful).
+	// Checking a local file that hasn't been modified isn't considered an update attempt.
+	LastAttempt time.Time `yaml:"last_attempt,omitempty"`
+	LastError   string    `yaml:"last_error,omitempty"`
+
+	// Limits for this filter.  They override the global settings "filters_max_size" and "filters_max_rules".
+	// 0: use the global setting
+	MaxSize  uint32 `yaml:"max_size,omitempty"`  // maximum size of filter data (in bytes)
+	MaxRules uint32 `yaml:"max_rules,omitempty"` // maximum number of rules
+
+	// Public key for verification of detached signatures (minisign or armored PGP key).
+	// If it's set, the data without a valid signature is refused.
+	PublicKey    string `yaml:"public_key,omitempty"`
+	SignatureURL string `yaml:"signature_url,omitempty"` // URL or path of the signature.  Empty: filter URL with ".minisig" or ".asc" suffix
+
+	// The result of verification of the current data (see filterVerify*)
+	Verification string `yaml:"verification,omitempty"`
+
+	// Format of the source data (see filterFormat*).
+	// The data is stored on disk already converted to adblock format.
+	Format string `yaml:"format,omitempty"`
+
+	// Modification time and size of a local source file at the time it was last read
+	srcModTime time.Time
+	srcSize    int64
+
+	// Update interval specified by "! Expires:" directive in filter data (0: not specified).
+	// It's used instead of the global setting "filters_update_interval".
+	expires time.Duration
+
+	// Invalid rules found during the last update.  They aren't loaded by the rule engine.
+	invalidRulesCount int           // the total number of invalid rules
+	invalidRules      []invalidRule // the first maxInvalidRules invalid rules
+
+	// The last maxFilterChanges changes of filter data (the oldest go first).  They aren't kept across restarts.
+	changes []filterChange
+
 	dnsfilter.Filter `yaml:",inline"`
 }
 
@@ -69,7 +128,7 @@ func userFilter() filter {
 		// User filter always has constant ID=0
 		Enabled: true,
 	}
-	f.Filter.Data = []byte(strings.Join(config.UserRules, "\n"))
+	f.Filter.Data = []byte(userRulesData(config.UserRules))
 	return f
 }
 
@@ -181,6 +240,31 @@ func filterAdd(f filter) bool {
 	return true
 }
 
+// Add several filters at once
+// Filters with URLs that already exist (or are repeated in the input array) are skipped.
+// All filters are added while the configuration is locked, so either all of them are visible to other modules or none.
+// Return the number of added filters
+func filterAddBulk(filters []filter) int {
+	config.Lock()
+	defer config.Unlock()
+
+	n := 0
+	for _, f := range filters {
+		if filterExistsNoLock(f.URL) {
+			continue
+		}
+
+		f.ID = assignUniqueFilterID()
+		if f.white {
+			config.WhitelistFilters = append(config.WhitelistFilters, f)
+		} else {
+			config.Filters = append(config.Filters, f)
+		}
+		n++
+	}
+	return n
+}
+
 // Load filters from the disk
 // And if any filter has zero ID, assign a new one
 func loadFilters(array []filter) {
@@ -235,29 +319,38 @@ func assignUniqueFilterID() int64 {
 }
 
 // Sets up a timer that will be checking for filters updates periodically
+// The task sleeps until the next filter is to be updated (see nextRefreshWait()),
+// but after a network error it retries with a dynamically increasing time interval.
 func periodicallyRefreshFilters() {
-	const maxInterval = 1 * 60 * 60
-	intval := 5 // use a dynamically increasing time interval
+	netErrWait := refreshMinWait
 	for {
+		config.RLock()
+		enabled := filtersUpdateEnabled()
+		config.RUnlock()
+
 		isNetworkErr := false
-		if config.DNS.FiltersUpdateIntervalHours != 0 && atomic.CompareAndSwapUint32(&refreshStatus, 0, 1) {
+		if enabled && atomic.CompareAndSwapUint32(&refreshStatus, 0, 1) {
 			refreshLock.Lock()
 			_, isNetworkErr = refreshFiltersIfNecessary(FilterRefreshBlocklists | FilterRefreshAllowlists)
 			refreshLock.Unlock()
 			refreshStatus = 0
-			if !isNetworkErr {
-				intval = maxInterval
-			}
 		}
 
+		wait := nextRefreshWait(time.Now())
 		if isNetworkErr {
-			intval *= 2
-			if intval > maxInterval {
-				intval = maxInterval
+			netErrWait *= 2
+			if netErrWait > refreshCheckInterval {
+				netErrWait = refreshCheckInterval
 			}
+			wait = netErrWait
+		} else {
+			netErrWait = refreshMinWait
 		}
 
-		time.Sleep(time.Duration(intval) * time.Second)
+		select {
+		case <-time.After(wait):
+		case <-refreshWakeup:
+		}
 	}
 }
 
@@ -268,7 +361,7 @@ func periodicallyRefreshFilters() {
 func refreshFilters(flags int, important bool) (int, error) {
 	set := atomic.CompareAndSwapUint32(&refreshStatus, 0, 1)
 	if !important && !set {
-		return 0, fmt.Errorf("Filters update procedure is already running")
+		return 0, errFiltersUpdating
 	}
 
 	refreshLock.Lock()
@@ -291,16 +384,17 @@ func refreshFiltersArray(filters *[]filter, force bool) (int, []filter, []bool,
 			continue
 		}
 
-		expireTime := f.LastUpdated.Unix() + int64(config.DNS.FiltersUpdateIntervalHours)*60*60
-		if !force && expireTime > now.Unix() {
+		// Local files are checked on each iteration:
+		//  it's cheap and we want to pick up the changes as soon as possible
+		if !force && f.nextUpdate().After(now) && filterLocalPath(f.URL) == "" {
 			continue
 		}
 
-		var uf filter
-		uf.ID = f.ID
-		uf.URL = f.URL
-		uf.Name = f.Name
-		uf.checksum = f.checksum
+		uf := f.copyForUpdate()
+		if force {
+			// re-read local files even if they haven't been modified
+			uf.srcModTime = time.Time{}
+		}
 		updateFilters = append(updateFilters, uf)
 	}
 	config.RUnlock()
@@ -314,58 +408,203 @@ func refreshFiltersArray(filters *[]filter, force bool) (int, []filter, []bool,
 		uf := &updateFilters[i]
 		updated, err := uf.update()
 		updateFlags = append(updateFlags, updated)
+		countFilterUpdate(err)
 		if err != nil {
 			nfail++
 			log.Printf("Failed to update filter %s: %s\n", uf.URL, err)
+			onFilterUpdateFailed(uf.URL, err)
+			uf.LastError = err.Error()
 			continue
 		}
+		uf.LastError = ""
 		uf.LastUpdated = now
 	}
 
+	updateCount := 0
+	configModified := false
+	for i := range updateFilters {
+		applied, modified, err := storeFilterUpdate(filters, &updateFilters[i], updateFlags[i])
+		if err != nil {
+			log.Error("%s", err)
+			continue
+		}
+		if applied {
+			updateCount++
+		}
+		configModified = configModified || modified
+	}
+	if configModified {
+		// save the new ETag and Last-Modified values
+		onConfigModified()
+	}
+
 	if nfail == len(updateFilters) {
 		return 0, nil, nil, true
 	}
+	return updateCount, updateFilters, updateFlags, false
+}
 
-	updateCount := 0
-	for i := range updateFilters {
-		uf := &updateFilters[i]
-		updated := updateFlags[i]
-		if updated {
-			err := uf.saveAndBackupOld()
-			if err != nil {
-				log.Printf("Failed to save the updated filter %d: %s", uf.ID, err)
-				continue
-			}
-		} else {
-			e := os.Chtimes(uf.Path(), uf.LastUpdated, uf.LastUpdated)
-			if e != nil {
-				log.Error("os.Chtimes(): %v", e)
-			}
+// Get a copy of filter properties that are necessary for the update procedure
+func (f *filter) copyForUpdate() filter {
+	var uf filter
+	uf.ID = f.ID
+	uf.URL = f.URL
+	uf.Name = f.Name
+	uf.checksum = f.checksum
+	uf.LastUpdated = f.LastUpdated
+	uf.ETag = f.ETag
+	uf.LastModified = f.LastModified
+	uf.Mirrors = f.Mirrors
+	uf.LastMirror = f.LastMirror
+	uf.srcModTime = f.srcModTime
+	uf.srcSize = f.srcSize
+	uf.Format = f.Format
+	uf.MaxSize = f.MaxSize
+	uf.MaxRules = f.MaxRules
+	uf.PublicKey = f.PublicKey
+	uf.SignatureURL = f.SignatureURL
+	uf.Verification = f.Verification
+	uf.LastAttempt = f.LastAttempt
+	uf.LastError = f.LastError
+	return uf
+}
+
+// Save the updated filter data to disk and apply the new properties to the filter object in configuration
+// updated: TRUE if filter data has changed
+// Return TRUE if the new filter data has been applied
+// Return TRUE if the properties stored in configuration file have changed
+// Return an error if the new filter data couldn't be saved
+func storeFilterUpdate(filters *[]filter, uf *filter, updated bool) (bool, bool, error) {
+	var change filterChange
+	if updated {
+		err := uf.saveAndBackupOld()
+		if err != nil {
+			return false, false, fmt.Errorf("failed to save the updated filter %d: %s", uf.ID, err)
+		}
+		change = uf.diffWithOld()
+	} else {
+		e := os.Chtimes(uf.Path(), uf.LastUpdated, uf.LastUpdated)
+		if e != nil {
+			log.Error("os.Chtimes(): %v", e)
 		}
+	}
 
-		config.Lock()
-		for k := range *filters {
-			f := &(*filters)[k]
-			if f.ID != uf.ID || f.URL != uf.URL {
-				continue
-			}
-			f.LastUpdated = uf.LastUpdated
-			if !updated {
-				continue
+	applied := false
+	modified := false
+	config.Lock()
+	for k := range *filters {
+		f := &(*filters)[k]
+		if f.ID != uf.ID || f.URL != uf.URL {
+			continue
+		}
+		f.LastUpdated = uf.LastUpdated
+		f.srcModTime = uf.srcModTime
+		f.srcSize = uf.srcSize
+		if f.ETag != uf.ETag || f.LastModified != uf.LastModified || f.LastMirror != uf.LastMirror ||
+			!f.LastAttempt.Equal(uf.LastAttempt) || f.LastError != uf.LastError ||
+			f.Verification != uf.Verification {
+			f.ETag = uf.ETag
+			f.LastModified = uf.LastModified
+			f.LastMirror = uf.LastMirror
+			f.LastAttempt = uf.LastAttempt
+			f.LastError = uf.LastError
+			f.Verification = uf.Verification
+			modified = true
+		}
+		if !updated {
+			continue
+		}
+
+		log.Info("Updated filter #%d.  Rules: %d -> %d (+%d, -%d)",
+			f.ID, f.RulesCount, uf.RulesCount, change.Added, change.Removed)
+		f.addChange(change)
+		f.Name = uf.Name
+		f.Data = nil
+		f.RulesCount = uf.RulesCount
+		f.Format = uf.Format
+		f.expires = uf.expires
+		f.invalidRulesCount = uf.invalidRulesCount
+		f.invalidRules = uf.invalidRules
+		f.checksum = uf.checksum
+		applied = true
+		modified = true
+	}
+	config.Unlock()
+
+	if applied {
+		onFilterUpdated(uf)
+	}
+	return applied, modified, nil
+}
+
+// Refresh one filter specified by its ID or URL
+// The filter is downloaded regardless of its last update time.
+// Only an enabled filter can be updated.
+// Return TRUE if filter data has changed
+func refreshFilter(id int64, url string) (bool, error) {
+	if !atomic.CompareAndSwapUint32(&refreshStatus, 0, 1) {
+		return false, errFiltersUpdating
+	}
+	refreshLock.Lock()
+	defer func() {
+		refreshLock.Unlock()
+		refreshStatus = 0
+	}()
+
+	var filters *[]filter
+	var uf filter
+	enabled := false
+	config.RLock()
+	for _, arr := range []*[]filter{&config.Filters, &config.WhitelistFilters} {
+		for i := range *arr {
+			f := &(*arr)[i]
+			if (id != 0 && f.ID == id) || (id == 0 && f.URL == url) {
+				filters = arr
+				enabled = f.Enabled
+				uf = f.copyForUpdate()
+				uf.srcModTime = time.Time{} // re-read a local file even if it hasn't been modified
+				break
 			}
+		}
+		if filters != nil {
+			break
+		}
+	}
+	config.RUnlock()
 
-			log.Info("Updated filter #%d.  Rules: %d -> %d",
-				f.ID, f.RulesCount, uf.RulesCount)
-			f.Name = uf.Name
-			f.Data = nil
-			f.RulesCount = uf.RulesCount
-			f.checksum = uf.checksum
-			updateCount++
+	if filters == nil {
+		return false, fmt.Errorf("filter not found")
+	}
+	if !enabled {
+		return false, fmt.Errorf("filter %d is disabled", uf.ID)
+	}
+
+	log.Debug("Filters: updating filter %d...", uf.ID)
+	updated, err := uf.update()
+	if err != nil {
+		uf.LastError = err.Error()
+		_, modified, _ := storeFilterUpdate(filters, &uf, false)
+		if modified {
+			onConfigModified()
 		}
-		config.Unlock()
+		return false, err
 	}
+	uf.LastError = ""
+	uf.LastUpdated = time.Now()
 
-	return updateCount, updateFilters, updateFlags, false
+	applied, modified, err := storeFilterUpdate(filters, &uf, updated)
+	if err != nil {
+		return false, err
+	}
+	if modified {
+		onConfigModified()
+	}
+	if !applied {
+		return false, nil
+	}
+
+	enableFilters(false)
+	return true, nil
 }
 
 const (
@@ -388,7 +627,7 @@ const (
 //    . store the new data on disk (1.txt)
 //  . Pass new filters to dnsfilter object - it analyzes new data while the old filters are still active
 //  . dnsfilter activates new filters
-//  . Remove the old filter files (1.txt.old)
+//  . The old filter files (1.txt.old) are kept until the next update - they're used to compute the changes
 //
 // Return the number of updated filters
 // Return TRUE - there was a network error and nothing could be updated
@@ -396,8 +635,6 @@ func refreshFiltersIfNecessary(flags int) (int, bool) {
 	log.Debug("Filters: updating...")
 
 	updateCount := 0
-	var updateFilters []filter
-	var updateFlags []bool
 	netError := false
 	netErrorW := false
 	force := false
@@ -405,16 +642,12 @@ func refreshFiltersIfNecessary(flags int) (int, bool) {
 		force = true
 	}
 	if (flags & FilterRefreshBlocklists) != 0 {
-		updateCount, updateFilters, updateFlags, netError = refreshFiltersArray(&config.Filters, force)
+		updateCount, _, _, netError = refreshFiltersArray(&config.Filters, force)
 	}
 	if (flags & FilterRefreshAllowlists) != 0 {
 		updateCountW := 0
-		var updateFiltersW []filter
-		var updateFlagsW []bool
-		updateCountW, updateFiltersW, updateFlagsW, netErrorW = refreshFiltersArray(&config.WhitelistFilters, force)
+		updateCountW, _, _, netErrorW = refreshFiltersArray(&config.WhitelistFilters, force)
 		updateCount += updateCountW
-		updateFilters = append(updateFilters, updateFiltersW...)
-		updateFlags = append(updateFlags, updateFlagsW...)
 	}
 	if netError && netErrorW {
 		return 0, true
@@ -422,15 +655,6 @@ func refreshFiltersIfNecessary(flags int) (int, bool) {
 
 	if updateCount != 0 {
 		enableFilters(false)
-
-		for i := range updateFilters {
-			uf := &updateFilters[i]
-			updated := updateFlags[i]
-			if !updated {
-				continue
-			}
-			_ = os.Remove(uf.Path() + ".old")
-		}
 	}
 
 	log.Debug("Filters: update finished")
@@ -448,12 +672,51 @@ func isPrintableText(data []byte) bool {
 	return true
 }
 
-// A helper function that parses filter contents and returns a number of rules and a filter name (if there's any)
-func parseFilterContents(contents []byte) (int, string) {
+// Limits for the update interval specified by "! Expires:" directive
+const (
+	filterExpiresMin = 1 * time.Hour
+	filterExpiresMax = 7 * 24 * time.Hour
+)
+
+// Parse the value of "! Expires:" directive
+// The value is bounded by filterExpiresMin and filterExpiresMax.
+// Return 0 if the value is invalid.
+func parseFilterExpires(num, unit string) time.Duration {
+	n, err := strconv.Atoi(num)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	if n > 10000 {
+		n = 10000 // prevent overflow; the value will be bounded anyway
+	}
+
+	var d time.Duration
+	switch strings.ToLower(unit) {
+	case "", "d", "day", "days":
+		d = time.Duration(n) * 24 * time.Hour
+	case "h", "hour", "hours":
+		d = time.Duration(n) * time.Hour
+	default:
+		return 0
+	}
+
+	if d < filterExpiresMin {
+		d = filterExpiresMin
+	} else if d > filterExpiresMax {
+		d = filterExpiresMax
+	}
+	return d
+}
+
+// A helper function that parses filter contents and returns a number of rules, a filter name (if there's any)
+//  and the update interval specified by "! Expires:" directive (if there's any)
+func parseFilterContents(contents []byte) (int, string, time.Duration) {
 	data := string(contents)
 	rulesCount := 0
 	name := ""
 	seenTitle := false
+	var expires time.Duration
+	seenExpires := false
 
 	// Count lines in the filter
 	for len(data) != 0 {
@@ -462,51 +725,109 @@ func parseFilterContents(contents []byte) (int, string) {
 			continue
 		}
 
-		if line[0] == '!' {
+		if isFilterComment(line) {
 			m := filterTitleRegexp.FindAllStringSubmatch(line, -1)
 			if len(m) > 0 && len(m[0]) >= 2 && !seenTitle {
 				name = m[0][1]
 				seenTitle = true
 			}
+
+			m = filterExpiresRegexp.FindAllStringSubmatch(line, -1)
+			if len(m) > 0 && len(m[0]) >= 3 && !seenExpires {
+				expires = parseFilterExpires(m[0][1], m[0][2])
+				seenExpires = true
+			}
 		} else {
 			rulesCount++
 		}
 	}
 
-	return rulesCount, name
+	return rulesCount, name, expires
+}
+
+// Maximum number of invalid rules stored for a filter
+const maxInvalidRules = 100
+
+// An invalid line in filter data
+type invalidRule struct {
+	Line  int    `json:"line"` // line number in the source data (starting from 1)
+	Text  string `json:"text"`
+	Error string `json:"error"`
+}
+
+// Check the syntax of each rule in the source data of the specified format
+// Return the number of valid rules, the total number of invalid lines
+//  and the list of invalid lines (no more than maxInvalidRules items)
+func validateFilterContents(data []byte, format string, filterID int64) (int, int, []invalidRule) {
+	conv := filterLineConverter(format)
+	s := string(data)
+	rulesCount := 0
+	nInvalid := 0
+	invalid := []invalidRule{}
+	for lineNum := 1; len(s) != 0; lineNum++ {
+		line := strings.TrimSpace(util.SplitNext(&s, '\n'))
+		if len(line) == 0 || isFilterComment(line) {
+			continue
+		}
+
+		texts := []string{line}
+		if conv != nil {
+			texts = conv(line)
+		}
+		for _, text := range texts {
+			_, err := rules.NewRule(text, int(filterID))
+			if err == nil {
+				rulesCount++
+				continue
+			}
+
+			nInvalid++
+			if len(invalid) < maxInvalidRules {
+				if len(line) > 256 {
+					line = line[:256]
+				}
+				invalid = append(invalid, invalidRule{Line: lineNum, Text: line, Error: err.Error()})
+			}
+			break
+		}
+	}
+	return rulesCount, nInvalid, invalid
 }
 
 // Perform upgrade on a filter
 func (filter *filter) update() (bool, error) {
-	log.Tracef("Downloading update for filter %d from %s", filter.ID, filter.URL)
-
-	resp, err := Context.client.Get(filter.URL)
-	if resp != nil && resp.Body != nil {
-		defer resp.Body.Close()
+	var body []byte
+	var hdr http.Header
+	var st os.FileInfo
+	var err error
+	src := filter.URL
+	if filterLocalPath(filter.URL) != "" {
+		body, st, err = filter.readLocal()
+		if err == nil && body == nil {
+			return false, nil
+		}
+	} else {
+		body, hdr, src, err = filter.downloadMirrors()
 	}
-	if err != nil {
-		log.Printf("Couldn't request filter from URL %s, skipping: %s", filter.URL, err)
+	filter.LastAttempt = time.Now()
+	if err != nil || body == nil {
 		return false, err
 	}
 
-	if resp.StatusCode != 200 {
-		log.Printf("Got status code %d from URL %s, skipping", resp.StatusCode, filter.URL)
-		return false, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
+	raw := body
+	if util.IsGzip(body) {
+		body, err = util.Gunzip(body, filter.maxSize())
+		if err != nil {
+			return false, fmt.Errorf("Couldn't decompress data: %s", err)
+		}
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	// Tampered data must not replace the data we already have
+	verification, err := filter.verify(body, raw, src)
 	if err != nil {
-		log.Printf("Couldn't fetch filter contents from URL %s, skipping: %s", filter.URL, err)
 		return false, err
 	}
 
-	// Check if the filter has been really changed
-	checksum := crc32.ChecksumIEEE(body)
-	if filter.checksum == checksum {
-		log.Tracef("Filter #%d at URL %s hasn't changed, not updating it", filter.ID, filter.URL)
-		return false, nil
-	}
-
 	var firstChunk []byte
 	if len(body) <= 4096 {
 		firstChunk = body
@@ -523,28 +844,321 @@ func (filter *filter) update() (bool, error) {
 		return false, fmt.Errorf("Data is HTML, not plain text")
 	}
 
-	// Extract filter name and count number of rules
-	rulesCount, filterName := parseFilterContents(body)
-	log.Printf("Filter %d has been updated: %d bytes, %d rules", filter.ID, len(body), rulesCount)
+	// Convert hosts, dnsmasq and domain lists to the format supported by the rule engine
+	format := detectFilterFormat(body)
+	rulesCount, nInvalid, invalid := validateFilterContents(body, format, filter.ID)
+	maxRules := filter.maxRules()
+	if maxRules != 0 && rulesCount > maxRules {
+		return false, fmt.Errorf("Too many rules: %d (limit: %d)", rulesCount, maxRules)
+	}
+	body = normalizeFilterContents(body, format)
+
+	// Check if the filter has been really changed
+	checksum := crc32.ChecksumIEEE(body)
+	if filter.checksum == checksum {
+		log.Tracef("Filter #%d at URL %s hasn't changed, not updating it", filter.ID, filter.URL)
+		// this is the data we have already accepted
+		filter.setCacheHeaders(hdr, src)
+		filter.setSourceStat(st)
+		filter.Verification = verification
+		return false, nil
+	}
+
+	// Extract filter name
+	_, filterName, expires := parseFilterContents(body)
+	log.Printf("Filter %d has been updated: %d bytes, %d rules, %d invalid rules, format: %s, expires: %s",
+		filter.ID, len(body), rulesCount, nInvalid, format, expires)
 	if filterName != "" {
 		filter.Name = filterName
 	}
+	filter.expires = expires
+	filter.Verification = verification
 	filter.RulesCount = rulesCount
+	filter.Format = format
+	filter.invalidRulesCount = nInvalid
+	filter.invalidRules = invalid
 	filter.Data = body
 	filter.checksum = checksum
+	// the data is accepted - now we can use these values for the next requests
+	filter.setCacheHeaders(hdr, src)
+	filter.setSourceStat(st)
 
 	return true, nil
 }
 
+// Get the update interval for the filter
+func (filter *filter) updateInterval() time.Duration {
+	if filter.expires != 0 {
+		return filter.expires
+	}
+	return time.Duration(config.DNS.FiltersUpdateIntervalHours) * time.Hour
+}
+
+// Get the maximum size of filter data (in bytes).  0: no limit
+func (filter *filter) maxSize() int64 {
+	if filter.MaxSize != 0 {
+		return int64(filter.MaxSize)
+	}
+	return int64(config.DNS.FiltersMaxSize)
+}
+
+// Get the maximum number of rules in a filter.  0: no limit
+func (filter *filter) maxRules() int {
+	if filter.MaxRules != 0 {
+		return int(filter.MaxRules)
+	}
+	return int(config.DNS.FiltersMaxRules)
+}
+
+// Store modification time and size of a local source file
+func (filter *filter) setSourceStat(st os.FileInfo) {
+	if st == nil {
+		return
+	}
+	filter.srcModTime = st.ModTime()
+	filter.srcSize = st.Size()
+}
+
+// Store ETag and Last-Modified values from HTTP response headers
+// and the mirror the response was received from
+func (filter *filter) setCacheHeaders(hdr http.Header, src string) {
+	if hdr == nil {
+		return
+	}
+	filter.ETag = hdr.Get("ETag")
+	filter.LastModified = hdr.Get("Last-Modified")
+	filter.LastMirror = ""
+	if src != filter.URL {
+		filter.LastMirror = src
+	}
+}
+
+// Download filter data from the URL (either the main one or a mirror)
+// Return nil data if the filter hasn't been changed on server
+// Return HTTP response headers, so the caller can store ETag and Last-Modified values after the data is accepted
+func (filter *filter) download(u string) ([]byte, http.Header, error) {
+	log.Tracef("Downloading update for filter %d from %s", filter.ID, u)
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u == filter.cacheSource() {
+		setConditionalHeaders(req, filter)
+	}
+	// We decompress the data by ourselves (see update()), so it works for .gz files as well
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := Context.client.Do(req)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		log.Printf("Couldn't request filter from URL %s, skipping: %s", u, err)
+		return nil, nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		log.Tracef("Filter #%d at URL %s hasn't changed (HTTP 304), not updating it", filter.ID, u)
+		return nil, nil, nil
+	}
+
+	if resp.StatusCode != 200 {
+		log.Printf("Got status code %d from URL %s, skipping", resp.StatusCode, u)
+		return nil, nil, statusError(resp.StatusCode)
+	}
+
+	maxSize := filter.maxSize()
+	if maxSize != 0 && resp.ContentLength > maxSize {
+		return nil, nil, fmt.Errorf("Data is too large: %d bytes (limit: %d)", resp.ContentLength, maxSize)
+	}
+
+	var r io.Reader = resp.Body
+	if maxSize != 0 {
+		// stop downloading once the limit is exceeded
+		r = io.LimitReader(resp.Body, maxSize+1)
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		log.Printf("Couldn't fetch filter contents from URL %s, skipping: %s", u, err)
+		return nil, nil, err
+	}
+	if maxSize != 0 && int64(len(body)) > maxSize {
+		return nil, nil, fmt.Errorf("Data is too large: more than %d bytes", maxSize)
+	}
+	return body, resp.Header, nil
+}
+
+// Read filter data from a local file
+// Return nil data if the file hasn't been modified since the last update
+// Return file information, so the caller can store it after the data is accepted
+func (filter *filter) readLocal() ([]byte, os.FileInfo, error) {
+	fn := filterLocalPath(filter.URL)
+	log.Tracef("Reading update for filter %d from %s", filter.ID, fn)
+
+	st, err := os.Stat(fn)
+	if err != nil {
+		log.Printf("Couldn't stat filter file %s, skipping: %s", fn, err)
+		return nil, nil, err
+	}
+	err = checkLocalFilterFile(fn, st)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if filter.checksum != 0 &&
+		st.ModTime().Equal(filter.srcModTime) && st.Size() == filter.srcSize {
+		log.Tracef("Filter #%d at %s hasn't been modified, not updating it", filter.ID, fn)
+		return nil, nil, nil
+	}
+
+	maxSize := filter.maxSize()
+	if maxSize != 0 && st.Size() > maxSize {
+		return nil, nil, fmt.Errorf("File is too large: %d bytes (limit: %d)", st.Size(), maxSize)
+	}
+
+	// Note: if the file is modified after Stat(), its modification time will differ from the one we store,
+	//  so we'll read it again next time.
+	body, err := ioutil.ReadFile(fn)
+	if err != nil {
+		log.Printf("Couldn't read filter file %s, skipping: %s", fn, err)
+		return nil, nil, err
+	}
+	return body, st, nil
+}
+
+// Check whether we may use this file as a filter source:
+// . it must be a regular file
+// . it must be located inside the directory set by "filters_local_dir" setting
+// . it must not be located inside our working directory (data files, configuration)
+// . it must not be our configuration file
+// We read it with the rights of our process, and its lines may be shown to user via "check_host" method,
+//  so we don't allow to read the files with our own databases and passwords.
+func checkLocalFilterFile(fn string, st os.FileInfo) error {
+	if !st.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", fn)
+	}
+
+	resolved, err := resolvePath(fn)
+	if err != nil {
+		return err
+	}
+
+	localDir := config.DNS.FiltersLocalDir
+	if len(localDir) == 0 {
+		return fmt.Errorf("%s: local filter files are disabled: filters_local_dir isn't set", fn)
+	}
+	localDir, err = resolvePath(localDir)
+	if err != nil {
+		return err
+	}
+	if !isPathInside(resolved, localDir) {
+		return fmt.Errorf("%s is located outside %s", fn, localDir)
+	}
+
+	if len(Context.workDir) != 0 {
+		workDir, err := resolvePath(Context.workDir)
+		if err == nil && isPathInside(resolved, workDir) {
+			return fmt.Errorf("%s is located inside the working directory", fn)
+		}
+	}
+
+	if len(Context.configFilename) != 0 {
+		configFile, err := resolvePath(config.getConfigFilename())
+		if err == nil && resolved == configFile {
+			return fmt.Errorf("%s is the configuration file", fn)
+		}
+	}
+
+	return nil
+}
+
+// Get the absolute path with all symlinks resolved
+func resolvePath(fn string) (string, error) {
+	fn, err := filepath.Abs(fn)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(fn)
+}
+
+// Return TRUE if the file is located inside the directory (at any depth)
+func isPathInside(fn, dir string) bool {
+	rel, err := filepath.Rel(dir, fn)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Get the path to a local filter file: either "file://" URL or an absolute file path
+// "file://" URL must have an empty host or "localhost" and an absolute path
+// Return an empty string if it's not a local filter
+func filterLocalPath(s string) string {
+	if filepath.IsAbs(s) {
+		return s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return ""
+	}
+
+	p := u.Path
+	if runtime.GOOS == "windows" && len(p) >= 3 && p[0] == '/' && p[2] == ':' {
+		// file:///C:/path -> C:/path
+		p = p[1:]
+	}
+	p = filepath.FromSlash(p)
+	if !filepath.IsAbs(p) {
+		return ""
+	}
+	return p
+}
+
+// Add If-None-Match and If-Modified-Since headers to the request.
+// We do it only if we already have the filter data:
+//  if the file doesn't exist, 304 response would leave us with nothing.
+// Only the values received from server are used:
+//  our local time may be skewed relative to the server's clock.
+func setConditionalHeaders(req *http.Request, filter *filter) {
+	if filter.checksum == 0 {
+		return
+	}
+
+	if len(filter.ETag) != 0 {
+		req.Header.Set("If-None-Match", filter.ETag)
+	}
+	if len(filter.LastModified) != 0 {
+		req.Header.Set("If-Modified-Since", filter.LastModified)
+	}
+}
+
 // saves filter contents to the file in dataDir
 // This method is safe to call during filters update,
 //  because it creates a new file and then renames it,
 //  so the currently opened file descriptors to the old filter file remain valid.
+// The data is compressed if "filters_compress" setting is enabled.
 func (filter *filter) save() error {
 	filterFilePath := filter.Path()
 	log.Printf("Saving filter %d contents to: %s", filter.ID, filterFilePath)
 
-	err := file.SafeWrite(filterFilePath, filter.Data)
+	data := filter.Data
+	if config.DNS.FiltersCompress {
+		var err error
+		data, err = util.Gzip(data)
+		if err != nil {
+			return err
+		}
+	}
+	err := file.SafeWrite(filterFilePath, data)
+	if err == nil {
+		// the file in the other format is not needed anymore
+		_ = os.Remove(filter.pathFormat(!config.DNS.FiltersCompress))
+	}
 
 	// update LastUpdated field after saving the file
 	filter.LastUpdated = filter.LastTimeUpdated()
@@ -560,25 +1174,65 @@ func (filter *filter) saveAndBackupOld() error {
 	return filter.save()
 }
 
+// Read the filter file and decompress its data if necessary
+func readFilterFile(fn string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if util.IsGzip(data) {
+		return util.Gunzip(data, 0)
+	}
+	return data, nil
+}
+
+// If "filters_compress" setting has been changed, convert the filter file to the current format
+// The modification time of the file is preserved, so the filter isn't considered updated.
+func (filter *filter) convertFile() error {
+	oldPath := filter.pathFormat(!config.DNS.FiltersCompress)
+	st, err := os.Stat(oldPath)
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Converting filter file %s", oldPath)
+	data, err := readFilterFile(oldPath)
+	if err != nil {
+		return err
+	}
+	f := filter.copyForUpdate()
+	f.Data = data
+	err = f.save()
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(filter.Path(), st.ModTime(), st.ModTime())
+}
+
 // loads filter contents from the file in dataDir
+// The data is decompressed only to count the rules - the decompressed data isn't kept in memory.
 func (filter *filter) load() error {
 	filterFilePath := filter.Path()
 	log.Tracef("Loading filter %d contents to: %s", filter.ID, filterFilePath)
 
 	if _, err := os.Stat(filterFilePath); os.IsNotExist(err) {
-		// do nothing, file doesn't exist
-		return err
+		err2 := filter.convertFile()
+		if err2 != nil {
+			// do nothing, file doesn't exist
+			return err
+		}
 	}
 
-	filterFileContents, err := ioutil.ReadFile(filterFilePath)
+	filterFileContents, err := readFilterFile(filterFilePath)
 	if err != nil {
 		return err
 	}
 
 	log.Tracef("File %s, id %d, length %d", filterFilePath, filter.ID, len(filterFileContents))
-	rulesCount, _ := parseFilterContents(filterFileContents)
+	rulesCount, _, expires := parseFilterContents(filterFileContents)
 
 	filter.RulesCount = rulesCount
+	filter.expires = expires
 	filter.Data = nil
 	filter.checksum = crc32.ChecksumIEEE(filterFileContents)
 	filter.LastUpdated = filter.LastTimeUpdated()
@@ -594,7 +1248,16 @@ func (filter *filter) unload() {
 
 // Path to the filter contents
 func (filter *filter) Path() string {
-	return filepath.Join(Context.getDataDir(), filterDir, strconv.FormatInt(filter.ID, 10)+".txt")
+	return filter.pathFormat(config.DNS.FiltersCompress)
+}
+
+// Path to the filter contents stored in the specified format
+func (filter *filter) pathFormat(compressed bool) string {
+	fn := strconv.FormatInt(filter.ID, 10) + ".txt"
+	if compressed {
+		fn += ".gz"
+	}
+	return filepath.Join(Context.getDataDir(), filterDir, fn)
 }
 
 // LastTimeUpdated returns the time when the filter was last time updated
@@ -635,6 +1298,7 @@ func enableFilters(async bool) {
 			f := dnsfilter.Filter{
 				ID:       filter.ID,
 				FilePath: filter.Path(),
+				Checksum: filter.checksum,
 			}
 			filters = append(filters, f)
 		}
@@ -645,6 +1309,7 @@ func enableFilters(async bool) {
 			f := dnsfilter.Filter{
 				ID:       filter.ID,
 				FilePath: filter.Path(),
+				Checksum: filter.checksum,
 			}
 			whiteFilters = append(whiteFilters, f)
 		}
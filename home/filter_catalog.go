@@ -0,0 +1,285 @@
+package home
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// How long the downloaded catalog is kept in memory
+const catalogCacheTime = 24 * time.Hour
+
+// Maximum size of the catalog index file
+const catalogMaxSize = 4 * 1024 * 1024
+
+// The catalog published by AdGuard and the key which its index is signed with
+const (
+	catalogDefaultURL       = "https://static.adguard.com/adguardhome/filters/catalog.json"
+	catalogDefaultPublicKey = "rlecIsBCmSJcweTN/CXTomXSkXFNDhiFtS4cvOHZfOU="
+)
+
+type filtersCatalogConfig struct {
+	// URL of the JSON index of known filter lists.  If empty, the catalog is disabled.
+	URL string `yaml:"url"`
+
+	// Base64-encoded Ed25519 public key.
+	// If set, the index must be signed: the signature is downloaded from URL + ".sig".
+	// If it's empty, the index isn't verified, unless it's the default catalog: its key is always used.
+	PublicKey string `yaml:"public_key"`
+}
+
+// An entry in the filters catalog
+type catalogFilter struct {
+	ID              string   `json:"id"`
+	Name            string   `json:"name"`
+	URL             string   `json:"url"`
+	Homepage        string   `json:"homepage,omitempty"`
+	Categories      []string `json:"categories"`
+	Languages       []string `json:"languages"`
+	UpdateFrequency uint32   `json:"update_frequency"` // the expected period of updates (in hours)
+}
+
+type catalogIndex struct {
+	Filters []catalogFilter `json:"filters"`
+}
+
+// The catalog of known filter lists
+type filtersCatalog struct {
+	lock       sync.Mutex
+	filters    []catalogFilter
+	conf       filtersCatalogConfig // the settings which the filters were downloaded with
+	lastUpdate time.Time
+}
+
+// Get the list of filters from the catalog
+// The index is downloaded if it's not in cache yet, or it has expired, or force is set.
+func (c *filtersCatalog) get(force bool) ([]catalogFilter, error) {
+	config.RLock()
+	conf := config.FiltersCatalog
+	config.RUnlock()
+	if len(conf.URL) == 0 {
+		return nil, fmt.Errorf("filters catalog is disabled")
+	}
+	if conf.URL == catalogDefaultURL && len(conf.PublicKey) == 0 {
+		conf.PublicKey = catalogDefaultPublicKey
+	}
+
+	// the data downloaded with other settings (e.g. without a key) isn't used
+	c.lock.Lock()
+	filters := c.filters
+	cached := filters != nil && c.conf == conf
+	fresh := cached && time.Since(c.lastUpdate) < catalogCacheTime
+	c.lock.Unlock()
+	if !force && fresh {
+		return filters, nil
+	}
+
+	// the lock isn't held during the download, so the other requests use the old data meanwhile
+	newFilters, err := downloadCatalog(conf)
+	if err != nil {
+		if cached {
+			log.Info("filters catalog: %s.  Using the old data", err)
+			return filters, nil
+		}
+		return nil, err
+	}
+
+	c.lock.Lock()
+	c.filters = newFilters
+	c.conf = conf
+	c.lastUpdate = time.Now()
+	c.lock.Unlock()
+	return newFilters, nil
+}
+
+// Find a catalog entry by its ID
+func (c *filtersCatalog) find(id string) (catalogFilter, error) {
+	filters, err := c.get(false)
+	if err != nil {
+		return catalogFilter{}, err
+	}
+	for _, f := range filters {
+		if f.ID == id {
+			return f, nil
+		}
+	}
+	return catalogFilter{}, fmt.Errorf("filter %s is not found in catalog", id)
+}
+
+func downloadFile(url string, maxSize int64) ([]byte, error) {
+	resp, err := Context.client.Get(url)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s: got status code != 200: %d", url, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", url, err)
+	}
+	if int64(len(body)) > maxSize {
+		return nil, fmt.Errorf("%s: file is too large", url)
+	}
+	return body, nil
+}
+
+// Download the catalog index, verify its signature and parse it
+func downloadCatalog(conf filtersCatalogConfig) ([]catalogFilter, error) {
+	log.Debug("filters catalog: downloading %s", conf.URL)
+	body, err := downloadFile(conf.URL, catalogMaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(conf.PublicKey) != 0 {
+		sig, err := downloadFile(conf.URL+".sig", 1024)
+		if err != nil {
+			return nil, err
+		}
+		err = verifyCatalogSignature(body, sig, conf.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return parseCatalog(body)
+}
+
+// Verify Ed25519 signature of the data
+// sig: base64-encoded signature
+// pubkey: base64-encoded public key
+func verifyCatalogSignature(data, sig []byte, pubkey string) error {
+	key, err := base64.StdEncoding.DecodeString(pubkey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key")
+	}
+
+	sigData, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(key), data, sigData) {
+		return fmt.Errorf("signature verification failed")
+	}
+	return nil
+}
+
+// Parse the catalog index
+// Invalid entries are skipped.
+func parseCatalog(data []byte) ([]catalogFilter, error) {
+	idx := catalogIndex{}
+	err := json.Unmarshal(data, &idx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid catalog index: %s", err)
+	}
+
+	filters := []catalogFilter{}
+	ids := map[string]bool{}
+	for _, f := range idx.Filters {
+		if len(f.ID) == 0 || ids[f.ID] || len(f.Name) == 0 || !isValidFilterURL(f.URL) || filterLocalPath(f.URL) != "" {
+			log.Debug("filters catalog: skipping invalid entry %s (%s)", f.ID, f.URL)
+			continue
+		}
+		ids[f.ID] = true
+		if f.Categories == nil {
+			f.Categories = []string{}
+		}
+		if f.Languages == nil {
+			f.Languages = []string{}
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// Get the sorted list of categories
+func catalogCategories(filters []catalogFilter) []string {
+	m := map[string]bool{}
+	for _, f := range filters {
+		for _, c := range f.Categories {
+			m[c] = true
+		}
+	}
+	cats := []string{}
+	for c := range m {
+		cats = append(cats, c)
+	}
+	sort.Strings(cats)
+	return cats
+}
+
+type catalogFilterJSON struct {
+	catalogFilter
+	Added bool `json:"added"` // the filter with this URL is already added
+}
+
+type catalogJSON struct {
+	Categories []string            `json:"categories"`
+	Filters    []catalogFilterJSON `json:"filters"`
+}
+
+// Get the filters catalog
+// Parameters:
+// . category: return only the filters of this category
+// . language: return only the filters for this language
+// . refresh=true: download the catalog even if it's cached
+func handleFilteringCatalog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filters, err := Context.filtersCatalog.get(q.Get("refresh") == "true")
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't get filters catalog: %s", err)
+		return
+	}
+
+	category := q.Get("category")
+	lang := q.Get("language")
+	resp := catalogJSON{}
+	resp.Categories = catalogCategories(filters)
+	resp.Filters = []catalogFilterJSON{}
+	for _, f := range filters {
+		if len(category) != 0 && !hasString(f.Categories, category) {
+			continue
+		}
+		if len(lang) != 0 && !hasString(f.Languages, lang) {
+			continue
+		}
+		resp.Filters = append(resp.Filters, catalogFilterJSON{
+			catalogFilter: f,
+			Added:         filterExists(f.URL),
+		})
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// Return TRUE if the array contains the string
+func hasString(ar []string, s string) bool {
+	for _, a := range ar {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package home
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testCatalog = `{"filters":[
+	{"id":"adguard_dns","name":"AdGuard DNS filter","url":"https://example.org/1.txt","categories":["ads"],"languages":["en"],"update_frequency":24},
+	{"id":"fr","name":"French list","url":"https://example.org/2.txt","categories":["ads","regional"],"languages":["fr"]},
+	{"id":"fr","name":"Duplicate","url":"https://example.org/3.txt"},
+	{"id":"local","name":"Local file","url":"/etc/hosts"},
+	{"id":"","name":"No ID","url":"https://example.org/4.txt"}
+]}`
+
+func TestParseCatalog(t *testing.T) {
+	filters, err := parseCatalog([]byte(testCatalog))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(filters))
+	assert.Equal(t, "adguard_dns", filters[0].ID)
+	assert.Equal(t, uint32(24), filters[0].UpdateFrequency)
+	assert.Equal(t, []string{"ads", "regional"}, catalogCategories(filters))
+
+	_, err = parseCatalog([]byte("not json"))
+	assert.NotNil(t, err)
+}
+
+func TestCatalogSignature(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	sig := ed25519.Sign(priv, []byte(testCatalog))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/catalog.json":
+			_, _ = w.Write([]byte(testCatalog))
+		case "/catalog.json.sig":
+			_, _ = w.Write([]byte(base64.StdEncoding.EncodeToString(sig) + "\n"))
+		case "/bad.json":
+			_, _ = w.Write([]byte(testCatalog + " "))
+		case "/bad.json.sig":
+			_, _ = w.Write([]byte(base64.StdEncoding.EncodeToString(sig)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	Context = homeContext{}
+	Context.client = &http.Client{
+		Timeout: time.Minute * 5,
+	}
+
+	conf := filtersCatalogConfig{
+		URL:       srv.URL + "/catalog.json",
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+	}
+	filters, err := downloadCatalog(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(filters))
+
+	// data doesn't match the signature
+	conf.URL = srv.URL + "/bad.json"
+	_, err = downloadCatalog(conf)
+	assert.NotNil(t, err)
+
+	// signature verification is disabled
+	conf.PublicKey = ""
+	_, err = downloadCatalog(conf)
+	assert.Nil(t, err)
+
+	// the catalog handler
+	config.FiltersCatalog = filtersCatalogConfig{URL: srv.URL + "/catalog.json"}
+	defer func() { config.FiltersCatalog = filtersCatalogConfig{} }()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/control/filtering/catalog?language=fr", nil)
+	handleFilteringCatalog(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), `"id":"fr"`))
+	assert.False(t, strings.Contains(w.Body.String(), `"id":"adguard_dns"`))
+
+	f, err := Context.filtersCatalog.find("adguard_dns")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://example.org/1.txt", f.URL)
+	_, err = Context.filtersCatalog.find("unknown")
+	assert.NotNil(t, err)
+
+	// the data downloaded without the key isn't used when the key is set
+	config.FiltersCatalog.URL = srv.URL + "/bad.json"
+	_, err = Context.filtersCatalog.get(false)
+	assert.Nil(t, err)
+	config.FiltersCatalog.PublicKey = base64.StdEncoding.EncodeToString(pub)
+	_, err = Context.filtersCatalog.get(false)
+	assert.NotNil(t, err)
+
+	// the default key is valid
+	key, err := base64.StdEncoding.DecodeString(catalogDefaultPublicKey)
+	assert.Nil(t, err)
+	assert.Equal(t, ed25519.PublicKeySize, len(key))
+}
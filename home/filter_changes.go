@@ -0,0 +1,157 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	maxFilterChanges = 10   // the number of changes stored for a filter
+	maxChangeRules   = 1000 // the maximum number of added (or removed) rules stored for a change
+)
+
+// The changes in filter data made by an update
+type filterChange struct {
+	Time    time.Time `json:"time"`
+	Added   int       `json:"added"`   // the number of added rules
+	Removed int       `json:"removed"` // the number of removed rules
+
+	// Added and removed rules (no more than maxChangeRules items).
+	// They're stored only if "filters_changes_full" setting is enabled.
+	AddedRules   []string `json:"added_rules,omitempty"`
+	RemovedRules []string `json:"removed_rules,omitempty"`
+}
+
+// Get the set of rules from filter data
+func filterRuleSet(data []byte) map[string]bool {
+	set := map[string]bool{}
+	s := string(data)
+	for len(s) != 0 {
+		line := strings.TrimSpace(util.SplitNext(&s, '\n'))
+		if len(line) == 0 || isFilterComment(line) {
+			continue
+		}
+		set[line] = true
+	}
+	return set
+}
+
+// Return the rules from "a" that aren't present in "b"
+// The number of the rules returned in the list is limited by maxChangeRules.
+func filterRulesDiff(a, b map[string]bool, full bool) (int, []string) {
+	n := 0
+	var list []string
+	for r := range a {
+		if b[r] {
+			continue
+		}
+		n++
+		if full && len(list) < maxChangeRules {
+			list = append(list, r)
+		}
+	}
+	sort.Strings(list)
+	return n, list
+}
+
+// Compare the old and the new filter data
+// full: store the lists of added and removed rules
+func diffFilterData(oldData, newData []byte, full bool) filterChange {
+	oldSet := filterRuleSet(oldData)
+	newSet := filterRuleSet(newData)
+	ch := filterChange{}
+	ch.Added, ch.AddedRules = filterRulesDiff(newSet, oldSet, full)
+	ch.Removed, ch.RemovedRules = filterRulesDiff(oldSet, newSet, full)
+	return ch
+}
+
+// Compare the new filter data with the previous version (which is stored in .old file)
+func (filter *filter) diffWithOld() filterChange {
+	oldData, err := readFilterFile(filter.Path() + ".old")
+	if err != nil && !os.IsNotExist(err) {
+		log.Debug("Filters: couldn't read the previous version of filter %d: %s", filter.ID, err)
+	}
+	ch := diffFilterData(oldData, filter.Data, config.DNS.FiltersChangesFull)
+	ch.Time = filter.LastUpdated
+	return ch
+}
+
+// Store the change (the oldest changes are removed)
+func (filter *filter) addChange(ch filterChange) {
+	filter.changes = append(filter.changes, ch)
+	if len(filter.changes) > maxFilterChanges {
+		filter.changes = filter.changes[len(filter.changes)-maxFilterChanges:]
+	}
+}
+
+type filterChangesJSON struct {
+	ID        int64          `json:"id"`
+	Name      string         `json:"name"`
+	URL       string         `json:"url"`
+	Whitelist bool           `json:"whitelist"`
+	Changes   []filterChange `json:"changes"` // the newest changes go first
+}
+
+func filterToChangesJSON(f filter, whitelist bool) filterChangesJSON {
+	fj := filterChangesJSON{
+		ID:        f.ID,
+		Name:      f.Name,
+		URL:       f.URL,
+		Whitelist: whitelist,
+		Changes:   []filterChange{},
+	}
+	for i := len(f.changes) - 1; i >= 0; i-- {
+		fj.Changes = append(fj.Changes, f.changes[i])
+	}
+	return fj
+}
+
+// Get the recent changes of filters
+// "id" parameter (optional) selects a single filter
+func handleFilteringChanges(w http.ResponseWriter, r *http.Request) {
+	var id int64
+	s := r.URL.Query().Get("id")
+	if len(s) != 0 {
+		var err error
+		id, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "invalid filter ID: %s", s)
+			return
+		}
+	}
+
+	resp := []filterChangesJSON{}
+	config.RLock()
+	for _, f := range config.Filters {
+		if id == 0 || f.ID == id {
+			resp = append(resp, filterToChangesJSON(f, false))
+		}
+	}
+	for _, f := range config.WhitelistFilters {
+		if id == 0 || f.ID == id {
+			resp = append(resp, filterToChangesJSON(f, true))
+		}
+	}
+	config.RUnlock()
+
+	if id != 0 && len(resp) == 0 {
+		httpError(w, http.StatusBadRequest, "filter not found")
+		return
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
@@ -0,0 +1,111 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffFilterData(t *testing.T) {
+	oldData := []byte("! Title: test\n||example.org^\n||example.com^\n")
+	newData := []byte("! Title: test 2\n||example.org^\n||example.net^\n||example.info^\n")
+
+	ch := diffFilterData(oldData, newData, false)
+	assert.Equal(t, 2, ch.Added)
+	assert.Equal(t, 1, ch.Removed)
+	assert.Nil(t, ch.AddedRules)
+	assert.Nil(t, ch.RemovedRules)
+
+	ch = diffFilterData(oldData, newData, true)
+	assert.Equal(t, []string{"||example.info^", "||example.net^"}, ch.AddedRules)
+	assert.Equal(t, []string{"||example.com^"}, ch.RemovedRules)
+
+	// no previous version
+	ch = diffFilterData(nil, newData, false)
+	assert.Equal(t, 3, ch.Added)
+	assert.Equal(t, 0, ch.Removed)
+
+	f := filter{}
+	for i := 0; i != maxFilterChanges+2; i++ {
+		f.addChange(filterChange{Added: i})
+	}
+	assert.Equal(t, maxFilterChanges, len(f.changes))
+	assert.Equal(t, 2, f.changes[0].Added)
+	assert.Equal(t, maxFilterChanges+1, f.changes[maxFilterChanges-1].Added)
+}
+
+func TestFilterChanges(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	data := "||example.org^\n||example.com^\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(data))
+	}))
+	defer srv.Close()
+
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	Context.client = &http.Client{
+		Timeout: time.Minute * 5,
+	}
+	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0755)
+	config.Filters = []filter{{Enabled: true, URL: srv.URL + "/1", Filter: dnsfilter.Filter{ID: 1}}}
+	config.WhitelistFilters = []filter{{Enabled: true, URL: srv.URL + "/2", Filter: dnsfilter.Filter{ID: 2}}}
+	config.DNS.FiltersChangesFull = true
+	defer func() {
+		config.Filters = nil
+		config.WhitelistFilters = nil
+		config.DNS.FiltersChangesFull = false
+	}()
+
+	n, _, _, _ := refreshFiltersArray(&config.Filters, true)
+	assert.Equal(t, 1, n)
+	data = "||example.org^\n||example.net^\n"
+	n, _, _, _ = refreshFiltersArray(&config.Filters, true)
+	assert.Equal(t, 1, n)
+
+	// the previous version is kept
+	_, err := os.Stat(config.Filters[0].Path() + ".old")
+	assert.Nil(t, err)
+
+	// not changed
+	n, _, _, _ = refreshFiltersArray(&config.Filters, true)
+	assert.Equal(t, 0, n)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/control/filtering/changes?id=1", nil)
+	handleFilteringChanges(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := []filterChangesJSON{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 1, len(resp))
+	assert.Equal(t, 2, len(resp[0].Changes))
+	ch := resp[0].Changes[0]
+	assert.Equal(t, 1, ch.Added)
+	assert.Equal(t, 1, ch.Removed)
+	assert.Equal(t, []string{"||example.net^"}, ch.AddedRules)
+	assert.Equal(t, []string{"||example.com^"}, ch.RemovedRules)
+	assert.Equal(t, 2, resp[0].Changes[1].Added)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/control/filtering/changes", nil)
+	handleFilteringChanges(w, r)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 2, len(resp))
+	assert.True(t, resp[1].Whitelist)
+	assert.Equal(t, 0, len(resp[1].Changes))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/control/filtering/changes?id=3", nil)
+	handleFilteringChanges(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
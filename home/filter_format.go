@@ -0,0 +1,282 @@
+package home
+
+import (
+	"net"
+	"strings"
+	"unicode"
+
+	"github.com/AdguardTeam/AdGuardHome/util"
+)
+
+// Supported formats of filter lists
+const (
+	filterFormatAdblock = "adblock" // adblock-style rules (||example.org^)
+	filterFormatHosts   = "hosts"   // /etc/hosts format (0.0.0.0 example.org)
+	filterFormatDnsmasq = "dnsmasq" // dnsmasq configuration (address=/example.org/0.0.0.0)
+	filterFormatDomains = "domains" // plain list of domain names (example.org)
+)
+
+// Host names that are commonly present in hosts files, but must never be blocked
+var hostsSystemNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// Return TRUE if the line is a comment
+func isFilterComment(line string) bool {
+	return line[0] == '!' || line[0] == '#'
+}
+
+// Return TRUE if the string is a valid domain name with at least 2 labels
+func isValidDomainName(s string) bool {
+	if len(s) == 0 || len(s) > 253 || strings.IndexByte(s, '.') == -1 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if len(label) == 0 || len(label) > 63 ||
+			label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+				c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return net.ParseIP(s) == nil
+}
+
+// Parse a line in hosts format
+// Return IP address and host names, or nil if the line has a different format
+func parseHostsLine(line string) (net.IP, []string) {
+	i := strings.IndexByte(line, '#')
+	if i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, nil
+	}
+	ip := net.ParseIP(fields[0])
+	if ip == nil {
+		return nil, nil
+	}
+	return ip, fields[1:]
+}
+
+// Parse a line in dnsmasq format
+// "address=/host1/host2/ip" or "server=/host1/host2/ip"
+// Return the directive name, host names and the value, or an empty directive name if the line has a different format
+func parseDnsmasqLine(line string) (string, []string, string) {
+	i := strings.Index(line, "=/")
+	if i == -1 {
+		return "", nil, ""
+	}
+	directive := line[:i]
+	if directive != "address" && directive != "server" {
+		return "", nil, ""
+	}
+	parts := strings.Split(line[i+2:], "/")
+	if len(parts) < 2 {
+		return "", nil, ""
+	}
+	return directive, parts[:len(parts)-1], parts[len(parts)-1]
+}
+
+// Detect the format of filter data
+// The format that is used by the majority of rules wins.  If there's no such format, adblock format is assumed.
+func detectFilterFormat(data []byte) string {
+	s := string(data)
+	n := 0
+	counts := map[string]int{}
+	for len(s) != 0 {
+		line := strings.TrimSpace(util.SplitNext(&s, '\n'))
+		if len(line) == 0 || isFilterComment(line) {
+			continue
+		}
+		n++
+
+		if ip, _ := parseHostsLine(line); ip != nil {
+			counts[filterFormatHosts]++
+		} else if d, _, _ := parseDnsmasqLine(line); len(d) != 0 {
+			counts[filterFormatDnsmasq]++
+		} else if isValidDomainName(util.ToPunycode(line)) {
+			counts[filterFormatDomains]++
+		}
+	}
+
+	for _, f := range []string{filterFormatHosts, filterFormatDnsmasq, filterFormatDomains} {
+		if counts[f]*2 > n {
+			return f
+		}
+	}
+	return filterFormatAdblock
+}
+
+// Convert filter data of the specified format so it can be used by the rule engine
+// Comments and the lines which have a different format are left as is.
+// Internationalized domain names are converted to punycode.
+func normalizeFilterContents(data []byte, format string) []byte {
+	conv := filterLineConverter(format)
+	if conv == nil {
+		if util.IsASCII(string(data)) {
+			return data
+		}
+		conv = func(line string) []string { return []string{line} }
+	}
+
+	s := string(data)
+	out := strings.Builder{}
+	out.Grow(len(s))
+	for len(s) != 0 {
+		line := strings.TrimSpace(util.SplitNext(&s, '\n'))
+		if len(line) == 0 || isFilterComment(line) {
+			out.WriteString(line)
+			out.WriteByte('\n')
+			continue
+		}
+		for _, r := range conv(ruleToPunycode(line)) {
+			out.WriteString(r)
+			out.WriteByte('\n')
+		}
+	}
+	return []byte(out.String())
+}
+
+// Convert internationalized domain names in a rule to punycode, so that the rule matches DNS queries:
+// "||пример.рф^" -> "||xn--e1afmkfd.xn--p1ai^"
+// The modifiers are left as is (e.g. they may contain client names), except the domains of $denyallow.
+// Regular expressions and comments aren't converted.
+func ruleToPunycode(text string) string {
+	if util.IsASCII(text) || isFilterComment(text) {
+		return text
+	}
+
+	pattern := text
+	modifiers := ""
+	i := strings.IndexByte(text, '$')
+	if i != -1 {
+		pattern = text[:i]
+		modifiers = text[i:]
+	}
+	if strings.HasPrefix(strings.TrimPrefix(pattern, "@@"), "/") {
+		return text
+	}
+
+	const denyallow = "denyallow="
+	i = strings.Index(modifiers, denyallow)
+	if i != -1 {
+		i += len(denyallow)
+		n := strings.IndexByte(modifiers[i:], ',')
+		if n == -1 {
+			n = len(modifiers) - i
+		}
+		modifiers = modifiers[:i] + hostsToPunycode(modifiers[i:i+n]) + modifiers[i+n:]
+	}
+	return hostsToPunycode(pattern) + modifiers
+}
+
+// Convert the host names in a text to punycode
+// A host name is a sequence of letters, digits, '-' and '.' characters.
+func hostsToPunycode(s string) string {
+	out := strings.Builder{}
+	start := -1
+	for i, c := range s + " " {
+		isHostChar := unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.Is(unicode.Mn, c) || c == '-' || c == '.'
+		if isHostChar {
+			if start == -1 {
+				start = i
+			}
+			continue
+		}
+		if start != -1 {
+			out.WriteString(util.ToPunycode(s[start:i]))
+			start = -1
+		}
+		if i != len(s) {
+			out.WriteRune(c)
+		}
+	}
+	return out.String()
+}
+
+// Get the function that converts a line of the specified format to the rules in adblock format
+// Return nil if no conversion is required.
+func filterLineConverter(format string) func(line string) []string {
+	switch format {
+	case filterFormatHosts:
+		return normalizeHostsLine
+	case filterFormatDnsmasq:
+		return normalizeDnsmasqLine
+	case filterFormatDomains:
+		return normalizeDomainLine
+	}
+	return nil
+}
+
+// "0.0.0.0 host1 host2 # comment" -> "0.0.0.0 host1 host2"
+// System host names (e.g. "localhost") are removed.
+func normalizeHostsLine(line string) []string {
+	ip, hosts := parseHostsLine(line)
+	if ip == nil {
+		return []string{line}
+	}
+
+	rule := ip.String()
+	for _, h := range hosts {
+		if hostsSystemNames[strings.ToLower(h)] || net.ParseIP(h) != nil {
+			continue
+		}
+		rule += " " + h
+	}
+	if len(rule) == len(ip.String()) {
+		return nil
+	}
+	return []string{rule}
+}
+
+// "address=/host1/host2/0.0.0.0" -> "||host1^", "||host2^"
+// "address=/host/1.2.3.4" -> "1.2.3.4 host"
+// "server=/..." directives have nothing to do with blocking, so they are removed.
+func normalizeDnsmasqLine(line string) []string {
+	d, hosts, val := parseDnsmasqLine(line)
+	if len(d) == 0 {
+		return []string{line}
+	}
+	if d != "address" {
+		return nil
+	}
+
+	ip := net.ParseIP(val)
+	blocking := ip == nil || ip.IsUnspecified() || ip.IsLoopback()
+	rules := []string{}
+	for _, h := range hosts {
+		if !isValidDomainName(h) {
+			continue
+		}
+		if blocking {
+			rules = append(rules, "||"+h+"^")
+		} else {
+			rules = append(rules, ip.String()+" "+h)
+		}
+	}
+	return rules
+}
+
+// "host" -> "||host^"
+func normalizeDomainLine(line string) []string {
+	if !isValidDomainName(line) {
+		return []string{line}
+	}
+	return []string{"||" + line + "^"}
+}
@@ -0,0 +1,87 @@
+package home
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectFilterFormat(t *testing.T) {
+	assert.Equal(t, filterFormatAdblock, detectFilterFormat([]byte("! Title: test\n||example.org^\n||example.com^\n")))
+	assert.Equal(t, filterFormatHosts, detectFilterFormat([]byte("# hosts\n127.0.0.1 localhost\n0.0.0.0 example.org\n::1 example.com\n")))
+	assert.Equal(t, filterFormatDnsmasq, detectFilterFormat([]byte("# dnsmasq\naddress=/example.org/0.0.0.0\naddress=/example.com/\n")))
+	assert.Equal(t, filterFormatDomains, detectFilterFormat([]byte("# domains\nexample.org\nsub.example.com\n")))
+
+	// no format has the majority of rules
+	assert.Equal(t, filterFormatAdblock, detectFilterFormat([]byte("||example.org^\n0.0.0.0 example.com\nexample.net\n")))
+	assert.Equal(t, filterFormatAdblock, detectFilterFormat([]byte("")))
+}
+
+func TestNormalizeFilterContents(t *testing.T) {
+	data := []byte("||example.org^\n")
+	assert.Equal(t, data, normalizeFilterContents(data, filterFormatAdblock))
+
+	data = []byte("# comment\n127.0.0.1 localhost\n0.0.0.0 0.0.0.0\n0.0.0.0 example.org  # ads\n  0.0.0.0\tads.example.com tracker.example.com\n||example.net^\n")
+	assert.Equal(t, "# comment\n0.0.0.0 example.org\n0.0.0.0 ads.example.com tracker.example.com\n||example.net^\n",
+		string(normalizeFilterContents(data, filterFormatHosts)))
+
+	data = []byte("# comment\naddress=/example.org/0.0.0.0\naddress=/ads.example.com/tracker.example.com/\naddress=/example.net/1.2.3.4\nserver=/example.com/8.8.8.8\n")
+	assert.Equal(t, "# comment\n||example.org^\n||ads.example.com^\n||tracker.example.com^\n1.2.3.4 example.net\n",
+		string(normalizeFilterContents(data, filterFormatDnsmasq)))
+
+	data = []byte("! comment\nexample.org\nsub.example.com\n\n||example.net^\n")
+	assert.Equal(t, "! comment\n||example.org^\n||sub.example.com^\n\n||example.net^\n",
+		string(normalizeFilterContents(data, filterFormatDomains)))
+
+	// internationalized domain names
+	data = []byte("! пример\n||пример.рф^\n")
+	assert.Equal(t, "! пример\n||xn--e1afmkfd.xn--p1ai^\n", string(normalizeFilterContents(data, filterFormatAdblock)))
+	data = []byte("пример.рф\nexample.org\n")
+	assert.Equal(t, filterFormatDomains, detectFilterFormat(data))
+	assert.Equal(t, "||xn--e1afmkfd.xn--p1ai^\n||example.org^\n", string(normalizeFilterContents(data, filterFormatDomains)))
+	data = []byte("0.0.0.0 пример.рф bücher.de\n")
+	assert.Equal(t, "0.0.0.0 xn--e1afmkfd.xn--p1ai xn--bcher-kva.de\n", string(normalizeFilterContents(data, filterFormatHosts)))
+}
+
+func TestRuleToPunycode(t *testing.T) {
+	assert.Equal(t, "||example.org^", ruleToPunycode("||example.org^"))
+	assert.Equal(t, "@@||xn--e1afmkfd.xn--p1ai^$important", ruleToPunycode("@@||ПРИМЕР.рф^$important"))
+	assert.Equal(t, "*.xn--e1afmkfd.xn--p1ai", ruleToPunycode("*.пример.рф"))
+	assert.Equal(t, "||xn--p1ai^$denyallow=xn--e1afmkfd.xn--p1ai|example.org,client='Мой телефон'",
+		ruleToPunycode("||рф^$denyallow=пример.рф|example.org,client='Мой телефон'"))
+	assert.Equal(t, "/пример\\.рф/", ruleToPunycode("/пример\\.рф/"))
+	assert.Equal(t, "! пример.рф", ruleToPunycode("! пример.рф"))
+	assert.Equal(t, "127.0.0.1 xn--e1afmkfd.xn--p1ai", ruleToPunycode("127.0.0.1 пример.рф"))
+
+	// the user rules are stored as written, but the engine gets them converted
+	assert.Equal(t, "||xn--e1afmkfd.xn--p1ai^", userRulesData([]userRule{{Text: "||пример.рф^", Enabled: true}}))
+}
+
+func TestIsValidDomainName(t *testing.T) {
+	assert.True(t, isValidDomainName("example.org"))
+	assert.True(t, isValidDomainName("a-b_c.example.org"))
+	assert.False(t, isValidDomainName("localhost"))
+	assert.False(t, isValidDomainName("1.2.3.4"))
+	assert.False(t, isValidDomainName("-example.org"))
+	assert.False(t, isValidDomainName("example..org"))
+	assert.False(t, isValidDomainName("||example.org^"))
+}
+
+func TestValidateFilterContents(t *testing.T) {
+	data := []byte("! comment\n||example.org^\n||example.com^$unknown_modifier\n\n0.0.0.0 example.net\n||example.org^$domain=\n")
+	n, nInvalid, invalid := validateFilterContents(data, filterFormatAdblock, 1)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 2, nInvalid)
+	assert.Equal(t, 2, len(invalid))
+	assert.Equal(t, 3, invalid[0].Line)
+	assert.Equal(t, "||example.com^$unknown_modifier", invalid[0].Text)
+	assert.NotEqual(t, "", invalid[0].Error)
+	assert.Equal(t, 6, invalid[1].Line)
+
+	// line numbers refer to the source data
+	data = []byte("# comment\naddress=/example.org/ads.example.org/\nserver=/example.com/8.8.8.8\n|example.net^$bad\n")
+	n, nInvalid, invalid = validateFilterContents(data, filterFormatDnsmasq, 1)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 1, nInvalid)
+	assert.Equal(t, 4, invalid[0].Line)
+}
@@ -0,0 +1,102 @@
+// Download of filter data: retries with exponential backoff and alternate URLs (mirrors)
+
+package home
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// The maximum number of download attempts for each URL
+const filterDownloadAttempts = 3
+
+// The delay before the first retry.  It's doubled for each next retry.
+var filterRetryDelay = 1 * time.Second
+
+// HTTP response with a status code other than 200 and 304
+type statusError int
+
+func (code statusError) Error() string {
+	return fmt.Sprintf("got status code != 200: %d", int(code))
+}
+
+// Return TRUE if the download may succeed when it's retried:
+// network errors, server errors (5xx), "Request Timeout" (408) and "Too Many Requests" (429)
+func isTransientError(err error) bool {
+	var code statusError
+	if errors.As(err, &code) {
+		return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+	}
+
+	// url.Error implements net.Error even if the request couldn't be sent at all (e.g. unsupported scheme)
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		err = uerr.Err
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) || err == io.ErrUnexpectedEOF
+}
+
+// Get the URL the current ETag and Last-Modified values were received from
+func (filter *filter) cacheSource() string {
+	if len(filter.LastMirror) != 0 {
+		return filter.LastMirror
+	}
+	return filter.URL
+}
+
+// Download filter data from the URL.  Transient errors are retried with exponential backoff.
+func (filter *filter) downloadRetry(u string) ([]byte, http.Header, error) {
+	delay := filterRetryDelay
+	for i := 1; ; i++ {
+		body, hdr, err := filter.download(u)
+		if err == nil || i == filterDownloadAttempts || !isTransientError(err) {
+			return body, hdr, err
+		}
+		log.Debug("filter #%d: download attempt %d from %s failed: %s.  Retrying in %s", filter.ID, i, u, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Download filter data from the main URL or, if it fails, from the mirrors
+// Return the URL the data was received from
+// Return an error only if all URLs have failed
+func (filter *filter) downloadMirrors() ([]byte, http.Header, string, error) {
+	urls := []string{filter.URL}
+	for _, m := range filter.Mirrors {
+		if filterLocalPath(m) != "" || !IsValidURL(m) {
+			log.Info("filter #%d: invalid mirror URL %q, skipping", filter.ID, m)
+			continue
+		}
+		urls = append(urls, m)
+	}
+
+	var err error
+	errs := []string{}
+	for i, u := range urls {
+		var body []byte
+		var hdr http.Header
+		body, hdr, err = filter.downloadRetry(u)
+		if err == nil {
+			if i != 0 {
+				log.Info("filter #%d: downloaded from mirror %s", filter.ID, u)
+			}
+			return body, hdr, u, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", u, err))
+	}
+
+	if len(urls) == 1 {
+		return nil, nil, "", err
+	}
+	return nil, nil, "", fmt.Errorf("all %d URLs have failed: %s", len(urls), strings.Join(errs, "; "))
+}
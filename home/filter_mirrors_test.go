@@ -0,0 +1,106 @@
+package home
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransientError(t *testing.T) {
+	assert.True(t, isTransientError(statusError(503)))
+	assert.True(t, isTransientError(statusError(http.StatusTooManyRequests)))
+	assert.False(t, isTransientError(statusError(404)))
+	assert.True(t, isTransientError(io.ErrUnexpectedEOF))
+	assert.True(t, isTransientError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.False(t, isTransientError(errors.New("Data is too large")))
+
+	_, err := http.Get("unknown://example.org/")
+	assert.NotNil(t, err)
+	assert.False(t, isTransientError(err))
+}
+
+func TestFilterMirrors(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	delay := filterRetryDelay
+	filterRetryDelay = time.Millisecond
+	defer func() { filterRetryDelay = delay }()
+
+	// the main URL fails, the first mirror doesn't have the file, the second mirror fails once
+	var nMain, nMirror1, nMirror2 int
+	mainOK := false
+	var mainReq *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/main.txt":
+			nMain++
+			mainReq = r
+			if !mainOK {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/mirror1.txt":
+			nMirror1++
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case "/mirror2.txt":
+			nMirror2++
+			if nMirror2 == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Header().Set("ETag", `"mirror2"`)
+		}
+		_, _ = w.Write([]byte("||example.org^\n"))
+	}))
+	defer srv.Close()
+
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.client = &http.Client{
+		Timeout: time.Minute * 5,
+	}
+	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0755)
+
+	f := filter{
+		URL:     srv.URL + "/main.txt",
+		Mirrors: []string{"/local/path", srv.URL + "/mirror1.txt", srv.URL + "/mirror2.txt"},
+		Filter:  dnsfilter.Filter{ID: 1},
+	}
+	ok, err := f.update()
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, filterDownloadAttempts, nMain)
+	assert.Equal(t, 1, nMirror1)
+	assert.Equal(t, 2, nMirror2)
+	assert.Equal(t, srv.URL+"/mirror2.txt", f.LastMirror)
+	assert.Equal(t, `"mirror2"`, f.ETag)
+	assert.Equal(t, f.LastMirror, filterToJSON(f).LastMirror)
+
+	// the main URL is tried first, but the conditional request is sent only to the mirror
+	mainOK = true
+	ok, err = f.update()
+	assert.True(t, !ok && err == nil)
+	assert.Equal(t, "", mainReq.Header.Get("If-None-Match"))
+	assert.Equal(t, "", f.LastMirror)
+	assert.Equal(t, "", f.ETag)
+
+	// all URLs have failed
+	mainOK = false
+	nMirror2 = 0
+	f.Mirrors = f.Mirrors[1:2]
+	_, err = f.update()
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "all 2 URLs have failed"))
+	assert.True(t, strings.Contains(err.Error(), "503"))
+	assert.Equal(t, 0, nMirror2)
+}
@@ -0,0 +1,171 @@
+// Filtering engine profiling: match latency per filter list and memory usage
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	benchmarkMaxMatches     = 10000 // max number of hosts * iterations
+	benchmarkRandomHosts    = 100   // the number of random host names if the names aren't specified
+	benchmarkDefaultRepeats = 10
+)
+
+type listProfileJSON struct {
+	ID          int64   `json:"id"`
+	Name        string  `json:"name"` // empty for user rules
+	Whitelist   bool    `json:"whitelist"`
+	RulesCount  int     `json:"rules_count"`
+	MemoryBytes uint64  `json:"memory_bytes"` // estimated
+	BuildTimeMs float64 `json:"build_time_ms"`
+	Duplicates  int     `json:"duplicates"` // the number of removed duplicate rules
+	Samples     int     `json:"samples"`
+	Matches     uint64  `json:"matches"`
+	P50         float64 `json:"p50_us"`
+	P90         float64 `json:"p90_us"`
+	P99         float64 `json:"p99_us"`
+	Max         float64 `json:"max_us"`
+}
+
+type engineSwapJSON struct {
+	Time               string  `json:"time"` // RFC3339
+	Strategy           string  `json:"strategy"`
+	Created            int     `json:"created"`
+	EstimatedBytes     uint64  `json:"estimated_bytes"`
+	DurationMs         float64 `json:"duration_ms"`
+	PeakMemoryBytes    uint64  `json:"peak_memory_bytes"`
+	PeakHeapAllocBytes uint64  `json:"peak_heap_alloc_bytes"`
+}
+
+type engineProfileJSON struct {
+	Lists          []listProfileJSON `json:"lists"` // the slowest first
+	MemoryBytes    uint64            `json:"memory_bytes"`
+	HeapAllocBytes uint64            `json:"heap_alloc_bytes"`
+	SampleRate     int               `json:"sample_rate"`
+	Duplicates     int               `json:"duplicates"`
+
+	LastSwap           *engineSwapJSON `json:"last_swap,omitempty"` // the last replacement of the engines
+	PeakMemoryBytes    uint64          `json:"peak_memory_bytes"`
+	PeakHeapAllocBytes uint64          `json:"peak_heap_alloc_bytes"`
+}
+
+type benchmarkReq struct {
+	Hosts      []string `json:"hosts"` // empty: random host names
+	Iterations int      `json:"iterations"`
+}
+
+func microseconds(d time.Duration) float64 {
+	return float64(d.Nanoseconds()) / 1000
+}
+
+func profileToJSON(prof dnsfilter.EngineProfile) engineProfileJSON {
+	resp := engineProfileJSON{
+		Lists:          []listProfileJSON{},
+		MemoryBytes:    prof.MemoryBytes,
+		HeapAllocBytes: prof.HeapAlloc,
+		SampleRate:     prof.SampleRate,
+		Duplicates:     prof.Duplicates,
+
+		PeakMemoryBytes:    prof.PeakMemory,
+		PeakHeapAllocBytes: prof.PeakHeapAlloc,
+	}
+	if st := prof.LastSwap; !st.Time.IsZero() {
+		resp.LastSwap = &engineSwapJSON{
+			Time:               st.Time.Format(time.RFC3339),
+			Strategy:           st.Strategy,
+			Created:            st.Created,
+			EstimatedBytes:     st.Estimated,
+			DurationMs:         float64(st.Duration.Nanoseconds()) / 1000000,
+			PeakMemoryBytes:    st.PeakMemory,
+			PeakHeapAllocBytes: st.PeakHeapAlloc,
+		}
+	}
+	for _, lp := range prof.Lists {
+		resp.Lists = append(resp.Lists, listProfileJSON{
+			ID:          lp.ID,
+			Name:        filterNameByID(lp.ID),
+			Whitelist:   lp.Allowlist,
+			RulesCount:  lp.RulesCount,
+			MemoryBytes: lp.MemoryBytes,
+			BuildTimeMs: float64(lp.BuildTime.Nanoseconds()) / 1000000,
+			Duplicates:  lp.Duplicates,
+			Samples:     lp.Samples,
+			Matches:     lp.Matches,
+			P50:         microseconds(lp.P50),
+			P90:         microseconds(lp.P90),
+			P99:         microseconds(lp.P99),
+			Max:         microseconds(lp.Max),
+		})
+	}
+	// the slowest lists by 99th percentile of match duration first
+	sort.SliceStable(resp.Lists, func(i, j int) bool { return resp.Lists[i].P99 > resp.Lists[j].P99 })
+	return resp
+}
+
+// Get random host names that most likely aren't matched by any rule
+func benchmarkHosts(n int) []string {
+	hosts := []string{}
+	for i := 0; i != n; i++ {
+		hosts = append(hosts, fmt.Sprintf("%x.benchmark.example.org", rand.Uint32()))
+	}
+	return hosts
+}
+
+func writeEngineProfile(w http.ResponseWriter, prof dnsfilter.EngineProfile) {
+	js, err := json.Marshal(profileToJSON(prof))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// Get the match latency of the latest DNS requests per filter list
+func handleFilteringProfile(w http.ResponseWriter, r *http.Request) {
+	writeEngineProfile(w, Context.dnsFilter.Profile())
+}
+
+// Match the host names against each filter list and get the latency
+func handleFilteringBenchmark(w http.ResponseWriter, r *http.Request) {
+	req := benchmarkReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+
+	hosts := []string{}
+	for _, h := range req.Hosts {
+		h = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(h), "."))
+		if len(h) != 0 {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == 0 {
+		hosts = benchmarkHosts(benchmarkRandomHosts)
+	}
+	if req.Iterations == 0 {
+		req.Iterations = benchmarkDefaultRepeats
+	}
+	if req.Iterations < 0 || req.Iterations > benchmarkMaxMatches || len(hosts)*req.Iterations > benchmarkMaxMatches {
+		httpError(w, http.StatusBadRequest, "the number of hosts multiplied by iterations must be in range 1..%d",
+			benchmarkMaxMatches)
+		return
+	}
+
+	start := time.Now()
+	prof := Context.dnsFilter.Benchmark(hosts, req.Iterations)
+	log.Debug("filtering benchmark: %d hosts * %d iterations in %s", len(hosts), req.Iterations, time.Since(start))
+	writeEngineProfile(w, prof)
+}
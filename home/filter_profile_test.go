@@ -0,0 +1,59 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilteringProfileHandlers(t *testing.T) {
+	Context = homeContext{}
+	filters := []dnsfilter.Filter{{ID: 0, Data: []byte("||host1^\n")}}
+	Context.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, filters)
+	defer func() {
+		Context.dnsFilter.Close()
+		Context.dnsFilter = nil
+	}()
+
+	w := httptest.NewRecorder()
+	handleFilteringProfile(w, httptest.NewRequest("GET", "/control/filtering/profile", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := engineProfileJSON{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 1, len(resp.Lists))
+	assert.Equal(t, 1, resp.Lists[0].RulesCount)
+	assert.Equal(t, 0, resp.Lists[0].Samples)
+	assert.NotNil(t, resp.LastSwap)
+	assert.Equal(t, "parallel", resp.LastSwap.Strategy)
+	assert.Equal(t, 1, resp.LastSwap.Created)
+
+	post := func(body string) (int, engineProfileJSON) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/control/filtering/benchmark", strings.NewReader(body))
+		handleFilteringBenchmark(w, r)
+		resp := engineProfileJSON{}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	code, _ := post(`{"iterations":-1}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post(`{"iterations":101}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// random host names
+	code, resp = post(`{}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, len(resp.Lists))
+	assert.Equal(t, uint64(benchmarkRandomHosts*benchmarkDefaultRepeats), resp.Lists[0].Matches)
+
+	code, resp = post(`{"hosts":["host1", " Host2. ", ""],"iterations":2}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, uint64(4), resp.Lists[0].Matches)
+	assert.True(t, resp.Lists[0].P50 <= resp.Lists[0].Max)
+}
@@ -0,0 +1,388 @@
+// Periodic update of filters: cron-style schedule and randomized delay
+
+package home
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	refreshCheckInterval = 1 * time.Hour   // local files are checked for modifications at least this often
+	refreshMinWait       = 5 * time.Second // the minimum time between the checks
+	refreshMaxJitter     = 24 * 60         // the maximum value of "filters_update_jitter" (in minutes)
+)
+
+var (
+	// The seed for the random delays: the delays differ between installations, but are stable while the process runs
+	refreshJitterSeed = newRefreshJitterSeed()
+
+	// Wakes up the periodic task when the update settings are changed
+	refreshWakeup = make(chan bool, 1)
+
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+
+	cronMacros = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+func newRefreshJitterSeed() uint64 {
+	b := make([]byte, 8)
+	_, err := crand.Read(b)
+	if err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// Cron-style schedule: "minute hour day-of-month month day-of-week"
+// Each field is a bit mask of the allowed values.
+type cronSchedule struct {
+	minutes  uint64 // 0..59
+	hours    uint64 // 0..23
+	days     uint64 // 1..31
+	months   uint64 // 1..12
+	weekdays uint64 // 0..6 (Sunday is 0)
+
+	// Whether the day of month or the day of week is "*".
+	// If both fields are restricted, a day matches if either field matches.
+	anyDay     bool
+	anyWeekday bool
+}
+
+// Parse a value of a cron field: a number or a name
+// names: the names of the values starting from min
+func parseCronValue(s string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.ToLower(s) == name {
+			return min + i, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("invalid value: %s", s)
+	}
+	return n, nil
+}
+
+// Parse a cron field: "*", "5", "1-5", "*/15", "0-30/10", "mon,wed,fri"
+func parseCronField(s string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		i := strings.IndexByte(part, '/')
+		if i != -1 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step: %s", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			j := strings.IndexByte(part, '-')
+			if j == -1 {
+				lo, err = parseCronValue(part, min, max, names)
+				if err != nil {
+					return 0, err
+				}
+				if i == -1 {
+					hi = lo // "5" is a single value, but "5/10" is "5-max/10"
+				}
+			} else {
+				lo, err = parseCronValue(part[:j], min, max, names)
+				if err != nil {
+					return 0, err
+				}
+				hi, err = parseCronValue(part[j+1:], min, max, names)
+				if err != nil {
+					return 0, err
+				}
+				if lo > hi {
+					return 0, fmt.Errorf("invalid range: %s", part)
+				}
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Parse a cron expression: 5 fields or a macro ("@daily", "@weekly", ...)
+func parseCron(s string) (*cronSchedule, error) {
+	s = strings.TrimSpace(s)
+	if m, ok := cronMacros[strings.ToLower(s)]; ok {
+		s = m
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression: %s: 5 fields expected", s)
+	}
+
+	c := &cronSchedule{
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	var err error
+	c.minutes, err = parseCronField(fields[0], 0, 59, nil)
+	if err == nil {
+		c.hours, err = parseCronField(fields[1], 0, 23, nil)
+	}
+	if err == nil {
+		c.days, err = parseCronField(fields[2], 1, 31, nil)
+	}
+	if err == nil {
+		c.months, err = parseCronField(fields[3], 1, 12, monthNames)
+	}
+	if err == nil {
+		c.weekdays, err = parseCronField(fields[4], 0, 7, weekdayNames)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression: %s: %s", s, err)
+	}
+	if c.weekdays&(1<<7) != 0 {
+		// both 0 and 7 are Sunday
+		c.weekdays = (c.weekdays | 1) &^ (1 << 7)
+	}
+
+	if c.next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("invalid cron expression: %s: it never matches", s)
+	}
+	return c, nil
+}
+
+func (c *cronSchedule) matchDay(t time.Time) bool {
+	day := c.days&(1<<uint(t.Day())) != 0
+	weekday := c.weekdays&(1<<uint(t.Weekday())) != 0
+	if c.anyDay {
+		return weekday
+	} else if c.anyWeekday {
+		return day
+	}
+	return day || weekday
+}
+
+// Get the first time after t that matches the schedule (in the time zone of t)
+// Return zero time if there's no such time in the next 5 years
+func (c *cronSchedule) next(t time.Time) time.Time {
+	limit := t.AddDate(5, 0, 0)
+	loc := t.Location()
+	// the new time must be after the previous one, even if the local time is ambiguous because of DST change
+	advance := func(n time.Time, d time.Duration) {
+		if !n.After(t) {
+			n = t.Add(d)
+		}
+		t = n
+	}
+
+	advance(time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc), time.Minute)
+	for t.Before(limit) {
+		if c.months&(1<<uint(t.Month())) == 0 {
+			advance(time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc), 24*time.Hour)
+		} else if !c.matchDay(t) {
+			advance(time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc), time.Hour)
+		} else if c.hours&(1<<uint(t.Hour())) == 0 {
+			advance(time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc), time.Hour)
+		} else if c.minutes&(1<<uint(t.Minute())) == 0 {
+			advance(time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc), time.Minute)
+		} else {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Return TRUE if the filters are updated periodically
+func filtersUpdateEnabled() bool {
+	return len(config.DNS.FiltersUpdateSchedule) != 0 || config.DNS.FiltersUpdateIntervalHours != 0
+}
+
+// Get the random delay for the scheduled update of a filter (bounded by "filters_update_jitter")
+// The delay is the same for the filter and the scheduled time, so it doesn't change between the checks.
+func refreshJitter(id int64, scheduled time.Time) time.Duration {
+	max := time.Duration(config.DNS.FiltersUpdateJitter) * time.Minute
+	if max == 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%d:%d:%d", refreshJitterSeed, id, scheduled.Unix())
+	return time.Duration(h.Sum64() % uint64(max))
+}
+
+// Get the time when the filter is to be updated
+// With "filters_update_schedule" it's the first scheduled time after the last update,
+// otherwise the update interval is used (see updateInterval()).
+// Return zero time if the filter has never been updated.
+// config lock must be held.
+func (filter *filter) nextUpdate() time.Time {
+	if filter.LastUpdated.IsZero() {
+		return time.Time{}
+	}
+
+	scheduled := time.Time{}
+	if len(config.DNS.FiltersUpdateSchedule) != 0 {
+		c, err := parseCron(config.DNS.FiltersUpdateSchedule)
+		if err == nil {
+			scheduled = c.next(filter.LastUpdated.Local())
+		}
+	}
+	if scheduled.IsZero() {
+		scheduled = filter.LastUpdated.Add(filter.updateInterval())
+	}
+	return scheduled.Add(refreshJitter(filter.ID, scheduled))
+}
+
+// Get the time to wait until the next check of the filters
+// The filters that failed to update are retried at the next check.
+func nextRefreshWait(now time.Time) time.Duration {
+	wait := refreshCheckInterval
+	config.RLock()
+	if filtersUpdateEnabled() {
+		for _, filters := range [][]filter{config.Filters, config.WhitelistFilters} {
+			for i := range filters {
+				f := &filters[i]
+				if !f.Enabled || len(f.LastError) != 0 {
+					continue
+				}
+				d := f.nextUpdate().Sub(now)
+				if d < wait {
+					wait = d
+				}
+			}
+		}
+	}
+	config.RUnlock()
+
+	if wait < refreshMinWait {
+		wait = refreshMinWait
+	}
+	return wait
+}
+
+// Wake up the periodic task, so that the new update settings are applied
+func wakeRefresh() {
+	select {
+	case refreshWakeup <- true:
+	default:
+	}
+}
+
+// Check the update schedule settings
+func checkFiltersUpdateSchedule(schedule string, jitter uint32) error {
+	if len(schedule) != 0 {
+		_, err := parseCron(schedule)
+		if err != nil {
+			return err
+		}
+	}
+	if jitter > refreshMaxJitter {
+		return fmt.Errorf("invalid jitter: %d: the maximum is %d minutes", jitter, refreshMaxJitter)
+	}
+	return nil
+}
+
+type filterUpdateJSON struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Whitelist   bool   `json:"whitelist"`
+	LastUpdated string `json:"last_updated"`
+	NextUpdate  string `json:"next_update"` // empty: the filter is disabled or periodic updates are disabled
+}
+
+type updateScheduleJSON struct {
+	Schedule string             `json:"schedule"` // cron expression.  Empty: the update interval is used
+	Jitter   uint32             `json:"jitter"`   // in minutes
+	Interval uint32             `json:"interval"` // in hours
+	Filters  []filterUpdateJSON `json:"filters"`
+}
+
+// Get the update schedule and the time of the next update of each filter
+func handleUpdateScheduleGet(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	resp := updateScheduleJSON{
+		Filters: []filterUpdateJSON{},
+	}
+	config.RLock()
+	resp.Schedule = config.DNS.FiltersUpdateSchedule
+	resp.Jitter = config.DNS.FiltersUpdateJitter
+	resp.Interval = config.DNS.FiltersUpdateIntervalHours
+	for i, filters := range [][]filter{config.Filters, config.WhitelistFilters} {
+		for j := range filters {
+			f := &filters[j]
+			fj := filterUpdateJSON{
+				ID:        f.ID,
+				Name:      f.Name,
+				URL:       f.URL,
+				Whitelist: i == 1,
+			}
+			if !f.LastUpdated.IsZero() {
+				fj.LastUpdated = f.LastUpdated.Format(time.RFC3339)
+			}
+			if f.Enabled && filtersUpdateEnabled() {
+				next := f.nextUpdate()
+				if next.Before(now) {
+					next = now // the filter is updated at the next check
+				}
+				fj.NextUpdate = next.Format(time.RFC3339)
+			}
+			resp.Filters = append(resp.Filters, fj)
+		}
+	}
+	config.RUnlock()
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// Set the update schedule
+func handleUpdateScheduleSet(w http.ResponseWriter, r *http.Request) {
+	req := updateScheduleJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+	req.Schedule = strings.TrimSpace(req.Schedule)
+	err = checkFiltersUpdateSchedule(req.Schedule, req.Jitter)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	config.DNS.FiltersUpdateSchedule = req.Schedule
+	config.DNS.FiltersUpdateJitter = req.Jitter
+	config.Unlock()
+
+	log.Debug("filters update schedule: %q, jitter: %d minutes", req.Schedule, req.Jitter)
+	onConfigModified()
+	wakeRefresh()
+	returnOK(w)
+}
@@ -0,0 +1,165 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronParse(t *testing.T) {
+	c, err := parseCron("*/15 1-3,5 * * *")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1|1<<15|1<<30|1<<45), c.minutes)
+	assert.Equal(t, uint64(1<<1|1<<2|1<<3|1<<5), c.hours)
+	assert.True(t, c.anyDay && c.anyWeekday)
+
+	c, err = parseCron("0 0 1 JAN-Mar/2 mon,sun")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1<<1|1<<3), c.months)
+	assert.Equal(t, uint64(1|1<<1), c.weekdays)
+	assert.False(t, c.anyDay || c.anyWeekday)
+
+	// 7 is Sunday too
+	c, err = parseCron("30 4 * * 5/2")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1|1<<5), c.weekdays)
+
+	c, err = parseCron(" @Weekly ")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), c.weekdays)
+
+	for _, s := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+		"* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "0 0 30 feb *", "@often"} {
+		_, err = parseCron(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	date := func(s string) time.Time {
+		tm, _ := time.Parse("2006-01-02 15:04", s)
+		return tm
+	}
+	next := func(expr, from string) string {
+		c, err := parseCron(expr)
+		assert.Nil(t, err)
+		return c.next(date(from)).Format("2006-01-02 15:04")
+	}
+
+	assert.Equal(t, "2020-06-10 10:15", next("*/15 * * * *", "2020-06-10 10:07"))
+	assert.Equal(t, "2020-06-11 03:00", next("0 3 * * *", "2020-06-10 03:00"))
+	assert.Equal(t, "2020-06-10 03:00", next("0 3 * * *", "2020-06-10 02:59"))
+	assert.Equal(t, "2020-06-14 00:00", next("@weekly", "2020-06-10 12:00"))
+	assert.Equal(t, "2020-06-15 00:00", next("0 0 * * mon", "2020-06-10 12:00"))
+	assert.Equal(t, "2021-01-01 00:00", next("@yearly", "2020-06-10 12:00"))
+	assert.Equal(t, "2024-02-29 12:30", next("30 12 29 2 *", "2021-03-01 00:00"))
+	// the day of month or the day of week
+	assert.Equal(t, "2020-06-12 00:00", next("0 0 13 * fri", "2020-06-10 12:00"))
+	assert.Equal(t, "2020-06-13 00:00", next("0 0 13 * fri", "2020-06-12 00:00"))
+}
+
+func TestFilterNextUpdate(t *testing.T) {
+	defer func() {
+		config.DNS.FiltersUpdateIntervalHours = 24
+		config.DNS.FiltersUpdateSchedule = ""
+		config.DNS.FiltersUpdateJitter = 10
+		config.Filters = nil
+	}()
+	config.DNS.FiltersUpdateIntervalHours = 24
+	config.DNS.FiltersUpdateSchedule = ""
+	config.DNS.FiltersUpdateJitter = 0
+
+	last := time.Date(2020, 6, 10, 10, 7, 0, 0, time.Local)
+	f := filter{Filter: dnsfilter.Filter{ID: 1}}
+	assert.True(t, f.nextUpdate().IsZero())
+	f.LastUpdated = last
+	assert.Equal(t, last.Add(24*time.Hour), f.nextUpdate())
+	f.expires = 12 * time.Hour
+	assert.Equal(t, last.Add(12*time.Hour), f.nextUpdate())
+
+	// the schedule is used instead of the interval
+	config.DNS.FiltersUpdateSchedule = "0 3 * * *"
+	assert.Equal(t, time.Date(2020, 6, 11, 3, 0, 0, 0, time.Local), f.nextUpdate())
+
+	// the delay is stable for the scheduled time, but differs between the filters
+	config.DNS.FiltersUpdateJitter = 60
+	next := f.nextUpdate()
+	assert.Equal(t, next, f.nextUpdate())
+	scheduled := time.Date(2020, 6, 11, 3, 0, 0, 0, time.Local)
+	assert.False(t, next.Before(scheduled))
+	assert.True(t, next.Before(scheduled.Add(time.Hour)))
+	differ := false
+	for id := int64(2); id != 20; id++ {
+		if refreshJitter(id, scheduled) != refreshJitter(1, scheduled) {
+			differ = true
+		}
+	}
+	assert.True(t, differ)
+
+	// the time until the next update, but local files are checked every hour
+	now := time.Now()
+	config.DNS.FiltersUpdateJitter = 0
+	config.DNS.FiltersUpdateSchedule = ""
+	config.Filters = []filter{
+		{Enabled: true, LastUpdated: now.Add(-23*time.Hour - 30*time.Minute), Filter: dnsfilter.Filter{ID: 1}},
+		{Enabled: false, LastUpdated: now.Add(-24 * time.Hour), Filter: dnsfilter.Filter{ID: 2}},
+		{Enabled: true, LastUpdated: now.Add(-24 * time.Hour), LastError: "error", Filter: dnsfilter.Filter{ID: 3}},
+	}
+	assert.Equal(t, 30*time.Minute, nextRefreshWait(now))
+	config.Filters[0].LastUpdated = now
+	assert.Equal(t, refreshCheckInterval, nextRefreshWait(now))
+	config.Filters[0].LastUpdated = now.Add(-48 * time.Hour)
+	assert.Equal(t, refreshMinWait, nextRefreshWait(now))
+}
+
+func TestUpdateScheduleHandlers(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	defer func() {
+		config.DNS.FiltersUpdateSchedule = ""
+		config.DNS.FiltersUpdateJitter = 10
+		config.Filters = nil
+	}()
+	config.Filters = []filter{
+		{Enabled: true, URL: "https://example.org/1", LastUpdated: time.Now(), Filter: dnsfilter.Filter{ID: 1}},
+		{Enabled: false, URL: "https://example.org/2", Filter: dnsfilter.Filter{ID: 2}},
+	}
+
+	set := func(body string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/control/filtering/update_schedule/set", strings.NewReader(body))
+		handleUpdateScheduleSet(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusBadRequest, set(`{"schedule":"0 3 * *"}`))
+	assert.Equal(t, http.StatusBadRequest, set(`{"schedule":"","jitter":100000}`))
+	assert.Equal(t, http.StatusOK, set(`{"schedule":" 0 3 * * * ","jitter":30}`))
+	assert.Equal(t, "0 3 * * *", config.DNS.FiltersUpdateSchedule)
+	assert.Equal(t, uint32(30), config.DNS.FiltersUpdateJitter)
+	// the periodic task isn't running: drain the wakeup signal
+	assert.Equal(t, 1, len(refreshWakeup))
+	<-refreshWakeup
+
+	w := httptest.NewRecorder()
+	handleUpdateScheduleGet(w, httptest.NewRequest("GET", "/control/filtering/update_schedule", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := updateScheduleJSON{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "0 3 * * *", resp.Schedule)
+	assert.Equal(t, 2, len(resp.Filters))
+	next, err := time.Parse(time.RFC3339, resp.Filters[0].NextUpdate)
+	assert.Nil(t, err)
+	assert.True(t, next.After(time.Now()))
+	assert.True(t, next.Before(time.Now().Add(25*time.Hour)))
+	assert.Equal(t, "", resp.Filters[1].NextUpdate)
+}
@@ -1,11 +1,20 @@
 package home
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/stats"
+	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -40,3 +49,701 @@ func TestFilters(t *testing.T) {
 	f.unload()
 	_ = os.Remove(f.Path())
 }
+
+func TestFilterConditionalUpdate(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	const etag = `"1234"`
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	var lastReq *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastReq = r
+		if r.Header.Get("If-None-Match") == etag ||
+			r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		switch r.URL.Path {
+		case "/etag":
+			w.Header().Set("ETag", etag)
+		case "/last-modified":
+			w.Header().Set("Last-Modified", lastModified)
+		case "/html":
+			w.Header().Set("ETag", etag)
+			_, _ = w.Write([]byte("<html></html>\n"))
+			return
+		}
+		_, _ = w.Write([]byte("||example.org^\n"))
+	}))
+	defer srv.Close()
+
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.client = &http.Client{
+		Timeout: time.Minute * 5,
+	}
+
+	// ETag -> If-None-Match
+	f := filter{
+		URL: srv.URL + "/etag",
+	}
+	ok, err := f.update()
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, "", lastReq.Header.Get("If-None-Match"))
+	assert.Equal(t, etag, f.ETag)
+	assert.Equal(t, 1, f.RulesCount)
+
+	ok, err = f.update()
+	assert.True(t, !ok && err == nil)
+	assert.Equal(t, etag, lastReq.Header.Get("If-None-Match"))
+	assert.Equal(t, "", lastReq.Header.Get("If-Modified-Since"))
+	assert.Equal(t, 1, f.RulesCount)
+
+	// Last-Modified -> If-Modified-Since
+	f = filter{
+		URL: srv.URL + "/last-modified",
+	}
+	ok, err = f.update()
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, "", f.ETag)
+	assert.Equal(t, lastModified, f.LastModified)
+
+	ok, err = f.update()
+	assert.True(t, !ok && err == nil)
+	assert.Equal(t, "", lastReq.Header.Get("If-None-Match"))
+	assert.Equal(t, lastModified, lastReq.Header.Get("If-Modified-Since"))
+
+	// no conditional headers if we don't have the filter data
+	f.checksum = 0
+	ok, err = f.update()
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, "", lastReq.Header.Get("If-Modified-Since"))
+
+	// ETag of the rejected data isn't stored
+	f = filter{
+		URL: srv.URL + "/html",
+	}
+	ok, err = f.update()
+	assert.True(t, !ok && err != nil)
+	assert.Equal(t, "", f.ETag)
+}
+
+func TestFilterCompressed(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	rules := []byte("||example.org^\n||example.com^\n")
+	gz, _ := util.Gzip(rules)
+	var lastReq *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastReq = r
+		if r.URL.Path == "/filter.txt" {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		_, _ = w.Write(gz)
+	}))
+	defer srv.Close()
+
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.client = &http.Client{
+		Timeout: time.Minute * 5,
+	}
+	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0755)
+
+	// Content-Encoding: gzip
+	f := filter{
+		URL:    srv.URL + "/filter.txt",
+		Filter: dnsfilter.Filter{ID: 1},
+	}
+	ok, err := f.update()
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, "gzip", lastReq.Header.Get("Accept-Encoding"))
+	assert.Equal(t, rules, f.Data)
+	assert.Equal(t, 2, f.RulesCount)
+
+	// .gz file
+	f2 := filter{
+		URL:    srv.URL + "/filter.txt.gz",
+		Filter: dnsfilter.Filter{ID: 2},
+	}
+	ok, err = f2.update()
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, rules, f2.Data)
+
+	// compressed file on disk
+	config.DNS.FiltersCompress = true
+	defer func() { config.DNS.FiltersCompress = false }()
+	assert.Nil(t, f.save())
+	assert.True(t, strings.HasSuffix(f.Path(), ".txt.gz"))
+	data, _ := ioutil.ReadFile(f.Path())
+	assert.True(t, util.IsGzip(data))
+
+	f.Data = nil
+	f.RulesCount = 0
+	assert.Nil(t, f.load())
+	assert.Equal(t, 2, f.RulesCount)
+	assert.Nil(t, f.Data)
+
+	// the setting is disabled: the file is converted, its modification time is preserved
+	st, _ := os.Stat(f.Path())
+	config.DNS.FiltersCompress = false
+	assert.Nil(t, f.load())
+	assert.Equal(t, 2, f.RulesCount)
+	data, _ = ioutil.ReadFile(f.Path())
+	assert.Equal(t, rules, data)
+	assert.True(t, st.ModTime().Equal(f.LastUpdated))
+	assert.False(t, util.FileExists(f.pathFormat(true)))
+}
+
+func TestFilterLimits(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	rules := []byte("||example.org^\n||example.com^\n||example.net^\n")
+	gz, _ := util.Gzip(rules)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/filter.txt.gz":
+			_, _ = w.Write(gz)
+		case "/chunked":
+			// no Content-Length
+			w.(http.Flusher).Flush()
+			_, _ = w.Write(rules)
+		default:
+			_, _ = w.Write(rules)
+		}
+	}))
+	defer srv.Close()
+
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	Context.client = &http.Client{
+		Timeout: time.Minute * 5,
+	}
+	defer func() {
+		config.DNS.FiltersMaxSize = 0
+		config.DNS.FiltersMaxRules = 0
+	}()
+
+	// global limits
+	config.DNS.FiltersMaxSize = uint32(len(rules))
+	config.DNS.FiltersMaxRules = 3
+	f := filter{URL: srv.URL + "/filter.txt"}
+	ok, err := f.update()
+	assert.True(t, ok && err == nil)
+
+	config.DNS.FiltersMaxSize = uint32(len(rules) - 1)
+	for _, u := range []string{"/filter.txt", "/chunked", "/filter.txt.gz"} {
+		f = filter{URL: srv.URL + u}
+		ok, err = f.update()
+		assert.True(t, !ok && err != nil, "%s", u)
+	}
+
+	config.DNS.FiltersMaxSize = 0
+	config.DNS.FiltersMaxRules = 2
+	f = filter{URL: srv.URL + "/filter.txt"}
+	ok, err = f.update()
+	assert.True(t, !ok && err != nil)
+
+	// per-filter limits override the global ones
+	f = filter{URL: srv.URL + "/filter.txt", MaxRules: 3}
+	ok, err = f.update()
+	assert.True(t, ok && err == nil)
+
+	config.DNS.FiltersMaxRules = 0
+	f = filter{URL: srv.URL + "/filter.txt", MaxSize: 10}
+	ok, err = f.update()
+	assert.True(t, !ok && err != nil)
+
+	// local file
+	srcDir, _ := ioutil.TempDir("", "agh-filters")
+	defer func() { _ = os.RemoveAll(srcDir) }()
+	config.DNS.FiltersLocalDir = srcDir
+	defer func() { config.DNS.FiltersLocalDir = "" }()
+	fn := filepath.Join(srcDir, "filter.txt")
+	_ = ioutil.WriteFile(fn, rules, 0644)
+	f = filter{URL: fn, MaxSize: 10}
+	ok, err = f.update()
+	assert.True(t, !ok && err != nil)
+
+	// the error is shown in filtering status
+	config.Filters = []filter{{Enabled: true, URL: srv.URL + "/filter.txt", MaxRules: 1, Filter: dnsfilter.Filter{ID: 1}}}
+	defer func() { config.Filters = nil }()
+	_, _, _, _ = refreshFiltersArray(&config.Filters, true)
+	assert.True(t, strings.Contains(config.Filters[0].LastError, "Too many rules"))
+	assert.Equal(t, config.Filters[0].LastError, filterToJSON(config.Filters[0]).LastError)
+}
+
+func TestFilterLastAttempt(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("||example.org^\n"))
+	}))
+	defer srv.Close()
+
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	Context.client = &http.Client{
+		Timeout: time.Minute * 5,
+	}
+	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0755)
+	config.Filters = []filter{{Enabled: true, URL: srv.URL + "/filter.txt", Filter: dnsfilter.Filter{ID: 1}}}
+	defer func() { config.Filters = nil }()
+
+	// the error is stored even if all filters have failed
+	_, _, _, netErr := refreshFiltersArray(&config.Filters, true)
+	assert.True(t, netErr)
+	f := config.Filters[0]
+	assert.True(t, strings.Contains(f.LastError, "404"))
+	assert.False(t, f.LastAttempt.IsZero())
+	assert.True(t, f.LastUpdated.IsZero())
+	fj := filterToJSON(f)
+	assert.Equal(t, f.LastError, fj.LastError)
+	assert.Equal(t, f.LastAttempt.Format(time.RFC3339), fj.LastAttempt)
+
+	// the values are saved in configuration file
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "AdGuardHome.yaml"))
+	assert.True(t, strings.Contains(string(data), "last_error:"))
+	assert.True(t, strings.Contains(string(data), "last_attempt:"))
+
+	// the error is cleared after a successful update
+	fail = false
+	n, _, _, _ := refreshFiltersArray(&config.Filters, true)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "", config.Filters[0].LastError)
+	assert.False(t, config.Filters[0].LastUpdated.IsZero())
+}
+
+func TestFilterLocalPath(t *testing.T) {
+	fn, _ := filepath.Abs("filter.txt")
+	assert.Equal(t, fn, filterLocalPath(fn))
+	assert.Equal(t, fn, filterLocalPath("file://"+filepath.ToSlash(fn)))
+	assert.Equal(t, fn, filterLocalPath("file://localhost"+filepath.ToSlash(fn)))
+	assert.Equal(t, "", filterLocalPath("file://host"+filepath.ToSlash(fn)))
+	assert.Equal(t, "", filterLocalPath("file://relative/filter.txt"))
+	assert.Equal(t, "", filterLocalPath("relative/filter.txt"))
+	assert.Equal(t, "", filterLocalPath("https://example.org/filter.txt"))
+}
+
+func TestFilterLocalFile(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+
+	srcDir, _ := ioutil.TempDir("", "agh-filters")
+	defer func() { _ = os.RemoveAll(srcDir) }()
+	fn := filepath.Join(srcDir, "local.txt")
+	_ = ioutil.WriteFile(fn, []byte("||example.org^\n"), 0644)
+
+	// local files are disabled by default
+	f := filter{
+		URL: fn,
+	}
+	ok, err := f.update()
+	assert.True(t, !ok && err != nil)
+
+	config.DNS.FiltersLocalDir = srcDir
+	defer func() { config.DNS.FiltersLocalDir = "" }()
+	ok, err = f.update()
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, 1, f.RulesCount)
+	err = f.save()
+	assert.Nil(t, err)
+
+	// the file hasn't been modified
+	ok, err = f.update()
+	assert.True(t, !ok && err == nil)
+
+	// the file has been replaced with a file having an older modification time
+	_ = ioutil.WriteFile(fn, []byte("||example.org^\n||example.com^\n"), 0644)
+	mtime := f.srcModTime.Add(-time.Hour)
+	_ = os.Chtimes(fn, mtime, mtime)
+	ok, err = f.update()
+	assert.True(t, ok && err == nil)
+	assert.Equal(t, 2, f.RulesCount)
+
+	// files inside the working directory can't be used
+	absDir, _ := filepath.Abs(dir)
+	f = filter{
+		URL: filepath.Join(absDir, "filter.txt"),
+	}
+	_ = ioutil.WriteFile(f.URL, []byte("||example.org^\n"), 0644)
+	ok, err = f.update()
+	assert.True(t, !ok && err != nil)
+
+	// files outside the directory of local filters can't be used
+	otherDir, _ := ioutil.TempDir("", "agh-other")
+	defer func() { _ = os.RemoveAll(otherDir) }()
+	f = filter{
+		URL: filepath.Join(otherDir, "shadow"),
+	}
+	_ = ioutil.WriteFile(f.URL, []byte("||example.org^\n"), 0644)
+	ok, err = f.update()
+	assert.True(t, !ok && err != nil)
+
+	// directories can't be used
+	f = filter{
+		URL: srcDir,
+	}
+	ok, err = f.update()
+	assert.True(t, !ok && err != nil)
+}
+
+func TestRefreshFilter(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("||example.org^\n||example.com^\n"))
+	}))
+	defer srv.Close()
+
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	Context.client = &http.Client{
+		Timeout: time.Minute * 5,
+	}
+	Context.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	defer func() {
+		Context.dnsFilter.Close()
+		Context.dnsFilter = nil
+	}()
+	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0755)
+
+	config.Filters = []filter{
+		{Enabled: true, URL: srv.URL + "/1", Filter: dnsfilter.Filter{ID: 1}},
+		{Enabled: true, URL: srv.URL + "/2", Filter: dnsfilter.Filter{ID: 2}},
+		{Enabled: false, URL: srv.URL + "/3", Filter: dnsfilter.Filter{ID: 3}},
+	}
+	config.WhitelistFilters = []filter{
+		{Enabled: true, URL: srv.URL + "/4", Filter: dnsfilter.Filter{ID: 4}},
+	}
+	defer func() {
+		config.Filters = nil
+		config.WhitelistFilters = nil
+	}()
+
+	// by ID
+	updated, err := refreshFilter(1, "")
+	assert.True(t, updated && err == nil)
+	assert.Equal(t, 2, config.Filters[0].RulesCount)
+	assert.False(t, config.Filters[0].LastUpdated.IsZero())
+	assert.Equal(t, 0, config.Filters[1].RulesCount)
+	assert.True(t, config.Filters[1].LastUpdated.IsZero())
+	assert.True(t, config.WhitelistFilters[0].LastUpdated.IsZero())
+
+	// the data hasn't changed
+	updated, err = refreshFilter(1, "")
+	assert.True(t, !updated && err == nil)
+
+	// by URL
+	updated, err = refreshFilter(0, srv.URL+"/4")
+	assert.True(t, updated && err == nil)
+	assert.Equal(t, 2, config.WhitelistFilters[0].RulesCount)
+	assert.Equal(t, 0, config.Filters[1].RulesCount)
+	assert.True(t, config.Filters[1].LastUpdated.IsZero())
+
+	// not found
+	_, err = refreshFilter(100, "")
+	assert.NotNil(t, err)
+	_, err = refreshFilter(0, srv.URL+"/100")
+	assert.NotNil(t, err)
+
+	// disabled
+	_, err = refreshFilter(3, "")
+	assert.NotNil(t, err)
+	assert.True(t, config.Filters[2].LastUpdated.IsZero())
+
+	// another update procedure is running
+	refreshStatus = 1
+	_, err = refreshFilter(2, "")
+	assert.Equal(t, errFiltersUpdating, err)
+	refreshStatus = 0
+	assert.True(t, config.Filters[1].LastUpdated.IsZero())
+
+	// HTTP handler
+	Context.controlLock.Lock()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/control/filtering/refresh_one", strings.NewReader(`{"id":2}`))
+	handleFilteringRefreshOne(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"updated":true}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/control/filtering/refresh_one", strings.NewReader(`{"id":100}`))
+	handleFilteringRefreshOne(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	refreshStatus = 1
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/control/filtering/refresh_one", strings.NewReader(`{"id":2}`))
+	handleFilteringRefreshOne(w, r)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	refreshStatus = 0
+	Context.controlLock.Unlock()
+}
+
+func TestFiltersBundle(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	Context.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	Context.dnsFilter.Start()
+	defer func() {
+		Context.dnsFilter.Close()
+		Context.dnsFilter = nil
+	}()
+	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0755)
+
+	config.Filters = []filter{
+		{Enabled: false, URL: "https://example.org/1.txt", Name: "1", Filter: dnsfilter.Filter{ID: 1}},
+	}
+	config.WhitelistFilters = nil
+	config.UserRules = []userRule{{Text: "||example.org^", Enabled: true}}
+	defer func() {
+		config.Filters = nil
+		config.WhitelistFilters = nil
+		config.UserRules = nil
+	}()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/control/filtering/export?format=yaml", nil)
+	handleFilteringExport(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "url: https://example.org/1.txt"))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/control/filtering/export", nil)
+	handleFilteringExport(w, r)
+	assert.Equal(t, `{"filters":[{"name":"1","url":"https://example.org/1.txt","enabled":false}],"whitelist_filters":[],"user_rules":["||example.org^"]}`,
+		w.Body.String())
+
+	// import: duplicate URLs are skipped
+	bundle := `{"filters":[{"name":"1","url":"https://example.org/1.txt"},
+		{"name":"2","url":"https://example.org/2.txt"},
+		{"name":"2","url":"https://example.org/2.txt"}],
+		"whitelist_filters":[{"name":"3","url":"https://example.org/3.txt"}],
+		"user_rules":["||example.org^","||example.com^",""]}`
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/control/filtering/import", strings.NewReader(bundle))
+	handleFilteringImport(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"added":2,"user_rules_added":1}`, w.Body.String())
+	assert.Equal(t, 2, len(config.Filters))
+	assert.Equal(t, "https://example.org/2.txt", config.Filters[1].URL)
+	assert.True(t, config.Filters[1].ID != 0 && config.Filters[1].ID != 1)
+	assert.Equal(t, 1, len(config.WhitelistFilters))
+	assert.Equal(t, []string{"||example.org^", "||example.com^"}, userRulesTexts(config.UserRules))
+
+	// invalid URL
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/control/filtering/import", strings.NewReader(`{"filters":[{"url":"invalid"}]}`))
+	handleFilteringImport(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestFilteringStats(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/control/filtering/stats", nil)
+	handleFilteringStats(w, r)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	var err error
+	Context.stats, err = stats.New(stats.Config{
+		Filename:  filepath.Join(dir, "stats.db"),
+		LimitDays: 1,
+	})
+	assert.Nil(t, err)
+	defer func() {
+		Context.stats.Close()
+		Context.stats = nil
+	}()
+
+	config.Filters = []filter{
+		{Enabled: true, URL: "https://example.org/1.txt", Name: "1", Filter: dnsfilter.Filter{ID: 1}},
+		{Enabled: true, URL: "https://example.org/2.txt", Name: "2", Filter: dnsfilter.Filter{ID: 2}},
+	}
+	config.WhitelistFilters = []filter{
+		{Enabled: true, URL: "https://example.org/3.txt", Name: "3", Filter: dnsfilter.Filter{ID: 3}},
+	}
+	defer func() {
+		config.Filters = nil
+		config.WhitelistFilters = nil
+	}()
+
+	e := stats.Entry{
+		Domain:      "example.org",
+		Client:      net.ParseIP("127.0.0.1"),
+		Result:      stats.RFiltered,
+		RuleMatched: true,
+		FilterID:    1,
+	}
+	Context.stats.Update(e)
+	e.Result = stats.RNotFiltered
+	e.FilterID = 3
+	Context.stats.Update(e)
+	e.FilterID = 0
+	Context.stats.Update(e)
+
+	w = httptest.NewRecorder()
+	handleFilteringStats(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := filteringStatsJSON{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 3, len(resp.Filters))
+	assert.Equal(t, uint64(1), resp.Filters[0].Hits)
+	assert.Equal(t, uint64(0), resp.Filters[1].Hits)
+	assert.Equal(t, uint64(1), resp.Filters[2].Hits)
+	assert.True(t, resp.Filters[2].Whitelist)
+	assert.Equal(t, uint64(1), resp.UserRulesHits)
+}
+
+func TestCheckHostVerbose(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.clients.testing = true
+	Context.clients.Init(nil, nil)
+	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0755)
+
+	config.Filters = []filter{{Enabled: true, Name: "list 1", Filter: dnsfilter.Filter{ID: 1}}}
+	config.WhitelistFilters = []filter{{Enabled: true, Name: "list 2", Filter: dnsfilter.Filter{ID: 2}}}
+	defer func() {
+		config.Filters = nil
+		config.WhitelistFilters = nil
+	}()
+	_ = ioutil.WriteFile(config.Filters[0].Path(), []byte("||example.org^\n||example.com^\n"), 0644)
+	_ = ioutil.WriteFile(config.WhitelistFilters[0].Path(), []byte("||example.com^\n"), 0644)
+	Context.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	defer func() {
+		Context.dnsFilter.Close()
+		Context.dnsFilter = nil
+	}()
+	_ = Context.dnsFilter.SetFilters(
+		[]dnsfilter.Filter{{ID: 1, FilePath: config.Filters[0].Path()}},
+		[]dnsfilter.Filter{{ID: 2, FilePath: config.WhitelistFilters[0].Path()}}, false)
+
+	// filtering is disabled for this client
+	ok, _ := Context.clients.Add(Client{IDs: []string{"1.1.1.1"}, Name: "client1", UseOwnSettings: true})
+	assert.True(t, ok)
+
+	check := func(query string) (int, checkHostVerboseResp) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/control/filtering/check_host_verbose?"+query, nil)
+		handleCheckHostVerbose(w, r)
+		resp := checkHostVerboseResp{}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	code, resp := check("name=example.org&qtype=aaaa")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "FilteredBlackList", resp.Reason)
+	assert.Equal(t, "||example.org^", resp.Rule)
+	assert.Equal(t, int64(1), resp.FilterID)
+	assert.Equal(t, "list 1", resp.FilterName)
+	assert.Equal(t, 3, len(resp.Steps))
+	assert.Equal(t, dnsfilter.TraceRewrites, resp.Steps[0].Name)
+	assert.Equal(t, dnsfilter.TraceAllowlists, resp.Steps[1].Name)
+	assert.Equal(t, "NotFilteredNotFound", resp.Steps[1].Reason)
+	assert.Equal(t, dnsfilter.TraceBlocklists, resp.Steps[2].Name)
+	assert.Equal(t, []matchedRuleJSON{{Text: "||example.org^", FilterID: 1, FilterName: "list 1"}}, resp.Steps[2].Rules)
+
+	code, resp = check("name=example.com")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "NotFilteredWhiteList", resp.Reason)
+	assert.Equal(t, "list 2", resp.FilterName)
+	assert.Equal(t, 2, len(resp.Steps))
+
+	// client settings are applied
+	code, resp = check("name=example.org&client=1.1.1.1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "NotFilteredNotFound", resp.Reason)
+	assert.Equal(t, "client1", resp.ClientName)
+	assert.Equal(t, 1, len(resp.Steps))
+
+	code, _ = check("name=example.org&qtype=invalid")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = check("name=example.org&client=invalid")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestFilterExpires(t *testing.T) {
+	assert.Equal(t, 4*24*time.Hour, parseFilterExpires("4", "days"))
+	assert.Equal(t, 24*time.Hour, parseFilterExpires("1", ""))
+	assert.Equal(t, 12*time.Hour, parseFilterExpires("12", "Hours"))
+	assert.Equal(t, filterExpiresMax, parseFilterExpires("30", "days"))
+	assert.Equal(t, filterExpiresMax, parseFilterExpires("99999999999", "days"))
+	assert.Equal(t, time.Duration(0), parseFilterExpires("0", "days"))
+	assert.Equal(t, time.Duration(0), parseFilterExpires("1", "weeks"))
+
+	n, name, expires := parseFilterContents([]byte("! Title: test\n! Expires: 2 days (update frequency)\n! Expires: 1 day\n||example.org^\n"))
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "test", name)
+	assert.Equal(t, 2*24*time.Hour, expires)
+	_, _, expires = parseFilterContents([]byte("# Expires: 6 hours\n0.0.0.0 example.org\n"))
+	assert.Equal(t, 6*time.Hour, expires)
+	_, _, expires = parseFilterContents([]byte("||example.org^\n"))
+	assert.Equal(t, time.Duration(0), expires)
+
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	data := "! Expires: 4 days\n||example.org^\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(data))
+	}))
+	defer srv.Close()
+
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	Context.client = &http.Client{
+		Timeout: time.Minute * 5,
+	}
+	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0755)
+	config.DNS.FiltersUpdateIntervalHours = 24
+	config.Filters = []filter{{Enabled: true, URL: srv.URL + "/1", Filter: dnsfilter.Filter{ID: 1}}}
+	defer func() { config.Filters = nil }()
+
+	n, _, _, _ = refreshFiltersArray(&config.Filters, true)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 4*24*time.Hour, config.Filters[0].expires)
+	assert.Equal(t, uint32(4*24), filterToJSON(config.Filters[0]).Expires)
+
+	// the filter isn't updated after the global interval, because it hasn't expired yet
+	data = "! Expires: 12 hours\n||example.com^\n"
+	config.Filters[0].LastUpdated = time.Now().Add(-48 * time.Hour)
+	n, _, _, _ = refreshFiltersArray(&config.Filters, false)
+	assert.Equal(t, 0, n)
+
+	config.Filters[0].LastUpdated = time.Now().Add(-5 * 24 * time.Hour)
+	n, _, _, _ = refreshFiltersArray(&config.Filters, false)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 12*time.Hour, config.Filters[0].expires)
+
+	// the value is restored when the filter is loaded from disk
+	f := filter{Filter: dnsfilter.Filter{ID: 1}}
+	assert.Nil(t, f.load())
+	assert.Equal(t, 12*time.Hour, f.expires)
+}
@@ -0,0 +1,222 @@
+package home
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp"
+)
+
+// The result of filter data verification
+const (
+	filterVerifyNone      = ""          // the data isn't verified
+	filterVerifyChecksum  = "checksum"  // "! Checksum:" value matches the data
+	filterVerifySignature = "signature" // the detached signature is valid
+)
+
+// The maximum size of a signature file
+const filterSignatureMaxSize = 64 * 1024
+
+// "! Checksum: BASE64-MD5" line (see Adblock Plus documentation)
+var filterChecksumRegexp = regexp.MustCompile(`(?im)^\s*!\s*checksum[\s\-:]+([\w\+\/=]+).*\n`)
+
+var emptyLinesRegexp = regexp.MustCompile(`\n+`)
+
+// Return TRUE if the public key is in PGP format
+func isPGPKey(key string) bool {
+	return strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN PGP PUBLIC KEY BLOCK-----")
+}
+
+// Verify the value of "! Checksum:" line
+// The checksum is Base64-encoded (without padding) MD5 hash of the data
+// with "\r" characters, empty lines and the checksum line itself removed.
+// Return FALSE if there's no checksum line
+func verifyFilterChecksum(data []byte) (bool, error) {
+	m := filterChecksumRegexp.FindSubmatch(data)
+	if m == nil {
+		return false, nil
+	}
+	expected := strings.TrimRight(string(m[1]), "=")
+
+	norm := bytes.Replace(data, []byte("\r"), nil, -1)
+	norm = emptyLinesRegexp.ReplaceAll(norm, []byte("\n"))
+	norm = filterChecksumRegexp.ReplaceAll(norm, nil)
+	sum := md5.Sum(norm)
+	actual := strings.TrimRight(base64.StdEncoding.EncodeToString(sum[:]), "=")
+	if actual != expected {
+		return false, fmt.Errorf("Checksum verification failed")
+	}
+	return true, nil
+}
+
+// Get the last line of a minisign file that isn't a comment
+func minisignDataLine(s string) string {
+	line := ""
+	for _, ln := range strings.Split(s, "\n") {
+		ln = strings.TrimSpace(ln)
+		if len(ln) != 0 && !strings.HasPrefix(ln, "untrusted comment:") {
+			line = ln
+		}
+	}
+	return line
+}
+
+// Verify minisign signature of the data
+// sig: the contents of .minisig file
+// pubkey: the contents of minisign public key file or just its Base64-encoded line
+func verifyMinisign(data, sig []byte, pubkey string) error {
+	key, err := base64.StdEncoding.DecodeString(minisignDataLine(pubkey))
+	if err != nil || len(key) != 2+8+ed25519.PublicKeySize || string(key[:2]) != "Ed" {
+		return fmt.Errorf("invalid public key")
+	}
+
+	// untrusted comment, signature, trusted comment, global signature
+	lines := strings.Split(strings.TrimSpace(string(sig)), "\n")
+	if len(lines) < 4 {
+		return fmt.Errorf("invalid signature")
+	}
+	sigData, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sigData) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("invalid signature")
+	}
+	const trustedPrefix = "trusted comment: "
+	trusted := strings.TrimRight(lines[2], "\r")
+	if !strings.HasPrefix(trusted, trustedPrefix) {
+		return fmt.Errorf("invalid signature")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid signature")
+	}
+
+	if !bytes.Equal(sigData[2:10], key[2:10]) {
+		return fmt.Errorf("signature is made with a different key")
+	}
+	pk := ed25519.PublicKey(key[10:])
+
+	msg := data
+	switch string(sigData[:2]) {
+	case "Ed":
+		// legacy: the data itself is signed
+	case "ED":
+		h := blake2b.Sum512(data)
+		msg = h[:]
+	default:
+		return fmt.Errorf("unsupported signature algorithm")
+	}
+	if !ed25519.Verify(pk, msg, sigData[10:]) {
+		return fmt.Errorf("Signature verification failed")
+	}
+
+	global := append(append([]byte{}, sigData[10:]...), trusted[len(trustedPrefix):]...)
+	if !ed25519.Verify(pk, global, globalSig) {
+		return fmt.Errorf("Signature verification failed: invalid trusted comment")
+	}
+	return nil
+}
+
+// Verify PGP detached signature of the data
+// sig: either armored or binary signature
+// pubkey: armored public key
+func verifyPGP(data, sig []byte, pubkey string) error {
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(pubkey))
+	if err != nil {
+		return fmt.Errorf("invalid public key: %s", err)
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN PGP SIGNATURE-----")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig))
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig))
+	}
+	if err != nil {
+		return fmt.Errorf("Signature verification failed: %s", err)
+	}
+	return nil
+}
+
+// Get the location of the detached signature:
+// "signature_url" setting or the URL the data was received from (src) with ".minisig" (minisign) or ".asc" (PGP) suffix
+func (filter *filter) signatureURL(src string) string {
+	if len(filter.SignatureURL) != 0 {
+		return filter.SignatureURL
+	}
+	if isPGPKey(filter.PublicKey) {
+		return src + ".asc"
+	}
+	return src + ".minisig"
+}
+
+// Download or read the detached signature
+func (filter *filter) readSignature(src string) ([]byte, error) {
+	u := filter.signatureURL(src)
+	fn := filterLocalPath(u)
+	if fn == "" {
+		return downloadFile(u, filterSignatureMaxSize)
+	}
+
+	st, err := os.Stat(fn)
+	if err != nil {
+		return nil, err
+	}
+	err = checkLocalFilterFile(fn, st)
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() > filterSignatureMaxSize {
+		return nil, fmt.Errorf("%s: file is too large", fn)
+	}
+	return ioutil.ReadFile(fn)
+}
+
+// Verify the downloaded filter data
+// If the public key is set, the data must have a valid signature.
+// Otherwise, the checksum is verified if the data contains "! Checksum:" line.
+// data: the data after decompression
+// raw: the data as it was received (it may be compressed)
+// src: the URL the data was received from
+// Return the verification result (filterVerify*)
+func (filter *filter) verify(data, raw []byte, src string) (string, error) {
+	if len(filter.PublicKey) != 0 {
+		sig, err := filter.readSignature(src)
+		if err != nil {
+			return filterVerifyNone, fmt.Errorf("Couldn't get the signature: %s", err)
+		}
+
+		check := verifyMinisign
+		if isPGPKey(filter.PublicKey) {
+			check = verifyPGP
+		}
+		err = check(data, sig, filter.PublicKey)
+		if err != nil && !bytes.Equal(data, raw) {
+			// the signature may be made for the compressed file
+			if check(raw, sig, filter.PublicKey) == nil {
+				err = nil
+			}
+		}
+		if err != nil {
+			return filterVerifyNone, err
+		}
+		log.Debug("Filter %d: signature is valid", filter.ID)
+		return filterVerifySignature, nil
+	}
+
+	ok, err := verifyFilterChecksum(data)
+	if err != nil {
+		return filterVerifyNone, err
+	}
+	if ok {
+		log.Debug("Filter %d: checksum is valid", filter.ID)
+		return filterVerifyChecksum, nil
+	}
+	return filterVerifyNone, nil
+}
@@ -0,0 +1,170 @@
+package home
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// Add "! Checksum:" line to the data
+func addTestChecksum(data string) string {
+	sum := md5.Sum([]byte(data))
+	cs := strings.TrimRight(base64.StdEncoding.EncodeToString(sum[:]), "=")
+	i := strings.IndexByte(data, '\n') + 1
+	return data[:i] + "! Checksum: " + cs + "\n\n" + data[i:]
+}
+
+func TestVerifyFilterChecksum(t *testing.T) {
+	data := addTestChecksum("! Title: test\n||example.org^\n")
+	ok, err := verifyFilterChecksum([]byte(data))
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	// line endings don't matter
+	ok, err = verifyFilterChecksum([]byte(strings.Replace(data, "\n", "\r\n", -1)))
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	_, err = verifyFilterChecksum([]byte(data + "||example.com^\n"))
+	assert.NotNil(t, err)
+
+	ok, err = verifyFilterChecksum([]byte("||example.org^\n"))
+	assert.False(t, ok)
+	assert.Nil(t, err)
+}
+
+// Create minisign public key and a function that signs the data
+func testMinisignKey(t *testing.T) (string, func(data []byte) string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	keyID := []byte("12345678")
+	pubkey := "untrusted comment: minisign public key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), pub...)) + "\n"
+
+	sign := func(data []byte) string {
+		h := blake2b.Sum512(data)
+		sig := ed25519.Sign(priv, h[:])
+		trusted := "timestamp:1234567890"
+		global := ed25519.Sign(priv, append(append([]byte{}, sig...), trusted...))
+		return "untrusted comment: signature\n" +
+			base64.StdEncoding.EncodeToString(append(append([]byte("ED"), keyID...), sig...)) + "\n" +
+			"trusted comment: " + trusted + "\n" +
+			base64.StdEncoding.EncodeToString(global) + "\n"
+	}
+	return pubkey, sign
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	pubkey, sign := testMinisignKey(t)
+	data := []byte("||example.org^\n")
+	sig := sign(data)
+
+	assert.Nil(t, verifyMinisign(data, []byte(sig), pubkey))
+	assert.Nil(t, verifyMinisign(data, []byte(sig), minisignDataLine(pubkey)))
+	assert.NotNil(t, verifyMinisign([]byte("||example.com^\n"), []byte(sig), pubkey))
+
+	// the trusted comment is modified
+	assert.NotNil(t, verifyMinisign(data, []byte(strings.Replace(sig, "1234567890", "1234567891", 1)), pubkey))
+
+	otherKey, _ := testMinisignKey(t)
+	assert.NotNil(t, verifyMinisign(data, []byte(sig), otherKey))
+	assert.NotNil(t, verifyMinisign(data, []byte("invalid"), pubkey))
+}
+
+func TestVerifyPGP(t *testing.T) {
+	e, err := openpgp.NewEntity("test", "", "test@example.org", nil)
+	assert.Nil(t, err)
+	buf := &bytes.Buffer{}
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, e.Serialize(w))
+	assert.Nil(t, w.Close())
+	pubkey := buf.String()
+	assert.True(t, isPGPKey(pubkey))
+
+	data := []byte("||example.org^\n")
+	sig := &bytes.Buffer{}
+	assert.Nil(t, openpgp.ArmoredDetachSign(sig, e, bytes.NewReader(data), nil))
+	assert.Nil(t, verifyPGP(data, sig.Bytes(), pubkey))
+
+	binSig := &bytes.Buffer{}
+	assert.Nil(t, openpgp.DetachSign(binSig, e, bytes.NewReader(data), nil))
+	assert.Nil(t, verifyPGP(data, binSig.Bytes(), pubkey))
+
+	assert.NotNil(t, verifyPGP([]byte("||example.com^\n"), sig.Bytes(), pubkey))
+}
+
+func TestFilterVerify(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	pubkey, sign := testMinisignKey(t)
+	data := "||example.org^\n"
+	sig := sign([]byte(data))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".minisig") {
+			_, _ = w.Write([]byte(sig))
+			return
+		}
+		_, _ = w.Write([]byte(data))
+	}))
+	defer srv.Close()
+
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	Context.client = &http.Client{
+		Timeout: time.Minute * 5,
+	}
+	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0755)
+	config.Filters = []filter{
+		{Enabled: true, URL: srv.URL + "/1", PublicKey: pubkey, Filter: dnsfilter.Filter{ID: 1}},
+		{Enabled: true, URL: srv.URL + "/2", Filter: dnsfilter.Filter{ID: 2}},
+	}
+	defer func() { config.Filters = nil }()
+
+	n, _, _, _ := refreshFiltersArray(&config.Filters, true)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, filterVerifySignature, config.Filters[0].Verification)
+	assert.Equal(t, "signature", filterToJSON(config.Filters[0]).Verification)
+	assert.Equal(t, filterVerifyNone, config.Filters[1].Verification)
+	assert.Equal(t, "", config.Filters[0].LastError)
+
+	// tampered data is refused and the previous data is kept
+	data = "||example.com^\n"
+	n, _, _, _ = refreshFiltersArray(&config.Filters, true)
+	assert.Equal(t, 1, n)
+	assert.True(t, strings.Contains(config.Filters[0].LastError, "Signature verification failed"))
+	assert.Equal(t, filterVerifySignature, config.Filters[0].Verification)
+	stored, err := readFilterFile(config.Filters[0].Path())
+	assert.Nil(t, err)
+	assert.Equal(t, "||example.org^\n", string(stored))
+
+	// checksum
+	data = addTestChecksum("! Title: test\n||example.net^\n")
+	config.Filters[0].PublicKey = ""
+	n, _, _, _ = refreshFiltersArray(&config.Filters, true)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "", config.Filters[0].LastError)
+	assert.Equal(t, filterVerifyChecksum, config.Filters[0].Verification)
+
+	data += "||example.info^\n"
+	n, _, _, _ = refreshFiltersArray(&config.Filters, true)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, "Checksum verification failed", config.Filters[1].LastError)
+}
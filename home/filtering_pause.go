@@ -0,0 +1,298 @@
+// Temporary pause of filtering: globally, for a client or for a domain
+
+package home
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	filteringPauseMaxMin  = 24 * 60
+	filteringPauseComment = "Filtering paused"
+)
+
+// The global and per-client pauses of filtering
+// They are kept in memory only: filtering is resumed on restart.
+// The pause for a domain is a temporary allowlist user rule.
+type filteringPause struct {
+	lock    sync.Mutex
+	until   time.Time            // the end of the global pause.  Zero: not paused
+	clients map[string]time.Time // client name or IP address -> the end of the pause
+}
+
+// Pause filtering globally (empty client) or for the client
+func (p *filteringPause) set(client string, until time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(client) == 0 {
+		p.until = until
+		return
+	}
+	if p.clients == nil {
+		p.clients = map[string]time.Time{}
+	}
+	p.clients[client] = until
+}
+
+// Resume filtering globally (empty client) or for the client
+// Return FALSE if filtering isn't paused.
+func (p *filteringPause) remove(client string, now time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.removeExpired(now)
+	if len(client) == 0 {
+		ok := !p.until.IsZero()
+		p.until = time.Time{}
+		return ok
+	}
+	_, ok := p.clients[client]
+	delete(p.clients, client)
+	return ok
+}
+
+// Remove the pauses that have ended
+// The object must be locked.
+func (p *filteringPause) removeExpired(now time.Time) {
+	if !p.until.IsZero() && !now.Before(p.until) {
+		log.Info("Filtering is resumed")
+		p.until = time.Time{}
+	}
+	for c, t := range p.clients {
+		if !now.Before(t) {
+			log.Info("Filtering is resumed for %s", c)
+			delete(p.clients, c)
+		}
+	}
+}
+
+// Return TRUE if filtering is paused globally or for any of the client's names (IP address, ClientID or name)
+func (p *filteringPause) paused(now time.Time, names ...string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.until.IsZero() && now.Before(p.until) {
+		return true
+	}
+	for _, n := range names {
+		if len(n) == 0 {
+			continue
+		}
+		t, ok := p.clients[n]
+		if ok && now.Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Disable all filtering if it's paused for the client
+func (p *filteringPause) apply(setts *dnsfilter.RequestFilteringSettings, now time.Time, names ...string) {
+	if !p.paused(now, names...) {
+		return
+	}
+	setts.FilteringEnabled = false
+	setts.SafeSearchEnabled = false
+	setts.SafeBrowsingEnabled = false
+	setts.ParentalEnabled = false
+	setts.ServicesRules = nil
+}
+
+// Get the domain from the text of a temporary allowlist rule (see pauseDomainRule())
+// Return an empty string if the rule doesn't unblock a domain.
+func pausedDomain(text string) string {
+	if !strings.HasPrefix(text, "@@||") || !strings.HasSuffix(text, "^$important") {
+		return ""
+	}
+	return text[len("@@||") : len(text)-len("^$important")]
+}
+
+// Get the text of the rule that disables filtering for the domain and its subdomains
+func pauseDomainRule(domain string) string {
+	return "@@||" + domain + "^$important"
+}
+
+type filteringPauseReq struct {
+	Minutes uint32 `json:"minutes"`
+	Client  string `json:"client"` // client name or IP address
+	Domain  string `json:"domain"`
+}
+
+type filteringPauseItemJSON struct {
+	Client string `json:"client,omitempty"`
+	Domain string `json:"domain,omitempty"`
+	Until  string `json:"until"` // RFC3339
+}
+
+type filteringPauseJSON struct {
+	Until   string                   `json:"until"` // the end of the global pause.  Empty: not paused
+	Clients []filteringPauseItemJSON `json:"clients"`
+	Domains []filteringPauseItemJSON `json:"domains"`
+}
+
+// Check the client name or IP address
+// Return the normalized value.
+func pauseClientName(client string) (string, bool) {
+	ip := net.ParseIP(client)
+	if ip != nil {
+		return ip.String(), true
+	}
+	Context.clients.lock.Lock()
+	_, ok := Context.clients.list[client]
+	Context.clients.lock.Unlock()
+	return client, ok
+}
+
+// Get the active pauses
+func getFilteringPause(now time.Time) filteringPauseJSON {
+	resp := filteringPauseJSON{
+		Clients: []filteringPauseItemJSON{},
+		Domains: []filteringPauseItemJSON{},
+	}
+	p := &Context.filteringPause
+	p.lock.Lock()
+	p.removeExpired(now)
+	if !p.until.IsZero() {
+		resp.Until = p.until.Format(time.RFC3339)
+	}
+	for c, t := range p.clients {
+		resp.Clients = append(resp.Clients, filteringPauseItemJSON{Client: c, Until: t.Format(time.RFC3339)})
+	}
+	p.lock.Unlock()
+	sort.Slice(resp.Clients, func(i, j int) bool { return resp.Clients[i].Client < resp.Clients[j].Client })
+
+	config.RLock()
+	for _, ur := range config.UserRules {
+		d := pausedDomain(ur.Text)
+		if len(d) != 0 && ur.Enabled && !ur.Expires.IsZero() && !ur.expired(now) {
+			resp.Domains = append(resp.Domains, filteringPauseItemJSON{Domain: d, Until: ur.Expires.Format(time.RFC3339)})
+		}
+	}
+	config.RUnlock()
+	return resp
+}
+
+func handleFilteringPauseGet(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, getFilteringPause(time.Now()))
+}
+
+// Pause filtering for the specified time
+// "client" and "domain" are optional: if neither is set, filtering is paused globally.
+// The pause of a domain applies to all clients.
+func handleFilteringPause(w http.ResponseWriter, r *http.Request) {
+	req := filteringPauseReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+	if req.Minutes == 0 || req.Minutes > filteringPauseMaxMin {
+		httpError(w, http.StatusBadRequest, "minutes must be in range 1..%d", filteringPauseMaxMin)
+		return
+	}
+	if len(req.Client) != 0 && len(req.Domain) != 0 {
+		httpError(w, http.StatusBadRequest, "client and domain can't be set together")
+		return
+	}
+	d := time.Duration(req.Minutes) * time.Minute
+
+	if len(req.Domain) != 0 {
+		domain := strings.ToLower(strings.TrimSuffix(req.Domain, "."))
+		if !isValidDomainName(domain) {
+			httpError(w, http.StatusBadRequest, "invalid domain name: %s", req.Domain)
+			return
+		}
+		resumeDomain(domain)
+		ur := addTemporaryUserRule(pauseDomainRule(domain), filteringPauseComment, d)
+		log.Info("Filtering is paused for %s until %s", domain, ur.Expires.Format(time.RFC3339))
+		applyUserRules()
+		writeJSON(w, getFilteringPause(time.Now()))
+		return
+	}
+
+	client := req.Client
+	if len(client) != 0 {
+		var ok bool
+		client, ok = pauseClientName(client)
+		if !ok {
+			httpError(w, http.StatusBadRequest, "unknown client: %s", req.Client)
+			return
+		}
+	}
+	until := time.Now().Add(d)
+	Context.filteringPause.set(client, until)
+	if len(client) == 0 {
+		log.Info("Filtering is paused until %s", until.Format(time.RFC3339))
+	} else {
+		log.Info("Filtering is paused for %s until %s", client, until.Format(time.RFC3339))
+	}
+	writeJSON(w, getFilteringPause(time.Now()))
+}
+
+// Remove the temporary rules that unblock the domain
+// Return FALSE if there were no such rules.
+func resumeDomain(domain string) bool {
+	config.Lock()
+	defer config.Unlock()
+	rules := []userRule{}
+	for _, ur := range config.UserRules {
+		if !ur.Expires.IsZero() && pausedDomain(ur.Text) == domain {
+			continue
+		}
+		rules = append(rules, ur)
+	}
+	ok := len(rules) != len(config.UserRules)
+	config.UserRules = rules
+	return ok
+}
+
+// Resume filtering before the pause ends
+func handleFilteringResume(w http.ResponseWriter, r *http.Request) {
+	req := filteringPauseReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+
+	if len(req.Domain) != 0 {
+		domain := strings.ToLower(strings.TrimSuffix(req.Domain, "."))
+		if !resumeDomain(domain) {
+			httpError(w, http.StatusBadRequest, "filtering isn't paused for %s", req.Domain)
+			return
+		}
+		log.Info("Filtering is resumed for %s", domain)
+		applyUserRules()
+		writeJSON(w, getFilteringPause(time.Now()))
+		return
+	}
+
+	client := req.Client
+	if len(client) != 0 {
+		client, _ = pauseClientName(client)
+	}
+	if !Context.filteringPause.remove(client, time.Now()) {
+		httpError(w, http.StatusBadRequest, "filtering isn't paused")
+		return
+	}
+	if len(client) == 0 {
+		log.Info("Filtering is resumed")
+	} else {
+		log.Info("Filtering is resumed for %s", client)
+	}
+	writeJSON(w, getFilteringPause(time.Now()))
+}
+
+// RegisterFilteringPauseHandlers - register HTTP handlers
+func RegisterFilteringPauseHandlers() {
+	httpRegister(http.MethodGet, "/control/filtering/pauses", handleFilteringPauseGet)
+	httpRegister(http.MethodPost, "/control/filtering/pause", handleFilteringPause)
+	httpRegister(http.MethodPost, "/control/filtering/resume", handleFilteringResume)
+}
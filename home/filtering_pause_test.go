@@ -0,0 +1,154 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilteringPauseApply(t *testing.T) {
+	p := filteringPause{}
+	now := time.Now()
+	full := dnsfilter.RequestFilteringSettings{
+		FilteringEnabled:    true,
+		SafeSearchEnabled:   true,
+		SafeBrowsingEnabled: true,
+		ParentalEnabled:     true,
+		ServicesRules:       []dnsfilter.ServiceEntry{{Name: "youtube"}},
+	}
+
+	setts := full
+	p.apply(&setts, now, "192.168.1.2", "")
+	assert.True(t, setts.FilteringEnabled)
+
+	// the client is selected by IP address or name
+	p.set("192.168.1.2", now.Add(time.Minute))
+	p.set("laptop", now.Add(time.Minute))
+	p.apply(&setts, now, "192.168.1.2", "")
+	assert.False(t, setts.FilteringEnabled)
+	assert.False(t, setts.SafeSearchEnabled)
+	assert.False(t, setts.SafeBrowsingEnabled)
+	assert.False(t, setts.ParentalEnabled)
+	assert.Nil(t, setts.ServicesRules)
+	setts = full
+	p.apply(&setts, now, "192.168.1.3", "laptop")
+	assert.False(t, setts.FilteringEnabled)
+	setts = full
+	p.apply(&setts, now, "192.168.1.3", "")
+	assert.True(t, setts.FilteringEnabled)
+
+	// the pause ends
+	p.apply(&setts, now.Add(time.Minute), "192.168.1.2", "")
+	assert.True(t, setts.FilteringEnabled)
+
+	// global pause
+	p.set("", now.Add(time.Minute))
+	p.apply(&setts, now, "192.168.1.3", "")
+	assert.False(t, setts.FilteringEnabled)
+	assert.True(t, p.remove("", now))
+	assert.False(t, p.remove("", now))
+	setts = full
+	p.apply(&setts, now, "192.168.1.3", "")
+	assert.True(t, setts.FilteringEnabled)
+
+	// the expired pauses are removed
+	assert.False(t, p.remove("laptop", now.Add(time.Minute)))
+}
+
+func TestFilteringPauseHandlers(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	Context.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	Context.dnsFilter.Start()
+	defer func() {
+		Context.dnsFilter.Close()
+		Context.dnsFilter = nil
+	}()
+	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0755)
+	config.DNS.FilteringEnabled = true
+	config.UserRules = nil
+	defer func() { config.UserRules = nil }()
+
+	post := func(h func(http.ResponseWriter, *http.Request), body string) (int, filteringPauseJSON) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/control/filtering/pause", strings.NewReader(body))
+		h(w, r)
+		resp := filteringPauseJSON{}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	code, _ := post(handleFilteringPause, `{"minutes":0}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post(handleFilteringPause, `{"minutes":1441}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post(handleFilteringPause, `{"minutes":30,"client":"unknown"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post(handleFilteringPause, `{"minutes":30,"client":"192.168.1.2","domain":"example.org"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post(handleFilteringPause, `{"minutes":30,"domain":"example"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// global
+	code, resp := post(handleFilteringPause, `{"minutes":30}`)
+	assert.Equal(t, http.StatusOK, code)
+	until, err := time.Parse(time.RFC3339, resp.Until)
+	assert.Nil(t, err)
+	assert.True(t, until.After(time.Now().Add(29*time.Minute)))
+
+	// client
+	code, resp = post(handleFilteringPause, `{"minutes":10,"client":"192.168.1.2"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, len(resp.Clients))
+	assert.Equal(t, "192.168.1.2", resp.Clients[0].Client)
+
+	// domain: a temporary user rule
+	code, resp = post(handleFilteringPause, `{"minutes":10,"domain":"Example.org."}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, len(resp.Domains))
+	assert.Equal(t, "example.org", resp.Domains[0].Domain)
+	assert.Equal(t, 1, len(config.UserRules))
+	assert.Equal(t, "@@||example.org^$important", config.UserRules[0].Text)
+	assert.False(t, config.UserRules[0].Expires.IsZero())
+
+	// the pause of the same domain is replaced
+	_, resp = post(handleFilteringPause, `{"minutes":20,"domain":"example.org"}`)
+	assert.Equal(t, 1, len(resp.Domains))
+	assert.Equal(t, 1, len(config.UserRules))
+
+	w := httptest.NewRecorder()
+	handleFilteringPauseGet(w, httptest.NewRequest("GET", "/control/filtering/pauses", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp = filteringPauseJSON{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.NotEqual(t, "", resp.Until)
+	assert.Equal(t, 1, len(resp.Clients))
+	assert.Equal(t, 1, len(resp.Domains))
+
+	// resume
+	code, resp = post(handleFilteringResume, `{"domain":"example.org"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0, len(resp.Domains))
+	assert.Equal(t, 0, len(config.UserRules))
+	code, _ = post(handleFilteringResume, `{"domain":"example.org"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, resp = post(handleFilteringResume, `{"client":"192.168.1.2"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0, len(resp.Clients))
+	code, resp = post(handleFilteringResume, `{}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "", resp.Until)
+	code, _ = post(handleFilteringResume, `{}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
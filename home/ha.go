@@ -0,0 +1,267 @@
+// High availability: active/standby state of the instance
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// High availability modes
+const (
+	haModeDisabled  = ""           // the instance is always active
+	haModeVirtualIP = "virtual_ip" // the instance is active while the virtual IP address is assigned to a local interface
+	haModeManual    = "manual"     // the state is set by API, e.g. by keepalived notify script
+)
+
+// Instance states
+const (
+	haStateActive  = "active"
+	haStateStandby = "standby" // queries aren't written to query log and statistics
+)
+
+const haCheckInterval = 2 * time.Second // interval between the checks of the virtual IP address
+
+// Settings of high availability
+type haConfig struct {
+	Mode      string `yaml:"mode" json:"mode"`
+	VirtualIP string `yaml:"virtual_ip" json:"virtual_ip"` // for "virtual_ip" mode
+
+	// The state set by API in "manual" mode.  It's kept across restarts.  Empty: active
+	State string `yaml:"state,omitempty" json:"-"`
+}
+
+// Get the addresses of local interfaces
+var haInterfaceAddrs = net.InterfaceAddrs
+
+// High availability module
+type haManager struct {
+	lock    sync.Mutex
+	state   string
+	changed time.Time // the time of the last state change
+}
+
+func newHAManager() *haManager {
+	h := &haManager{
+		state:   haStateActive,
+		changed: time.Now(),
+	}
+	h.update()
+	return h
+}
+
+// Start the checks of the virtual IP address
+func (h *haManager) start() {
+	go func() {
+		for {
+			time.Sleep(haCheckInterval)
+			h.update()
+		}
+	}()
+}
+
+// Check the settings of high availability
+func checkHAConfig(c haConfig) error {
+	switch c.Mode {
+	case haModeDisabled, haModeManual:
+		//
+	case haModeVirtualIP:
+		if net.ParseIP(c.VirtualIP) == nil {
+			return fmt.Errorf("invalid virtual_ip: %s", c.VirtualIP)
+		}
+	default:
+		return fmt.Errorf("invalid mode: %s", c.Mode)
+	}
+
+	switch c.State {
+	case "", haStateActive, haStateStandby:
+		//
+	default:
+		return fmt.Errorf("invalid state: %s", c.State)
+	}
+	return nil
+}
+
+// Return TRUE if the IP address is assigned to a local interface
+func haHasLocalIP(ip net.IP) bool {
+	addrs, err := haInterfaceAddrs()
+	if err != nil {
+		log.Debug("HA: can't get the addresses of network interfaces: %s", err)
+		return false
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the state according to the current settings
+func haCurrentState() string {
+	config.RLock()
+	c := config.HA
+	config.RUnlock()
+
+	switch c.Mode {
+	case haModeVirtualIP:
+		if haHasLocalIP(net.ParseIP(c.VirtualIP)) {
+			return haStateActive
+		}
+		return haStateStandby
+	case haModeManual:
+		if c.State == haStateStandby {
+			return haStateStandby
+		}
+	}
+	return haStateActive
+}
+
+// Update the state according to the current settings
+func (h *haManager) update() {
+	state := haCurrentState()
+
+	h.lock.Lock()
+	if h.state == state {
+		h.lock.Unlock()
+		return
+	}
+	h.state = state
+	h.changed = time.Now()
+	h.lock.Unlock()
+
+	log.Info("HA: the instance is %s now", state)
+}
+
+// Return TRUE if the instance is standby
+// The module may be nil (not initialized yet).
+func (h *haManager) isStandby() bool {
+	if h == nil {
+		return false
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.state == haStateStandby
+}
+
+type haStatusJSON struct {
+	haConfig
+	State   string `json:"state"`
+	Changed string `json:"changed"` // the time of the last state change (RFC3339)
+}
+
+func (h *haManager) status() haStatusJSON {
+	resp := haStatusJSON{}
+	config.RLock()
+	resp.haConfig = config.HA
+	config.RUnlock()
+
+	h.lock.Lock()
+	resp.State = h.state
+	resp.Changed = h.changed.Format(time.RFC3339)
+	h.lock.Unlock()
+	return resp
+}
+
+func handleHAStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, Context.ha.status())
+}
+
+func handleHAConfig(w http.ResponseWriter, r *http.Request) {
+	c := haConfig{}
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	err = checkHAConfig(c)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	c.State = config.HA.State
+	config.HA = c
+	config.Unlock()
+	onConfigModified()
+	Context.ha.update()
+
+	httpOK(r, w)
+}
+
+type haStateJSON struct {
+	State string `json:"state"`
+}
+
+// Set the state in "manual" mode
+func handleHASetState(w http.ResponseWriter, r *http.Request) {
+	req := haStateJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	if req.State != haStateActive && req.State != haStateStandby {
+		httpError(w, http.StatusBadRequest, "invalid state: %s", req.State)
+		return
+	}
+
+	config.Lock()
+	if config.HA.Mode != haModeManual {
+		config.Unlock()
+		httpError(w, http.StatusBadRequest, "the state can be set in manual mode only")
+		return
+	}
+	config.HA.State = req.State
+	config.Unlock()
+	onConfigModified()
+	Context.ha.update()
+
+	httpOK(r, w)
+}
+
+type haHealthJSON struct {
+	State   string `json:"state"`
+	Running bool   `json:"running"` // DNS server is running
+}
+
+// Health check for load balancers: 200 if the instance is active and DNS server is running, 503 otherwise
+// Authentication isn't required.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "This request must be GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := haHealthJSON{
+		State:   Context.ha.status().State,
+		Running: isRunning(),
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Marshal: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.State != haStateActive || !resp.Running {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(data)
+}
+
+// RegisterHAHandlers - register HTTP handlers
+func RegisterHAHandlers() {
+	httpRegister(http.MethodGet, "/control/ha/status", handleHAStatus)
+	httpRegister(http.MethodPost, "/control/ha/config", handleHAConfig)
+	httpRegister(http.MethodPost, "/control/ha/state", handleHASetState)
+	http.HandleFunc("/health", postInstall(handleHealth))
+}
@@ -0,0 +1,73 @@
+package home
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckHAConfig(t *testing.T) {
+	assert.Nil(t, checkHAConfig(haConfig{}))
+	assert.Nil(t, checkHAConfig(haConfig{Mode: haModeVirtualIP, VirtualIP: "192.168.1.100"}))
+	assert.Nil(t, checkHAConfig(haConfig{Mode: haModeManual, State: haStateStandby}))
+	assert.NotNil(t, checkHAConfig(haConfig{Mode: haModeVirtualIP}))
+	assert.NotNil(t, checkHAConfig(haConfig{Mode: "vrrp"}))
+	assert.NotNil(t, checkHAConfig(haConfig{Mode: haModeManual, State: "master"}))
+}
+
+func TestHAState(t *testing.T) {
+	prevHA := config.HA
+	prevAddrs := haInterfaceAddrs
+	defer func() {
+		config.HA = prevHA
+		haInterfaceAddrs = prevAddrs
+	}()
+	addrs := []net.Addr{&net.IPNet{IP: net.ParseIP("192.168.1.2"), Mask: net.CIDRMask(24, 32)}}
+	haInterfaceAddrs = func() ([]net.Addr, error) {
+		return addrs, nil
+	}
+
+	config.HA = haConfig{}
+	h := newHAManager()
+	assert.False(t, h.isStandby())
+
+	// the virtual IP address is assigned to another instance
+	config.HA = haConfig{Mode: haModeVirtualIP, VirtualIP: "192.168.1.100"}
+	h.update()
+	assert.True(t, h.isStandby())
+
+	addrs = append(addrs, &net.IPNet{IP: net.ParseIP("192.168.1.100"), Mask: net.CIDRMask(32, 32)})
+	h.update()
+	assert.False(t, h.isStandby())
+
+	config.HA = haConfig{Mode: haModeManual, State: haStateStandby}
+	h.update()
+	assert.True(t, h.isStandby())
+	assert.Equal(t, haStateStandby, h.status().State)
+
+	// nil module: always active
+	var h2 *haManager
+	assert.False(t, h2.isStandby())
+}
+
+func TestHAHealth(t *testing.T) {
+	prevHA, prevModule := config.HA, Context.ha
+	defer func() {
+		config.HA, Context.ha = prevHA, prevModule
+	}()
+
+	// standby, DNS server isn't running
+	config.HA = haConfig{Mode: haModeManual, State: haStateStandby}
+	Context.ha = newHAManager()
+	w := httptest.NewRecorder()
+	handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, `{"state":"standby","running":false}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handleHealth(w, httptest.NewRequest(http.MethodPost, "/health", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
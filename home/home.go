@@ -43,10 +43,9 @@ const (
 
 // Update-related variables
 var (
-	versionString   string
-	updateChannel   string
-	versionCheckURL string
-	ARMVersion      string
+	versionString string
+	updateChannel string
+	ARMVersion    string
 )
 
 const versionCheckPeriod = time.Hour * 8
@@ -67,6 +66,23 @@ type homeContext struct {
 	auth        *Auth                // HTTP authentication module
 	httpServer  *http.Server         // HTTP module
 	httpsServer HTTPSServer          // HTTPS module
+	notifier    *notifier            // notifications module
+	syncer      *syncer              // configuration sync module
+	ha          *haManager           // high availability module
+	hooks       *hookRunner          // external hooks module
+	acme        *acmeManager         // ACME module
+	updater     *updateManager       // self-update module
+	logger      logWriter            // the output of the logger
+	audit       *auditLog            // audit trail of configuration changes
+	loginLog    *loginLog            // log of log-in attempts
+	authLimiter *authRateLimiter     // brute-force protection of log-in
+	blockPage   blockPageServer      // block page module
+
+	filteringPause filteringPause // temporary pauses of filtering
+
+	filtersCatalog filtersCatalog // catalog of known filter lists
+
+	sockets listeningSockets // sockets passed by systemd or opened before the privileges are dropped
 
 	// Runtime properties
 	// --
@@ -98,24 +114,33 @@ func Main(version string, channel string, armVer string) {
 	versionString = version
 	updateChannel = channel
 	ARMVersion = armVer
-	versionCheckURL = "https://static.adguard.com/adguardhome/" + updateChannel + "/version.json"
 
 	// config can be specified, which reads options from there, but other command line flags have to override config values
 	// therefore, we must do it manually instead of using a lib
 	args := loadOptions()
 
 	if args.serviceControlAction != "" {
-		handleServiceControlAction(args.serviceControlAction)
+		handleServiceControlAction(args)
 		return
 	}
 
 	Context.appSignalChannel = make(chan os.Signal)
 	signal.Notify(Context.appSignalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
 	go func() {
-		<-Context.appSignalChannel
-		cleanup()
-		cleanupAlways()
-		os.Exit(0)
+		for {
+			sig := <-Context.appSignalChannel
+			if sig == syscall.SIGHUP {
+				// reload the configuration rather than exit
+				err := reloadConfig()
+				if err != nil {
+					log.Error("Reload: %s", err)
+				}
+				continue
+			}
+			cleanup()
+			cleanupAlways()
+			os.Exit(0)
+		}
 	}()
 
 	// run the protection
@@ -137,6 +162,7 @@ func run(args options) {
 	// Init some of the Context fields right away
 	Context.transport = &http.Transport{
 		DialContext: customDialContext,
+		Proxy:       outboundProxy,
 	}
 	Context.client = &http.Client{
 		Timeout:   time.Minute * 5,
@@ -162,6 +188,21 @@ func run(args options) {
 	Context.runningAsService = args.runningAsService
 	Context.disableUpdate = args.disableUpdate
 
+	Context.updater = newUpdateManager()
+	if !args.checkConfig {
+		// the new version is rolled back before anything is initialized:
+		// the previous version gets the sockets passed by systemd
+		if Context.updater.onStart() {
+			updateRollback("the new version has failed to start", false)
+		}
+		go Context.updater.healthCheck()
+	}
+
+	err := Context.sockets.addSystemd()
+	if err != nil {
+		log.Fatalf("systemd socket activation: %s", err)
+	}
+
 	Context.firstRun = detectFirstRun()
 	if Context.firstRun {
 		requireAdminRights()
@@ -198,6 +239,23 @@ func run(args options) {
 	Context.clients.Init(config.Clients, Context.dhcpServer)
 	config.Clients = nil
 
+	Context.notifier = newNotifier()
+	Context.notifier.start()
+
+	Context.hooks = newHookRunner()
+	Context.hooks.start()
+
+	Context.syncer = newSyncer()
+
+	Context.ha = newHAManager()
+	Context.ha.start()
+
+	Context.acme = newACMEManager()
+	Context.acme.start()
+
+	initAudit()
+	initLoginProtection()
+
 	if (runtime.GOOS == "linux" || runtime.GOOS == "darwin") &&
 		config.RlimitNoFile != 0 {
 		util.SetRlimit(config.RlimitNoFile)
@@ -218,6 +276,14 @@ func run(args options) {
 			log.Fatal(err)
 		}
 
+		if len(config.UserName) != 0 {
+			// the privileged ports must be bound before the privileges are dropped
+			err = Context.sockets.bind()
+			if err != nil {
+				log.Fatalf("Can't open the listening sockets: %s", err)
+			}
+		}
+
 		err = initDNSServer()
 		if err != nil {
 			log.Fatalf("%s", err)
@@ -233,17 +299,32 @@ func run(args options) {
 		if err != nil {
 			log.Fatal(err)
 		}
+
+		go backupLoop()
+		go userRulesExpireLoop()
+		err = Context.blockPage.start()
+		if err != nil {
+			log.Error("Couldn't start block page server: %s", err)
+		}
+		Context.syncer.start()
 	}
 
 	if len(args.pidFile) != 0 && writePIDFile(args.pidFile) {
 		Context.pidFileName = args.pidFile
 	}
 
+	if !Context.firstRun {
+		dropPrivileges()
+	}
+
 	// Initialize and run the admin Web interface
 	box := packr.NewBox("../build/static")
 
 	// if not configured, redirect / to /install.html, otherwise redirect /install.html to /
-	http.Handle("/", postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(http.FileServer(box)))))
+	// DNS-over-HTTPS paths are set in configuration, their requests are passed by the root handler
+	http.Handle("/", dohPathHandler(postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(http.FileServer(box))))))
+	// ACME server must be able to get HTTP-01 challenge responses without authentication
+	http.HandleFunc(acmeChallengePath, Context.acme.handleHTTP01)
 	registerControlHandlers()
 
 	// add handlers for /install paths, we only need them when we're not configured yet
@@ -257,6 +338,7 @@ func run(args options) {
 
 	// for https, we have a separate goroutine loop
 	go httpServerLoop()
+	go tlsWatchLoop()
 
 	// this loop is used as an ability to change listening host and/or port
 	for !Context.httpsServer.shutdown {
@@ -267,7 +349,13 @@ func run(args options) {
 		Context.httpServer = &http.Server{
 			Addr: address,
 		}
-		err := Context.httpServer.ListenAndServe()
+		var err error
+		ln := Context.sockets.takeWeb()
+		if ln != nil {
+			err = Context.httpServer.Serve(ln)
+		} else {
+			err = Context.httpServer.ListenAndServe()
+		}
 		if err != http.ErrServerClosed {
 			cleanupAlways()
 			log.Fatal(err)
@@ -311,19 +399,39 @@ func httpServerLoop() {
 			cleanupAlways()
 			log.Fatal(err)
 		}
+		Context.httpsServer.setCertificate(cert)
+		names, err := dnsforward.NewTLSCertificates(config.TLS.ServerNames)
+		if err != nil {
+			log.Error("TLS: server names: %s", err)
+		}
+		Context.httpsServer.setServerNames(names)
 		Context.httpsServer.cond.L.Unlock()
 
 		// prepare HTTPS server
 		Context.httpsServer.server = &http.Server{
 			Addr: address,
 			TLSConfig: &tls.Config{
-				Certificates: []tls.Certificate{cert},
-				MinVersion:   tls.VersionTLS12,
+				GetCertificate: Context.httpsServer.getCertificate,
+				MinVersion:     tls.VersionTLS12,
 			},
 		}
+		if config.TLS.ClientAuth {
+			// the web interface is available without a client certificate, DNS-over-HTTPS requests are checked by handleDOH()
+			Context.httpsServer.server.TLSConfig.ClientCAs, err = dnsforward.ParseClientCAs(config.TLS.ClientCAData)
+			if err != nil {
+				cleanupAlways()
+				log.Fatal(err)
+			}
+			Context.httpsServer.server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
 
 		printHTTPAddresses("https")
-		err = Context.httpsServer.server.ListenAndServeTLS("", "")
+		ln := Context.sockets.takeHTTPS()
+		if ln != nil {
+			err = Context.httpsServer.server.ServeTLS(ln, "", "")
+		} else {
+			err = Context.httpsServer.server.ListenAndServeTLS("", "")
+		}
 		if err != http.ErrServerClosed {
 			cleanupAlways()
 			log.Fatal(err)
@@ -333,10 +441,11 @@ func httpServerLoop() {
 
 // Check if the current user has root (administrator) rights
 //  and if not, ask and try to run as root
+// The service user with CAP_NET_BIND_SERVICE capability doesn't need root rights.
 func requireAdminRights() {
 	admin, _ := util.HaveAdminRights()
 	if //noinspection ALL
-	admin || isdelve.Enabled {
+	admin || isdelve.Enabled || util.HaveNetBindCapability() {
 		return
 	}
 
@@ -402,9 +511,9 @@ func configureLogger(args options) {
 		ls.LogFile = args.logFile
 	}
 
-	// log.SetLevel(log.INFO) - default
-	if ls.Verbose {
-		log.SetLevel(log.DEBUG)
+	err := checkLogSettings(ls)
+	if err != nil {
+		log.Fatalf("%s", err)
 	}
 
 	if args.runningAsService && ls.LogFile == "" && runtime.GOOS == "windows" {
@@ -413,28 +522,25 @@ func configureLogger(args options) {
 		ls.LogFile = configSyslog
 	}
 
-	if ls.LogFile == "" {
-		return
-	}
-
+	var out io.Writer = os.Stderr
 	if ls.LogFile == configSyslog {
 		// Use syslog where it is possible and eventlog on Windows
-		err := util.ConfigureSyslog(serviceName)
+		out, err = util.NewSyslogWriter(serviceName)
 		if err != nil {
 			log.Fatalf("cannot initialize syslog: %s", err)
 		}
-	} else {
+	} else if ls.LogFile != "" {
 		logFilePath := filepath.Join(Context.workDir, ls.LogFile)
 		if filepath.IsAbs(ls.LogFile) {
 			logFilePath = ls.LogFile
 		}
 
-		file, err := os.OpenFile(logFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		out, err = util.OpenLogFile(logFilePath, int64(ls.LogMaxSize)*1024*1024, time.Duration(ls.LogMaxAge)*24*time.Hour)
 		if err != nil {
 			log.Fatalf("cannot create a log file: %s", err)
 		}
-		log.SetOutput(file)
 	}
+	Context.logger.init(out, ls)
 }
 
 func cleanup() {
@@ -448,6 +554,7 @@ func cleanup() {
 	if err != nil {
 		log.Error("Couldn't stop DHCP server: %s", err)
 	}
+	Context.blockPage.stop()
 }
 
 // Stop HTTP server, possibly waiting for all active connections to be closed
@@ -484,6 +591,12 @@ type options struct {
 	// service control action (see service.ControlAction array + "status" command)
 	serviceControlAction string
 
+	// service install: systemd opens DNS port and passes the sockets to the service
+	socketActivation bool
+
+	// service install: the user the service runs as ("root": don't create a user)
+	serviceUser string
+
 	// runningAsService flag is set to true when options are passed from the service runner
 	runningAsService bool
 }
@@ -513,6 +626,10 @@ func loadOptions() options {
 		{"service", "s", "Service control action: status, install, uninstall, start, stop, restart", func(value string) {
 			o.serviceControlAction = value
 		}, nil},
+		{"user", "", "Service install: the user the service runs as, created if necessary ('root': run as root)", func(value string) {
+			o.serviceUser = value
+		}, nil},
+		{"socket-activation", "", "Service install: use systemd socket activation for DNS port", nil, func() { o.socketActivation = true }},
 		{"logfile", "l", "Path to log file. If empty: write to stdout; if 'syslog': write to system log", func(value string) {
 			o.logFile = value
 		}, nil},
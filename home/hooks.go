@@ -0,0 +1,394 @@
+// External hooks: programs and HTTP endpoints called on events
+
+package home
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Hook event types
+const (
+	hookBlockedQuery  = "blocked_query"
+	hookNewClient     = "new_client"
+	hookFilterUpdated = "filter_updated"
+)
+
+var hookEventTypes = []string{
+	hookBlockedQuery,
+	hookNewClient,
+	hookFilterUpdated,
+}
+
+const (
+	hookQueueSize        = 1000
+	hookTimeout          = 10 * time.Second
+	hookDefaultRateLimit = 60    // executions per minute
+	hookMaxClientsSeen   = 10000 // the maximum number of client addresses remembered for "new_client" event
+)
+
+// An external hook: either a program or an HTTP endpoint
+type hook struct {
+	Name string `yaml:"name"`
+
+	// The program to execute.  The event is passed as JSON object on stdin and in AGH_* environment variables.
+	Command string   `yaml:"command,omitempty"`
+	Args    []string `yaml:"args,omitempty"`
+
+	// The event is sent as JSON object by POST request
+	URL string `yaml:"url,omitempty"`
+
+	Events []string `yaml:"events"` // the event types to send.  Empty: all events
+
+	// The maximum number of executions per minute, the other events are dropped.  0: default (60)
+	RateLimit uint32 `yaml:"rate_limit"`
+}
+
+// A hook event
+type hookEvent struct {
+	Type string `json:"type"`
+	Time string `json:"time"` // RFC3339
+
+	Client string `json:"client,omitempty"` // blocked_query, new_client
+	Host   string `json:"host,omitempty"`   // blocked_query
+	Reason string `json:"reason,omitempty"` // blocked_query
+	Rule   string `json:"rule,omitempty"`   // blocked_query
+
+	FilterURL  string `json:"filter_url,omitempty"`  // filter_updated
+	FilterName string `json:"filter_name,omitempty"` // filter_updated
+	RulesCount int    `json:"rules_count,omitempty"` // filter_updated
+}
+
+// The counters of a hook
+type hookStats struct {
+	Executed  uint64 `json:"executed"`
+	Failed    uint64 `json:"failed"`
+	Dropped   uint64 `json:"dropped"` // by rate limit or because the queue is full
+	LastError string `json:"last_error"`
+
+	windowStart time.Time // the start of the current rate limit window
+	windowCount uint32    // the number of executions in the current window
+}
+
+type hookTask struct {
+	h hook
+	e hookEvent
+}
+
+// Hooks module: the events are queued and passed to hooks in background.
+type hookRunner struct {
+	lock        sync.Mutex
+	stats       map[string]*hookStats // by hook name
+	clientsSeen map[string]bool
+
+	queue  chan hookTask
+	client *http.Client
+}
+
+func newHookRunner() *hookRunner {
+	return &hookRunner{
+		stats:       map[string]*hookStats{},
+		clientsSeen: map[string]bool{},
+		queue:       make(chan hookTask, hookQueueSize),
+		client:      &http.Client{Timeout: hookTimeout},
+	}
+}
+
+// Start passing the events to hooks
+func (hr *hookRunner) start() {
+	go hr.runLoop()
+}
+
+// Check the settings of hooks
+func checkHooksConfig(hooks []hook) error {
+	names := map[string]bool{}
+	for _, h := range hooks {
+		if len(h.Name) == 0 {
+			return fmt.Errorf("hook name is empty")
+		}
+		if names[h.Name] {
+			return fmt.Errorf("duplicate hook name: %s", h.Name)
+		}
+		names[h.Name] = true
+
+		if (len(h.Command) == 0) == (len(h.URL) == 0) {
+			return fmt.Errorf("hook %s: either command or url must be set", h.Name)
+		}
+		if len(h.URL) != 0 {
+			u, err := url.Parse(h.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+				return fmt.Errorf("hook %s: invalid URL: %s", h.Name, h.URL)
+			}
+		}
+
+		for _, e := range h.Events {
+			if !isHookEventType(e) {
+				return fmt.Errorf("hook %s: invalid event type: %s", h.Name, e)
+			}
+		}
+	}
+	return nil
+}
+
+func isHookEventType(t string) bool {
+	for _, e := range hookEventTypes {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Return TRUE if the hook accepts the events of this type
+func (h *hook) accepts(t string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the hooks that accept the events of this type
+func hooksForEvent(t string) []hook {
+	config.RLock()
+	defer config.RUnlock()
+	list := []hook{}
+	for _, h := range config.Hooks {
+		if h.accepts(t) {
+			list = append(list, h)
+		}
+	}
+	return list
+}
+
+// Get the counters of the hook
+// hr.lock must be held.
+func (hr *hookRunner) statsOf(name string) *hookStats {
+	st, ok := hr.stats[name]
+	if !ok {
+		st = &hookStats{}
+		hr.stats[name] = st
+	}
+	return st
+}
+
+// Return TRUE if the rate limit of the hook allows one more execution
+func (hr *hookRunner) allow(h hook, now time.Time) bool {
+	limit := h.RateLimit
+	if limit == 0 {
+		limit = hookDefaultRateLimit
+	}
+
+	hr.lock.Lock()
+	defer hr.lock.Unlock()
+	st := hr.statsOf(h.Name)
+	if now.Sub(st.windowStart) >= time.Minute {
+		st.windowStart = now
+		st.windowCount = 0
+	}
+	if st.windowCount >= limit {
+		st.Dropped++
+		return false
+	}
+	st.windowCount++
+	return true
+}
+
+// Queue the event for all hooks that accept it
+// The module may be nil (not initialized yet).
+func (hr *hookRunner) fire(e hookEvent) {
+	if hr == nil {
+		return
+	}
+	now := time.Now()
+	e.Time = now.Format(time.RFC3339)
+	for _, h := range hooksForEvent(e.Type) {
+		if !hr.allow(h, now) {
+			continue
+		}
+		select {
+		case hr.queue <- hookTask{h: h, e: e}:
+			//
+		default:
+			hr.lock.Lock()
+			hr.statsOf(h.Name).Dropped++
+			hr.lock.Unlock()
+			log.Debug("Hooks: the queue is full, event dropped: %s: %s", h.Name, e.Type)
+		}
+	}
+}
+
+func (hr *hookRunner) runLoop() {
+	for t := range hr.queue {
+		err := hr.run(t.h, t.e)
+
+		hr.lock.Lock()
+		st := hr.statsOf(t.h.Name)
+		st.Executed++
+		st.LastError = ""
+		if err != nil {
+			st.Failed++
+			st.LastError = err.Error()
+		}
+		hr.lock.Unlock()
+
+		if err != nil {
+			log.Info("Hooks: %s: %s", t.h.Name, err)
+		}
+	}
+}
+
+// Pass the event to the hook
+func (hr *hookRunner) run(h hook, e hookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if len(h.URL) != 0 {
+		resp, err := hr.client.Post(h.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("HTTP status %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.Command, h.Args...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(), hookEnv(e)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(out) != 0 {
+			return fmt.Errorf("%s: %s", err, bytes.TrimSpace(out))
+		}
+		return err
+	}
+	return nil
+}
+
+// Get the environment variables for the program
+func hookEnv(e hookEvent) []string {
+	env := []string{
+		"AGH_EVENT=" + e.Type,
+		"AGH_TIME=" + e.Time,
+	}
+	add := func(name, val string) {
+		if len(val) != 0 {
+			env = append(env, name+"="+val)
+		}
+	}
+	add("AGH_CLIENT", e.Client)
+	add("AGH_HOST", e.Host)
+	add("AGH_REASON", e.Reason)
+	add("AGH_RULE", e.Rule)
+	add("AGH_FILTER_URL", e.FilterURL)
+	add("AGH_FILTER_NAME", e.FilterName)
+	if e.Type == hookFilterUpdated {
+		env = append(env, fmt.Sprintf("AGH_RULES_COUNT=%d", e.RulesCount))
+	}
+	return env
+}
+
+// Send "new_client" event when a request from an unknown client is received for the first time
+func (hr *hookRunner) clientSeen(ip string) {
+	if hr == nil || len(hooksForEvent(hookNewClient)) == 0 {
+		return
+	}
+	hr.lock.Lock()
+	if hr.clientsSeen[ip] || len(hr.clientsSeen) >= hookMaxClientsSeen {
+		hr.lock.Unlock()
+		return
+	}
+	hr.clientsSeen[ip] = true
+	hr.lock.Unlock()
+
+	_, ok := Context.clients.Find(ip, "")
+	if ok || Context.clients.Exists(ip, ClientSourceHostsFile) {
+		return
+	}
+	hr.fire(hookEvent{Type: hookNewClient, Client: ip})
+}
+
+// Called by DNS server for each blocked request
+func onDNSBlocked(clientIP, host string, result *dnsfilter.Result) {
+	Context.hooks.fire(hookEvent{
+		Type:   hookBlockedQuery,
+		Client: clientIP,
+		Host:   host,
+		Reason: result.Reason.String(),
+		Rule:   result.Rule,
+	})
+}
+
+// Called when the new data of a filter has been applied
+func onFilterUpdated(f *filter) {
+	Context.hooks.fire(hookEvent{
+		Type:       hookFilterUpdated,
+		FilterURL:  f.URL,
+		FilterName: f.Name,
+		RulesCount: f.RulesCount,
+	})
+}
+
+type hookStatusJSON struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"` // "command" or "url"
+	Events []string `json:"events"`
+	hookStats
+}
+
+type hooksStatusJSON struct {
+	Hooks      []hookStatusJSON `json:"hooks"`
+	EventTypes []string         `json:"event_types"` // the supported event types
+}
+
+// Get the hooks and their counters
+// The commands and URLs aren't returned: they may contain secrets.
+func handleHooksStatus(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	list := append([]hook{}, config.Hooks...)
+	config.RUnlock()
+
+	resp := hooksStatusJSON{Hooks: []hookStatusJSON{}, EventTypes: hookEventTypes}
+	Context.hooks.lock.Lock()
+	for _, h := range list {
+		st := hookStatusJSON{Name: h.Name, Type: "command", Events: h.Events}
+		if len(h.URL) != 0 {
+			st.Type = "url"
+		}
+		if len(st.Events) == 0 {
+			st.Events = hookEventTypes
+		}
+		st.hookStats = *Context.hooks.statsOf(h.Name)
+		resp.Hooks = append(resp.Hooks, st)
+	}
+	Context.hooks.lock.Unlock()
+
+	writeJSON(w, resp)
+}
+
+// RegisterHooksHandlers - register HTTP handlers
+func RegisterHooksHandlers() {
+	httpRegister(http.MethodGet, "/control/hooks/status", handleHooksStatus)
+}
@@ -0,0 +1,106 @@
+package home
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckHooksConfig(t *testing.T) {
+	assert.Nil(t, checkHooksConfig([]hook{
+		{Name: "1", Command: "/usr/local/bin/on-blocked.sh", Events: []string{hookBlockedQuery}},
+		{Name: "2", URL: "https://example.org/hook", RateLimit: 10},
+	}))
+
+	assert.NotNil(t, checkHooksConfig([]hook{{URL: "http://127.0.0.1/"}}))
+	assert.NotNil(t, checkHooksConfig([]hook{
+		{Name: "1", URL: "http://127.0.0.1/"},
+		{Name: "1", URL: "http://127.0.0.2/"},
+	}))
+	assert.NotNil(t, checkHooksConfig([]hook{{Name: "1"}}))
+	assert.NotNil(t, checkHooksConfig([]hook{{Name: "1", Command: "/bin/true", URL: "http://127.0.0.1/"}}))
+	assert.NotNil(t, checkHooksConfig([]hook{{Name: "1", URL: "ftp://127.0.0.1/"}}))
+	assert.NotNil(t, checkHooksConfig([]hook{{Name: "1", Command: "/bin/true", Events: []string{"unknown"}}}))
+}
+
+func TestHookRunner(t *testing.T) {
+	received := make(chan hookEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		e := hookEvent{}
+		_ = json.Unmarshal(data, &e)
+		received <- e
+	}))
+	defer srv.Close()
+
+	config.Hooks = []hook{
+		{Name: "blocked", URL: srv.URL, Events: []string{hookBlockedQuery}, RateLimit: 2},
+		{Name: "filters", URL: srv.URL, Events: []string{hookFilterUpdated}},
+	}
+	defer func() { config.Hooks = nil }()
+
+	hr := newHookRunner()
+	go hr.runLoop()
+	defer close(hr.queue)
+
+	// the third event is dropped by rate limit
+	for i := 0; i != 3; i++ {
+		hr.fire(hookEvent{Type: hookBlockedQuery, Client: "192.168.1.2", Host: "ads.example.org"})
+	}
+	hr.fire(hookEvent{Type: hookFilterUpdated, FilterURL: "https://filters.example.org/1.txt", RulesCount: 10})
+
+	types := map[string]int{}
+	for i := 0; i != 3; i++ {
+		select {
+		case e := <-received:
+			types[e.Type]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+	assert.Equal(t, 2, types[hookBlockedQuery])
+	assert.Equal(t, 1, types[hookFilterUpdated])
+
+	hr.lock.Lock()
+	assert.Equal(t, uint64(1), hr.stats["blocked"].Dropped)
+	hr.lock.Unlock()
+
+	// the window is over
+	hr.lock.Lock()
+	hr.stats["blocked"].windowStart = time.Now().Add(-time.Minute)
+	hr.lock.Unlock()
+	assert.True(t, hr.allow(config.Hooks[0], time.Now()))
+}
+
+func TestHookCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no shell")
+	}
+	dir, err := ioutil.TempDir("", "agh-hooks")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "out")
+
+	hr := newHookRunner()
+	h := hook{Name: "script", Command: "/bin/sh", Args: []string{"-c", `echo "$AGH_EVENT $AGH_HOST" > ` + fn + `; cat >> ` + fn}}
+	e := hookEvent{Type: hookBlockedQuery, Host: "ads.example.org"}
+	assert.Nil(t, hr.run(h, e))
+
+	data, err := ioutil.ReadFile(fn)
+	assert.Nil(t, err)
+	body, _ := json.Marshal(e)
+	assert.Equal(t, "blocked_query ads.example.org\n"+string(body), string(data))
+
+	h.Args = []string{"-c", "echo failed; exit 1"}
+	err = hr.run(h, e)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failed")
+}
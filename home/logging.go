@@ -0,0 +1,353 @@
+// Logging: text or JSON output, per-module levels
+
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Log formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Log modules
+const (
+	logModuleDefault    = "default" // the messages of the other modules
+	logModuleDNSForward = "dnsforward"
+	logModuleFiltering  = "filtering"
+	logModuleDHCP       = "dhcp"
+	logModuleWeb        = "web"
+)
+
+var logModules = []string{logModuleDefault, logModuleDNSForward, logModuleFiltering, logModuleDHCP, logModuleWeb}
+
+// The modules of the packages (by the function name prefix)
+var logPackageModules = []struct {
+	prefix string
+	module string
+}{
+	{"github.com/AdguardTeam/AdGuardHome/dnsforward.", logModuleDNSForward},
+	{"github.com/AdguardTeam/dnsproxy/", logModuleDNSForward},
+	{"github.com/AdguardTeam/AdGuardHome/dnsfilter.", logModuleFiltering},
+	{"github.com/AdguardTeam/urlfilter", logModuleFiltering},
+	{"github.com/AdguardTeam/AdGuardHome/dhcpd.", logModuleDHCP},
+	{"net/http.", logModuleWeb},
+}
+
+// The modules of the source files in "home" package
+var logHomeFileModules = map[string]string{
+	"blocked_services.go":  logModuleFiltering,
+	"control_filtering.go": logModuleFiltering,
+	"filter.go":            logModuleFiltering,
+	"filter_catalog.go":    logModuleFiltering,
+	"filter_changes.go":    logModuleFiltering,
+	"filter_format.go":     logModuleFiltering,
+	"filter_profile.go":    logModuleFiltering,
+	"filter_verify.go":     logModuleFiltering,
+	"filtering_pause.go":   logModuleFiltering,
+	"schedule.go":          logModuleFiltering,
+	"user_rules.go":        logModuleFiltering,
+
+	"dhcp.go": logModuleDHCP,
+
+	"dns.go": logModuleDNSForward,
+
+	"auth.go":            logModuleWeb,
+	"auth_ratelimit.go":  logModuleWeb,
+	"blockpage.go":       logModuleWeb,
+	"clients_http.go":    logModuleWeb,
+	"control.go":         logModuleWeb,
+	"control_install.go": logModuleWeb,
+	"control_tls.go":     logModuleWeb,
+	"control_update.go":  logModuleWeb,
+	"debug.go":           logModuleWeb,
+	"i18n.go":            logModuleWeb,
+	"rebind.go":          logModuleWeb,
+	"tokens.go":          logModuleWeb,
+	"totp.go":            logModuleWeb,
+	"users.go":           logModuleWeb,
+}
+
+// The levels by name
+var logLevelNames = map[string]int{
+	"error": log.ERROR,
+	"info":  log.INFO,
+	"debug": log.DEBUG,
+}
+
+// The number of the last written messages kept in memory
+const logRecentMax = 1000
+
+// "PID#GOID " prefix of the debug messages
+var logDebugPrefix = regexp.MustCompile(`^[0-9]+#[0-9]+ `)
+
+// logWriter - the output of the logger
+// The messages are filtered by the level of the module which has written them.
+type logWriter struct {
+	lock    sync.Mutex
+	out     io.Writer
+	json    bool
+	verbose bool           // the default level is "debug"
+	levels  map[string]int // module -> level
+	recent  []string       // the last written messages (for support bundle)
+}
+
+func isLogModule(name string) bool {
+	for _, m := range logModules {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the settings of the logger
+func checkLogSettings(ls logSettings) error {
+	switch ls.LogFormat {
+	case "", logFormatText, logFormatJSON:
+		//
+	default:
+		return fmt.Errorf("invalid log_format: %s", ls.LogFormat)
+	}
+	return checkLogLevels(ls.LogLevels)
+}
+
+func checkLogLevels(levels map[string]string) error {
+	for m, l := range levels {
+		if !isLogModule(m) {
+			return fmt.Errorf("invalid log module: %s", m)
+		}
+		if _, ok := logLevelNames[l]; !ok {
+			return fmt.Errorf("invalid log level: %s: %s", m, l)
+		}
+	}
+	return nil
+}
+
+// Get the levels of all modules
+// The default level is set by "verbose" setting.  The other modules have the default level unless it's set.
+func getLogLevels(verbose bool, levels map[string]string) map[string]int {
+	def := log.INFO
+	if verbose {
+		def = log.DEBUG
+	}
+	if l, ok := logLevelNames[levels[logModuleDefault]]; ok {
+		def = l
+	}
+
+	m := map[string]int{}
+	for _, name := range logModules {
+		m[name] = def
+		if l, ok := logLevelNames[levels[name]]; ok {
+			m[name] = l
+		}
+	}
+	return m
+}
+
+// Start writing all messages to the output
+func (w *logWriter) init(out io.Writer, ls logSettings) {
+	w.lock.Lock()
+	w.out = out
+	w.json = ls.LogFormat == logFormatJSON
+	w.verbose = ls.Verbose
+	w.lock.Unlock()
+	w.setLevels(getLogLevels(ls.Verbose, ls.LogLevels))
+
+	// the time is written by logWriter
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(w)
+}
+
+// Set the levels of the modules
+// The messages are produced with the highest level, the others are filtered out by logWriter.
+func (w *logWriter) setLevels(levels map[string]int) {
+	max := log.ERROR
+	for _, l := range levels {
+		if l > max {
+			max = l
+		}
+	}
+
+	w.lock.Lock()
+	w.levels = levels
+	w.lock.Unlock()
+	log.SetLevel(max)
+}
+
+// Get the module which has written the message
+func logCallerModule() string {
+	pc := make([]uintptr, 16)
+	n := runtime.Callers(3, pc)
+	frames := runtime.CallersFrames(pc[:n])
+	for {
+		f, more := frames.Next()
+		fn := f.Function
+		if !strings.HasPrefix(fn, "log.") && !strings.HasPrefix(fn, "log/") &&
+			!strings.HasPrefix(fn, "github.com/AdguardTeam/golibs/log.") {
+			if strings.HasPrefix(fn, "github.com/AdguardTeam/AdGuardHome/home.") {
+				m, ok := logHomeFileModules[filepath.Base(f.File)]
+				if ok {
+					return m
+				}
+				return logModuleDefault
+			}
+			for _, it := range logPackageModules {
+				if strings.HasPrefix(fn, it.prefix) {
+					return it.module
+				}
+			}
+			return logModuleDefault
+		}
+		if !more {
+			return logModuleDefault
+		}
+	}
+}
+
+// Parse the message written by golibs/log: "[PID#GOID ][LEVEL] TEXT"
+// The messages written directly by "log" package have "info" level.
+func parseLogMessage(b []byte) (string, string) {
+	msg := string(bytes.TrimRight(b, "\n"))
+	msg = logDebugPrefix.ReplaceAllString(msg, "")
+	if strings.HasPrefix(msg, "[") {
+		i := strings.Index(msg, "] ")
+		if i > 0 {
+			return msg[1:i], msg[i+2:]
+		}
+	}
+	return "info", msg
+}
+
+type logEntryJSON struct {
+	Time   string `json:"time"`
+	Level  string `json:"level"`
+	Module string `json:"module"`
+	Msg    string `json:"msg"`
+}
+
+// Write the message if its level is enabled for the module
+func (w *logWriter) Write(b []byte) (int, error) {
+	module := logCallerModule()
+	level, msg := parseLogMessage(b)
+	now := time.Now()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	l, ok := logLevelNames[level]
+	if ok && l > w.levels[module] {
+		return len(b), nil
+	}
+
+	var data []byte
+	if w.json {
+		data, _ = json.Marshal(logEntryJSON{
+			Time:   now.Format(time.RFC3339Nano),
+			Level:  level,
+			Module: module,
+			Msg:    msg,
+		})
+		data = append(data, '\n')
+	} else {
+		data = append([]byte(now.Format("2006/01/02 15:04:05 ")), b...)
+	}
+	w.recent = append(w.recent, string(data))
+	if len(w.recent) > logRecentMax {
+		w.recent = w.recent[len(w.recent)-logRecentMax:]
+	}
+	_, err := w.out.Write(data)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Get the last written messages
+func (w *logWriter) recentMessages() []byte {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return []byte(strings.Join(w.recent, ""))
+}
+
+type logLevelsJSON struct {
+	Levels map[string]string `json:"levels"`
+}
+
+// Get the current levels of the modules
+func handleLogLevels(w http.ResponseWriter, r *http.Request) {
+	Context.logger.lock.Lock()
+	resp := logLevelsJSON{Levels: map[string]string{}}
+	for m, l := range Context.logger.levels {
+		for name, v := range logLevelNames {
+			if v == l {
+				resp.Levels[m] = name
+			}
+		}
+	}
+	Context.logger.lock.Unlock()
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// Change the levels of the modules
+// The modules which aren't set in the request keep their current levels.
+func handleLogLevelsSet(w http.ResponseWriter, r *http.Request) {
+	req := logLevelsJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+	err = checkLogLevels(req.Levels)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	levels := map[string]string{}
+	for m, l := range config.LogLevels {
+		levels[m] = l
+	}
+	for m, l := range req.Levels {
+		levels[m] = l
+	}
+	config.LogLevels = levels
+	config.Unlock()
+
+	Context.logger.lock.Lock()
+	verbose := Context.logger.verbose
+	Context.logger.lock.Unlock()
+	Context.logger.setLevels(getLogLevels(verbose, levels))
+	log.Info("Log levels: %v", levels)
+	onConfigModified()
+	returnOK(w)
+}
+
+// RegisterLogHandlers - register HTTP handlers
+func RegisterLogHandlers() {
+	httpRegister(http.MethodGet, "/control/log/levels", handleLogLevels)
+	httpRegister(http.MethodPost, "/control/log/levels/set", handleLogLevelsSet)
+}
@@ -0,0 +1,74 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	stdlog "log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevels(t *testing.T) {
+	assert.Nil(t, checkLogSettings(logSettings{LogFormat: logFormatJSON, LogLevels: map[string]string{"dhcp": "debug"}}))
+	assert.NotNil(t, checkLogSettings(logSettings{LogFormat: "xml"}))
+	assert.NotNil(t, checkLogLevels(map[string]string{"querylog": "debug"}))
+	assert.NotNil(t, checkLogLevels(map[string]string{"dhcp": "verbose"}))
+
+	m := getLogLevels(true, map[string]string{logModuleDHCP: "error"})
+	assert.Equal(t, log.DEBUG, m[logModuleDefault])
+	assert.Equal(t, log.DEBUG, m[logModuleWeb])
+	assert.Equal(t, log.ERROR, m[logModuleDHCP])
+
+	m = getLogLevels(true, map[string]string{logModuleDefault: "info", logModuleWeb: "debug"})
+	assert.Equal(t, log.INFO, m[logModuleDefault])
+	assert.Equal(t, log.INFO, m[logModuleFiltering])
+	assert.Equal(t, log.DEBUG, m[logModuleWeb])
+
+	level, msg := parseLogMessage([]byte("123#45 [debug] text [1]\n"))
+	assert.Equal(t, "debug", level)
+	assert.Equal(t, "text [1]", msg)
+	level, msg = parseLogMessage([]byte("http: TLS handshake error\n"))
+	assert.Equal(t, "info", level)
+	assert.Equal(t, "http: TLS handshake error", msg)
+}
+
+func TestLogWriter(t *testing.T) {
+	defer func() {
+		stdlog.SetFlags(stdlog.LstdFlags)
+		stdlog.SetOutput(os.Stderr)
+		log.SetLevel(log.INFO)
+	}()
+
+	buf := &bytes.Buffer{}
+	w := &logWriter{}
+	w.init(buf, logSettings{LogFormat: logFormatJSON, LogLevels: map[string]string{logModuleWeb: "debug"}})
+	assert.Equal(t, log.DEBUG, log.GetLevel())
+
+	// the default module has "info" level
+	log.Debug("debug message")
+	log.Info("info message")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 1, len(lines))
+	e := logEntryJSON{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &e))
+	assert.Equal(t, "info", e.Level)
+	assert.Equal(t, logModuleDefault, e.Module)
+	assert.Equal(t, "info message", e.Msg)
+
+	buf.Reset()
+	w.setLevels(getLogLevels(false, map[string]string{logModuleDefault: "error"}))
+	assert.Equal(t, log.ERROR, log.GetLevel())
+	log.Info("info message")
+	log.Error("error message")
+	assert.True(t, strings.Contains(buf.String(), `"msg":"error message"`))
+	assert.False(t, strings.Contains(buf.String(), "info message"))
+
+	// the written messages are kept for support bundle
+	recent := string(w.recentMessages())
+	assert.Equal(t, 2, strings.Count(recent, "\n"))
+	assert.True(t, strings.HasSuffix(recent, `"msg":"error message"}`+"\n"))
+}
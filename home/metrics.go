@@ -0,0 +1,159 @@
+package home
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+	"github.com/AdguardTeam/AdGuardHome/metrics"
+)
+
+// Settings of the metrics endpoint
+type metricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// If TRUE, the same authentication as for the web interface is required (if it's configured)
+	RequireAuth bool `yaml:"require_auth"`
+
+	// IP addresses or CIDR ranges of the clients that may access the endpoint.  Empty: all clients
+	AllowedClients []string `yaml:"allowed_clients"`
+}
+
+// The counters of filter updates (atomic)
+var (
+	filterUpdatesSucceeded uint64
+	filterUpdatesFailed    uint64
+)
+
+// Count the result of a filter update attempt
+func countFilterUpdate(err error) {
+	if err != nil {
+		atomic.AddUint64(&filterUpdatesFailed, 1)
+	} else {
+		atomic.AddUint64(&filterUpdatesSucceeded, 1)
+	}
+}
+
+// Return TRUE if the client may access the metrics endpoint
+func metricsClientAllowed(allowed []string, remoteAddr string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, s := range allowed {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err == nil {
+			if ipnet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		a := net.ParseIP(s)
+		if a != nil && a.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the settings of the metrics endpoint
+func checkMetricsConfig(c metricsConfig) error {
+	for _, s := range c.AllowedClients {
+		if net.ParseIP(s) == nil {
+			_, _, err := net.ParseCIDR(s)
+			if err != nil {
+				return fmt.Errorf("invalid client address: %s", s)
+			}
+		}
+	}
+	return nil
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	c := config.Metrics
+	config.RUnlock()
+
+	if !c.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "This request must be GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if !metricsClientAllowed(c.AllowedClients, r.RemoteAddr) {
+		httpError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	if c.RequireAuth {
+		optionalAuth(writeMetrics)(w, r)
+		return
+	}
+	writeMetrics(w, r)
+}
+
+// Write the metrics of all modules
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	mw := metrics.NewWriter(w)
+
+	if Context.dnsServer != nil {
+		Context.dnsServer.WriteMetrics(mw)
+	}
+
+	writeFilterMetrics(mw)
+
+	if Context.dhcpServer != nil {
+		mw.Header("adguardhome_dhcp_leases", metrics.Gauge, "The number of DHCP leases")
+		mw.Value("adguardhome_dhcp_leases", float64(len(Context.dhcpServer.Leases(dhcpd.LeasesDynamic))), "type", "dynamic")
+		mw.Value("adguardhome_dhcp_leases", float64(len(Context.dhcpServer.Leases(dhcpd.LeasesStatic))), "type", "static")
+	}
+}
+
+func writeFilterMetrics(mw *metrics.Writer) {
+	mw.Header("adguardhome_filter_rules", metrics.Gauge, "The number of rules in enabled filter lists")
+	nUserRules := 0
+	config.RLock()
+	for _, f := range config.Filters {
+		if f.Enabled {
+			mw.Value("adguardhome_filter_rules", float64(f.RulesCount),
+				"id", strconv.FormatInt(f.ID, 10), "name", f.Name, "type", "blocklist")
+		}
+	}
+	for _, f := range config.WhitelistFilters {
+		if f.Enabled {
+			mw.Value("adguardhome_filter_rules", float64(f.RulesCount),
+				"id", strconv.FormatInt(f.ID, 10), "name", f.Name, "type", "allowlist")
+		}
+	}
+	for _, r := range config.UserRules {
+		if r.Enabled {
+			nUserRules++
+		}
+	}
+	config.RUnlock()
+
+	mw.Header("adguardhome_user_rules", metrics.Gauge, "The number of enabled user rules")
+	mw.Value("adguardhome_user_rules", float64(nUserRules))
+
+	mw.Header("adguardhome_filter_updates_total", metrics.Counter, "The number of filter update attempts by result")
+	mw.Value("adguardhome_filter_updates_total", float64(atomic.LoadUint64(&filterUpdatesSucceeded)), "result", "success")
+	mw.Value("adguardhome_filter_updates_total", float64(atomic.LoadUint64(&filterUpdatesFailed)), "result", "failure")
+}
+
+// RegisterMetricsHandlers - register the handler of the metrics endpoint
+func RegisterMetricsHandlers() {
+	http.HandleFunc("/metrics", postInstall(handleMetrics))
+}
@@ -0,0 +1,21 @@
+package home
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsClientAllowed(t *testing.T) {
+	assert.True(t, metricsClientAllowed(nil, "1.2.3.4:1234"))
+
+	allowed := []string{"127.0.0.1", "192.168.0.0/16", "::1"}
+	assert.True(t, metricsClientAllowed(allowed, "127.0.0.1:1234"))
+	assert.True(t, metricsClientAllowed(allowed, "192.168.1.2:1234"))
+	assert.True(t, metricsClientAllowed(allowed, "[::1]:1234"))
+	assert.False(t, metricsClientAllowed(allowed, "10.0.0.1:1234"))
+	assert.False(t, metricsClientAllowed(allowed, "invalid"))
+
+	assert.Nil(t, checkMetricsConfig(metricsConfig{AllowedClients: allowed}))
+	assert.NotNil(t, checkMetricsConfig(metricsConfig{AllowedClients: []string{"1.2.3"}}))
+}
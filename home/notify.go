@@ -0,0 +1,423 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Notification event types
+const (
+	notifyFilterUpdateFailed  = "filter_update_failed"
+	notifyUpstreamDown        = "upstream_down"
+	notifyNewClient           = "new_client"
+	notifyDiskFull            = "disk_full"
+	notifyCertificateExpiring = "certificate_expiring"
+	notifyTest                = "test" // sent by "API: Test webhook" only
+)
+
+var notifyEventTypes = []string{
+	notifyFilterUpdateFailed,
+	notifyUpstreamDown,
+	notifyNewClient,
+	notifyDiskFull,
+	notifyCertificateExpiring,
+}
+
+// Webhook formats
+const (
+	webhookFormatJSON     = "json"     // notifyEvent object
+	webhookFormatSlack    = "slack"    // Slack incoming webhook: {"text":"..."}
+	webhookFormatTelegram = "telegram" // Telegram Bot API sendMessage method: {"chat_id":"...","text":"..."}
+)
+
+const (
+	notifyQueueSize       = 100
+	notifyTimeout         = 10 * time.Second
+	notifyCheckInterval   = 1 * time.Hour  // interval between the checks of disk space and TLS certificate
+	notifyRepeatInterval  = 24 * time.Hour // the same event isn't sent again during this time
+	notifyMaxClientsSeen  = 10000          // the maximum number of client addresses remembered for "new_client" event
+	notifyDefaultDiskFree = 5              // in percent
+	notifyDefaultCertDays = 14
+)
+
+// A destination of notifications
+type webhook struct {
+	Name   string   `yaml:"name" json:"name"`
+	URL    string   `yaml:"url" json:"url"`
+	Format string   `yaml:"format" json:"format"`                       // "json", "slack" or "telegram".  Empty: "json"
+	ChatID string   `yaml:"chat_id,omitempty" json:"chat_id,omitempty"` // for "telegram" format
+	Events []string `yaml:"events" json:"events"`                       // the event types to send.  Empty: all events
+}
+
+// Settings of notifications
+type notificationsConfig struct {
+	Webhooks []webhook `yaml:"webhooks" json:"webhooks"`
+
+	// "disk_full" event is sent when the available space on the disk with the data directory
+	// is less than this value (in percent).  0: default (5)
+	DiskFreeMinPercent uint32 `yaml:"disk_free_min_percent" json:"disk_free_min_percent"`
+
+	// "certificate_expiring" event is sent when TLS certificate expires
+	// in less than this number of days.  0: default (14)
+	CertificateExpireDays uint32 `yaml:"certificate_expire_days" json:"certificate_expire_days"`
+}
+
+// A notification event
+type notifyEvent struct {
+	Type    string `json:"type"`
+	Time    string `json:"time"`   // RFC3339
+	Target  string `json:"target"` // the object of the event: filter URL, upstream address, client IP, directory or server name
+	Message string `json:"message"`
+}
+
+// Notification module: the events are queued and sent to webhooks in background.
+type notifier struct {
+	lock        sync.Mutex
+	lastSent    map[string]time.Time // the time when the event was sent by its type and target
+	clientsSeen map[string]bool
+
+	queue  chan notifyEvent
+	client *http.Client
+}
+
+func newNotifier() *notifier {
+	return &notifier{
+		lastSent:    map[string]time.Time{},
+		clientsSeen: map[string]bool{},
+		queue:       make(chan notifyEvent, notifyQueueSize),
+		client:      &http.Client{Timeout: notifyTimeout},
+	}
+}
+
+// Start sending the events and periodic checks
+func (n *notifier) start() {
+	go n.sendLoop()
+	go n.checkLoop()
+}
+
+// Check the settings of notifications
+func checkNotificationsConfig(c notificationsConfig) error {
+	names := map[string]bool{}
+	for _, wh := range c.Webhooks {
+		if len(wh.Name) == 0 {
+			return fmt.Errorf("webhook name is empty")
+		}
+		if names[wh.Name] {
+			return fmt.Errorf("duplicate webhook name: %s", wh.Name)
+		}
+		names[wh.Name] = true
+
+		u, err := url.Parse(wh.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("webhook %s: invalid URL: %s", wh.Name, wh.URL)
+		}
+
+		switch wh.Format {
+		case "", webhookFormatJSON, webhookFormatSlack:
+			//
+		case webhookFormatTelegram:
+			if len(wh.ChatID) == 0 {
+				return fmt.Errorf("webhook %s: chat_id is required for telegram format", wh.Name)
+			}
+		default:
+			return fmt.Errorf("webhook %s: invalid format: %s", wh.Name, wh.Format)
+		}
+
+		for _, e := range wh.Events {
+			if !isNotifyEventType(e) {
+				return fmt.Errorf("webhook %s: invalid event type: %s", wh.Name, e)
+			}
+		}
+	}
+	if c.DiskFreeMinPercent > 100 {
+		return fmt.Errorf("invalid disk_free_min_percent: %d", c.DiskFreeMinPercent)
+	}
+	return nil
+}
+
+func isNotifyEventType(t string) bool {
+	for _, e := range notifyEventTypes {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Return TRUE if the webhook accepts the events of this type
+func (wh *webhook) accepts(t string) bool {
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the webhooks that accept the events of this type
+func webhooksForEvent(t string) []webhook {
+	config.RLock()
+	defer config.RUnlock()
+	list := []webhook{}
+	for _, wh := range config.Notifications.Webhooks {
+		if wh.accepts(t) {
+			list = append(list, wh)
+		}
+	}
+	return list
+}
+
+// Queue the event
+// The notifier may be nil (not initialized yet).
+// The event is dropped if the queue is full or if there are no webhooks for it.
+func (n *notifier) notify(t, target, msg string) {
+	if n == nil || len(webhooksForEvent(t)) == 0 {
+		return
+	}
+	e := notifyEvent{
+		Type:    t,
+		Time:    time.Now().Format(time.RFC3339),
+		Target:  target,
+		Message: msg,
+	}
+	select {
+	case n.queue <- e:
+		//
+	default:
+		log.Info("Notify: the queue is full, event dropped: %s: %s", t, msg)
+	}
+}
+
+// Queue the event unless the same event has been sent recently
+func (n *notifier) notifyOnce(t, target, msg string) {
+	if n == nil {
+		return
+	}
+	key := t + " " + target
+	now := time.Now()
+	n.lock.Lock()
+	last, ok := n.lastSent[key]
+	if ok && now.Sub(last) < notifyRepeatInterval {
+		n.lock.Unlock()
+		return
+	}
+	n.lastSent[key] = now
+	n.lock.Unlock()
+
+	n.notify(t, target, msg)
+}
+
+// Send "new_client" event when a request from an unknown client is received for the first time
+func (n *notifier) clientSeen(ip string) {
+	if n == nil || len(webhooksForEvent(notifyNewClient)) == 0 {
+		return
+	}
+	n.lock.Lock()
+	if n.clientsSeen[ip] || len(n.clientsSeen) >= notifyMaxClientsSeen {
+		n.lock.Unlock()
+		return
+	}
+	n.clientsSeen[ip] = true
+	n.lock.Unlock()
+
+	_, ok := Context.clients.Find(ip, "")
+	if ok || Context.clients.Exists(ip, ClientSourceHostsFile) {
+		return
+	}
+	n.notify(notifyNewClient, ip, fmt.Sprintf("New client: %s", ip))
+}
+
+func (n *notifier) sendLoop() {
+	for e := range n.queue {
+		for _, wh := range webhooksForEvent(e.Type) {
+			err := n.send(wh, e)
+			if err != nil {
+				log.Info("Notify: webhook %s: %s", wh.Name, err)
+			}
+		}
+	}
+}
+
+// Get the request body for the webhook
+func webhookBody(wh webhook, e notifyEvent) ([]byte, error) {
+	text := "AdGuard Home: " + e.Message
+	switch wh.Format {
+	case webhookFormatSlack:
+		return json.Marshal(map[string]string{"text": text})
+	case webhookFormatTelegram:
+		return json.Marshal(map[string]string{"chat_id": wh.ChatID, "text": text})
+	}
+	return json.Marshal(e)
+}
+
+// Send the event to the webhook
+func (n *notifier) send(wh webhook, e notifyEvent) error {
+	body, err := webhookBody(wh, e)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(wh.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (n *notifier) checkLoop() {
+	for {
+		n.checkDiskSpace()
+		n.checkCertificate()
+		time.Sleep(notifyCheckInterval)
+	}
+}
+
+// Send "disk_full" event if the available disk space is low
+func (n *notifier) checkDiskSpace() {
+	config.RLock()
+	minPercent := config.Notifications.DiskFreeMinPercent
+	config.RUnlock()
+	if minPercent == 0 {
+		minPercent = notifyDefaultDiskFree
+	}
+
+	dir := Context.getDataDir()
+	avail, total, err := util.DiskUsage(dir)
+	if err != nil || total == 0 {
+		log.Debug("Notify: can't get disk usage of %s: %v", dir, err)
+		return
+	}
+	if avail*100/total < uint64(minPercent) {
+		n.notifyOnce(notifyDiskFull, dir, fmt.Sprintf("Low disk space for query log and statistics in %s: %d MB available (%d%%)",
+			dir, avail/(1024*1024), avail*100/total))
+	}
+}
+
+// Send "certificate_expiring" event if TLS certificate expires soon
+func (n *notifier) checkCertificate() {
+	config.RLock()
+	enabled := config.TLS.Enabled
+	notAfter := config.TLS.NotAfter
+	serverName := config.TLS.ServerName
+	config.RUnlock()
+
+	if enabled && tlsExpiresSoon(notAfter) {
+		n.notifyOnce(notifyCertificateExpiring, serverName, fmt.Sprintf("TLS certificate for %s expires on %s",
+			serverName, notAfter.Format(time.RFC3339)))
+	}
+}
+
+// Called when DNS server considers an upstream server down
+func onUpstreamDown(address string, err error) {
+	Context.notifier.notify(notifyUpstreamDown, address, fmt.Sprintf("Upstream server %s is down: %s", address, err))
+}
+
+// Called when a filter couldn't be updated
+func onFilterUpdateFailed(url string, err error) {
+	Context.notifier.notifyOnce(notifyFilterUpdateFailed, url, fmt.Sprintf("Failed to update filter %s: %s", url, err))
+}
+
+type notificationsJSON struct {
+	notificationsConfig
+	EventTypes []string `json:"event_types"` // the supported event types
+}
+
+func handleNotifications(w http.ResponseWriter, r *http.Request) {
+	resp := notificationsJSON{EventTypes: notifyEventTypes}
+	config.RLock()
+	resp.notificationsConfig = config.Notifications
+	resp.Webhooks = append([]webhook{}, config.Notifications.Webhooks...)
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleNotificationsConfig(w http.ResponseWriter, r *http.Request) {
+	c := notificationsConfig{}
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	err = checkNotificationsConfig(c)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	config.Notifications = c
+	config.Unlock()
+	onConfigModified()
+
+	httpOK(r, w)
+}
+
+type webhookTestJSON struct {
+	Name string `json:"name"`
+}
+
+// Send a test event to the webhook
+func handleNotificationsTest(w http.ResponseWriter, r *http.Request) {
+	req := webhookTestJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	var wh *webhook
+	config.RLock()
+	for _, it := range config.Notifications.Webhooks {
+		if it.Name == req.Name {
+			found := it
+			wh = &found
+			break
+		}
+	}
+	config.RUnlock()
+	if wh == nil {
+		httpError(w, http.StatusBadRequest, "webhook %s not found", req.Name)
+		return
+	}
+
+	e := notifyEvent{
+		Type:    notifyTest,
+		Time:    time.Now().Format(time.RFC3339),
+		Target:  wh.Name,
+		Message: "Test notification",
+	}
+	err = Context.notifier.send(*wh, e)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, "webhook %s: %s", wh.Name, err)
+		return
+	}
+
+	httpOK(r, w)
+}
+
+// RegisterNotificationsHandlers - register HTTP handlers
+func RegisterNotificationsHandlers() {
+	httpRegister(http.MethodGet, "/control/notifications", handleNotifications)
+	httpRegister(http.MethodPost, "/control/notifications/config", handleNotificationsConfig)
+	httpRegister(http.MethodPost, "/control/notifications/test", handleNotificationsTest)
+}
@@ -0,0 +1,92 @@
+package home
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckNotificationsConfig(t *testing.T) {
+	assert.Nil(t, checkNotificationsConfig(notificationsConfig{
+		Webhooks: []webhook{
+			{Name: "1", URL: "http://127.0.0.1/hook"},
+			{Name: "2", URL: "https://hooks.slack.com/services/x", Format: "slack", Events: []string{"upstream_down"}},
+			{Name: "3", URL: "https://api.telegram.org/botX/sendMessage", Format: "telegram", ChatID: "123"},
+		},
+	}))
+
+	assert.NotNil(t, checkNotificationsConfig(notificationsConfig{Webhooks: []webhook{{URL: "http://127.0.0.1/"}}}))
+	assert.NotNil(t, checkNotificationsConfig(notificationsConfig{Webhooks: []webhook{
+		{Name: "1", URL: "http://127.0.0.1/"},
+		{Name: "1", URL: "http://127.0.0.2/"},
+	}}))
+	assert.NotNil(t, checkNotificationsConfig(notificationsConfig{Webhooks: []webhook{{Name: "1", URL: "ftp://127.0.0.1/"}}}))
+	assert.NotNil(t, checkNotificationsConfig(notificationsConfig{Webhooks: []webhook{{Name: "1", URL: "http://127.0.0.1/", Format: "xml"}}}))
+	assert.NotNil(t, checkNotificationsConfig(notificationsConfig{Webhooks: []webhook{{Name: "1", URL: "http://127.0.0.1/", Format: "telegram"}}}))
+	assert.NotNil(t, checkNotificationsConfig(notificationsConfig{Webhooks: []webhook{{Name: "1", URL: "http://127.0.0.1/", Events: []string{"unknown"}}}}))
+	assert.NotNil(t, checkNotificationsConfig(notificationsConfig{DiskFreeMinPercent: 101}))
+}
+
+func TestWebhookBody(t *testing.T) {
+	e := notifyEvent{Type: notifyUpstreamDown, Target: "8.8.8.8:53", Message: "Upstream server 8.8.8.8:53 is down"}
+
+	data, _ := webhookBody(webhook{}, e)
+	e2 := notifyEvent{}
+	assert.Nil(t, json.Unmarshal(data, &e2))
+	assert.Equal(t, e, e2)
+
+	data, _ = webhookBody(webhook{Format: webhookFormatSlack}, e)
+	assert.Equal(t, `{"text":"AdGuard Home: Upstream server 8.8.8.8:53 is down"}`, string(data))
+
+	data, _ = webhookBody(webhook{Format: webhookFormatTelegram, ChatID: "123"}, e)
+	assert.Equal(t, `{"chat_id":"123","text":"AdGuard Home: Upstream server 8.8.8.8:53 is down"}`, string(data))
+}
+
+func TestNotifier(t *testing.T) {
+	received := make(chan notifyEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		e := notifyEvent{}
+		_ = json.Unmarshal(data, &e)
+		received <- e
+	}))
+	defer srv.Close()
+
+	config.Notifications = notificationsConfig{Webhooks: []webhook{
+		{Name: "all", URL: srv.URL},
+		{Name: "filters", URL: srv.URL, Events: []string{notifyFilterUpdateFailed}},
+	}}
+	defer func() { config.Notifications = notificationsConfig{} }()
+
+	n := newNotifier()
+	go n.sendLoop()
+	defer close(n.queue)
+
+	// both webhooks accept the event, but it's sent only once during the repeat interval
+	n.notifyOnce(notifyFilterUpdateFailed, "https://filters.example.org/1.txt", "Failed to update filter")
+	n.notifyOnce(notifyFilterUpdateFailed, "https://filters.example.org/1.txt", "Failed to update filter")
+	n.notify(notifyUpstreamDown, "8.8.8.8:53", "Upstream server is down")
+
+	types := []string{}
+	for i := 0; i != 3; i++ {
+		select {
+		case e := <-received:
+			types = append(types, e.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+	assert.Equal(t, []string{notifyFilterUpdateFailed, notifyFilterUpdateFailed, notifyUpstreamDown}, types)
+
+	select {
+	case e := <-received:
+		t.Fatalf("unexpected event: %v", e)
+	case <-time.After(100 * time.Millisecond):
+		//
+	}
+}
@@ -0,0 +1,75 @@
+// Outbound proxy for the connections to remote servers: filter downloads, version checks and DNS-over-HTTPS upstreams
+
+package home
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type proxyConfig struct {
+	// URL of the proxy: "http://[user:password@]host:port" (HTTP CONNECT) or "socks5://[user:password@]host:port"
+	// Empty: the connections are direct
+	URL string `yaml:"url"`
+
+	// If TRUE, DNS-over-HTTPS upstream servers are connected through the proxy too
+	Upstreams bool `yaml:"upstreams"`
+}
+
+// Parse and check the proxy URL
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if len(u.Hostname()) == 0 || len(u.Port()) == 0 {
+		return nil, fmt.Errorf("host and port are required")
+	}
+	if (len(u.Path) != 0 && u.Path != "/") || len(u.RawQuery) != 0 {
+		return nil, fmt.Errorf("path and query aren't allowed")
+	}
+	return u, nil
+}
+
+func checkProxyConfig(conf proxyConfig) error {
+	if len(conf.URL) == 0 {
+		if conf.Upstreams {
+			return fmt.Errorf("url is required")
+		}
+		return nil
+	}
+	_, err := parseProxyURL(conf.URL)
+	if err != nil {
+		return fmt.Errorf("url: %s", err)
+	}
+	return nil
+}
+
+// Get the proxy for the request (see http.Transport.Proxy)
+// The requests to the local host are sent directly.
+func outboundProxy(req *http.Request) (*url.URL, error) {
+	if len(config.Proxy.URL) == 0 {
+		return nil, nil
+	}
+	host := req.URL.Hostname()
+	ip := net.ParseIP(host)
+	if strings.EqualFold(host, "localhost") || (ip != nil && ip.IsLoopback()) {
+		return nil, nil
+	}
+	return parseProxyURL(config.Proxy.URL)
+}
+
+// Get the proxy for DNS-over-HTTPS upstream servers (nil: no proxy)
+func upstreamProxy() *url.URL {
+	if !config.Proxy.Upstreams || len(config.Proxy.URL) == 0 {
+		return nil
+	}
+	u, _ := parseProxyURL(config.Proxy.URL)
+	return u
+}
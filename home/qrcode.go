@@ -0,0 +1,483 @@
+// QR code encoder (ISO/IEC 18004) for the provisioning URI of 2FA secret
+// Only byte mode, error correction level M and versions 1-10 are supported.
+
+package home
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// Error correction parameters for level M
+type qrVersion struct {
+	ecLen   int    // the number of EC codewords in each block
+	blocks  [2]int // the number of blocks in group 1 and group 2
+	dataLen [2]int // the number of data codewords in each block of group 1 and group 2
+	align   []int  // the positions of alignment patterns
+}
+
+var qrVersions = []qrVersion{
+	{}, // versions start at 1
+	{10, [2]int{1, 0}, [2]int{16, 0}, nil},
+	{16, [2]int{1, 0}, [2]int{28, 0}, []int{6, 18}},
+	{26, [2]int{1, 0}, [2]int{44, 0}, []int{6, 22}},
+	{18, [2]int{2, 0}, [2]int{32, 0}, []int{6, 26}},
+	{24, [2]int{2, 0}, [2]int{43, 0}, []int{6, 30}},
+	{16, [2]int{4, 0}, [2]int{27, 0}, []int{6, 34}},
+	{18, [2]int{4, 0}, [2]int{31, 0}, []int{6, 22, 38}},
+	{22, [2]int{2, 2}, [2]int{38, 39}, []int{6, 24, 42}},
+	{22, [2]int{3, 2}, [2]int{36, 37}, []int{6, 26, 46}},
+	{26, [2]int{4, 1}, [2]int{43, 44}, []int{6, 28, 50}},
+}
+
+const qrECLevelM = 0 // format information bits for level M
+
+func (v *qrVersion) dataCodewords() int {
+	return v.blocks[0]*v.dataLen[0] + v.blocks[1]*v.dataLen[1]
+}
+
+// QR code matrix
+type qrCode struct {
+	size     int
+	modules  [][]bool // [y][x], true: dark
+	function [][]bool // [y][x], true: the module isn't used for data
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// Append the bits of data codewords
+type qrBits []bool
+
+func (b *qrBits) append(val uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (val>>uint(i))&1 != 0)
+	}
+}
+
+// Multiply in GF(256) with polynomial 0x11d
+func qrMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11d)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// Get Reed-Solomon error correction codewords for the data
+func qrReedSolomon(data []byte, n int) []byte {
+	// generator polynomial (x - 2^0)(x - 2^1)...(x - 2^(n-1)), without the leading term
+	gen := make([]byte, n)
+	gen[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			gen[j] = qrMul(gen[j], root)
+			if j+1 < n {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = qrMul(root, 2)
+	}
+
+	res := make([]byte, n)
+	for _, b := range data {
+		factor := b ^ res[0]
+		copy(res, res[1:])
+		res[n-1] = 0
+		for i := range res {
+			res[i] ^= qrMul(gen[i], factor)
+		}
+	}
+	return res
+}
+
+// Get the data and error correction codewords in the order of placement
+func qrCodewords(data []byte, ver int) ([]byte, error) {
+	v := &qrVersions[ver]
+	capacity := v.dataCodewords()
+	countBits := 8
+	if ver >= 10 {
+		countBits = 16
+	}
+	if 4+countBits+len(data)*8 > capacity*8 {
+		return nil, fmt.Errorf("data is too long")
+	}
+
+	bits := qrBits{}
+	bits.append(4, 4) // byte mode
+	bits.append(uint(len(data)), countBits)
+	for _, b := range data {
+		bits.append(uint(b), 8)
+	}
+	// terminator and padding to the byte boundary
+	term := capacity*8 - len(bits)
+	if term > 4 {
+		term = 4
+	}
+	bits.append(0, term)
+	bits.append(0, (8-len(bits)%8)%8)
+
+	cw := make([]byte, capacity)
+	for i, bit := range bits {
+		if bit {
+			cw[i/8] |= 1 << uint(7-i%8)
+		}
+	}
+	for i := len(bits) / 8; i < capacity; i++ {
+		cw[i] = 0xec
+		if (i-len(bits)/8)%2 == 1 {
+			cw[i] = 0x11
+		}
+	}
+
+	// split into blocks
+	var blocks [][]byte
+	var ecBlocks [][]byte
+	for g := 0; g < 2; g++ {
+		for i := 0; i < v.blocks[g]; i++ {
+			b := cw[:v.dataLen[g]]
+			cw = cw[v.dataLen[g]:]
+			blocks = append(blocks, b)
+			ecBlocks = append(ecBlocks, qrReedSolomon(b, v.ecLen))
+		}
+	}
+
+	// interleave
+	res := []byte{}
+	for i := 0; i < v.dataLen[0] || i < v.dataLen[1]; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				res = append(res, b[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecLen; i++ {
+		for _, b := range ecBlocks {
+			res = append(res, b[i])
+		}
+	}
+	return res, nil
+}
+
+// Get the remainder of BCH code
+func qrBCH(val uint, gen uint, genBits uint) uint {
+	n := genBits - 1
+	r := val << n
+	for i := genBits + n - 1; i >= n; i-- {
+		if r&(1<<i) != 0 {
+			r ^= gen << (i - n)
+		}
+	}
+	return val<<n | r
+}
+
+// Get 15 bits of format information
+func qrFormatBits(mask int) uint {
+	return qrBCH(uint(qrECLevelM<<3|mask), 0x537, 11) ^ 0x5412
+}
+
+// Get 18 bits of version information
+func qrVersionBits(ver int) uint {
+	return qrBCH(uint(ver), 0x1f25, 13)
+}
+
+func newQRCode(ver int) *qrCode {
+	q := &qrCode{size: ver*4 + 17}
+	q.modules = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, q.size)
+		q.function[i] = make([]bool, q.size)
+	}
+
+	// timing patterns
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	// finder patterns with separators
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || x >= q.size || y < 0 || y >= q.size {
+					continue
+				}
+				dist := qrMax(qrAbs(dx), qrAbs(dy))
+				q.set(x, y, dist != 2 && dist != 4)
+			}
+		}
+	}
+
+	// alignment patterns
+	align := qrVersions[ver].align
+	last := len(align) - 1
+	for i, ay := range align {
+		for j, ax := range align {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue // finder pattern is here
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(ax+dx, ay+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// version information
+	if ver >= 7 {
+		bits := qrVersionBits(ver)
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 != 0
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+
+	// reserve the modules for format information
+	q.drawFormat(0)
+	return q
+}
+
+// Draw format information
+func (q *qrCode) drawFormat(mask int) {
+	bits := qrFormatBits(mask)
+	bit := func(i int) bool {
+		return (bits>>uint(i))&1 != 0
+	}
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true) // dark module
+}
+
+// Call the function for each data module in the order of placement
+func (q *qrCode) forEachData(f func(x, y int)) {
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if upward {
+				y = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if !q.function[y][x] {
+					f(x, y)
+				}
+			}
+		}
+	}
+}
+
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	q.forEachData(func(x, y int) {
+		if i < len(data)*8 {
+			q.modules[y][x] = (data[i/8]>>uint(7-i%8))&1 != 0
+			i++
+		}
+	})
+}
+
+func qrMaskBit(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	}
+	return ((x+y)%2+x*y%3)%2 == 0
+}
+
+// Apply the mask to the data modules.  Applying the same mask twice restores the data.
+func (q *qrCode) applyMask(mask int) {
+	q.forEachData(func(x, y int) {
+		if qrMaskBit(mask, x, y) {
+			q.modules[y][x] = !q.modules[y][x]
+		}
+	})
+}
+
+// Get the penalty score for the mask selection
+func (q *qrCode) penalty() int {
+	score := 0
+	get := func(i, j int, vertical bool) bool {
+		if vertical {
+			return q.modules[j][i]
+		}
+		return q.modules[i][j]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+
+	for _, vertical := range []bool{false, true} {
+		for i := 0; i < q.size; i++ {
+			// runs of the same color
+			run := 1
+			for j := 1; j <= q.size; j++ {
+				if j < q.size && get(i, j, vertical) == get(i, j-1, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+
+			// finder-like patterns with 4 light modules on either side
+			for j := 0; j+7 <= q.size; j++ {
+				match := true
+				for k, dark := range finder {
+					if get(i, j+k, vertical) != dark {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				for _, side := range [][2]int{{j - 4, j}, {j + 7, j + 11}} {
+					light := true
+					for k := side[0]; k < side[1]; k++ {
+						if k >= 0 && k < q.size && get(i, k, vertical) {
+							light = false
+						}
+					}
+					if light {
+						score += 40
+					}
+				}
+			}
+		}
+	}
+
+	// 2x2 blocks of the same color
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					score += 3
+				}
+			}
+		}
+	}
+
+	// the balance of dark and light modules
+	total := q.size * q.size
+	score += qrAbs(dark*20-total*10) / total * 10
+	return score
+}
+
+// Encode the data into QR code with the smallest version and the best mask
+func qrEncode(data []byte) (*qrCode, error) {
+	for ver := 1; ver < len(qrVersions); ver++ {
+		cw, err := qrCodewords(data, ver)
+		if err != nil {
+			continue
+		}
+
+		q := newQRCode(ver)
+		q.drawCodewords(cw)
+		best, bestScore := 0, -1
+		for mask := 0; mask < 8; mask++ {
+			q.applyMask(mask)
+			q.drawFormat(mask)
+			score := q.penalty()
+			if bestScore < 0 || score < bestScore {
+				best, bestScore = mask, score
+			}
+			q.applyMask(mask)
+		}
+		q.applyMask(best)
+		q.drawFormat(best)
+		return q, nil
+	}
+	return nil, fmt.Errorf("QR code: data is too long: %d bytes", len(data))
+}
+
+// Get PNG image of QR code
+// scale: the size of a module in pixels
+func qrPNG(data []byte, scale int) ([]byte, error) {
+	q, err := qrEncode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	const border = 4 // quiet zone, in modules
+	n := (q.size + 2*border) * scale
+	img := image.NewGray(image.Rect(0, 0, n, n))
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			mx, my := x/scale-border, y/scale-border
+			c := color.Gray{Y: 0xff}
+			if mx >= 0 && mx < q.size && my >= 0 && my < q.size && q.modules[my][mx] {
+				c = color.Gray{Y: 0}
+			}
+			img.SetGray(x, y, c)
+		}
+	}
+
+	buf := bytes.Buffer{}
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func qrAbs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func qrMax(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
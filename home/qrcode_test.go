@@ -0,0 +1,146 @@
+package home
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQRReedSolomon(t *testing.T) {
+	// "HELLO WORLD", version 1-M
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	ec := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	assert.Equal(t, ec, qrReedSolomon(data, 10))
+}
+
+func TestQRFormat(t *testing.T) {
+	assert.Equal(t, uint(0x5412), qrFormatBits(0)) // 101010000010010
+	assert.Equal(t, uint(0x5125), qrFormatBits(1)) // 101000100100101
+	assert.Equal(t, uint(0x07c94), qrVersionBits(7))
+	assert.Equal(t, uint(0x085bc), qrVersionBits(8))
+}
+
+// Decode QR code created by qrEncode()
+func testQRDecode(t *testing.T, q *qrCode) []byte {
+	ver := (q.size - 17) / 4
+	v := &qrVersions[ver]
+
+	// format information: the first copy
+	var bits uint
+	get := func(x, y int, i uint) {
+		if q.modules[y][x] {
+			bits |= 1 << i
+		}
+	}
+	for i := 0; i <= 5; i++ {
+		get(8, i, uint(i))
+	}
+	get(8, 7, 6)
+	get(8, 8, 7)
+	get(7, 8, 8)
+	for i := 9; i < 15; i++ {
+		get(14-i, 8, uint(i))
+	}
+	mask := -1
+	for m := 0; m < 8; m++ {
+		if qrFormatBits(m) == bits {
+			mask = m
+		}
+	}
+	assert.True(t, mask >= 0)
+
+	// unmask and read the codewords
+	empty := newQRCode(ver)
+	q.function = empty.function
+	q.applyMask(mask)
+	n := v.dataCodewords() + v.ecLen*(v.blocks[0]+v.blocks[1])
+	cw := make([]byte, n)
+	i := 0
+	q.forEachData(func(x, y int) {
+		if i < n*8 && q.modules[y][x] {
+			cw[i/8] |= 1 << uint(7-i%8)
+		}
+		i++
+	})
+	q.applyMask(mask)
+
+	// de-interleave the data codewords, the error correction codewords must match
+	blocks := make([][]byte, v.blocks[0]+v.blocks[1])
+	blockLen := func(b int) int {
+		if b < v.blocks[0] {
+			return v.dataLen[0]
+		}
+		return v.dataLen[1]
+	}
+	k := 0
+	for j := 0; j < v.dataLen[0] || j < v.dataLen[1]; j++ {
+		for b := range blocks {
+			if j < blockLen(b) {
+				blocks[b] = append(blocks[b], cw[k])
+				k++
+			}
+		}
+	}
+	data := []byte{}
+	for b := range blocks {
+		ec := []byte{}
+		for j := 0; j < v.ecLen; j++ {
+			ec = append(ec, cw[k+j*len(blocks)+b])
+		}
+		assert.Equal(t, qrReedSolomon(blocks[b], v.ecLen), ec)
+		data = append(data, blocks[b]...)
+	}
+
+	// byte mode segment
+	assert.Equal(t, byte(0x40), data[0]&0xf0)
+	if ver < 10 {
+		length := int(data[0]&0x0f)<<4 | int(data[1]>>4)
+		res := make([]byte, length)
+		for j := range res {
+			res[j] = data[1+j]<<4 | data[2+j]>>4
+		}
+		return res
+	}
+	length := int(data[0]&0x0f)<<12 | int(data[1])<<4 | int(data[2]>>4)
+	res := make([]byte, length)
+	for j := range res {
+		res[j] = data[2+j]<<4 | data[3+j]>>4
+	}
+	return res
+}
+
+func TestQREncode(t *testing.T) {
+	for _, s := range []string{
+		"hello",
+		totpURI("admin", "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"),
+		strings.Repeat("0123456789", 15),
+		strings.Repeat("a", 200),
+	} {
+		q, err := qrEncode([]byte(s))
+		assert.Nil(t, err)
+
+		// finder pattern
+		for i := 0; i < 7; i++ {
+			assert.True(t, q.modules[0][i] && q.modules[6][i] && q.modules[i][0] && q.modules[i][6])
+		}
+		assert.False(t, q.modules[1][1])
+		assert.True(t, q.modules[3][3])
+
+		assert.Equal(t, s, string(testQRDecode(t, q)))
+	}
+
+	q, _ := qrEncode([]byte("hello"))
+	assert.Equal(t, 21, q.size)
+
+	_, err := qrEncode([]byte(strings.Repeat("a", 300)))
+	assert.NotNil(t, err)
+
+	data, err := qrPNG([]byte("hello"), 4)
+	assert.Nil(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, (21+8)*4, img.Bounds().Dx())
+}
@@ -0,0 +1,200 @@
+// Changing the listen addresses of the web interface and DNS server at runtime
+
+package home
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// webRebind - the sockets opened on the new address of the web interface
+// The sockets are opened before the current servers are stopped:
+// if the new address isn't available, the servers keep running on the current address.
+type webRebind struct {
+	web   net.Listener
+	https net.Listener // nil: HTTPS server isn't restarted
+}
+
+// Open the sockets on the new address of the web interface
+// HTTPS server is moved to the new host only if it's running.
+func prepareWebRebind(host string, port int) (*webRebind, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("impossible to listen on %s: %s", net.JoinHostPort(host, strconv.Itoa(port)), err)
+	}
+	wr := &webRebind{web: ln}
+
+	config.RLock()
+	hostChanged := config.BindHost != host
+	portHTTPS := config.TLS.PortHTTPS
+	config.RUnlock()
+	if !hostChanged || Context.httpsServer.cond == nil {
+		return wr, nil
+	}
+
+	Context.httpsServer.cond.L.Lock()
+	running := Context.httpsServer.server != nil
+	Context.httpsServer.cond.L.Unlock()
+	if running && portHTTPS != 0 {
+		wr.https, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(portHTTPS)))
+		if err != nil {
+			wr.cancel()
+			return nil, fmt.Errorf("impossible to listen on %s: %s", net.JoinHostPort(host, strconv.Itoa(portHTTPS)), err)
+		}
+	}
+	return wr, nil
+}
+
+// Close the sockets: the address isn't changed
+func (wr *webRebind) cancel() {
+	if wr == nil {
+		return
+	}
+	_ = wr.web.Close()
+	if wr.https != nil {
+		_ = wr.https.Close()
+	}
+}
+
+// Pass the sockets to the web servers and stop the servers listening on the previous address
+// The new address must be written to configuration before.
+// The servers are stopped in background: Shutdown() waits until all requests are finished,
+// including the request which has changed the address.
+func (wr *webRebind) apply() {
+	ls := &Context.sockets
+	ls.Lock()
+	if ls.web != nil {
+		// the server hasn't taken the socket from the previous change yet
+		_ = ls.web.Close()
+	}
+	ls.web = wr.web
+	if wr.https != nil {
+		if ls.https != nil {
+			_ = ls.https.Close()
+		}
+		ls.https = wr.https
+	}
+	ls.Unlock()
+
+	log.Info("Web interface: listening on %s", wr.web.Addr())
+	srv := Context.httpServer
+	if srv != nil {
+		go func() {
+			_ = srv.Shutdown(context.TODO())
+		}()
+	}
+	if wr.https != nil {
+		go restartHTTPS()
+	}
+}
+
+type addressesJSON struct {
+	Web applyConfigReqEnt `json:"web"`
+	DNS applyConfigReqEnt `json:"dns"`
+}
+
+func (a *addressesJSON) validate() error {
+	for _, it := range []struct {
+		name string
+		ent  applyConfigReqEnt
+	}{{"web", a.Web}, {"dns", a.DNS}} {
+		if net.ParseIP(it.ent.IP) == nil {
+			return fmt.Errorf("%s: invalid IP address: %q", it.name, it.ent.IP)
+		}
+		if it.ent.Port <= 0 || it.ent.Port > 65535 {
+			return fmt.Errorf("%s: invalid port: %d", it.name, it.ent.Port)
+		}
+	}
+	return nil
+}
+
+func handleAddressesGet(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	resp := addressesJSON{
+		Web: applyConfigReqEnt{IP: config.BindHost, Port: config.BindPort},
+		DNS: applyConfigReqEnt{IP: config.DNS.BindHost, Port: config.DNS.Port},
+	}
+	config.RUnlock()
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// Change the listen addresses of the web interface and DNS server
+// The new addresses are checked before the current sockets are closed.
+// DNS server is restarted on the new address using configuration transaction:
+// if it fails to start, the previous address is restored.
+func handleAddressesSet(w http.ResponseWriter, r *http.Request) {
+	req := addressesJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+	err = req.validate()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.RLock()
+	prevHost := config.BindHost
+	prevPort := config.BindPort
+	webChanged := prevHost != req.Web.IP || prevPort != req.Web.Port
+	dnsChanged := config.DNS.BindHost != req.DNS.IP || config.DNS.Port != req.DNS.Port
+	config.RUnlock()
+
+	var wr *webRebind
+	if webChanged {
+		wr, err = prepareWebRebind(req.Web.IP, req.Web.Port)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+	}
+
+	tx := beginConfigTx()
+	config.Lock()
+	config.BindHost = req.Web.IP
+	config.BindPort = req.Web.Port
+	config.DNS.BindHost = req.DNS.IP
+	config.DNS.Port = req.DNS.Port
+	config.Unlock()
+
+	if dnsChanged {
+		err = tx.commit()
+	} else {
+		err = writeAllConfigs()
+	}
+	if err != nil {
+		wr.cancel()
+		config.Lock()
+		config.BindHost = prevHost
+		config.BindPort = prevPort
+		config.Unlock()
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	if wr != nil {
+		wr.apply()
+	}
+	returnOK(w)
+}
+
+// RegisterAddressesHandlers - register HTTP handlers
+func RegisterAddressesHandlers() {
+	httpRegister(http.MethodGet, "/control/addresses", handleAddressesGet)
+	httpRegister(http.MethodPost, "/control/addresses/set", handleAddressesSet)
+}
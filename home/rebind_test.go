@@ -0,0 +1,70 @@
+package home
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebRebind(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer func() { _ = busy.Close() }()
+	busyPort := busy.Addr().(*net.TCPAddr).Port
+
+	// the address is in use: nothing is changed
+	wr, err := prepareWebRebind("127.0.0.1", busyPort)
+	assert.NotNil(t, err)
+	assert.Nil(t, wr)
+
+	wr, err = prepareWebRebind("127.0.0.1", 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, wr.web)
+	assert.Nil(t, wr.https)
+	addr := wr.web.Addr().String()
+	wr.cancel()
+
+	// the socket is closed on cancel
+	ln, err := net.Listen("tcp", addr)
+	assert.Nil(t, err)
+	_ = ln.Close()
+}
+
+func TestAddressesValidate(t *testing.T) {
+	a := addressesJSON{
+		Web: applyConfigReqEnt{IP: "0.0.0.0", Port: 3000},
+		DNS: applyConfigReqEnt{IP: "::", Port: 53},
+	}
+	assert.Nil(t, a.validate())
+
+	a.Web.Port = 0
+	assert.NotNil(t, a.validate())
+	a.Web.Port = 3000
+	a.DNS.IP = "localhost"
+	assert.NotNil(t, a.validate())
+	a.DNS.IP = "127.0.0.1"
+	a.DNS.Port = 65536
+	assert.NotNil(t, a.validate())
+}
+
+func TestConfigTxDNSAddress(t *testing.T) {
+	initServices()
+	defer initServices()
+	prevDNS := config.DNS
+	defer func() { config.DNS = prevDNS }()
+
+	busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer func() { _ = busy.Close() }()
+
+	// the new port is checked before DNS server is restarted
+	tx := beginConfigTx()
+	config.Lock()
+	config.DNS.BindHost = "127.0.0.1"
+	config.DNS.Port = busy.LocalAddr().(*net.UDPAddr).Port
+	config.Unlock()
+	assert.NotNil(t, tx.validate())
+	tx.rollback()
+	assert.Equal(t, prevDNS.Port, config.DNS.Port)
+}
@@ -0,0 +1,327 @@
+// Graceful reload of the configuration file on SIGHUP:
+// the settings are applied without restarting the process,
+// the requests in progress and the web sessions are kept.
+
+package home
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+
+	"github.com/AdguardTeam/golibs/log"
+	"gopkg.in/yaml.v2"
+)
+
+// The sections of configuration file applied on reload
+// The changes of the other settings are applied after restart.
+var reloadSections = map[string]bool{
+	"bind_host":         true,
+	"bind_port":         true,
+	"dns":               true,
+	"tls":               true,
+	"filters":           true,
+	"whitelist_filters": true,
+	"user_rules":        true,
+	"clients":           true,
+}
+
+// The settings from "dns" section applied on reload, in addition to the settings of DNS server
+var reloadDNSKeys = map[string]bool{
+	"bind_host":               true,
+	"port":                    true,
+	"filtering_enabled":       true,
+	"filters_update_interval": true,
+	"blocked_services":        true,
+	"custom_services":         true,
+	"schedule":                true,
+}
+
+// The settings read from configuration file on reload
+type reloadedConfig struct {
+	SchemaVersion    int            `yaml:"schema_version"`
+	BindHost         string         `yaml:"bind_host"`
+	BindPort         int            `yaml:"bind_port"`
+	DNS              dnsConfig      `yaml:"dns"`
+	TLS              tlsConfig      `yaml:"tls"`
+	Filters          []filter       `yaml:"filters"`
+	WhitelistFilters []filter       `yaml:"whitelist_filters"`
+	UserRules        []userRule     `yaml:"user_rules"`
+	Clients          []clientObject `yaml:"clients"`
+}
+
+// Return TRUE if the encryption settings are equal
+// The certificate and the private key loaded from files aren't compared.
+func tlsSettingsEqual(a, b tlsConfigSettings) bool {
+	da, err1 := yaml.Marshal(a)
+	db, err2 := yaml.Marshal(b)
+	return err1 == nil && err2 == nil && bytes.Equal(da, db)
+}
+
+// Log the settings which have been changed in file but can't be applied without restart
+func reloadCheckRestart(cur, loaded yaml.MapSlice) {
+	keys := map[interface{}]bool{}
+	for _, it := range append(append(yaml.MapSlice{}, cur...), loaded...) {
+		keys[it.Key] = true
+	}
+
+	// DNS server settings are applied
+	dnsServerKeys := map[interface{}]bool{}
+	data, _ := yaml.Marshal(config.DNS.FilteringConfig)
+	fc := yaml.MapSlice{}
+	_ = yaml.Unmarshal(data, &fc)
+	for _, it := range fc {
+		dnsServerKeys[it.Key] = true
+	}
+
+	for k := range keys {
+		name, _ := k.(string)
+		curVal, _ := yamlGet(cur, k)
+		newVal, _ := yamlGet(loaded, k)
+		if name != "dns" {
+			if !reloadSections[name] && !yamlEqual(curVal, newVal) {
+				log.Info("Reload: changes of %s setting will be applied after restart", name)
+			}
+			continue
+		}
+
+		cm, _ := curVal.(yaml.MapSlice)
+		nm, _ := newVal.(yaml.MapSlice)
+		subkeys := map[interface{}]bool{}
+		for _, it := range append(append(yaml.MapSlice{}, cm...), nm...) {
+			subkeys[it.Key] = true
+		}
+		for sk := range subkeys {
+			sname, _ := sk.(string)
+			if reloadDNSKeys[sname] || dnsServerKeys[sk] {
+				continue
+			}
+			cv, _ := yamlGet(cm, sk)
+			nv, _ := yamlGet(nm, sk)
+			if !yamlEqual(cv, nv) {
+				log.Info("Reload: changes of dns.%s setting will be applied after restart", sname)
+			}
+		}
+	}
+}
+
+// Read the configuration file and parse the settings applied on reload
+// The settings which aren't set in file keep their current values.
+func reloadRead() (*reloadedConfig, configIncludes, error) {
+	ci := configIncludes{}
+	configFile := config.getConfigFilename()
+	data, err := readConfigFile()
+	if err != nil {
+		return nil, ci, err
+	}
+	data, err = ci.load(data, filepath.Dir(configFile))
+	if err != nil {
+		return nil, ci, err
+	}
+
+	loaded := yaml.MapSlice{}
+	err = yaml.Unmarshal(data, &loaded)
+	if err != nil {
+		return nil, ci, err
+	}
+	curData, err := config.marshal()
+	if err != nil {
+		return nil, ci, err
+	}
+	cur := yaml.MapSlice{}
+	err = yaml.Unmarshal(curData, &cur)
+	if err != nil {
+		return nil, ci, err
+	}
+
+	config.RLock()
+	r := &reloadedConfig{
+		BindHost: config.BindHost,
+		BindPort: config.BindPort,
+		DNS:      config.DNS,
+		TLS:      config.TLS,
+	}
+	config.RUnlock()
+	// the mappings are merged by decoder rather than replaced
+	r.DNS.UpstreamWeights = nil
+	err = yaml.Unmarshal(data, r)
+	if err != nil {
+		return nil, ci, err
+	}
+	if r.SchemaVersion != currentSchemaVersion {
+		return nil, ci, fmt.Errorf("schema_version %d: the configuration must be upgraded on restart", r.SchemaVersion)
+	}
+
+	reloadCheckRestart(cur, loaded)
+	return r, ci, nil
+}
+
+// Check the reloaded settings which aren't checked by configuration transaction
+func (r *reloadedConfig) validate() error {
+	if r.BindPort <= 0 || r.BindPort > 65535 {
+		return fmt.Errorf("invalid bind_port: %d", r.BindPort)
+	}
+	if !checkFiltersUpdateIntervalHours(r.DNS.FiltersUpdateIntervalHours) {
+		return fmt.Errorf("invalid filters_update_interval: %d", r.DNS.FiltersUpdateIntervalHours)
+	}
+	err := checkFiltersUpdateSchedule(r.DNS.FiltersUpdateSchedule, r.DNS.FiltersUpdateJitter)
+	if err != nil {
+		return fmt.Errorf("invalid filters_update_schedule: %s", err)
+	}
+	err = r.DNS.Schedule.init()
+	if err != nil {
+		return fmt.Errorf("invalid schedule: %s", err)
+	}
+
+	status := tlsConfigStatus{}
+	if !tlsLoadConfig(&r.TLS, &status) {
+		return fmt.Errorf("%s", status.WarningValidation)
+	}
+	if r.TLS.Enabled && !r.TLS.ACME.Enabled && len(r.TLS.CertificateChainData) != 0 {
+		status = validateCertificates(string(r.TLS.CertificateChainData), string(r.TLS.PrivateKeyData), r.TLS.ServerName)
+		if !status.ValidPair {
+			return fmt.Errorf("%s", status.WarningValidation)
+		}
+	}
+	return nil
+}
+
+// Open the sockets on the new address of the web interface
+// Return nil if the address hasn't been changed.
+func (r *reloadedConfig) prepareWeb() (*webRebind, error) {
+	config.RLock()
+	changed := config.BindHost != r.BindHost || config.BindPort != r.BindPort
+	config.RUnlock()
+	if !changed {
+		return nil, nil
+	}
+	return prepareWebRebind(r.BindHost, r.BindPort)
+}
+
+// Apply the DNS and encryption settings
+func (r *reloadedConfig) applyDNS() error {
+	tx := beginConfigTx()
+	config.Lock()
+	err := setCustomServices(r.DNS.CustomServices)
+	if err != nil {
+		config.Unlock()
+		return fmt.Errorf("invalid custom services: %s", err)
+	}
+	d := &config.DNS
+	d.BindHost = r.DNS.BindHost
+	d.Port = r.DNS.Port
+	d.FilteringConfig = r.DNS.FilteringConfig
+	d.FilteringEnabled = r.DNS.FilteringEnabled
+	d.FiltersUpdateIntervalHours = r.DNS.FiltersUpdateIntervalHours
+	d.FiltersUpdateSchedule = r.DNS.FiltersUpdateSchedule
+	d.FiltersUpdateJitter = r.DNS.FiltersUpdateJitter
+	d.BlockedServices = r.DNS.BlockedServices
+	d.CustomServices = r.DNS.CustomServices
+	d.Schedule = r.DNS.Schedule
+
+	// the new certificate is used without restarting the servers
+	newTLS := r.TLS
+	newTLS.CertificateChainData = config.TLS.CertificateChainData
+	newTLS.PrivateKeyData = config.TLS.PrivateKeyData
+	config.TLS = newTLS
+	config.Unlock()
+	wakeRefresh()
+
+	err = tx.reload()
+	if err != nil {
+		return err
+	}
+
+	if !tlsSettingsEqual(tx.tls.tlsConfigSettings, r.TLS.tlsConfigSettings) {
+		restartHTTPS()
+	}
+	if r.TLS.Enabled && !r.TLS.ACME.Enabled && len(r.TLS.CertificateChainData) != 0 &&
+		(!bytes.Equal(r.TLS.CertificateChainData, tx.tls.CertificateChainData) ||
+			!bytes.Equal(r.TLS.PrivateKeyData, tx.tls.PrivateKeyData)) {
+		err = tlsUpdateCertificate(r.TLS.CertificateChainData, r.TLS.PrivateKeyData)
+		if err != nil {
+			return err
+		}
+		log.Info("TLS: the certificate has been reloaded")
+	}
+	if r.TLS.Enabled && len(r.TLS.ServerNames) != 0 {
+		err = tlsUpdateServerNames(r.TLS.ServerNames)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the filters and the user rules
+// The filters which haven't been downloaded yet are updated in background.
+func (r *reloadedConfig) applyFilters() {
+	loadFilters(r.Filters)
+	loadFilters(r.WhitelistFilters)
+	for i := range r.WhitelistFilters {
+		r.WhitelistFilters[i].white = true
+	}
+
+	config.Lock()
+	config.Filters = r.Filters
+	config.WhitelistFilters = r.WhitelistFilters
+	deduplicateFilters()
+	updateUniqueFilterID(config.Filters)
+	updateUniqueFilterID(config.WhitelistFilters)
+	config.UserRules = r.UserRules
+	assignUserRuleIDs(config.UserRules)
+	config.Unlock()
+
+	enableFilters(true)
+	go func() {
+		_, _ = refreshFilters(FilterRefreshBlocklists|FilterRefreshAllowlists, false)
+	}()
+}
+
+// Reload the configuration file and apply the settings at runtime:
+// web interface address, DNS settings, encryption settings and certificate, filters, user rules and clients
+// The other settings are applied after restart.
+func reloadConfig() error {
+	Context.controlLock.Lock()
+	defer Context.controlLock.Unlock()
+
+	if Context.firstRun {
+		return fmt.Errorf("AdGuard Home isn't configured yet")
+	}
+	log.Info("Reloading configuration file %s", config.getConfigFilename())
+
+	r, ci, err := reloadRead()
+	if err != nil {
+		return err
+	}
+	err = r.validate()
+	if err != nil {
+		return err
+	}
+	wr, err := r.prepareWeb()
+	if err != nil {
+		return err
+	}
+	err = Context.clients.setFromConfig(r.Clients)
+	if err != nil {
+		wr.cancel()
+		return err
+	}
+	err = r.applyDNS()
+	if err != nil {
+		wr.cancel()
+		return err
+	}
+	r.applyFilters()
+
+	config.Lock()
+	config.includes = ci
+	config.BindHost = r.BindHost
+	config.BindPort = r.BindPort
+	config.Unlock()
+	if wr != nil {
+		wr.apply()
+	}
+	log.Info("Configuration has been reloaded")
+	return nil
+}
@@ -0,0 +1,57 @@
+package home
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSSettingsEqual(t *testing.T) {
+	a := tlsConfigSettings{Enabled: true, PortHTTPS: 443}
+	a.CertificatePath = "/etc/cert.pem"
+	b := a
+	b.CertificateChainData = []byte("data")
+	assert.True(t, tlsSettingsEqual(a, b))
+	b.PortHTTPS = 8443
+	assert.False(t, tlsSettingsEqual(a, b))
+}
+
+func TestReloadRead(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	prevWorkDir, prevName, prevVersion := Context.workDir, Context.configFilename, config.SchemaVersion
+	defer func() {
+		Context.workDir, Context.configFilename, config.SchemaVersion = prevWorkDir, prevName, prevVersion
+	}()
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	config.SchemaVersion = currentSchemaVersion
+
+	// the file with the changed settings
+	prevPort, prevRefuseAny := config.BindPort, config.DNS.RefuseAny
+	config.BindPort = prevPort + 1
+	config.DNS.RefuseAny = !prevRefuseAny
+	config.Filters = append(config.Filters, filter{Enabled: true, URL: "https://example.org/filter.txt", Name: "test"})
+	data, err := config.marshal()
+	assert.Nil(t, err)
+	config.BindPort, config.DNS.RefuseAny = prevPort, prevRefuseAny
+	config.Filters = config.Filters[:len(config.Filters)-1]
+	fn := filepath.Join(dir, "AdGuardHome.yaml")
+	assert.Nil(t, ioutil.WriteFile(fn, data, 0644))
+
+	r, _, err := reloadRead()
+	assert.Nil(t, err)
+	assert.Equal(t, !prevRefuseAny, r.DNS.RefuseAny)
+	assert.Equal(t, len(config.Filters)+1, len(r.Filters))
+	assert.Nil(t, r.validate())
+	// the current settings aren't changed
+	assert.Equal(t, prevRefuseAny, config.DNS.RefuseAny)
+
+	// the configuration of an older schema isn't reloaded
+	assert.Nil(t, ioutil.WriteFile(fn, []byte("schema_version: 1\n"), 0644))
+	_, _, err = reloadRead()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,197 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// A period of time that repeats every week
+type scheduleEntry struct {
+	Days  []string `yaml:"days" json:"days"`   // "mon", "tue", ..., "sun".  Empty: every day
+	Start string   `yaml:"start" json:"start"` // "HH:MM"
+	End   string   `yaml:"end" json:"end"`     // "HH:MM".  If it's less than Start, the period ends on the next day
+
+	// What happens during the period:
+	// . if there are no services, filtering is disabled
+	// . otherwise, these services are blocked (in addition to the blocked services from settings)
+	Services []string `yaml:"services" json:"services"`
+
+	days  [7]bool // Days converted to the array indexed by time.Weekday
+	start int     // minutes since midnight
+	end   int     // minutes since midnight
+}
+
+// Weekly schedule of filtering settings
+type filteringSchedule struct {
+	TimeZone string          `yaml:"time_zone" json:"time_zone"` // IANA time zone name, e.g. "Europe/Berlin".  Empty: local time
+	Entries  []scheduleEntry `yaml:"entries" json:"entries"`
+
+	loc *time.Location
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Parse "HH:MM" string
+// Return the number of minutes since midnight
+func parseScheduleTime(s string) (int, error) {
+	i := strings.IndexByte(s, ':')
+	if i == -1 {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	h, err := strconv.Atoi(s[:i])
+	if err != nil || h < 0 || h > 23 {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	m, err := strconv.Atoi(s[i+1:])
+	if err != nil || m < 0 || m > 59 || len(s[i+1:]) != 2 {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	return h*60 + m, nil
+}
+
+// Check the schedule and prepare it for use
+func (s *filteringSchedule) init() error {
+	s.loc = nil
+	if len(s.TimeZone) != 0 {
+		loc, err := time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return fmt.Errorf("invalid time zone: %s", s.TimeZone)
+		}
+		s.loc = loc
+	}
+
+	for i := range s.Entries {
+		e := &s.Entries[i]
+		e.days = [7]bool{}
+		for _, d := range e.Days {
+			found := false
+			for wd, name := range weekdayNames {
+				if strings.ToLower(d) == name {
+					e.days[wd] = true
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("invalid day: %s", d)
+			}
+		}
+		if len(e.Days) == 0 {
+			for wd := range e.days {
+				e.days[wd] = true
+			}
+		}
+
+		var err error
+		e.start, err = parseScheduleTime(e.Start)
+		if err != nil {
+			return err
+		}
+		e.end, err = parseScheduleTime(e.End)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range e.Services {
+			if !serviceExists(name) {
+				return fmt.Errorf("unknown service name: %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Return TRUE if the time is inside the period
+// A period which starts and ends at the same time lasts the whole day.
+func (e *scheduleEntry) contains(t time.Time) bool {
+	wd := t.Weekday()
+	m := t.Hour()*60 + t.Minute()
+
+	if e.start < e.end {
+		return e.days[wd] && m >= e.start && m < e.end
+	}
+	if e.start == e.end {
+		return e.days[wd]
+	}
+
+	// the period ends on the next day
+	prevDay := (wd + 6) % 7
+	return (e.days[wd] && m >= e.start) || (e.days[prevDay] && m < e.end)
+}
+
+// Apply the schedule to the filtering settings of a DNS request
+func (s *filteringSchedule) apply(setts *dnsfilter.RequestFilteringSettings, now time.Time) {
+	if len(s.Entries) == 0 {
+		return
+	}
+
+	if s.loc != nil {
+		now = now.In(s.loc)
+	}
+	for i := range s.Entries {
+		e := &s.Entries[i]
+		if !e.contains(now) {
+			continue
+		}
+
+		if len(e.Services) == 0 {
+			log.Debug("Schedule: filtering is paused (%s-%s)", e.Start, e.End)
+			setts.FilteringEnabled = false
+			continue
+		}
+		addBlockedServices(setts, e.Services)
+	}
+}
+
+func handleScheduleGet(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	sched := config.DNS.Schedule
+	config.RUnlock()
+
+	if sched.Entries == nil {
+		sched.Entries = []scheduleEntry{}
+	}
+	js, err := json.Marshal(sched)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+func handleScheduleSet(w http.ResponseWriter, r *http.Request) {
+	sched := filteringSchedule{}
+	err := json.NewDecoder(r.Body).Decode(&sched)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+
+	err = sched.init()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Invalid schedule: %s", err)
+		return
+	}
+
+	config.Lock()
+	config.DNS.Schedule = sched
+	config.Unlock()
+
+	log.Debug("Updated filtering schedule: %d entries", len(sched.Entries))
+	onConfigModified()
+	returnOK(w)
+}
+
+// RegisterScheduleHandlers - register HTTP handlers
+func RegisterScheduleHandlers() {
+	httpRegister(http.MethodGet, "/control/schedule", handleScheduleGet)
+	httpRegister(http.MethodPost, "/control/schedule/set", handleScheduleSet)
+}
@@ -0,0 +1,174 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleEntry(t *testing.T) {
+	s := filteringSchedule{
+		Entries: []scheduleEntry{
+			{Days: []string{"mon", "Tue"}, Start: "09:00", End: "17:30"},
+			{Days: []string{"fri"}, Start: "22:00", End: "07:00"},
+			{Days: []string{"sun"}, Start: "00:00", End: "00:00"},
+		},
+	}
+	assert.Nil(t, s.init())
+
+	// 2019-12-02 is Monday
+	tm := func(day, h, m int) time.Time {
+		return time.Date(2019, 12, 2+day, h, m, 0, 0, time.UTC)
+	}
+	e := &s.Entries[0]
+	assert.True(t, e.contains(tm(0, 9, 0)))
+	assert.True(t, e.contains(tm(1, 17, 29)))
+	assert.False(t, e.contains(tm(1, 17, 30)))
+	assert.False(t, e.contains(tm(0, 8, 59)))
+	assert.False(t, e.contains(tm(2, 12, 0)))
+
+	// the period ends on the next day
+	e = &s.Entries[1]
+	assert.True(t, e.contains(tm(4, 23, 0)))
+	assert.True(t, e.contains(tm(5, 6, 59)))
+	assert.False(t, e.contains(tm(5, 7, 0)))
+	assert.False(t, e.contains(tm(4, 6, 0)))
+	assert.False(t, e.contains(tm(5, 23, 0)))
+
+	// the whole day
+	e = &s.Entries[2]
+	assert.True(t, e.contains(tm(6, 0, 0)))
+	assert.True(t, e.contains(tm(6, 23, 59)))
+	assert.False(t, e.contains(tm(0, 0, 0)))
+
+	// every day
+	s = filteringSchedule{Entries: []scheduleEntry{{Start: "01:00", End: "02:00"}}}
+	assert.Nil(t, s.init())
+	for d := 0; d != 7; d++ {
+		assert.True(t, s.Entries[0].contains(tm(d, 1, 30)))
+	}
+}
+
+func TestScheduleInit(t *testing.T) {
+	initServices()
+	for _, s := range []filteringSchedule{
+		{TimeZone: "Unknown/Zone"},
+		{Entries: []scheduleEntry{{Days: []string{"monday"}, Start: "01:00", End: "02:00"}}},
+		{Entries: []scheduleEntry{{Start: "24:00", End: "02:00"}}},
+		{Entries: []scheduleEntry{{Start: "01:00", End: "2:0"}}},
+		{Entries: []scheduleEntry{{Start: "01:00", End: ""}}},
+		{Entries: []scheduleEntry{{Start: "01:00", End: "02:00", Services: []string{"unknown"}}}},
+	} {
+		assert.NotNil(t, s.init(), "%v", s)
+	}
+}
+
+func TestScheduleApply(t *testing.T) {
+	initServices()
+	s := filteringSchedule{
+		TimeZone: "Europe/Moscow", // UTC+3
+		Entries: []scheduleEntry{
+			{Start: "22:00", End: "07:00"},
+			{Start: "18:00", End: "20:00", Services: []string{"youtube"}},
+		},
+	}
+	assert.Nil(t, s.init())
+
+	// 15:00 in Moscow: nothing is changed
+	setts := dnsfilter.RequestFilteringSettings{FilteringEnabled: true}
+	ApplyBlockedServices(&setts, []string{"facebook"})
+	s.apply(&setts, time.Date(2019, 12, 2, 12, 0, 0, 0, time.UTC))
+	assert.True(t, setts.FilteringEnabled)
+	assert.Equal(t, 1, len(setts.ServicesRules))
+
+	// 19:00 in Moscow: youtube is blocked
+	s.apply(&setts, time.Date(2019, 12, 2, 16, 0, 0, 0, time.UTC))
+	assert.True(t, setts.FilteringEnabled)
+	assert.Equal(t, 2, len(setts.ServicesRules))
+	assert.Equal(t, "youtube", setts.ServicesRules[1].Name)
+
+	// the service is already blocked
+	setts = dnsfilter.RequestFilteringSettings{FilteringEnabled: true}
+	ApplyBlockedServices(&setts, []string{"facebook", "youtube"})
+	s.apply(&setts, time.Date(2019, 12, 2, 16, 0, 0, 0, time.UTC))
+	assert.Equal(t, 2, len(setts.ServicesRules))
+
+	// 23:00 in Moscow: filtering is paused
+	setts = dnsfilter.RequestFilteringSettings{FilteringEnabled: true}
+	s.apply(&setts, time.Date(2019, 12, 2, 20, 0, 0, 0, time.UTC))
+	assert.False(t, setts.FilteringEnabled)
+}
+
+func TestScheduleClient(t *testing.T) {
+	initServices()
+	Context = homeContext{}
+	Context.clients.testing = true
+	Context.clients.Init(nil, nil)
+
+	now := time.Now()
+	h := now.Hour()
+	pause := scheduleEntry{
+		Start: time.Date(2000, 1, 1, h, 0, 0, 0, time.Local).Format("15:04"),
+		End:   time.Date(2000, 1, 1, (h+1)%24, 0, 0, 0, time.Local).Format("15:04"),
+	}
+	config.DNS.Schedule = filteringSchedule{Entries: []scheduleEntry{pause}}
+	assert.Nil(t, config.DNS.Schedule.init())
+	defer func() { config.DNS.Schedule = filteringSchedule{} }()
+
+	// client with its own empty schedule
+	ok, err := Context.clients.Add(Client{IDs: []string{"1.1.1.1"}, Name: "client1", Schedule: &filteringSchedule{}})
+	assert.True(t, ok && err == nil)
+	// client which uses global schedule
+	ok, err = Context.clients.Add(Client{IDs: []string{"2.2.2.2"}, Name: "client2"})
+	assert.True(t, ok && err == nil)
+	// invalid schedule
+	_, err = Context.clients.Add(Client{IDs: []string{"3.3.3.3"}, Name: "client3",
+		Schedule: &filteringSchedule{Entries: []scheduleEntry{{Start: "1", End: "2"}}}})
+	assert.NotNil(t, err)
+
+	setts := dnsfilter.RequestFilteringSettings{FilteringEnabled: true}
+	applyAdditionalFiltering("1.1.1.1", "", &setts)
+	assert.True(t, setts.FilteringEnabled)
+
+	setts = dnsfilter.RequestFilteringSettings{FilteringEnabled: true}
+	applyAdditionalFiltering("2.2.2.2", "", &setts)
+	assert.False(t, setts.FilteringEnabled)
+
+	setts = dnsfilter.RequestFilteringSettings{FilteringEnabled: true}
+	applyAdditionalFiltering("", "", &setts)
+	assert.False(t, setts.FilteringEnabled)
+}
+
+func TestScheduleHandlers(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	initServices()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	defer func() { config.DNS.Schedule = filteringSchedule{} }()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/control/schedule/set", strings.NewReader(`{"entries":[{"days":["xyz"],"start":"22:00","end":"07:00"}]}`))
+	handleScheduleSet(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/control/schedule/set", strings.NewReader(`{"time_zone":"UTC","entries":[{"days":["sat","sun"],"start":"22:00","end":"07:00","services":["youtube"]}]}`))
+	handleScheduleSet(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, len(config.DNS.Schedule.Entries))
+	assert.NotNil(t, config.DNS.Schedule.loc)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/control/schedule", nil)
+	handleScheduleGet(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), `"services":["youtube"]`))
+}
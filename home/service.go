@@ -1,6 +1,7 @@
 package home
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"runtime"
@@ -18,6 +19,7 @@ const (
 	serviceName        = "AdGuardHome"
 	serviceDisplayName = "AdGuard Home service"
 	serviceDescription = "AdGuard Home: Network-level blocker"
+	systemdSocketPath  = "/etc/systemd/system/" + serviceName + ".socket"
 )
 
 // Represents the program that will be launched by a service or daemon
@@ -81,7 +83,8 @@ func svcAction(s service.Service, action string) error {
 // run - this is a special command that is not supposed to be used directly
 // it is specified when we register a service, and it indicates to the app
 // that it is being run as a service/daemon.
-func handleServiceControlAction(action string) {
+func handleServiceControlAction(opts options) {
+	action := opts.serviceControlAction
 	log.Printf("Service control action: %s", action)
 
 	pwd, err := os.Getwd()
@@ -96,6 +99,25 @@ func handleServiceControlAction(action string) {
 		Arguments:        []string{"-s", "run"},
 	}
 	configureService(svcConfig)
+	if opts.socketActivation {
+		if action != "install" || service.Platform() != "linux-systemd" {
+			log.Fatal("Socket activation is supported only for service installation with systemd")
+		}
+		svcConfig.Option["SocketActivation"] = true
+	}
+	if action == "install" {
+		userName, err := getServiceUser(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(userName) != 0 {
+			err = configureServiceUser(svcConfig, userName)
+			if err != nil {
+				log.Fatalf("Can't configure the service user %s: %s", userName, err)
+			}
+			log.Printf("The service runs as user %s", userName)
+		}
+	}
 	prg := &program{}
 	s, err := service.New(prg, svcConfig)
 	if err != nil {
@@ -110,7 +132,7 @@ func handleServiceControlAction(action string) {
 			log.Fatalf("Failed to run service: %s", err)
 		}
 	} else if action == "install" {
-		handleServiceInstallCommand(s)
+		handleServiceInstallCommand(s, opts.socketActivation)
 	} else if action == "uninstall" {
 		handleServiceUninstallCommand(s)
 	} else {
@@ -141,12 +163,27 @@ func handleServiceStatusCommand(s service.Service) {
 }
 
 // handleServiceStatusCommand handles service "install" command
-func handleServiceInstallCommand(s service.Service) {
+func handleServiceInstallCommand(s service.Service, socketActivation bool) {
+	if socketActivation {
+		// the socket unit must exist before the service that requires it is enabled
+		err := ioutil.WriteFile(systemdSocketPath, []byte(systemdSocket), 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	err := svcAction(s, "install")
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if socketActivation {
+		err = runSystemctl("enable", serviceName+".socket")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	if isOpenWrt() {
 		// On OpenWrt it is important to run enable after the service installation
 		// Otherwise, the service won't start on the system startup
@@ -188,6 +225,17 @@ func handleServiceUninstallCommand(s service.Service) {
 		log.Fatal(err)
 	}
 
+	if util.FileExists(systemdSocketPath) {
+		err = runSystemctl("disable", "--now", serviceName+".socket")
+		if err != nil {
+			log.Printf("%s", err)
+		}
+		err = os.Remove(systemdSocketPath)
+		if err != nil {
+			log.Printf("cannot remove %s: %s", systemdSocketPath, err)
+		}
+	}
+
 	if runtime.GOOS == "darwin" {
 		// Removing log files on cleanup and ignore errors
 		err := os.Remove(launchdStdoutPath)
@@ -216,6 +264,9 @@ func configureService(c *service.Config) {
 	// Redirect StdErr & StdOut to files.
 	c.Option["LogOutput"] = true
 
+	// SIGHUP reloads the configuration file ("systemctl reload")
+	c.Option["ReloadSignal"] = "HUP"
+
 	// Use modified service file templates
 	c.Option["SystemdScript"] = systemdScript
 	c.Option["SysvScript"] = sysvScript
@@ -234,6 +285,18 @@ func runInitdCommand(action string) (int, error) {
 	return code, err
 }
 
+// runSystemctl runs systemctl command
+func runSystemctl(args ...string) error {
+	code, out, err := util.RunCommand("systemctl", args...)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("systemctl %s: %d: %s", strings.Join(args, " "), code, out)
+	}
+	return nil
+}
+
 // isOpenWrt checks if OS is OpenWRT
 func isOpenWrt() bool {
 	if runtime.GOOS != "linux" {
@@ -285,6 +348,8 @@ const systemdScript = `[Unit]
 Description={{.Description}}
 ConditionFileIsExecutable={{.Path|cmdEscape}}
 After=syslog.target network-online.target
+{{if .Option.SocketActivation}}Requires={{.Name}}.socket
+After={{.Name}}.socket{{end}}
 
 [Service]
 StartLimitInterval=5
@@ -293,6 +358,16 @@ ExecStart={{.Path|cmdEscape}}{{range .Arguments}} {{.|cmd}}{{end}}
 {{if .ChRoot}}RootDirectory={{.ChRoot|cmd}}{{end}}
 {{if .WorkingDirectory}}WorkingDirectory={{.WorkingDirectory|cmdEscape}}{{end}}
 {{if .UserName}}User={{.UserName}}{{end}}
+{{if .Option.Capabilities}}AmbientCapabilities={{.Option.Capabilities}}
+CapabilityBoundingSet={{.Option.Capabilities}}{{end}}
+{{if .Option.Hardened}}NoNewPrivileges=true
+ProtectSystem=full
+PrivateTmp=true
+PrivateDevices=true
+ProtectKernelTunables=true
+ProtectKernelModules=true
+ProtectControlGroups=true
+LockPersonality=true{{end}}
 {{if .ReloadSignal}}ExecReload=/bin/kill -{{.ReloadSignal}} "$MAINPID"{{end}}
 {{if .PIDFile}}PIDFile={{.PIDFile|cmd}}{{end}}
 {{if and .LogOutput .HasOutputFileSupport -}}
@@ -307,6 +382,21 @@ EnvironmentFile=-/etc/sysconfig/{{.Name}}
 WantedBy=multi-user.target
 `
 
+// systemd socket unit for socket activation: systemd opens DNS port and passes the sockets to the service
+// FileDescriptorName must match socketNameDNS.
+const systemdSocket = `[Unit]
+Description=AdGuard Home DNS sockets
+
+[Socket]
+ListenDatagram=53
+ListenStream=53
+FileDescriptorName=dns
+Service=` + serviceName + `.service
+
+[Install]
+WantedBy=sockets.target
+`
+
 // Note: we should keep it in sync with the template from service_sysv_linux.go file
 // Use "ps | grep -v grep | grep $(get_pid)" because "ps PID" may not work on OpenWrt
 const sysvScript = `#!/bin/sh
@@ -0,0 +1,126 @@
+// Running the service as an unprivileged user (Linux with systemd)
+
+package home
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/kardianos/service"
+)
+
+const (
+	// The user the service runs as on Linux with systemd, if not set by --user
+	serviceUserDefault = "adguardhome"
+
+	// The capabilities of the service running as an unprivileged user:
+	// binding the privileged ports (DNS, HTTP, HTTPS), raw sockets for DHCP server
+	serviceCapabilities = "CAP_NET_BIND_SERVICE CAP_NET_RAW"
+)
+
+// Get the user the service runs as
+// Return an empty string if the service runs as root.
+func getServiceUser(opts options) (string, error) {
+	if service.Platform() != "linux-systemd" {
+		if len(opts.serviceUser) != 0 {
+			return "", fmt.Errorf("running the service as a user is supported only with systemd")
+		}
+		return "", nil
+	}
+	if len(opts.serviceUser) == 0 {
+		return serviceUserDefault, nil
+	}
+	if opts.serviceUser == "root" {
+		return "", nil
+	}
+	return opts.serviceUser, nil
+}
+
+// Prepare running the service as an unprivileged user:
+// create the system user if necessary, give it the ownership of the working directory,
+// set the capabilities and the hardening options of the unit file
+func configureServiceUser(c *service.Config, userName string) error {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if _, ok := err.(user.UnknownUserError); !ok {
+			return err
+		}
+		err = createSystemUser(userName, c.WorkingDirectory)
+		if err != nil {
+			return err
+		}
+		u, err = user.Lookup(userName)
+		if err != nil {
+			return err
+		}
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s: invalid uid: %s", userName, u.Uid)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("user %s: invalid gid: %s", userName, u.Gid)
+	}
+	err = chownWorkDir(c.WorkingDirectory, uid, gid)
+	if err != nil {
+		return err
+	}
+
+	c.UserName = userName
+	c.Option["Capabilities"] = serviceCapabilities
+	c.Option["Hardened"] = true
+	return nil
+}
+
+// Create the system user without a home directory and log-in shell
+func createSystemUser(name, home string) error {
+	shell := "/usr/sbin/nologin"
+	if !util.FileExists(shell) {
+		shell = "/bin/false"
+	}
+	code, out, err := util.RunCommand("useradd", "--system", "--user-group",
+		"--no-create-home", "--home-dir", home, "--shell", shell, name)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("useradd: %d: %s", code, out)
+	}
+	log.Printf("Created system user %s", name)
+	return nil
+}
+
+// Give the user the ownership of the files AdGuard Home writes to:
+// the working directory itself (for the temporary files and updates), the configuration file and the data directory
+func chownWorkDir(dir string, uid, gid int) error {
+	data := filepath.Join(dir, dataDir)
+	err := os.MkdirAll(data, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Lchown(dir, uid, gid)
+	if err != nil {
+		return err
+	}
+	conf := filepath.Join(dir, "AdGuardHome.yaml")
+	if util.FileExists(conf) {
+		err = os.Lchown(conf, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+	return filepath.Walk(data, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
@@ -0,0 +1,68 @@
+package home
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/kardianos/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemdScriptUser(t *testing.T) {
+	tf := template.FuncMap{
+		"cmd":       func(s string) string { return s },
+		"cmdEscape": func(s string) string { return s },
+	}
+	tmpl := template.Must(template.New("").Funcs(tf).Parse(systemdScript))
+	c := &service.Config{Name: serviceName, UserName: "adguardhome", Option: service.KeyValue{
+		"Capabilities": serviceCapabilities,
+		"Hardened":     true,
+	}}
+	data := struct {
+		*service.Config
+		Path                 string
+		HasOutputFileSupport bool
+		ReloadSignal         string
+		PIDFile              string
+		LogOutput            bool
+	}{Config: c, Path: "/opt/AdGuardHome/AdGuardHome"}
+	buf := bytes.Buffer{}
+	assert.Nil(t, tmpl.Execute(&buf, data))
+	s := buf.String()
+	assert.True(t, strings.Contains(s, "\nUser=adguardhome\n"))
+	assert.True(t, strings.Contains(s, "\nAmbientCapabilities=CAP_NET_BIND_SERVICE CAP_NET_RAW\n"))
+	assert.True(t, strings.Contains(s, "\nNoNewPrivileges=true\n"))
+	assert.False(t, strings.Contains(s, "Requires="))
+
+	// root: no capabilities and hardening
+	c.UserName = ""
+	c.Option = service.KeyValue{}
+	buf.Reset()
+	assert.Nil(t, tmpl.Execute(&buf, data))
+	s = buf.String()
+	assert.False(t, strings.Contains(s, "User="))
+	assert.False(t, strings.Contains(s, "AmbientCapabilities="))
+	assert.False(t, strings.Contains(s, "NoNewPrivileges="))
+}
+
+func TestChownWorkDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	dir, err := ioutil.TempDir("", "agh-service")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "AdGuardHome.yaml"), []byte("bind_port: 3000\n"), 0644))
+
+	// the data directory is created
+	assert.Nil(t, chownWorkDir(dir, os.Getuid(), os.Getgid()))
+	st, err := os.Stat(filepath.Join(dir, dataDir))
+	assert.Nil(t, err)
+	assert.True(t, st.IsDir())
+}
@@ -0,0 +1,242 @@
+// Listening sockets opened before AdGuard Home is initialized:
+// systemd socket activation and dropping the privileges
+
+package home
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// The first file descriptor passed by systemd (SD_LISTEN_FDS_START)
+const listenFDsStart = 3
+
+// The names of the sockets (FileDescriptorName= in systemd socket unit)
+// A socket without a known name is used for plain DNS.
+const (
+	socketNameDNS   = "dns"   // plain DNS: UDP and TCP
+	socketNameTLS   = "tls"   // DNS-over-TLS
+	socketNameWeb   = "web"   // HTTP: web interface
+	socketNameHTTPS = "https" // HTTPS: web interface
+
+	socketNameBlockPage      = "blockpage"       // HTTP: block page
+	socketNameBlockPageHTTPS = "blockpage-https" // HTTPS: block page
+)
+
+// listeningSockets - the sockets passed by systemd or opened before the privileges are dropped
+type listeningSockets struct {
+	sync.Mutex
+	dns   dnsforward.Sockets // DNS sockets are used while the process is running
+	web   net.Listener       // nil: not opened
+	https net.Listener       // nil: not opened
+
+	blockPage      net.Listener // nil: not opened
+	blockPageHTTPS net.Listener // nil: not opened
+}
+
+// Get the sockets passed by systemd (socket activation)
+// The environment variables are described in sd_listen_fds(3).
+func (ls *listeningSockets) addSystemd() error {
+	pid := os.Getenv("LISTEN_PID")
+	fds := os.Getenv("LISTEN_FDS")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// child processes must not use the sockets
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	if len(pid) == 0 || pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid LISTEN_FDS value: %q", fds)
+	}
+
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		err = ls.addFile(f, name)
+		// net.File*() functions duplicate the descriptor
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("socket #%d: %s", listenFDsStart+i, err)
+		}
+	}
+	return nil
+}
+
+// Add the socket from file
+func (ls *listeningSockets) addFile(f *os.File, name string) error {
+	ls.Lock()
+	defer ls.Unlock()
+
+	ln, err := net.FileListener(f)
+	if err == nil {
+		log.Info("Using %s socket %s", name, ln.Addr())
+		switch name {
+		case socketNameWeb:
+			ls.web = ln
+		case socketNameHTTPS:
+			ls.https = ln
+		case socketNameBlockPage:
+			ls.blockPage = ln
+		case socketNameBlockPageHTTPS:
+			ls.blockPageHTTPS = ln
+		case socketNameTLS:
+			ls.dns.TLS = append(ls.dns.TLS, ln)
+		default:
+			ls.dns.TCP = append(ls.dns.TCP, ln)
+		}
+		return nil
+	}
+
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return err
+	}
+	log.Info("Using %s socket %s/udp", name, c.LocalAddr())
+	switch name {
+	case socketNameWeb, socketNameHTTPS, socketNameTLS, socketNameBlockPage, socketNameBlockPageHTTPS:
+		_ = c.Close()
+		return fmt.Errorf("%s: datagram socket isn't supported", name)
+	}
+	ls.dns.UDP = append(ls.dns.UDP, c)
+	return nil
+}
+
+// Open the listening sockets which weren't passed by systemd:
+// DNS, DNS-over-TLS, web interface and block page (HTTP and HTTPS)
+// Only the main listen addresses are used: additional DNS listeners bind their addresses by themselves.
+func (ls *listeningSockets) bind() error {
+	ls.Lock()
+	defer ls.Unlock()
+
+	if len(ls.dns.UDP) == 0 && len(ls.dns.TCP) == 0 && config.DNS.Port != 0 {
+		addr := net.JoinHostPort(config.DNS.BindHost, strconv.Itoa(config.DNS.Port))
+		c, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		ls.dns.UDP = append(ls.dns.UDP, c)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		ls.dns.TCP = append(ls.dns.TCP, ln)
+	}
+
+	if len(ls.dns.TLS) == 0 && config.TLS.Enabled && config.TLS.PortDNSOverTLS != 0 {
+		ln, err := net.Listen("tcp", net.JoinHostPort(config.DNS.BindHost, strconv.Itoa(config.TLS.PortDNSOverTLS)))
+		if err != nil {
+			return err
+		}
+		ls.dns.TLS = append(ls.dns.TLS, ln)
+	}
+
+	var err error
+	if ls.web == nil {
+		ls.web, err = net.Listen("tcp", net.JoinHostPort(config.BindHost, strconv.Itoa(config.BindPort)))
+		if err != nil {
+			return err
+		}
+	}
+	if ls.https == nil && config.TLS.Enabled && config.TLS.PortHTTPS != 0 {
+		ls.https, err = net.Listen("tcp", net.JoinHostPort(config.BindHost, strconv.Itoa(config.TLS.PortHTTPS)))
+		if err != nil {
+			return err
+		}
+	}
+
+	bp := config.BlockPage
+	if ls.blockPage == nil && bp.Enabled && bp.PortHTTP != 0 {
+		ls.blockPage, err = net.Listen("tcp", net.JoinHostPort(bp.BindHost, strconv.Itoa(bp.PortHTTP)))
+		if err != nil {
+			return err
+		}
+	}
+	if ls.blockPageHTTPS == nil && bp.Enabled && bp.PortHTTPS != 0 && blockPageTLSReady() {
+		ls.blockPageHTTPS, err = net.Listen("tcp", net.JoinHostPort(bp.BindHost, strconv.Itoa(bp.PortHTTPS)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get DNS sockets
+// Return nil if there are no sockets.
+func (ls *listeningSockets) dnsSockets() *dnsforward.Sockets {
+	ls.Lock()
+	defer ls.Unlock()
+	if len(ls.dns.UDP)+len(ls.dns.TCP)+len(ls.dns.TLS) == 0 {
+		return nil
+	}
+	return &ls.dns
+}
+
+// Get the socket for HTTP server
+// The socket is used only once: after that HTTP server binds the address by itself.
+func (ls *listeningSockets) takeWeb() net.Listener {
+	ls.Lock()
+	defer ls.Unlock()
+	ln := ls.web
+	ls.web = nil
+	return ln
+}
+
+// Get the socket for HTTPS server
+// The socket is used only once: after that HTTPS server binds the address by itself.
+func (ls *listeningSockets) takeHTTPS() net.Listener {
+	ls.Lock()
+	defer ls.Unlock()
+	ln := ls.https
+	ls.https = nil
+	return ln
+}
+
+// Get the sockets for block page server (HTTP and HTTPS)
+// The sockets are used only once: after that the server binds the addresses by itself.
+func (ls *listeningSockets) takeBlockPage() (net.Listener, net.Listener) {
+	ls.Lock()
+	defer ls.Unlock()
+	ln, lnTLS := ls.blockPage, ls.blockPageHTTPS
+	ls.blockPage = nil
+	ls.blockPageHTTPS = nil
+	return ln, lnTLS
+}
+
+// Check if DNS port is available (UDP or TCP)
+// When DNS sockets are passed by systemd, they are used instead of the port:  there's nothing to check.
+func checkDNSPortAvailable(host string, port int, udp bool) error {
+	if Context.sockets.dnsSockets() != nil {
+		return nil
+	}
+	if udp {
+		return util.CheckPacketPortAvailable(host, port)
+	}
+	return util.CheckPortAvailable(host, port)
+}
+
+// Change the user and the group of the process if they are configured
+func dropPrivileges() {
+	if len(config.UserName) == 0 {
+		return
+	}
+	err := util.SetUser(config.UserName, config.GroupName)
+	if err != nil {
+		log.Fatalf("Can't change the user to %s: %s", config.UserName, err)
+	}
+	log.Info("Running as user %s", config.UserName)
+}
@@ -0,0 +1,56 @@
+package home
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListeningSockets(t *testing.T) {
+	ls := listeningSockets{}
+
+	// the sockets are passed to another process
+	_ = os.Setenv("LISTEN_PID", "1")
+	_ = os.Setenv("LISTEN_FDS", "1")
+	assert.Nil(t, ls.addSystemd())
+	assert.Equal(t, "", os.Getenv("LISTEN_FDS"))
+	assert.Nil(t, ls.dnsSockets())
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	assert.Nil(t, err)
+	defer func() { _ = udp.Close() }()
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	assert.Nil(t, err)
+	defer func() { _ = tcp.Close() }()
+
+	f, err := udp.File()
+	assert.Nil(t, err)
+	assert.NotNil(t, ls.addFile(f, socketNameWeb))
+	assert.Nil(t, ls.addFile(f, socketNameDNS))
+	_ = f.Close()
+
+	f, err = tcp.File()
+	assert.Nil(t, err)
+	assert.Nil(t, ls.addFile(f, "unknown"))
+	assert.Nil(t, ls.addFile(f, socketNameWeb))
+	_ = f.Close()
+
+	sk := ls.dnsSockets()
+	assert.NotNil(t, sk)
+	assert.Equal(t, 1, len(sk.UDP))
+	assert.Equal(t, 1, len(sk.TCP))
+	assert.Equal(t, udp.LocalAddr().String(), sk.UDP[0].LocalAddr().String())
+
+	// the web interface socket is used only once
+	ln := ls.takeWeb()
+	assert.NotNil(t, ln)
+	assert.Equal(t, tcp.Addr().String(), ln.Addr().String())
+	assert.Nil(t, ls.takeWeb())
+	assert.Nil(t, ls.takeHTTPS())
+
+	_ = ln.Close()
+	_ = sk.UDP[0].Close()
+	_ = sk.TCP[0].Close()
+}
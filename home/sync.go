@@ -0,0 +1,529 @@
+// Configuration sync: a follower instance replicates the settings of a leader instance
+
+package home
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Sync sections
+const (
+	syncSectionFilters         = "filters"          // block-lists and allow-lists downloaded from URLs
+	syncSectionUserRules       = "user_rules"       // custom filtering rules
+	syncSectionClients         = "clients"          // persistent clients
+	syncSectionRewrites        = "rewrites"         // DNS rewrites
+	syncSectionBlockedServices = "blocked_services" // blocked services and custom services
+)
+
+var syncSections = []string{
+	syncSectionFilters,
+	syncSectionUserRules,
+	syncSectionClients,
+	syncSectionRewrites,
+	syncSectionBlockedServices,
+}
+
+const (
+	syncDefaultInterval = 10 // in minutes
+	syncTimeout         = 30 * time.Second
+	syncMaxSize         = 64 * 1024 * 1024 // the maximum size of the data received from leader
+	syncCheckInterval   = 1 * time.Minute
+)
+
+// Settings of configuration sync
+type syncConfig struct {
+	// The URL of the leader instance, e.g. "https://primary.example.org".  Empty: sync is disabled
+	LeaderURL string `yaml:"leader_url" json:"leader_url"`
+
+	// API token of the leader instance.  A token with "read-only" scope is enough.
+	// The token gives access to the leader's query log, statistics and settings (clients, rules), so it must be kept secret.
+	// It's never sent to UI.
+	Token string `yaml:"token" json:"token,omitempty"`
+
+	Interval uint32   `yaml:"interval" json:"interval"` // in minutes
+	Exclude  []string `yaml:"exclude" json:"exclude"`   // the sections that aren't replicated
+}
+
+// The settings sent by leader
+type syncData struct {
+	Filters          []syncFilter    `json:"filters"`
+	WhitelistFilters []syncFilter    `json:"whitelist_filters"`
+	UserRules        []userRule      `json:"user_rules"`
+	Clients          []clientJSON    `json:"clients"`
+	Rewrites         []syncRewrite   `json:"rewrites"`
+	BlockedServices  []string        `json:"blocked_services"`
+	CustomServices   []customService `json:"custom_services"`
+}
+
+type syncFilter struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Enabled bool   `json:"enabled"`
+}
+
+type syncRewrite struct {
+	Domain string `json:"domain"`
+	Answer string `json:"answer"`
+	QType  string `json:"type"`
+}
+
+// Sync module: the follower periodically requests the settings from leader and applies the changed sections
+type syncer struct {
+	lock      sync.Mutex
+	lastSync  time.Time         // the time of the last successful sync
+	lastError string            // the error that occurred during the last attempt
+	applied   map[string]string // the hash of the data of the section which was applied last
+
+	client *http.Client
+}
+
+func newSyncer() *syncer {
+	return &syncer{
+		applied: map[string]string{},
+		client:  &http.Client{Timeout: syncTimeout},
+	}
+}
+
+// Start the sync loop
+func (s *syncer) start() {
+	go s.loop()
+}
+
+// Check the settings of configuration sync
+func checkSyncConfig(c syncConfig) error {
+	if len(c.LeaderURL) == 0 {
+		return nil
+	}
+	u, err := url.Parse(c.LeaderURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("invalid leader_url: %s", c.LeaderURL)
+	}
+	if c.Interval == 0 {
+		return fmt.Errorf("invalid interval: %d", c.Interval)
+	}
+	for _, s := range c.Exclude {
+		if !isSyncSection(s) {
+			return fmt.Errorf("invalid section: %s", s)
+		}
+	}
+	return nil
+}
+
+func isSyncSection(name string) bool {
+	for _, s := range syncSections {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Return TRUE if the section is replicated
+func (c *syncConfig) includes(section string) bool {
+	for _, s := range c.Exclude {
+		if s == section {
+			return false
+		}
+	}
+	return true
+}
+
+// Collect the settings for followers
+func syncCollect() syncData {
+	d := syncData{}
+
+	config.RLock()
+	for _, f := range config.Filters {
+		if filterLocalPath(f.URL) == "" {
+			d.Filters = append(d.Filters, syncFilter{Name: f.Name, URL: f.URL, Enabled: f.Enabled})
+		}
+	}
+	for _, f := range config.WhitelistFilters {
+		if filterLocalPath(f.URL) == "" {
+			d.WhitelistFilters = append(d.WhitelistFilters, syncFilter{Name: f.Name, URL: f.URL, Enabled: f.Enabled})
+		}
+	}
+	d.UserRules = append([]userRule{}, config.UserRules...)
+	d.BlockedServices = stringArrayDup(config.DNS.BlockedServices)
+	d.CustomServices = append([]customService{}, config.DNS.CustomServices...)
+	rewrites := config.DNS.DnsfilterConf.Rewrites
+	config.RUnlock()
+
+	if Context.dnsFilter != nil {
+		c := dnsfilter.Config{}
+		Context.dnsFilter.WriteDiskConfig(&c)
+		rewrites = c.Rewrites
+	}
+	for _, ent := range rewrites {
+		d.Rewrites = append(d.Rewrites, syncRewrite{Domain: ent.Domain, Answer: ent.Answer, QType: ent.QType})
+	}
+
+	Context.clients.lock.Lock()
+	for _, c := range Context.clients.list {
+		d.Clients = append(d.Clients, clientToJSON(c))
+	}
+	Context.clients.lock.Unlock()
+	sort.Slice(d.Clients, func(i, j int) bool {
+		return d.Clients[i].Name < d.Clients[j].Name
+	})
+
+	return d
+}
+
+// Request the settings from leader
+func (s *syncer) fetch(c syncConfig) (syncData, error) {
+	d := syncData{}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(c.LeaderURL, "/")+"/control/sync/data", nil)
+	if err != nil {
+		return d, err
+	}
+	if len(c.Token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return d, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return d, fmt.Errorf("leader responded with HTTP status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, syncMaxSize+1))
+	if err != nil {
+		return d, err
+	}
+	if len(body) > syncMaxSize {
+		return d, fmt.Errorf("the data is too large")
+	}
+	err = json.Unmarshal(body, &d)
+	if err != nil {
+		return d, fmt.Errorf("json.Unmarshal: %s", err)
+	}
+	return d, nil
+}
+
+// Get the hash of the section data
+func syncHash(v ...interface{}) string {
+	data, _ := json.Marshal(v)
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// Apply the sections which have been changed since the last sync
+func (s *syncer) apply(c syncConfig, d syncData) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	type section struct {
+		name  string
+		hash  string
+		apply func() error
+	}
+	list := []section{
+		// custom services go first: they may be used by clients
+		{syncSectionBlockedServices, syncHash(d.BlockedServices, d.CustomServices), func() error {
+			return syncApplyBlockedServices(d.BlockedServices, d.CustomServices)
+		}},
+		{syncSectionFilters, syncHash(d.Filters, d.WhitelistFilters), func() error {
+			syncApplyFilters(d.Filters, d.WhitelistFilters)
+			return nil
+		}},
+		{syncSectionUserRules, syncHash(d.UserRules), func() error {
+			syncApplyUserRules(d.UserRules)
+			return nil
+		}},
+		{syncSectionClients, syncHash(d.Clients), func() error {
+			return syncApplyClients(d.Clients)
+		}},
+		{syncSectionRewrites, syncHash(d.Rewrites), func() error {
+			return syncApplyRewrites(d.Rewrites)
+		}},
+	}
+
+	for _, sec := range list {
+		if !c.includes(sec.name) || s.applied[sec.name] == sec.hash {
+			continue
+		}
+		err := sec.apply()
+		if err != nil {
+			return fmt.Errorf("%s: %s", sec.name, err)
+		}
+		s.applied[sec.name] = sec.hash
+		log.Info("Sync: applied %s", sec.name)
+	}
+	return nil
+}
+
+func syncApplyBlockedServices(services []string, custom []customService) error {
+	tx := beginConfigTx()
+	config.Lock()
+	err := setCustomServices(custom)
+	if err == nil {
+		config.DNS.CustomServices = custom
+		config.DNS.BlockedServices = services
+	}
+	config.Unlock()
+	if err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// Replace the filters downloaded from URLs with the leader's ones
+// The filters from local files are kept.
+func syncApplyFilters(filters, whitelistFilters []syncFilter) {
+	config.Lock()
+	update := syncMergeFilters(&config.Filters, filters, false)
+	if syncMergeFilters(&config.WhitelistFilters, whitelistFilters, true) {
+		update = true
+	}
+	config.Unlock()
+
+	onConfigModified()
+	enableFilters(true)
+	if update {
+		_, _ = refreshFilters(FilterRefreshBlocklists|FilterRefreshAllowlists, true)
+	}
+}
+
+// Return TRUE if the new filters must be downloaded
+func syncMergeFilters(filters *[]filter, list []syncFilter, whitelist bool) bool {
+	cur := map[string]filter{}
+	newFilters := []filter{}
+	for _, f := range *filters {
+		if filterLocalPath(f.URL) != "" {
+			newFilters = append(newFilters, f)
+			continue
+		}
+		cur[f.URL] = f
+	}
+
+	update := false
+	seen := map[string]bool{}
+	for _, sf := range list {
+		if !IsValidURL(sf.URL) || filterLocalPath(sf.URL) != "" || seen[sf.URL] {
+			continue
+		}
+		seen[sf.URL] = true
+
+		f, ok := cur[sf.URL]
+		if ok {
+			delete(cur, sf.URL)
+			if f.Enabled != sf.Enabled {
+				if !sf.Enabled {
+					f.unload()
+				} else if f.load() != nil {
+					f.LastUpdated = time.Time{}
+					f.checksum = 0
+					f.RulesCount = 0
+					update = true
+				}
+			}
+		} else {
+			f = filter{URL: sf.URL, white: whitelist}
+			f.ID = assignUniqueFilterID()
+			update = update || sf.Enabled
+		}
+		f.Name = sf.Name
+		f.Enabled = sf.Enabled
+		newFilters = append(newFilters, f)
+	}
+
+	for _, f := range cur {
+		err := os.Rename(f.Path(), f.Path()+".old")
+		if err != nil && !os.IsNotExist(err) {
+			log.Error("os.Rename: %s: %s", f.Path(), err)
+		}
+	}
+	*filters = newFilters
+	return update
+}
+
+func syncApplyUserRules(rules []userRule) {
+	config.Lock()
+	config.UserRules = append([]userRule{}, rules...)
+	assignUserRuleIDs(config.UserRules)
+	config.Unlock()
+	applyUserRules()
+}
+
+func syncApplyClients(list []clientJSON) error {
+	clients := []Client{}
+	for _, cj := range list {
+		c, err := jsonToClient(cj)
+		if err != nil {
+			return err
+		}
+		clients = append(clients, *c)
+	}
+	err := Context.clients.SetAll(clients)
+	if err != nil {
+		return err
+	}
+	onConfigModified()
+	return nil
+}
+
+func syncApplyRewrites(list []syncRewrite) error {
+	rewrites := []dnsfilter.RewriteEntry{}
+	for _, r := range list {
+		rewrites = append(rewrites, dnsfilter.RewriteEntry{Domain: r.Domain, Answer: r.Answer, QType: r.QType})
+	}
+	err := Context.dnsFilter.SetRewrites(rewrites)
+	if err != nil {
+		return err
+	}
+	onConfigModified()
+	return nil
+}
+
+// Request the settings from leader and apply them
+func (s *syncer) run(c syncConfig) error {
+	d, err := s.fetch(c)
+	if err == nil {
+		err = s.apply(c, d)
+	}
+
+	s.lock.Lock()
+	if err != nil {
+		s.lastError = err.Error()
+	} else {
+		s.lastError = ""
+		s.lastSync = time.Now()
+	}
+	s.lock.Unlock()
+	return err
+}
+
+func (s *syncer) loop() {
+	var last time.Time
+	for {
+		time.Sleep(syncCheckInterval)
+
+		config.RLock()
+		c := config.Sync
+		c.Exclude = stringArrayDup(config.Sync.Exclude)
+		config.RUnlock()
+		if len(c.LeaderURL) == 0 || time.Since(last) < time.Duration(c.Interval)*time.Minute {
+			continue
+		}
+
+		last = time.Now()
+		err := s.run(c)
+		if err != nil {
+			log.Info("Sync: %s: %s", c.LeaderURL, err)
+		}
+	}
+}
+
+// Get the settings for followers
+func handleSyncData(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, syncCollect())
+}
+
+type syncStatusJSON struct {
+	syncConfig
+	Sections  []string `json:"sections"`   // all sections
+	LastSync  string   `json:"last_sync"`  // RFC3339.  Empty: no successful sync yet
+	LastError string   `json:"last_error"` // the error of the last attempt
+}
+
+func handleSyncStatus(w http.ResponseWriter, r *http.Request) {
+	resp := syncStatusJSON{Sections: syncSections}
+	config.RLock()
+	resp.syncConfig = config.Sync
+	resp.Exclude = stringArrayDup(config.Sync.Exclude)
+	config.RUnlock()
+	resp.Token = ""
+	if resp.Exclude == nil {
+		resp.Exclude = []string{}
+	}
+
+	s := Context.syncer
+	s.lock.Lock()
+	if !s.lastSync.IsZero() {
+		resp.LastSync = s.lastSync.Format(time.RFC3339)
+	}
+	resp.LastError = s.lastError
+	s.lock.Unlock()
+
+	writeJSON(w, resp)
+}
+
+// Set the settings of configuration sync
+// If the token isn't set and the leader URL hasn't been changed, the current token is kept.
+func handleSyncConfig(w http.ResponseWriter, r *http.Request) {
+	c := syncConfig{}
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	if len(c.LeaderURL) != 0 && c.Interval == 0 {
+		c.Interval = syncDefaultInterval
+	}
+	err = checkSyncConfig(c)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	if len(c.Token) == 0 && c.LeaderURL == config.Sync.LeaderURL {
+		c.Token = config.Sync.Token
+	}
+	config.Sync = c
+	config.Unlock()
+	onConfigModified()
+
+	// the sections that are replicated again must be applied on the next sync
+	s := Context.syncer
+	s.lock.Lock()
+	s.applied = map[string]string{}
+	s.lock.Unlock()
+
+	httpOK(r, w)
+}
+
+// Sync now
+func handleSyncNow(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	c := config.Sync
+	c.Exclude = stringArrayDup(config.Sync.Exclude)
+	config.RUnlock()
+	if len(c.LeaderURL) == 0 {
+		httpError(w, http.StatusBadRequest, "sync is disabled")
+		return
+	}
+
+	err := Context.syncer.run(c)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, "%s", err)
+		return
+	}
+	httpOK(r, w)
+}
+
+// RegisterSyncHandlers - register HTTP handlers
+func RegisterSyncHandlers() {
+	httpRegister(http.MethodGet, "/control/sync/data", handleSyncData)
+	httpRegister(http.MethodGet, "/control/sync/status", handleSyncStatus)
+	httpRegister(http.MethodPost, "/control/sync/config", handleSyncConfig)
+	httpRegister(http.MethodPost, "/control/sync/now", handleSyncNow)
+}
@@ -0,0 +1,89 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSyncConfig(t *testing.T) {
+	assert.Nil(t, checkSyncConfig(syncConfig{}))
+	assert.Nil(t, checkSyncConfig(syncConfig{LeaderURL: "https://primary.example.org", Interval: 10, Exclude: []string{"clients"}}))
+	assert.NotNil(t, checkSyncConfig(syncConfig{LeaderURL: "ftp://primary.example.org", Interval: 10}))
+	assert.NotNil(t, checkSyncConfig(syncConfig{LeaderURL: "https://", Interval: 10}))
+	assert.NotNil(t, checkSyncConfig(syncConfig{LeaderURL: "https://primary.example.org"}))
+	assert.NotNil(t, checkSyncConfig(syncConfig{LeaderURL: "https://primary.example.org", Interval: 10, Exclude: []string{"dns"}}))
+
+	c := syncConfig{Exclude: []string{syncSectionClients}}
+	assert.False(t, c.includes(syncSectionClients))
+	assert.True(t, c.includes(syncSectionFilters))
+}
+
+func TestSyncMergeFilters(t *testing.T) {
+	prevNextFilterID := nextFilterID
+	defer func() { nextFilterID = prevNextFilterID }()
+	nextFilterID = 100
+
+	filters := []filter{
+		{URL: "/opt/local.txt", Name: "local", Enabled: true},
+		{URL: "https://example.org/1.txt", Name: "1"},
+		{URL: "https://example.org/2.txt", Name: "2", Enabled: true},
+	}
+	filters[1].ID = 1
+	filters[2].ID = 2
+	update := syncMergeFilters(&filters, []syncFilter{
+		{URL: "https://example.org/3.txt", Name: "3", Enabled: true},
+		{URL: "https://example.org/1.txt", Name: "one"},
+		{URL: "https://example.org/3.txt", Name: "duplicate", Enabled: true},
+		{URL: "/etc/leader.txt", Name: "leader's local file", Enabled: true},
+	}, false)
+
+	// the local filter is kept, the removed filter is deleted, the new filter must be downloaded
+	assert.True(t, update)
+	assert.Equal(t, 3, len(filters))
+	assert.Equal(t, "local", filters[0].Name)
+	assert.Equal(t, "3", filters[1].Name)
+	assert.Equal(t, int64(100), filters[1].ID)
+	assert.True(t, filters[1].Enabled)
+	assert.Equal(t, "one", filters[2].Name)
+	assert.Equal(t, int64(1), filters[2].ID)
+
+	// nothing to download
+	update = syncMergeFilters(&filters, []syncFilter{{URL: "https://example.org/1.txt", Name: "one"}}, false)
+	assert.False(t, update)
+	assert.Equal(t, 2, len(filters))
+}
+
+func TestSyncFetch(t *testing.T) {
+	data := syncData{
+		UserRules:       []userRule{{Text: "||example.org^", Enabled: true}},
+		Rewrites:        []syncRewrite{{Domain: "host.lan", Answer: "192.168.1.1"}},
+		BlockedServices: []string{"youtube"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/control/sync/data" || r.Header.Get("Authorization") != "Bearer agh_secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(data)
+	}))
+	defer srv.Close()
+
+	s := newSyncer()
+	d, err := s.fetch(syncConfig{LeaderURL: srv.URL + "/", Token: "agh_secret"})
+	assert.Nil(t, err)
+	assert.Equal(t, data.UserRules[0].Text, d.UserRules[0].Text)
+	assert.Equal(t, data.Rewrites, d.Rewrites)
+	assert.Equal(t, data.BlockedServices, d.BlockedServices)
+
+	_, err = s.fetch(syncConfig{LeaderURL: srv.URL, Token: "agh_wrong"})
+	assert.NotNil(t, err)
+
+	// unchanged sections and excluded sections aren't applied
+	c := syncConfig{Exclude: []string{syncSectionFilters, syncSectionUserRules, syncSectionClients, syncSectionRewrites}}
+	s.applied[syncSectionBlockedServices] = syncHash(d.BlockedServices, d.CustomServices)
+	assert.Nil(t, s.apply(c, d))
+}
@@ -0,0 +1,178 @@
+// Hot reload of TLS certificate: the servers use the new certificate without restarting
+
+package home
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Interval between the checks of the certificate and private key files
+const tlsWatchInterval = 1 * time.Minute
+
+func (h *HTTPSServer) setCertificate(cert tls.Certificate) {
+	h.certLock.Lock()
+	h.cert = cert
+	h.certLock.Unlock()
+}
+
+func (h *HTTPSServer) setServerNames(names *dnsforward.TLSCertificates) {
+	h.certLock.Lock()
+	h.names = names
+	h.certLock.Unlock()
+}
+
+// The certificate of an additional server name is selected by SNI value; otherwise the main certificate is used
+func (h *HTTPSServer) getCertificate(ch *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	h.certLock.RLock()
+	defer h.certLock.RUnlock()
+	if c := h.names.Get(ch.ServerName); c != nil {
+		return c, nil
+	}
+	cert := h.cert
+	return &cert, nil
+}
+
+// Get the modification time and size of the certificate and private key files
+// Return an empty string if the files aren't used.
+func tlsFilesState() string {
+	config.RLock()
+	files := []string{config.TLS.CertificatePath, config.TLS.PrivateKeyPath}
+	for _, n := range config.TLS.ServerNames {
+		files = append(files, n.CertificatePath, n.PrivateKeyPath)
+	}
+	config.RUnlock()
+
+	state := ""
+	for _, fn := range files {
+		if len(fn) == 0 {
+			continue
+		}
+		st, err := os.Stat(fn)
+		if err != nil {
+			state += fn + " -;"
+			continue
+		}
+		state += fmt.Sprintf("%s %d %d;", fn, st.ModTime().UnixNano(), st.Size())
+	}
+	return state
+}
+
+// Reload the certificate when its files have changed
+func tlsWatchLoop() {
+	state := tlsFilesState()
+	for {
+		time.Sleep(tlsWatchInterval)
+		cur := tlsFilesState()
+		if cur == state {
+			continue
+		}
+		state = cur
+		if len(state) != 0 {
+			tlsReload()
+		}
+	}
+}
+
+// Load the certificate and private key from files and use them
+func tlsReload() {
+	config.RLock()
+	data := config.TLS
+	config.RUnlock()
+	if !data.Enabled || data.ACME.Enabled {
+		return
+	}
+
+	status := tlsConfigStatus{}
+	if !tlsLoadConfig(&data, &status) {
+		log.Error("TLS: reload: %s", status.WarningValidation)
+		return
+	}
+	err := tlsUpdateCertificate(data.CertificateChainData, data.PrivateKeyData)
+	if err != nil {
+		log.Error("TLS: reload: %s", err)
+		return
+	}
+	err = tlsUpdateServerNames(data.ServerNames)
+	if err != nil {
+		log.Error("TLS: reload: %s", err)
+		return
+	}
+	log.Info("TLS: the certificate has been reloaded")
+}
+
+// Use the new certificate for HTTPS, DNS-over-HTTPS and DNS-over-TLS servers without restarting them
+func tlsUpdateCertificate(certChain, privateKey []byte) error {
+	config.RLock()
+	serverName := config.TLS.ServerName
+	hadCert := len(config.TLS.CertificateChainData) != 0 && len(config.TLS.PrivateKeyData) != 0
+	config.RUnlock()
+
+	status := validateCertificates(string(certChain), string(privateKey), serverName)
+	if !status.ValidPair {
+		return fmt.Errorf("%s", status.WarningValidation)
+	}
+	cert, err := tls.X509KeyPair(certChain, privateKey)
+	if err != nil {
+		return err
+	}
+
+	config.Lock()
+	config.TLS.CertificateChainData = certChain
+	config.TLS.PrivateKeyData = privateKey
+	config.TLS.tlsConfigStatus = status
+	config.Unlock()
+
+	Context.httpsServer.setCertificate(cert)
+	if Context.httpsServer.server == nil && Context.httpsServer.cond != nil {
+		// HTTPS server is waiting for the certificate
+		restartHTTPS()
+	}
+
+	if Context.dnsServer != nil && isRunning() {
+		if hadCert {
+			err = Context.dnsServer.UpdateCertificate(certChain, privateKey)
+		} else {
+			// DNS-over-TLS server hasn't been started without the certificate
+			err = reconfigureDNSServer()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Use the new certificates of the additional server names without restarting the servers
+func tlsUpdateServerNames(names []dnsforward.TLSServerName) error {
+	c, err := dnsforward.NewTLSCertificates(names)
+	if err != nil {
+		return err
+	}
+
+	config.Lock()
+	config.TLS.ServerNames = names
+	config.Unlock()
+
+	Context.httpsServer.setServerNames(c)
+	if Context.dnsServer != nil && isRunning() {
+		return Context.dnsServer.UpdateServerNames(names)
+	}
+	return nil
+}
+
+// Return TRUE if the certificate expires in less than the number of days set by certificate_expire_days
+func tlsExpiresSoon(notAfter time.Time) bool {
+	config.RLock()
+	days := config.Notifications.CertificateExpireDays
+	config.RUnlock()
+	if days == 0 {
+		days = notifyDefaultCertDays
+	}
+	return !notAfter.IsZero() && time.Until(notAfter) < time.Duration(days)*24*time.Hour
+}
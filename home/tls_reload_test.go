@@ -0,0 +1,184 @@
+package home
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-tls")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	prevTLS := config.TLS
+	defer func() { config.TLS = prevTLS }()
+
+	writeCert := func(notAfter time.Time) []byte {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		cert := testACMECertificate(t, key.Public(), key, []string{"dns.example.org"}, notAfter)
+		keyPEM, err := encodeECKey(key)
+		assert.Nil(t, err)
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "cert.pem"), cert, 0600))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600))
+		return cert
+	}
+	httpsCert := func() []byte {
+		c, err := Context.httpsServer.getCertificate(&tls.ClientHelloInfo{})
+		assert.Nil(t, err)
+		if len(c.Certificate) == 0 {
+			return nil
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]})
+	}
+
+	config.TLS = tlsConfig{}
+	config.TLS.Enabled = true
+	config.TLS.CertificatePath = filepath.Join(dir, "cert.pem")
+	config.TLS.PrivateKeyPath = filepath.Join(dir, "key.pem")
+	noFiles := tlsFilesState()
+
+	cert := writeCert(time.Now().Add(90 * 24 * time.Hour))
+	state := tlsFilesState()
+	assert.NotEqual(t, noFiles, state)
+	tlsReload()
+	assert.Equal(t, cert, httpsCert())
+	assert.Equal(t, cert, config.TLS.CertificateChainData)
+	assert.False(t, tlsExpiresSoon(config.TLS.NotAfter))
+
+	// the files have changed
+	time.Sleep(10 * time.Millisecond)
+	cert = writeCert(time.Now().Add(24 * time.Hour))
+	assert.NotEqual(t, state, tlsFilesState())
+	tlsReload()
+	assert.Equal(t, cert, httpsCert())
+	assert.True(t, tlsExpiresSoon(config.TLS.NotAfter))
+
+	// the invalid certificate isn't used
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte("invalid"), 0600))
+	tlsReload()
+	assert.Equal(t, cert, httpsCert())
+}
+
+func TestTLSServerNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-tls")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	prevNames := Context.httpsServer.names
+	defer func() { Context.httpsServer.setServerNames(prevNames) }()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyPEM, _ := encodeECKey(key)
+	cert := testACMECertificate(t, key.Public(), key, []string{"*.dns.example.com"}, time.Now().Add(24*time.Hour))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "cert.pem"), cert, 0600))
+
+	block, _ := pem.Decode(cert)
+	x, _ := x509.ParseCertificate(block.Bytes)
+	assert.True(t, coversSubdomains(x, "dns.example.com"))
+	assert.True(t, coversSubdomains(x, "DNS.example.com."))
+	assert.False(t, coversSubdomains(x, "example.com"))
+
+	conf := tlsConfig{}
+	conf.ServerName = "dns.example.org"
+	conf.ServerNames = []dnsforward.TLSServerName{{
+		ServerName:      "dns.example.com",
+		CertificatePath: filepath.Join(dir, "cert.pem"),
+		PrivateKey:      string(keyPEM),
+		ClientIDMode:    dnsforward.ClientIDModePath,
+	}}
+	names := conf.ServerNames
+	status := tlsConfigStatus{}
+	assert.True(t, tlsLoadConfig(&conf, &status))
+	assert.Equal(t, cert, conf.ServerNames[0].CertificateChainData)
+	// the original array isn't changed
+	assert.Nil(t, names[0].CertificateChainData)
+
+	// the certificate is selected by SNI value
+	c, err := dnsforward.NewTLSCertificates(conf.ServerNames)
+	assert.Nil(t, err)
+	Context.httpsServer.setServerNames(c)
+	hc, err := Context.httpsServer.getCertificate(&tls.ClientHelloInfo{ServerName: "phone.dns.example.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, block.Bytes, hc.Certificate[0])
+
+	// the certificates are base64-encoded in API
+	data := conf
+	data.ServerNames[0].CertificatePath = ""
+	data.ServerNames[0].CertificateChain = string(cert)
+	w := httptest.NewRecorder()
+	marshalTLS(w, data)
+	assert.Equal(t, string(cert), data.ServerNames[0].CertificateChain)
+	resp := struct {
+		ServerNames []dnsforward.TLSServerName `json:"server_names"`
+	}{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(cert), resp.ServerNames[0].CertificateChain)
+	r := httptest.NewRequest("POST", "/control/tls/configure", bytes.NewReader(w.Body.Bytes()))
+	decoded, err := unmarshalTLS(r)
+	assert.Nil(t, err)
+	assert.Equal(t, string(cert), decoded.ServerNames[0].CertificateChain)
+	assert.Equal(t, string(keyPEM), decoded.ServerNames[0].PrivateKey)
+
+	// the private keys are sent to admins only
+	stripped := withoutTLSSecrets(data)
+	assert.Equal(t, "", stripped.ServerNames[0].PrivateKey)
+	assert.Equal(t, string(cert), stripped.ServerNames[0].CertificateChain)
+	assert.Equal(t, string(keyPEM), data.ServerNames[0].PrivateKey)
+
+	// invalid settings
+	conf.ServerNames[0].ClientIDMode = "ip"
+	assert.False(t, tlsLoadConfig(&conf, &status))
+	conf.ServerNames[0].ClientIDMode = ""
+	conf.ServerNames[0].ServerName = "DNS.example.org"
+	assert.False(t, tlsLoadConfig(&conf, &status))
+	assert.Equal(t, "server_names: dns.example.org: duplicate server name", status.WarningValidation)
+	conf.ServerNames[0].ServerName = "dns.example.com"
+	conf.ServerNames[0].PrivateKey = ""
+	assert.False(t, tlsLoadConfig(&conf, &status))
+	conf.ClientIDMode = "unknown"
+	conf.ServerNames = nil
+	assert.False(t, tlsLoadConfig(&conf, &status))
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	prevTLS := config.TLS
+	defer func() { config.TLS = prevTLS }()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := testACMECertificate(t, key.Public(), key, []string{"ca.example.org"}, time.Now().Add(24*time.Hour))
+
+	conf := tlsConfig{}
+	conf.ClientAuth = true
+	status := tlsConfigStatus{}
+	assert.False(t, tlsLoadConfig(&conf, &status))
+	assert.Equal(t, "client CA: no valid CA certificates", status.WarningValidation)
+	conf.ClientCA = string(ca)
+	assert.True(t, tlsLoadConfig(&conf, &status))
+	assert.Equal(t, ca, conf.ClientCAData)
+	conf.ClientCAPath = "/etc/ca.pem"
+	assert.False(t, tlsLoadConfig(&conf, &status))
+
+	// DNS-over-HTTPS requests without a verified client certificate are rejected
+	config.TLS = tlsConfig{}
+	config.TLS.ClientAuth = true
+	r := httptest.NewRequest("GET", "/dns-query?dns=AAABAAABAAAAAAAAB2V4YW1wbGUDb3JnAAABAAE", nil)
+	r.TLS = &tls.ConnectionState{}
+	w := httptest.NewRecorder()
+	handleDOH(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
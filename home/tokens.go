@@ -0,0 +1,368 @@
+// API tokens for scripts and integrations
+
+package home
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/etcd-io/bbolt"
+)
+
+// Token scopes
+const (
+	tokenScopeReadOnly  = "read-only" // may only get the settings and data available to read-only users and sync data
+	tokenScopeFiltering = "filtering" // may only use filtering API
+	tokenScopeFull      = "full"      // the same access as admin, except users and tokens management
+)
+
+// The requests allowed for the tokens with "filtering" scope
+var tokenFilteringPaths = []string{
+	"/control/status",
+	"/control/filtering/",
+	"/control/blocked_services/",
+	"/control/rewrite/",
+	"/control/safebrowsing/",
+	"/control/parental/",
+	"/control/safesearch/",
+	"/control/schedule/",
+}
+
+// The requests that aren't allowed for any token
+var tokenForbiddenPaths = []string{
+	"/control/users/",
+	"/control/2fa/",
+	"/control/tokens/",
+	"/control/backup",     // the archive contains password hashes
+	"/control/debug/",     // support bundle contains logs, profiles contain the data of the process
+	"/control/tls/status", // private keys
+}
+
+// The requests allowed for the tokens with "read-only" scope in addition to the methods available to read-only users
+var tokenReadOnlyPaths = []string{
+	"/control/sync/data", // followers get the settings from leader
+}
+
+const tokenLastUsedInterval = 60 // the time interval (in seconds) after which the last use time is stored in DB
+
+const tokenPrefix = "agh_"
+
+// API token
+type apiToken struct {
+	Name    string    `yaml:"name"`
+	Hash    string    `yaml:"hash"` // SHA-256 hash of the token
+	Scope   string    `yaml:"scope"`
+	Created time.Time `yaml:"created"`
+}
+
+// Get token ID: the first bytes of its hash
+func (t *apiToken) id() string {
+	if len(t.Hash) < 16 {
+		return t.Hash
+	}
+	return t.Hash[:16]
+}
+
+func isValidTokenScope(scope string) bool {
+	return scope == tokenScopeReadOnly || scope == tokenScopeFiltering || scope == tokenScopeFull
+}
+
+func tokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Return TRUE if the request is allowed for the token scope
+// role: the minimum role for the request path
+func tokenAllowed(scope string, r *http.Request, role string) bool {
+	for _, p := range tokenForbiddenPaths {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return false
+		}
+	}
+	switch scope {
+	case tokenScopeFull:
+		return true
+	case tokenScopeReadOnly:
+		if r.Method != http.MethodGet {
+			return false
+		}
+		for _, p := range tokenReadOnlyPaths {
+			if r.URL.Path == p {
+				return true
+			}
+		}
+		return role == roleReadOnly
+	case tokenScopeFiltering:
+		for _, p := range tokenFilteringPaths {
+			if strings.HasPrefix(r.URL.Path, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func tokenBucketName() []byte {
+	return []byte("api-tokens")
+}
+
+// Set tokens and load their last use time from DB
+func (a *Auth) setTokens(tokens []apiToken) {
+	lastUsed := map[string]uint32{}
+	_ = a.db.View(func(tx *bbolt.Tx) error {
+		bkt := tx.Bucket(tokenBucketName())
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			if len(v) == 4 {
+				lastUsed[string(k)] = binary.BigEndian.Uint32(v)
+			}
+			return nil
+		})
+	})
+
+	a.lock.Lock()
+	a.tokens = tokens
+	a.tokensLastUsed = lastUsed
+	a.lock.Unlock()
+}
+
+// Get tokens
+func (a *Auth) getTokens() []apiToken {
+	a.lock.Lock()
+	tokens := a.tokens
+	a.lock.Unlock()
+	return tokens
+}
+
+// Find the token from "Authorization: Bearer ..." header and update its last use time
+// Return FALSE if there's no such token.
+func (a *Auth) findToken(r *http.Request) (apiToken, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return apiToken{}, false
+	}
+	hash := tokenHash(strings.TrimSpace(auth[len("Bearer "):]))
+
+	now := uint32(time.Now().Unix())
+	a.lock.Lock()
+	var t apiToken
+	found := false
+	for _, tok := range a.tokens {
+		if tok.Hash == hash {
+			t = tok
+			found = true
+			break
+		}
+	}
+	store := false
+	if found && now-a.tokensLastUsed[t.id()] >= tokenLastUsedInterval {
+		a.tokensLastUsed[t.id()] = now
+		store = true
+	}
+	a.lock.Unlock()
+
+	if store {
+		a.storeTokenLastUsed(t.id(), now)
+	}
+	return t, found
+}
+
+// Get the user on whose behalf the token makes requests
+func (t *apiToken) user() User {
+	u := User{Name: "token:" + t.Name, tokenScope: t.Scope}
+	switch t.Scope {
+	case tokenScopeReadOnly:
+		u.Role = roleReadOnly
+	case tokenScopeFiltering:
+		u.Role = roleOperator
+	}
+	return u
+}
+
+func (a *Auth) storeTokenLastUsed(id string, t uint32) {
+	err := a.db.Update(func(tx *bbolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(tokenBucketName())
+		if err != nil {
+			return err
+		}
+		var data [4]byte
+		binary.BigEndian.PutUint32(data[:], t)
+		return bkt.Put([]byte(id), data[:])
+	})
+	if err != nil {
+		log.Error("Auth: bbolt: %s", err)
+	}
+}
+
+func (a *Auth) removeTokenLastUsed(id string) {
+	err := a.db.Update(func(tx *bbolt.Tx) error {
+		bkt := tx.Bucket(tokenBucketName())
+		if bkt == nil {
+			return nil
+		}
+		return bkt.Delete([]byte(id))
+	})
+	if err != nil {
+		log.Error("Auth: bbolt: %s", err)
+	}
+}
+
+type tokenJSON struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Scope    string `json:"scope"`
+	Created  string `json:"created"`             // RFC3339
+	LastUsed string `json:"last_used,omitempty"` // RFC3339
+}
+
+func handleTokensList(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		httpError(w, http.StatusForbidden, "not allowed")
+		return
+	}
+	a := Context.auth
+	list := []tokenJSON{}
+	a.lock.Lock()
+	for _, t := range a.tokens {
+		j := tokenJSON{
+			ID:      t.id(),
+			Name:    t.Name,
+			Scope:   t.Scope,
+			Created: t.Created.Format(time.RFC3339),
+		}
+		if lastUsed, ok := a.tokensLastUsed[t.id()]; ok {
+			j.LastUsed = time.Unix(int64(lastUsed), 0).Format(time.RFC3339)
+		}
+		list = append(list, j)
+	}
+	a.lock.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	writeJSON(w, list)
+}
+
+type tokenCreateJSON struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+type tokenCreatedJSON struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+}
+
+// Create a new token
+// The token itself is returned only once, only its hash is stored.
+func (a *Auth) createToken(name string, scope string) (apiToken, string, error) {
+	if len(name) == 0 {
+		return apiToken{}, "", fmt.Errorf("name is empty")
+	}
+	if !isValidTokenScope(scope) {
+		return apiToken{}, "", fmt.Errorf("invalid scope: %s", scope)
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return apiToken{}, "", err
+	}
+	token := tokenPrefix + hex.EncodeToString(b)
+	t := apiToken{
+		Name:    name,
+		Hash:    tokenHash(token),
+		Scope:   scope,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, tok := range a.tokens {
+		if tok.Name == name {
+			return apiToken{}, "", fmt.Errorf("token %s already exists", name)
+		}
+	}
+	a.tokens = append(append([]apiToken{}, a.tokens...), t)
+	return t, token, nil
+}
+
+// Remove the token by its ID
+// Return FALSE if there's no such token.
+func (a *Auth) revokeToken(id string) bool {
+	a.lock.Lock()
+	tokens := []apiToken{}
+	for _, t := range a.tokens {
+		if t.id() != id {
+			tokens = append(tokens, t)
+		}
+	}
+	found := len(tokens) != len(a.tokens)
+	a.tokens = tokens
+	delete(a.tokensLastUsed, id)
+	a.lock.Unlock()
+
+	if found {
+		a.removeTokenLastUsed(id)
+	}
+	return found
+}
+
+func handleTokensCreate(w http.ResponseWriter, r *http.Request) {
+	req := tokenCreateJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+
+	t, token, err := Context.auth.createToken(req.Name, req.Scope)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	onConfigModified()
+	log.Info("Auth: created token %s with scope %s", t.Name, t.Scope)
+
+	writeJSON(w, tokenCreatedJSON{ID: t.id(), Token: token})
+}
+
+type tokenRevokeJSON struct {
+	ID string `json:"id"`
+}
+
+func handleTokensRevoke(w http.ResponseWriter, r *http.Request) {
+	req := tokenRevokeJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+
+	if !Context.auth.revokeToken(req.ID) {
+		httpError(w, http.StatusBadRequest, "token %s not found", req.ID)
+		return
+	}
+	onConfigModified()
+	log.Info("Auth: revoked token %s", req.ID)
+
+	returnOK(w)
+}
+
+// RegisterTokensHandlers - register handlers
+func RegisterTokensHandlers() {
+	httpRegister(http.MethodGet, "/control/tokens/list", handleTokensList)
+	httpRegister(http.MethodPost, "/control/tokens/create", handleTokensCreate)
+	httpRegister(http.MethodPost, "/control/tokens/revoke", handleTokensRevoke)
+}
@@ -0,0 +1,85 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokens(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "sessions.db")
+
+	a := InitAuth(fn, []User{User{Name: "admin"}}, 60)
+	prevAuth := Context.auth
+	Context.auth = a
+	defer func() { Context.auth = prevAuth }()
+
+	_, _, err := a.createToken("ro", "admin")
+	assert.NotNil(t, err)
+	ro, roToken, err := a.createToken("ro", tokenScopeReadOnly)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(roToken, tokenPrefix))
+	assert.NotEqual(t, roToken, ro.Hash)
+	_, _, err = a.createToken("ro", tokenScopeFull)
+	assert.NotNil(t, err)
+	_, filteringToken, _ := a.createToken("filtering", tokenScopeFiltering)
+	full, fullToken, _ := a.createToken("full", tokenScopeFull)
+
+	check := func(token, method, path string) int {
+		handler := optionalAuth(auditHandler(routeRole(path), func(w http.ResponseWriter, r *http.Request) {}))
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, check("agh_unknown", http.MethodGet, "/control/status"))
+
+	assert.Equal(t, http.StatusOK, check(roToken, http.MethodGet, "/control/status"))
+	assert.Equal(t, http.StatusForbidden, check(roToken, http.MethodPost, "/control/filtering/refresh"))
+	assert.Equal(t, http.StatusOK, check(roToken, http.MethodGet, "/control/sync/data"))
+	assert.Equal(t, http.StatusForbidden, check(roToken, http.MethodGet, "/control/tls/status"))
+	assert.Equal(t, http.StatusForbidden, check(roToken, http.MethodGet, "/control/querylog/export"))
+	assert.Equal(t, http.StatusForbidden, check(roToken, http.MethodGet, "/control/notifications"))
+
+	assert.Equal(t, http.StatusOK, check(filteringToken, http.MethodPost, "/control/filtering/refresh"))
+	assert.Equal(t, http.StatusOK, check(filteringToken, http.MethodGet, "/control/filtering/status"))
+	assert.Equal(t, http.StatusForbidden, check(filteringToken, http.MethodGet, "/control/querylog"))
+	assert.Equal(t, http.StatusForbidden, check(filteringToken, http.MethodPost, "/control/dns_config"))
+
+	assert.Equal(t, http.StatusOK, check(fullToken, http.MethodPost, "/control/dns_config"))
+	assert.Equal(t, http.StatusForbidden, check(fullToken, http.MethodPost, "/control/tokens/create"))
+	assert.Equal(t, http.StatusForbidden, check(fullToken, http.MethodGet, "/control/users/list"))
+	assert.Equal(t, http.StatusForbidden, check(fullToken, http.MethodGet, "/control/tls/status"))
+
+	// the last use time is stored in DB
+	tokens := a.getTokens()
+	assert.Equal(t, 3, len(tokens))
+	a.Close()
+	a = InitAuth(fn, []User{User{Name: "admin"}}, 60)
+	defer a.Close()
+	Context.auth = a
+	a.setTokens(tokens)
+	_, ok := a.tokensLastUsed[ro.id()]
+	assert.True(t, ok)
+
+	assert.True(t, a.revokeToken(full.id()))
+	assert.False(t, a.revokeToken(full.id()))
+	assert.Equal(t, 2, len(a.getTokens()))
+	assert.Equal(t, http.StatusForbidden, check(fullToken, http.MethodGet, "/control/status"))
+	_, ok = a.tokensLastUsed[full.id()]
+	assert.False(t, ok)
+
+	u := ro.user()
+	assert.Equal(t, roleReadOnly, u.role())
+	u = full.user()
+	assert.Equal(t, roleAdmin, u.role())
+}
@@ -0,0 +1,406 @@
+// Two-factor authentication with time-based one-time passwords (RFC 6238)
+
+package home
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	totpDigits      = 6
+	totpPeriod      = 30 // in seconds
+	totpSkew        = 1  // the number of periods before and after the current one for which the codes are accepted
+	totpSecretLen   = 20 // in bytes
+	totpBackupCodes = 10 // the number of backup codes
+	totpIssuer      = "AdGuard Home"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Get HOTP value (RFC 4226)
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	_, _ = mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	off := sum[len(sum)-1] & 0x0f
+	val := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, val%mod)
+}
+
+// Check the code for the time
+// Return the counter value for which the code is valid or 0 if the code is invalid.
+func totpCheck(secret string, code string, now time.Time) uint64 {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0
+	}
+	cur := uint64(now.Unix()) / totpPeriod
+	for c := cur - totpSkew; c <= cur+totpSkew; c++ {
+		if hmac.Equal([]byte(totpCode(key, c)), []byte(code)) {
+			return c
+		}
+	}
+	return 0
+}
+
+// Generate a new secret
+func totpNewSecret() (string, error) {
+	key := make([]byte, totpSecretLen)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(key), nil
+}
+
+// Get the provisioning URI for authenticator apps
+func totpURI(name, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprintf("%d", totpDigits))
+	q.Set("period", fmt.Sprintf("%d", totpPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + name,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// Normalize backup code entered by user: "ABCD-1234" -> "abcd1234"
+func totpNormalizeCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	return code
+}
+
+func totpHashBackupCode(code string) string {
+	hash := sha256.Sum256([]byte(totpNormalizeCode(code)))
+	return hex.EncodeToString(hash[:])
+}
+
+// Generate backup codes
+// Return the codes and their hashes which are stored in configuration file.
+func totpNewBackupCodes() ([]string, []string, error) {
+	var codes, hashes []string
+	for i := 0; i < totpBackupCodes; i++ {
+		b := make([]byte, 4)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		s := hex.EncodeToString(b)
+		code := s[:4] + "-" + s[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, totpHashBackupCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// Get 2FA state of the user which the sessions are bound to
+// A session is valid only while 2FA state of its user is the same as it was at the time of log-in.
+func totpState(u User) uint32 {
+	if len(u.TOTPSecret) == 0 {
+		return 0
+	}
+	hash := sha256.Sum256([]byte(u.TOTPSecret))
+	return binary.BigEndian.Uint32(hash[:4]) | 1
+}
+
+// Check 2FA code or backup code of the user
+// A used backup code is removed, a used 2FA code can't be used again.
+// Return FALSE if the code is invalid.
+// Return backup=TRUE if backup code is used and the configuration must be saved.
+func (a *Auth) checkTOTP(u User, code string) (ok bool, backup bool) {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		counter := totpCheck(u.TOTPSecret, code, time.Now())
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if counter == 0 || counter <= a.totpLast[u.Name] {
+			return false, false
+		}
+		a.totpLast[u.Name] = counter
+		return true, false
+	}
+
+	hash := totpHashBackupCode(code)
+	found := false
+	a.updateUser(u.Name, func(u *User) {
+		for i, h := range u.TOTPBackupCodes {
+			if h == hash {
+				u.TOTPBackupCodes = append(u.TOTPBackupCodes[:i:i], u.TOTPBackupCodes[i+1:]...)
+				found = true
+				return
+			}
+		}
+	})
+	if found {
+		log.Info("Auth: %s: used backup code", u.Name)
+	}
+	return found, found
+}
+
+// Change the user's data
+// The list of users is copied because it's shared with the readers.
+func (a *Auth) updateUser(name string, change func(u *User)) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	users := append([]User{}, a.users...)
+	for i := range users {
+		if users[i].Name == name {
+			change(&users[i])
+			a.users = users
+			return true
+		}
+	}
+	return false
+}
+
+// Bind the session to the current 2FA state of its user
+func (a *Auth) bindSession(sess string, u User) {
+	a.lock.Lock()
+	s, ok := a.sessions[sess]
+	if ok {
+		s.totp = totpState(u)
+	}
+	a.lock.Unlock()
+	if ok {
+		key, _ := hex.DecodeString(sess)
+		a.storeSession(key, s)
+	}
+}
+
+// Get the user who makes the request with a session
+// Return FALSE and send an error response otherwise.
+func totpSessionUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	u, ok := currentUser(r)
+	if !ok {
+		httpError(w, http.StatusBadRequest, "authentication is disabled")
+		return User{}, false
+	}
+	return u, true
+}
+
+type totpStatusJSON struct {
+	Enabled     bool `json:"enabled"`
+	BackupCodes int  `json:"backup_codes"` // the number of unused backup codes
+}
+
+type totpEnrollJSON struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`     // otpauth://totp/...
+	QRCode string `json:"qr_code"` // data:image/png;base64,...
+}
+
+type totpCodeJSON struct {
+	Code string `json:"code"`
+	Name string `json:"name,omitempty"` // disable: admin may disable 2FA of another user
+}
+
+type totpBackupCodesJSON struct {
+	BackupCodes []string `json:"backup_codes"`
+}
+
+func handleTOTPStatus(w http.ResponseWriter, r *http.Request) {
+	u, ok := totpSessionUser(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, totpStatusJSON{
+		Enabled:     len(u.TOTPSecret) != 0,
+		BackupCodes: len(u.TOTPBackupCodes),
+	})
+}
+
+// Generate a new secret;  2FA is enabled after the user confirms it with a valid code
+func handleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	u, ok := totpSessionUser(w, r)
+	if !ok {
+		return
+	}
+	if len(u.TOTPSecret) != 0 {
+		httpError(w, http.StatusBadRequest, "2FA is already enabled")
+		return
+	}
+
+	secret, err := totpNewSecret()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	resp := totpEnrollJSON{
+		Secret: secret,
+		URI:    totpURI(u.Name, secret),
+	}
+	img, err := qrPNG([]byte(resp.URI), 4)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	resp.QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString(img)
+
+	Context.auth.lock.Lock()
+	Context.auth.totpPending[u.Name] = secret
+	Context.auth.lock.Unlock()
+
+	writeJSON(w, resp)
+}
+
+func handleTOTPEnable(w http.ResponseWriter, r *http.Request) {
+	u, ok := totpSessionUser(w, r)
+	if !ok {
+		return
+	}
+	req := totpCodeJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+
+	a := Context.auth
+	a.lock.Lock()
+	secret := a.totpPending[u.Name]
+	a.lock.Unlock()
+	if len(secret) == 0 {
+		httpError(w, http.StatusBadRequest, "2FA enrollment isn't started")
+		return
+	}
+	u.TOTPSecret = secret
+	if ok, _ := a.checkTOTP(u, req.Code); !ok {
+		httpError(w, http.StatusBadRequest, "invalid 2FA code")
+		return
+	}
+
+	codes, hashes, err := totpNewBackupCodes()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	a.updateUser(u.Name, func(u *User) {
+		u.TOTPSecret = secret
+		u.TOTPBackupCodes = hashes
+	})
+	a.lock.Lock()
+	delete(a.totpPending, u.Name)
+	a.lock.Unlock()
+	// the other sessions of the user become invalid
+	u.TOTPBackupCodes = hashes
+	a.bindSession(requestSession(r), u)
+	onConfigModified()
+	log.Info("Auth: %s: enabled 2FA", u.Name)
+
+	writeJSON(w, totpBackupCodesJSON{BackupCodes: codes})
+}
+
+func handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	u, ok := totpSessionUser(w, r)
+	if !ok {
+		return
+	}
+	req := totpCodeJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+
+	a := Context.auth
+	name := u.Name
+	if len(req.Name) != 0 && req.Name != u.Name {
+		// admin resets 2FA of the user who has lost access to their authenticator app
+		if u.role() != roleAdmin {
+			httpError(w, http.StatusForbidden, "not allowed")
+			return
+		}
+		name = req.Name
+	} else if ok, _ := a.checkTOTP(u, req.Code); !ok {
+		httpError(w, http.StatusBadRequest, "invalid 2FA code")
+		return
+	}
+
+	if !a.updateUser(name, func(u *User) {
+		u.TOTPSecret = ""
+		u.TOTPBackupCodes = nil
+	}) {
+		httpError(w, http.StatusBadRequest, "user %s not found", name)
+		return
+	}
+	if name == u.Name {
+		a.bindSession(requestSession(r), User{Name: name})
+	}
+	onConfigModified()
+	log.Info("Auth: %s: disabled 2FA of %s", u.Name, name)
+
+	returnOK(w)
+}
+
+// Replace backup codes with the new ones
+func handleTOTPBackupCodes(w http.ResponseWriter, r *http.Request) {
+	u, ok := totpSessionUser(w, r)
+	if !ok {
+		return
+	}
+	req := totpCodeJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+	if len(u.TOTPSecret) == 0 {
+		httpError(w, http.StatusBadRequest, "2FA is disabled")
+		return
+	}
+	if ok, _ := Context.auth.checkTOTP(u, req.Code); !ok {
+		httpError(w, http.StatusBadRequest, "invalid 2FA code")
+		return
+	}
+
+	codes, hashes, err := totpNewBackupCodes()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	Context.auth.updateUser(u.Name, func(u *User) {
+		u.TOTPBackupCodes = hashes
+	})
+	onConfigModified()
+
+	writeJSON(w, totpBackupCodesJSON{BackupCodes: codes})
+}
+
+// RegisterTOTPHandlers - register handlers
+func RegisterTOTPHandlers() {
+	httpRegister(http.MethodGet, "/control/2fa/status", handleTOTPStatus)
+	httpRegister(http.MethodPost, "/control/2fa/enroll", handleTOTPEnroll)
+	httpRegister(http.MethodPost, "/control/2fa/enable", handleTOTPEnable)
+	httpRegister(http.MethodPost, "/control/2fa/disable", handleTOTPDisable)
+	httpRegister(http.MethodPost, "/control/2fa/backup_codes", handleTOTPBackupCodes)
+}
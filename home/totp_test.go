@@ -0,0 +1,109 @@
+package home
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vectors (the last 6 digits)
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	assert.Equal(t, uint64(1), totpCheck(secret, "287082", time.Unix(59, 0)))
+	assert.Equal(t, uint64(37037036), totpCheck(secret, "081804", time.Unix(1111111109, 0)))
+	assert.Equal(t, uint64(41152263), totpCheck(secret, "005924", time.Unix(1234567890, 0)))
+
+	// the previous period is accepted
+	assert.Equal(t, uint64(41152263), totpCheck(secret, "005924", time.Unix(1234567890+totpPeriod, 0)))
+	assert.Equal(t, uint64(0), totpCheck(secret, "005924", time.Unix(1234567890+3*totpPeriod, 0)))
+	assert.Equal(t, uint64(0), totpCheck(secret, "12345", time.Unix(59, 0)))
+
+	uri := totpURI("admin", "ABC")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/AdGuard%20Home:admin?"))
+	assert.True(t, strings.Contains(uri, "secret=ABC"))
+}
+
+func TestTOTPLogin(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	secret, err := totpNewSecret()
+	assert.Nil(t, err)
+	codes, hashes, err := totpNewBackupCodes()
+	assert.Nil(t, err)
+	assert.Equal(t, totpBackupCodes, len(codes))
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	users := []User{
+		User{Name: "name", PasswordHash: string(hash)},
+	}
+	a := InitAuth(filepath.Join(dir, "sessions.db"), users, 60)
+	defer a.Close()
+
+	// 2FA is disabled
+	cookie, _, err := a.httpCookie(loginJSON{Name: "name", Password: "password"})
+	assert.Nil(t, err)
+	assert.True(t, cookie != "")
+	sess := strings.TrimPrefix(strings.Split(cookie, ";")[0], sessionCookieName+"=")
+	assert.Equal(t, 0, a.CheckSession(sess))
+
+	a.updateUser("name", func(u *User) {
+		u.TOTPSecret = secret
+		u.TOTPBackupCodes = hashes
+	})
+
+	// the session is bound to 2FA state
+	assert.Equal(t, -1, a.CheckSession(sess))
+
+	cookie, _, err = a.httpCookie(loginJSON{Name: "name", Password: "password"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", cookie)
+	cookie, _, err = a.httpCookie(loginJSON{Name: "name", Password: "password", TOTP: "000000"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", cookie)
+
+	key, _ := totpEncoding.DecodeString(secret)
+	code := totpCode(key, uint64(time.Now().Unix())/totpPeriod)
+	cookie, backup, err := a.httpCookie(loginJSON{Name: "name", Password: "password", TOTP: code})
+	assert.Nil(t, err)
+	assert.False(t, backup)
+	assert.True(t, cookie != "")
+	sess = strings.TrimPrefix(strings.Split(cookie, ";")[0], sessionCookieName+"=")
+	assert.Equal(t, 0, a.CheckSession(sess))
+
+	// the code can't be used twice
+	cookie, _, _ = a.httpCookie(loginJSON{Name: "name", Password: "password", TOTP: code})
+	assert.Equal(t, "", cookie)
+
+	// backup code can be used once
+	cookie, backup, _ = a.httpCookie(loginJSON{Name: "name", Password: "password", TOTP: strings.ToUpper(codes[3])})
+	assert.True(t, cookie != "")
+	assert.True(t, backup)
+	u, _ := a.userByName("name")
+	assert.Equal(t, totpBackupCodes-1, len(u.TOTPBackupCodes))
+	cookie, _, _ = a.httpCookie(loginJSON{Name: "name", Password: "password", TOTP: codes[3]})
+	assert.Equal(t, "", cookie)
+
+	// Basic authentication isn't allowed
+	assert.Equal(t, "", a.basicAuthUser("name", "password").Name)
+
+	// the session survives 2FA change after it's bound to the new state
+	a.updateUser("name", func(u *User) {
+		u.TOTPSecret = ""
+	})
+	u, _ = a.userByName("name")
+	a.bindSession(sess, u)
+	assert.Equal(t, 0, a.CheckSession(sess))
+
+	// the older session records have no 2FA state
+	s := session{}
+	data := (&session{userName: "name", expire: 123}).serialize()
+	assert.True(t, s.deserialize(data[:len(data)-4]))
+	assert.Equal(t, uint32(0), s.totp)
+	assert.Equal(t, "name", s.userName)
+}
@@ -0,0 +1,467 @@
+// Self-update: update channels, signature verification of the packages,
+// automatic rollback if the new version fails to start
+
+package home
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Update channels
+const (
+	updateChannelRelease = "release"
+	updateChannelBeta    = "beta"
+	updateChannelEdge    = "edge"
+)
+
+// The states of the last update
+const (
+	updateStateFailed     = "failed"      // the update has failed:  the current version is kept
+	updateStatePending    = "pending"     // the new version has been installed and it's checked on the first start
+	updateStateCompleted  = "completed"   // the new version has passed the health checks
+	updateStateRolledBack = "rolled_back" // the previous version has been restored
+)
+
+// The file in data directory with the state of the last update
+const updateStateFileName = "update.json"
+
+// The time within which the new version must pass the health checks
+var updateHealthTimeout = time.Minute
+
+// The built-in public key to verify the packages (base64-encoded ed25519 key)
+// It's set via ldflags: -X github.com/AdguardTeam/AdGuardHome/home.updatePublicKey=...
+var updatePublicKey = ""
+
+// Settings of the self-update
+type updateConfig struct {
+	// The update channel: release, beta or edge.  Empty: the channel of the build
+	Channel string `yaml:"channel"`
+
+	// Base64-encoded ed25519 public keys to verify the packages, in addition to the built-in key
+	// They can be changed in configuration file only.
+	PublicKeys []string `yaml:"public_keys"`
+}
+
+// The state of the last update;  it's kept across restarts
+type updateState struct {
+	State       string    `json:"state"`
+	Version     string    `json:"version"`      // the new version
+	PrevVersion string    `json:"prev_version"` // the version before update
+	Time        time.Time `json:"time"`         // the time of the last state change
+	Error       string    `json:"error,omitempty"`
+	Starts      int       `json:"starts"` // the number of starts of the new version
+}
+
+// Self-update module
+type updateManager struct {
+	lock       sync.Mutex
+	state      updateState
+	inProgress bool // the package is being downloaded and installed
+}
+
+func newUpdateManager() *updateManager {
+	m := &updateManager{}
+	data, err := ioutil.ReadFile(updateStateFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Update: %s", err)
+		}
+		return m
+	}
+	err = json.Unmarshal(data, &m.state)
+	if err != nil {
+		log.Error("Update: %s: %s", updateStateFile(), err)
+	}
+	return m
+}
+
+func updateStateFile() string {
+	return filepath.Join(Context.getDataDir(), updateStateFileName)
+}
+
+// Get the update channel
+func getUpdateChannel() string {
+	config.RLock()
+	ch := config.Update.Channel
+	config.RUnlock()
+	if len(ch) == 0 {
+		return updateChannel
+	}
+	return ch
+}
+
+// Get the URL of version.json for the update channel
+func getVersionCheckURL() string {
+	return "https://static.adguard.com/adguardhome/" + getUpdateChannel() + "/version.json"
+}
+
+func checkUpdateChannel(ch string) error {
+	switch ch {
+	case "", updateChannelRelease, updateChannelBeta, updateChannelEdge:
+		return nil
+	}
+	return fmt.Errorf("invalid update channel: %s", ch)
+}
+
+// Get the public keys to verify the packages
+func getUpdatePublicKeys() ([]ed25519.PublicKey, error) {
+	config.RLock()
+	list := append([]string{}, config.Update.PublicKeys...)
+	config.RUnlock()
+	if len(updatePublicKey) != 0 {
+		list = append(list, updatePublicKey)
+	}
+
+	keys := []ed25519.PublicKey{}
+	for _, s := range list {
+		k, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(k) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key: %s", s)
+		}
+		keys = append(keys, ed25519.PublicKey(k))
+	}
+	return keys, nil
+}
+
+// Check the signature of the package:  it must be signed with one of the keys
+// sig: base64-encoded ed25519 signature
+func verifyPackageSignature(keys []ed25519.PublicKey, data, sig []byte) error {
+	s, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+	if err != nil || len(s) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid signature")
+	}
+	for _, k := range keys {
+		if ed25519.Verify(k, data, s) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the signature doesn't match")
+}
+
+// Download the signature of the package (<package URL>.sig) and verify the package file
+// If there are no public keys, the package isn't verified.
+func verifyPackage(u *updateInfo) error {
+	keys, err := getUpdatePublicKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		log.Info("Update: the public key isn't set:  the package signature isn't verified")
+		return nil
+	}
+
+	resp, err := Context.client.Get(u.pkgURL + ".sig")
+	if err != nil {
+		return fmt.Errorf("HTTP request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("can't get the package signature: %s: %s", u.pkgURL+".sig", resp.Status)
+	}
+	sig, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("ioutil.ReadAll() failed: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(u.pkgName)
+	if err != nil {
+		return err
+	}
+	err = verifyPackageSignature(keys, data, sig)
+	if err != nil {
+		return fmt.Errorf("package %s: %s", u.pkgURL, err)
+	}
+	log.Info("Update: the package signature is valid")
+	return nil
+}
+
+func (m *updateManager) get() updateState {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.state
+}
+
+// Set the state and write it to disk
+// Call with the lock held.
+func (m *updateManager) write() {
+	m.state.Time = time.Now()
+	data, _ := json.Marshal(m.state)
+	err := os.MkdirAll(Context.getDataDir(), 0755)
+	if err == nil {
+		err = file.SafeWrite(updateStateFile(), data)
+	}
+	if err != nil {
+		log.Error("Update: %s", err)
+	}
+}
+
+func (m *updateManager) setState(state, errMsg string) {
+	m.lock.Lock()
+	m.state.State = state
+	m.state.Error = errMsg
+	m.write()
+	m.lock.Unlock()
+}
+
+// The new version has been installed:  it's checked on the first start
+func (m *updateManager) setPending(newVer string) {
+	m.lock.Lock()
+	m.state = updateState{
+		State:       updateStatePending,
+		Version:     newVer,
+		PrevVersion: versionString,
+	}
+	m.write()
+	m.lock.Unlock()
+}
+
+// The update has failed:  the current version is kept
+func (m *updateManager) setFailed(newVer string, err error) {
+	m.lock.Lock()
+	m.state = updateState{
+		State:       updateStateFailed,
+		Version:     newVer,
+		PrevVersion: versionString,
+		Error:       err.Error(),
+	}
+	m.write()
+	m.lock.Unlock()
+}
+
+// Check the state of the last update on start
+// Return TRUE if the new version must be rolled back:  its previous start has failed.
+func (m *updateManager) onStart() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	st := &m.state
+	if st.State != updateStatePending {
+		return false
+	}
+	if st.Version != versionString {
+		st.State = updateStateFailed
+		st.Error = fmt.Sprintf("version %s is running instead of %s", versionString, st.Version)
+		m.write()
+		return false
+	}
+	st.Starts++
+	m.write()
+	return st.Starts > 1
+}
+
+// Wait until the new version passes the health checks
+// If it doesn't pass them in time, the previous version is restored.
+func (m *updateManager) healthCheck() {
+	if m.get().State != updateStatePending {
+		return
+	}
+	log.Info("Update: checking version %s", versionString)
+
+	deadline := time.Now().Add(updateHealthTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		if updateHealthy() {
+			m.setState(updateStateCompleted, "")
+			log.Info("Update: version %s has passed the health checks", versionString)
+			return
+		}
+	}
+	updateRollback("the new version has failed the health checks", true)
+}
+
+// Return TRUE if DNS server is running and the web interface accepts connections
+func updateHealthy() bool {
+	if !Context.firstRun && !isRunning() {
+		return false
+	}
+
+	config.RLock()
+	host := config.BindHost
+	port := config.BindPort
+	config.RUnlock()
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), time.Second)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// Get the paths of the current executable file and its backup copy
+func updateBinPaths() (string, string) {
+	binName := "AdGuardHome"
+	if runtime.GOOS == "windows" {
+		binName = "AdGuardHome.exe"
+	}
+	return filepath.Join(Context.workDir, binName), filepath.Join(Context.workDir, "agh-backup", binName)
+}
+
+// Restore the executable file and the configuration file from the backup directory
+func updateRestore() error {
+	curBinName, bkpBinName := updateBinPaths()
+	if !util.FileExists(bkpBinName) {
+		return fmt.Errorf("the backup copy %s doesn't exist", bkpBinName)
+	}
+
+	bkpConfigName := filepath.Join(filepath.Dir(bkpBinName), "AdGuardHome.yaml")
+	if util.FileExists(bkpConfigName) {
+		err := copyFile(bkpConfigName, config.getConfigFilename())
+		if err != nil {
+			return fmt.Errorf("copyFile() failed: %s", err)
+		}
+	}
+
+	if runtime.GOOS == "windows" {
+		// the running executable file can be renamed, but not overwritten
+		failedName := curBinName + ".failed"
+		_ = os.Remove(failedName)
+		err := os.Rename(curBinName, failedName)
+		if err != nil {
+			return err
+		}
+		return copyFile(bkpBinName, curBinName)
+	}
+	return os.Rename(bkpBinName, curBinName)
+}
+
+// Restore the previous version and restart
+// running: the servers are running and must be stopped before restart
+func updateRollback(reason string, running bool) {
+	st := Context.updater.get()
+	log.Error("Update: %s: restoring version %s", reason, st.PrevVersion)
+	err := updateRestore()
+	if err != nil {
+		log.Error("Update: can't restore the previous version: %s", err)
+		Context.updater.setState(updateStateFailed, fmt.Sprintf("%s; can't restore the previous version: %s", reason, err))
+		return
+	}
+	Context.updater.setState(updateStateRolledBack, reason)
+
+	if running {
+		Context.controlLock.Lock()
+		log.Info("Stopping all tasks")
+		cleanup()
+		stopHTTPServer()
+		cleanupAlways()
+	}
+	curBinName, _ := updateBinPaths()
+	restartProcess(curBinName)
+}
+
+type updateStatusJSON struct {
+	Channel        string    `json:"channel"`
+	CurrentVersion string    `json:"current_version"`
+	InProgress     bool      `json:"in_progress"`
+	VerifySignature bool     `json:"verify_signature"` // the packages are verified
+	CanRollback    bool      `json:"can_rollback"`     // the backup copy of the previous version exists
+	State          string    `json:"state"`
+	Version        string    `json:"version"`
+	PrevVersion    string    `json:"prev_version"`
+	Time           time.Time `json:"time"`
+	Error          string    `json:"error"`
+}
+
+func handleUpdateStatus(w http.ResponseWriter, r *http.Request) {
+	m := Context.updater
+	m.lock.Lock()
+	st := m.state
+	inProgress := m.inProgress
+	m.lock.Unlock()
+
+	keys, _ := getUpdatePublicKeys()
+	_, bkpBinName := updateBinPaths()
+	resp := updateStatusJSON{
+		Channel:        getUpdateChannel(),
+		CurrentVersion: versionString,
+		InProgress:     inProgress,
+		VerifySignature: len(keys) != 0,
+		CanRollback:    util.FileExists(bkpBinName),
+		State:          st.State,
+		Version:        st.Version,
+		PrevVersion:    st.PrevVersion,
+		Time:           st.Time,
+		Error:          st.Error,
+	}
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+type updateConfigJSON struct {
+	Channel string `json:"channel"`
+}
+
+func handleUpdateConfig(w http.ResponseWriter, r *http.Request) {
+	req := updateConfigJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+	err = checkUpdateChannel(req.Channel)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	config.Update.Channel = req.Channel
+	// version.json of the previous channel must not be used
+	config.versionCheckJSON = nil
+	config.versionCheckLastTime = time.Time{}
+	config.Unlock()
+	log.Info("Update: channel: %s", getUpdateChannel())
+	onConfigModified()
+	returnOK(w)
+}
+
+// Restore the version which was running before the last update
+func handleUpdateRollback(w http.ResponseWriter, r *http.Request) {
+	_, bkpBinName := updateBinPaths()
+	if !util.FileExists(bkpBinName) {
+		httpError(w, http.StatusBadRequest, "there's no previous version to restore")
+		return
+	}
+
+	returnOK(w)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	go updateRollback("requested by user", true)
+}
+
+// RegisterUpdateHandlers - register HTTP handlers
+func RegisterUpdateHandlers() {
+	httpRegister(http.MethodGet, "/control/update/status", handleUpdateStatus)
+	httpRegister(http.MethodPost, "/control/update/config", handleUpdateConfig)
+	httpRegister(http.MethodPost, "/control/update/rollback", handleUpdateRollback)
+}
@@ -0,0 +1,104 @@
+package home
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyPackageSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	pub2, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	prevKeys := config.Update.PublicKeys
+	defer func() { config.Update.PublicKeys = prevKeys }()
+	config.Update.PublicKeys = []string{base64.StdEncoding.EncodeToString(pub2), base64.StdEncoding.EncodeToString(pub)}
+	keys, err := getUpdatePublicKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(keys))
+
+	data := []byte("package data")
+	sig := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)) + "\n")
+	assert.Nil(t, verifyPackageSignature(keys, data, sig))
+	assert.NotNil(t, verifyPackageSignature(keys, []byte("package data!"), sig))
+	assert.NotNil(t, verifyPackageSignature(keys[:1], data, sig))
+	assert.NotNil(t, verifyPackageSignature(keys, data, []byte("invalid")))
+
+	config.Update.PublicKeys = []string{"AAAA"}
+	_, err = getUpdatePublicKeys()
+	assert.NotNil(t, err)
+}
+
+func TestCheckUpdateChannel(t *testing.T) {
+	assert.Nil(t, checkUpdateChannel(""))
+	assert.Nil(t, checkUpdateChannel(updateChannelBeta))
+	assert.Nil(t, checkUpdateChannel(updateChannelEdge))
+	assert.NotNil(t, checkUpdateChannel("nightly"))
+}
+
+func TestUpdateOnStart(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	prevWorkDir, prevVersion := Context.workDir, versionString
+	Context.workDir = dir
+	versionString = "v0.102"
+	defer func() { Context.workDir, versionString = prevWorkDir, prevVersion }()
+
+	m := newUpdateManager()
+	assert.False(t, m.onStart())
+	m.setPending("v0.103")
+
+	// the previous version is running
+	m = newUpdateManager()
+	assert.False(t, m.onStart())
+	assert.Equal(t, updateStateFailed, m.get().State)
+
+	// the new version is checked on the first start and rolled back on the second one
+	m.setPending("v0.103")
+	versionString = "v0.103"
+	m = newUpdateManager()
+	assert.False(t, m.onStart())
+	m = newUpdateManager()
+	assert.True(t, m.onStart())
+	assert.Equal(t, "v0.102", m.get().PrevVersion)
+	assert.Equal(t, 2, m.get().Starts)
+
+	m.setState(updateStateCompleted, "")
+	m = newUpdateManager()
+	assert.False(t, m.onStart())
+	assert.Equal(t, updateStateCompleted, m.get().State)
+}
+
+func TestUpdateRestore(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	prevWorkDir, prevConfigFilename := Context.workDir, Context.configFilename
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	defer func() {
+		Context.workDir, Context.configFilename = prevWorkDir, prevConfigFilename
+	}()
+
+	assert.NotNil(t, updateRestore())
+
+	curBinName, bkpBinName := updateBinPaths()
+	_ = os.MkdirAll(filepath.Dir(bkpBinName), 0755)
+	_ = ioutil.WriteFile(curBinName, []byte("new"), 0755)
+	_ = ioutil.WriteFile(bkpBinName, []byte("old"), 0755)
+	_ = ioutil.WriteFile(filepath.Join(dir, "AdGuardHome.yaml"), []byte("schema_version: 100"), 0644)
+	_ = ioutil.WriteFile(filepath.Join(filepath.Dir(bkpBinName), "AdGuardHome.yaml"), []byte("schema_version: 6"), 0644)
+
+	assert.Nil(t, updateRestore())
+	data, _ := ioutil.ReadFile(curBinName)
+	assert.Equal(t, "old", string(data))
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "AdGuardHome.yaml"))
+	assert.Equal(t, "schema_version: 6", string(data))
+}
@@ -0,0 +1,373 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// A user rule with its properties
+// In configuration file a rule without properties is stored as a string, as in the previous versions.
+type userRule struct {
+	Text    string    `yaml:"text" json:"text"`
+	Enabled bool      `yaml:"enabled" json:"enabled"`
+	Comment string    `yaml:"comment,omitempty" json:"comment"`
+	Group   string    `yaml:"group,omitempty" json:"group"` // the name of the group the rule belongs to.  Empty: no group
+	Created time.Time `yaml:"created,omitempty" json:"created"`
+	Expires time.Time `yaml:"expires,omitempty" json:"expires"` // a temporary rule is removed after this time.  Zero: permanent
+
+	// Unique ID of the rule.  It's assigned on application startup or when the rule is added, and it isn't stored.
+	ID int64 `yaml:"-" json:"id"`
+}
+
+// The ID for the next user rule
+var nextUserRuleID int64 = 1
+
+// The interval between the checks of temporary rules
+const userRulesExpireInterval = 1 * time.Minute
+
+// Used to read a rule with properties from configuration file
+type userRuleYAML userRule
+
+// UnmarshalYAML - read a rule: either a string or an object with properties
+func (r *userRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	err := unmarshal(&s)
+	if err == nil {
+		*r = userRule{Text: s, Enabled: true}
+		return nil
+	}
+
+	ry := userRuleYAML{Enabled: true}
+	err = unmarshal(&ry)
+	if err != nil {
+		return err
+	}
+	*r = userRule(ry)
+	return nil
+}
+
+// MarshalYAML - write a rule without properties as a string
+func (r userRule) MarshalYAML() (interface{}, error) {
+	if r.Enabled && len(r.Comment) == 0 && len(r.Group) == 0 && r.Created.IsZero() && r.Expires.IsZero() {
+		return r.Text, nil
+	}
+	return userRuleYAML(r), nil
+}
+
+// Assign unique IDs to the rules
+func assignUserRuleIDs(rules []userRule) {
+	for i := range rules {
+		rules[i].ID = nextUserRuleID
+		nextUserRuleID++
+	}
+}
+
+// Get the text of all user rules (including the disabled ones)
+func userRulesTexts(rules []userRule) []string {
+	texts := []string{}
+	for _, r := range rules {
+		texts = append(texts, r.Text)
+	}
+	return texts
+}
+
+// Return TRUE if the temporary rule has expired
+func (r *userRule) expired(now time.Time) bool {
+	return !r.Expires.IsZero() && !now.Before(r.Expires)
+}
+
+// Get the text of enabled user rules (the expired rules are skipped)
+func userRulesData(rules []userRule) string {
+	now := time.Now()
+	texts := []string{}
+	for _, r := range rules {
+		if r.Enabled && !r.expired(now) {
+			texts = append(texts, ruleToPunycode(r.Text))
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// Create the list of user rules from the lines of text
+// The properties of the existing rules with the same text are preserved.
+func userRulesFromTexts(existing []userRule, texts []string) []userRule {
+	props := map[string]userRule{}
+	for _, r := range existing {
+		if _, ok := props[r.Text]; !ok {
+			props[r.Text] = r
+		}
+	}
+
+	now := time.Now()
+	rules := []userRule{}
+	for _, t := range texts {
+		r, ok := props[t]
+		if ok {
+			delete(props, t) // a duplicate line becomes a new rule
+		} else {
+			r = userRule{Text: t, Enabled: true}
+			if len(strings.TrimSpace(t)) != 0 {
+				r.Created = now
+			}
+			r.ID = nextUserRuleID
+			nextUserRuleID++
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// Check the rule received from UI
+func (r *userRule) check() error {
+	r.Text = strings.TrimSpace(r.Text)
+	if len(r.Text) == 0 {
+		return fmt.Errorf("rule text is empty")
+	}
+	if strings.IndexByte(r.Text, '\n') != -1 || strings.IndexByte(r.Text, '\r') != -1 {
+		return fmt.Errorf("rule text must be a single line")
+	}
+	r.Group = strings.TrimSpace(r.Group)
+	return nil
+}
+
+// Remove the expired temporary rules
+// Return the number of the removed rules.
+func removeExpiredUserRules(now time.Time) int {
+	config.Lock()
+	defer config.Unlock()
+	rules := []userRule{}
+	for _, ur := range config.UserRules {
+		if ur.expired(now) {
+			log.Info("Temporary user rule %d has expired: %s", ur.ID, ur.Text)
+			continue
+		}
+		rules = append(rules, ur)
+	}
+	n := len(config.UserRules) - len(rules)
+	config.UserRules = rules
+	return n
+}
+
+// Periodically remove the expired temporary rules
+func userRulesExpireLoop() {
+	for range time.Tick(userRulesExpireInterval) {
+		if removeExpiredUserRules(time.Now()) != 0 {
+			applyUserRules()
+		}
+	}
+}
+
+// Apply the changes of user rules: save the configuration and restart the filtering engine
+func applyUserRules() {
+	onConfigModified()
+	userFilter := userFilter()
+	err := userFilter.save()
+	if err != nil {
+		log.Error("Couldn't save the user filter: %s", err)
+	}
+	enableFilters(true)
+}
+
+type userRulesListJSON struct {
+	Rules  []userRule `json:"rules"`
+	Groups []string   `json:"groups"` // names of all groups
+}
+
+// Get the list of user rules
+// "group" parameter (optional) selects the rules of a single group
+func handleUserRulesList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	_, byGroup := q["group"]
+	group := q.Get("group")
+
+	resp := userRulesListJSON{
+		Rules:  []userRule{},
+		Groups: []string{},
+	}
+	config.RLock()
+	for _, ur := range config.UserRules {
+		if len(ur.Group) != 0 && !hasString(resp.Groups, ur.Group) {
+			resp.Groups = append(resp.Groups, ur.Group)
+		}
+		if byGroup && ur.Group != group {
+			continue
+		}
+		if len(strings.TrimSpace(ur.Text)) == 0 {
+			continue
+		}
+		resp.Rules = append(resp.Rules, ur)
+	}
+	config.RUnlock()
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// Add a user rule
+// Response: the added rule
+func handleUserRulesAdd(w http.ResponseWriter, r *http.Request) {
+	ur := userRule{Enabled: true}
+	err := json.NewDecoder(r.Body).Decode(&ur)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+	err = ur.check()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if ur.expired(time.Now()) {
+		httpError(w, http.StatusBadRequest, "expiration time must be in the future")
+		return
+	}
+
+	config.Lock()
+	ur.Created = time.Now()
+	ur.ID = nextUserRuleID
+	nextUserRuleID++
+	config.UserRules = append(config.UserRules, ur)
+	config.Unlock()
+
+	log.Debug("Added user rule %d: %s", ur.ID, ur.Text)
+	applyUserRules()
+
+	js, err := json.Marshal(ur)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+type userRuleUpdateJSON struct {
+	ID   int64    `json:"id"`
+	Data userRule `json:"data"`
+}
+
+// Update the properties of a user rule
+// The creation and expiration time of the rule can't be changed.
+func handleUserRulesUpdate(w http.ResponseWriter, r *http.Request) {
+	req := userRuleUpdateJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+	err = req.Data.check()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	found := false
+	config.Lock()
+	for i := range config.UserRules {
+		ur := &config.UserRules[i]
+		if ur.ID != req.ID {
+			continue
+		}
+		ur.Text = req.Data.Text
+		ur.Enabled = req.Data.Enabled
+		ur.Comment = req.Data.Comment
+		ur.Group = req.Data.Group
+		found = true
+		break
+	}
+	config.Unlock()
+
+	if !found {
+		httpError(w, http.StatusBadRequest, "rule not found")
+		return
+	}
+
+	log.Debug("Updated user rule %d", req.ID)
+	applyUserRules()
+}
+
+// Remove a user rule
+func handleUserRulesDelete(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		ID int64 `json:"id"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+
+	found := false
+	config.Lock()
+	for i, ur := range config.UserRules {
+		if ur.ID == req.ID {
+			config.UserRules = append(config.UserRules[:i], config.UserRules[i+1:]...)
+			found = true
+			break
+		}
+	}
+	config.Unlock()
+
+	if !found {
+		httpError(w, http.StatusBadRequest, "rule not found")
+		return
+	}
+
+	log.Debug("Removed user rule %d", req.ID)
+	applyUserRules()
+}
+
+// Enable or disable all rules of a group
+func handleUserRulesGroup(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name    string `json:"name"`
+		Enabled bool   `json:"enabled"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+	if len(req.Name) == 0 {
+		httpError(w, http.StatusBadRequest, "group name is empty")
+		return
+	}
+
+	n := 0
+	config.Lock()
+	for i := range config.UserRules {
+		ur := &config.UserRules[i]
+		if ur.Group == req.Name {
+			ur.Enabled = req.Enabled
+			n++
+		}
+	}
+	config.Unlock()
+
+	if n == 0 {
+		httpError(w, http.StatusBadRequest, "group not found")
+		return
+	}
+
+	log.Debug("Group %s: %d user rules are enabled:%t", req.Name, n, req.Enabled)
+	applyUserRules()
+}
+
+// RegisterUserRulesHandlers - register HTTP handlers
+func RegisterUserRulesHandlers() {
+	httpRegister(http.MethodGet, "/control/filtering/user_rules", handleUserRulesList)
+	httpRegister(http.MethodPost, "/control/filtering/user_rules/add", handleUserRulesAdd)
+	httpRegister(http.MethodPost, "/control/filtering/user_rules/update", handleUserRulesUpdate)
+	httpRegister(http.MethodPost, "/control/filtering/user_rules/delete", handleUserRulesDelete)
+	httpRegister(http.MethodPost, "/control/filtering/user_rules/group", handleUserRulesGroup)
+}
@@ -0,0 +1,181 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestUserRulesYAML(t *testing.T) {
+	// the previous format: a list of strings
+	conf := struct {
+		UserRules []userRule `yaml:"user_rules"`
+	}{}
+	data := `user_rules:
+- '||example.org^'
+- text: '||example.com^'
+  enabled: false
+  comment: test
+  group: ads
+  created: 2020-01-02T03:04:05Z
+- text: '||example.net^'
+`
+	assert.Nil(t, yaml.Unmarshal([]byte(data), &conf))
+	assert.Equal(t, 3, len(conf.UserRules))
+	assert.Equal(t, userRule{Text: "||example.org^", Enabled: true}, conf.UserRules[0])
+	r := conf.UserRules[1]
+	assert.Equal(t, "||example.com^", r.Text)
+	assert.False(t, r.Enabled)
+	assert.Equal(t, "test", r.Comment)
+	assert.Equal(t, "ads", r.Group)
+	assert.Equal(t, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), r.Created.UTC())
+	assert.True(t, conf.UserRules[2].Enabled)
+
+	// rules without properties are written as strings
+	out, err := yaml.Marshal(conf)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "user_rules:\n- '||example.org^'\n- text: '||example.com^'\n"))
+	assert.True(t, strings.Contains(string(out), "- '||example.net^'\n"))
+
+	assert.Equal(t, "||example.org^\n||example.net^", userRulesData(conf.UserRules))
+	assert.Equal(t, []string{"||example.org^", "||example.com^", "||example.net^"}, userRulesTexts(conf.UserRules))
+}
+
+func TestUserRulesFromTexts(t *testing.T) {
+	existing := []userRule{
+		{Text: "||example.org^", Enabled: true, Comment: "1"},
+		{Text: "||example.com^", Enabled: false, Comment: "2"},
+	}
+	assignUserRuleIDs(existing)
+	rules := userRulesFromTexts(existing, []string{"||example.com^", "", "||example.net^", "||example.com^"})
+	assert.Equal(t, 4, len(rules))
+	assert.Equal(t, existing[1], rules[0])
+	assert.True(t, rules[1].Created.IsZero())
+	assert.Equal(t, "||example.net^", rules[2].Text)
+	assert.True(t, rules[2].Enabled)
+	assert.False(t, rules[2].Created.IsZero())
+	assert.True(t, rules[2].ID != existing[0].ID && rules[2].ID != existing[1].ID)
+	// a duplicate line is a new rule
+	assert.True(t, rules[3].Enabled)
+	assert.True(t, rules[3].ID != existing[1].ID && rules[3].ID != rules[2].ID)
+}
+
+func TestUserRulesHandlers(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	Context.configFilename = "AdGuardHome.yaml"
+	Context.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	Context.dnsFilter.Start()
+	defer func() {
+		Context.dnsFilter.Close()
+		Context.dnsFilter = nil
+	}()
+	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0755)
+	config.DNS.FilteringEnabled = true
+	config.UserRules = nil
+	defer func() { config.UserRules = nil }()
+
+	add := func(body string) (int, userRule) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/control/filtering/user_rules/add", strings.NewReader(body))
+		handleUserRulesAdd(w, r)
+		ur := userRule{}
+		_ = json.Unmarshal(w.Body.Bytes(), &ur)
+		return w.Code, ur
+	}
+	code, r1 := add(`{"text":" ||example.org^ ","comment":"blocked","group":"ads"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "||example.org^", r1.Text)
+	assert.True(t, r1.Enabled)
+	assert.False(t, r1.Created.IsZero())
+	code, r2 := add(`{"text":"||example.com^","enabled":false}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, r2.Enabled)
+	code, _ = add(`{"text":""}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = add(`{"text":"1\n2"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = add(`{"text":"||example.net^","expires":"2000-01-01T00:00:00Z"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// only enabled rules are passed to the filtering engine
+	assert.Equal(t, "||example.org^", string(userFilter().Data))
+
+	list := func(query string) userRulesListJSON {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/control/filtering/user_rules"+query, nil)
+		handleUserRulesList(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		resp := userRulesListJSON{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+	resp := list("")
+	assert.Equal(t, 2, len(resp.Rules))
+	assert.Equal(t, []string{"ads"}, resp.Groups)
+	resp = list("?group=ads")
+	assert.Equal(t, 1, len(resp.Rules))
+	assert.Equal(t, r1.ID, resp.Rules[0].ID)
+	resp = list("?group=")
+	assert.Equal(t, 1, len(resp.Rules))
+	assert.Equal(t, r2.ID, resp.Rules[0].ID)
+
+	// update
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/control/filtering/user_rules/update",
+		strings.NewReader(`{"id":`+strconv.FormatInt(r2.ID, 10)+`,"data":{"text":"||example.com^","enabled":true,"group":"ads"}}`))
+	handleUserRulesUpdate(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, config.UserRules[1].Enabled)
+	assert.True(t, r2.Created.Equal(config.UserRules[1].Created))
+	assert.Equal(t, "||example.org^\n||example.com^", string(userFilter().Data))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/control/filtering/user_rules/update", strings.NewReader(`{"id":-1,"data":{"text":"1"}}`))
+	handleUserRulesUpdate(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// disable the group
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/control/filtering/user_rules/group", strings.NewReader(`{"name":"ads","enabled":false}`))
+	handleUserRulesGroup(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, config.UserRules[0].Enabled)
+	assert.False(t, config.UserRules[1].Enabled)
+	assert.Equal(t, "", string(userFilter().Data))
+
+	// delete
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/control/filtering/user_rules/delete", strings.NewReader(`{"id":`+strconv.FormatInt(r1.ID, 10)+`}`))
+	handleUserRulesDelete(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, len(config.UserRules))
+	assert.Equal(t, r2.ID, config.UserRules[0].ID)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/control/filtering/user_rules/delete", strings.NewReader(`{"id":`+strconv.FormatInt(r1.ID, 10)+`}`))
+	handleUserRulesDelete(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// the properties are kept when the rules are set as text
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/control/filtering/set_rules", strings.NewReader("||example.com^\n||example.net^"))
+	handleFilteringSetRules(w, r)
+	assert.Equal(t, 2, len(config.UserRules))
+	assert.Equal(t, r2.ID, config.UserRules[0].ID)
+	assert.False(t, config.UserRules[0].Enabled)
+	assert.Equal(t, "ads", config.UserRules[0].Group)
+	assert.True(t, config.UserRules[1].Enabled)
+}
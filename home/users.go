@@ -0,0 +1,533 @@
+// Users management: roles, permissions, sessions and audit trail of configuration changes
+
+package home
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User roles
+const (
+	roleAdmin    = "admin"     // full access
+	roleOperator = "operator"  // can't change the server settings and users
+	roleReadOnly = "read-only" // can't change anything
+)
+
+// The minimum role for the HTTP API requests, by the path registered with httpRegister()
+// The paths that aren't listed here are allowed to admins only.
+var routeRoles = map[string]string{
+	"/control/status":                       roleReadOnly,
+	"/control/i18n/current_language":        roleReadOnly,
+	"/control/profile":                      roleReadOnly,
+	"/control/interfaces":                   roleReadOnly,
+	"/control/logout":                       roleReadOnly,
+	"/control/2fa/status":                   roleReadOnly,
+	"/control/filtering/status":             roleReadOnly,
+	"/control/filtering/catalog":            roleReadOnly,
+	"/control/filtering/stats":              roleReadOnly,
+	"/control/filtering/changes":            roleReadOnly,
+	"/control/filtering/export":             roleReadOnly,
+	"/control/filtering/check_host":         roleReadOnly,
+	"/control/filtering/check_host_verbose": roleReadOnly,
+	"/control/filtering/profile":            roleReadOnly,
+	"/control/filtering/update_schedule":    roleReadOnly,
+	"/control/filtering/pauses":             roleReadOnly,
+	"/control/filtering/user_rules":         roleReadOnly,
+	"/control/blocked_services/list":        roleReadOnly,
+	"/control/blocked_services/services":    roleReadOnly,
+	"/control/blocked_services/custom":      roleReadOnly,
+	"/control/expression_rules/list":        roleReadOnly,
+	"/control/safebrowsing/status":          roleReadOnly,
+	"/control/parental/status":              roleReadOnly,
+	"/control/safesearch/status":            roleReadOnly,
+	"/control/rewrite/list":                 roleReadOnly,
+	"/control/clients":                      roleReadOnly,
+	"/control/clients/find":                 roleReadOnly,
+	"/control/schedule":                     roleReadOnly,
+	"/control/stats":                        roleReadOnly,
+	"/control/stats_info":                   roleReadOnly,
+	"/control/stats/client/":                roleReadOnly,
+	"/control/stats/trends":                 roleReadOnly,
+	"/control/querylog":                     roleReadOnly,
+	"/control/querylog_info":                roleReadOnly,
+	"/control/querylog/suggestions":         roleReadOnly,
+	"/control/dns_info":                     roleReadOnly,
+	"/control/access/list":                  roleReadOnly,
+	"/control/zones":                        roleReadOnly,
+	"/control/cache_info":                   roleReadOnly,
+	"/control/trace/config":                 roleReadOnly,
+	"/control/trace/list":                   roleReadOnly,
+	"/control/dhcp/status":                  roleReadOnly,
+	"/control/dhcp/interfaces":              roleReadOnly,
+	"/control/log/levels":                   roleReadOnly,
+	"/control/addresses":                    roleReadOnly,
+	"/control/hooks/status":                 roleReadOnly,
+	"/control/ha/status":                    roleReadOnly,
+	"/control/sync/status":                  roleReadOnly,
+	"/control/update/status":                roleReadOnly,
+
+	// The handlers check that the user changes their own data only
+	"/control/users/sessions/revoke": roleReadOnly,
+	"/control/2fa/enroll":            roleReadOnly,
+	"/control/2fa/enable":            roleReadOnly,
+	"/control/2fa/disable":           roleReadOnly,
+	"/control/2fa/backup_codes":      roleReadOnly,
+
+	"/control/i18n/change_language":          roleOperator,
+	"/control/filtering/config":              roleOperator,
+	"/control/filtering/add_url":             roleOperator,
+	"/control/filtering/remove_url":          roleOperator,
+	"/control/filtering/set_url":             roleOperator,
+	"/control/filtering/refresh":             roleOperator,
+	"/control/filtering/refresh_one":         roleOperator,
+	"/control/filtering/set_rules":           roleOperator,
+	"/control/filtering/import":              roleOperator,
+	"/control/filtering/benchmark":           roleOperator,
+	"/control/filtering/update_schedule/set": roleOperator,
+	"/control/filtering/pause":               roleOperator,
+	"/control/filtering/resume":              roleOperator,
+	"/control/filtering/user_rules/add":      roleOperator,
+	"/control/filtering/user_rules/update":   roleOperator,
+	"/control/filtering/user_rules/delete":   roleOperator,
+	"/control/filtering/user_rules/group":    roleOperator,
+	"/control/blocked_services/set":          roleOperator,
+	"/control/blocked_services/custom/set":   roleOperator,
+	"/control/expression_rules/set":          roleOperator,
+	"/control/expression_rules/check":        roleOperator,
+	"/control/safebrowsing/enable":           roleOperator,
+	"/control/safebrowsing/disable":          roleOperator,
+	"/control/parental/enable":               roleOperator,
+	"/control/parental/disable":              roleOperator,
+	"/control/safesearch/enable":             roleOperator,
+	"/control/safesearch/disable":            roleOperator,
+	"/control/rewrite/add":                   roleOperator,
+	"/control/rewrite/delete":                roleOperator,
+	"/control/clients/add":                   roleOperator,
+	"/control/clients/delete":                roleOperator,
+	"/control/clients/update":                roleOperator,
+	"/control/schedule/set":                  roleOperator,
+	"/control/stats_reset":                   roleOperator,
+	"/control/stats_config":                  roleOperator,
+	"/control/querylog_clear":                roleOperator,
+	"/control/querylog/export":               roleOperator,
+	"/control/test_upstream_dns":             roleOperator,
+	"/control/cache_flush":                   roleOperator,
+	"/control/trace/clear":                   roleOperator,
+	"/control/tls/status":                    roleOperator, // private keys are sent to admins only
+}
+
+// Get the minimum role for the requests with this path
+func routeRole(path string) string {
+	role, ok := routeRoles[path]
+	if !ok {
+		return roleAdmin
+	}
+	return role
+}
+
+const (
+	auditFile       = "audit.json" // in the data directory
+	auditMaxEntries = 1000         // the number of entries kept in memory
+)
+
+func isValidRole(role string) bool {
+	return role == "" || role == roleAdmin || role == roleOperator || role == roleReadOnly
+}
+
+// Get the role of the user
+func (u *User) role() string {
+	if len(u.Role) == 0 {
+		return roleAdmin
+	}
+	return u.Role
+}
+
+// Get the description of the user's access level for the messages
+func (u *User) access() string {
+	if len(u.tokenScope) != 0 {
+		return "token scope " + u.tokenScope
+	}
+	return u.role()
+}
+
+// Return TRUE if the user is allowed to make the request
+// role: the minimum role for the request path
+func (u *User) allowed(r *http.Request, role string) bool {
+	if len(u.tokenScope) != 0 {
+		return tokenAllowed(u.tokenScope, r, role)
+	}
+	switch u.role() {
+	case roleAdmin:
+		return true
+	case roleOperator:
+		return role != roleAdmin
+	}
+	return role == roleReadOnly
+}
+
+// Get the user who makes the request
+// Return false if the request is made without authentication (i.e. authentication isn't required).
+func currentUser(r *http.Request) (User, bool) {
+	if Context.auth == nil || !Context.auth.AuthRequired() {
+		return User{}, false
+	}
+	u := Context.auth.GetCurrentUser(r)
+	return u, len(u.Name) != 0
+}
+
+// Return TRUE if the request is made by admin or without authentication
+func isAdminRequest(r *http.Request) bool {
+	u, ok := currentUser(r)
+	return !ok || u.role() == roleAdmin
+}
+
+// An entry of audit trail
+type auditEntry struct {
+	Time   string `json:"time"` // RFC3339
+	User   string `json:"user"`
+	IP     string `json:"ip"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"` // HTTP status code of the response
+}
+
+// Audit trail: the requests that change the configuration
+// The entries are appended to the file and the last entries are kept in memory.
+type auditLog struct {
+	lock     sync.Mutex
+	filename string
+	entries  []auditEntry
+}
+
+// Call the function for each line of the file
+func readLines(filename string, f func(line []byte)) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	sc := bufio.NewScanner(file)
+	for sc.Scan() {
+		f(sc.Bytes())
+	}
+}
+
+// Append JSON object to the file
+func appendJSONLine(filename string, v interface{}) error {
+	data, _ := json.Marshal(v)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	_ = f.Close()
+	return err
+}
+
+func newAuditLog(filename string) *auditLog {
+	l := &auditLog{filename: filename}
+	readLines(filename, func(line []byte) {
+		e := auditEntry{}
+		if json.Unmarshal(line, &e) != nil {
+			return
+		}
+		l.entries = append(l.entries, e)
+		if len(l.entries) > auditMaxEntries {
+			l.entries = l.entries[1:]
+		}
+	})
+	return l
+}
+
+func (l *auditLog) add(e auditEntry) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = append(l.entries, e)
+	if len(l.entries) > auditMaxEntries {
+		l.entries = l.entries[1:]
+	}
+
+	err := appendJSONLine(l.filename, e)
+	if err != nil {
+		log.Error("Audit: %s", err)
+	}
+}
+
+// Get the entries, the newest first
+func (l *auditLog) get() []auditEntry {
+	list := []auditEntry{}
+	if l == nil {
+		return list
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		list = append(list, l.entries[i])
+	}
+	return list
+}
+
+// Remember the status code of the response
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Check the permissions of the user and record the request in audit trail
+// role: the minimum role for the request path
+func auditHandler(role string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := currentUser(r)
+		if !ok {
+			handler(w, r)
+			return
+		}
+		if r.Method == http.MethodGet {
+			if u.allowed(r, role) {
+				handler(w, r)
+			} else {
+				httpError(w, http.StatusForbidden, "not allowed")
+			}
+			return
+		}
+
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		if u.allowed(r, role) {
+			handler(sw, r)
+		} else {
+			log.Info("Auth: %s: %s %s: not allowed for %s", u.Name, r.Method, r.URL.Path, u.access())
+			httpError(sw, http.StatusForbidden, "not allowed for %s", u.access())
+		}
+
+		Context.audit.add(auditEntry{
+			Time:   time.Now().Format(time.RFC3339),
+			User:   u.Name,
+			IP:     requestIP(r),
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Status: sw.status,
+		})
+	}
+}
+
+type userJSON struct {
+	Name     string `json:"name"`
+	Password string `json:"password,omitempty"` // for add and update requests only
+	Role     string `json:"role"`
+}
+
+// RegisterUsersHandlers - register handlers
+func RegisterUsersHandlers() {
+	httpRegister(http.MethodGet, "/control/users/list", handleUsersList)
+	httpRegister(http.MethodPost, "/control/users/add", handleUsersAdd)
+	httpRegister(http.MethodPost, "/control/users/update", handleUsersUpdate)
+	httpRegister(http.MethodPost, "/control/users/delete", handleUsersDelete)
+	httpRegister(http.MethodGet, "/control/users/sessions", handleUsersSessions)
+	httpRegister(http.MethodPost, "/control/users/sessions/revoke", handleUsersSessionsRevoke)
+	httpRegister(http.MethodGet, "/control/users/audit", handleUsersAudit)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+func handleUsersList(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		httpError(w, http.StatusForbidden, "not allowed")
+		return
+	}
+	list := []userJSON{}
+	for _, u := range Context.auth.GetUsers() {
+		list = append(list, userJSON{Name: u.Name, Role: u.role()})
+	}
+	writeJSON(w, list)
+}
+
+// Check that there's at least one admin
+func checkUsers(users []User) error {
+	for _, u := range users {
+		if u.role() == roleAdmin {
+			return nil
+		}
+	}
+	return fmt.Errorf("at least one admin is required")
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) == 0 {
+		return "", fmt.Errorf("password is empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Decode the request and apply the change to a copy of the list of users
+func changeUsers(r *http.Request, change func(users []User, req userJSON) ([]User, error)) error {
+	req := userJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return fmt.Errorf("json decode: %s", err)
+	}
+	if !isValidRole(req.Role) {
+		return fmt.Errorf("invalid role: %s", req.Role)
+	}
+	if req.Role == roleAdmin {
+		req.Role = ""
+	}
+
+	users := append([]User{}, Context.auth.GetUsers()...)
+	users, err = change(users, req)
+	if err != nil {
+		return err
+	}
+	err = checkUsers(users)
+	if err != nil {
+		return err
+	}
+	Context.auth.setUsers(users)
+	onConfigModified()
+	return nil
+}
+
+func handleUsersAdd(w http.ResponseWriter, r *http.Request) {
+	err := changeUsers(r, func(users []User, req userJSON) ([]User, error) {
+		if len(req.Name) == 0 {
+			return nil, fmt.Errorf("name is empty")
+		}
+		if _, ok := Context.auth.userByName(req.Name); ok {
+			return nil, fmt.Errorf("user %s already exists", req.Name)
+		}
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			return nil, err
+		}
+		return append(users, User{Name: req.Name, PasswordHash: hash, Role: req.Role}), nil
+	})
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	returnOK(w)
+}
+
+func handleUsersUpdate(w http.ResponseWriter, r *http.Request) {
+	err := changeUsers(r, func(users []User, req userJSON) ([]User, error) {
+		for i := range users {
+			if users[i].Name != req.Name {
+				continue
+			}
+			users[i].Role = req.Role
+			if len(req.Password) != 0 {
+				hash, err := hashPassword(req.Password)
+				if err != nil {
+					return nil, err
+				}
+				users[i].PasswordHash = hash
+			}
+			return users, nil
+		}
+		return nil, fmt.Errorf("user %s not found", req.Name)
+	})
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	returnOK(w)
+}
+
+func handleUsersDelete(w http.ResponseWriter, r *http.Request) {
+	err := changeUsers(r, func(users []User, req userJSON) ([]User, error) {
+		for i := range users {
+			if users[i].Name == req.Name {
+				return append(users[:i], users[i+1:]...), nil
+			}
+		}
+		return nil, fmt.Errorf("user %s not found", req.Name)
+	})
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	returnOK(w)
+}
+
+// Get the session name from the cookie of the request
+func requestSession(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// Admins get the sessions of all users, the other users get their own sessions
+func handleUsersSessions(w http.ResponseWriter, r *http.Request) {
+	user := ""
+	if !isAdminRequest(r) {
+		u, _ := currentUser(r)
+		user = u.Name
+	}
+	writeJSON(w, Context.auth.getSessions(user, requestSession(r)))
+}
+
+type sessionRevokeJSON struct {
+	ID string `json:"id"`
+}
+
+func handleUsersSessionsRevoke(w http.ResponseWriter, r *http.Request) {
+	req := sessionRevokeJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+	user := ""
+	if !isAdminRequest(r) {
+		u, _ := currentUser(r)
+		user = u.Name
+	}
+	if !Context.auth.removeSessionByID(req.ID, user) {
+		httpError(w, http.StatusBadRequest, "session %s not found", req.ID)
+		return
+	}
+	returnOK(w)
+}
+
+func handleUsersAudit(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		httpError(w, http.StatusForbidden, "not allowed")
+		return
+	}
+	writeJSON(w, Context.audit.get())
+}
+
+// Open audit trail in the data directory
+func initAudit() {
+	Context.audit = newAuditLog(filepath.Join(Context.getDataDir(), auditFile))
+}
@@ -0,0 +1,119 @@
+package home
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsersRoles(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	users := []User{
+		User{Name: "admin"},
+		User{Name: "op", Role: roleOperator},
+		User{Name: "ro", Role: roleReadOnly},
+	}
+	a := InitAuth(filepath.Join(dir, "sessions.db"), users, 60)
+	defer a.Close()
+	prevAuth := Context.auth
+	Context.auth = a
+	defer func() { Context.auth = prevAuth }()
+	prevAudit := Context.audit
+	Context.audit = newAuditLog(filepath.Join(dir, auditFile))
+	defer func() { Context.audit = prevAudit }()
+
+	cookies := map[string]string{}
+	for i := range users {
+		sess := getSession(&users[i])
+		a.addSession(sess, &session{userName: users[i].Name, expire: uint32(time.Now().Unix() + 60)})
+		cookies[users[i].Name] = hex.EncodeToString(sess)
+	}
+
+	check := func(user, method, path string) int {
+		handler := auditHandler(routeRole(path), func(w http.ResponseWriter, r *http.Request) {})
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: cookies[user]})
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, check("admin", http.MethodPost, "/control/dns_config"))
+	assert.Equal(t, http.StatusOK, check("op", http.MethodPost, "/control/filtering/refresh"))
+	assert.Equal(t, http.StatusForbidden, check("op", http.MethodPost, "/control/dns_config"))
+	assert.Equal(t, http.StatusForbidden, check("op", http.MethodPost, "/control/users/add"))
+	assert.Equal(t, http.StatusOK, check("ro", http.MethodGet, "/control/status"))
+	assert.Equal(t, http.StatusForbidden, check("ro", http.MethodPost, "/control/filtering/refresh"))
+	assert.Equal(t, http.StatusOK, check("ro", http.MethodPost, "/control/users/sessions/revoke"))
+	assert.Equal(t, http.StatusOK, check("op", http.MethodPost, "/control/users/sessions/revoke"))
+	assert.Equal(t, http.StatusForbidden, check("ro", http.MethodGet, "/control/backup"))
+	assert.Equal(t, http.StatusForbidden, check("ro", http.MethodGet, "/control/tls/status"))
+	assert.Equal(t, http.StatusOK, check("op", http.MethodGet, "/control/tls/status"))
+	assert.Equal(t, http.StatusForbidden, check("op", http.MethodGet, "/control/backup"))
+	assert.Equal(t, http.StatusForbidden, check("op", http.MethodPost, "/control/zones/add"))
+	assert.Equal(t, http.StatusForbidden, check("op", http.MethodPost, "/control/addresses/set"))
+	assert.Equal(t, "admin", routeRole("/control/new_endpoint"))
+
+	// GET requests aren't recorded
+	audit := Context.audit.get()
+	assert.Equal(t, 9, len(audit))
+	assert.Equal(t, "ro", audit[4].User)
+	assert.Equal(t, http.StatusForbidden, audit[4].Status)
+	assert.Equal(t, "admin", audit[8].User)
+	assert.Equal(t, "127.0.0.1", audit[8].IP)
+	assert.Equal(t, "/control/dns_config", audit[8].Path)
+
+	// audit trail is loaded from file
+	assert.Equal(t, audit, newAuditLog(filepath.Join(dir, auditFile)).get())
+
+	assert.NotNil(t, checkUsers(users[1:]))
+	assert.Nil(t, checkUsers(users))
+	assert.False(t, isValidRole("root"))
+}
+
+func TestUsersSessions(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	users := []User{
+		User{Name: "admin", PasswordHash: "1"},
+		User{Name: "op", PasswordHash: "2", Role: roleOperator},
+	}
+	a := InitAuth(filepath.Join(dir, "sessions.db"), users, 60)
+	defer a.Close()
+
+	var keys []string
+	for _, u := range []User{users[0], users[1], users[1]} {
+		sess := getSession(&u)
+		a.addSession(sess, &session{userName: u.Name, expire: uint32(time.Now().Unix() + 60)})
+		keys = append(keys, hex.EncodeToString(sess))
+	}
+
+	list := a.getSessions("", keys[0])
+	assert.Equal(t, 3, len(list))
+	assert.Equal(t, "admin", list[0].User)
+	assert.True(t, list[0].Current)
+	assert.Equal(t, sessionID(keys[0]), list[0].ID)
+
+	list = a.getSessions("op", "")
+	assert.Equal(t, 2, len(list))
+
+	// a user can't remove the sessions of another user
+	assert.False(t, a.removeSessionByID(sessionID(keys[0]), "op"))
+	assert.True(t, a.removeSessionByID(sessionID(keys[1]), "op"))
+	assert.Equal(t, -1, a.CheckSession(keys[1]))
+
+	// the sessions are removed when the password is changed
+	a.setUsers([]User{users[0], User{Name: "op", PasswordHash: "3", Role: roleOperator}})
+	assert.Equal(t, -1, a.CheckSession(keys[2]))
+	assert.Equal(t, 0, a.CheckSession(keys[0]))
+}
@@ -0,0 +1,140 @@
+// Package metrics writes metrics in Prometheus text exposition format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types
+const (
+	Counter = "counter"
+	Gauge   = "gauge"
+	Hist    = "histogram"
+)
+
+// DefaultDurationBuckets - the upper bounds (in seconds) of histogram buckets for request durations
+var DefaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram - the distribution of the observed values (thread-safe)
+type Histogram struct {
+	lock   sync.Mutex
+	bounds []float64 // the upper bounds of the buckets in ascending order
+	counts []uint64  // the number of values in each bucket (not cumulative)
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram - create a histogram with the buckets specified by their upper bounds
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+// Observe - add a value
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+	h.lock.Unlock()
+}
+
+// Writer - writes metrics in Prometheus text format
+// Write errors are ignored
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter - create a new Writer object
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Header - write the description of a metric
+// It must be written once before all values of the metric.
+func (w *Writer) Header(name, typ, help string) {
+	_, _ = fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+}
+
+// Value - write a value of a metric
+// labels: label names and values in turn, e.g. "reason", "FilteredBlackList"
+func (w *Writer) Value(name string, v float64, labels ...string) {
+	_, _ = fmt.Fprintf(w.w, "%s%s %s\n", name, formatLabels(labels), formatFloat(v))
+}
+
+// Histogram - write the values of a histogram
+func (w *Writer) Histogram(name string, h *Histogram, labels ...string) {
+	h.lock.Lock()
+	counts := append([]uint64{}, h.counts...)
+	sum := h.sum
+	count := h.count
+	h.lock.Unlock()
+
+	n := len(labels)
+	bucketLabels := append(append([]string{}, labels...), "le", "")
+	var total uint64
+	for i, b := range h.bounds {
+		total += counts[i]
+		bucketLabels[n+1] = formatFloat(b)
+		w.Value(name+"_bucket", float64(total), bucketLabels...)
+	}
+	bucketLabels[n+1] = "+Inf"
+	w.Value(name+"_bucket", float64(count), bucketLabels...)
+	w.Value(name+"_sum", sum, labels...)
+	w.Value(name+"_count", float64(count), labels...)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Get the label set string, e.g. {reason="FilteredBlackList"}
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	b := strings.Builder{}
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
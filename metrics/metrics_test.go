@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.Header("test_requests_total", Counter, "The number of requests")
+	w.Value("test_requests_total", 123)
+	w.Value("test_requests_total", 1.5, "reason", "a\"b\\c\n", "n", "1")
+	assert.Equal(t, `# HELP test_requests_total The number of requests
+# TYPE test_requests_total counter
+test_requests_total 123
+test_requests_total{reason="a\"b\\c\n",n="1"} 1.5
+`, buf.String())
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.Histogram("test_duration_seconds", h, "upstream", "1.1.1.1:53")
+	assert.Equal(t, `test_duration_seconds_bucket{upstream="1.1.1.1:53",le="0.1"} 2
+test_duration_seconds_bucket{upstream="1.1.1.1:53",le="1"} 3
+test_duration_seconds_bucket{upstream="1.1.1.1:53",le="+Inf"} 4
+test_duration_seconds_sum{upstream="1.1.1.1:53"} 2.65
+test_duration_seconds_count{upstream="1.1.1.1:53"} 4
+`, buf.String())
+}
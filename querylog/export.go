@@ -0,0 +1,193 @@
+// Query log export
+
+package querylog
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Export formats
+const (
+	exportFormatCSV   = "csv"
+	exportFormatJSONL = "jsonl" // JSON Lines: the same events as log forwarding sends
+)
+
+// The columns of CSV export
+var exportCSVHeader = []string{
+	"time", "client", "host", "qtype", "qclass", "rcode", "answer", "filtered", "reason",
+	"rule", "filter_id", "service_name", "upstream", "dnssec", "elapsed_ms",
+}
+
+// Write the log entries in the specified format
+type exportWriter interface {
+	write(ev forwardEvent) error
+
+	// Write the buffered data
+	flush() error
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func newCSVExportWriter(w io.Writer) (*csvExportWriter, error) {
+	cw := &csvExportWriter{w: csv.NewWriter(w)}
+	err := cw.w.Write(exportCSVHeader)
+	if err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvExportWriter) write(ev forwardEvent) error {
+	filterID := ""
+	if len(ev.Rule) != 0 {
+		filterID = strconv.FormatInt(ev.FilterID, 10)
+	}
+	return cw.w.Write([]string{
+		ev.Time, ev.Client, ev.Host, ev.QType, ev.QClass, ev.Rcode,
+		strings.Join(ev.Answer, "; "),
+		strconv.FormatBool(ev.Filtered), ev.Reason, ev.Rule, filterID, ev.ServiceName,
+		ev.Upstream, ev.DNSSEC,
+		strconv.FormatFloat(ev.ElapsedMs, 'f', -1, 64),
+	})
+}
+
+func (cw *csvExportWriter) flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type jsonExportWriter struct {
+	e *json.Encoder
+}
+
+func (jw *jsonExportWriter) write(ev forwardEvent) error {
+	return jw.e.Encode(ev) // the line is terminated by '\n'
+}
+
+func (jw *jsonExportWriter) flush() error {
+	return nil
+}
+
+// Get the event for the log entry with its response
+func exportEvent(e *logEntry) forwardEvent {
+	var msg *dns.Msg
+	if len(e.Answer) != 0 {
+		msg = new(dns.Msg)
+		if err := msg.Unpack(e.Answer); err != nil {
+			log.Debug("Failed to unpack dns message answer: %s: %s", err, string(e.Answer))
+			msg = nil
+		}
+	}
+	return makeForwardEvent(e, msg)
+}
+
+// Pass the log entries from memory buffer and then from files to the function (from newer to older)
+func (l *queryLog) export(params getDataParams, fn func(e *logEntry) bool) int {
+	// the entries in memory are copied so that DNS requests aren't blocked while the data is written
+	l.bufferLock.Lock()
+	memoryEntries := []*logEntry{}
+	for i := len(l.buffer) - 1; i >= 0; i-- {
+		entry := l.buffer[i]
+		if !params.OlderThan.IsZero() && entry.Time.UnixNano() >= params.OlderThan.UnixNano() {
+			continue
+		}
+		if !params.NewerThan.IsZero() && entry.Time.UnixNano() <= params.NewerThan.UnixNano() {
+			break
+		}
+		if matchesGetDataParams(entry, params) {
+			memoryEntries = append(memoryEntries, entry)
+		}
+	}
+	l.bufferLock.Unlock()
+
+	n := 0
+	for _, e := range memoryEntries {
+		n++
+		if !fn(e) {
+			return n
+		}
+	}
+	return n + l.storage.export(params, fn)
+}
+
+// Export the log entries that match the search parameters (the same as for "GET /control/querylog")
+// The data is written while the entries are read, the number of entries isn't limited.
+// "format": "csv" (default) or "jsonl";  "compress=gzip": the file is compressed.
+func (l *queryLog) handleExport(w http.ResponseWriter, r *http.Request) {
+	params, err := parseSearchParams(r)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	contentType := "text/csv"
+	switch format {
+	case "", exportFormatCSV:
+		format = exportFormatCSV
+	case exportFormatJSONL:
+		contentType = "application/x-ndjson"
+	default:
+		httpError(r, w, http.StatusBadRequest, "invalid format: %s", format)
+		return
+	}
+	compress := q.Get("compress")
+	if len(compress) != 0 && compress != "gzip" {
+		httpError(r, w, http.StatusBadRequest, "invalid compress: %s", compress)
+		return
+	}
+
+	fileName := "querylog." + format
+	var out io.Writer = w
+	var gz *gzip.Writer
+	if compress == "gzip" {
+		fileName += ".gz"
+		contentType = "application/gzip"
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+
+	var ew exportWriter
+	if format == exportFormatCSV {
+		ew, err = newCSVExportWriter(out)
+	} else {
+		ew = &jsonExportWriter{e: json.NewEncoder(out)}
+	}
+
+	start := time.Now()
+	n := 0
+	if err == nil {
+		n = l.export(params, func(e *logEntry) bool {
+			err = ew.write(exportEvent(e))
+			return err == nil
+		})
+	}
+	if err == nil {
+		err = ew.flush()
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		// the response status is already sent
+		log.Debug("QueryLog: export: %s", err)
+		return
+	}
+	log.Debug("QueryLog: exported %d entries in %s", n, time.Since(start))
+}
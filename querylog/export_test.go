@@ -0,0 +1,108 @@
+package querylog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExport(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	// disk entries
+	addEntry(l, "example.org", "1.1.1.1", "2.2.2.1")
+	addEntryResult(l, "ads.example.org", "0.0.0.0", "2.2.2.2",
+		dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList, Rule: "||ads.example.org^", FilterID: 1})
+	_ = l.flushLogBuffer(true)
+	// memory entries
+	addEntry(l, "example.com", "1.1.1.3", "2.2.2.1")
+	addEntry(l, "example.net", "1.1.1.4", "2.2.2.3")
+
+	export := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		l.handleExport(w, httptest.NewRequest("GET", "/control/querylog/export?"+query, nil))
+		return w
+	}
+
+	// CSV: all entries from newer to older
+	w := export("")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="querylog.csv"`, w.Header().Get("Content-Disposition"))
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(rows))
+	assert.Equal(t, exportCSVHeader, rows[0])
+	assert.Equal(t, "2.2.2.3", rows[1][1])
+	assert.Equal(t, "example.net", rows[1][2])
+	assert.True(t, strings.Contains(rows[1][6], "1.1.1.4"))
+	assert.Equal(t, "example.com", rows[2][2])
+	assert.Equal(t, "ads.example.org", rows[3][2])
+	assert.Equal(t, "true", rows[3][7])
+	assert.Equal(t, "||ads.example.org^", rows[3][9])
+	assert.Equal(t, "1", rows[3][10])
+	assert.Equal(t, "example.org", rows[4][2])
+	assert.Equal(t, "", rows[4][10])
+
+	// JSON Lines with the filter by client (both memory and disk entries match)
+	w = export("format=jsonl&filter_client=2.2.2.1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	assert.Equal(t, 2, len(lines))
+	ev := forwardEvent{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &ev))
+	assert.Equal(t, "example.com", ev.Host)
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &ev))
+	assert.Equal(t, "example.org", ev.Host)
+
+	// filtered only, compressed
+	w = export("format=jsonl&filter_response_status=filtered&compress=gzip")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/gzip", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="querylog.jsonl.gz"`, w.Header().Get("Content-Disposition"))
+	gz, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(gz)
+	assert.Nil(t, err)
+	lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	assert.Equal(t, 1, len(lines))
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &ev))
+	assert.Equal(t, "ads.example.org", ev.Host)
+	assert.True(t, ev.Filtered)
+
+	// the time range: the entries older than the newest one
+	rows, _ = csv.NewReader(strings.NewReader(export("").Body.String())).ReadAll()
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/control/querylog/export", nil)
+	q := r.URL.Query()
+	q.Set("older_than", rows[1][0])
+	q.Set("newer_than", rows[4][0])
+	r.URL.RawQuery = q.Encode()
+	l.handleExport(w, r)
+	rows, _ = csv.NewReader(w.Body).ReadAll()
+	assert.Equal(t, 3, len(rows))
+	assert.Equal(t, "example.com", rows[1][2])
+	assert.Equal(t, "ads.example.org", rows[2][2])
+
+	// invalid parameters
+	assert.Equal(t, http.StatusBadRequest, export("format=xml").Code)
+	assert.Equal(t, http.StatusBadRequest, export("compress=zip").Code)
+	assert.Equal(t, http.StatusBadRequest, export("older_than=yesterday").Code)
+}
@@ -0,0 +1,394 @@
+package querylog
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Types of log forwarding destinations
+const (
+	forwardTypeSyslog = "syslog" // syslog server (RFC 5424): "udp://host:514", "tcp://host:514", "tls://host:6514"
+	forwardTypeFile   = "file"   // JSON Lines file: "/path/to/file.jsonl"
+	forwardTypeHTTP   = "http"   // HTTP collector: the events are sent by POST requests in JSON Lines format
+)
+
+const (
+	forwardDefaultBufferSize = 10000 // the maximum number of events waiting to be sent
+	forwardBatchSize         = 100   // the maximum number of events sent at once
+	forwardMaxRetryInterval  = 30 * time.Second
+	forwardTimeout           = 10 * time.Second
+
+	// Syslog facility "local0" and severity "informational"
+	syslogPriority = 16*8 + 6
+)
+
+// ForwardConfig - settings of a log forwarding destination
+type ForwardConfig struct {
+	Type       string `yaml:"type"`        // "syslog", "file" or "http"
+	Address    string `yaml:"address"`     // syslog server URL, file path or HTTP collector URL
+	BufferSize uint32 `yaml:"buffer_size"` // the maximum number of events waiting to be sent.  0: default (10000)
+}
+
+// The event that is sent to log forwarding destinations
+type forwardEvent struct {
+	Time        string   `json:"time"` // RFC3339 time with nanoseconds
+	Client      string   `json:"client"`
+	Host        string   `json:"host"`
+	QType       string   `json:"qtype"`
+	QClass      string   `json:"qclass"`
+	Rcode       string   `json:"rcode,omitempty"`
+	Answer      []string `json:"answer,omitempty"`
+	Filtered    bool     `json:"filtered"`
+	Reason      string   `json:"reason"`
+	Rule        string   `json:"rule,omitempty"`
+	FilterID    int64    `json:"filter_id,omitempty"`
+	ServiceName string   `json:"service_name,omitempty"`
+	Upstream    string   `json:"upstream,omitempty"`
+	DNSSEC      string   `json:"dnssec,omitempty"`
+	ElapsedMs   float64  `json:"elapsed_ms"`
+}
+
+// Get the event for the log entry
+func makeForwardEvent(e *logEntry, answer *dns.Msg) forwardEvent {
+	ev := forwardEvent{
+		Time:        e.Time.Format(time.RFC3339Nano),
+		Client:      e.IP,
+		Host:        e.QHost,
+		QType:       e.QType,
+		QClass:      e.QClass,
+		Filtered:    e.Result.IsFiltered,
+		Reason:      e.Result.Reason.String(),
+		Rule:        e.Result.Rule,
+		FilterID:    e.Result.FilterID,
+		ServiceName: e.Result.ServiceName,
+		Upstream:    e.Upstream,
+		DNSSEC:      e.DNSSEC,
+		ElapsedMs:   float64(e.Elapsed) / float64(time.Millisecond),
+	}
+	if answer != nil {
+		ev.Rcode = dns.RcodeToString[answer.Rcode]
+		for _, rr := range answer.Answer {
+			ev.Answer = append(ev.Answer, strings.Replace(rr.String(), "\t", " ", -1))
+		}
+	}
+	return ev
+}
+
+// Get the event data for the log entry
+func newForwardEvent(e *logEntry, answer *dns.Msg) []byte {
+	data, err := json.Marshal(makeForwardEvent(e, answer))
+	if err != nil {
+		log.Error("Querylog: json.Marshal: %s", err)
+		return nil
+	}
+	return data
+}
+
+// A log forwarding destination
+type forwardWriter interface {
+	// Send the events
+	// If an error is returned, the same events are sent again later.
+	write(events [][]byte) error
+
+	close()
+}
+
+// Log forwarder: the events are queued and sent to the destination in background.
+// When the destination is slow or unavailable, the events are accumulated in the queue;
+// the new events are dropped while the queue is full, so DNS requests are never delayed.
+type forwarder struct {
+	dropped uint64 // atomic: the number of events dropped since the last warning
+
+	name  string
+	w     forwardWriter
+	queue chan []byte
+	stop  chan bool // closed when the forwarder must be stopped
+	done  chan bool // closed when the forwarder has stopped
+}
+
+// Check the settings of a log forwarding destination and create the object that writes the events
+func newForwardWriter(conf ForwardConfig) (forwardWriter, error) {
+	switch conf.Type {
+	case forwardTypeSyslog:
+		u, err := url.Parse(conf.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid syslog server address: %s", conf.Address)
+		}
+		switch u.Scheme {
+		case "udp", "tcp", "tls":
+			//
+		default:
+			return nil, fmt.Errorf("invalid syslog server address: %s: the scheme must be udp, tcp or tls", conf.Address)
+		}
+		if len(u.Port()) == 0 {
+			return nil, fmt.Errorf("invalid syslog server address: %s: no port", conf.Address)
+		}
+		return newSyslogWriter(u.Scheme, u.Host), nil
+
+	case forwardTypeFile:
+		if len(conf.Address) == 0 {
+			return nil, fmt.Errorf("no file name")
+		}
+		return &fileWriter{path: conf.Address}, nil
+
+	case forwardTypeHTTP:
+		u, err := url.Parse(conf.Address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("invalid HTTP collector URL: %s", conf.Address)
+		}
+		return &httpWriter{url: conf.Address, client: &http.Client{Timeout: forwardTimeout}}, nil
+	}
+	return nil, fmt.Errorf("invalid log forwarding type: %s", conf.Type)
+}
+
+// CheckForwardConfig - check the settings of log forwarding destinations
+func CheckForwardConfig(list []ForwardConfig) error {
+	for _, conf := range list {
+		_, err := newForwardWriter(conf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newForwarder(conf ForwardConfig) (*forwarder, error) {
+	w, err := newForwardWriter(conf)
+	if err != nil {
+		return nil, err
+	}
+	size := conf.BufferSize
+	if size == 0 {
+		size = forwardDefaultBufferSize
+	}
+	return &forwarder{
+		name:  conf.Type + ": " + conf.Address,
+		w:     w,
+		queue: make(chan []byte, size),
+		stop:  make(chan bool),
+		done:  make(chan bool),
+	}, nil
+}
+
+// Add the event to the queue
+// The event is dropped if the queue is full.
+func (f *forwarder) add(data []byte) {
+	select {
+	case f.queue <- data:
+		//
+	default:
+		atomic.AddUint64(&f.dropped, 1)
+	}
+}
+
+// Add the queued events to the batch until it's full
+func (f *forwarder) fillBatch(batch [][]byte) [][]byte {
+	for len(batch) < forwardBatchSize {
+		select {
+		case data := <-f.queue:
+			batch = append(batch, data)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// Send the events from the queue until the forwarder is stopped
+// If the destination is unavailable, the same events are sent again with increasing intervals.
+func (f *forwarder) run() {
+	defer close(f.done)
+	retryInterval := time.Second
+	var batch [][]byte
+	for {
+		if len(batch) == 0 {
+			select {
+			case data := <-f.queue:
+				batch = f.fillBatch([][]byte{data})
+			case <-f.stop:
+				f.flush()
+				return
+			}
+		}
+
+		n := atomic.SwapUint64(&f.dropped, 0)
+		if n != 0 {
+			log.Info("Querylog: forwarding to %s: the queue is full, %d events dropped", f.name, n)
+		}
+
+		err := f.w.write(batch)
+		if err == nil {
+			batch = nil
+			retryInterval = time.Second
+			continue
+		}
+		log.Debug("Querylog: forwarding to %s: %s", f.name, err)
+
+		select {
+		case <-time.After(retryInterval):
+			//
+		case <-f.stop:
+			return // the destination is unavailable: the queued events are lost
+		}
+		retryInterval *= 2
+		if retryInterval > forwardMaxRetryInterval {
+			retryInterval = forwardMaxRetryInterval
+		}
+	}
+}
+
+// Send the remaining events from the queue
+func (f *forwarder) flush() {
+	for {
+		batch := f.fillBatch(nil)
+		if len(batch) == 0 {
+			return
+		}
+		err := f.w.write(batch)
+		if err != nil {
+			log.Debug("Querylog: forwarding to %s: %s", f.name, err)
+			return
+		}
+	}
+}
+
+// Stop the forwarder after the queued events are sent
+func (f *forwarder) close() {
+	close(f.stop)
+	select {
+	case <-f.done:
+		f.w.close()
+	case <-time.After(forwardTimeout):
+		log.Info("Querylog: forwarding to %s: timeout while sending the remaining events", f.name)
+	}
+}
+
+// JSON Lines file
+type fileWriter struct {
+	path string
+}
+
+func (w *fileWriter) write(events [][]byte) error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	buf := bytes.Buffer{}
+	for _, data := range events {
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	_, err = file.Write(buf.Bytes())
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (w *fileWriter) close() {
+}
+
+// HTTP collector
+type httpWriter struct {
+	url    string
+	client *http.Client
+}
+
+func (w *httpWriter) write(events [][]byte) error {
+	buf := bytes.Buffer{}
+	for _, data := range events {
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	resp, err := w.client.Post(w.url, "application/x-ndjson", &buf)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (w *httpWriter) close() {
+}
+
+// Syslog server
+// The messages are in RFC 5424 format with JSON data;
+// over TCP and TLS they are framed by octet counting (RFC 6587).
+type syslogWriter struct {
+	network  string // "udp", "tcp" or "tls"
+	addr     string // host:port
+	hostname string
+	conn     net.Conn // nil: not connected
+}
+
+func newSyslogWriter(network, addr string) *syslogWriter {
+	hostname, _ := os.Hostname()
+	if len(hostname) == 0 {
+		hostname = "-"
+	}
+	return &syslogWriter{network: network, addr: addr, hostname: hostname}
+}
+
+func (w *syslogWriter) connect() error {
+	var err error
+	if w.network == "tls" {
+		dialer := &net.Dialer{Timeout: forwardTimeout}
+		w.conn, err = tls.DialWithDialer(dialer, "tcp", w.addr, &tls.Config{})
+	} else {
+		w.conn, err = net.DialTimeout(w.network, w.addr, forwardTimeout)
+	}
+	return err
+}
+
+// Get the syslog message for the event
+func (w *syslogWriter) message(data []byte) []byte {
+	msg := fmt.Sprintf("<%d>1 %s %s AdGuardHome %d querylog - %s",
+		syslogPriority, time.Now().Format(time.RFC3339), w.hostname, os.Getpid(), data)
+	if w.network == "udp" {
+		return []byte(msg)
+	}
+	return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+}
+
+func (w *syslogWriter) write(events [][]byte) error {
+	if w.conn == nil {
+		err := w.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	_ = w.conn.SetWriteDeadline(time.Now().Add(forwardTimeout))
+	for _, data := range events {
+		_, err := w.conn.Write(w.message(data))
+		if err != nil {
+			// reconnect next time
+			w.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *syslogWriter) close() {
+	if w.conn != nil {
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+}
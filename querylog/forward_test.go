@@ -0,0 +1,135 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckForwardConfig(t *testing.T) {
+	assert.Nil(t, CheckForwardConfig([]ForwardConfig{
+		{Type: "syslog", Address: "udp://127.0.0.1:514"},
+		{Type: "syslog", Address: "tls://syslog.example.org:6514"},
+		{Type: "file", Address: "/tmp/querylog.jsonl"},
+		{Type: "http", Address: "https://collector.example.org/events"},
+	}))
+	assert.NotNil(t, CheckForwardConfig([]ForwardConfig{{Type: "syslog", Address: "udp://127.0.0.1"}}))
+	assert.NotNil(t, CheckForwardConfig([]ForwardConfig{{Type: "syslog", Address: "ftp://127.0.0.1:514"}}))
+	assert.NotNil(t, CheckForwardConfig([]ForwardConfig{{Type: "file"}}))
+	assert.NotNil(t, CheckForwardConfig([]ForwardConfig{{Type: "http", Address: "collector:80"}}))
+	assert.NotNil(t, CheckForwardConfig([]ForwardConfig{{Type: "kafka", Address: "127.0.0.1:9092"}}))
+}
+
+// The entries are forwarded even if the query log is disabled
+func TestForwardFile(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "forward.jsonl")
+
+	conf := Config{
+		Enabled:  false,
+		Interval: 1,
+		MemSize:  100,
+		BaseDir:  dir,
+		Forward:  []ForwardConfig{{Type: "file", Address: fn}},
+	}
+	l := newQueryLog(conf)
+	l.Start()
+	addEntryResult(l, "example.org", "1.1.1.1", "2.2.2.1", dnsfilter.Result{})
+	addEntryResult(l, "blocked.org", "0.0.0.0", "2.2.2.2",
+		dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList, Rule: "||blocked.org^", FilterID: 1})
+	l.Close()
+	assert.Equal(t, 0, len(l.buffer))
+
+	f, err := os.Open(fn)
+	assert.Nil(t, err)
+	defer f.Close()
+	events := []forwardEvent{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		ev := forwardEvent{}
+		assert.Nil(t, json.Unmarshal(sc.Bytes(), &ev))
+		events = append(events, ev)
+	}
+	assert.Equal(t, 2, len(events))
+
+	assert.Equal(t, "example.org", events[0].Host)
+	assert.Equal(t, "2.2.2.1", events[0].Client)
+	assert.Equal(t, "A", events[0].QType)
+	assert.False(t, events[0].Filtered)
+	assert.Equal(t, 1, len(events[0].Answer))
+	assert.True(t, strings.Contains(events[0].Answer[0], "1.1.1.1"))
+
+	assert.Equal(t, "blocked.org", events[1].Host)
+	assert.True(t, events[1].Filtered)
+	assert.Equal(t, "FilteredBlackList", events[1].Reason)
+	assert.Equal(t, "||blocked.org^", events[1].Rule)
+	assert.Equal(t, int64(1), events[1].FilterID)
+}
+
+func TestForwardHTTP(t *testing.T) {
+	lock := sync.Mutex{}
+	body := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		body += string(data)
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	f, err := newForwarder(ForwardConfig{Type: "http", Address: srv.URL})
+	assert.Nil(t, err)
+	go f.run()
+	f.add([]byte(`{"host":"example.org"}`))
+	f.add([]byte(`{"host":"example.com"}`))
+	f.close()
+
+	lock.Lock()
+	assert.Equal(t, "{\"host\":\"example.org\"}\n{\"host\":\"example.com\"}\n", body)
+	lock.Unlock()
+}
+
+func TestForwardSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	f, err := newForwarder(ForwardConfig{Type: "syslog", Address: "udp://" + conn.LocalAddr().String()})
+	assert.Nil(t, err)
+	go f.run()
+	f.add([]byte(`{"host":"example.org"}`))
+
+	buf := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.Nil(t, err)
+	msg := string(buf[:n])
+	assert.True(t, strings.HasPrefix(msg, "<134>1 "))
+	assert.True(t, strings.Contains(msg, " AdGuardHome "))
+	assert.True(t, strings.HasSuffix(msg, ` querylog - {"host":"example.org"}`))
+	f.close()
+}
+
+// The new events are dropped while the queue is full
+func TestForwardQueueFull(t *testing.T) {
+	f, err := newForwarder(ForwardConfig{Type: "file", Address: "unused", BufferSize: 2})
+	assert.Nil(t, err)
+	f.add([]byte("1"))
+	f.add([]byte("2"))
+	f.add([]byte("3"))
+	assert.Equal(t, uint64(1), f.dropped)
+	assert.Equal(t, [][]byte{[]byte("1"), []byte("2")}, f.fillBatch(nil))
+}
@@ -2,8 +2,6 @@ package querylog
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,24 +24,47 @@ const (
 type queryLog struct {
 	conf    *Config
 	lock    sync.Mutex
-	logFile string // path to the log file
+	storage storage
 
 	bufferLock    sync.RWMutex
 	buffer        []*logEntry
 	fileFlushLock sync.Mutex // synchronize a file-flushing goroutine and main thread
 	flushPending  bool       // don't start another goroutine while the previous one is still running
-	fileWriteLock sync.Mutex
+
+	forwarders []*forwarder // log forwarding destinations
+
+	suggestLock sync.Mutex
+	suggestions *suggestionsJSON // the result of the last analysis;  nil if it hasn't been performed yet
+	suggestTime time.Time
 }
 
 // create a new instance of the query log
 func newQueryLog(conf Config) *queryLog {
 	l := queryLog{}
-	l.logFile = filepath.Join(conf.BaseDir, queryLogFileName)
 	l.conf = &Config{}
 	*l.conf = conf
+	l.storage = newFileStorage(l.conf.BaseDir, func() uint32 { return l.conf.MaxSize })
+	if conf.Storage.Type == StorageTypeClickHouse {
+		cs, err := newClickHouseStorage(conf.Storage)
+		if err != nil {
+			log.Error("querylog: %s;  using the log file", err)
+		} else {
+			l.storage = cs
+		}
+	} else if conf.Storage.Type != StorageTypeFile {
+		log.Error("querylog: unknown storage type %q;  using the log file", conf.Storage.Type)
+	}
 	if !checkInterval(l.conf.Interval) {
 		l.conf.Interval = 1
 	}
+	for _, fc := range conf.Forward {
+		f, err := newForwarder(fc)
+		if err != nil {
+			log.Error("Querylog: log forwarding: %s", err)
+			continue
+		}
+		l.forwarders = append(l.forwarders, f)
+	}
 	return &l
 }
 
@@ -52,10 +73,16 @@ func (l *queryLog) Start() {
 		l.initWeb()
 	}
 	go l.periodicRotate()
+	for _, f := range l.forwarders {
+		go f.run()
+	}
 }
 
 func (l *queryLog) Close() {
 	_ = l.flushLogBuffer(true)
+	for _, f := range l.forwarders {
+		f.close()
+	}
 }
 
 func checkInterval(days uint32) bool {
@@ -65,6 +92,8 @@ func checkInterval(days uint32) bool {
 func (l *queryLog) WriteDiskConfig(dc *DiskConfig) {
 	dc.Enabled = l.conf.Enabled
 	dc.Interval = l.conf.Interval
+	dc.MemSize = l.conf.MemSize
+	dc.MaxSize = l.conf.MaxSize
 }
 
 // Clear memory buffer and remove log files
@@ -77,15 +106,11 @@ func (l *queryLog) clear() {
 	l.flushPending = false
 	l.bufferLock.Unlock()
 
-	err := os.Remove(l.logFile + ".1")
-	if err != nil && !os.IsNotExist(err) {
-		log.Error("file remove: %s: %s", l.logFile+".1", err)
-	}
+	l.storage.clear()
 
-	err = os.Remove(l.logFile)
-	if err != nil && !os.IsNotExist(err) {
-		log.Error("file remove: %s: %s", l.logFile, err)
-	}
+	l.suggestLock.Lock()
+	l.suggestions = nil
+	l.suggestLock.Unlock()
 
 	log.Debug("Query log: cleared")
 }
@@ -101,13 +126,24 @@ type logEntry struct {
 	Answer     []byte `json:",omitempty"` // sometimes empty answers happen like binerdunt.top or rev2.globalrootservers.net
 	OrigAnswer []byte `json:",omitempty"`
 
-	Result   dnsfilter.Result
-	Elapsed  time.Duration
-	Upstream string `json:",omitempty"` // if empty, means it was cached
+	Result     dnsfilter.Result
+	WouldBlock *wouldBlockResult `json:"WB,omitempty"` // audit mode: the request would have been blocked
+	Elapsed    time.Duration
+	Upstream   string `json:",omitempty"` // if empty, means it was cached
+	DNSSEC     string `json:",omitempty"` // DNSSEC validation status
+}
+
+// The filtering result that isn't applied to the request in audit mode
+// The names differ from the names of Result fields, because decodeLogEntry() doesn't distinguish nested objects.
+type wouldBlockResult struct {
+	Reason      dnsfilter.Reason `json:"WBReason"`
+	Rule        string           `json:"WBRule,omitempty"`
+	FilterID    int64            `json:"WBFilterID,omitempty"`
+	ServiceName string           `json:"WBService,omitempty"`
 }
 
 func (l *queryLog) Add(params AddParams) {
-	if !l.conf.Enabled {
+	if !l.conf.Enabled && len(l.forwarders) == 0 {
 		return
 	}
 
@@ -128,6 +164,15 @@ func (l *queryLog) Add(params AddParams) {
 		Result:   *params.Result,
 		Elapsed:  params.Elapsed,
 		Upstream: params.Upstream,
+		DNSSEC:   params.DNSSEC,
+	}
+	if params.WouldBlock != nil {
+		entry.WouldBlock = &wouldBlockResult{
+			Reason:      params.WouldBlock.Reason,
+			Rule:        params.WouldBlock.Rule,
+			FilterID:    params.WouldBlock.FilterID,
+			ServiceName: params.WouldBlock.ServiceName,
+		}
 	}
 	q := params.Question.Question[0]
 	entry.QHost = strings.ToLower(q.Name[:len(q.Name)-1]) // remove the last dot
@@ -152,6 +197,16 @@ func (l *queryLog) Add(params AddParams) {
 		entry.OrigAnswer = a
 	}
 
+	if len(l.forwarders) != 0 {
+		data := newForwardEvent(&entry, params.Answer)
+		for _, f := range l.forwarders {
+			f.add(data)
+		}
+	}
+	if !l.conf.Enabled {
+		return
+	}
+
 	l.bufferLock.Lock()
 	l.buffer = append(l.buffer, &entry)
 	needFlush := false
@@ -174,12 +229,16 @@ func (l *queryLog) Add(params AddParams) {
 // Parameters for getData()
 type getDataParams struct {
 	OlderThan         time.Time          // return entries that are older than this value
+	NewerThan         time.Time          // return entries that are newer than this value
 	Domain            string             // filter by domain name in question
 	Client            string             // filter by client IP
 	QuestionType      string             // filter by question type
 	ResponseStatus    responseStatusType // filter by response status
 	StrictMatchDomain bool               // if Domain value must be matched strictly
 	StrictMatchClient bool               // if Client value must be matched strictly
+
+	// Domain contains non-ASCII characters: it's matched with the Unicode form of the host names
+	unicodeDomain bool
 }
 
 // Response status
@@ -189,14 +248,17 @@ type responseStatusType int32
 const (
 	responseStatusAll responseStatusType = iota + 1
 	responseStatusFiltered
+	responseStatusBlockedParental     // blocked by parental control
+	responseStatusBlockedSafeBrowsing // blocked by safe browsing
+	responseStatusWouldBlock          // not blocked in audit mode
 )
 
 // Gets log entries
 func (l *queryLog) getData(params getDataParams) map[string]interface{} {
 	now := time.Now()
 
-	// add from file
-	fileEntries, oldest, total := l.searchFiles(params)
+	// add from storage
+	fileEntries, oldest, total := l.storage.search(params)
 
 	if params.OlderThan.IsZero() {
 		params.OlderThan = now
@@ -216,6 +278,10 @@ func (l *queryLog) getData(params getDataParams) map[string]interface{} {
 			// Ignore entries newer than what was requested
 			continue
 		}
+		if !params.NewerThan.IsZero() && entry.Time.UnixNano() <= params.NewerThan.UnixNano() {
+			// Ignore entries older than what was requested
+			break
+		}
 
 		if !matchesGetDataParams(entry, params) {
 			continue
@@ -233,7 +299,7 @@ func (l *queryLog) getData(params getDataParams) map[string]interface{} {
 	}
 	if len(entries) == getDataLimit {
 		// change the "oldest" value here.
-		// we cannot use the "oldest" we got from "searchFiles" anymore
+		// we cannot use the "oldest" we got from "storage.search" anymore
 		// because after adding in-memory records and removing extra records
 		// the situation has changed
 		oldest = entries[len(entries)-1].Time
@@ -296,6 +362,24 @@ func logEntryToJSONEntry(entry *logEntry) map[string]interface{} {
 		jsonEntry["service_name"] = entry.Result.ServiceName
 	}
 
+	if entry.WouldBlock != nil {
+		wb := map[string]interface{}{
+			"reason": entry.WouldBlock.Reason.String(),
+		}
+		if len(entry.WouldBlock.Rule) != 0 {
+			wb["rule"] = entry.WouldBlock.Rule
+			wb["filterId"] = entry.WouldBlock.FilterID
+		}
+		if len(entry.WouldBlock.ServiceName) != 0 {
+			wb["service_name"] = entry.WouldBlock.ServiceName
+		}
+		jsonEntry["would_block"] = wb
+	}
+
+	if len(entry.DNSSEC) != 0 {
+		jsonEntry["dnssec"] = entry.DNSSEC
+	}
+
 	answers := answerToMap(msg)
 	if answers != nil {
 		jsonEntry["answer"] = answers
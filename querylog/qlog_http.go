@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/AdguardTeam/golibs/jsonutil"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
@@ -21,6 +22,7 @@ func httpError(r *http.Request, w http.ResponseWriter, code int, format string,
 
 type request struct {
 	olderThan            string
+	newerThan            string
 	filterDomain         string
 	filterClient         string
 	filterQuestionType   string
@@ -37,11 +39,13 @@ func getDoubleQuotesEnclosedValue(s *string) bool {
 	return false
 }
 
-func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
+// Get the search parameters from the URL query
+func parseSearchParams(r *http.Request) (getDataParams, error) {
 	var err error
 	req := request{}
 	q := r.URL.Query()
 	req.olderThan = q.Get("older_than")
+	req.newerThan = q.Get("newer_than")
 	req.filterDomain = q.Get("filter_domain")
 	req.filterClient = q.Get("filter_client")
 	req.filterQuestionType = q.Get("filter_question_type")
@@ -55,14 +59,23 @@ func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
 	if len(req.olderThan) != 0 {
 		params.OlderThan, err = time.Parse(time.RFC3339Nano, req.olderThan)
 		if err != nil {
-			httpError(r, w, http.StatusBadRequest, "invalid time stamp: %s", err)
-			return
+			return params, fmt.Errorf("invalid time stamp: %s", err)
+		}
+	}
+	if len(req.newerThan) != 0 {
+		params.NewerThan, err = time.Parse(time.RFC3339Nano, req.newerThan)
+		if err != nil {
+			return params, fmt.Errorf("invalid time stamp: %s", err)
 		}
 	}
 
 	if getDoubleQuotesEnclosedValue(&params.Domain) {
 		params.StrictMatchDomain = true
 	}
+	if !util.IsASCII(params.Domain) {
+		params.Domain = util.ToUnicode(util.ToPunycode(params.Domain))
+		params.unicodeDomain = true
+	}
 	if getDoubleQuotesEnclosedValue(&params.Client) {
 		params.StrictMatchClient = true
 	}
@@ -70,8 +83,7 @@ func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
 	if len(req.filterQuestionType) != 0 {
 		_, ok := dns.StringToType[req.filterQuestionType]
 		if !ok {
-			httpError(r, w, http.StatusBadRequest, "invalid question_type")
-			return
+			return params, fmt.Errorf("invalid question_type")
 		}
 		params.QuestionType = req.filterQuestionType
 	}
@@ -80,11 +92,25 @@ func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
 		switch req.filterResponseStatus {
 		case "filtered":
 			params.ResponseStatus = responseStatusFiltered
+		case "blocked_parental":
+			params.ResponseStatus = responseStatusBlockedParental
+		case "blocked_safebrowsing":
+			params.ResponseStatus = responseStatusBlockedSafeBrowsing
+		case "would_block":
+			params.ResponseStatus = responseStatusWouldBlock
 		default:
-			httpError(r, w, http.StatusBadRequest, "invalid response_status")
-			return
+			return params, fmt.Errorf("invalid response_status")
 		}
 	}
+	return params, nil
+}
+
+func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
+	params, err := parseSearchParams(r)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
 
 	data := l.getData(params)
 
@@ -163,4 +189,6 @@ func (l *queryLog) initWeb() {
 	l.conf.HTTPRegister("GET", "/control/querylog_info", l.handleQueryLogInfo)
 	l.conf.HTTPRegister("POST", "/control/querylog_clear", l.handleQueryLogClear)
 	l.conf.HTTPRegister("POST", "/control/querylog_config", l.handleQueryLogConfig)
+	l.conf.HTTPRegister("GET", "/control/querylog/suggestions", l.handleSuggestions)
+	l.conf.HTTPRegister("GET", "/control/querylog/export", l.handleExport)
 }
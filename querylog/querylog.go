@@ -14,6 +14,7 @@ type DiskConfig struct {
 	Enabled  bool
 	Interval uint32
 	MemSize  uint32
+	MaxSize  uint32
 }
 
 // QueryLog - main interface
@@ -36,6 +37,14 @@ type Config struct {
 	BaseDir  string // directory where log file is stored
 	Interval uint32 // interval to rotate logs (in days)
 	MemSize  uint32 // number of entries kept in memory before they are flushed to disk
+	MaxSize  uint32 // maximum size of log file (in bytes) after which it's rotated.  0: no limit
+
+	// The storage of log entries: the file in BaseDir or a database server
+	Storage StorageConfig
+
+	// Log forwarding destinations
+	// The entries are forwarded even if the query log is disabled.
+	Forward []ForwardConfig
 
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func()
@@ -50,9 +59,11 @@ type AddParams struct {
 	Answer     *dns.Msg          // The response we sent to the client (optional)
 	OrigAnswer *dns.Msg          // The response from an upstream server (optional)
 	Result     *dnsfilter.Result // Filtering result (optional)
+	WouldBlock *dnsfilter.Result // Filtering result that isn't applied to the request in audit mode (optional)
 	Elapsed    time.Duration     // Time spent for processing the request
 	ClientIP   net.IP
 	Upstream   string
+	DNSSEC     string // DNSSEC validation status: "secure", "insecure", "bogus" or empty (not validated)
 }
 
 // New - create a new instance of the query log
@@ -0,0 +1,376 @@
+package querylog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Types of query log storage
+const (
+	StorageTypeFile       = ""           // JSON file in the data directory
+	StorageTypeClickHouse = "clickhouse" // ClickHouse server
+)
+
+const (
+	clickHouseTimeout      = 30 * time.Second
+	clickHouseDefaultDB    = "default"
+	clickHouseDefaultTable = "querylog"
+	clickHouseMaxLine      = 1024 * 1024 // the maximum length of a row in response
+)
+
+// StorageConfig - settings of query log storage
+type StorageConfig struct {
+	Type string `yaml:"type"` // "" (file) or "clickhouse"
+
+	// The settings of ClickHouse server
+	URL      string `yaml:"url"`      // HTTP interface, e.g. "http://127.0.0.1:8123"
+	Database string `yaml:"database"` // Empty: "default"
+	Table    string `yaml:"table"`    // the table is created if it doesn't exist.  Empty: "querylog"
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// The entries older than this number of days are deleted.  0: the entries are never deleted
+	RetentionDays uint32 `yaml:"retention_days"`
+}
+
+var clickHouseNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Log entries are stored in ClickHouse table
+// The main properties are stored in separate columns, so that they can be used for analytics,
+// and the whole entry is stored in "entry" column in the same form as in the log file.
+// The requests are sent to HTTP interface of the server.
+type clickHouseStorage struct {
+	url       string
+	table     string // "database.table"
+	username  string
+	password  string
+	retention uint32
+	client    *http.Client
+
+	lock    sync.Mutex
+	created bool // the table has been created
+}
+
+// A row of the table
+type clickHouseRow struct {
+	TS       uint64 `json:"ts"` // UNIX time in nanoseconds
+	IP       string `json:"ip"`
+	Host     string `json:"host"`
+	QType    string `json:"qtype"`
+	Filtered uint8  `json:"filtered"`
+	Reason   uint8  `json:"reason"`
+	Upstream string `json:"upstream"`
+	Elapsed  uint64 `json:"elapsed"` // in nanoseconds
+	Entry    string `json:"entry"`
+}
+
+func newClickHouseStorage(conf StorageConfig) (*clickHouseStorage, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("clickhouse: invalid URL: %q", conf.URL)
+	}
+	db := conf.Database
+	if len(db) == 0 {
+		db = clickHouseDefaultDB
+	}
+	table := conf.Table
+	if len(table) == 0 {
+		table = clickHouseDefaultTable
+	}
+	if !clickHouseNameRegexp.MatchString(db) || !clickHouseNameRegexp.MatchString(table) {
+		return nil, fmt.Errorf("clickhouse: invalid table name: %s.%s", db, table)
+	}
+	return &clickHouseStorage{
+		url:       strings.TrimSuffix(conf.URL, "/") + "/",
+		table:     db + "." + table,
+		username:  conf.Username,
+		password:  conf.Password,
+		retention: conf.RetentionDays,
+		client:    &http.Client{Timeout: clickHouseTimeout},
+	}, nil
+}
+
+// Send the query;  params: the values of the query parameters ({name:Type} in the query)
+// The caller must close the response body.
+func (cs *clickHouseStorage) request(query string, params map[string]string, body []byte) (io.ReadCloser, error) {
+	v := url.Values{}
+	for name, val := range params {
+		v.Set("param_"+name, val)
+	}
+	var r io.Reader
+	if body != nil {
+		v.Set("query", query)
+		r = bytes.NewReader(body)
+	} else {
+		r = strings.NewReader(query)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, cs.url+"?"+v.Encode(), r)
+	if err != nil {
+		return nil, err
+	}
+	if len(cs.username) != 0 {
+		req.Header.Set("X-ClickHouse-User", cs.username)
+		req.Header.Set("X-ClickHouse-Key", cs.password)
+	}
+	resp, err := cs.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("clickhouse: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("clickhouse: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+// Send the query which doesn't return any data
+func (cs *clickHouseStorage) exec(query string, params map[string]string, body []byte) error {
+	r, err := cs.request(query, params, body)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, r)
+	return r.Close()
+}
+
+// Create the table if it doesn't exist
+func (cs *clickHouseStorage) createTable() error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if cs.created {
+		return nil
+	}
+	err := cs.exec(`CREATE TABLE IF NOT EXISTS `+cs.table+` (
+	ts UInt64,
+	time DateTime MATERIALIZED toDateTime(intDiv(ts, 1000000000)),
+	ip String,
+	host String,
+	qtype LowCardinality(String),
+	filtered UInt8,
+	reason UInt8,
+	upstream LowCardinality(String),
+	elapsed UInt64,
+	entry String
+) ENGINE = MergeTree() PARTITION BY toYYYYMM(time) ORDER BY ts`, nil, nil)
+	if err != nil {
+		return err
+	}
+	cs.created = true
+	return nil
+}
+
+func (cs *clickHouseStorage) write(entries []*logEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	err := cs.createTable()
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		row := clickHouseRow{
+			TS:       uint64(entry.Time.UnixNano()),
+			IP:       entry.IP,
+			Host:     entry.QHost,
+			QType:    entry.QType,
+			Reason:   uint8(entry.Result.Reason),
+			Upstream: entry.Upstream,
+			Elapsed:  uint64(entry.Elapsed),
+			Entry:    string(data),
+		}
+		if entry.Result.IsFiltered {
+			row.Filtered = 1
+		}
+		err = e.Encode(row)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = cs.exec("INSERT INTO "+cs.table+" FORMAT JSONEachRow", nil, b.Bytes())
+	if err != nil {
+		return err
+	}
+	log.Debug("querylog: %d entries written to ClickHouse", len(entries))
+	return nil
+}
+
+// Get the conditions of the query for the search criteria
+// The conditions only narrow down the rows:  the entries are checked by matchesGetDataParams() anyway.
+func clickHouseWhere(params getDataParams, olderThan, newerThan time.Time) (string, map[string]string) {
+	cond := []string{"1"}
+	args := map[string]string{}
+	if !olderThan.IsZero() {
+		cond = append(cond, "ts < {older:UInt64}")
+		args["older"] = strconv.FormatInt(olderThan.UnixNano(), 10)
+	}
+	if !newerThan.IsZero() {
+		cond = append(cond, "ts > {newer:UInt64}")
+		args["newer"] = strconv.FormatInt(newerThan.UnixNano(), 10)
+	}
+	switch params.ResponseStatus {
+	case responseStatusFiltered, responseStatusBlockedParental, responseStatusBlockedSafeBrowsing:
+		cond = append(cond, "filtered = 1")
+	}
+	if len(params.QuestionType) != 0 {
+		cond = append(cond, "qtype = {qtype:String}")
+		args["qtype"] = params.QuestionType
+	}
+	if len(params.Client) != 0 {
+		if params.StrictMatchClient {
+			cond = append(cond, "ip = {client:String}")
+		} else {
+			cond = append(cond, "position(ip, {client:String}) != 0")
+		}
+		args["client"] = params.Client
+	}
+	if len(params.Domain) != 0 && !params.unicodeDomain {
+		if params.StrictMatchDomain {
+			cond = append(cond, "host = {domain:String}")
+		} else {
+			cond = append(cond, "position(host, {domain:String}) != 0")
+		}
+		args["domain"] = params.Domain
+	}
+	return strings.Join(cond, " AND "), args
+}
+
+// Read the rows (from newer to older) and pass them to the function until it returns FALSE
+// limit: the maximum number of rows.  0: no limit
+func (cs *clickHouseStorage) query(where string, args map[string]string, limit int, fn func(ts int64, entry *logEntry) bool) error {
+	q := "SELECT ts, entry FROM " + cs.table + " WHERE " + where + " ORDER BY ts DESC"
+	if limit != 0 {
+		q += " LIMIT " + strconv.Itoa(limit)
+	}
+	r, err := cs.request(q+" FORMAT JSONEachRow", args, nil)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), clickHouseMaxLine)
+	for sc.Scan() {
+		row := struct {
+			// UInt64 values are quoted in JSON output by default
+			TS    json.Number `json:"ts"`
+			Entry string      `json:"entry"`
+		}{}
+		d := json.NewDecoder(bytes.NewReader(sc.Bytes()))
+		d.UseNumber()
+		err = d.Decode(&row)
+		if err != nil {
+			return fmt.Errorf("clickhouse: invalid row: %s", err)
+		}
+		ts, err := strconv.ParseInt(row.TS.String(), 10, 64)
+		if err != nil {
+			return fmt.Errorf("clickhouse: invalid row: %s", err)
+		}
+		entry := &logEntry{}
+		decodeLogEntry(entry, row.Entry)
+		if !fn(ts, entry) {
+			break
+		}
+	}
+	return sc.Err()
+}
+
+func (cs *clickHouseStorage) search(params getDataParams) ([]*logEntry, time.Time, int) {
+	entries := make([]*logEntry, 0)
+	where, args := clickHouseWhere(params, params.OlderThan, params.NewerThan)
+	total := 0
+	oldestNano := int64(0)
+	err := cs.query(where, args, maxSearchEntries, func(ts int64, entry *logEntry) bool {
+		total++
+		oldestNano = ts
+		if !matchesGetDataParams(entry, params) {
+			return true
+		}
+		entries = append(entries, entry)
+		return len(entries) != getDataLimit
+	})
+	if err != nil {
+		log.Error("querylog: %s", err)
+	}
+	oldest := time.Time{}
+	if oldestNano != 0 {
+		oldest = time.Unix(0, oldestNano)
+	}
+	return entries, oldest, total
+}
+
+func (cs *clickHouseStorage) scan(since time.Time, fn func(e *logEntry)) int {
+	where, args := clickHouseWhere(getDataParams{}, time.Time{}, since)
+	n := 0
+	err := cs.query(where, args, maxSearchEntries, func(_ int64, entry *logEntry) bool {
+		fn(entry)
+		n++
+		return true
+	})
+	if err != nil {
+		log.Error("querylog: %s", err)
+	}
+	return n
+}
+
+func (cs *clickHouseStorage) export(params getDataParams, fn func(e *logEntry) bool) int {
+	where, args := clickHouseWhere(params, params.OlderThan, params.NewerThan)
+	n := 0
+	err := cs.query(where, args, 0, func(_ int64, entry *logEntry) bool {
+		if !matchesGetDataParams(entry, params) {
+			return true
+		}
+		n++
+		return fn(entry)
+	})
+	if err != nil {
+		log.Error("querylog: %s", err)
+	}
+	return n
+}
+
+// Delete the entries that are older than the retention period
+func (cs *clickHouseStorage) rotate() error {
+	if cs.retention == 0 {
+		return nil
+	}
+	err := cs.createTable()
+	if err != nil {
+		return err
+	}
+	before := time.Now().Add(-time.Duration(cs.retention) * 24 * time.Hour)
+	return cs.exec("ALTER TABLE "+cs.table+" DELETE WHERE ts < {before:UInt64}",
+		map[string]string{"before": strconv.FormatInt(before.UnixNano(), 10)}, nil)
+}
+
+func (cs *clickHouseStorage) clear() {
+	err := cs.createTable()
+	if err == nil {
+		err = cs.exec("TRUNCATE TABLE "+cs.table, nil, nil)
+	}
+	if err != nil {
+		log.Error("querylog: %s", err)
+	}
+}
@@ -0,0 +1,131 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ClickHouse server that keeps the inserted rows and returns them all for SELECT queries
+type testClickHouse struct {
+	lock    sync.Mutex
+	rows    []clickHouseRow
+	queries []string
+	params  []map[string]string
+}
+
+func (ch *testClickHouse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	q := r.URL.Query().Get("query")
+	if len(q) == 0 {
+		q = string(body)
+	}
+	params := map[string]string{}
+	for k, v := range r.URL.Query() {
+		if strings.HasPrefix(k, "param_") {
+			params[k[len("param_"):]] = v[0]
+		}
+	}
+	ch.queries = append(ch.queries, q)
+	ch.params = append(ch.params, params)
+
+	switch {
+	case strings.HasPrefix(q, "INSERT INTO default.querylog FORMAT JSONEachRow"):
+		sc := bufio.NewScanner(strings.NewReader(string(body)))
+		for sc.Scan() {
+			row := clickHouseRow{}
+			_ = json.Unmarshal(sc.Bytes(), &row)
+			ch.rows = append(ch.rows, row)
+		}
+	case strings.HasPrefix(q, "SELECT ts, entry FROM default.querylog"):
+		for i := len(ch.rows) - 1; i >= 0; i-- {
+			// UInt64 values are quoted
+			d, _ := json.Marshal(ch.rows[i].Entry)
+			_, _ = fmt.Fprintf(w, "{\"ts\":\"%d\",\"entry\":%s}\n", ch.rows[i].TS, d)
+		}
+	case strings.HasPrefix(q, "TRUNCATE TABLE default.querylog"):
+		ch.rows = nil
+	case strings.HasPrefix(q, "CREATE TABLE IF NOT EXISTS default.querylog"),
+		strings.HasPrefix(q, "ALTER TABLE default.querylog DELETE"):
+	default:
+		http.Error(w, "unknown query", http.StatusBadRequest)
+	}
+}
+
+func TestQueryLogClickHouse(t *testing.T) {
+	ch := &testClickHouse{}
+	srv := httptest.NewServer(ch)
+	defer srv.Close()
+
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+		Storage: StorageConfig{
+			Type:          StorageTypeClickHouse,
+			URL:           srv.URL,
+			RetentionDays: 90,
+		},
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+	_, ok := l.storage.(*clickHouseStorage)
+	assert.True(t, ok)
+
+	addEntry(l, "example.org", "1.1.1.1", "2.2.2.1")
+	addEntry(l, "example.com", "1.1.1.2", "2.2.2.2")
+	assert.Nil(t, l.flushLogBuffer(true))
+	assert.Equal(t, 2, len(ch.rows))
+	assert.Equal(t, "example.com", ch.rows[1].Host)
+	assert.Equal(t, "2.2.2.2", ch.rows[1].IP)
+	assert.True(t, strings.HasPrefix(ch.queries[0], "CREATE TABLE"))
+
+	// the entries are read from the server (from newer to older)
+	d := l.getData(getDataParams{})
+	mdata := d["data"].([]map[string]interface{})
+	assert.Equal(t, 2, len(mdata))
+	assert.True(t, checkEntry(t, mdata[0], "example.com", "1.1.1.2", "2.2.2.2"))
+	assert.True(t, checkEntry(t, mdata[1], "example.org", "1.1.1.1", "2.2.2.1"))
+
+	// the search criteria are passed as query parameters and the entries are checked anyway
+	d = l.getData(getDataParams{Client: "2.2.2.1", ResponseStatus: responseStatusAll})
+	mdata = d["data"].([]map[string]interface{})
+	assert.Equal(t, 1, len(mdata))
+	assert.True(t, checkEntry(t, mdata[0], "example.org", "1.1.1.1", "2.2.2.1"))
+	last := len(ch.queries) - 1
+	assert.True(t, strings.Contains(ch.queries[last], "position(ip, {client:String}) != 0"))
+	assert.Equal(t, "2.2.2.1", ch.params[last]["client"])
+
+	n := l.storage.export(getDataParams{Domain: "example.org", ResponseStatus: responseStatusAll}, func(e *logEntry) bool { return true })
+	assert.Equal(t, 1, n)
+
+	assert.Nil(t, l.rotate())
+	last = len(ch.queries) - 1
+	assert.True(t, strings.HasPrefix(ch.queries[last], "ALTER TABLE default.querylog DELETE WHERE ts < {before:UInt64}"))
+
+	l.clear()
+	assert.Equal(t, 0, len(ch.rows))
+
+	// the server returns an error
+	ch.rows = []clickHouseRow{{TS: 1, Entry: "{}"}}
+	l.storage.(*clickHouseStorage).table = "default.unknown"
+	assert.NotNil(t, l.storage.write([]*logEntry{{IP: "1.2.3.4"}}))
+
+	_, err := newClickHouseStorage(StorageConfig{URL: srv.URL, Table: "querylog; DROP TABLE x"})
+	assert.NotNil(t, err)
+	_, err = newClickHouseStorage(StorageConfig{URL: "127.0.0.1:8123"})
+	assert.NotNil(t, err)
+}
@@ -4,11 +4,56 @@ import (
 	"bytes"
 	"encoding/json"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 )
 
+// Persistent storage of log entries
+type storage interface {
+	// Save the log entries (from older to newer)
+	write(entries []*logEntry) error
+
+	// Read the log entries that match the search criteria (from newer to older)
+	// Return the entries, the time of the oldest processed entry (even if it was discarded)
+	//  and the number of processed entries (including discarded)
+	search(params getDataParams) ([]*logEntry, time.Time, int)
+
+	// Pass the entries newer than the specified time to the function (from newer to older)
+	// No more than maxSearchEntries entries are read.  Return the number of the entries.
+	scan(since time.Time, fn func(e *logEntry)) int
+
+	// Pass all entries that match the search criteria to the function (from newer to older) until it returns FALSE
+	// Return the number of the entries.
+	export(params getDataParams, fn func(e *logEntry) bool) int
+
+	// Remove the old entries
+	rotate() error
+
+	// Remove all entries
+	clear()
+}
+
+// Log entries are stored in a JSON file on disk
+// The file is rotated periodically or when its size exceeds the limit: the old data is moved to "<file>.1"
+type fileStorage struct {
+	logFile   string // path to the log file
+	writeLock sync.Mutex
+
+	// Get the maximum size of log file (in bytes) after which it's rotated.  0: no limit
+	// The value is read from the current configuration on each write.
+	maxSize func() uint32
+}
+
+func newFileStorage(baseDir string, maxSize func() uint32) *fileStorage {
+	return &fileStorage{
+		logFile: filepath.Join(baseDir, queryLogFileName),
+		maxSize: maxSize,
+	}
+}
+
 // flushLogBuffer flushes the current buffer to file and resets the current buffer
 func (l *queryLog) flushLogBuffer(fullFlush bool) error {
 	l.fileFlushLock.Lock()
@@ -25,7 +70,7 @@ func (l *queryLog) flushLogBuffer(fullFlush bool) error {
 	l.buffer = nil
 	l.flushPending = false
 	l.bufferLock.Unlock()
-	err := l.flushToFile(flushBuffer)
+	err := l.storage.write(flushBuffer)
 	if err != nil {
 		log.Error("Saving querylog to file failed: %s", err)
 		return err
@@ -33,8 +78,8 @@ func (l *queryLog) flushLogBuffer(fullFlush bool) error {
 	return nil
 }
 
-// flushToFile saves the specified log entries to the query log file
-func (l *queryLog) flushToFile(buffer []*logEntry) error {
+// write saves the specified log entries to the query log file
+func (fs *fileStorage) write(buffer []*logEntry) error {
 	if len(buffer) == 0 {
 		log.Debug("querylog: there's nothing to write to a file")
 		return nil
@@ -56,11 +101,11 @@ func (l *queryLog) flushToFile(buffer []*logEntry) error {
 
 	var err error
 	var zb bytes.Buffer
-	filename := l.logFile
+	filename := fs.logFile
 	zb = b
 
-	l.fileWriteLock.Lock()
-	defer l.fileWriteLock.Unlock()
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
 	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		log.Error("failed to create file \"%s\": %s", filename, err)
@@ -76,12 +121,22 @@ func (l *queryLog) flushToFile(buffer []*logEntry) error {
 
 	log.Debug("ok \"%s\": %v bytes written", filename, n)
 
+	maxSize := fs.maxSize()
+	if maxSize != 0 {
+		fi, err := f.Stat()
+		if err == nil && fi.Size() >= int64(maxSize) {
+			log.Debug("querylog: file size %d exceeds the limit %d", fi.Size(), maxSize)
+			_ = f.Close()
+			_ = fs.rotate()
+		}
+	}
+
 	return nil
 }
 
-func (l *queryLog) rotate() error {
-	from := l.logFile
-	to := l.logFile + ".1"
+func (fs *fileStorage) rotate() error {
+	from := fs.logFile
+	to := fs.logFile + ".1"
 
 	if _, err := os.Stat(from); os.IsNotExist(err) {
 		// do nothing, file doesn't exist
@@ -98,6 +153,23 @@ func (l *queryLog) rotate() error {
 	return nil
 }
 
+// Remove log files
+func (fs *fileStorage) clear() {
+	err := os.Remove(fs.logFile + ".1")
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("file remove: %s: %s", fs.logFile+".1", err)
+	}
+
+	err = os.Remove(fs.logFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("file remove: %s: %s", fs.logFile, err)
+	}
+}
+
+func (l *queryLog) rotate() error {
+	return l.storage.rotate()
+}
+
 func (l *queryLog) periodicRotate() {
 	for range time.Tick(time.Duration(l.conf.Interval) * 24 * time.Hour) {
 		err := l.rotate()
@@ -13,7 +13,7 @@ import (
 	"github.com/miekg/dns"
 )
 
-// searchFiles reads log entries from all log files and applies the specified search criteria.
+// search reads log entries from all log files and applies the specified search criteria.
 // IMPORTANT: this method does not scan more than "maxSearchEntries" so you
 // may need to call it many times.
 //
@@ -21,11 +21,11 @@ import (
 // * an array of log entries that we have read
 // * time of the oldest processed entry (even if it was discarded)
 // * total number of processed entries (including discarded).
-func (l *queryLog) searchFiles(params getDataParams) ([]*logEntry, time.Time, int) {
+func (fs *fileStorage) search(params getDataParams) ([]*logEntry, time.Time, int) {
 	entries := make([]*logEntry, 0)
 	oldest := time.Time{}
 
-	r, err := l.openReader()
+	r, err := fs.openReader()
 	if err != nil {
 		log.Error("Failed to open qlog reader: %v", err)
 		return entries, oldest, 0
@@ -53,13 +53,19 @@ func (l *queryLog) searchFiles(params getDataParams) ([]*logEntry, time.Time, in
 	oldestNano := int64(0)
 	// Do not scan more than 50k at once
 	for total <= maxSearchEntries {
-		entry, ts, err := l.readNextEntry(r, params)
+		entry, ts, err := readNextEntry(r, params)
 
 		if err == io.EOF {
 			// there's nothing to read anymore
 			break
 		}
 
+		if !params.NewerThan.IsZero() && ts != 0 && ts <= params.NewerThan.UnixNano() {
+			// the rest of the entries are older than what was requested
+			oldestNano = 0
+			break
+		}
+
 		oldestNano = ts
 		total++
 
@@ -72,17 +78,87 @@ func (l *queryLog) searchFiles(params getDataParams) ([]*logEntry, time.Time, in
 		}
 	}
 
-	oldest = time.Unix(0, oldestNano)
+	if oldestNano != 0 {
+		oldest = time.Unix(0, oldestNano)
+	}
 	return entries, oldest, total
 }
 
+// export passes all log entries that match the search criteria to the function (from newer to older)
+// Unlike search() the number of the entries isn't limited and the time stamps don't need to match the entries.
+func (fs *fileStorage) export(params getDataParams, fn func(e *logEntry) bool) int {
+	r, err := fs.openReader()
+	if err != nil {
+		log.Error("Failed to open qlog reader: %v", err)
+		return 0
+	}
+	defer r.Close()
+
+	err = r.SeekStart()
+	if err != nil {
+		log.Debug("Cannot SeekStart(): %v", err)
+		return 0
+	}
+
+	n := 0
+	for {
+		entry, ts, err := readNextEntry(r, params)
+		if err != nil {
+			break
+		}
+		if !params.OlderThan.IsZero() && ts >= params.OlderThan.UnixNano() {
+			continue
+		}
+		if !params.NewerThan.IsZero() && ts != 0 && ts <= params.NewerThan.UnixNano() {
+			break
+		}
+		if entry != nil {
+			n++
+			if !fn(entry) {
+				break
+			}
+		}
+	}
+	return n
+}
+
+// scan passes the log entries newer than "since" to the function (from newer to older)
+func (fs *fileStorage) scan(since time.Time, fn func(e *logEntry)) int {
+	r, err := fs.openReader()
+	if err != nil {
+		log.Error("Failed to open qlog reader: %v", err)
+		return 0
+	}
+	defer r.Close()
+
+	err = r.SeekStart()
+	if err != nil {
+		log.Debug("Cannot SeekStart(): %v", err)
+		return 0
+	}
+
+	n := 0
+	params := getDataParams{ResponseStatus: responseStatusAll}
+	for n != maxSearchEntries {
+		entry, ts, err := readNextEntry(r, params)
+		if err != nil || (ts != 0 && ts <= since.UnixNano()) {
+			break
+		}
+		if entry != nil {
+			fn(entry)
+			n++
+		}
+	}
+	return n
+}
+
 // readNextEntry - reads the next log entry and checks if it matches the search criteria (getDataParams)
 //
 // returns:
 // * log entry that matches search criteria or null if it was discarded (or if there's nothing to read)
 // * timestamp of the processed log entry
 // * error if we can't read anymore
-func (l *queryLog) readNextEntry(r *QLogReader, params getDataParams) (*logEntry, int64, error) {
+func readNextEntry(r *QLogReader, params getDataParams) (*logEntry, int64, error) {
 	line, err := r.ReadNext()
 	if err != nil {
 		return nil, 0, err
@@ -108,14 +184,14 @@ func (l *queryLog) readNextEntry(r *QLogReader, params getDataParams) (*logEntry
 }
 
 // openReader - opens QLogReader instance
-func (l *queryLog) openReader() (*QLogReader, error) {
+func (fs *fileStorage) openReader() (*QLogReader, error) {
 	files := make([]string, 0)
 
-	if util.FileExists(l.logFile + ".1") {
-		files = append(files, l.logFile+".1")
+	if util.FileExists(fs.logFile + ".1") {
+		files = append(files, fs.logFile+".1")
 	}
-	if util.FileExists(l.logFile) {
-		files = append(files, l.logFile)
+	if util.FileExists(fs.logFile) {
+		files = append(files, fs.logFile)
 	}
 
 	return NewQLogReader(files)
@@ -125,11 +201,16 @@ func (l *queryLog) openReader() (*QLogReader, error) {
 // this method does not guarantee anything and the reason is to do a quick check
 // without deserializing anything
 func quickMatchesGetDataParams(line string, params getDataParams) bool {
-	if params.ResponseStatus == responseStatusFiltered {
+	switch params.ResponseStatus {
+	case responseStatusFiltered, responseStatusBlockedParental, responseStatusBlockedSafeBrowsing:
 		boolVal, ok := readJSONBool(line, "IsFiltered")
 		if !ok || !boolVal {
 			return false
 		}
+	case responseStatusWouldBlock:
+		if strings.Index(line, "\"WB\":") == -1 {
+			return false
+		}
 	}
 
 	if len(params.Domain) != 0 {
@@ -138,8 +219,7 @@ func quickMatchesGetDataParams(line string, params getDataParams) bool {
 			return false
 		}
 
-		if (params.StrictMatchDomain && val != params.Domain) ||
-			(!params.StrictMatchDomain && strings.Index(val, params.Domain) == -1) {
+		if !matchDomain(val, params) {
 			return false
 		}
 	}
@@ -167,10 +247,38 @@ func quickMatchesGetDataParams(line string, params getDataParams) bool {
 	return true
 }
 
+// Return TRUE if the host name matches the domain search criterion
+// An internationalized domain name is converted to Unicode when the criterion is in Unicode,
+// so that a part of a label matches too.
+func matchDomain(host string, params getDataParams) bool {
+	if params.unicodeDomain {
+		host = util.ToUnicode(host)
+	}
+	if params.StrictMatchDomain {
+		return host == params.Domain
+	}
+	return strings.Contains(host, params.Domain)
+}
+
 // matchesGetDataParams - returns true if the entry matches the search parameters
 func matchesGetDataParams(entry *logEntry, params getDataParams) bool {
-	if params.ResponseStatus == responseStatusFiltered && !entry.Result.IsFiltered {
-		return false
+	switch params.ResponseStatus {
+	case responseStatusFiltered:
+		if !entry.Result.IsFiltered {
+			return false
+		}
+	case responseStatusBlockedParental:
+		if entry.Result.Reason != dnsfilter.FilteredParental {
+			return false
+		}
+	case responseStatusBlockedSafeBrowsing:
+		if entry.Result.Reason != dnsfilter.FilteredSafeBrowsing {
+			return false
+		}
+	case responseStatusWouldBlock:
+		if entry.WouldBlock == nil {
+			return false
+		}
 	}
 
 	if len(params.QuestionType) != 0 {
@@ -180,8 +288,7 @@ func matchesGetDataParams(entry *logEntry, params getDataParams) bool {
 	}
 
 	if len(params.Domain) != 0 {
-		if (params.StrictMatchDomain && entry.QHost != params.Domain) ||
-			(!params.StrictMatchDomain && strings.Index(entry.QHost, params.Domain) == -1) {
+		if !matchDomain(entry.QHost, params) {
 			return false
 		}
 	}
@@ -196,6 +303,14 @@ func matchesGetDataParams(entry *logEntry, params getDataParams) bool {
 	return true
 }
 
+// Get the filtering result of audit mode, create it if necessary
+func (ent *logEntry) wouldBlock() *wouldBlockResult {
+	if ent.WouldBlock == nil {
+		ent.WouldBlock = &wouldBlockResult{}
+	}
+	return ent.WouldBlock
+}
+
 // decodeLogEntry - decodes query log entry from a line
 // nolint (gocyclo)
 func decodeLogEntry(ent *logEntry, str string) {
@@ -239,8 +354,21 @@ func decodeLogEntry(ent *logEntry, str string) {
 			i, err = strconv.Atoi(v)
 			ent.Result.Reason = dnsfilter.Reason(i)
 
+		case "WBReason":
+			i, err = strconv.Atoi(v)
+			ent.wouldBlock().Reason = dnsfilter.Reason(i)
+		case "WBRule":
+			ent.wouldBlock().Rule = v
+		case "WBFilterID":
+			i, err = strconv.Atoi(v)
+			ent.wouldBlock().FilterID = int64(i)
+		case "WBService":
+			ent.wouldBlock().ServiceName = v
+
 		case "Upstream":
 			ent.Upstream = v
+		case "DNSSEC":
+			ent.DNSSEC = v
 		case "Elapsed":
 			i, err = strconv.Atoi(v)
 			ent.Elapsed = time.Duration(i)
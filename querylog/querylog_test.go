@@ -2,11 +2,15 @@ package querylog
 
 import (
 	"net"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
@@ -105,7 +109,221 @@ func TestQueryLog(t *testing.T) {
 	assert.True(t, checkEntry(t, mdata[3], "example.org", "1.1.1.1", "2.2.2.1"))
 }
 
+// Check the search by internationalized domain name
+func TestQueryLogIDN(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	addEntry(l, "xn--e1afmkfd.xn--p1ai", "1.1.1.1", "2.2.2.1")
+	_ = l.flushLogBuffer(true)
+	addEntry(l, "example.org", "1.1.1.2", "2.2.2.2")
+
+	search := func(domain string) []map[string]interface{} {
+		r := httptest.NewRequest("GET", "/control/querylog?filter_domain="+url.QueryEscape(domain), nil)
+		params, err := parseSearchParams(r)
+		assert.Nil(t, err)
+		return l.getData(params)["data"].([]map[string]interface{})
+	}
+
+	// a part of the label in Unicode, the full name, the name in punycode
+	for _, domain := range []string{"РИМЕ", `"пример.рф"`, "xn--e1afmkfd"} {
+		mdata := search(domain)
+		assert.Equal(t, 1, len(mdata), domain)
+		assert.True(t, checkEntry(t, mdata[0], "xn--e1afmkfd.xn--p1ai", "1.1.1.1", "2.2.2.1"))
+	}
+	assert.Equal(t, 0, len(search(`"пример"`)))
+}
+
+// Check the search by response status
+func TestQueryLogResponseStatus(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	addEntry(l, "example.org", "1.1.1.1", "2.2.2.1")
+	addEntryResult(l, "adult.example.org", "1.1.1.2", "2.2.2.2",
+		dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredParental})
+	addEntryResult(l, "blocked.example.org", "1.1.1.3", "2.2.2.3",
+		dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList})
+	// write to disk
+	_ = l.flushLogBuffer(true)
+	addEntryResult(l, "adult.example.com", "1.1.1.4", "2.2.2.4",
+		dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredParental})
+	addEntryResult(l, "malware.example.com", "1.1.1.5", "2.2.2.5",
+		dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredSafeBrowsing})
+
+	params := getDataParams{
+		ResponseStatus: responseStatusFiltered,
+	}
+	d := l.getData(params)
+	mdata := d["data"].([]map[string]interface{})
+	assert.Equal(t, 4, len(mdata))
+
+	params = getDataParams{
+		ResponseStatus: responseStatusBlockedParental,
+	}
+	d = l.getData(params)
+	mdata = d["data"].([]map[string]interface{})
+	assert.Equal(t, 2, len(mdata))
+	assert.True(t, checkEntry(t, mdata[0], "adult.example.com", "1.1.1.4", "2.2.2.4"))
+	assert.True(t, checkEntry(t, mdata[1], "adult.example.org", "1.1.1.2", "2.2.2.2"))
+
+	params = getDataParams{
+		ResponseStatus: responseStatusBlockedSafeBrowsing,
+	}
+	d = l.getData(params)
+	mdata = d["data"].([]map[string]interface{})
+	assert.Equal(t, 1, len(mdata))
+	assert.True(t, checkEntry(t, mdata[0], "malware.example.com", "1.1.1.5", "2.2.2.5"))
+}
+
+// Check the search by time range
+func TestQueryLogNewerThan(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	addEntry(l, "example.org", "1.1.1.1", "2.2.2.1")
+	_ = l.flushLogBuffer(true)
+	time.Sleep(time.Millisecond)
+	newerThan := time.Now()
+	addEntry(l, "example.org", "1.1.1.2", "2.2.2.2")
+	_ = l.flushLogBuffer(true)
+	addEntry(l, "example.com", "1.1.1.3", "2.2.2.3")
+
+	params := getDataParams{
+		NewerThan: newerThan,
+	}
+	d := l.getData(params)
+	mdata := d["data"].([]map[string]interface{})
+	assert.Equal(t, 2, len(mdata))
+	assert.True(t, checkEntry(t, mdata[0], "example.com", "1.1.1.3", "2.2.2.3"))
+	assert.True(t, checkEntry(t, mdata[1], "example.org", "1.1.1.2", "2.2.2.2"))
+	assert.Equal(t, "", d["oldest"])
+}
+
+// Check the rotation of log file by size
+func TestQueryLogMaxSize(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+		MaxSize:  100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	addEntry(l, "example.org", "1.1.1.1", "2.2.2.1")
+	_ = l.flushLogBuffer(true)
+	fn := filepath.Join(conf.BaseDir, queryLogFileName)
+	assert.True(t, util.FileExists(fn+".1"))
+	assert.False(t, util.FileExists(fn))
+
+	addEntry(l, "example.org", "1.1.1.2", "2.2.2.2")
+	d := l.getData(getDataParams{})
+	mdata := d["data"].([]map[string]interface{})
+	assert.Equal(t, 2, len(mdata))
+
+	// the limit is taken from the current configuration
+	conf2 := *l.conf
+	conf2.MaxSize = 0
+	l.conf = &conf2
+	_ = l.flushLogBuffer(true)
+	assert.True(t, util.FileExists(fn))
+}
+
+// Check that DNSSEC validation status is stored on disk
+func TestQueryLogDNSSEC(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	q := dns.Msg{}
+	q.SetQuestion("example.org.", dns.TypeA)
+	l.Add(AddParams{
+		Question: &q,
+		Result:   &dnsfilter.Result{},
+		ClientIP: net.ParseIP("2.2.2.1"),
+		DNSSEC:   "secure",
+	})
+	addEntry(l, "example.com", "1.1.1.2", "2.2.2.2")
+	_ = l.flushLogBuffer(true)
+
+	d := l.getData(getDataParams{})
+	mdata := d["data"].([]map[string]interface{})
+	assert.Equal(t, 2, len(mdata))
+	_, ok := mdata[0]["dnssec"]
+	assert.False(t, ok)
+	assert.Equal(t, "secure", mdata[1]["dnssec"])
+}
+
+// Check the requests that aren't blocked in audit mode
+func TestQueryLogWouldBlock(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	q := dns.Msg{}
+	q.SetQuestion("ads.example.org.", dns.TypeA)
+	l.Add(AddParams{
+		Question:   &q,
+		Result:     &dnsfilter.Result{},
+		WouldBlock: &dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList, Rule: "||ads.example.org^", FilterID: 1},
+		ClientIP:   net.ParseIP("2.2.2.1"),
+	})
+	addEntry(l, "example.com", "1.1.1.2", "2.2.2.2")
+	// write to disk
+	_ = l.flushLogBuffer(true)
+	addEntry(l, "example.net", "1.1.1.3", "2.2.2.3")
+
+	d := l.getData(getDataParams{ResponseStatus: responseStatusAll})
+	mdata := d["data"].([]map[string]interface{})
+	assert.Equal(t, 3, len(mdata))
+	_, ok := mdata[0]["would_block"]
+	assert.False(t, ok)
+
+	d = l.getData(getDataParams{ResponseStatus: responseStatusWouldBlock})
+	mdata = d["data"].([]map[string]interface{})
+	assert.Equal(t, 1, len(mdata))
+	assert.Equal(t, "NotFilteredNotFound", mdata[0]["reason"])
+	wb := mdata[0]["would_block"].(map[string]interface{})
+	assert.Equal(t, "FilteredBlackList", wb["reason"])
+	assert.Equal(t, "||ads.example.org^", wb["rule"])
+	assert.Equal(t, int64(1), wb["filterId"])
+}
+
 func addEntry(l *queryLog, host, answerStr, client string) {
+	addEntryResult(l, host, answerStr, client, dnsfilter.Result{})
+}
+
+func addEntryResult(l *queryLog, host, answerStr, client string, res dnsfilter.Result) {
 	q := dns.Msg{}
 	q.Question = append(q.Question, dns.Question{
 		Name:   host + ".",
@@ -123,7 +341,6 @@ func addEntry(l *queryLog, host, answerStr, client string) {
 	}
 	answer.A = net.ParseIP(answerStr)
 	a.Answer = append(a.Answer, answer)
-	res := dnsfilter.Result{}
 	params := AddParams{
 		Question: &q,
 		Answer:   &a,
@@ -0,0 +1,283 @@
+// Allowlist and blocklist rule suggestions
+
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	suggestPeriod     = 24 * time.Hour   // the log entries of this period are analyzed
+	suggestCacheTime  = 10 * time.Minute // the result of the analysis is reused during this time
+	suggestMinCount   = 10               // the minimum number of requests for a suggestion
+	suggestBlockRatio = 0.5              // the minimum share of blocked requests to the domain for a "block" suggestion
+	suggestMaxItems   = 5                // the maximum number of hosts, clients and rules in a suggestion
+	suggestMaxResults = 50
+)
+
+// Suggestion types
+const (
+	suggestAllow = "allow" // the blocked requests may break a service: an allowlist rule
+	suggestBlock = "block" // the allowed host belongs to a mostly blocked domain: a blocking rule
+)
+
+type suggestCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// A suggested rule
+type suggestion struct {
+	Type    string         `json:"type"`
+	Domain  string         `json:"domain"` // eTLD+1
+	Rule    string         `json:"rule"`   // the rule to add to user rules
+	Reason  string         `json:"reason"` // the description for the user
+	Blocked int            `json:"blocked"`
+	Allowed int            `json:"allowed"`
+	Hosts   []suggestCount `json:"hosts"`   // the most frequent first
+	Clients []suggestCount `json:"clients"` // the clients which made the blocked ("allow") or allowed ("block") requests
+	Rules   []suggestCount `json:"rules"`   // the rules which blocked the requests
+}
+
+type suggestionsJSON struct {
+	Time        string       `json:"time"`    // RFC3339: the time of the analysis
+	Entries     int          `json:"entries"` // the number of the analyzed log entries
+	Suggestions []suggestion `json:"suggestions"`
+}
+
+// The requests to a host or domain
+type suggestStats struct {
+	blocked        int
+	allowed        int
+	hosts          map[string]*suggestStats
+	blockedClients map[string]int
+	allowedClients map[string]int
+	rules          map[string]int
+}
+
+func newSuggestStats() *suggestStats {
+	return &suggestStats{
+		hosts:          map[string]*suggestStats{},
+		blockedClients: map[string]int{},
+		allowedClients: map[string]int{},
+		rules:          map[string]int{},
+	}
+}
+
+// Count the request
+func (s *suggestStats) add(e *logEntry, blocked bool) {
+	if blocked {
+		s.blocked++
+		s.blockedClients[e.IP]++
+		if len(e.Result.Rule) != 0 {
+			s.rules[e.Result.Rule]++
+		}
+	} else {
+		s.allowed++
+		s.allowedClients[e.IP]++
+	}
+}
+
+// Get the domain which groups the host names: eTLD+1
+func suggestDomain(host string) string {
+	d, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return d
+}
+
+// Get the items with the largest counts (no more than suggestMaxItems)
+func topCounts(m map[string]int) []suggestCount {
+	list := []suggestCount{}
+	for name, n := range m {
+		list = append(list, suggestCount{name, n})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count == list[j].Count {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Count > list[j].Count
+	})
+	if len(list) > suggestMaxItems {
+		list = list[:suggestMaxItems]
+	}
+	return list
+}
+
+// The analysis of the log entries
+type suggestAnalyzer struct {
+	domains map[string]*suggestStats
+	entries int
+}
+
+// Count the request from the log entry
+// The requests blocked by a filtering rule or a blocked service may be unblocked by an allowlist rule.
+// The requests which aren't matched by filtering may be blocked by a rule.
+func (a *suggestAnalyzer) add(e *logEntry) {
+	a.entries++
+	var blocked bool
+	switch e.Result.Reason {
+	case dnsfilter.FilteredBlackList, dnsfilter.FilteredBlockedService:
+		blocked = true
+	case dnsfilter.NotFilteredNotFound:
+		blocked = false
+	default:
+		return
+	}
+
+	d := suggestDomain(e.QHost)
+	ds, ok := a.domains[d]
+	if !ok {
+		ds = newSuggestStats()
+		a.domains[d] = ds
+	}
+	ds.add(e, blocked)
+	hs, ok := ds.hosts[e.QHost]
+	if !ok {
+		hs = newSuggestStats()
+		ds.hosts[e.QHost] = hs
+	}
+	hs.add(e, blocked)
+}
+
+// Get the suggestions: the most frequent first
+func (a *suggestAnalyzer) suggestions() []suggestion {
+	list := []suggestion{}
+	for d, ds := range a.domains {
+		if ds.blocked < suggestMinCount {
+			continue
+		}
+		list = append(list, allowSuggestion(d, ds))
+
+		if float64(ds.blocked)/float64(ds.blocked+ds.allowed) < suggestBlockRatio {
+			continue
+		}
+		for h, hs := range ds.hosts {
+			if hs.blocked == 0 && hs.allowed >= suggestMinCount {
+				list = append(list, blockSuggestion(d, ds, h, hs))
+			}
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		ni, nj := list[i].Blocked, list[j].Blocked
+		if list[i].Type == suggestBlock {
+			ni = list[i].Allowed
+		}
+		if list[j].Type == suggestBlock {
+			nj = list[j].Allowed
+		}
+		if ni == nj {
+			return list[i].Rule < list[j].Rule
+		}
+		return ni > nj
+	})
+	if len(list) > suggestMaxResults {
+		list = list[:suggestMaxResults]
+	}
+	return list
+}
+
+// Suggest to unblock the domain (or the only blocked host of the domain)
+func allowSuggestion(d string, ds *suggestStats) suggestion {
+	blockedHosts := map[string]int{}
+	for h, hs := range ds.hosts {
+		if hs.blocked != 0 {
+			blockedHosts[h] = hs.blocked
+		}
+	}
+	s := suggestion{
+		Type:    suggestAllow,
+		Domain:  d,
+		Blocked: ds.blocked,
+		Allowed: ds.allowed,
+		Hosts:   topCounts(blockedHosts),
+		Clients: topCounts(ds.blockedClients),
+		Rules:   topCounts(ds.rules),
+	}
+	name := d
+	if len(blockedHosts) == 1 {
+		name = s.Hosts[0].Name
+	}
+	s.Rule = "@@||" + name + "^"
+	top := s.Clients[0]
+	s.Reason = fmt.Sprintf("%d requests to %s were blocked, %d of them from %s", ds.blocked, name, top.Count, top.Name)
+	if ds.allowed != 0 {
+		s.Reason += fmt.Sprintf(", while %d requests to the other hosts of %s were allowed: blocking may break it",
+			ds.allowed, d)
+	}
+	return s
+}
+
+// Suggest to block the host of a mostly blocked domain
+func blockSuggestion(d string, ds *suggestStats, h string, hs *suggestStats) suggestion {
+	s := suggestion{
+		Type:    suggestBlock,
+		Domain:  d,
+		Rule:    "||" + h + "^",
+		Blocked: ds.blocked,
+		Allowed: hs.allowed,
+		Hosts:   []suggestCount{{h, hs.allowed}},
+		Clients: topCounts(hs.allowedClients),
+		Rules:   []suggestCount{},
+	}
+	s.Reason = fmt.Sprintf("%d requests to %s were allowed, while %d of %d requests to %s were blocked",
+		hs.allowed, h, ds.blocked, ds.blocked+ds.allowed, d)
+	return s
+}
+
+// Analyze the log entries of the last suggestPeriod (from memory buffer and files)
+func (l *queryLog) analyzeSuggestions(now time.Time) suggestionsJSON {
+	a := suggestAnalyzer{domains: map[string]*suggestStats{}}
+	since := now.Add(-suggestPeriod)
+
+	l.bufferLock.Lock()
+	for _, e := range l.buffer {
+		if e.Time.After(since) {
+			a.add(e)
+		}
+	}
+	l.bufferLock.Unlock()
+
+	l.storage.scan(since, a.add)
+
+	return suggestionsJSON{
+		Time:        now.Format(time.RFC3339),
+		Entries:     a.entries,
+		Suggestions: a.suggestions(),
+	}
+}
+
+// Get the suggested rules
+// The analysis is performed again if its result is older than suggestCacheTime or "refresh" parameter is set.
+func (l *queryLog) handleSuggestions(w http.ResponseWriter, r *http.Request) {
+	refresh := r.URL.Query().Get("refresh") == "true"
+	now := time.Now()
+
+	l.suggestLock.Lock()
+	if refresh || l.suggestions == nil || now.Sub(l.suggestTime) > suggestCacheTime {
+		res := l.analyzeSuggestions(now)
+		l.suggestions = &res
+		l.suggestTime = now
+		log.Debug("QueryLog: suggestions: analyzed %d entries in %s", res.Entries, time.Since(now))
+	}
+	resp := *l.suggestions
+	l.suggestLock.Unlock()
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Marshal: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
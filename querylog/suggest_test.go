@@ -0,0 +1,103 @@
+package querylog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/stretchr/testify/assert"
+)
+
+func findSuggestion(list []suggestion, typ, rule string) *suggestion {
+	for i := range list {
+		if list[i].Type == typ && list[i].Rule == rule {
+			return &list[i]
+		}
+	}
+	return nil
+}
+
+func TestSuggestions(t *testing.T) {
+	conf := Config{
+		Enabled:  true,
+		Interval: 1,
+		MemSize:  1000,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	blocked := dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList, Rule: "||tv.example.co.uk^"}
+	for i := 0; i != 30; i++ {
+		client := "192.168.1.2"
+		if i%3 == 0 {
+			client = "192.168.1.3"
+		}
+		addEntryResult(l, "api.tv.example.co.uk", "1.2.3.4", client, blocked)
+	}
+	for i := 0; i != 5; i++ {
+		addEntry(l, "www.example.co.uk", "1.2.3.4", "192.168.1.2")
+	}
+	// some entries are on disk
+	_ = l.flushLogBuffer(true)
+
+	ads := dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList, Rule: "||ads.example.net^"}
+	for i := 0; i != 20; i++ {
+		addEntryResult(l, "ads.example.net", "1.2.3.4", "192.168.1.4", ads)
+	}
+	for i := 0; i != 12; i++ {
+		addEntry(l, "track.example.net", "1.2.3.4", "192.168.1.4")
+	}
+	// too few requests
+	for i := 0; i != suggestMinCount-1; i++ {
+		addEntryResult(l, "rare.example.com", "1.2.3.4", "192.168.1.4", blocked)
+	}
+	// safe browsing can't be allowed by a rule
+	for i := 0; i != 20; i++ {
+		addEntryResult(l, "malware.example.org", "1.2.3.4", "192.168.1.4",
+			dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredSafeBrowsing})
+	}
+
+	w := httptest.NewRecorder()
+	l.handleSuggestions(w, httptest.NewRequest("GET", "/control/querylog/suggestions", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	resp := suggestionsJSON{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 30+5+20+12+suggestMinCount-1+20, resp.Entries)
+	assert.Equal(t, 3, len(resp.Suggestions))
+
+	// the most frequent first
+	s := resp.Suggestions[0]
+	assert.Equal(t, suggestAllow, s.Type)
+	assert.Equal(t, "example.co.uk", s.Domain)
+	assert.Equal(t, "@@||api.tv.example.co.uk^", s.Rule)
+	assert.Equal(t, 30, s.Blocked)
+	assert.Equal(t, 5, s.Allowed)
+	assert.Equal(t, "192.168.1.2", s.Clients[0].Name)
+	assert.Equal(t, 20, s.Clients[0].Count)
+	assert.Equal(t, "||tv.example.co.uk^", s.Rules[0].Name)
+	assert.True(t, strings.Contains(s.Reason, "20 of them from 192.168.1.2"))
+
+	s2 := findSuggestion(resp.Suggestions, suggestAllow, "@@||ads.example.net^")
+	assert.NotNil(t, s2)
+	s2 = findSuggestion(resp.Suggestions, suggestBlock, "||track.example.net^")
+	assert.NotNil(t, s2)
+	assert.Equal(t, 12, s2.Allowed)
+
+	// the result is reused until it's refreshed
+	addEntryResult(l, "ads.example.net", "1.2.3.4", "192.168.1.4", ads)
+	assert.Equal(t, resp.Entries, l.analyzeSuggestions(time.Now()).Entries-1)
+	w = httptest.NewRecorder()
+	l.handleSuggestions(w, httptest.NewRequest("GET", "/control/querylog/suggestions", nil))
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 30+5+20+12+suggestMinCount-1+20, resp.Entries)
+	w = httptest.NewRecorder()
+	l.handleSuggestions(w, httptest.NewRequest("GET", "/control/querylog/suggestions?refresh=true", nil))
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 30+5+20+12+suggestMinCount+20, resp.Entries)
+}
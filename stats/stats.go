@@ -49,6 +49,9 @@ type Stats interface {
 	// Get IP addresses of the clients with the most number of requests
 	GetTopClientsIP(limit uint) []string
 
+	// Get the number of matched rules per filter ID
+	GetFilterHits() map[int64]uint64
+
 	// WriteDiskConfig - write configuration
 	WriteDiskConfig(dc *DiskConfig)
 }
@@ -72,6 +75,7 @@ const (
 	RSafeBrowsing
 	RSafeSearch
 	RParental
+	RFilteredAAAA // AAAA request is answered with an empty response (AAAA filtering)
 	rLast
 )
 
@@ -81,4 +85,7 @@ type Entry struct {
 	Client net.IP
 	Result Result
 	Time   uint32 // processing time (msec)
+
+	RuleMatched bool  // a filtering rule has matched (either blocking or whitelist)
+	FilterID    int64 // ID of the filter list the matched rule belongs to
 }
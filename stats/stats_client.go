@@ -0,0 +1,254 @@
+// Per-client statistics
+
+package stats
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	maxClientDomains = 10 // max number of top domains of a client to store in a unit
+	maxClientUnits   = maxClients
+)
+
+// The counters of a client for 1 time unit
+type clientUnit struct {
+	nTotal  uint64
+	nResult []uint64
+	timeSum uint64 // usec
+
+	domains        map[string]uint64
+	blockedDomains map[string]uint64
+}
+
+// The counters of a client stored in file
+type clientUnitDB struct {
+	Name    string // IP address
+	NTotal  uint64
+	NResult []uint64
+	TimeAvg uint32 // usec
+
+	Domains        []countPair
+	BlockedDomains []countPair
+}
+
+// Update the counters of the client
+// The unit must be locked.
+func (u *unit) updateClient(client string, e Entry) {
+	cu, ok := u.clientUnits[client]
+	if !ok {
+		cu = &clientUnit{
+			nResult:        make([]uint64, rLast),
+			domains:        map[string]uint64{},
+			blockedDomains: map[string]uint64{},
+		}
+		u.clientUnits[client] = cu
+	}
+	cu.nTotal++
+	cu.nResult[e.Result]++
+	cu.timeSum += uint64(e.Time)
+	if e.Result == RNotFiltered || e.Result == RFilteredAAAA {
+		cu.domains[e.Domain]++
+	} else {
+		cu.blockedDomains[e.Domain]++
+	}
+}
+
+// Get the counters of the clients with the most number of requests
+func serializeClients(m map[string]*clientUnit) []clientUnitDB {
+	counts := map[string]uint64{}
+	for name, cu := range m {
+		counts[name] = cu.nTotal
+	}
+	list := []clientUnitDB{}
+	for _, it := range convertMapToArray(counts, maxClientUnits) {
+		cu := m[it.Name]
+		c := clientUnitDB{
+			Name:           it.Name,
+			NTotal:         cu.nTotal,
+			NResult:        append([]uint64{}, cu.nResult...),
+			TimeAvg:        uint32(cu.timeSum / cu.nTotal),
+			Domains:        convertMapToArray(cu.domains, maxClientDomains),
+			BlockedDomains: convertMapToArray(cu.blockedDomains, maxClientDomains),
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+func deserializeClients(list []clientUnitDB) map[string]*clientUnit {
+	m := map[string]*clientUnit{}
+	for _, c := range list {
+		cu := &clientUnit{
+			nTotal:         c.NTotal,
+			nResult:        make([]uint64, rLast),
+			timeSum:        uint64(c.TimeAvg) * c.NTotal,
+			domains:        convertArrayToMap(c.Domains),
+			blockedDomains: convertArrayToMap(c.BlockedDomains),
+		}
+		copy(cu.nResult, c.NResult)
+		m[c.Name] = cu
+	}
+	return m
+}
+
+// Find the counters of the client in the unit
+// Return nil if the client hasn't made requests during this time unit.
+func (udb *unitDB) findClient(client string) *clientUnitDB {
+	for i := range udb.ClientUnits {
+		if udb.ClientUnits[i].Name == client {
+			return &udb.ClientUnits[i]
+		}
+	}
+	return nil
+}
+
+// Group the client's units by time unit in the same way as getData() does:
+// hours: a unit per group;  days: 24 units per group.
+func groupClientUnits(units []*clientUnitDB, firstID uint32, timeUnit TimeUnit) [][]*clientUnitDB {
+	groups := [][]*clientUnitDB{}
+	if timeUnit == Hours {
+		for _, c := range units {
+			groups = append(groups, []*clientUnitDB{c})
+		}
+		return groups
+	}
+
+	// 720 hours may span 31 days, so we skip data for the first day in this case
+	firstDayID := (firstID + 24 - 1) / 24 * 24 // align_ceil(24)
+	g := []*clientUnitDB{}
+	id := firstDayID
+	nextDayID := firstDayID + 24
+	for i := firstDayID - firstID; int(i) != len(units); i++ {
+		g = append(g, units[i])
+		if id == nextDayID {
+			groups = append(groups, g)
+			g = []*clientUnitDB{}
+			nextDayID += 24
+		}
+		id++
+	}
+	if id <= nextDayID {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// Get the sums of the client's counter per time unit
+// A nil unit means the client hasn't made requests during this time unit.
+func clientSeries(groups [][]*clientUnitDB, val func(c *clientUnitDB) uint64) []uint64 {
+	a := []uint64{}
+	for _, g := range groups {
+		var sum uint64
+		for _, c := range g {
+			if c != nil {
+				sum += val(c)
+			}
+		}
+		a = append(a, sum)
+	}
+	return a
+}
+
+// Get the statistics of the client: the same data as getData() returns, except top clients
+func (s *statsCtx) getClientData(client string) map[string]interface{} {
+	limit := s.conf.limit
+	timeUnit := Hours
+	if limit/24 > 7 {
+		timeUnit = Days
+	}
+
+	units, firstID := s.loadUnits(limit)
+	if units == nil {
+		return nil
+	}
+	cunits := []*clientUnitDB{}
+	for _, u := range units {
+		cunits = append(cunits, u.findClient(client))
+	}
+
+	d := map[string]interface{}{}
+	d["client"] = client
+	groups := groupClientUnits(cunits, firstID, timeUnit)
+	d["dns_queries"] = clientSeries(groups, func(c *clientUnitDB) uint64 { return c.NTotal })
+	d["blocked_filtering"] = clientSeries(groups, func(c *clientUnitDB) uint64 { return c.NResult[RFiltered] })
+	d["replaced_safebrowsing"] = clientSeries(groups, func(c *clientUnitDB) uint64 { return c.NResult[RSafeBrowsing] })
+	d["replaced_parental"] = clientSeries(groups, func(c *clientUnitDB) uint64 { return c.NResult[RParental] })
+
+	// average processing time (in seconds) per time unit is weighted by the number of requests
+	at := []float64{}
+	times := clientSeries(groups, func(c *clientUnitDB) uint64 { return uint64(c.TimeAvg) * c.NTotal })
+	for i, n := range d["dns_queries"].([]uint64) {
+		at = append(at, avgTimeSeconds(times[i], n))
+	}
+	d["avg_processing_time_series"] = at
+
+	domains := map[string]uint64{}
+	blocked := map[string]uint64{}
+	sum := clientUnitDB{NResult: make([]uint64, rLast)}
+	var timeSum uint64
+	for _, c := range cunits {
+		if c == nil {
+			continue
+		}
+		for _, it := range c.Domains {
+			domains[it.Name] += it.Count
+		}
+		for _, it := range c.BlockedDomains {
+			blocked[it.Name] += it.Count
+		}
+		sum.NTotal += c.NTotal
+		for i := range sum.NResult {
+			sum.NResult[i] += c.NResult[i]
+		}
+		timeSum += uint64(c.TimeAvg) * c.NTotal
+	}
+	d["top_queried_domains"] = convertTopArray(convertMapToArray(domains, maxDomains))
+	d["top_blocked_domains"] = convertTopArray(convertMapToArray(blocked, maxDomains))
+
+	d["num_dns_queries"] = sum.NTotal
+	d["num_blocked_filtering"] = sum.NResult[RFiltered]
+	d["num_replaced_safebrowsing"] = sum.NResult[RSafeBrowsing]
+	d["num_replaced_safesearch"] = sum.NResult[RSafeSearch]
+	d["num_replaced_parental"] = sum.NResult[RParental]
+	d["num_filtered_aaaa"] = sum.NResult[RFilteredAAAA]
+	d["avg_processing_time"] = avgTimeSeconds(timeSum, sum.NTotal) // weighted by the number of requests
+
+	d["time_units"] = "hours"
+	if timeUnit == Days {
+		d["time_units"] = "days"
+	}
+	return d
+}
+
+// Return the statistics of the client: /control/stats/client/{IP}
+func (s *statsCtx) handleStatsClient(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/control/stats/client/")
+	ip := net.ParseIP(id)
+	if ip == nil {
+		httpError(r, w, http.StatusBadRequest, "invalid client IP address: %q", id)
+		return
+	}
+
+	start := time.Now()
+	d := s.getClientData(ip.String())
+	log.Debug("Stats: prepared data for client %s in %v", ip, time.Since(start))
+	if d == nil {
+		httpError(r, w, http.StatusInternalServerError, "Couldn't get statistics data")
+		return
+	}
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
@@ -94,4 +94,6 @@ func (s *statsCtx) initWeb() {
 	s.conf.HTTPRegister("POST", "/control/stats_reset", s.handleStatsReset)
 	s.conf.HTTPRegister("POST", "/control/stats_config", s.handleStatsConfig)
 	s.conf.HTTPRegister("GET", "/control/stats_info", s.handleStatsInfo)
+	s.conf.HTTPRegister("GET", "/control/stats/client/", s.handleStatsClient)
+	s.conf.HTTPRegister("GET", "/control/stats/trends", s.handleStatsTrends)
 }
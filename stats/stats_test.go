@@ -3,7 +3,10 @@ package stats
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"sync/atomic"
 	"testing"
 
@@ -72,8 +75,14 @@ func TestStats(t *testing.T) {
 	assert.True(t, d["num_replaced_safebrowsing"].(uint64) == 0)
 	assert.True(t, d["num_replaced_safesearch"].(uint64) == 0)
 	assert.True(t, d["num_replaced_parental"].(uint64) == 0)
+	assert.True(t, d["num_filtered_aaaa"].(uint64) == 0)
 	assert.True(t, d["avg_processing_time"].(float64) == 0.123456)
 
+	at := d["avg_processing_time_series"].([]float64)
+	assert.Equal(t, 24, len(at))
+	assert.Equal(t, 0.123456, at[23])
+	assert.Equal(t, float64(0), at[22])
+
 	topClients := s.GetTopClientsIP(2)
 	assert.True(t, topClients[0] == "127.0.0.1")
 
@@ -123,6 +132,130 @@ func TestLargeNumbers(t *testing.T) {
 	os.Remove(conf.Filename)
 }
 
+func TestStatsDays(t *testing.T) {
+	var hour int32
+	hour = 100*24 + 5
+	newID := func() uint32 {
+		return uint32(atomic.LoadInt32(&hour))
+	}
+
+	conf := Config{
+		Filename:  "./stats.db",
+		LimitDays: 14,
+		UnitID:    newID,
+	}
+	os.Remove(conf.Filename)
+	s, _ := createObject(conf)
+	assert.Equal(t, uint32(14*24), s.conf.limit)
+
+	e := Entry{}
+	e.Domain = "domain"
+	e.Client = net.ParseIP("127.0.0.1")
+	e.Result = RNotFiltered
+	e.Time = 100000
+	s.Update(e)
+	s.Update(e)
+
+	atomic.AddInt32(&hour, 1)
+	e.Result = RFiltered
+	e.Time = 400000
+	s.Update(e)
+
+	d := s.getData()
+	assert.Equal(t, "days", d["time_units"])
+
+	a := d["dns_queries"].([]uint64)
+	assert.Equal(t, 14, len(a))
+	assert.Equal(t, uint64(3), a[13])
+	assert.Equal(t, uint64(0), a[12])
+
+	a = d["blocked_filtering"].([]uint64)
+	assert.Equal(t, uint64(1), a[13])
+
+	// (2 * 100000 + 400000) / 3
+	at := d["avg_processing_time_series"].([]float64)
+	assert.Equal(t, 14, len(at))
+	assert.Equal(t, 0.2, at[13])
+	assert.Equal(t, float64(0), at[12])
+
+	s.Close()
+	os.Remove(conf.Filename)
+}
+
+func TestFilterHits(t *testing.T) {
+	conf := Config{
+		Filename:  "./stats.db",
+		LimitDays: 1,
+	}
+	os.Remove(conf.Filename)
+	s, _ := createObject(conf)
+
+	e := Entry{}
+	e.Domain = "domain"
+	e.Client = net.ParseIP("127.0.0.1")
+	e.Result = RFiltered
+	e.RuleMatched = true
+	e.FilterID = 1
+	s.Update(e)
+	s.Update(e)
+
+	// whitelist rule from user rules
+	e.Result = RNotFiltered
+	e.FilterID = 0
+	s.Update(e)
+
+	// no rule matched
+	e.RuleMatched = false
+	e.FilterID = 2
+	s.Update(e)
+
+	m := s.GetFilterHits()
+	assert.Equal(t, 2, len(m))
+	assert.Equal(t, uint64(2), m[1])
+	assert.Equal(t, uint64(1), m[0])
+
+	// the counters are stored in database
+	s.Close()
+	s, _ = createObject(conf)
+	m = s.GetFilterHits()
+	assert.Equal(t, uint64(2), m[1])
+	assert.Equal(t, uint64(1), m[0])
+
+	s.clear()
+	assert.Equal(t, 0, len(s.GetFilterHits()))
+	s.Close()
+	os.Remove(conf.Filename)
+}
+
+func TestStatsAAAAFiltered(t *testing.T) {
+	conf := Config{
+		Filename:  "./stats.db",
+		LimitDays: 1,
+	}
+	os.Remove(conf.Filename)
+	s, _ := createObject(conf)
+
+	e := Entry{Domain: "domain", Client: net.ParseIP("127.0.0.1"), Result: RFilteredAAAA}
+	s.Update(e)
+	e.Result = RNotFiltered
+	s.Update(e)
+
+	d := s.getData()
+	assert.Equal(t, uint64(2), d["num_dns_queries"].(uint64))
+	assert.Equal(t, uint64(1), d["num_filtered_aaaa"].(uint64))
+	assert.Equal(t, uint64(0), d["num_blocked_filtering"].(uint64))
+	assert.Equal(t, 0, len(d["top_blocked_domains"].([]map[string]uint64)))
+	s.Close()
+	os.Remove(conf.Filename)
+
+	// a unit written by an older version
+	u := unit{}
+	s.initUnit(&u, 1)
+	deserialize(&u, &unitDB{NResult: []uint64{0, 1, 2}})
+	assert.Equal(t, uint64(2), u.nResult[RFiltered])
+	assert.Equal(t, uint64(0), u.nResult[RFilteredAAAA])
+}
+
 // this code is a chunk copied from getData() that generates aggregate data per day
 func aggregateDataPerDay(firstID uint32) int {
 	firstDayID := (firstID + 24 - 1) / 24 * 24 // align_ceil(24)
@@ -150,3 +283,160 @@ func TestAggregateDataPerTimeUnit(t *testing.T) {
 		assert.True(t, alen == 30, "i=%d", i)
 	}
 }
+
+func TestStatsClient(t *testing.T) {
+	conf := Config{
+		Filename:  "./stats.db",
+		LimitDays: 1,
+	}
+	os.Remove(conf.Filename)
+	s, _ := createObject(conf)
+
+	e := Entry{}
+	e.Client = net.ParseIP("127.0.0.1")
+	e.Domain = "domain1"
+	e.Result = RNotFiltered
+	e.Time = 100000
+	s.Update(e)
+	s.Update(e)
+	e.Domain = "domain2"
+	e.Result = RFiltered
+	e.Time = 400000
+	s.Update(e)
+
+	e.Client = net.ParseIP("127.0.0.2")
+	e.Domain = "domain3"
+	e.Result = RSafeBrowsing
+	s.Update(e)
+
+	// the counters are stored in file
+	u := unit{}
+	s.initUnit(&u, 1)
+	deserialize(&u, serialize(s.unit))
+	assert.Equal(t, 2, len(u.clientUnits))
+	assert.Equal(t, uint64(3), u.clientUnits["127.0.0.1"].nTotal)
+	assert.Equal(t, uint64(600000), u.clientUnits["127.0.0.1"].timeSum)
+	assert.Equal(t, uint64(1), u.clientUnits["127.0.0.2"].nResult[RSafeBrowsing])
+
+	d := s.getClientData("127.0.0.1")
+	assert.Equal(t, "127.0.0.1", d["client"])
+	assert.Equal(t, "hours", d["time_units"])
+	assert.Equal(t, uint64(3), d["num_dns_queries"])
+	assert.Equal(t, uint64(1), d["num_blocked_filtering"])
+	assert.Equal(t, uint64(0), d["num_replaced_safebrowsing"])
+	assert.Equal(t, 0.2, d["avg_processing_time"])
+
+	a := d["dns_queries"].([]uint64)
+	assert.Equal(t, 24, len(a))
+	assert.Equal(t, uint64(3), a[23])
+	assert.Equal(t, uint64(0), a[22])
+	a = d["blocked_filtering"].([]uint64)
+	assert.Equal(t, uint64(1), a[23])
+	at := d["avg_processing_time_series"].([]float64)
+	assert.Equal(t, 0.2, at[23])
+
+	m := d["top_queried_domains"].([]map[string]uint64)
+	assert.Equal(t, 1, len(m))
+	assert.Equal(t, uint64(2), m[0]["domain1"])
+	m = d["top_blocked_domains"].([]map[string]uint64)
+	assert.Equal(t, 1, len(m))
+	assert.Equal(t, uint64(1), m[0]["domain2"])
+
+	// unknown client
+	d = s.getClientData("127.0.0.3")
+	assert.Equal(t, uint64(0), d["num_dns_queries"])
+	assert.Equal(t, 24, len(d["dns_queries"].([]uint64)))
+
+	r := httptest.NewRequest("GET", "/control/stats/client/127.0.0.2", nil)
+	w := httptest.NewRecorder()
+	s.handleStatsClient(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), `"num_replaced_safebrowsing":1`))
+
+	r = httptest.NewRequest("GET", "/control/stats/client/invalid", nil)
+	w = httptest.NewRecorder()
+	s.handleStatsClient(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	s.Close()
+	os.Remove(conf.Filename)
+}
+
+func TestStatsTrends(t *testing.T) {
+	var hour int32
+	hour = 100*24 + 23
+	newID := func() uint32 {
+		return uint32(atomic.LoadInt32(&hour))
+	}
+	conf := Config{
+		Filename:  "./stats.db",
+		LimitDays: 1,
+		UnitID:    newID,
+	}
+	os.Remove(conf.Filename)
+	s, _ := createObject(conf)
+
+	e := Entry{}
+	e.Client = net.ParseIP("127.0.0.1")
+	e.Domain = "example.com"
+	e.Result = RNotFiltered
+	s.Update(e)
+	s.Update(e)
+	e.Domain = "ads.example.com"
+	e.Result = RFiltered
+	s.Update(e)
+	s.Close()
+
+	// the unit flushed on close is added to the daily aggregates after restart
+	atomic.StoreInt32(&hour, 101*24)
+	s, _ = createObject(conf)
+	e.Domain = "example.com"
+	e.Result = RNotFiltered
+	s.Update(e)
+	s.Close()
+
+	atomic.StoreInt32(&hour, 101*24+1)
+	s, _ = createObject(conf)
+	s.Close()
+	// the units are added once
+	s, _ = createObject(conf)
+
+	tr := s.getTrends(trendTimeUnitDays, trendTopDomains)
+	assert.Equal(t, 2, len(tr.Trends))
+	assert.Equal(t, "1970-04-11", tr.Trends[0].Time)
+	assert.Equal(t, uint64(3), tr.Trends[0].NumDNSQueries)
+	assert.Equal(t, uint64(1), tr.Trends[0].NumBlockedFiltering)
+	assert.Equal(t, uint64(2), tr.Trends[0].TopQueriedDomains[0]["example.com"])
+	assert.Equal(t, uint64(1), tr.Trends[0].TopBlockedDomains[0]["ads.example.com"])
+	assert.Equal(t, "1970-04-12", tr.Trends[1].Time)
+	assert.Equal(t, uint64(1), tr.Trends[1].NumDNSQueries)
+
+	tr = s.getTrends(trendTimeUnitMonths, trendTopDomains)
+	assert.Equal(t, 1, len(tr.Trends))
+	assert.Equal(t, "1970-04", tr.Trends[0].Time)
+	assert.Equal(t, uint64(4), tr.Trends[0].NumDNSQueries)
+	assert.Equal(t, uint64(3), tr.Trends[0].TopQueriedDomains[0]["example.com"])
+
+	r := httptest.NewRequest("GET", "/control/stats/trends?time_units=months&top=0", nil)
+	w := httptest.NewRecorder()
+	s.handleStatsTrends(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), `"num_dns_queries":4,`))
+	assert.True(t, strings.Contains(w.Body.String(), `"top_queried_domains":[]`))
+
+	r = httptest.NewRequest("GET", "/control/stats/trends?time_units=hours", nil)
+	w = httptest.NewRecorder()
+	s.handleStatsTrends(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	s.Close()
+
+	// the aggregates are kept after the units are deleted, the stale ones are removed
+	atomic.StoreInt32(&hour, (100+trendMaxDays)*24)
+	s, _ = createObject(conf)
+	tr = s.getTrends(trendTimeUnitDays, trendTopDomains)
+	assert.Equal(t, 1, len(tr.Trends))
+	assert.Equal(t, "1970-04-12", tr.Trends[0].Time)
+
+	s.Close()
+	os.Remove(conf.Filename)
+}
@@ -0,0 +1,318 @@
+// Long-term trends: daily aggregates kept beyond the statistics retention period
+
+package stats
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	bolt "github.com/etcd-io/bbolt"
+)
+
+const (
+	trendMaxDays        = 365 // the daily aggregates are kept for this number of days
+	trendMaxDomains     = 100 // max number of top domains to store for a day
+	trendTopDomains     = 10  // default number of top domains per time unit returned via API
+	trendTimeUnitDays   = "days"
+	trendTimeUnitMonths = "months"
+)
+
+var (
+	trendsBucket  = []byte("trends") // the name isn't 8 bytes long, so it can't be mixed up with a unit
+	trendsLastKey = []byte("last")   // the ID of the last unit that has been added to the daily aggregates
+)
+
+// The daily aggregate stored in file
+// The key is the day ID: absolute day since Jan 1, 1970 (UTC)
+type trendDB struct {
+	NTotal  uint64
+	NResult []uint64
+
+	Domains        []countPair
+	BlockedDomains []countPair
+}
+
+// Add the counters of the unit
+func (td *trendDB) add(udb *unitDB) {
+	td.NTotal += udb.NTotal
+	for len(td.NResult) < int(rLast) {
+		td.NResult = append(td.NResult, 0)
+	}
+	for i := 0; i != len(udb.NResult) && i != len(td.NResult); i++ {
+		td.NResult[i] += udb.NResult[i]
+	}
+	td.Domains = mergeTopArrays(td.Domains, udb.Domains, trendMaxDomains)
+	td.BlockedDomains = mergeTopArrays(td.BlockedDomains, udb.BlockedDomains, trendMaxDomains)
+}
+
+// Sum up the counts of the same names and get the top items
+func mergeTopArrays(a, b []countPair, max int) []countPair {
+	m := convertArrayToMap(a)
+	for _, it := range b {
+		m[it.Name] += it.Count
+	}
+	return convertMapToArray(m, max)
+}
+
+func loadTrend(bkt *bolt.Bucket, day uint32) *trendDB {
+	data := bkt.Get(itob(uint64(day)))
+	if data == nil {
+		return nil
+	}
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	td := trendDB{}
+	err := dec.Decode(&td)
+	if err != nil {
+		log.Error("gob Decode: %s", err)
+		return nil
+	}
+	return &td
+}
+
+// Add the units older than the current unit to the daily aggregates and remove the stale aggregates
+// Each unit is added once.  The unit flushed on Close() is added when the next unit is started (after restart too).
+// The first call adds all units stored in file.
+// Return TRUE if the data has been changed.
+func (s *statsCtx) updateTrends(tx *bolt.Tx, curID uint32) bool {
+	bkt, err := tx.CreateBucketIfNotExists(trendsBucket)
+	if err != nil {
+		log.Error("tx.CreateBucketIfNotExists: %s", err)
+		return false
+	}
+
+	var lastID uint32
+	v := bkt.Get(trendsLastKey)
+	if len(v) == 8 {
+		lastID = uint32(btoi(v))
+	}
+	if lastID+1 >= curID {
+		return false
+	}
+
+	ids := []uint32{}
+	_ = tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if len(name) != 8 {
+			return nil // not a unit
+		}
+		id := uint32(btoi(name))
+		if id > lastID && id < curID {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+
+	days := map[uint32]*trendDB{}
+	for _, id := range ids {
+		udb := s.loadUnitFromDB(tx, id)
+		if udb == nil {
+			continue
+		}
+		day := id / 24
+		td, ok := days[day]
+		if !ok {
+			td = loadTrend(bkt, day)
+			if td == nil {
+				td = &trendDB{}
+			}
+			days[day] = td
+		}
+		td.add(udb)
+	}
+
+	for day, td := range days {
+		var buf bytes.Buffer
+		err = gob.NewEncoder(&buf).Encode(td)
+		if err != nil {
+			log.Error("gob.Encode: %s", err)
+			return false
+		}
+		err = bkt.Put(itob(uint64(day)), buf.Bytes())
+		if err != nil {
+			log.Error("bkt.Put: %s", err)
+			return false
+		}
+	}
+
+	var firstDay uint32
+	if curID/24+1 > trendMaxDays {
+		firstDay = curID/24 + 1 - trendMaxDays
+	}
+	stale := [][]byte{}
+	_ = bkt.ForEach(func(k, _ []byte) error {
+		if len(k) == 8 && uint32(btoi(k)) < firstDay {
+			stale = append(stale, k)
+		}
+		return nil
+	})
+	for _, k := range stale {
+		_ = bkt.Delete(k)
+		log.Debug("Stats: deleted daily aggregate %d", btoi(k))
+	}
+
+	err = bkt.Put(trendsLastKey, itob(uint64(curID-1)))
+	if err != nil {
+		log.Error("bkt.Put: %s", err)
+		return false
+	}
+	log.Debug("Stats: added %d units to %d daily aggregates", len(ids), len(days))
+	return true
+}
+
+type trendJSON struct {
+	Time                    string              `json:"time"` // "2006-01-02" or "2006-01"
+	NumDNSQueries           uint64              `json:"num_dns_queries"`
+	NumBlockedFiltering     uint64              `json:"num_blocked_filtering"`
+	NumReplacedSafebrowsing uint64              `json:"num_replaced_safebrowsing"`
+	NumReplacedSafesearch   uint64              `json:"num_replaced_safesearch"`
+	NumReplacedParental     uint64              `json:"num_replaced_parental"`
+	NumFilteredAAAA         uint64              `json:"num_filtered_aaaa"`
+	TopQueriedDomains       []map[string]uint64 `json:"top_queried_domains"`
+	TopBlockedDomains       []map[string]uint64 `json:"top_blocked_domains"`
+}
+
+type trendsJSON struct {
+	TimeUnits string      `json:"time_units"`
+	Trends    []trendJSON `json:"trends"` // from older to newer
+}
+
+// Get the daily or monthly aggregates
+// There's an item for each time unit from the first to the last stored day.
+func (s *statsCtx) getTrends(timeUnits string, top int) *trendsJSON {
+	tx := s.beginTxn(false)
+	if tx == nil {
+		return nil
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	days := map[uint32]*trendDB{}
+	var first, last uint32
+	bkt := tx.Bucket(trendsBucket)
+	if bkt != nil {
+		_ = bkt.ForEach(func(k, _ []byte) error {
+			if len(k) != 8 {
+				return nil
+			}
+			day := uint32(btoi(k))
+			td := loadTrend(bkt, day)
+			if td == nil {
+				return nil
+			}
+			if len(days) == 0 || day < first {
+				first = day
+			}
+			if day > last {
+				last = day
+			}
+			days[day] = td
+			return nil
+		})
+	}
+
+	resp := &trendsJSON{TimeUnits: timeUnits, Trends: []trendJSON{}}
+	if len(days) == 0 {
+		return resp
+	}
+
+	format := "2006-01-02"
+	if timeUnits == trendTimeUnitMonths {
+		format = "2006-01"
+	}
+	var cur *trendDB
+	var curTime string
+	addItem := func() {
+		if cur != nil {
+			resp.Trends = append(resp.Trends, trendJSONItem(curTime, cur, top))
+		}
+	}
+	for day := first; day <= last; day++ {
+		t := time.Unix(int64(day)*24*60*60, 0).UTC().Format(format)
+		if cur == nil || t != curTime {
+			addItem()
+			cur = &trendDB{}
+			curTime = t
+		}
+		td, ok := days[day]
+		if ok {
+			cur.add(&unitDB{
+				NTotal:         td.NTotal,
+				NResult:        td.NResult,
+				Domains:        td.Domains,
+				BlockedDomains: td.BlockedDomains,
+			})
+		}
+	}
+	addItem()
+	return resp
+}
+
+func trendJSONItem(t string, td *trendDB, top int) trendJSON {
+	for len(td.NResult) < int(rLast) {
+		td.NResult = append(td.NResult, 0)
+	}
+	it := trendJSON{
+		Time:                    t,
+		NumDNSQueries:           td.NTotal,
+		NumBlockedFiltering:     td.NResult[RFiltered],
+		NumReplacedSafebrowsing: td.NResult[RSafeBrowsing],
+		NumReplacedSafesearch:   td.NResult[RSafeSearch],
+		NumReplacedParental:     td.NResult[RParental],
+		NumFilteredAAAA:         td.NResult[RFilteredAAAA],
+	}
+	domains := td.Domains
+	if len(domains) > top {
+		domains = domains[:top]
+	}
+	blocked := td.BlockedDomains
+	if len(blocked) > top {
+		blocked = blocked[:top]
+	}
+	it.TopQueriedDomains = convertTopArray(domains)
+	it.TopBlockedDomains = convertTopArray(blocked)
+	return it
+}
+
+// Return the long-term trends
+// "time_units": "days" (default) or "months";  "top": the number of top domains per time unit (up to 100)
+func (s *statsCtx) handleStatsTrends(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	timeUnits := q.Get("time_units")
+	switch timeUnits {
+	case "":
+		timeUnits = trendTimeUnitDays
+	case trendTimeUnitDays, trendTimeUnitMonths:
+		//
+	default:
+		httpError(r, w, http.StatusBadRequest, "invalid time_units: %s", timeUnits)
+		return
+	}
+	top := trendTopDomains
+	if len(q.Get("top")) != 0 {
+		n, err := strconv.Atoi(q.Get("top"))
+		if err != nil || n < 0 || n > trendMaxDomains {
+			httpError(r, w, http.StatusBadRequest, "invalid top: %s", q.Get("top"))
+			return
+		}
+		top = n
+	}
+
+	start := time.Now()
+	resp := s.getTrends(timeUnits, top)
+	log.Debug("Stats: prepared trends in %v", time.Since(start))
+	if resp == nil {
+		httpError(r, w, http.StatusInternalServerError, "Couldn't get statistics data")
+		return
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
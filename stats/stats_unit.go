@@ -40,6 +40,10 @@ type unit struct {
 	domains        map[string]uint64 // number of requests per domain
 	blockedDomains map[string]uint64 // number of blocked requests per domain
 	clients        map[string]uint64 // number of requests per client
+
+	clientUnits map[string]*clientUnit // the counters of each client
+
+	filters map[int64]uint64 // number of matched rules per filter ID
 }
 
 // name-count pair
@@ -58,6 +62,10 @@ type unitDB struct {
 	Clients        []countPair
 
 	TimeAvg uint32 // usec
+
+	ClientUnits []clientUnitDB // the counters of the top clients
+
+	Filters map[int64]uint64
 }
 
 func createObject(conf Config) (*statsCtx, error) {
@@ -80,10 +88,16 @@ func createObject(conf Config) (*statsCtx, error) {
 	tx := s.beginTxn(true)
 	var udb *unitDB
 	if tx != nil {
+		// the old units are added to the daily aggregates before they are deleted
+		trendsChanged := s.updateTrends(tx, id)
+
 		log.Tracef("Deleting old units...")
 		firstID := id - s.conf.limit - 1
 		unitDel := 0
 		forEachBkt := func(name []byte, b *bolt.Bucket) error {
+			if len(name) != 8 {
+				return nil // not a unit
+			}
 			id := uint32(btoi(name))
 			if id < firstID {
 				err := tx.DeleteBucket(name)
@@ -100,7 +114,7 @@ func createObject(conf Config) (*statsCtx, error) {
 
 		udb = s.loadUnitFromDB(tx, id)
 
-		if unitDel != 0 {
+		if unitDel != 0 || trendsChanged {
 			s.commitTxn(tx)
 		} else {
 			_ = tx.Rollback()
@@ -123,8 +137,9 @@ func (s *statsCtx) Start() {
 	go s.periodicFlush()
 }
 
+// Return TRUE if the time interval (in days) is supported: from 1 to 90 days
 func checkInterval(days uint32) bool {
-	return days == 1 || days == 7 || days == 30 || days == 90
+	return days >= 1 && days <= 90
 }
 
 func (s *statsCtx) dbOpen() bool {
@@ -164,6 +179,8 @@ func (s *statsCtx) initUnit(u *unit, id uint32) {
 	u.domains = make(map[string]uint64)
 	u.blockedDomains = make(map[string]uint64)
 	u.clients = make(map[string]uint64)
+	u.clientUnits = make(map[string]*clientUnit)
+	u.filters = make(map[int64]uint64)
 }
 
 // Open a DB transaction
@@ -215,6 +232,7 @@ func btoi(b []byte) uint64 {
 // . atomically set a new empty unit as the current one and get the old unit
 //   This is important to do it inside DB lock, so the reader won't get inconsistent results.
 // . write the unit to DB
+// . add the finished units to the daily aggregates (long-term trends)
 // . remove the stale unit from DB
 // . unlock DB
 func (s *statsCtx) periodicFlush() {
@@ -243,8 +261,9 @@ func (s *statsCtx) periodicFlush() {
 			continue
 		}
 		ok1 := s.flushUnitToDB(tx, u.id, udb)
-		ok2 := s.deleteUnit(tx, id-s.conf.limit)
-		if ok1 || ok2 {
+		ok2 := s.updateTrends(tx, id)
+		ok3 := s.deleteUnit(tx, id-s.conf.limit)
+		if ok1 || ok2 || ok3 {
 			s.commitTxn(tx)
 		} else {
 			_ = tx.Rollback()
@@ -305,6 +324,11 @@ func serialize(u *unit) *unitDB {
 	udb.Domains = convertMapToArray(u.domains, maxDomains)
 	udb.BlockedDomains = convertMapToArray(u.blockedDomains, maxDomains)
 	udb.Clients = convertMapToArray(u.clients, maxClients)
+	udb.ClientUnits = serializeClients(u.clientUnits)
+	udb.Filters = make(map[int64]uint64, len(u.filters))
+	for id, n := range u.filters {
+		udb.Filters[id] = n
+	}
 	return &udb
 }
 
@@ -312,7 +336,7 @@ func deserialize(u *unit, udb *unitDB) {
 	u.nTotal = udb.NTotal
 
 	n := len(udb.NResult)
-	if n < len(u.nResult) {
+	if n > len(u.nResult) {
 		n = len(u.nResult) // n = min(len(udb.NResult), len(u.nResult))
 	}
 	for i := 1; i < n; i++ {
@@ -322,7 +346,11 @@ func deserialize(u *unit, udb *unitDB) {
 	u.domains = convertArrayToMap(udb.Domains)
 	u.blockedDomains = convertArrayToMap(udb.BlockedDomains)
 	u.clients = convertArrayToMap(udb.Clients)
+	u.clientUnits = deserializeClients(udb.ClientUnits)
 	u.timeSum = uint64(udb.TimeAvg) * u.nTotal
+	for id, n := range udb.Filters {
+		u.filters[id] = n
+	}
 }
 
 func (s *statsCtx) flushUnitToDB(tx *bolt.Tx, id uint32, udb *unitDB) bool {
@@ -368,6 +396,10 @@ func (s *statsCtx) loadUnitFromDB(tx *bolt.Tx, id uint32) *unitDB {
 		log.Error("gob Decode: %s", err)
 		return nil
 	}
+	// the units written by an older version have less counters
+	for len(udb.NResult) < int(rLast) {
+		udb.NResult = append(udb.NResult, 0)
+	}
 
 	return &udb
 }
@@ -456,13 +488,17 @@ func (s *statsCtx) Update(e Entry) {
 
 	u.nResult[e.Result]++
 
-	if e.Result == RNotFiltered {
+	if e.Result == RNotFiltered || e.Result == RFilteredAAAA {
 		u.domains[e.Domain]++
 	} else {
 		u.blockedDomains[e.Domain]++
 	}
 
 	u.clients[client]++
+	u.updateClient(client, e)
+	if e.RuleMatched {
+		u.filters[e.FilterID]++
+	}
 	u.timeSum += uint64(e.Time)
 	u.nTotal++
 	s.unitLock.Unlock()
@@ -512,6 +548,7 @@ func (s *statsCtx) loadUnits(limit uint32) ([]*unitDB, uint32) {
   * blocked/time-unit
   * safebrowsing-blocked/time-unit
   * parental-blocked/time-unit
+  * average processing time/time-unit
   If time-unit is an hour, just add values from each unit to an array.
   If time-unit is a day, aggregate per-hour data into days.
  * top counters:
@@ -647,6 +684,33 @@ func (s *statsCtx) getData() map[string]interface{} {
 	}
 	d["replaced_parental"] = a
 
+	// average processing time (in seconds) per time unit is weighted by the number of requests
+	at := []float64{}
+	if timeUnit == Hours {
+		for _, u := range units {
+			at = append(at, float64(u.TimeAvg)/1000000)
+		}
+	} else {
+		var timeSum, n uint64
+		id := firstDayID
+		nextDayID := firstDayID + 24
+		for i := firstDayID - firstID; int(i) != len(units); i++ {
+			timeSum += uint64(units[i].TimeAvg) * units[i].NTotal
+			n += units[i].NTotal
+			if id == nextDayID {
+				at = append(at, avgTimeSeconds(timeSum, n))
+				timeSum = 0
+				n = 0
+				nextDayID += 24
+			}
+			id++
+		}
+		if id <= nextDayID {
+			at = append(at, avgTimeSeconds(timeSum, n))
+		}
+	}
+	d["avg_processing_time_series"] = at
+
 	// top counters:
 
 	m := map[string]uint64{}
@@ -691,6 +755,7 @@ func (s *statsCtx) getData() map[string]interface{} {
 		sum.NResult[RSafeBrowsing] += u.NResult[RSafeBrowsing]
 		sum.NResult[RSafeSearch] += u.NResult[RSafeSearch]
 		sum.NResult[RParental] += u.NResult[RParental]
+		sum.NResult[RFilteredAAAA] += u.NResult[RFilteredAAAA]
 	}
 
 	d["num_dns_queries"] = sum.NTotal
@@ -698,6 +763,7 @@ func (s *statsCtx) getData() map[string]interface{} {
 	d["num_replaced_safebrowsing"] = sum.NResult[RSafeBrowsing]
 	d["num_replaced_safesearch"] = sum.NResult[RSafeSearch]
 	d["num_replaced_parental"] = sum.NResult[RParental]
+	d["num_filtered_aaaa"] = sum.NResult[RFilteredAAAA]
 
 	avgTime := float64(0)
 	if timeN != 0 {
@@ -713,6 +779,14 @@ func (s *statsCtx) getData() map[string]interface{} {
 	return d
 }
 
+// Get the average time in seconds from the sum of processing times (in usec)
+func avgTimeSeconds(timeSum, n uint64) float64 {
+	if n == 0 {
+		return 0
+	}
+	return float64(timeSum/n) / 1000000
+}
+
 func (s *statsCtx) GetTopClientsIP(maxCount uint) []string {
 	units, _ := s.loadUnits(s.conf.limit)
 	if units == nil {
@@ -733,3 +807,18 @@ func (s *statsCtx) GetTopClientsIP(maxCount uint) []string {
 	}
 	return d
 }
+
+func (s *statsCtx) GetFilterHits() map[int64]uint64 {
+	units, _ := s.loadUnits(s.conf.limit)
+	if units == nil {
+		return nil
+	}
+
+	m := map[int64]uint64{}
+	for _, u := range units {
+		for id, n := range u.Filters {
+			m[id] += n
+		}
+	}
+	return m
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// CAP_NET_BIND_SERVICE bit number (linux/capability.h)
+const capNetBindService = 10
+
+// HaveNetBindCapability - check if the process may bind the privileged ports (CAP_NET_BIND_SERVICE)
+// e.g. when it's run by systemd as an unprivileged user with AmbientCapabilities
+func HaveNetBindCapability() bool {
+	data, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, ln := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(ln, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(ln[len("CapEff:"):]), 16, 64)
+		if err != nil {
+			return false
+		}
+		return caps&(1<<capNetBindService) != 0
+	}
+	return false
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package util
+
+// HaveNetBindCapability - check if the process may bind the privileged ports (CAP_NET_BIND_SERVICE)
+// The capabilities are supported only on Linux.
+func HaveNetBindCapability() bool {
+	return false
+}
@@ -0,0 +1,11 @@
+// +build !linux,!darwin,!freebsd,!windows
+
+package util
+
+import "fmt"
+
+// DiskUsage - get the available and the total space (in bytes) of the file system that contains the path
+// It's not supported on this OS.
+func DiskUsage(path string) (uint64, uint64, error) {
+	return 0, 0, fmt.Errorf("not supported")
+}
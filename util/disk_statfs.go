@@ -0,0 +1,15 @@
+// +build linux darwin freebsd
+
+package util
+
+import "syscall"
+
+// DiskUsage - get the available and the total space (in bytes) of the file system that contains the path
+func DiskUsage(path string) (uint64, uint64, error) {
+	st := syscall.Statfs_t{}
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
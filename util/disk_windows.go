@@ -0,0 +1,17 @@
+package util
+
+import "golang.org/x/sys/windows"
+
+// DiskUsage - get the available and the total space (in bytes) of the disk that contains the path
+func DiskUsage(path string) (uint64, uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var avail, total, free uint64
+	err = windows.GetDiskFreeSpaceEx(p, &avail, &total, &free)
+	if err != nil {
+		return 0, 0, err
+	}
+	return avail, total, nil
+}
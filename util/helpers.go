@@ -1,7 +1,11 @@
 package util
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
@@ -33,6 +37,48 @@ func RunCommand(command string, arguments ...string) (int, string, error) {
 	return cmd.ProcessState.ExitCode(), string(out), nil
 }
 
+// IsGzip returns TRUE if data starts with gzip header
+func IsGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// Gunzip decompresses gzip data
+// maxSize: maximum size of the decompressed data.  0: no limit
+func Gunzip(data []byte, maxSize int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if maxSize == 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	d, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(d)) > maxSize {
+		return nil, fmt.Errorf("decompressed data is larger than %d bytes", maxSize)
+	}
+	return d, nil
+}
+
+// Gzip compresses data
+func Gzip(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // ---------------------
 // debug logging helpers
 // ---------------------
@@ -12,3 +12,40 @@ func TestSplitNext(t *testing.T) {
 	assert.True(t, SplitNext(&s, ',') == "b")
 	assert.True(t, SplitNext(&s, ',') == "c" && len(s) == 0)
 }
+
+func TestGzip(t *testing.T) {
+	data := []byte("||example.org^\n")
+	assert.False(t, IsGzip(data))
+
+	gz, err := Gzip(data)
+	assert.Nil(t, err)
+	assert.True(t, IsGzip(gz))
+
+	d, err := Gunzip(gz, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, data, d)
+
+	d, err = Gunzip(gz, int64(len(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, data, d)
+
+	_, err = Gunzip(gz, int64(len(data)-1))
+	assert.NotNil(t, err)
+
+	_, err = Gunzip(data, 0)
+	assert.NotNil(t, err)
+}
+
+func TestPunycode(t *testing.T) {
+	assert.Equal(t, "example.org", ToPunycode("example.org"))
+	assert.Equal(t, "xn--e1afmkfd.xn--p1ai", ToPunycode("пример.рф"))
+	assert.Equal(t, "xn--e1afmkfd.xn--p1ai", ToPunycode("ПРИМЕР.РФ"))
+	assert.Equal(t, "*.xn--e1afmkfd.xn--p1ai", ToPunycode("*.пример.рф"))
+	assert.Equal(t, "_dns.xn--bcher-kva.de", ToPunycode("_dns.bücher.de"))
+
+	assert.Equal(t, "пример.рф", ToUnicode("xn--e1afmkfd.xn--p1ai"))
+	assert.Equal(t, "пример.рф", ToUnicode("XN--E1AFMKFD.xn--p1ai"))
+	assert.Equal(t, "example.org", ToUnicode("example.org"))
+	assert.True(t, IsASCII("example.org"))
+	assert.False(t, IsASCII("bücher.de"))
+}
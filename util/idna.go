@@ -0,0 +1,52 @@
+package util
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// The profile for conversion of the domain names written by users:
+// it maps the characters to lower case and NFC form, "*" and "_" are allowed
+// Note: the deviation characters are mapped as in IDNA2003 ("ß" -> "ss").
+var idnaProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false))
+
+// IsASCII returns TRUE if the string contains only ASCII characters
+func IsASCII(s string) bool {
+	for i := 0; i != len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// ToPunycode converts an internationalized domain name to ASCII form: "пример.рф" -> "xn--e1afmkfd.xn--p1ai"
+// ASCII names are returned as is.  The labels that can't be mapped are just lowercased and encoded.
+func ToPunycode(host string) string {
+	if IsASCII(host) {
+		return host
+	}
+	a, err := idnaProfile.ToASCII(host)
+	if err == nil {
+		return a
+	}
+	a, err = idna.Punycode.ToASCII(strings.ToLower(host))
+	if err != nil {
+		return strings.ToLower(host)
+	}
+	return a
+}
+
+// ToUnicode converts the punycode labels of a domain name to Unicode: "xn--e1afmkfd.xn--p1ai" -> "пример.рф"
+// The names which can't be decoded are returned as is.
+func ToUnicode(host string) string {
+	if !strings.Contains(strings.ToLower(host), "xn--") {
+		return host
+	}
+	u, err := idna.Punycode.ToUnicode(strings.ToLower(host))
+	if err != nil {
+		return host
+	}
+	return u
+}
@@ -0,0 +1,131 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The time in the names of the rotated log files
+const logFileTimeFormat = "20060102-150405"
+
+// LogFile - the log file which is rotated when its size exceeds the limit
+// The rotated files are named <path>.<YYYYMMDD-HHMMSS>.
+type LogFile struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64         // 0: the file isn't rotated
+	maxAge  time.Duration // the rotated files older than maxAge are removed;  0: they are kept
+	f       *os.File
+	size    int64
+}
+
+// OpenLogFile opens the log file for appending
+func OpenLogFile(path string, maxSize int64, maxAge time.Duration) (*LogFile, error) {
+	l := &LogFile{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	l.removeOld()
+	return l, nil
+}
+
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.f = f
+	l.size = st.Size()
+	return nil
+}
+
+// Write writes the data to file;  the file is rotated before if the data doesn't fit into it
+func (l *LogFile) Write(b []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.maxSize != 0 && l.size != 0 && l.size+int64(len(b)) > l.maxSize {
+		err := l.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if l.f == nil {
+		return 0, fmt.Errorf("log file %s isn't opened", l.path)
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return n, err
+}
+
+// Close closes the file
+func (l *LogFile) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// Rename the current file and open a new one
+func (l *LogFile) rotate() error {
+	_ = l.f.Close()
+	l.f = nil
+
+	now := time.Now().Format(logFileTimeFormat)
+	name := l.path + "." + now
+	for i := 1; FileExists(name); i++ {
+		name = fmt.Sprintf("%s.%s-%d", l.path, now, i)
+	}
+	err := os.Rename(l.path, name)
+	if err != nil {
+		// keep writing to the current file
+		_ = l.open()
+		return nil
+	}
+
+	err = l.open()
+	if err != nil {
+		return err
+	}
+	l.removeOld()
+	return nil
+}
+
+// Remove the rotated files older than maxAge
+func (l *LogFile) removeOld() {
+	if l.maxAge == 0 {
+		return
+	}
+	files, _ := filepath.Glob(l.path + ".*")
+	for _, fn := range files {
+		suffix := strings.TrimPrefix(fn, l.path+".")
+		if len(suffix) < len(logFileTimeFormat) {
+			continue
+		}
+		if _, err := time.Parse(logFileTimeFormat, suffix[:len(logFileTimeFormat)]); err != nil {
+			continue // not a rotated file
+		}
+		st, err := os.Stat(fn)
+		if err == nil && time.Since(st.ModTime()) > l.maxAge {
+			_ = os.Remove(fn)
+		}
+	}
+}
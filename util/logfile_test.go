@@ -0,0 +1,45 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-log")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "AdGuardHome.log")
+
+	// the old rotated file is removed, the other files are kept
+	old := fn + ".20200101-000000"
+	other := fn + ".backup"
+	_ = ioutil.WriteFile(old, []byte("old\n"), 0644)
+	_ = ioutil.WriteFile(other, []byte("other\n"), 0644)
+	tm := time.Now().Add(-48 * time.Hour)
+	_ = os.Chtimes(old, tm, tm)
+	_ = os.Chtimes(other, tm, tm)
+
+	l, err := OpenLogFile(fn, 10, 24*time.Hour)
+	assert.Nil(t, err)
+	assert.False(t, FileExists(old))
+	assert.True(t, FileExists(other))
+
+	_, err = l.Write([]byte("line 1\n"))
+	assert.Nil(t, err)
+	_, err = l.Write([]byte("line 2\n"))
+	assert.Nil(t, err)
+	_, err = l.Write([]byte("line 3\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, l.Close())
+
+	data, _ := ioutil.ReadFile(fn)
+	assert.Equal(t, "line 3\n", string(data))
+	files, _ := filepath.Glob(fn + ".2*")
+	assert.Equal(t, 2, len(files))
+}
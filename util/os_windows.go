@@ -1,6 +1,10 @@
 package util
 
-import "golang.org/x/sys/windows"
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
 
 // Set user-specified limit of how many fd's we can use
 func SetRlimit(val uint) {
@@ -26,3 +30,8 @@ func HaveAdminRights() (bool, error) {
 	}
 	return true, nil
 }
+
+// SetUser - change the user and the group of the process
+func SetUser(userName, groupName string) error {
+	return fmt.Errorf("changing user is not supported on Windows")
+}
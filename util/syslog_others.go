@@ -3,16 +3,22 @@
 package util
 
 import (
+	"io"
 	"log"
 	"log/syslog"
 )
 
 // ConfigureSyslog reroutes standard logger output to syslog
 func ConfigureSyslog(serviceName string) error {
-	w, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_USER, serviceName)
+	w, err := NewSyslogWriter(serviceName)
 	if err != nil {
 		return err
 	}
 	log.SetOutput(w)
 	return nil
 }
+
+// NewSyslogWriter returns the writer which sends log messages to syslog
+func NewSyslogWriter(serviceName string) (io.Writer, error) {
+	return syslog.New(syslog.LOG_NOTICE|syslog.LOG_USER, serviceName)
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"io"
 	"log"
 	"strings"
 
@@ -18,6 +19,16 @@ func (w *eventLogWriter) Write(b []byte) (int, error) {
 }
 
 func ConfigureSyslog(serviceName string) error {
+	w, err := NewSyslogWriter(serviceName)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(w)
+	return nil
+}
+
+// NewSyslogWriter returns the writer which sends log messages to the Event Log
+func NewSyslogWriter(serviceName string) (io.Writer, error) {
 	// Note that the eventlog src is the same as the service name
 	// Otherwise, we will get "the description for event id cannot be found" warning in every log record
 
@@ -26,14 +37,12 @@ func ConfigureSyslog(serviceName string) error {
 	// for pre-existing eventlog sources.
 	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Info|eventlog.Warning|eventlog.Error); err != nil {
 		if !strings.Contains(err.Error(), "registry key already exists") && err != windows.ERROR_ACCESS_DENIED {
-			return err
+			return nil, err
 		}
 	}
 	el, err := eventlog.Open(serviceName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	log.SetOutput(&eventLogWriter{el: el})
-	return nil
+	return &eventLogWriter{el: el}, nil
 }
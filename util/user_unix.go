@@ -0,0 +1,58 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// SetUser - change the user and the group of the process
+// groupName: if empty, the primary group of the user is used
+// The privileges can't be restored after that.
+func SetUser(userName, groupName string) error {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s: invalid uid: %s", userName, u.Uid)
+	}
+
+	gidStr := u.Gid
+	if len(groupName) != 0 {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return fmt.Errorf("group %s: invalid gid: %s", groupName, gidStr)
+	}
+
+	if os.Getuid() == uid && os.Getgid() == gid {
+		// e.g. the service is already run as this user
+		return nil
+	}
+
+	// the group must be changed first: the process can't do it after the user is changed
+	err = syscall.Setgroups([]int{gid})
+	if err != nil {
+		return fmt.Errorf("setgroups: %s", err)
+	}
+	err = syscall.Setgid(gid)
+	if err != nil {
+		return fmt.Errorf("setgid: %s", err)
+	}
+	err = syscall.Setuid(uid)
+	if err != nil {
+		return fmt.Errorf("setuid: %s", err)
+	}
+	return nil
+}